@@ -16,11 +16,14 @@ package api
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"runtime"
@@ -36,8 +39,101 @@ import (
 // Client encapsulates client state for interacting with the ollama
 // service. Use [ClientFromEnvironment] to create new Clients.
 type Client struct {
-	base *url.URL
-	http *http.Client
+	base  *url.URL
+	http  *http.Client
+	retry RetryPolicy
+}
+
+// RetryPolicy configures how a [Client] retries requests that fail. Any
+// request that couldn't connect to the server is retried, since none of it
+// was sent. Requests that only read, such as showing or embedding, are also
+// retried after a server error or a dropped connection. Generating a
+// response is only retried after a 503, such as while the server's queue is
+// full, which it sends before it starts to generate; other requests that
+// change the server's state, such as copying a model, aren't retried once
+// sent. Streamed requests are retried only until the server starts
+// responding; an error part way through a stream is returned as is.
+type RetryPolicy struct {
+	// MaxAttempts is the most times a request is sent, including the first.
+	// Values less than 2 disable retries.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. It doubles for each
+	// later retry.
+	Backoff time.Duration
+
+	// MaxBackoff caps the delay between retries. Zero means no cap.
+	MaxBackoff time.Duration
+}
+
+// delay returns how long to wait after the given failed attempt, counting
+// from 1.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for range attempt - 1 {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+		d *= 2
+	}
+
+	if p.MaxBackoff > 0 {
+		d = min(d, p.MaxBackoff)
+	}
+	return d
+}
+
+// readOnlyPaths are the POST endpoints that don't change the server's
+// state, so they can be sent again after any failure.
+var readOnlyPaths = map[string]bool{
+	"/api/show":             true,
+	"/api/manifest":         true,
+	"/api/embed":            true,
+	"/api/embeddings":       true,
+	"/api/similarity":       true,
+	"/api/tokenize":         true,
+	"/api/detokenize":       true,
+	"/api/tokenize/compare": true,
+}
+
+// generatePaths are the POST endpoints that generate responses. They're only
+// sent again after a 503, which is sent before generating.
+var generatePaths = map[string]bool{
+	"/api/generate":       true,
+	"/api/generate/batch": true,
+	"/api/chat":           true,
+}
+
+func readOnly(method, path string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		return readOnlyPaths[path]
+	default:
+		return false
+	}
+}
+
+// retryable reports whether a request that failed with err, or got response
+// if err is nil, can be sent again
+func retryable(method, path string, response *http.Response, err error) bool {
+	if opErr := (*net.OpError)(nil); errors.As(err, &opErr) && opErr.Op == "dial" {
+		// nothing was sent to the server
+		return true
+	}
+
+	switch {
+	case err != nil:
+		// the server dropped the connection, perhaps after handling it
+		return readOnly(method, path)
+	case response.StatusCode == http.StatusServiceUnavailable:
+		return readOnly(method, path) || method == http.MethodPost && generatePaths[path]
+	case response.StatusCode >= http.StatusInternalServerError && response.StatusCode != http.StatusNotImplemented:
+		return readOnly(method, path)
+	default:
+		return false
+	}
 }
 
 func checkError(resp *http.Response, body []byte) error {
@@ -79,6 +175,12 @@ func NewClient(base *url.URL, http *http.Client) *Client {
 	}
 }
 
+// SetRetryPolicy sets how the client retries failed requests. By default
+// requests are sent once. It should be called before the client is used.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retry = p
+}
+
 func getAuthorizationToken(ctx context.Context, challenge string) (string, error) {
 	token, err := auth.Sign(ctx, []byte(challenge))
 	if err != nil {
@@ -87,35 +189,17 @@ func getAuthorizationToken(ctx context.Context, challenge string) (string, error
 	return token, nil
 }
 
-func (c *Client) do(ctx context.Context, method, path string, reqData, respData any) error {
-	var reqBody io.Reader
-	var data []byte
-	var err error
-
-	switch reqData := reqData.(type) {
-	case io.Reader:
-		// reqData is already an io.Reader
-		reqBody = reqData
-	case nil:
-		// noop
-	default:
-		data, err = json.Marshal(reqData)
-		if err != nil {
-			return err
-		}
-
-		reqBody = bytes.NewReader(data)
-	}
-
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader, accept string) (*http.Request, error) {
 	requestURL := c.base.JoinPath(path)
 
 	var token string
 	if envconfig.UseAuth() || c.base.Hostname() == "ollama.com" {
+		var err error
 		now := strconv.FormatInt(time.Now().Unix(), 10)
 		chal := fmt.Sprintf("%s,%s?ts=%s", method, path, now)
 		token, err = getAuthorizationToken(ctx, chal)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		q := requestURL.Query()
@@ -123,20 +207,139 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 		requestURL.RawQuery = q.Encode()
 	}
 
-	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), reqBody)
+	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Accept", accept)
+	request.Header.Set("Accept-Encoding", "gzip, deflate")
 	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
 
 	if token != "" {
 		request.Header.Set("Authorization", token)
 	}
 
-	respObj, err := c.http.Do(request)
+	return request, nil
+}
+
+// send sends a request, retrying it as the client's retry policy allows.
+// Only requests without a body or with an in-memory body, which can be
+// rewound, are sent again.
+func (c *Client) send(ctx context.Context, method, path string, body io.Reader, accept string) (*http.Response, error) {
+	attempts := 1
+	reader, rewindable := body.(*bytes.Reader)
+	if body == nil || rewindable {
+		attempts = max(c.retry.MaxAttempts, 1)
+	}
+
+	for attempt := 1; ; attempt++ {
+		if rewindable && attempt > 1 {
+			if _, err := reader.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+
+		request, err := c.newRequest(ctx, method, path, body, accept)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := c.http.Do(request)
+		if attempt == attempts || ctx.Err() != nil {
+			if err != nil {
+				return nil, err
+			}
+			return decompress(response)
+		}
+
+		if !retryable(method, path, response, err) {
+			if err != nil {
+				return nil, err
+			}
+			return decompress(response)
+		}
+
+		if err == nil {
+			// discard the error so the connection can be reused
+			_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, maxBufferSize))
+			response.Body.Close()
+		}
+
+		t := time.NewTimer(c.retry.delay(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// decompressedBody reads the decompressed body of a response and closes
+// both it and the compressed body.
+type decompressedBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (b decompressedBody) Close() error {
+	return errors.Join(b.ReadCloser.Close(), b.body.Close())
+}
+
+// decompress replaces the body of a response compressed by the server with
+// its decompressed content. Since the client sets Accept-Encoding itself,
+// the transport leaves this to it.
+func decompress(response *http.Response) (*http.Response, error) {
+	if response.ContentLength == 0 || response.Request.Method == http.MethodHead {
+		return response, nil
+	}
+
+	var r io.ReadCloser
+	var err error
+	switch response.Header.Get("Content-Encoding") {
+	case "gzip":
+		r, err = gzip.NewReader(response.Body)
+	case "deflate":
+		r, err = zlib.NewReader(response.Body)
+	default:
+		return response, nil
+	}
+
+	if err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+
+	response.Body = decompressedBody{ReadCloser: r, body: response.Body}
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+	response.ContentLength = -1
+	return response, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, reqData, respData any) error {
+	var reqBody io.Reader
+	var data []byte
+	var err error
+
+	switch reqData := reqData.(type) {
+	case io.Reader:
+		// reqData is already an io.Reader
+		reqBody = reqData
+	case nil:
+		// noop
+	default:
+		data, err = json.Marshal(reqData)
+		if err != nil {
+			return err
+		}
+
+		reqBody = bytes.NewReader(data)
+	}
+
+	respObj, err := c.send(ctx, method, path, reqBody, "application/json")
 	if err != nil {
 		return err
 	}
@@ -169,40 +372,10 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 			return err
 		}
 
-		buf = bytes.NewBuffer(bts)
-	}
-
-	requestURL := c.base.JoinPath(path)
-
-	var token string
-	if envconfig.UseAuth() || c.base.Hostname() == "ollama.com" {
-		var err error
-		now := strconv.FormatInt(time.Now().Unix(), 10)
-		chal := fmt.Sprintf("%s,%s?ts=%s", method, path, now)
-		token, err = getAuthorizationToken(ctx, chal)
-		if err != nil {
-			return err
-		}
-
-		q := requestURL.Query()
-		q.Set("ts", now)
-		requestURL.RawQuery = q.Encode()
+		buf = bytes.NewReader(bts)
 	}
 
-	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), buf)
-	if err != nil {
-		return err
-	}
-
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Accept", "application/x-ndjson")
-	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
-
-	if token != "" {
-		request.Header.Set("Authorization", token)
-	}
-
-	response, err := c.http.Do(request)
+	response, err := c.send(ctx, method, path, buf, "application/x-ndjson")
 	if err != nil {
 		return err
 	}
@@ -215,6 +388,7 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	for scanner.Scan() {
 		var errorResponse struct {
 			Error string `json:"error,omitempty"`
+			Code  string `json:"code,omitempty"`
 		}
 
 		bts := scanner.Bytes()
@@ -223,7 +397,12 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 		}
 
 		if errorResponse.Error != "" {
-			return errors.New(errorResponse.Error)
+			// without the status, the error reads as the message alone
+			return StatusError{
+				StatusCode:   response.StatusCode,
+				ErrorMessage: errorResponse.Error,
+				Code:         errorResponse.Code,
+			}
 		}
 
 		if response.StatusCode >= http.StatusBadRequest {
@@ -231,6 +410,7 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 				StatusCode:   response.StatusCode,
 				Status:       response.Status,
 				ErrorMessage: errorResponse.Error,
+				Code:         errorResponse.Code,
 			}
 		}
 
@@ -261,6 +441,26 @@ func (c *Client) Generate(ctx context.Context, req *GenerateRequest, fn Generate
 	})
 }
 
+// BatchGenerateResponseFunc is a function that [Client.GenerateBatch] invokes
+// every time a response is received from the service. If this function
+// returns an error, [Client.GenerateBatch] will stop generating and return
+// this error.
+type BatchGenerateResponseFunc func(BatchGenerateResponse) error
+
+// GenerateBatch generates responses to many prompts with one model. fn is
+// called with each prompt's response as it finishes if streaming is enabled,
+// or else once with every response.
+func (c *Client) GenerateBatch(ctx context.Context, req *BatchGenerateRequest, fn BatchGenerateResponseFunc) error {
+	return c.stream(ctx, http.MethodPost, "/api/generate/batch", req, func(bts []byte) error {
+		var resp BatchGenerateResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return err
+		}
+
+		return fn(resp)
+	})
+}
+
 // ChatResponseFunc is a function that [Client.Chat] invokes every time
 // a response is received from the service. If this function returns an error,
 // [Client.Chat] will stop generating and return this error.
@@ -358,14 +558,35 @@ func (c *Client) ListRunning(ctx context.Context) (*ProcessResponse, error) {
 }
 
 // Copy copies a model - creating a model with another name from an existing
-// model.
+// model. If req.Quantize is set, Copy waits for the quantization to finish.
 func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
+	if req.Quantize != "" {
+		return c.stream(ctx, http.MethodPost, "/api/copy", req, func([]byte) error { return nil })
+	}
+
 	if err := c.do(ctx, http.MethodPost, "/api/copy", req, nil); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Alias creates an alias for a model, or points an existing alias at a
+// different model. The alias shares the model's data, so no data is copied.
+func (c *Client) Alias(ctx context.Context, req *AliasRequest) error {
+	if err := c.do(ctx, http.MethodPost, "/api/alias", req, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteAlias deletes an alias, leaving the model it resolves to.
+func (c *Client) DeleteAlias(ctx context.Context, req *DeleteAliasRequest) error {
+	if err := c.do(ctx, http.MethodDelete, "/api/alias", req, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Delete deletes a model and its data.
 func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
 	if err := c.do(ctx, http.MethodDelete, "/api/delete", req, nil); err != nil {
@@ -374,6 +595,25 @@ func (c *Client) Delete(ctx context.Context, req *DeleteRequest) error {
 	return nil
 }
 
+// Unload evicts a model from memory, returning once its memory has been
+// released. It fails if the model is not loaded.
+func (c *Client) Unload(ctx context.Context, req *UnloadRequest) error {
+	if err := c.do(ctx, http.MethodDelete, "/api/unload", req, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Cancel stops a streamed generate or chat request that is in progress,
+// identified by the RequestID of its first response. It fails if the request
+// has already finished.
+func (c *Client) Cancel(ctx context.Context, req *CancelRequest) error {
+	if err := c.do(ctx, http.MethodPost, "/api/cancel", req, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Show obtains model information, including details, modelfile, license etc.
 func (c *Client) Show(ctx context.Context, req *ShowRequest) (*ShowResponse, error) {
 	var resp ShowResponse
@@ -383,6 +623,17 @@ func (c *Client) Show(ctx context.Context, req *ShowRequest) (*ShowResponse, err
 	return &resp, nil
 }
 
+// Manifest fetches the manifest of a model from its registry without
+// downloading the model. The response lists the model's layers and which of
+// them are already present locally.
+func (c *Client) Manifest(ctx context.Context, req *ManifestRequest) (*ManifestResponse, error) {
+	var resp ManifestResponse
+	if err := c.do(ctx, http.MethodPost, "/api/manifest", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Heartbeat checks if the server has started and is responsive; if yes, it
 // returns nil, otherwise an error.
 func (c *Client) Heartbeat(ctx context.Context) error {
@@ -401,6 +652,64 @@ func (c *Client) Embed(ctx context.Context, req *EmbedRequest) (*EmbedResponse,
 	return &resp, nil
 }
 
+// Options updates the default options of a model without recreating it, and
+// returns them. With no options in req, it only returns them.
+func (c *Client) Options(ctx context.Context, req *OptionsRequest) (*OptionsResponse, error) {
+	var resp OptionsResponse
+	if err := c.do(ctx, http.MethodPost, "/api/options", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Similarity ranks candidate texts by the cosine similarity of their
+// embeddings to the embedding of a query.
+func (c *Client) Similarity(ctx context.Context, req *SimilarityRequest) (*SimilarityResponse, error) {
+	var resp SimilarityResponse
+	if err := c.do(ctx, http.MethodPost, "/api/similarity", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SaveSession saves the KV cache of a previous generate request so that later
+// requests can continue from it, even after the model is reloaded.
+func (c *Client) SaveSession(ctx context.Context, req *SessionSaveRequest) (*SessionSaveResponse, error) {
+	var resp SessionSaveResponse
+	if err := c.do(ctx, http.MethodPost, "/api/session/save", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Tokenize converts text into the token IDs used by a model.
+func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	var resp TokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/tokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Detokenize converts token IDs back into text using a model's vocabulary.
+func (c *Client) Detokenize(ctx context.Context, req *DetokenizeRequest) (*DetokenizeResponse, error) {
+	var resp DetokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/detokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CompareTokenizers tokenizes text with two models to show how their
+// tokenizations differ.
+func (c *Client) CompareTokenizers(ctx context.Context, req *CompareTokenizersRequest) (*CompareTokenizersResponse, error) {
+	var resp CompareTokenizersResponse
+	if err := c.do(ctx, http.MethodPost, "/api/tokenize/compare", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 // Embeddings generates an embedding from a model.
 func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*EmbeddingResponse, error) {
 	var resp EmbeddingResponse
@@ -1,13 +1,22 @@
 package api
 
 import (
+	"cmp"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestClientFromEnvironment(t *testing.T) {
@@ -54,6 +63,7 @@ func TestClientFromEnvironment(t *testing.T) {
 // this is used since the error response from the server is not a standard error struct
 type testError struct {
 	message    string
+	code       string
 	statusCode int
 }
 
@@ -66,6 +76,7 @@ func TestClientStream(t *testing.T) {
 		name      string
 		responses []any
 		wantErr   string
+		wantCode  string
 	}{
 		{
 			name: "immediate error response",
@@ -89,6 +100,31 @@ func TestClientStream(t *testing.T) {
 			},
 			wantErr: "mid-stream error",
 		},
+		{
+			name: "error response with code",
+			responses: []any{
+				testError{
+					message:    `model "missing" not found`,
+					code:       ErrorCodeModelNotFound,
+					statusCode: http.StatusNotFound,
+				},
+			},
+			wantErr:  `model "missing" not found`,
+			wantCode: ErrorCodeModelNotFound,
+		},
+		{
+			name: "mid-stream error with code",
+			responses: []any{
+				ChatResponse{Message: Message{Content: "partial response"}},
+				testError{
+					message:    "input length exceeds the context length",
+					code:       ErrorCodeContextExceeded,
+					statusCode: http.StatusOK,
+				},
+			},
+			wantErr:  "input length exceeds the context length",
+			wantCode: ErrorCodeContextExceeded,
+		},
 		{
 			name: "successful stream completion",
 			responses: []any{
@@ -118,6 +154,7 @@ func TestClientStream(t *testing.T) {
 						w.WriteHeader(errResp.statusCode)
 						err := json.NewEncoder(w).Encode(map[string]string{
 							"error": errResp.message,
+							"code":  errResp.code,
 						})
 						if err != nil {
 							t.Fatal("failed to encode error response:", err)
@@ -152,6 +189,10 @@ func TestClientStream(t *testing.T) {
 				if !strings.Contains(err.Error(), tc.wantErr) {
 					t.Errorf("expected error containing %q, got %v", tc.wantErr, err)
 				}
+				var serr StatusError
+				if tc.wantCode != "" && (!errors.As(err, &serr) || serr.Code != tc.wantCode) {
+					t.Errorf("expected error code %q, got %v", tc.wantCode, err)
+				}
 				return
 			}
 			if err != nil {
@@ -166,6 +207,7 @@ func TestClientDo(t *testing.T) {
 		name     string
 		response any
 		wantErr  string
+		wantCode string
 	}{
 		{
 			name: "immediate error response",
@@ -183,6 +225,16 @@ func TestClientDo(t *testing.T) {
 			},
 			wantErr: "internal error",
 		},
+		{
+			name: "error response with code",
+			response: testError{
+				message:    "option top_k must be of type integer",
+				code:       ErrorCodeInvalidOptions,
+				statusCode: http.StatusBadRequest,
+			},
+			wantErr:  "option top_k must be of type integer",
+			wantCode: ErrorCodeInvalidOptions,
+		},
 		{
 			name: "successful response",
 			response: struct {
@@ -202,6 +254,7 @@ func TestClientDo(t *testing.T) {
 					w.WriteHeader(errResp.statusCode)
 					err := json.NewEncoder(w).Encode(map[string]string{
 						"error": errResp.message,
+						"code":  errResp.code,
 					})
 					if err != nil {
 						t.Fatal("failed to encode error response:", err)
@@ -231,6 +284,10 @@ func TestClientDo(t *testing.T) {
 				if err.Error() != tc.wantErr {
 					t.Errorf("error message mismatch: got %q, want %q", err.Error(), tc.wantErr)
 				}
+				var serr StatusError
+				if tc.wantCode != "" && (!errors.As(err, &serr) || serr.Code != tc.wantCode) {
+					t.Errorf("error code mismatch: got %v, want %q", err, tc.wantCode)
+				}
 				return
 			}
 
@@ -252,3 +309,319 @@ func TestClientDo(t *testing.T) {
 		})
 	}
 }
+
+func TestClientRetry(t *testing.T) {
+	retry := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+
+	// newServer returns a client for a server that fails the first failures
+	// requests with a 503 and counts the requests it receives.
+	newServer := func(t *testing.T, failures int, handler http.HandlerFunc) (*Client, *atomic.Int32) {
+		t.Helper()
+
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if int(requests.Add(1)) <= failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": "model is loading", "code": ErrorCodeUnavailable})
+				return
+			}
+
+			handler(w, r)
+		}))
+		t.Cleanup(ts.Close)
+
+		client := NewClient(&url.URL{Scheme: "http", Host: ts.Listener.Addr().String()}, http.DefaultClient)
+		client.SetRetryPolicy(retry)
+		return client, &requests
+	}
+
+	embed := func(w http.ResponseWriter, r *http.Request) {
+		var req EmbedRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		_ = json.NewEncoder(w).Encode(EmbedResponse{Model: req.Model})
+	}
+
+	t.Run("fails then succeeds", func(t *testing.T) {
+		client, requests := newServer(t, 2, embed)
+
+		resp, err := client.Embed(t.Context(), &EmbedRequest{Model: "test", Input: "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the body is sent again with each attempt
+		if resp.Model != "test" || requests.Load() != 3 {
+			t.Errorf("expected model test after 3 requests, got %q after %d", resp.Model, requests.Load())
+		}
+	})
+
+	t.Run("attempts exhausted", func(t *testing.T) {
+		client, requests := newServer(t, 3, embed)
+
+		_, err := client.Embed(t.Context(), &EmbedRequest{Model: "test", Input: "hello"})
+		var serr StatusError
+		if !errors.As(err, &serr) || serr.StatusCode != http.StatusServiceUnavailable || serr.Code != ErrorCodeUnavailable {
+			t.Errorf("expected a 503 unavailable error, got %v", err)
+		}
+
+		if requests.Load() != 3 {
+			t.Errorf("expected 3 requests, got %d", requests.Load())
+		}
+	})
+
+	t.Run("client error", func(t *testing.T) {
+		client, requests := newServer(t, 0, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "model 'test' not found", "code": ErrorCodeModelNotFound})
+		})
+
+		if _, err := client.Show(t.Context(), &ShowRequest{Model: "test"}); err == nil {
+			t.Error("expected an error")
+		}
+
+		if requests.Load() != 1 {
+			t.Errorf("expected 1 request, got %d", requests.Load())
+		}
+	})
+
+	t.Run("not idempotent", func(t *testing.T) {
+		client, requests := newServer(t, 1, func(w http.ResponseWriter, r *http.Request) {})
+
+		if err := client.Create(t.Context(), &CreateRequest{Model: "test"}, func(ProgressResponse) error { return nil }); err == nil {
+			t.Error("expected an error")
+		}
+
+		if requests.Load() != 1 {
+			t.Errorf("expected 1 request, got %d", requests.Load())
+		}
+	})
+
+	t.Run("dial error", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			_ = json.NewEncoder(w).Encode(ProgressResponse{Status: "success"})
+		}))
+		defer ts.Close()
+
+		// the first connection fails before anything is sent, so even a
+		// request that creates a model is sent again
+		var dials atomic.Int32
+		var d net.Dialer
+		client := NewClient(&url.URL{Scheme: "http", Host: ts.Listener.Addr().String()}, &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if dials.Add(1) == 1 {
+					return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+				}
+				return d.DialContext(ctx, network, addr)
+			},
+		}})
+		client.SetRetryPolicy(retry)
+
+		if err := client.Create(t.Context(), &CreateRequest{Model: "test"}, func(ProgressResponse) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+
+		if dials.Load() != 2 || requests.Load() != 1 {
+			t.Errorf("expected 2 dials and 1 request, got %d and %d", dials.Load(), requests.Load())
+		}
+	})
+
+	t.Run("chat server error", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "model runner has unexpectedly stopped", "code": ErrorCodeInternal})
+		}))
+		defer ts.Close()
+
+		client := NewClient(&url.URL{Scheme: "http", Host: ts.Listener.Addr().String()}, http.DefaultClient)
+		client.SetRetryPolicy(retry)
+
+		// the chat may have been generated before the server failed
+		if err := client.Chat(t.Context(), &ChatRequest{Model: "test"}, func(ChatResponse) error { return nil }); err == nil {
+			t.Error("expected an error")
+		}
+
+		if requests.Load() != 1 {
+			t.Errorf("expected 1 request, got %d", requests.Load())
+		}
+	})
+
+	t.Run("stream before first byte", func(t *testing.T) {
+		client, requests := newServer(t, 1, func(w http.ResponseWriter, r *http.Request) {
+			_ = json.NewEncoder(w).Encode(GenerateResponse{Response: "hello", Done: true})
+		})
+
+		var responses []string
+		if err := client.Generate(t.Context(), &GenerateRequest{Model: "test"}, func(resp GenerateResponse) error {
+			responses = append(responses, resp.Response)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(responses) != 1 || responses[0] != "hello" || requests.Load() != 2 {
+			t.Errorf("expected one response after 2 requests, got %q after %d", responses, requests.Load())
+		}
+	})
+
+	t.Run("stream after first byte", func(t *testing.T) {
+		client, requests := newServer(t, 0, func(w http.ResponseWriter, r *http.Request) {
+			_ = json.NewEncoder(w).Encode(GenerateResponse{Response: "hello"})
+			w.(http.Flusher).Flush()
+
+			// drop the connection part way through the stream
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+		})
+
+		var responses []string
+		_ = client.Generate(t.Context(), &GenerateRequest{Model: "test"}, func(resp GenerateResponse) error {
+			responses = append(responses, resp.Response)
+			return nil
+		})
+
+		if len(responses) != 1 || requests.Load() != 1 {
+			t.Errorf("expected one response after 1 request, got %q after %d", responses, requests.Load())
+		}
+	})
+
+	t.Run("connection error", func(t *testing.T) {
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) == 1 {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.Close()
+				return
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]string{"version": "0.0.0"})
+		}))
+		defer ts.Close()
+
+		client := NewClient(&url.URL{Scheme: "http", Host: ts.Listener.Addr().String()}, &http.Client{Transport: &http.Transport{}})
+		client.SetRetryPolicy(retry)
+
+		if v, err := client.Version(t.Context()); err != nil || v != "0.0.0" {
+			t.Errorf("expected version 0.0.0, got %q, %v", v, err)
+		}
+
+		if requests.Load() != 2 {
+			t.Errorf("expected 2 requests, got %d", requests.Load())
+		}
+	})
+
+	t.Run("canceled during backoff", func(t *testing.T) {
+		client, requests := newServer(t, 3, embed)
+		client.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, Backoff: time.Minute})
+
+		ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := client.Embed(ctx, &EmbedRequest{Model: "test", Input: "hello"})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 5*time.Second || requests.Load() != 1 {
+			t.Errorf("expected to stop after 1 request, got %d after %v", requests.Load(), elapsed)
+		}
+	})
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		if got := p.delay(attempt + 1); got != want {
+			t.Errorf("attempt %d: expected %v, got %v", attempt+1, want, got)
+		}
+	}
+}
+
+func TestClientDecompress(t *testing.T) {
+	chunks := []GenerateResponse{{Response: "why is"}, {Response: " the sky blue?", Done: true}}
+
+	for _, encoding := range []string{"", "gzip", "deflate"} {
+		t.Run(cmp.Or(encoding, "none"), func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.Contains(r.Header.Get("Accept-Encoding"), cmp.Or(encoding, "gzip")) {
+					t.Errorf("expected Accept-Encoding to include %q, got %q", encoding, r.Header.Get("Accept-Encoding"))
+				}
+
+				var zw interface {
+					io.WriteCloser
+					Flush() error
+				}
+				switch encoding {
+				case "gzip":
+					zw = gzip.NewWriter(w)
+				case "deflate":
+					zw = zlib.NewWriter(w)
+				}
+
+				var out io.Writer = w
+				if zw != nil {
+					w.Header().Set("Content-Encoding", encoding)
+					out = zw
+				}
+
+				switch r.URL.Path {
+				case "/api/generate":
+					for _, chunk := range chunks {
+						_ = json.NewEncoder(out).Encode(chunk)
+						if zw != nil {
+							_ = zw.Flush()
+						}
+						w.(http.Flusher).Flush()
+					}
+				case "/api/show":
+					w.WriteHeader(http.StatusNotFound)
+					_ = json.NewEncoder(out).Encode(map[string]string{"error": "model 'test' not found", "code": ErrorCodeModelNotFound})
+				default:
+					_ = json.NewEncoder(out).Encode(map[string]string{"version": "0.0.0"})
+				}
+
+				if zw != nil {
+					_ = zw.Close()
+				}
+			}))
+			defer ts.Close()
+
+			client := NewClient(&url.URL{Scheme: "http", Host: ts.Listener.Addr().String()}, http.DefaultClient)
+
+			if v, err := client.Version(t.Context()); err != nil || v != "0.0.0" {
+				t.Errorf("expected version 0.0.0, got %q, %v", v, err)
+			}
+
+			var responses []GenerateResponse
+			if err := client.Generate(t.Context(), &GenerateRequest{Model: "test"}, func(resp GenerateResponse) error {
+				responses = append(responses, resp)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(responses) != 2 || responses[0].Response+responses[1].Response != "why is the sky blue?" {
+				t.Errorf("expected 2 responses, got %+v", responses)
+			}
+
+			var serr StatusError
+			if _, err := client.Show(t.Context(), &ShowRequest{Model: "test"}); !errors.As(err, &serr) || serr.Code != ErrorCodeModelNotFound {
+				t.Errorf("expected a model not found error, got %v", err)
+			}
+		})
+	}
+}
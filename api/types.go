@@ -2,14 +2,17 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math"
 	"os"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/types/model"
@@ -20,8 +23,57 @@ type StatusError struct {
 	StatusCode   int
 	Status       string
 	ErrorMessage string `json:"error"`
+
+	// Code identifies the kind of error, one of the ErrorCode constants.
+	// Unlike the message, it is stable across versions, so clients can
+	// handle errors by it. It is empty for errors from older servers.
+	Code string `json:"code,omitempty"`
 }
 
+// The codes of a [StatusError]. Servers may add codes, which clients should
+// handle as they do the code for the error's status.
+const (
+	// ErrorCodeInvalidRequest is a request that is malformed or combines
+	// fields that can't be used together.
+	ErrorCodeInvalidRequest = "invalid_request"
+
+	// ErrorCodeInvalidOptions is a request with options that are unknown or
+	// have invalid values.
+	ErrorCodeInvalidOptions = "invalid_options"
+
+	// ErrorCodeModelNotFound is a request for a model that doesn't exist.
+	ErrorCodeModelNotFound = "model_not_found"
+
+	// ErrorCodeNotFound is a request for anything else that doesn't exist,
+	// such as a blob or a session.
+	ErrorCodeNotFound = "not_found"
+
+	// ErrorCodeUnsupported is a request for something the model can't do,
+	// such as tools with a model that doesn't support them.
+	ErrorCodeUnsupported = "unsupported"
+
+	// ErrorCodeContextExceeded is an input that doesn't fit in the model's
+	// context and can't be truncated.
+	ErrorCodeContextExceeded = "context_exceeded"
+
+	// ErrorCodeUnauthorized is a request without the credentials it needs.
+	ErrorCodeUnauthorized = "unauthorized"
+
+	// ErrorCodeCanceled is a request that was canceled before it finished.
+	ErrorCodeCanceled = "canceled"
+
+	// ErrorCodeUnavailable is a request the server can't take on now, such
+	// as when its queue is full. It may succeed if retried later.
+	ErrorCodeUnavailable = "unavailable"
+
+	// ErrorCodeBudgetExceeded is a request from a session that has generated
+	// as many tokens as its budget allows.
+	ErrorCodeBudgetExceeded = "budget_exceeded"
+
+	// ErrorCodeInternal is a failure of the server.
+	ErrorCodeInternal = "internal_error"
+)
+
 func (e StatusError) Error() string {
 	switch {
 	case e.Status != "" && e.ErrorMessage != "":
@@ -63,19 +115,41 @@ type GenerateRequest struct {
 	// [Client.Generate]. It can be used to keep a short conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Session is the digest of a session saved by [Client.SaveSession]. The
+	// prompt continues from the saved KV cache without evaluating its tokens
+	// again. It can't be combined with Context or Raw.
+	Session string `json:"session,omitempty"`
+
 	// Stream specifies whether the response is streaming; it is true by default.
 	Stream *bool `json:"stream,omitempty"`
 
 	// Raw set to true means that no formatting will be applied to the prompt.
 	Raw bool `json:"raw,omitempty"`
 
+	// FIM prompts a code model to fill in the middle between Prompt, as the
+	// prefix, and Suffix using the fill-in-the-middle tokens declared in the
+	// model's metadata rather than its template. The response is the infill.
+	FIM bool `json:"fim,omitempty"`
+
+	// SkipSpecialTokens stops the tokenizer from inserting special tokens,
+	// such as BOS, at the start of the prompt, so that a prompt that already
+	// contains them is sent as is. Special tokens written in the prompt are
+	// still recognized. It requires Raw.
+	SkipSpecialTokens bool `json:"skip_special_tokens,omitempty"`
+
 	// Format specifies the format to return a response in.
 	Format json.RawMessage `json:"format,omitempty"`
 
 	// KeepAlive controls how long the model will stay loaded in memory following
-	// this request.
+	// this request. Zero unloads the model as soon as the request completes and
+	// a negative duration keeps it loaded indefinitely.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Timeout limits how long the response may take to generate once the
+	// model is loaded. When it passes, generation stops and the final
+	// response, with DoneReason "timeout", follows the text generated so far.
+	Timeout *Duration `json:"timeout,omitempty"`
+
 	// Images is an optional list of raw image bytes accompanying this
 	// request, for multimodal models.
 	Images []ImageData `json:"images,omitempty"`
@@ -106,18 +180,45 @@ type ChatRequest struct {
 	Format json.RawMessage `json:"format,omitempty"`
 
 	// KeepAlive controls how long the model will stay loaded into memory
-	// following the request.
+	// following the request. Zero unloads the model as soon as the request
+	// completes and a negative duration keeps it loaded indefinitely.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Timeout limits how long the response may take to generate, as in
+	// [GenerateRequest].
+	Timeout *Duration `json:"timeout,omitempty"`
+
 	// Tools is an optional list of tools the model has access to.
 	Tools `json:"tools,omitempty"`
 
+	// Template overrides the model's default prompt template for this
+	// request.
+	Template string `json:"template,omitempty"`
+
+	// ToolValidation checks the arguments of tool calls against the
+	// parameters of their tools. With "mark", each tool call is returned
+	// with [ToolCall.Valid] set. With "retry", a response with an invalid
+	// tool call is generated again, up to twice, before being returned
+	// marked, and responses are held back until they are known to be valid.
+	ToolValidation string `json:"tool_validation,omitempty"`
+
+	// TruncationStrategy chooses which messages are left out when the
+	// conversation doesn't fit in the context window. The latest message is
+	// always kept. With "keep_system", the default, the oldest messages other
+	// than system messages are dropped. With "drop_oldest", the oldest
+	// messages are dropped whatever their role.
+	TruncationStrategy string `json:"truncation_strategy,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]any `json:"options"`
 
 	// Think controls whether thinking/reasoning models will think before
 	// responding
 	Think *bool `json:"think,omitempty"`
+
+	// RenderOnly returns the prompt produced by applying the model's template
+	// to the messages in [ChatResponse.Prompt] without running generation.
+	RenderOnly bool `json:"render_only,omitempty"`
 }
 
 type Tools []Tool
@@ -143,6 +244,16 @@ type Message struct {
 	Thinking  string      `json:"thinking,omitempty"`
 	Images    []ImageData `json:"images,omitempty"`
 	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
+
+	// Name identifies the participant that wrote the message, such as one
+	// of several users in the same conversation. Templates can render it as
+	// .Name; it is ignored by templates that do not.
+	Name string `json:"name,omitempty"`
+
+	// CachePrompt marks a system message at the start of the conversation
+	// to be retained in the model's KV cache, so later requests with the
+	// same system prompt reuse it instead of processing it again.
+	CachePrompt bool `json:"cache_prompt,omitempty"`
 }
 
 func (m *Message) UnmarshalJSON(b []byte) error {
@@ -159,6 +270,13 @@ func (m *Message) UnmarshalJSON(b []byte) error {
 
 type ToolCall struct {
 	Function ToolCallFunction `json:"function"`
+
+	// Valid reports whether the arguments match the parameters the tool
+	// declares. It is only set in responses to requests with
+	// [ChatRequest.ToolValidation], as is ValidationError, which describes
+	// why they don't.
+	Valid           *bool  `json:"valid,omitempty"`
+	ValidationError string `json:"validation_error,omitempty"`
 }
 
 type ToolCallFunction struct {
@@ -252,8 +370,72 @@ type ChatResponse struct {
 	Message    Message   `json:"message"`
 	DoneReason string    `json:"done_reason,omitempty"`
 
+	// RequestID identifies the request for [Client.Cancel]. It is only set
+	// on the first response of a streamed request.
+	RequestID string `json:"request_id,omitempty"`
+
+	// StopSequence is the stop sequence that ended generation, if any.
+	StopSequence string `json:"stop_sequence,omitempty"`
+
+	// StoppedAt is the text that ended generation: the stop sequence that
+	// matched, or else the text of the token, such as the model's EOS token
+	// or one of the stop_tokens, that was sampled. It is only set on the
+	// final response.
+	StoppedAt string `json:"stopped_at,omitempty"`
+
 	Done bool `json:"done"`
 
+	// Index is which of the responses requested with the n option this
+	// belongs to. Each of them ends with its own final response.
+	Index int `json:"index,omitempty"`
+
+	// Fingerprint identifies the model, version of Ollama and load options
+	// that generated the response. The same seed may not reproduce a
+	// response when it changes.
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Phase is "thinking" or "answer" on streamed responses to requests
+	// that think, telling apart the model's thinking from its answer. A
+	// response never has both.
+	Phase string `json:"phase,omitempty"`
+
+	// Seed is the seed used for sampling. It is only set on the final
+	// response.
+	Seed int `json:"seed,omitempty"`
+
+	// Warning describes a problem with the request that didn't stop it,
+	// such as num_ctx being limited to the model's trained context. It is
+	// only set on the final response.
+	Warning string `json:"warning,omitempty"`
+
+	// SystemCacheHit reports whether the system prompt, marked with
+	// [Message.CachePrompt], was reused from the KV cache of an earlier
+	// request. It is only set on the final response.
+	SystemCacheHit bool `json:"system_cache_hit,omitempty"`
+
+	// TruncatedMessages is the number of messages, including those of the
+	// model, left out of the prompt because the conversation didn't fit in
+	// the context window. It is only set on the final response.
+	TruncatedMessages int `json:"truncated_messages,omitempty"`
+
+	// Logits are the raw logits the last generated token was sampled from.
+	// It is only set on the final response and only if the return_logits
+	// option is set.
+	Logits []float32 `json:"logits,omitempty"`
+
+	// Logprobs are the log probabilities of the tokens generated for this
+	// response, if the logprobs option is set.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
+	// PromptEvalProgress is set on responses sent while the prompt is still
+	// being processed, before the first token is generated.
+	PromptEvalProgress *PromptEvalProgress `json:"prompt_eval_progress,omitempty"`
+
+	// Prompt is the rendered prompt, including any special tokens, tool
+	// definitions and image placeholders added by the template. It is only
+	// set when [ChatRequest.RenderOnly] is true.
+	Prompt string `json:"prompt,omitempty"`
+
 	Metrics
 }
 
@@ -264,6 +446,33 @@ type Metrics struct {
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
 	EvalCount          int           `json:"eval_count,omitempty"`
 	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+
+	// EvalRate is the number of tokens generated per second over roughly the
+	// last second. It is only set on streamed responses when the
+	// report_eval_rate option is enabled.
+	EvalRate float64 `json:"eval_rate,omitempty"`
+
+	// CachedPromptTokens is the number of tokens at the start of the prompt
+	// that were reused from the K/V cache of an earlier request rather than
+	// evaluated again. They are not included in PromptEvalCount.
+	CachedPromptTokens int `json:"cached_prompt_tokens,omitempty"`
+
+	// PromptCacheHitTokens is the same count as CachedPromptTokens, under
+	// the name other APIs report prompt cache hits with.
+	PromptCacheHitTokens int `json:"prompt_cache_hit_tokens,omitempty"`
+
+	// DraftTokens is the number of tokens proposed by the lookahead option
+	// and AcceptedDraftTokens how many of them were generated without a step
+	// of their own. DraftAcceptanceRate is the fraction that were accepted.
+	DraftTokens         int     `json:"draft_tokens,omitempty"`
+	AcceptedDraftTokens int     `json:"accepted_draft_tokens,omitempty"`
+	DraftAcceptanceRate float64 `json:"draft_acceptance_rate,omitempty"`
+
+	// TokenTimings are the times each generated token was sampled, relative
+	// to when the model started processing the request, in nanoseconds. The
+	// first includes the time taken to evaluate the prompt. It is only set on the final
+	// response and only if the return_token_timings option is set.
+	TokenTimings []time.Duration `json:"token_timings,omitempty"`
 }
 
 // Options specified in [GenerateRequest].  If you add a new option here, also
@@ -285,6 +494,131 @@ type Options struct {
 	PresencePenalty  float32  `json:"presence_penalty,omitempty"`
 	FrequencyPenalty float32  `json:"frequency_penalty,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+
+	// KeepTokens is the number of tokens at the start of the prompt, such as
+	// a system prompt, that are never discarded when the context is shifted.
+	// -1 keeps the whole prompt. If zero, NumKeep is used. See [Options.Keep].
+	KeepTokens int `json:"keep_tokens,omitempty"`
+
+	// TemperatureSchedule changes the temperature over the response instead
+	// of keeping it at Temperature. It is parsed by
+	// [ParseTemperatureSchedule], e.g. "start=1.2,end=0.4,interpolation=cosine".
+	// It requires a model that runs on the Ollama engine.
+	TemperatureSchedule string `json:"temperature_schedule,omitempty"`
+
+	// StopTokens ends generation as soon as one of these token IDs is
+	// sampled, before its text is produced. They are checked before Stop,
+	// and the stopping token is not included in the response.
+	StopTokens []int `json:"stop_tokens,omitempty"`
+
+	// Mirostat enables Mirostat sampling (1 for Mirostat, 2 for Mirostat
+	// 2.0), which targets a perplexity of MirostatTau instead of truncating
+	// with top_k, top_p, min_p and typical_p. MirostatEta is the learning
+	// rate used to adjust towards the target after each token.
+	Mirostat    int     `json:"mirostat,omitempty"`
+	MirostatTau float32 `json:"mirostat_tau,omitempty"`
+	MirostatEta float32 `json:"mirostat_eta,omitempty"`
+
+	// Greedy always selects the most likely token, ignoring temperature,
+	// top_k, top_p, min_p, typical_p and repetition penalties.
+	Greedy bool `json:"greedy,omitempty"`
+
+	// LogitBias maps token IDs to a value between -100 and 100 that is added
+	// to the token's logit before sampling. -100 effectively bans the token.
+	LogitBias map[int]float32 `json:"logit_bias,omitempty"`
+
+	// Adapter selects a single LoRA adapter of the model, by digest, to
+	// apply to the request. All of the model's adapters are applied if
+	// empty.
+	Adapter string `json:"adapter,omitempty"`
+
+	// ReturnPromptTokens includes the token IDs of the rendered prompt in
+	// the final generate response.
+	ReturnPromptTokens bool `json:"return_prompt_tokens,omitempty"`
+
+	// ReturnLogits includes the raw logits of the last generated token in
+	// the final response. There is one for each token in the vocabulary, so
+	// the response can be several megabytes.
+	ReturnLogits bool `json:"return_logits,omitempty"`
+
+	// Logprobs includes the log probability of each generated token in the
+	// response it is sent with.
+	Logprobs bool `json:"logprobs,omitempty"`
+
+	// TopLogprobs is the number of the most likely tokens at each position,
+	// up to 20, whose log probabilities are included with those of the
+	// generated tokens. It requires Logprobs.
+	TopLogprobs int `json:"top_logprobs,omitempty"`
+
+	// RawLogits includes the raw logit of each token alongside its log
+	// probability. It requires Logprobs.
+	RawLogits bool `json:"raw_logits,omitempty"`
+
+	// ReportEvalRate includes a rolling generation rate in each response
+	// produced while tokens are being generated.
+	ReportEvalRate bool `json:"report_eval_rate,omitempty"`
+
+	// ReturnTokenTimings includes the time each generated token was sampled
+	// in the final response.
+	ReturnTokenTimings bool `json:"return_token_timings,omitempty"`
+
+	// TokenHealing removes the last token of the prompt if it could be the
+	// start of a longer token, such as a partial word, and constrains the
+	// response to begin with its text, which is not repeated in the response.
+	// It has no effect when a format is set.
+	TokenHealing bool `json:"token_healing,omitempty"`
+
+	// AddBOS and AddEOS force the model's beginning and end of sequence
+	// tokens to be inserted at the start and end of the prompt, if true, or
+	// left out, if false, rather than following the model's tokenizer.
+	// They apply to the prompt after any template is applied, so a template
+	// that writes these tokens itself is best used with them set to false.
+	// They take precedence over SkipSpecialTokens.
+	AddBOS *bool `json:"add_bos,omitempty"`
+	AddEOS *bool `json:"add_eos,omitempty"`
+
+	// Choices constrains the response to be exactly one of the given
+	// strings, such as the labels of a classification. It can't be used
+	// with a format.
+	Choices []string `json:"choices,omitempty"`
+
+	// N generates that many independent responses to the prompt, one after
+	// another, each with a different seed. Responses are streamed in order
+	// and told apart by their index.
+	N int `json:"n,omitempty"`
+
+	// Bytes includes the raw bytes of each generated token in generate
+	// responses, for clients that decode text themselves.
+	Bytes bool `json:"bytes,omitempty"`
+
+	// Think controls whether thinking models think before responding when
+	// the request doesn't set think itself. If false, the model's template
+	// tells it not to think and any thinking is left out of the response.
+	Think *bool `json:"think,omitempty"`
+
+	// NegativePrompt is text to steer the response away from with
+	// classifier-free guidance. It's used as is, without the model's
+	// template. The model evaluates both prompts for every token, which
+	// roughly doubles the compute a response takes, and the request uses two
+	// of the model's parallel sequences.
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+
+	// GuidanceScale is how strongly the negative prompt steers the response.
+	// 1 has no effect and larger values move further away from it.
+	GuidanceScale float32 `json:"guidance_scale,omitempty"`
+
+	// Lookahead enables prompt lookup decoding: the tokens that followed an
+	// earlier occurrence of the last few tokens generated are proposed as
+	// the next ones and verified by the model in a single step, which speeds
+	// up responses that repeat text from their context. The response is
+	// the same as without it.
+	Lookahead bool `json:"lookahead,omitempty"`
+
+	// ImageDetail is the level of detail the request's images are encoded
+	// at: "low", "high" or "auto", the default, which leaves it to the
+	// model. Models that split images into tiles use fewer of them at low
+	// detail. Other models ignore it.
+	ImageDetail string `json:"image_detail,omitempty"`
 }
 
 // Runner options which must be set when the model is loaded into memory
@@ -295,6 +629,116 @@ type Runner struct {
 	MainGPU   int   `json:"main_gpu,omitempty"`
 	UseMMap   *bool `json:"use_mmap,omitempty"`
 	NumThread int   `json:"num_thread,omitempty"`
+
+	// CacheType is the quantization type for the K/V cache. If empty, the
+	// server default set by OLLAMA_KV_CACHE_TYPE is used.
+	CacheType string `json:"cache_type,omitempty"`
+
+	// GGUFOverride replaces model metadata values at load time. Each entry is
+	// a key and value separated by whitespace, e.g. "rope.freq_base 1000000".
+	GGUFOverride []string `json:"gguf_override,omitempty"`
+
+	// NumParallel is the number of requests the model can process at the
+	// same time. If zero, the server default set by OLLAMA_NUM_PARALLEL is
+	// used.
+	NumParallel int `json:"num_parallel,omitempty"`
+
+	// RopeScalingType is the method used to extend the context of the model
+	// beyond its training length, either "linear" or "yarn". It is linear if
+	// only RopeFrequencyScale is set.
+	RopeScalingType string `json:"rope_scaling_type,omitempty"`
+
+	// RopeFrequencyScale scales the RoPE frequencies of the model. A value
+	// of 0.25 extends the context to 4 times its training length. If zero,
+	// the model's own scale is used.
+	RopeFrequencyScale float32 `json:"rope_frequency_scale,omitempty"`
+
+	// RopeFactors replace the RoPE frequency factors loaded from models that
+	// have them, such as Llama 3.2 Vision, with one factor for each pair of
+	// RoPE dimensions. The model rejects factors of the wrong length.
+	RopeFactors []float32 `json:"rope_factors,omitempty"`
+
+	// ExceedTrainCtx allows NumCtx to be larger than the context the model
+	// was trained with, or extended to by RoPE scaling. Otherwise NumCtx is
+	// limited to it and responses carry a warning.
+	ExceedTrainCtx bool `json:"exceed_train_ctx,omitempty"`
+
+	// Pooling is how token embeddings are combined into an embedding for
+	// the input, one of "mean", "cls", "last" or "none". If empty, the
+	// model's own pooling is used.
+	Pooling string `json:"pooling,omitempty"`
+
+	// GPULayerRanges lists the layers to offload to the GPU, overriding
+	// NumGPU, as comma separated layer numbers or inclusive ranges of them,
+	// e.g. "0-9,20-31". Layers are numbered from 0 and the output layer is
+	// numbered after the model's last repeating layer. Only the Ollama
+	// engine can place layers other than the last NumGPU.
+	GPULayerRanges string `json:"gpu_layer_ranges,omitempty"`
+
+	// ForceGPULayers skips checking how much of the model fits in free GPU
+	// memory and offloads NumGPU layers with a context of NumCtx as given,
+	// even if they don't fit. The memory they use is still estimated. It
+	// requires NumGPU to be set.
+	ForceGPULayers bool `json:"force_gpu_layers,omitempty"`
+}
+
+// maxLayer bounds the layer numbers in [Runner.GPULayerRanges] so that a
+// mistyped range cannot expand to an unreasonable number of layers.
+const maxLayer = 1 << 16
+
+// cacheTypes are the supported values for [Runner.CacheType].
+var cacheTypes = []string{"f16", "q8_0", "q4_0"}
+
+// interpolations are the supported interpolations of a
+// [TemperatureSchedule].
+var interpolations = []string{"linear", "cosine"}
+
+// imageDetails are the supported values for [Options.ImageDetail].
+var imageDetails = []string{"low", "high", "auto"}
+
+// poolingTypes are the supported values for [Runner.Pooling].
+var poolingTypes = []string{"mean", "cls", "last", "none"}
+
+// ropeScalingTypes are the supported values for [Runner.RopeScalingType].
+var ropeScalingTypes = []string{"linear", "yarn"}
+
+// Keep returns the number of tokens at the start of the prompt that are
+// never discarded when the context is shifted: KeepTokens if it's set and
+// NumKeep otherwise.
+func (opts *Options) Keep() int {
+	if opts.KeepTokens != 0 {
+		return opts.KeepTokens
+	}
+
+	return opts.NumKeep
+}
+
+// ropeScalingArchitectures are the model architectures that honor
+// [Runner.RopeScalingType] and [Runner.RopeFrequencyScale] on the Ollama
+// engine.
+var ropeScalingArchitectures = []string{"llama", "mllama"}
+
+// ErrRopeScalingUnsupported is returned by [Runner.ValidateRopeScaling] for
+// RoPE scaling options on a model that doesn't honor them.
+var ErrRopeScalingUnsupported = errors.New(`options "rope_scaling_type" and "rope_frequency_scale" are only supported by the llama and mllama architectures on the Ollama engine`)
+
+// ValidateRopeScaling returns an error if the options set RoPE scaling for a
+// model of architecture arch, which runs on the Ollama engine if
+// ollamaEngine is true, that doesn't honor it.
+func (opts *Runner) ValidateRopeScaling(arch string, ollamaEngine bool) error {
+	if opts.RopeScalingType == "" && opts.RopeFrequencyScale == 0 {
+		return nil
+	}
+
+	if !ollamaEngine {
+		return fmt.Errorf("%w, got %s on the llama.cpp engine", ErrRopeScalingUnsupported, arch)
+	}
+
+	if !slices.Contains(ropeScalingArchitectures, arch) {
+		return fmt.Errorf("%w, got %s", ErrRopeScalingUnsupported, arch)
+	}
+
+	return nil
 }
 
 // EmbedRequest is the request passed to [Client.Embed].
@@ -305,6 +749,51 @@ type EmbedRequest struct {
 	// Input is the input to embed.
 	Input any `json:"input"`
 
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request. Zero unloads the model as soon as the request completes and
+	// a negative duration keeps it loaded indefinitely.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	Truncate *bool `json:"truncate,omitempty"`
+
+	// Dimensions truncates each embedding to its first Dimensions values before
+	// it is normalized. Zero returns the model's full embedding length.
+	Dimensions int `json:"dimensions,omitempty"`
+
+	// Normalize scales each embedding to unit length. Defaults to true; set
+	// it to false to get the model's raw embeddings.
+	Normalize *bool `json:"normalize,omitempty"`
+
+	// Pooling selects how token embeddings are combined: "mean", "cls",
+	// "last", or "none" to return every token's embedding. If empty, the
+	// model's own pooling is used. Changing it reloads the model.
+	Pooling string `json:"pooling,omitempty"`
+
+	// Stream sends the embeddings of each input in a response of its own as
+	// soon as it and the inputs before it are embedded, followed by a final
+	// response with Done set. Defaults to false.
+	Stream *bool `json:"stream,omitempty"`
+
+	// ReportProgress sends streamed responses with the progress of processing
+	// each input that takes more than one batch, before its embeddings. It
+	// requires Stream.
+	ReportProgress bool `json:"report_progress,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]any `json:"options"`
+}
+
+// SimilarityRequest is the request passed to [Client.Similarity].
+type SimilarityRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Query is the text the candidates are compared to.
+	Query string `json:"query"`
+
+	// Candidates are the texts to rank by similarity to Query.
+	Candidates []string `json:"candidates"`
+
 	// KeepAlive controls how long the model will stay loaded in memory following
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
@@ -315,11 +804,47 @@ type EmbedRequest struct {
 	Options map[string]any `json:"options"`
 }
 
+// SimilarityResponse is the response from [Client.Similarity].
+type SimilarityResponse struct {
+	Model string `json:"model"`
+
+	// Similarities has one entry for each candidate, most similar first.
+	Similarities []Similarity `json:"similarities"`
+
+	TotalDuration   time.Duration `json:"total_duration,omitempty"`
+	LoadDuration    time.Duration `json:"load_duration,omitempty"`
+	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
+}
+
+// Similarity is the cosine similarity of the embeddings of a candidate and
+// the query, between -1 and 1.
+type Similarity struct {
+	// Index is the position of the candidate in the request.
+	Index int     `json:"index"`
+	Score float64 `json:"score"`
+}
+
 // EmbedResponse is the response from [Client.Embed].
 type EmbedResponse struct {
 	Model      string      `json:"model"`
 	Embeddings [][]float32 `json:"embeddings"`
 
+	// Index is the input the embeddings of a streamed response are of.
+	Index int `json:"index,omitempty"`
+
+	// Done is set on the final streamed response, which carries the totals
+	// and no embeddings.
+	Done bool `json:"done,omitempty"`
+
+	// TokenCounts is the number of tokens embedded for each input, in the
+	// same order as Embeddings. Counts reflect any truncation.
+	TokenCounts []int `json:"token_counts,omitempty"`
+
+	// PromptEvalProgress is set on streamed responses sent while input Index
+	// is still being processed, when ReportProgress is set. They have no
+	// embeddings.
+	PromptEvalProgress *PromptEvalProgress `json:"prompt_eval_progress,omitempty"`
+
 	TotalDuration   time.Duration `json:"total_duration,omitempty"`
 	LoadDuration    time.Duration `json:"load_duration,omitempty"`
 	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
@@ -334,7 +859,8 @@ type EmbeddingRequest struct {
 	Prompt string `json:"prompt"`
 
 	// KeepAlive controls how long the model will stay loaded in memory following
-	// this request.
+	// this request. Zero unloads the model as soon as the request completes and
+	// a negative duration keeps it loaded indefinitely.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
 	// Options lists model-specific options.
@@ -346,6 +872,90 @@ type EmbeddingResponse struct {
 	Embedding []float64 `json:"embedding"`
 }
 
+// TokenizeRequest is the request passed to [Client.Tokenize].
+type TokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Text is the text to tokenize.
+	Text string `json:"text"`
+}
+
+// TokenizeResponse is the response from [Client.Tokenize].
+type TokenizeResponse struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+}
+
+// SessionSaveRequest is the request passed to [Client.SaveSession].
+type SessionSaveRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Context is the context returned by a previous generate request. The
+	// cached tokens sharing the longest prefix with it are saved. If it is
+	// empty, the most recently used tokens are saved.
+	Context []int `json:"context,omitempty"`
+}
+
+// SessionSaveResponse is the response from [Client.SaveSession].
+type SessionSaveResponse struct {
+	Model string `json:"model"`
+
+	// Session is the digest to pass as the session of a generate request.
+	Session string `json:"session"`
+
+	// Tokens is the number of tokens saved.
+	Tokens int `json:"tokens"`
+
+	// Size is the size of the saved session in bytes.
+	Size int64 `json:"size"`
+}
+
+// CompareTokenizersRequest is the request passed to [Client.CompareTokenizers].
+type CompareTokenizersRequest struct {
+	// Models are the names of the two models to compare.
+	Models []string `json:"models"`
+
+	// Text is the text to tokenize with each model.
+	Text string `json:"text"`
+}
+
+// Tokenization is the tokens a model splits text into.
+type Tokenization struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+
+	// Pieces are the text of each token, decoded on its own.
+	Pieces []string `json:"pieces"`
+}
+
+// CompareTokenizersResponse is the response from [Client.CompareTokenizers].
+type CompareTokenizersResponse struct {
+	// Tokenizations are the tokenizations of the text by each model, in the
+	// order of the request.
+	Tokenizations []Tokenization `json:"tokenizations"`
+
+	// Diff is the number of tokens of the second model less those of the
+	// first, negative if the second model takes fewer.
+	Diff int `json:"diff"`
+}
+
+// DetokenizeRequest is the request passed to [Client.Detokenize].
+type DetokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Tokens is the list of token IDs to convert back to text.
+	Tokens []int `json:"tokens"`
+}
+
+// DetokenizeResponse is the response from [Client.Detokenize].
+type DetokenizeResponse struct {
+	Model string `json:"model"`
+	Text  string `json:"text"`
+}
+
 // CreateRequest is the request passed to [Client.Create].
 type CreateRequest struct {
 	Model    string `json:"model"`
@@ -375,6 +985,41 @@ type DeleteRequest struct {
 	Name string `json:"name"`
 }
 
+// UnloadRequest is the request passed to [Client.Unload].
+type UnloadRequest struct {
+	Model string `json:"model"`
+
+	// Abort cancels requests in flight on the model instead of waiting for
+	// them to complete before it is unloaded.
+	Abort bool `json:"abort,omitempty"`
+}
+
+// HealthResponse is the response from the health endpoint, which reports on
+// the server or, if a model is given, whether the model is ready.
+type HealthResponse struct {
+	// Status is "ok" for the server, or either "ready", "loading" or
+	// "not-loaded" for a model.
+	Status string `json:"status"`
+
+	Model string `json:"model,omitempty"`
+
+	// Progress is the percentage of the model that has been loaded. It is
+	// 100 once the model is ready and omitted until some of it has loaded.
+	Progress int `json:"progress,omitempty"`
+
+	// EstimatedTimeToReady is how much longer the model is expected to take
+	// to load, based on how quickly it has loaded so far. It is only set
+	// once some of a loading model has been loaded.
+	EstimatedTimeToReady *Duration `json:"estimated_time_to_ready,omitempty"`
+}
+
+// CancelRequest is the request passed to [Client.Cancel].
+type CancelRequest struct {
+	// RequestID is the ID sent in the first response of a streamed generate
+	// or chat request.
+	RequestID string `json:"request_id"`
+}
+
 // ShowRequest is the request passed to [Client.Show].
 type ShowRequest struct {
 	Model  string `json:"model"`
@@ -404,12 +1049,90 @@ type ShowResponse struct {
 	Tensors       []Tensor           `json:"tensors,omitempty"`
 	Capabilities  []model.Capability `json:"capabilities,omitempty"`
 	ModifiedAt    time.Time          `json:"modified_at,omitempty"`
+	Architecture  *ArchitectureInfo  `json:"architecture,omitempty"`
+
+	// TrainCtx is the context length the model was trained with.
+	TrainCtx int `json:"train_ctx,omitempty"`
+
+	// BitsPerWeight is the average size of the model's weights in bits,
+	// over all of its tensors.
+	BitsPerWeight float64 `json:"bits_per_weight,omitempty"`
+
+	// Quantization breaks the model's tensors down by type, largest first.
+	// Models are often quantized with a mix of types, so this can differ
+	// from the quantization level in Details.
+	Quantization []QuantizationType `json:"quantization,omitempty"`
+}
+
+// QuantizationType describes the tensors of a model that have the same type.
+type QuantizationType struct {
+	Type          string  `json:"type"`
+	Tensors       int     `json:"tensors"`
+	Parameters    uint64  `json:"parameters"`
+	Size          uint64  `json:"size"`
+	BitsPerWeight float64 `json:"bits_per_weight"`
+}
+
+// ArchitectureInfo describes the structure of a model, derived from its
+// metadata.
+type ArchitectureInfo struct {
+	Name            string `json:"name"`
+	BlockCount      uint64 `json:"block_count,omitempty"`
+	EmbeddingLength uint64 `json:"embedding_length,omitempty"`
+	NumHeads        uint64 `json:"num_heads,omitempty"`
+	NumKVHeads      uint64 `json:"num_kv_heads,omitempty"`
+	HeadDim         uint64 `json:"head_dim,omitempty"`
+
+	// CrossAttentionLayers lists the layers that attend to vision inputs
+	// for models such as mllama.
+	CrossAttentionLayers []int32 `json:"cross_attention_layers,omitempty"`
+}
+
+// OptionsRequest is the request passed to [Client.Options].
+type OptionsRequest struct {
+	Model string `json:"model"`
+
+	// Options are merged into the model's default options, which the options
+	// of each request are merged over in turn. An option set to nil is
+	// removed, so the server's default applies again. If Options is empty,
+	// the defaults are left as they are.
+	Options map[string]any `json:"options,omitempty"`
+}
+
+// OptionsResponse is the response returned by [Client.Options].
+type OptionsResponse struct {
+	Model string `json:"model"`
+
+	// Options are the model's default options after the request.
+	Options map[string]any `json:"options"`
 }
 
 // CopyRequest is the request passed to [Client.Copy].
 type CopyRequest struct {
 	Source      string `json:"source"`
 	Destination string `json:"destination"`
+
+	// Quantize, if set, quantizes the source model's weights to this type
+	// (e.g. "q4_K_M") while copying instead of copying them by reference.
+	Quantize string `json:"quantize,omitempty"`
+
+	// Stream, when quantizing, streams progress responses. Defaults to true.
+	Stream *bool `json:"stream,omitempty"`
+}
+
+// AliasRequest is the request passed to [Client.Alias].
+type AliasRequest struct {
+	// Alias is the name the model can be used by. It can't be the name of
+	// an existing model.
+	Alias string `json:"alias"`
+
+	// Model is the model the alias resolves to.
+	Model string `json:"model"`
+}
+
+// DeleteAliasRequest is the request passed to [Client.DeleteAlias].
+type DeleteAliasRequest struct {
+	Alias string `json:"alias"`
 }
 
 // PullRequest is the request passed to [Client.Pull].
@@ -420,10 +1143,23 @@ type PullRequest struct {
 	Password string `json:"password"`           // Deprecated: ignored
 	Stream   *bool  `json:"stream,omitempty"`
 
+	// Webhook is a URL the server posts a [PullWebhook] to once the pull
+	// succeeds or fails. The pull continues even if the client disconnects.
+	Webhook string `json:"webhook,omitempty"`
+
 	// Deprecated: set the model name with Model instead
 	Name string `json:"name"`
 }
 
+// PullWebhook is the body of the request posted to [PullRequest.Webhook].
+type PullWebhook struct {
+	Model string `json:"model"`
+
+	// Status is "success" or "error"
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
 // ProgressResponse is the response passed to progress functions like
 // [PullProgressFunc] and [PushProgressFunc].
 type ProgressResponse struct {
@@ -433,6 +1169,39 @@ type ProgressResponse struct {
 	Completed int64  `json:"completed,omitempty"`
 }
 
+// ManifestRequest is the request passed to [Client.Manifest].
+type ManifestRequest struct {
+	// Model is the name of the model in its registry.
+	Model string `json:"model"`
+
+	// Insecure allows the manifest to be fetched over HTTP.
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// ManifestResponse is the response returned from [Client.Manifest].
+type ManifestResponse struct {
+	Model  string          `json:"model"`
+	Layers []ManifestLayer `json:"layers"`
+
+	// TotalSize is the combined size of all layers in bytes.
+	TotalSize int64 `json:"total_size"`
+
+	// MissingSize is the combined size in bytes of the layers that are not
+	// present locally, i.e. how much a pull would download.
+	MissingSize int64 `json:"missing_size"`
+}
+
+// ManifestLayer is a single blob referenced by a model's manifest. The model's
+// config is included as a layer.
+type ManifestLayer struct {
+	MediaType string `json:"media_type"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+
+	// Local reports whether the blob is already present locally.
+	Local bool `json:"local"`
+}
+
 // PushRequest is the request passed to [Client.Push].
 type PushRequest struct {
 	Model    string `json:"model"`
@@ -463,6 +1232,10 @@ type ListModelResponse struct {
 	Size       int64        `json:"size"`
 	Digest     string       `json:"digest"`
 	Details    ModelDetails `json:"details,omitempty"`
+
+	// ContextLength is the context length the model was trained with, if
+	// known.
+	ContextLength uint64 `json:"context_length,omitempty"`
 }
 
 // ProcessModelResponse is a single model description in [ProcessResponse].
@@ -474,6 +1247,38 @@ type ProcessModelResponse struct {
 	Details   ModelDetails `json:"details,omitempty"`
 	ExpiresAt time.Time    `json:"expires_at"`
 	SizeVRAM  int64        `json:"size_vram"`
+
+	// ExpiresIn is the time left before the model is unloaded, or -1 if it
+	// is kept loaded indefinitely. A model in use doesn't start counting
+	// down until its last request completes.
+	ExpiresIn Duration `json:"expires_in"`
+
+	// ContextUsed is the number of tokens currently held in the model's
+	// context across all parallel requests, out of ContextTotal.
+	ContextUsed  int `json:"context_used"`
+	ContextTotal int `json:"context_total"`
+
+	// VRAMBytes is the GPU memory used by the model and GPULayers the number
+	// of its layers offloaded to the GPU. Unlike SizeVRAM, these are
+	// reported by the running model rather than estimated when it loaded,
+	// where the engine supports it.
+	VRAMBytes uint64 `json:"vram_bytes"`
+	GPULayers int    `json:"gpu_layers"`
+
+	// GPULayerRanges lists the layers offloaded to the GPU in the same form
+	// as [Runner.GPULayerRanges].
+	GPULayerRanges string `json:"gpu_layer_ranges,omitempty"`
+
+	// NumParallel is the number of requests the model can process at the
+	// same time. This may be lower than requested if there was not enough
+	// memory.
+	NumParallel int `json:"num_parallel"`
+
+	// Preloaded is set for models loaded at startup by OLLAMA_PRELOAD, which
+	// stay loaded unless another model needs their memory. Priority orders
+	// them when one has to be unloaded, lowest first.
+	Preloaded bool `json:"preloaded,omitempty"`
+	Priority  int  `json:"priority,omitempty"`
 }
 
 type TokenResponse struct {
@@ -491,6 +1296,16 @@ type GenerateResponse struct {
 	// Response is the textual response itself.
 	Response string `json:"response"`
 
+	// RequestID identifies the request for [Client.Cancel]. It is only set
+	// on the first response of a streamed request.
+	RequestID string `json:"request_id,omitempty"`
+
+	// Bytes is the raw text of the tokens generated for this response when
+	// [Options.Bytes] is set. Unlike Response, it is not held back until it
+	// forms complete UTF-8 characters, so a character may be split across
+	// responses.
+	Bytes []byte `json:"bytes,omitempty"`
+
 	// Thinking contains the text that was inside thinking tags in the
 	// original model output when ChatRequest.Think is enabled.
 	Thinking string `json:"thinking,omitempty"`
@@ -501,10 +1316,194 @@ type GenerateResponse struct {
 	// DoneReason is the reason the model stopped generating text.
 	DoneReason string `json:"done_reason,omitempty"`
 
+	// StopSequence is the stop sequence that ended generation, if any.
+	StopSequence string `json:"stop_sequence,omitempty"`
+
+	// StoppedAt is the text that ended generation: the stop sequence that
+	// matched, or else the text of the token, such as the model's EOS token
+	// or one of the stop_tokens, that was sampled. It is only set on the
+	// final response.
+	StoppedAt string `json:"stopped_at,omitempty"`
+
 	// Context is an encoding of the conversation used in this response; this
 	// can be sent in the next request to keep a conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Index is which of the responses requested with the n option this
+	// belongs to. Each of them ends with its own final response.
+	Index int `json:"index,omitempty"`
+
+	// Fingerprint identifies the model, version of Ollama and load options
+	// that generated the response. The same seed may not reproduce a
+	// response when it changes.
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Seed is the seed used for sampling. If the request did not set a seed,
+	// this is the one the server chose. It is only set on the final response.
+	Seed int `json:"seed,omitempty"`
+
+	// Warning describes a problem with the request that didn't stop it,
+	// such as num_ctx being limited to the model's trained context. It is
+	// only set on the final response.
+	Warning string `json:"warning,omitempty"`
+
+	// PromptTokens are the token IDs of the prompt after the template has
+	// been applied. It is only set on the final response and only if the
+	// return_prompt_tokens option is set.
+	PromptTokens []int `json:"prompt_tokens,omitempty"`
+
+	// Logits are the raw logits, before sampling, that the last generated
+	// token was sampled from, with one for each token in the vocabulary. It
+	// is only set on the final response and only if the return_logits option
+	// is set.
+	Logits []float32 `json:"logits,omitempty"`
+
+	// Logprobs are the log probabilities of the tokens generated for this
+	// response, if the logprobs option is set.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
+	// PromptEvalProgress is set on responses sent while the prompt is still
+	// being processed, before the first token is generated.
+	PromptEvalProgress *PromptEvalProgress `json:"prompt_eval_progress,omitempty"`
+
+	Metrics
+}
+
+// TokenLogprob is the log probability of a token at a position in the
+// generated text.
+type TokenLogprob struct {
+	ID    int    `json:"id"`
+	Token string `json:"token"`
+
+	// Logprob is the natural log of the token's probability under the
+	// model's distribution, before sampling options such as temperature or
+	// logit_bias are applied.
+	Logprob float64 `json:"logprob"`
+
+	// Logit is the raw score the model gave the token, which the log
+	// probability is normalized from. It is only set if the raw_logits
+	// option is set.
+	Logit *float32 `json:"logit,omitempty"`
+}
+
+// Logprob is the log probability of a generated token, with those of the
+// most likely tokens at its position if the top_logprobs option is set.
+type Logprob struct {
+	TokenLogprob
+	TopLogprobs []TokenLogprob `json:"top_logprobs,omitempty"`
+}
+
+// PromptEvalProgress reports how many prompt tokens have been processed.
+// Tokens reused from the cache count as processed.
+type PromptEvalProgress struct {
+	Processed int `json:"processed"`
+	Total     int `json:"total"`
+}
+
+// BatchGenerateRequest describes a request sent by [Client.GenerateBatch] to
+// generate responses to many prompts with one model. The prompts are run
+// concurrently, so the runner can batch as many of them as it has parallel
+// slots for.
+type BatchGenerateRequest struct {
+	// Model is the model name; it should be a name familiar to Ollama from
+	// the library at https://ollama.com/library
+	Model string `json:"model"`
+
+	// Prompts are the prompts to respond to. In JSON each may be a string or
+	// an object with options of its own.
+	Prompts []BatchPrompt `json:"prompts"`
+
+	// System overrides the model's default system message/prompt for every
+	// prompt that doesn't set its own.
+	System string `json:"system,omitempty"`
+
+	// Raw set to true means that no formatting will be applied to the prompts.
+	Raw bool `json:"raw,omitempty"`
+
+	// Stream specifies whether each response is sent as soon as its prompt
+	// is done, rather than all of them in order once every prompt is done.
+	Stream *bool `json:"stream,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory
+	// following this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Options lists model-specific options shared by every prompt.
+	Options map[string]any `json:"options"`
+}
+
+// BatchPrompt is one of the prompts of a [BatchGenerateRequest].
+type BatchPrompt struct {
+	Prompt string `json:"prompt"`
+
+	// System overrides the system message of the request for this prompt.
+	System string `json:"system,omitempty"`
+
+	// Options take precedence over the options of the request for this
+	// prompt. Options that affect how the model is loaded, such as num_ctx,
+	// must be the same for every prompt.
+	Options map[string]any `json:"options,omitempty"`
+}
+
+func (p *BatchPrompt) UnmarshalJSON(b []byte) error {
+	var prompt string
+	if err := json.Unmarshal(b, &prompt); err == nil {
+		*p = BatchPrompt{Prompt: prompt}
+		return nil
+	}
+
+	type Alias BatchPrompt
+	var a Alias
+	if err := json.Unmarshal(b, &a); err != nil {
+		return err
+	}
+
+	*p = BatchPrompt(a)
+	return nil
+}
+
+// BatchGenerateResponse is the response passed into [BatchGenerateResponseFunc].
+type BatchGenerateResponse struct {
+	// Model is the model name that generated the responses.
+	Model string `json:"model"`
+
+	// CreatedAt is the timestamp of the response.
+	CreatedAt time.Time `json:"created_at"`
+
+	// Responses are the responses to the prompts, in the order of the
+	// prompts. When streaming, each response but the last carries the
+	// response to a single prompt as soon as it's done.
+	Responses []BatchResponse `json:"responses,omitempty"`
+
+	// Done specifies if every prompt has been responded to.
+	Done bool `json:"done"`
+
+	// TotalDuration and LoadDuration are only set once done.
+	TotalDuration time.Duration `json:"total_duration,omitempty"`
+	LoadDuration  time.Duration `json:"load_duration,omitempty"`
+}
+
+// BatchResponse is the response to one of the prompts of a
+// [BatchGenerateRequest].
+type BatchResponse struct {
+	// Index is the position of the prompt in the request.
+	Index int `json:"index"`
+
+	// Response is the textual response itself.
+	Response string `json:"response"`
+
+	// DoneReason is the reason the model stopped generating text.
+	DoneReason string `json:"done_reason,omitempty"`
+
+	// StoppedAt is the text that ended generation, as in [GenerateResponse].
+	StoppedAt string `json:"stopped_at,omitempty"`
+
+	// Error is why the prompt failed, if it did. A failed prompt doesn't
+	// stop the others.
+	Error string `json:"error,omitempty"`
+
+	// Metrics are those of the prompt's own response. The durations of the
+	// batch as a whole are reported with the final [BatchGenerateResponse].
 	Metrics
 }
 
@@ -538,6 +1537,10 @@ func (m *Metrics) Summary() {
 		fmt.Fprintf(os.Stderr, "prompt eval count:    %d token(s)\n", m.PromptEvalCount)
 	}
 
+	if m.CachedPromptTokens > 0 {
+		fmt.Fprintf(os.Stderr, "cached prompt:        %d token(s)\n", m.CachedPromptTokens)
+	}
+
 	if m.PromptEvalDuration > 0 {
 		fmt.Fprintf(os.Stderr, "prompt eval duration: %s\n", m.PromptEvalDuration)
 		fmt.Fprintf(os.Stderr, "prompt eval rate:     %.2f tokens/s\n", float64(m.PromptEvalCount)/m.PromptEvalDuration.Seconds())
@@ -551,6 +1554,10 @@ func (m *Metrics) Summary() {
 		fmt.Fprintf(os.Stderr, "eval duration:        %s\n", m.EvalDuration)
 		fmt.Fprintf(os.Stderr, "eval rate:            %.2f tokens/s\n", float64(m.EvalCount)/m.EvalDuration.Seconds())
 	}
+
+	if m.DraftTokens > 0 {
+		fmt.Fprintf(os.Stderr, "draft acceptance:     %.2f%% (%d/%d token(s))\n", m.DraftAcceptanceRate*100, m.AcceptedDraftTokens, m.DraftTokens)
+	}
 }
 
 func (opts *Options) FromMap(m map[string]any) error {
@@ -585,7 +1592,11 @@ func (opts *Options) FromMap(m map[string]any) error {
 				case int64:
 					field.SetInt(t)
 				case float64:
-					// when JSON unmarshals numbers, it uses float64, not int
+					// when JSON unmarshals numbers, it uses float64, not int,
+					// but a fractional number isn't truncated to one
+					if t != math.Trunc(t) {
+						return fmt.Errorf("option %q must be of type integer, got %v", key, t)
+					}
 					field.SetInt(int64(t))
 				default:
 					return fmt.Errorf("option %q must be of type integer", key)
@@ -615,6 +1626,43 @@ func (opts *Options) FromMap(m map[string]any) error {
 				if !ok {
 					return fmt.Errorf("option %q must be of type array", key)
 				}
+				if field.Type().Elem().Kind() == reflect.Int {
+					// convert []any to []int
+					slice := make([]int, len(val))
+					for i, item := range val {
+						switch t := item.(type) {
+						case int64:
+							slice[i] = int(t)
+						case float64:
+							if t != math.Trunc(t) {
+								return fmt.Errorf("option %q must be of an array of integers, got %v", key, t)
+							}
+							slice[i] = int(t)
+						default:
+							return fmt.Errorf("option %q must be of an array of integers", key)
+						}
+					}
+					field.Set(reflect.ValueOf(slice))
+					break
+				}
+
+				if field.Type().Elem().Kind() == reflect.Float32 {
+					// convert []any to []float32
+					slice := make([]float32, len(val))
+					for i, item := range val {
+						switch t := item.(type) {
+						case float64:
+							slice[i] = float32(t)
+						case int64:
+							slice[i] = float32(t)
+						default:
+							return fmt.Errorf("option %q must be of an array of numbers", key)
+						}
+					}
+					field.Set(reflect.ValueOf(slice))
+					break
+				}
+
 				// convert []any to []string
 				slice := make([]string, len(val))
 				for i, item := range val {
@@ -625,6 +1673,25 @@ func (opts *Options) FromMap(m map[string]any) error {
 					slice[i] = str
 				}
 				field.Set(reflect.ValueOf(slice))
+			case reflect.Map:
+				// JSON unmarshals to map[string]any with token IDs as keys
+				val, ok := val.(map[string]any)
+				if !ok {
+					return fmt.Errorf("option %q must be of type object", key)
+				}
+				m := make(map[int]float32, len(val))
+				for k, v := range val {
+					id, err := strconv.Atoi(k)
+					if err != nil {
+						return fmt.Errorf("option %q must have token IDs as keys, got %q", key, k)
+					}
+					f, ok := v.(float64)
+					if !ok {
+						return fmt.Errorf("option %q must have numbers as values", key)
+					}
+					m[id] = float32(f)
+				}
+				field.Set(reflect.ValueOf(m))
 			case reflect.Pointer:
 				var b bool
 				if field.Type() == reflect.TypeOf(&b) {
@@ -642,6 +1709,314 @@ func (opts *Options) FromMap(m map[string]any) error {
 		}
 	}
 
+	return opts.validate()
+}
+
+// ParseLayerRanges parses [Runner.GPULayerRanges] into sorted, unique layer
+// numbers.
+func ParseLayerRanges(s string) ([]int, error) {
+	var layers []int
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		start, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil || start < 0 || start > maxLayer {
+			return nil, fmt.Errorf("invalid layer %q", strings.TrimSpace(part))
+		}
+
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(strings.TrimSpace(last))
+			if err != nil || end < start || end > maxLayer {
+				return nil, fmt.Errorf("invalid layer range %q", strings.TrimSpace(part))
+			}
+		}
+
+		for i := start; i <= end; i++ {
+			layers = append(layers, i)
+		}
+	}
+
+	slices.Sort(layers)
+	return slices.Compact(layers), nil
+}
+
+// FormatLayerRanges formats sorted layer numbers in the form parsed by
+// [ParseLayerRanges], joining consecutive layers into ranges.
+func FormatLayerRanges(layers []int) string {
+	var parts []string
+	for i := 0; i < len(layers); {
+		j := i + 1
+		for j < len(layers) && layers[j] == layers[j-1]+1 {
+			j++
+		}
+
+		if j-i == 1 {
+			parts = append(parts, strconv.Itoa(layers[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", layers[i], layers[j-1]))
+		}
+		i = j
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// TemperatureSchedule moves the temperature from Start to End over the first
+// Tokens tokens of a response, after which it stays at End.
+type TemperatureSchedule struct {
+	Start float32
+	End   float32
+
+	// Interpolation is how the temperature moves between Start and End:
+	// "linear", the default, or "cosine", which changes slowly near each
+	// end and fastest half way.
+	Interpolation string
+
+	// Tokens is the number of tokens the temperature moves over. If zero,
+	// it is the response's num_predict.
+	Tokens int
+}
+
+// ParseTemperatureSchedule parses an [Options.TemperatureSchedule] of comma
+// separated key=value pairs: start, end, and optionally interpolation and
+// tokens.
+func ParseTemperatureSchedule(s string) (TemperatureSchedule, error) {
+	schedule := TemperatureSchedule{Interpolation: "linear"}
+
+	var start, end bool
+	for part := range strings.SplitSeq(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return TemperatureSchedule{}, fmt.Errorf("expected key=value, got %q", strings.TrimSpace(part))
+		}
+
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "start", "end":
+			f, err := strconv.ParseFloat(value, 32)
+			if err != nil || f < 0 {
+				return TemperatureSchedule{}, fmt.Errorf("%s must be a temperature of at least 0, got %q", key, value)
+			}
+
+			if key == "start" {
+				schedule.Start, start = float32(f), true
+			} else {
+				schedule.End, end = float32(f), true
+			}
+		case "interpolation":
+			schedule.Interpolation = strings.ToLower(value)
+			if !slices.Contains(interpolations, schedule.Interpolation) {
+				return TemperatureSchedule{}, fmt.Errorf("interpolation must be one of %s, got %q", strings.Join(interpolations, ", "), value)
+			}
+		case "tokens":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return TemperatureSchedule{}, fmt.Errorf("tokens must not be negative, got %q", value)
+			}
+			schedule.Tokens = n
+		default:
+			return TemperatureSchedule{}, fmt.Errorf("unknown key %q", key)
+		}
+	}
+
+	if !start || !end {
+		return TemperatureSchedule{}, errors.New("start and end are required")
+	}
+
+	return schedule, nil
+}
+
+// Temperature returns the temperature of the token at position n of the
+// response, counting from 0.
+func (s TemperatureSchedule) Temperature(n int) float32 {
+	if n >= s.Tokens-1 {
+		return s.End
+	}
+
+	// the fraction of the way from the first token to the last
+	t := float64(n) / float64(s.Tokens-1)
+	if s.Interpolation == "cosine" {
+		t = (1 - math.Cos(math.Pi*t)) / 2
+	}
+
+	return s.Start + float32(t)*(s.End-s.Start)
+}
+
+// ParseGGUFOverride splits a [Runner.GGUFOverride] entry into its key and value.
+func ParseGGUFOverride(s string) (key, value string, ok bool) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return "", "", false
+	}
+
+	key, value = s[:i], strings.TrimSpace(s[i:])
+	return key, value, value != ""
+}
+
+// validate checks option values that cannot be expressed by their type alone.
+func (opts *Options) validate() error {
+	if opts.CacheType != "" {
+		opts.CacheType = strings.ToLower(opts.CacheType)
+		if !slices.Contains(cacheTypes, opts.CacheType) {
+			return fmt.Errorf("option \"cache_type\" must be one of %s, got %q", strings.Join(cacheTypes, ", "), opts.CacheType)
+		}
+	}
+
+	if opts.MinP < 0 || opts.MinP > 1 {
+		return fmt.Errorf("option \"min_p\" must be between 0 and 1, got %v", opts.MinP)
+	}
+
+	if opts.Pooling != "" {
+		opts.Pooling = strings.ToLower(opts.Pooling)
+		if !slices.Contains(poolingTypes, opts.Pooling) {
+			return fmt.Errorf("option \"pooling\" must be one of %s, got %q", strings.Join(poolingTypes, ", "), opts.Pooling)
+		}
+	}
+
+	if opts.ImageDetail != "" {
+		opts.ImageDetail = strings.ToLower(opts.ImageDetail)
+		if !slices.Contains(imageDetails, opts.ImageDetail) {
+			return fmt.Errorf("option \"image_detail\" must be one of %s, got %q", strings.Join(imageDetails, ", "), opts.ImageDetail)
+		}
+	}
+
+	if opts.Mirostat < 0 || opts.Mirostat > 2 {
+		return fmt.Errorf("option \"mirostat\" must be 0 (disabled), 1 or 2, got %d", opts.Mirostat)
+	}
+
+	if opts.MirostatTau <= 0 {
+		return fmt.Errorf("option \"mirostat_tau\" must be greater than 0, got %v", opts.MirostatTau)
+	}
+
+	if opts.MirostatEta <= 0 {
+		return fmt.Errorf("option \"mirostat_eta\" must be greater than 0, got %v", opts.MirostatEta)
+	}
+
+	if opts.NumParallel < 0 {
+		return fmt.Errorf("option \"num_parallel\" must not be negative, got %d", opts.NumParallel)
+	}
+
+	// as with num_thread, zero num_batch leaves the default
+	if opts.NumBatch == 0 {
+		opts.NumBatch = DefaultOptions().NumBatch
+	}
+
+	if opts.NumBatch < 0 {
+		return fmt.Errorf("option \"num_batch\" must not be negative, got %d", opts.NumBatch)
+	}
+
+	if opts.NumThread < 0 {
+		return fmt.Errorf("option \"num_thread\" must not be negative, got %d", opts.NumThread)
+	}
+
+	if opts.TypicalP < 0 || opts.TypicalP > 1 {
+		return fmt.Errorf("option \"typical_p\" must be between 0 and 1, got %v", opts.TypicalP)
+	}
+
+	if opts.PresencePenalty < -2 || opts.PresencePenalty > 2 {
+		return fmt.Errorf("option \"presence_penalty\" must be between -2 and 2, got %v", opts.PresencePenalty)
+	}
+
+	if opts.FrequencyPenalty < -2 || opts.FrequencyPenalty > 2 {
+		return fmt.Errorf("option \"frequency_penalty\" must be between -2 and 2, got %v", opts.FrequencyPenalty)
+	}
+
+	if opts.KeepTokens < -1 {
+		return fmt.Errorf("option \"keep_tokens\" must be -1 (whole prompt) or greater, got %d", opts.KeepTokens)
+	}
+
+	if opts.RepeatLastN < -1 {
+		return fmt.Errorf("option \"repeat_last_n\" must be -1 (whole context), 0 (disabled) or greater, got %d", opts.RepeatLastN)
+	}
+
+	if opts.RopeScalingType != "" {
+		opts.RopeScalingType = strings.ToLower(opts.RopeScalingType)
+		if !slices.Contains(ropeScalingTypes, opts.RopeScalingType) {
+			return fmt.Errorf("option \"rope_scaling_type\" must be one of %s, got %q", strings.Join(ropeScalingTypes, ", "), opts.RopeScalingType)
+		}
+
+		if opts.RopeFrequencyScale == 0 {
+			return fmt.Errorf("option \"rope_scaling_type\" requires \"rope_frequency_scale\" to be set")
+		}
+	}
+
+	if opts.RopeFrequencyScale < 0 || opts.RopeFrequencyScale > 1 {
+		return fmt.Errorf("option \"rope_frequency_scale\" must be between 0 and 1, got %v", opts.RopeFrequencyScale)
+	}
+
+	for _, factor := range opts.RopeFactors {
+		if factor <= 0 {
+			return fmt.Errorf("option \"rope_factors\" must be positive, got %v", factor)
+		}
+	}
+
+	for id, bias := range opts.LogitBias {
+		if id < 0 {
+			return fmt.Errorf("option \"logit_bias\" token IDs must not be negative, got %d", id)
+		}
+		if bias < -100 || bias > 100 {
+			return fmt.Errorf("option \"logit_bias\" values must be between -100 and 100, got %v for token %d", bias, id)
+		}
+	}
+
+	for _, id := range opts.StopTokens {
+		if id < 0 {
+			return fmt.Errorf("option \"stop_tokens\" token IDs must not be negative, got %d", id)
+		}
+	}
+
+	if opts.N < 0 {
+		return fmt.Errorf("option \"n\" must not be negative, got %d", opts.N)
+	}
+
+	if opts.TopLogprobs < 0 || opts.TopLogprobs > 20 {
+		return fmt.Errorf("option \"top_logprobs\" must be between 0 and 20, got %d", opts.TopLogprobs)
+	}
+
+	if opts.TopLogprobs > 0 && !opts.Logprobs {
+		return fmt.Errorf("option \"top_logprobs\" requires \"logprobs\" to be set")
+	}
+
+	if opts.RawLogits && !opts.Logprobs {
+		return fmt.Errorf("option \"raw_logits\" requires \"logprobs\" to be set")
+	}
+
+	if opts.GuidanceScale < 1 {
+		return fmt.Errorf("option \"guidance_scale\" must be at least 1, got %v", opts.GuidanceScale)
+	}
+
+	if slices.Contains(opts.Choices, "") {
+		return fmt.Errorf("option \"choices\" must not contain empty strings")
+	}
+
+	if opts.TemperatureSchedule != "" {
+		schedule, err := ParseTemperatureSchedule(opts.TemperatureSchedule)
+		if err != nil {
+			return fmt.Errorf("option \"temperature_schedule\" is invalid: %w", err)
+		}
+
+		if schedule.Tokens == 0 && opts.NumPredict <= 0 {
+			return fmt.Errorf("option \"temperature_schedule\" requires tokens or \"num_predict\" to be set")
+		}
+	}
+
+	if opts.GPULayerRanges != "" {
+		if _, err := ParseLayerRanges(opts.GPULayerRanges); err != nil {
+			return fmt.Errorf("option \"gpu_layer_ranges\" is invalid: %w", err)
+		}
+	}
+
+	if opts.ForceGPULayers && opts.NumGPU < 0 {
+		return fmt.Errorf("option \"force_gpu_layers\" requires \"num_gpu\" to be set")
+	}
+
+	for _, override := range opts.GGUFOverride {
+		if _, _, ok := ParseGGUFOverride(override); !ok {
+			return fmt.Errorf("option \"gguf_override\" must be a key and value separated by whitespace, got %q", override)
+		}
+	}
+
 	return nil
 }
 
@@ -662,7 +2037,11 @@ func DefaultOptions() Options {
 		RepeatPenalty:    1.1,
 		PresencePenalty:  0.0,
 		FrequencyPenalty: 0.0,
+		Mirostat:         0,
+		MirostatTau:      5.0,
+		MirostatEta:      0.1,
 		Seed:             -1,
+		GuidanceScale:    1.0,
 
 		Runner: Runner{
 			// options set when the model is loaded
@@ -764,8 +2143,50 @@ func FormatParams(params map[string][]string) (map[string]any, error) {
 				case reflect.String:
 					out[key] = vals[0]
 				case reflect.Slice:
-					// TODO: only string slices are supported right now
-					out[key] = vals
+					if field.Type().Elem().Kind() == reflect.Float32 {
+						// each value is a single number, such as a RoPE factor
+						floats := make([]any, len(vals))
+						for i, val := range vals {
+							floatVal, err := strconv.ParseFloat(val, 32)
+							if err != nil {
+								return nil, fmt.Errorf("invalid float value %s", val)
+							}
+							floats[i] = floatVal
+						}
+						out[key] = floats
+						break
+					}
+
+					if field.Type().Elem().Kind() != reflect.Int {
+						out[key] = vals
+						break
+					}
+
+					// each value is a single integer, such as a token ID
+					ints := make([]any, len(vals))
+					for i, val := range vals {
+						intVal, err := strconv.ParseInt(val, 10, 64)
+						if err != nil {
+							return nil, fmt.Errorf("invalid int value %s", val)
+						}
+						ints[i] = intVal
+					}
+					out[key] = ints
+				case reflect.Map:
+					// each value is a token ID and bias separated by whitespace
+					m := make(map[string]any, len(vals))
+					for _, val := range vals {
+						fields := strings.Fields(val)
+						if len(fields) != 2 {
+							return nil, fmt.Errorf("invalid %s value %q; expected a token ID and a bias", key, val)
+						}
+						floatVal, err := strconv.ParseFloat(fields[1], 32)
+						if err != nil {
+							return nil, fmt.Errorf("invalid float value %s", fields[1])
+						}
+						m[fields[0]] = floatVal
+					}
+					out[key] = m
 				case reflect.Pointer:
 					var b bool
 					if field.Type() == reflect.TypeOf(&b) {
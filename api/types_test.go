@@ -32,6 +32,16 @@ func TestKeepAliveParsingFromJSON(t *testing.T) {
 			req:  `{ "keep_alive": "42m" }`,
 			exp:  &Duration{42 * time.Minute},
 		},
+		{
+			name: "Zero",
+			req:  `{ "keep_alive": 0 }`,
+			exp:  &Duration{0},
+		},
+		{
+			name: "Zero String",
+			req:  `{ "keep_alive": "0s" }`,
+			exp:  &Duration{0},
+		},
 		{
 			name: "Negative Integer",
 			req:  `{ "keep_alive": -1 }`,
@@ -419,3 +429,996 @@ func TestThinking_UnmarshalJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestCacheTypeFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  string
+		err  bool
+	}{
+		{
+			name: "Undefined",
+			req:  `{ }`,
+			exp:  "",
+		},
+		{
+			name: "Valid",
+			req:  `{ "cache_type": "q8_0" }`,
+			exp:  "q8_0",
+		},
+		{
+			name: "Uppercase",
+			req:  `{ "cache_type": "Q4_0" }`,
+			exp:  "q4_0",
+		},
+		{
+			name: "Invalid",
+			req:  `{ "cache_type": "q2_k" }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, opts.CacheType)
+		})
+	}
+}
+
+func TestPoolingFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  string
+		err  bool
+	}{
+		{
+			name: "Undefined",
+			req:  `{ }`,
+			exp:  "",
+		},
+		{
+			name: "Valid",
+			req:  `{ "pooling": "cls" }`,
+			exp:  "cls",
+		},
+		{
+			name: "Uppercase",
+			req:  `{ "pooling": "MEAN" }`,
+			exp:  "mean",
+		},
+		{
+			name: "Invalid",
+			req:  `{ "pooling": "max" }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, opts.Pooling)
+		})
+	}
+}
+
+func TestImageDetailFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  string
+		err  bool
+	}{
+		{
+			name: "Undefined",
+			req:  `{ }`,
+			exp:  "",
+		},
+		{
+			name: "Valid",
+			req:  `{ "image_detail": "low" }`,
+			exp:  "low",
+		},
+		{
+			name: "Uppercase",
+			req:  `{ "image_detail": "HIGH" }`,
+			exp:  "high",
+		},
+		{
+			name: "Invalid",
+			req:  `{ "image_detail": "medium" }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, opts.ImageDetail)
+		})
+	}
+}
+
+func TestMirostatFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  int
+		err  bool
+	}{
+		{
+			name: "Default",
+			req:  `{ }`,
+			exp:  0,
+		},
+		{
+			name: "Mirostat 2.0",
+			req:  `{ "mirostat": 2, "mirostat_tau": 3.0, "mirostat_eta": 0.2 }`,
+			exp:  2,
+		},
+		{
+			name: "Invalid mode",
+			req:  `{ "mirostat": 3 }`,
+			err:  true,
+		},
+		{
+			name: "Zero tau",
+			req:  `{ "mirostat": 2, "mirostat_tau": 0 }`,
+			err:  true,
+		},
+		{
+			name: "Negative eta",
+			req:  `{ "mirostat": 1, "mirostat_eta": -0.1 }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, opts.Mirostat)
+		})
+	}
+}
+
+func TestMinPFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  float32
+		err  bool
+	}{
+		{
+			name: "Disabled",
+			req:  `{ "min_p": 0 }`,
+			exp:  0,
+		},
+		{
+			name: "Valid",
+			req:  `{ "min_p": 0.05 }`,
+			exp:  0.05,
+		},
+		{
+			name: "Upper bound",
+			req:  `{ "min_p": 1 }`,
+			exp:  1,
+		},
+		{
+			name: "Negative",
+			req:  `{ "min_p": -0.1 }`,
+			err:  true,
+		},
+		{
+			name: "Too large",
+			req:  `{ "min_p": 1.5 }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.InDelta(t, test.exp, opts.MinP, 1e-6)
+		})
+	}
+}
+
+func TestTypicalPFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  float32
+		err  bool
+	}{
+		{
+			name: "Default",
+			req:  `{}`,
+			exp:  1,
+		},
+		{
+			name: "Valid",
+			req:  `{ "typical_p": 0.7 }`,
+			exp:  0.7,
+		},
+		{
+			name: "Lower bound",
+			req:  `{ "typical_p": 0 }`,
+			exp:  0,
+		},
+		{
+			name: "Negative",
+			req:  `{ "typical_p": -0.1 }`,
+			err:  true,
+		},
+		{
+			name: "Too large",
+			req:  `{ "typical_p": 1.1 }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.InDelta(t, test.exp, opts.TypicalP, 1e-6)
+		})
+	}
+}
+
+func TestPenaltiesFromMap(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       string
+		presence  float32
+		frequency float32
+		err       bool
+	}{
+		{
+			name: "Default",
+			req:  `{}`,
+		},
+		{
+			name:      "Valid",
+			req:       `{ "presence_penalty": 1.5, "frequency_penalty": -0.5 }`,
+			presence:  1.5,
+			frequency: -0.5,
+		},
+		{
+			name:      "Bounds",
+			req:       `{ "presence_penalty": -2, "frequency_penalty": 2 }`,
+			presence:  -2,
+			frequency: 2,
+		},
+		{
+			name: "Presence too large",
+			req:  `{ "presence_penalty": 2.5 }`,
+			err:  true,
+		},
+		{
+			name: "Frequency too small",
+			req:  `{ "frequency_penalty": -2.5 }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.InDelta(t, test.presence, opts.PresencePenalty, 1e-6)
+			assert.InDelta(t, test.frequency, opts.FrequencyPenalty, 1e-6)
+		})
+	}
+}
+
+func TestParseLayerRanges(t *testing.T) {
+	tests := []struct {
+		in     string
+		layers []int
+		out    string
+		err    bool
+	}{
+		{in: "3", layers: []int{3}, out: "3"},
+		{in: "0-3", layers: []int{0, 1, 2, 3}, out: "0-3"},
+		{in: "8-9, 0-2,5", layers: []int{0, 1, 2, 5, 8, 9}, out: "0-2,5,8-9"},
+		{in: "0-2,1-3", layers: []int{0, 1, 2, 3}, out: "0-3"},
+		{in: "", err: true},
+		{in: "a", err: true},
+		{in: "-1", err: true},
+		{in: "3-1", err: true},
+		{in: "0-", err: true},
+		{in: "0-100000", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			layers, err := ParseLayerRanges(tt.in)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.layers, layers)
+			assert.Equal(t, tt.out, FormatLayerRanges(layers))
+		})
+	}
+}
+
+func TestGPULayerRangesFromMap(t *testing.T) {
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(map[string]any{"gpu_layer_ranges": "0-9,20-31"}))
+	assert.Equal(t, "0-9,20-31", opts.GPULayerRanges)
+
+	opts = DefaultOptions()
+	require.Error(t, opts.FromMap(map[string]any{"gpu_layer_ranges": "0-9,x"}))
+}
+
+func TestRopeScalingFromMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      string
+		expType  string
+		expScale float32
+		err      bool
+	}{
+		{
+			name: "Default",
+			req:  `{}`,
+		},
+		{
+			name:     "Scale only",
+			req:      `{ "rope_frequency_scale": 0.5 }`,
+			expScale: 0.5,
+		},
+		{
+			name:     "YaRN",
+			req:      `{ "rope_scaling_type": "YaRN", "rope_frequency_scale": 0.25 }`,
+			expType:  "yarn",
+			expScale: 0.25,
+		},
+		{
+			name: "Type without scale",
+			req:  `{ "rope_scaling_type": "linear" }`,
+			err:  true,
+		},
+		{
+			name: "Unknown type",
+			req:  `{ "rope_scaling_type": "ntk", "rope_frequency_scale": 0.5 }`,
+			err:  true,
+		},
+		{
+			name: "Scale too large",
+			req:  `{ "rope_frequency_scale": 2 }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expType, opts.RopeScalingType)
+			assert.InDelta(t, test.expScale, opts.RopeFrequencyScale, 1e-6)
+		})
+	}
+}
+
+func TestKeepTokensFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		keep int
+		err  bool
+	}{
+		{name: "Default", req: `{}`, keep: 4},
+		{name: "num_keep", req: `{ "num_keep": 8 }`, keep: 8},
+		{name: "keep_tokens", req: `{ "keep_tokens": 16 }`, keep: 16},
+		{name: "keep_tokens over num_keep", req: `{ "num_keep": 8, "keep_tokens": 16 }`, keep: 16},
+		{name: "Whole prompt", req: `{ "keep_tokens": -1 }`, keep: -1},
+		{name: "Negative", req: `{ "keep_tokens": -2 }`, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			require.NoError(t, json.Unmarshal([]byte(test.req), &oMap))
+			opts := DefaultOptions()
+			err := opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.keep, opts.Keep())
+		})
+	}
+}
+
+func TestValidateRopeScaling(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         Runner
+		arch         string
+		ollamaEngine bool
+		err          bool
+	}{
+		{name: "Unset", arch: "qwen2"},
+		{name: "Unset on llama.cpp", arch: "llama"},
+		{name: "llama", opts: Runner{RopeFrequencyScale: 0.5}, arch: "llama", ollamaEngine: true},
+		{name: "mllama", opts: Runner{RopeScalingType: "yarn", RopeFrequencyScale: 0.25}, arch: "mllama", ollamaEngine: true},
+		{name: "Other architecture", opts: Runner{RopeFrequencyScale: 0.5}, arch: "qwen2", ollamaEngine: true, err: true},
+		{name: "llama.cpp", opts: Runner{RopeScalingType: "yarn", RopeFrequencyScale: 0.25}, arch: "llama", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.opts.ValidateRopeScaling(test.arch, test.ollamaEngine)
+			if test.err {
+				require.ErrorIs(t, err, ErrRopeScalingUnsupported)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestLogitBiasFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  map[int]float32
+		err  bool
+	}{
+		{
+			name: "Default",
+			req:  `{}`,
+		},
+		{
+			name: "Valid",
+			req:  `{ "logit_bias": { "1234": -100, "42": 2.5 } }`,
+			exp:  map[int]float32{1234: -100, 42: 2.5},
+		},
+		{
+			name: "Non-numeric token ID",
+			req:  `{ "logit_bias": { "hello": -100 } }`,
+			err:  true,
+		},
+		{
+			name: "Negative token ID",
+			req:  `{ "logit_bias": { "-1": -100 } }`,
+			err:  true,
+		},
+		{
+			name: "Bias out of range",
+			req:  `{ "logit_bias": { "1234": -101 } }`,
+			err:  true,
+		},
+		{
+			name: "Not an object",
+			req:  `{ "logit_bias": [1234] }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, opts.LogitBias)
+		})
+	}
+}
+
+func TestGuidanceScaleFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  float32
+		err  bool
+	}{
+		{
+			name: "Default",
+			req:  `{}`,
+			exp:  1,
+		},
+		{
+			name: "Valid",
+			req:  `{ "negative_prompt": "sad", "guidance_scale": 1.5 }`,
+			exp:  1.5,
+		},
+		{
+			name: "Too small",
+			req:  `{ "negative_prompt": "sad", "guidance_scale": 0.5 }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.InDelta(t, test.exp, opts.GuidanceScale, 1e-6)
+		})
+	}
+}
+
+func TestChoicesFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  []string
+		err  bool
+	}{
+		{
+			name: "Default",
+			req:  `{}`,
+		},
+		{
+			name: "Valid",
+			req:  `{ "choices": ["no", "none"] }`,
+			exp:  []string{"no", "none"},
+		},
+		{
+			name: "Empty choice",
+			req:  `{ "choices": ["yes", ""] }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, opts.Choices)
+		})
+	}
+}
+
+func TestLogitBiasFormatParams(t *testing.T) {
+	params, err := FormatParams(map[string][]string{"logit_bias": {"1234 -100", "42\t2.5"}})
+	require.NoError(t, err)
+
+	// parameters are stored as JSON in the model config
+	bts, err := json.Marshal(params)
+	require.NoError(t, err)
+	var oMap map[string]any
+	require.NoError(t, json.Unmarshal(bts, &oMap))
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(oMap))
+	assert.Equal(t, map[int]float32{1234: -100, 42: 2.5}, opts.LogitBias)
+
+	_, err = FormatParams(map[string][]string{"logit_bias": {"1234"}})
+	require.Error(t, err)
+}
+
+func TestStopTokensFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  []int
+		err  bool
+	}{
+		{
+			name: "Default",
+			req:  `{}`,
+		},
+		{
+			name: "Valid",
+			req:  `{ "stop_tokens": [128009, 2] }`,
+			exp:  []int{128009, 2},
+		},
+		{
+			name: "Negative token ID",
+			req:  `{ "stop_tokens": [-1] }`,
+			err:  true,
+		},
+		{
+			name: "Not a token ID",
+			req:  `{ "stop_tokens": ["<|eot_id|>"] }`,
+			err:  true,
+		},
+		{
+			name: "Whole number",
+			req:  `{ "stop_tokens": [2.0] }`,
+			exp:  []int{2},
+		},
+		{
+			name: "Fractional token ID",
+			req:  `{ "stop_tokens": [2.5] }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, opts.StopTokens)
+		})
+	}
+}
+
+func TestStopTokensFormatParams(t *testing.T) {
+	params, err := FormatParams(map[string][]string{"stop_tokens": {"128009", "2"}})
+	require.NoError(t, err)
+
+	// parameters are stored as JSON in the model config
+	bts, err := json.Marshal(params)
+	require.NoError(t, err)
+	var oMap map[string]any
+	require.NoError(t, json.Unmarshal(bts, &oMap))
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(oMap))
+	assert.Equal(t, []int{128009, 2}, opts.StopTokens)
+
+	_, err = FormatParams(map[string][]string{"stop_tokens": {"<|eot_id|>"}})
+	require.Error(t, err)
+}
+
+func TestRopeFactorsFromMap(t *testing.T) {
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(map[string]any{"rope_factors": []any{1.0, 2.5, int64(4)}}))
+	assert.Equal(t, []float32{1, 2.5, 4}, opts.RopeFactors)
+
+	opts = DefaultOptions()
+	require.Error(t, opts.FromMap(map[string]any{"rope_factors": []any{1.0, 0.0}}))
+	require.Error(t, opts.FromMap(map[string]any{"rope_factors": []any{"1.0"}}))
+
+	params, err := FormatParams(map[string][]string{"rope_factors": {"1", "2.5"}})
+	require.NoError(t, err)
+
+	opts = DefaultOptions()
+	require.NoError(t, opts.FromMap(params))
+	assert.Equal(t, []float32{1, 2.5}, opts.RopeFactors)
+}
+
+func TestIntFromMap(t *testing.T) {
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(map[string]any{"num_ctx": float64(8192)}))
+	assert.Equal(t, 8192, opts.NumCtx)
+
+	// a fractional number isn't truncated
+	require.EqualError(t, opts.FromMap(map[string]any{"num_ctx": 2048.5}), `option "num_ctx" must be of type integer, got 2048.5`)
+}
+
+func TestRepeatLastNFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  int
+		err  bool
+	}{
+		{
+			name: "Default",
+			req:  `{ }`,
+			exp:  64,
+		},
+		{
+			name: "Whole context",
+			req:  `{ "repeat_last_n": -1 }`,
+			exp:  -1,
+		},
+		{
+			name: "Disabled",
+			req:  `{ "repeat_last_n": 0 }`,
+			exp:  0,
+		},
+		{
+			name: "Window",
+			req:  `{ "repeat_last_n": 1 }`,
+			exp:  1,
+		},
+		{
+			name: "Invalid",
+			req:  `{ "repeat_last_n": -2 }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, opts.RepeatLastN)
+		})
+	}
+}
+
+func TestThreadsAndBatchFromMap(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    string
+		thread int
+		batch  int
+		err    bool
+	}{
+		{
+			name:  "Default",
+			req:   `{ }`,
+			batch: 512,
+		},
+		{
+			name:   "Valid",
+			req:    `{ "num_thread": 8, "num_batch": 128 }`,
+			thread: 8,
+			batch:  128,
+		},
+		{
+			name: "Negative threads",
+			req:  `{ "num_thread": -1 }`,
+			err:  true,
+		},
+		{
+			name:  "Zero batch",
+			req:   `{ "num_batch": 0 }`,
+			batch: 512,
+		},
+		{
+			name: "Negative batch",
+			req:  `{ "num_batch": -1 }`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.thread, opts.NumThread)
+			assert.Equal(t, test.batch, opts.NumBatch)
+		})
+	}
+}
+
+func TestGGUFOverrideFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		req  map[string][]string
+		exp  []string
+		err  bool
+	}{
+		{
+			name: "Single",
+			req:  map[string][]string{"gguf_override": {"rope.freq_base 1000000"}},
+			exp:  []string{"rope.freq_base 1000000"},
+		},
+		{
+			name: "Multiple",
+			req:  map[string][]string{"gguf_override": {"rope.freq_base 1000000", "general.name\tfixed"}},
+			exp:  []string{"rope.freq_base 1000000", "general.name\tfixed"},
+		},
+		{
+			name: "Missing value",
+			req:  map[string][]string{"gguf_override": {"rope.freq_base"}},
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params, err := FormatParams(test.req)
+			require.NoError(t, err)
+
+			// parameters are stored as JSON in the model config
+			bts, err := json.Marshal(params)
+			require.NoError(t, err)
+			var oMap map[string]any
+			require.NoError(t, json.Unmarshal(bts, &oMap))
+
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, opts.GGUFOverride)
+		})
+	}
+}
+
+func TestParseGGUFOverride(t *testing.T) {
+	key, value, ok := ParseGGUFOverride("  rope.freq_base   1e6 ")
+	assert.True(t, ok)
+	assert.Equal(t, "rope.freq_base", key)
+	assert.Equal(t, "1e6", value)
+
+	_, _, ok = ParseGGUFOverride("rope.freq_base")
+	assert.False(t, ok)
+}
+
+func TestParseTemperatureSchedule(t *testing.T) {
+	tests := []struct {
+		in       string
+		schedule TemperatureSchedule
+		err      bool
+	}{
+		{in: "start=1.2,end=0.4", schedule: TemperatureSchedule{Start: 1.2, End: 0.4, Interpolation: "linear"}},
+		{in: " start = 0 , end=1, interpolation=Cosine, tokens=64", schedule: TemperatureSchedule{Start: 0, End: 1, Interpolation: "cosine", Tokens: 64}},
+		{in: "", err: true},
+		{in: "start=1", err: true},
+		{in: "end=1", err: true},
+		{in: "start=1,end", err: true},
+		{in: "start=-1,end=1", err: true},
+		{in: "start=a,end=1", err: true},
+		{in: "start=1,end=0,interpolation=step", err: true},
+		{in: "start=1,end=0,tokens=-1", err: true},
+		{in: "start=1,end=0,top_k=1", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			schedule, err := ParseTemperatureSchedule(tt.in)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.schedule, schedule)
+		})
+	}
+}
+
+func TestTemperatureScheduleTemperature(t *testing.T) {
+	linear := TemperatureSchedule{Start: 1, End: 0.2, Interpolation: "linear", Tokens: 5}
+	for n, want := range []float32{1, 0.8, 0.6, 0.4, 0.2, 0.2, 0.2} {
+		assert.InDelta(t, want, linear.Temperature(n), 1e-6, "linear at %d", n)
+	}
+
+	cosine := TemperatureSchedule{Start: 0, End: 1, Interpolation: "cosine", Tokens: 5}
+	for n, want := range []float32{0, 0.1464466, 0.5, 0.8535534, 1, 1} {
+		assert.InDelta(t, want, cosine.Temperature(n), 1e-6, "cosine at %d", n)
+	}
+
+	// a single token is at the end of the schedule
+	single := TemperatureSchedule{Start: 1, End: 0.5, Interpolation: "linear", Tokens: 1}
+	assert.InDelta(t, 0.5, single.Temperature(0), 1e-6)
+}
+
+func TestTemperatureScheduleFromMap(t *testing.T) {
+	tests := []struct {
+		name string
+		opts map[string]any
+		err  bool
+	}{
+		{name: "unset", opts: map[string]any{}},
+		{name: "tokens", opts: map[string]any{"temperature_schedule": "start=1,end=0.5,tokens=32"}},
+		{name: "num_predict", opts: map[string]any{"temperature_schedule": "start=1,end=0.5", "num_predict": float64(32)}},
+		{name: "no length", opts: map[string]any{"temperature_schedule": "start=1,end=0.5"}, err: true},
+		{name: "invalid", opts: map[string]any{"temperature_schedule": "start=1"}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			err := opts.FromMap(tt.opts)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -1084,6 +1084,11 @@ func chat(cmd *cobra.Command, opts runOptions) (*api.Message, error) {
 	var thinkTagClosed bool = false
 
 	fn := func(response api.ChatResponse) error {
+		// keep the spinner running while the prompt is processed
+		if response.PromptEvalProgress != nil {
+			return nil
+		}
+
 		if response.Message.Content != "" || !opts.HideThinking {
 			p.StopAndClear()
 		}
@@ -1192,6 +1197,11 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 	plainText := !term.IsTerminal(int(os.Stdout.Fd()))
 
 	fn := func(response api.GenerateResponse) error {
+		// keep the spinner running while the prompt is processed
+		if response.PromptEvalProgress != nil {
+			return nil
+		}
+
 		latest = response
 		content := response.Response
 
@@ -1564,6 +1574,7 @@ func NewCLI() *cobra.Command {
 				envVars["OLLAMA_MODELS"],
 				envVars["OLLAMA_NUM_PARALLEL"],
 				envVars["OLLAMA_NOPRUNE"],
+				envVars["OLLAMA_NO_WARMUP"],
 				envVars["OLLAMA_ORIGINS"],
 				envVars["OLLAMA_SCHED_SPREAD"],
 				envVars["OLLAMA_FLASH_ATTENTION"],
@@ -1571,6 +1582,8 @@ func NewCLI() *cobra.Command {
 				envVars["OLLAMA_LLM_LIBRARY"],
 				envVars["OLLAMA_GPU_OVERHEAD"],
 				envVars["OLLAMA_LOAD_TIMEOUT"],
+				envVars["OLLAMA_COMPRESSION"],
+				envVars["OLLAMA_SESSION_BUDGET"],
 			})
 		default:
 			appendEnvDocs(cmd, envs)
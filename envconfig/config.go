@@ -1,6 +1,7 @@
 package envconfig
 
 import (
+	"cmp"
 	"fmt"
 	"log/slog"
 	"math"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -94,6 +96,20 @@ func Models() string {
 	return filepath.Join(home, ".ollama", "models")
 }
 
+// ModelFileDirs returns the directories that GGUF files can be loaded from by
+// path without creating a model first. ModelFileDirs can be configured via the
+// OLLAMA_MODEL_FILE_DIRS environment variable as a list separated like PATH.
+// Loading GGUF files by path is disabled if it's unset.
+func ModelFileDirs() (dirs []string) {
+	for _, dir := range filepath.SplitList(Var("OLLAMA_MODEL_FILE_DIRS")) {
+		if dir != "" {
+			dirs = append(dirs, filepath.Clean(dir))
+		}
+	}
+
+	return dirs
+}
+
 // KeepAlive returns the duration that models stay loaded in memory. KeepAlive can be configured via the OLLAMA_KEEP_ALIVE environment variable.
 // Negative values are treated as infinite. Zero is treated as no keep alive.
 // Default is 5 minutes.
@@ -114,6 +130,46 @@ func KeepAlive() (keepAlive time.Duration) {
 	return keepAlive
 }
 
+// PreloadModel is a model to load at startup and keep loaded.
+type PreloadModel struct {
+	Name string
+
+	// Priority orders preloaded models when one has to be unloaded to make
+	// room for another. Those with the lowest priority are unloaded first.
+	Priority int
+}
+
+// Preload returns the models to load at startup, in order of decreasing priority. Preload can be configured via the OLLAMA_PRELOAD environment variable
+// as a comma separated list of model names, each optionally followed by = and an integer priority, e.g. "llama3.2=10,qwen3:8b".
+// Default priority is 0.
+func Preload() (models []PreloadModel) {
+	if s := Var("OLLAMA_PRELOAD"); s != "" {
+		for entry := range strings.SplitSeq(s, ",") {
+			name, priority, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if name == "" {
+				continue
+			}
+
+			m := PreloadModel{Name: name}
+			if ok {
+				n, err := strconv.Atoi(priority)
+				if err != nil {
+					slog.Warn("invalid preload priority, using default", "key", "OLLAMA_PRELOAD", "model", name, "value", priority, "default", 0)
+				}
+				m.Priority = n
+			}
+
+			models = append(models, m)
+		}
+	}
+
+	slices.SortStableFunc(models, func(a, b PreloadModel) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+
+	return models
+}
+
 // LoadTimeout returns the duration for stall detection during model loads. LoadTimeout can be configured via the OLLAMA_LOAD_TIMEOUT environment variable.
 // Zero or Negative values are treated as infinite.
 // Default is 5 minutes.
@@ -173,6 +229,9 @@ var (
 	NoHistory = Bool("OLLAMA_NOHISTORY")
 	// NoPrune disables pruning of model blobs on startup.
 	NoPrune = Bool("OLLAMA_NOPRUNE")
+	// NoWarmup disables generating a token when a model is loaded, which
+	// makes loads faster but the first request slower.
+	NoWarmup = Bool("OLLAMA_NO_WARMUP")
 	// SchedSpread allows scheduling models across all GPUs.
 	SchedSpread = Bool("OLLAMA_SCHED_SPREAD")
 	// IntelGPU enables experimental Intel GPU detection.
@@ -185,6 +244,14 @@ var (
 	ContextLength = Uint("OLLAMA_CONTEXT_LENGTH", 4096)
 	// Auth enables authentication between the Ollama client and server
 	UseAuth = Bool("OLLAMA_AUTH")
+	// Compression enables compressing responses for clients that accept it.
+	Compression = Bool("OLLAMA_COMPRESSION")
+	// RemoteImages allows fetching the images of OpenAI compatible requests
+	// from http(s) URLs. Without it only data URLs are accepted.
+	RemoteImages = Bool("OLLAMA_REMOTE_IMAGES")
+	// PrivateWebhooks allows posting webhooks to private, loopback and other
+	// non-public addresses.
+	PrivateWebhooks = Bool("OLLAMA_PRIVATE_WEBHOOKS")
 )
 
 func String(s string) func() string {
@@ -224,6 +291,8 @@ var (
 	MaxRunners = Uint("OLLAMA_MAX_LOADED_MODELS", 0)
 	// MaxQueue sets the maximum number of queued requests. MaxQueue can be configured via the OLLAMA_MAX_QUEUE environment variable.
 	MaxQueue = Uint("OLLAMA_MAX_QUEUE", 512)
+	// SessionBudget caps the tokens generated for each session, identified by the X-Ollama-Session header of its requests. 0 disables it.
+	SessionBudget = Uint("OLLAMA_SESSION_BUDGET", 0)
 )
 
 func Uint64(key string, defaultValue uint64) func() uint64 {
@@ -262,14 +331,21 @@ func AsMap() map[string]EnvVar {
 		"OLLAMA_MAX_LOADED_MODELS": {"OLLAMA_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
 		"OLLAMA_MAX_QUEUE":         {"OLLAMA_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests"},
 		"OLLAMA_MODELS":            {"OLLAMA_MODELS", Models(), "The path to the models directory"},
+		"OLLAMA_MODEL_FILE_DIRS":   {"OLLAMA_MODEL_FILE_DIRS", ModelFileDirs(), "Directories of GGUF files that can be loaded by path without creating a model"},
 		"OLLAMA_NOHISTORY":         {"OLLAMA_NOHISTORY", NoHistory(), "Do not preserve readline history"},
 		"OLLAMA_NOPRUNE":           {"OLLAMA_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
+		"OLLAMA_NO_WARMUP":         {"OLLAMA_NO_WARMUP", NoWarmup(), "Do not warm up models after loading them"},
 		"OLLAMA_NUM_PARALLEL":      {"OLLAMA_NUM_PARALLEL", NumParallel(), "Maximum number of parallel requests"},
 		"OLLAMA_ORIGINS":           {"OLLAMA_ORIGINS", AllowedOrigins(), "A comma separated list of allowed origins"},
+		"OLLAMA_PRELOAD":           {"OLLAMA_PRELOAD", Preload(), "A comma separated list of models to load at startup and keep loaded, each optionally with =priority"},
 		"OLLAMA_SCHED_SPREAD":      {"OLLAMA_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
 		"OLLAMA_MULTIUSER_CACHE":   {"OLLAMA_MULTIUSER_CACHE", MultiUserCache(), "Optimize prompt caching for multi-user scenarios"},
 		"OLLAMA_CONTEXT_LENGTH":    {"OLLAMA_CONTEXT_LENGTH", ContextLength(), "Context length to use unless otherwise specified (default: 4096)"},
 		"OLLAMA_NEW_ENGINE":        {"OLLAMA_NEW_ENGINE", NewEngine(), "Enable the new Ollama engine"},
+		"OLLAMA_COMPRESSION":       {"OLLAMA_COMPRESSION", Compression(), "Compress responses with gzip or deflate for clients that accept it"},
+		"OLLAMA_SESSION_BUDGET":    {"OLLAMA_SESSION_BUDGET", SessionBudget(), "Maximum number of tokens generated for each X-Ollama-Session header value"},
+		"OLLAMA_REMOTE_IMAGES":     {"OLLAMA_REMOTE_IMAGES", RemoteImages(), "Fetch images of OpenAI compatible requests from http(s) URLs"},
+		"OLLAMA_PRIVATE_WEBHOOKS":  {"OLLAMA_PRIVATE_WEBHOOKS", PrivateWebhooks(), "Allow pull webhooks to private, loopback and other non-public addresses"},
 
 		// Informational
 		"HTTP_PROXY":  {"HTTP_PROXY", String("HTTP_PROXY")(), "HTTP proxy"},
@@ -3,6 +3,8 @@ package envconfig
 import (
 	"log/slog"
 	"math"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
@@ -225,6 +227,50 @@ func TestKeepAlive(t *testing.T) {
 	}
 }
 
+func TestPreload(t *testing.T) {
+	cases := map[string][]PreloadModel{
+		"":                       nil,
+		"llama3.2":               {{Name: "llama3.2"}},
+		"llama3.2, qwen3:8b":     {{Name: "llama3.2"}, {Name: "qwen3:8b"}},
+		"llama3.2,qwen3:8b=10":   {{Name: "qwen3:8b", Priority: 10}, {Name: "llama3.2"}},
+		"a=-1,b=2,c":             {{Name: "b", Priority: 2}, {Name: "c"}, {Name: "a", Priority: -1}},
+		"llama3.2=high,,":        {{Name: "llama3.2"}},
+		"user/model:latest=3,b=": {{Name: "user/model:latest", Priority: 3}, {Name: "b"}},
+	}
+
+	for tt, expect := range cases {
+		t.Run(tt, func(t *testing.T) {
+			t.Setenv("OLLAMA_PRELOAD", tt)
+			if actual := Preload(); !slices.Equal(actual, expect) {
+				t.Errorf("%s: expected %v, got %v", tt, expect, actual)
+			}
+		})
+	}
+}
+
+func TestModelFileDirs(t *testing.T) {
+	sep := string(filepath.ListSeparator)
+	cases := map[string][]string{
+		"":                               nil,
+		"/models":                        {"/models"},
+		"/models/" + sep + "/tmp/a/../b": {"/models", "/tmp/b"},
+		sep + "/models" + sep:            {"/models"},
+	}
+
+	for tt, expect := range cases {
+		t.Run(tt, func(t *testing.T) {
+			t.Setenv("OLLAMA_MODEL_FILE_DIRS", tt)
+			for i := range expect {
+				expect[i] = filepath.FromSlash(expect[i])
+			}
+
+			if actual := ModelFileDirs(); !slices.Equal(actual, expect) {
+				t.Errorf("%s: expected %v, got %v", tt, expect, actual)
+			}
+		})
+	}
+}
+
 func TestLoadTimeout(t *testing.T) {
 	defaultTimeout := 5 * time.Minute
 	cases := map[string]time.Duration{
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log/slog"
 	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/ollama/ollama/fs/util/bufioutil"
@@ -16,6 +17,9 @@ type GGML struct {
 	container
 	model
 	Length int64
+
+	// Shards are the files the model was decoded from by [DecodeFile]
+	Shards []Shard
 }
 
 type model interface {
@@ -143,11 +147,89 @@ type arrayValueTypes interface {
 		*array[string] | *array[float32] | *array[float64] | *array[bool]
 }
 
-func keyValue[T valueTypes | arrayValueTypes](kv KV, key string, defaultValue ...T) T {
+// Override replaces the value of an existing key with value, parsed as the
+// key's current type. Keys may be given in full or without the architecture
+// prefix, as with the typed accessors.
+func (kv KV) Override(key, value string) error {
+	if _, ok := kv[key]; !ok {
+		key = kv.resolve(key)
+	}
+
+	current, ok := kv[key]
+	if !ok {
+		return fmt.Errorf("key %q not found", key)
+	}
+
+	var v any
+	var err error
+	switch current.(type) {
+	case uint8:
+		v, err = parseUint[uint8](value, 8)
+	case uint16:
+		v, err = parseUint[uint16](value, 16)
+	case uint32:
+		v, err = parseUint[uint32](value, 32)
+	case uint64:
+		v, err = parseUint[uint64](value, 64)
+	case int8:
+		v, err = parseInt[int8](value, 8)
+	case int16:
+		v, err = parseInt[int16](value, 16)
+	case int32:
+		v, err = parseInt[int32](value, 32)
+	case int64:
+		v, err = parseInt[int64](value, 64)
+	case float32:
+		var f float64
+		f, err = strconv.ParseFloat(value, 32)
+		v = float32(f)
+	case float64:
+		v, err = strconv.ParseFloat(value, 64)
+	case bool:
+		v, err = strconv.ParseBool(value)
+	case string:
+		v = value
+	default:
+		return fmt.Errorf("key %q has unsupported type %T", key, current)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid value for key %q of type %T: %w", key, current, err)
+	}
+
+	kv[key] = v
+	return nil
+}
+
+// SetFloats sets key to an array of values, read back with [KV.Floats]. Keys
+// are resolved as with the typed accessors.
+func (kv KV) SetFloats(key string, values []float32) {
+	kv[kv.resolve(key)] = &array[float32]{size: len(values), values: values}
+}
+
+func parseUint[T uint8 | uint16 | uint32 | uint64](s string, bitSize int) (T, error) {
+	n, err := strconv.ParseUint(s, 10, bitSize)
+	return T(n), err
+}
+
+func parseInt[T int8 | int16 | int32 | int64](s string, bitSize int) (T, error) {
+	n, err := strconv.ParseInt(s, 10, bitSize)
+	return T(n), err
+}
+
+// resolve returns the full name of key, prefixing it with the architecture
+// unless it is a general or tokenizer key.
+func (kv KV) resolve(key string) string {
 	if !strings.HasPrefix(key, "tokenizer.") && !strings.HasPrefix(key, "general.") {
 		key = kv.Architecture() + "." + key
 	}
 
+	return key
+}
+
+func keyValue[T valueTypes | arrayValueTypes](kv KV, key string, defaultValue ...T) T {
+	key = kv.resolve(key)
+
 	if val, ok := kv[key]; ok {
 		return val.(T)
 	}
@@ -214,6 +296,9 @@ type Tensor struct {
 	Kind   uint32 `json:"kind"`
 	Offset uint64 `json:"-"`
 
+	// Shard is the index of the file in [GGML.Shards] the tensor is in
+	Shard int `json:"-"`
+
 	// Shape is the number of elements in each dimension
 	Shape []uint64 `json:"shape"`
 
@@ -269,3 +269,50 @@ func TestKeyValue(t *testing.T) {
 		t.Errorf("unexpected uint8s (-got +want):\n%s", diff)
 	}
 }
+
+func TestKeyValueOverride(t *testing.T) {
+	kv := KV{
+		"general.architecture": "test",
+		"general.name":         "before",
+		"test.context_length":  uint32(2048),
+		"test.rope.freq_base":  float32(10000),
+		"test.use_parallel":    false,
+		"test.uint32s":         &array[uint32]{size: 3, values: []uint32{1, 2, 3}},
+	}
+
+	cases := []struct {
+		key, value string
+		want       any
+		err        bool
+	}{
+		{key: "rope.freq_base", value: "1000000", want: float32(1000000)},
+		{key: "test.context_length", value: "8192", want: uint32(8192)},
+		{key: "use_parallel", value: "true", want: true},
+		{key: "general.name", value: "after", want: "after"},
+		{key: "context_length", value: "-1", err: true},
+		{key: "context_length", value: "4294967296", err: true},
+		{key: "rope.freq_base", value: "high", err: true},
+		{key: "uint32s", value: "1", err: true},
+		{key: "nonexistent", value: "1", err: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			err := kv.Override(tt.key, tt.value)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(kv[kv.resolve(strings.TrimPrefix(tt.key, "test."))], tt.want); diff != "" {
+				t.Errorf("unexpected value (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
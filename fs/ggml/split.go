@@ -0,0 +1,147 @@
+package ggml
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// splitPattern matches the names of the files of a split model, such as
+// model-00001-of-00003.gguf
+var splitPattern = regexp.MustCompile(`^(.*)-(\d{5})-of-(\d{5})\.gguf$`)
+
+// Shard is one of the files a model is stored in. Models too large for a
+// single file are split across several.
+type Shard struct {
+	Path string
+
+	// Offset is where the tensor data of the shard starts
+	Offset uint64
+
+	// Length is where the shard ends
+	Length int64
+}
+
+// SplitPaths returns the paths of the files the model at path is split
+// across, in order, or just path if it isn't split. Any shard of a split
+// model can be given.
+func SplitPaths(path string) ([]string, error) {
+	m := splitPattern.FindStringSubmatch(filepath.Base(path))
+	if m == nil {
+		return []string{path}, nil
+	}
+
+	count, err := strconv.Atoi(m[3])
+	if err != nil || count == 0 {
+		return nil, fmt.Errorf("invalid split model name %q", filepath.Base(path))
+	}
+
+	paths := make([]string, count)
+	for i := range paths {
+		paths[i] = filepath.Join(filepath.Dir(path), fmt.Sprintf("%s-%05d-of-%05d.gguf", m[1], i+1, count))
+		if _, err := os.Stat(paths[i]); errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("split model is missing shard %d of %d: %s", i+1, count, paths[i])
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return paths, nil
+}
+
+// DecodeFile decodes the model at path like [Decode]. If the model is split
+// across several files, all of them are decoded and their tensors combined,
+// so the model can be used as if it were one file. The metadata is that of
+// the first shard.
+func DecodeFile(path string, maxArraySize int) (*GGML, error) {
+	paths, err := SplitPaths(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f *GGML
+	for i, path := range paths {
+		shard, err := decodeShard(path, maxArraySize)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkShard(shard.KV(), i, len(paths)); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		tensors := shard.Tensors().Items()
+		for _, t := range tensors {
+			t.Shard = i
+		}
+
+		if f == nil {
+			f = shard
+		} else {
+			g, ok := f.model.(*gguf)
+			if !ok {
+				return nil, fmt.Errorf("%s: split models must be GGUF", path)
+			}
+
+			g.tensors = append(g.tensors, tensors...)
+			for _, t := range tensors {
+				g.parameters += t.Elements()
+			}
+			g.kv["general.parameter_count"] = g.parameters
+		}
+
+		f.Shards = append(f.Shards, Shard{Path: path, Offset: shard.Tensors().Offset, Length: shard.Length})
+	}
+
+	if want, ok := splitKey(f.KV(), "split.tensors.count"); ok && want != len(f.Tensors().Items()) {
+		return nil, fmt.Errorf("split model has %d tensors, expected %d", len(f.Tensors().Items()), want)
+	}
+
+	return f, nil
+}
+
+func decodeShard(path string, maxArraySize int) (*GGML, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return Decode(r, maxArraySize)
+}
+
+// checkShard returns an error if the split metadata of a shard, when it has
+// any, doesn't match its position among the files of the model.
+func checkShard(kv KV, index, count int) error {
+	if n, ok := splitKey(kv, "split.count"); ok && n != count {
+		if count == 1 {
+			return fmt.Errorf("model is split across %d files but isn't named like model-00001-of-%05d.gguf", n, n)
+		}
+		return fmt.Errorf("shard is one of %d, expected one of %d", n, count)
+	}
+
+	if n, ok := splitKey(kv, "split.no"); ok && n != index {
+		return fmt.Errorf("shard is number %d, expected %d", n+1, index+1)
+	}
+
+	return nil
+}
+
+// splitKey returns the integer value of a split key. Unlike other keys these
+// aren't prefixed with the architecture and their types vary between tools.
+func splitKey(kv KV, key string) (int, bool) {
+	switch v := kv[key].(type) {
+	case uint16:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case uint32:
+		return int(v), true
+	default:
+		return 0, false
+	}
+}
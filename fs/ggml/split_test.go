@@ -0,0 +1,155 @@
+package ggml
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func writeShard(t *testing.T, path string, kv KV, ts []*Tensor) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := WriteGGUF(f, kv, ts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeFileSplit(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "model-00001-of-00002.gguf")
+	second := filepath.Join(dir, "model-00002-of-00002.gguf")
+
+	writeShard(t, first, KV{
+		"general.architecture": "llama",
+		"split.no":             uint32(0),
+		"split.count":          uint32(2),
+		"split.tensors.count":  uint32(2),
+	}, []*Tensor{
+		{Name: "blk.0.attn_norm.weight", Shape: []uint64{2, 3}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{1}, 4*2*3))},
+	})
+
+	writeShard(t, second, KV{
+		"split.no":    uint32(1),
+		"split.count": uint32(2),
+	}, []*Tensor{
+		{Name: "output.weight", Shape: []uint64{3, 2}, WriterTo: bytes.NewReader(bytes.Repeat([]byte{2}, 4*3*2))},
+	})
+
+	// either shard can be given
+	for _, path := range []string{first, second} {
+		f, err := DecodeFile(path, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := f.KV().Architecture(); got != "llama" {
+			t.Errorf("expected the metadata of the first shard, got architecture %q", got)
+		}
+
+		if got := f.KV().ParameterCount(); got != 12 {
+			t.Errorf("expected 12 parameters, got %d", got)
+		}
+
+		var names []string
+		for _, t := range f.Tensors().Items() {
+			names = append(names, t.Name)
+		}
+
+		if diff := cmp.Diff([]string{"blk.0.attn_norm.weight", "output.weight"}, names); diff != "" {
+			t.Errorf("tensors mismatch (-want +got):\n%s", diff)
+		}
+
+		if len(f.Shards) != 2 || f.Shards[0].Path != first || f.Shards[1].Path != second {
+			t.Fatalf("expected shards %s and %s, got %v", first, second, f.Shards)
+		}
+
+		// each tensor's data is read from its own shard
+		for i, tensor := range f.Tensors().Items() {
+			shard := f.Shards[tensor.Shard]
+			r, err := os.Open(shard.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			bts, err := io.ReadAll(io.NewSectionReader(r, int64(shard.Offset+tensor.Offset), int64(tensor.Size())))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := bytes.Repeat([]byte{byte(i + 1)}, 24); !bytes.Equal(bts, want) {
+				t.Errorf("%s: expected data %v, got %v", tensor.Name, want, bts)
+			}
+		}
+	}
+}
+
+func TestDecodeFileSplitErrors(t *testing.T) {
+	cases := []struct {
+		name  string
+		files map[string]KV
+		path  string
+		err   string
+	}{
+		{
+			name: "missing shard",
+			files: map[string]KV{
+				"model-00001-of-00003.gguf": {"split.no": uint32(0), "split.count": uint32(3)},
+				"model-00003-of-00003.gguf": {"split.no": uint32(2), "split.count": uint32(3)},
+			},
+			path: "model-00001-of-00003.gguf",
+			err:  "split model is missing shard 2 of 3",
+		},
+		{
+			name: "wrong shard number",
+			files: map[string]KV{
+				"model-00001-of-00002.gguf": {"split.no": uint32(0), "split.count": uint32(2)},
+				"model-00002-of-00002.gguf": {"split.no": uint32(0), "split.count": uint32(2)},
+			},
+			path: "model-00001-of-00002.gguf",
+			err:  "shard is number 1, expected 2",
+		},
+		{
+			name: "wrong shard count",
+			files: map[string]KV{
+				"model-00001-of-00002.gguf": {"split.no": uint32(0), "split.count": uint32(3)},
+				"model-00002-of-00002.gguf": {"split.no": uint32(1), "split.count": uint32(3)},
+			},
+			path: "model-00001-of-00002.gguf",
+			err:  "shard is one of 3, expected one of 2",
+		},
+		{
+			name: "not named as split",
+			files: map[string]KV{
+				"model.gguf": {"split.no": uint32(0), "split.count": uint32(2)},
+			},
+			path: "model.gguf",
+			err:  "isn't named like model-00001-of-00002.gguf",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, kv := range tt.files {
+				writeShard(t, filepath.Join(dir, name), kv, nil)
+			}
+
+			_, err := DecodeFile(filepath.Join(dir, tt.path), -1)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
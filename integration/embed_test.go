@@ -218,6 +218,46 @@ func TestAllMiniLMEmbedTruncate(t *testing.T) {
 	}
 }
 
+func TestAllMiniLMEmbedPooling(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Minute)
+	defer cancel()
+	client, _, cleanup := InitServerConnection(ctx, t)
+	defer cleanup()
+
+	res := make(map[string]*api.EmbedResponse)
+	for _, pooling := range []string{"mean", "last", "none"} {
+		response, err := embedTestHelper(ctx, client, t, api.EmbedRequest{
+			Model:   "all-minilm",
+			Input:   "why is the sky blue?",
+			Pooling: pooling,
+		})
+		if err != nil {
+			t.Fatalf("%s: error: %v", pooling, err)
+		}
+		res[pooling] = response
+	}
+
+	mean, last := res["mean"].Embeddings, res["last"].Embeddings
+	if len(mean) != 1 || len(last) != 1 {
+		t.Fatalf("expected 1 embedding each, got %d and %d", len(mean), len(last))
+	}
+
+	if sim := cosineSimilarity(mean[0], last[0]); sim > 0.99 {
+		t.Fatalf("expected mean and last pooling to differ, similarity %f", sim)
+	}
+
+	none := res["none"]
+	if len(none.TokenCounts) != 1 || len(none.Embeddings) != none.TokenCounts[0] || len(none.Embeddings) < 2 {
+		t.Fatalf("expected an embedding per token, got %d embeddings for token counts %v", len(none.Embeddings), none.TokenCounts)
+	}
+
+	for _, embedding := range none.Embeddings {
+		if len(embedding) != 384 {
+			t.Fatalf("expected 384 floats, got %d", len(embedding))
+		}
+	}
+}
+
 func embeddingTestHelper(ctx context.Context, client *api.Client, t *testing.T, req api.EmbeddingRequest) (*api.EmbeddingResponse, error) {
 	if err := PullIfMissing(ctx, client, req.Model); err != nil {
 		t.Fatalf("failed to pull model %s: %v", req.Model, err)
@@ -2,6 +2,7 @@ package kvcache
 
 import (
 	"errors"
+	"io"
 
 	"github.com/ollama/ollama/ml"
 	"github.com/ollama/ollama/model/input"
@@ -71,7 +72,29 @@ type Cache interface {
 	// Remove deletes tokens in the range [beginIndex, endIndex) from seq. Set
 	// endIndex to math.MaxInt32 to remove everything starting at beginIndex.
 	//
+	// Tokens after endIndex move down to beginIndex, with their positions
+	// updated to match. The runner uses this to shift the context when a
+	// sequence fills it: the first num_keep tokens are left in place and the
+	// oldest half of the rest is removed so generation can continue.
+	//
 	// If an error occurs, the entire context for the sequence should be
 	// removed by calling Remove(seq, 0, math.MaxInt32)
 	Remove(seq int, beginIndex, endIndex int32) error
 }
+
+// StateCache is implemented by caches that can save the contents of a
+// sequence and load them back, possibly into another instance of the cache
+// for the same model, such as after the model is reloaded.
+type StateCache interface {
+	// CanSave reports whether the cache is configured to keep every entry
+	// of a sequence, which saving needs
+	CanSave() bool
+
+	// Save writes the entries of seq at positions in the range [0, len) to w
+	Save(seq int, len int32, w io.Writer) error
+
+	// Load replaces the contents of seq with entries written by Save. The
+	// cache must have the same data type and layer shapes as the one that
+	// saved them.
+	Load(seq int, r io.Reader) error
+}
@@ -1,9 +1,13 @@
 package kvcache
 
 import (
+	"cmp"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"math"
 	"slices"
 
@@ -174,10 +178,10 @@ func (c *Causal) StartForward(ctx ml.Context, batch input.Batch, reserve bool) e
 		c.updateSlidingWindow()
 
 		var err error
-		c.curLoc, err = c.findStartLoc()
+		c.curLoc, err = c.findStartLoc(c.curBatchSize)
 		if errors.Is(err, ErrKvCacheFull) {
 			c.defrag()
-			c.curLoc, err = c.findStartLoc()
+			c.curLoc, err = c.findStartLoc(c.curBatchSize)
 		}
 		if err != nil {
 			return err
@@ -229,13 +233,13 @@ func newRange() cellRange {
 	}
 }
 
-// Find the first contiguous block of at least curBatchSize
-func (c *Causal) findStartLoc() (int, error) {
+// Find the first contiguous block of at least size cells
+func (c *Causal) findStartLoc(size int) (int, error) {
 	var start, count int
 	for i := range c.cells {
 		if len(c.cells[i].sequences) == 0 {
 			count++
-			if count >= c.curBatchSize {
+			if count >= size {
 				return start, nil
 			}
 		} else {
@@ -244,7 +248,7 @@ func (c *Causal) findStartLoc() (int, error) {
 		}
 	}
 
-	return 0, fmt.Errorf("%w (cache: %v batch: %v)", ErrKvCacheFull, len(c.cells), c.curBatchSize)
+	return 0, fmt.Errorf("%w (cache: %v batch: %v)", ErrKvCacheFull, len(c.cells), size)
 }
 
 func (c *Causal) updateSlidingWindow() {
@@ -551,21 +555,7 @@ func (c *Causal) Put(ctx ml.Context, key, value ml.Tensor) {
 		panic(fmt.Errorf("inconsistent batch sizes (layer: %v, batch size: %v layer batch size: %v)", c.curLayer, c.curBatchSize, batchSize))
 	}
 
-	if _, ok := c.ctxs[c.curLayer]; !ok {
-		c.ctxs[c.curLayer] = c.backend.NewContextSize(2).Layer(c.curLayer)
-	}
-
-	if _, ok := c.keys[c.curLayer]; !ok {
-		c.keys[c.curLayer] = c.ctxs[c.curLayer].Zeros(c.DType, kHeadDim, numKVHeads, len(c.cells))
-	}
-
-	if _, ok := c.values[c.curLayer]; !ok {
-		if c.config.PermutedV {
-			c.values[c.curLayer] = c.ctxs[c.curLayer].Zeros(c.DType, len(c.cells), vHeadDim, numKVHeads)
-		} else {
-			c.values[c.curLayer] = c.ctxs[c.curLayer].Zeros(c.DType, vHeadDim, numKVHeads, len(c.cells))
-		}
-	}
+	c.ensureLayer(c.curLayer, kHeadDim, vHeadDim, numKVHeads)
 
 	rowSize := c.keys[c.curLayer].Stride(2)
 	ctx.Forward(key.Copy(ctx, c.keys[c.curLayer].View(ctx, rowSize*c.curLoc, kHeadDim*numKVHeads*batchSize)))
@@ -736,3 +726,319 @@ func (c *Causal) Remove(seq int, beginIndex, endIndex int32) error {
 
 	return nil
 }
+
+// stateMagic begins the state of a sequence written by Save, followed by a
+// stateHeader, the position of each entry, the lengths of the runs of
+// entries stored next to each other and then the keys and values of each
+// layer, one run at a time
+const stateMagic = "OKVS"
+
+type stateHeader struct {
+	Version   uint32
+	DType     int32
+	PermutedV bool
+	Cells     int32
+	Runs      int32
+	Layers    int32
+}
+
+type stateLayer struct {
+	Layer      int32
+	KHeadDim   int32
+	VHeadDim   int32
+	NumKVHeads int32
+}
+
+// CanSave reports false for sliding window and chunked attention caches,
+// which drop entries that are no longer attended to
+func (c *Causal) CanSave() bool {
+	return c.windowSize == math.MaxInt32 && c.chunkSize == 0
+}
+
+func (c *Causal) Save(seq int, n int32, w io.Writer) error {
+	if !c.CanSave() {
+		return ErrNotSupported
+	}
+
+	var cells []int
+	for i, cell := range c.cells {
+		if slices.Contains(cell.sequences, seq) && cell.pos < n {
+			cells = append(cells, i)
+		}
+	}
+	slices.SortFunc(cells, func(a, b int) int { return cmp.Compare(c.cells[a].pos, c.cells[b].pos) })
+
+	positions := make([]int32, 0, len(cells))
+	var runs []int32
+	for i, cell := range cells {
+		positions = append(positions, c.cells[cell].pos)
+		if i > 0 && cell == cells[i-1]+1 {
+			runs[len(runs)-1]++
+		} else {
+			runs = append(runs, 1)
+		}
+	}
+
+	layers := slices.Sorted(maps.Keys(c.keys))
+
+	if _, err := io.WriteString(w, stateMagic); err != nil {
+		return err
+	}
+
+	for _, v := range []any{
+		stateHeader{Version: 1, DType: int32(c.DType), PermutedV: c.config.PermutedV, Cells: int32(len(cells)), Runs: int32(len(runs)), Layers: int32(len(layers))},
+		positions,
+		runs,
+	} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+
+	for _, layer := range layers {
+		key, value := c.keys[layer], c.values[layer]
+
+		kHeadDim, numKVHeads := key.Dim(0), key.Dim(1)
+		vHeadDim := value.Dim(0)
+		if c.config.PermutedV {
+			vHeadDim = value.Dim(1)
+		}
+
+		if err := binary.Write(w, binary.LittleEndian, stateLayer{int32(layer), int32(kHeadDim), int32(vHeadDim), int32(numKVHeads)}); err != nil {
+			return err
+		}
+
+		var start int
+		for _, run := range runs {
+			length := int(run)
+			loc := cells[start]
+
+			ctx := c.backend.NewContext()
+			kView, vView := c.views(ctx, layer, loc, length)
+			k := ctx.Input().Empty(c.DType, kHeadDim*numKVHeads*length)
+			v := ctx.Input().Empty(c.DType, vView.Shape()...)
+			ctx.Forward(kView.Copy(ctx, k), vView.Copy(ctx, v)).Compute(k, v)
+
+			err := writeState(w, k.Bytes(), v.Bytes())
+			ctx.Close()
+			if err != nil {
+				return err
+			}
+
+			start += length
+		}
+	}
+
+	return nil
+}
+
+func (c *Causal) Load(seq int, r io.Reader) error {
+	if !c.CanSave() {
+		return ErrNotSupported
+	}
+
+	magic := make([]byte, len(stateMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	} else if string(magic) != stateMagic {
+		return errors.New("not a saved kv cache state")
+	}
+
+	var header stateHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+
+	if header.Version != 1 {
+		return fmt.Errorf("unsupported kv cache state version %d", header.Version)
+	}
+
+	if ml.DType(header.DType) != c.DType || header.PermutedV != c.config.PermutedV {
+		return errors.New("kv cache state was saved with a different cache type")
+	}
+
+	if header.Cells < 0 || int(header.Cells) > len(c.cells) || header.Runs < 0 || header.Runs > header.Cells {
+		return fmt.Errorf("kv cache state of %d entries doesn't fit in a cache of %d", header.Cells, len(c.cells))
+	}
+
+	positions := make([]int32, header.Cells)
+	runs := make([]int32, header.Runs)
+	if err := binary.Read(r, binary.LittleEndian, positions); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, runs); err != nil {
+		return err
+	}
+
+	var total int32
+	for _, run := range runs {
+		if run < 1 {
+			return errors.New("invalid kv cache state")
+		}
+		total += run
+	}
+	if total != header.Cells {
+		return errors.New("invalid kv cache state")
+	}
+
+	if len(c.keys) > 0 && int(header.Layers) != len(c.keys) {
+		return fmt.Errorf("kv cache state has %d layers, the cache has %d", header.Layers, len(c.keys))
+	}
+
+	if err := c.Remove(seq, 0, math.MaxInt32); err != nil {
+		return err
+	}
+
+	loc, err := c.findStartLoc(int(header.Cells))
+	if errors.Is(err, ErrKvCacheFull) {
+		c.defrag()
+		loc, err = c.findStartLoc(int(header.Cells))
+	}
+	if err != nil {
+		return err
+	}
+
+	for range header.Layers {
+		var l stateLayer
+		if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+			return err
+		}
+
+		layer := int(l.Layer)
+		if l.Layer < 0 || l.KHeadDim < 1 || l.VHeadDim < 1 || l.NumKVHeads < 1 {
+			return errors.New("invalid kv cache state")
+		}
+
+		if _, ok := c.keys[layer]; !ok && len(c.keys) > 0 {
+			return fmt.Errorf("kv cache state has layer %d, which the cache doesn't", layer)
+		}
+
+		c.ensureLayer(layer, int(l.KHeadDim), int(l.VHeadDim), int(l.NumKVHeads))
+		key := c.keys[layer]
+		kHeadDim, numKVHeads := key.Dim(0), key.Dim(1)
+		if kHeadDim != int(l.KHeadDim) || numKVHeads != int(l.NumKVHeads) {
+			return fmt.Errorf("kv cache state of layer %d has a different shape", layer)
+		}
+
+		start := loc
+		for _, run := range runs {
+			length := int(run)
+
+			ctx := c.backend.NewContext()
+			kView, vView := c.views(ctx, layer, start, length)
+
+			// the size of a run is checked against the cache before the
+			// backend reads it
+			kSize, vSize := c.runSizes(layer, length)
+			kBytes, vBytes, err := readState(r, kSize, vSize)
+			if err != nil {
+				ctx.Close()
+				return err
+			}
+
+			k := ctx.Input().FromBytes(c.DType, kBytes, kHeadDim*numKVHeads*length)
+			v := ctx.Input().FromBytes(c.DType, vBytes, vView.Shape()...)
+			ctx.Forward(k.Copy(ctx, kView), v.Copy(ctx, vView)).Compute()
+			ctx.Close()
+
+			start += length
+		}
+	}
+
+	for i, pos := range positions {
+		c.cells[loc+i] = cacheCell{pos: pos, sequences: []int{seq}}
+	}
+
+	if header.Cells > 0 {
+		c.cellRanges[seq] = cellRange{min: loc, max: loc + int(header.Cells) - 1}
+	}
+
+	return nil
+}
+
+// views returns views of the keys and values of layer for length entries
+// starting at loc, in the layout they are saved in
+func (c *Causal) views(ctx ml.Context, layer, loc, length int) (ml.Tensor, ml.Tensor) {
+	key, value := c.keys[layer], c.values[layer]
+
+	kHeadDim := key.Dim(0)
+	numKVHeads := key.Dim(1)
+	kView := key.View(ctx, key.Stride(2)*loc, kHeadDim*numKVHeads*length)
+
+	if c.config.PermutedV {
+		vHeadDim := value.Dim(1)
+		elemSize := value.Stride(0)
+
+		return kView, value.View(ctx, elemSize*loc, length, len(c.cells)*elemSize, vHeadDim*numKVHeads)
+	}
+
+	vHeadDim := value.Dim(0)
+	return kView, value.View(ctx, value.Stride(2)*loc, vHeadDim*numKVHeads*length)
+}
+
+// ensureLayer allocates the keys and values of layer if no batch has been
+// stored in it yet
+func (c *Causal) ensureLayer(layer, kHeadDim, vHeadDim, numKVHeads int) {
+	if _, ok := c.ctxs[layer]; !ok {
+		c.ctxs[layer] = c.backend.NewContextSize(2).Layer(layer)
+	}
+
+	if _, ok := c.keys[layer]; !ok {
+		c.keys[layer] = c.ctxs[layer].Zeros(c.DType, kHeadDim, numKVHeads, len(c.cells))
+	}
+
+	if _, ok := c.values[layer]; !ok {
+		if c.config.PermutedV {
+			c.values[layer] = c.ctxs[layer].Zeros(c.DType, len(c.cells), vHeadDim, numKVHeads)
+		} else {
+			c.values[layer] = c.ctxs[layer].Zeros(c.DType, vHeadDim, numKVHeads, len(c.cells))
+		}
+	}
+}
+
+func writeState(w io.Writer, data ...[]byte) error {
+	for _, b := range data {
+		if err := binary.Write(w, binary.LittleEndian, int64(len(b))); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runSizes returns the number of bytes of the keys and values of layer for
+// length entries
+func (c *Causal) runSizes(layer, length int) (int, int) {
+	key, value := c.keys[layer], c.values[layer]
+	if c.config.PermutedV {
+		return key.Stride(2) * length, value.Stride(0) * length * value.Dim(1) * value.Dim(2)
+	}
+
+	return key.Stride(2) * length, value.Stride(2) * length
+}
+
+func readState(r io.Reader, kSize, vSize int) ([]byte, []byte, error) {
+	sizes := []int{kSize, vSize}
+	data := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		var n int64
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return nil, nil, err
+		}
+
+		if n != int64(size) {
+			return nil, nil, fmt.Errorf("kv cache state has %d bytes where %d were expected", n, size)
+		}
+
+		data[i] = make([]byte, n)
+		if _, err := io.ReadFull(r, data[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return data[0], data[1], nil
+}
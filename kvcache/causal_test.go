@@ -1,6 +1,8 @@
 package kvcache
 
 import (
+	"bytes"
+	"encoding/binary"
 	"math"
 	"slices"
 	"testing"
@@ -366,6 +368,88 @@ func testCache(t *testing.T, backend ml.Backend, cache Cache, tests []testCase)
 	}
 }
 
+func TestSaveLoad(t *testing.T) {
+	backend := &testBackend{}
+	cache := NewCausalCache(nil)
+	defer cache.Close()
+
+	cache.Init(backend, ml.DTypeF16, 2, 16, 16)
+
+	// another sequence splits the saved one into two runs of entries
+	context := backend.NewContext()
+	err := cache.StartForward(context, input.Batch{
+		Positions: []int32{0, 0, 1, 2},
+		Sequences: []int{0, 1, 0, 0},
+	}, false)
+	if err != nil {
+		t.Fatalf("StartForward failed: %v", err)
+	}
+
+	cache.SetLayer(0)
+	tensor := context.FromFloatSlice([]float32{1, 2, 3, 4}, 1, 1, 4)
+	cache.Put(context, tensor, tensor)
+	context.Close()
+
+	var state bytes.Buffer
+	if err := cache.Save(0, math.MaxInt32, &state); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	var partial bytes.Buffer
+	if err := cache.Save(0, 2, &partial); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	t.Run("different type", func(t *testing.T) {
+		other := NewCausalCache(nil)
+		defer other.Close()
+
+		other.Init(backend, ml.DTypeQ80, 1, 16, 16)
+		if err := other.Load(0, bytes.NewReader(state.Bytes())); err == nil {
+			t.Error("expected an error loading state of another cache type")
+		}
+	})
+
+	loaded := NewCausalCache(nil)
+	defer loaded.Close()
+
+	loaded.Init(backend, ml.DTypeF16, 1, 16, 16)
+	if err := loaded.Load(0, &state); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	testCache(t, backend, loaded, []testCase{
+		{
+			name:          "Continue",
+			in:            []float32{5},
+			inShape:       []int{1, 1, 1},
+			seqs:          []int{0},
+			pos:           []int32{3},
+			expected:      []float32{1, 3, 4, 5},
+			expectedShape: []int{1, 1, 4},
+			expectedMask:  []float32{0, 0, 0, 0},
+		},
+	})
+
+	// loading replaces what the sequence held
+	if err := loaded.Load(0, &partial); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	testCache(t, backend, loaded, []testCase{
+		{
+			name:          "Partial",
+			in:            []float32{6},
+			inShape:       []int{1, 1, 1},
+			seqs:          []int{0},
+			pos:           []int32{2},
+			expected:      []float32{1, 3, 6},
+			expectedShape: []int{1, 1, 3},
+			expectedMask:  []float32{0, 0, 0},
+		},
+	})
+}
+
 func TestCanResume(t *testing.T) {
 	backend := &testBackend{}
 	windowSize := int32(4)
@@ -478,6 +562,16 @@ func (c *testContext) FromFloatSlice(s []float32, shape ...int) ml.Tensor {
 	return t
 }
 
+func (c *testContext) FromBytes(dtype ml.DType, s []byte, shape ...int) ml.Tensor {
+	t := c.Empty(dtype, shape...).(*testTensor)
+
+	for i := range t.data {
+		t.data[i] = math.Float32frombits(binary.LittleEndian.Uint32(s[i*4:]))
+	}
+
+	return t
+}
+
 func (c *testContext) FromIntSlice(s []int32, shape ...int) ml.Tensor {
 	f := make([]float32, len(s))
 	for i := range f {
@@ -546,6 +640,14 @@ func (t *testTensor) DType() ml.DType {
 	return t.dtype
 }
 
+func (t *testTensor) Bytes() []byte {
+	out := make([]byte, 0, len(t.data)*4)
+	for _, f := range t.data {
+		out = binary.LittleEndian.AppendUint32(out, math.Float32bits(f))
+	}
+	return out
+}
+
 func (t *testTensor) Floats() []float32 {
 	out := make([]float32, len(t.data))
 	copy(out, t.data)
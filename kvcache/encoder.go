@@ -2,6 +2,7 @@ package kvcache
 
 import (
 	"fmt"
+	"slices"
 
 	"github.com/ollama/ollama/ml"
 	"github.com/ollama/ollama/model/input"
@@ -9,7 +10,9 @@ import (
 
 // Encoder cache stores K and V tensors that are position independent
 //
-// The tensors can be of any shape and will be returned as they were stored
+// The tensors can be of any shape and will be returned as they were stored.
+// Storing tensors of a different shape than before, such as the encoding of
+// an image split into a different number of tiles, replaces the storage.
 // The mask is currently always nil
 //
 // Not currently safe for multiple sequences
@@ -54,6 +57,9 @@ func NewEncoderCache() *EncoderCache {
 	}
 }
 
+// Init prepares the cache. The encoder cache stores the key and value tensors
+// it is given as-is, so dtype (the requested K/V cache quantization) does not
+// apply to cross-attention layers.
 func (c *EncoderCache) Init(backend ml.Backend, dtype ml.DType, maxSequences, capacity, maxBatch int) {
 	if c.config == nil {
 		var config ml.CacheConfig
@@ -121,6 +127,13 @@ func (c *EncoderCache) Put(ctx ml.Context, key, value ml.Tensor) {
 		value = value.Permute(ctx, 1, 2, 0, 3)
 	}
 
+	if k, ok := c.keys[c.curLayer]; ok && (!slices.Equal(k.Shape(), key.Shape()) || !slices.Equal(c.values[c.curLayer].Shape(), value.Shape())) {
+		c.ctxs[c.curLayer].Close()
+		delete(c.ctxs, c.curLayer)
+		delete(c.keys, c.curLayer)
+		delete(c.values, c.curLayer)
+	}
+
 	if _, ok := c.ctxs[c.curLayer]; !ok {
 		c.ctxs[c.curLayer] = c.backend.NewContextSize(2).Layer(c.curLayer)
 	}
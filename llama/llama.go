@@ -87,7 +87,7 @@ type ContextParams struct {
 	c C.struct_llama_context_params
 }
 
-func NewContextParams(numCtx int, batchSize int, numSeqMax int, threads int, flashAttention bool, kvCacheType string) ContextParams {
+func NewContextParams(numCtx int, batchSize int, numSeqMax int, threads int, flashAttention bool, kvCacheType string, poolingType string) ContextParams {
 	params := C.llama_context_default_params()
 	params.n_ctx = C.uint(numCtx)
 	params.n_batch = C.uint(batchSize)
@@ -98,10 +98,28 @@ func NewContextParams(numCtx int, batchSize int, numSeqMax int, threads int, fla
 	params.flash_attn = C.bool(flashAttention)
 	params.type_k = kvCacheTypeFromStr(strings.ToLower(kvCacheType))
 	params.type_v = kvCacheTypeFromStr(strings.ToLower(kvCacheType))
+	params.pooling_type = poolingTypeFromStr(poolingType)
 
 	return ContextParams{c: params}
 }
 
+// poolingTypeFromStr converts a pooling type name to the corresponding llama
+// pooling type, defaulting to the model's own pooling
+func poolingTypeFromStr(s string) C.enum_llama_pooling_type {
+	switch s {
+	case "none":
+		return C.LLAMA_POOLING_TYPE_NONE
+	case "mean":
+		return C.LLAMA_POOLING_TYPE_MEAN
+	case "cls":
+		return C.LLAMA_POOLING_TYPE_CLS
+	case "last":
+		return C.LLAMA_POOLING_TYPE_LAST
+	default:
+		return C.LLAMA_POOLING_TYPE_UNSPECIFIED
+	}
+}
+
 // kvCacheTypeFromStr converts a string cache type to the corresponding GGML type value
 func kvCacheTypeFromStr(s string) C.enum_ggml_type {
 	if s == "" {
@@ -194,6 +212,19 @@ func (c *Context) GetEmbeddingsIth(i int) []float32 {
 	return embeddings
 }
 
+// GetLogitsIth returns the logits computed for the ith output of the last
+// batch, one for each token in the vocabulary
+func (c *Context) GetLogitsIth(i int) []float32 {
+	l := unsafe.Pointer(C.llama_get_logits_ith(c.c, C.int32_t(i)))
+	if l == nil {
+		return nil
+	}
+
+	logits := make([]float32, c.Model().NumVocab())
+	_ = copy(logits, unsafe.Slice((*float32)(l), len(logits)))
+	return logits
+}
+
 type ModelParams struct {
 	NumGpuLayers int
 	MainGpu      int
@@ -276,21 +307,49 @@ func (m *Model) AddBOSToken() bool {
 	return bool(C.llama_vocab_get_add_bos(m.Vocab()))
 }
 
-func (m *Model) ApplyLoraFromFile(context *Context, loraPath string, scale float32, threads int) error {
+func (m *Model) AddEOSToken() bool {
+	return bool(C.llama_vocab_get_add_eos(m.Vocab()))
+}
+
+// TokenBOS returns the model's beginning of sequence token, or -1 if it has
+// none
+func (m *Model) TokenBOS() int {
+	return int(C.llama_vocab_bos(m.Vocab()))
+}
+
+// TokenEOS returns the model's end of sequence token, or -1 if it has none
+func (m *Model) TokenEOS() int {
+	return int(C.llama_vocab_eos(m.Vocab()))
+}
+
+type LoraAdapter struct {
+	c *C.struct_llama_adapter_lora
+}
+
+// LoadLoraFromFile loads a LoRA adapter for the model. The adapter is not
+// applied to any context until it is passed to SetLoraAdapters.
+func (m *Model) LoadLoraFromFile(loraPath string) (*LoraAdapter, error) {
 	cLoraPath := C.CString(loraPath)
 	defer C.free(unsafe.Pointer(cLoraPath))
 
 	loraAdapter := C.llama_adapter_lora_init(m.c, cLoraPath)
 	if loraAdapter == nil {
-		return errors.New("unable to load lora")
+		return nil, errors.New("unable to load lora")
 	}
 
-	err := -1
-	if loraAdapter != nil {
-		err = int(C.llama_set_adapter_lora(context.c, loraAdapter, C.float(scale)))
-	}
-	if err != 0 {
-		return errors.New("error applying lora from file")
+	return &LoraAdapter{c: loraAdapter}, nil
+}
+
+// SetLoraAdapters replaces the adapters applied to the context with the
+// provided adapters, each applied with the given scale. Only the adapter
+// weights are swapped so this is cheap compared to reloading the model.
+func (c *Context) SetLoraAdapters(adapters []*LoraAdapter, scale float32) error {
+	C.llama_clear_adapter_lora(c.c)
+
+	for _, adapter := range adapters {
+		if int(C.llama_set_adapter_lora(c.c, adapter.c, C.float(scale))) != 0 {
+			return errors.New("error applying lora")
+		}
 	}
 
 	return nil
@@ -529,9 +588,13 @@ type SamplingParams struct {
 	PenaltyRepeat  float32
 	PenaltyFreq    float32
 	PenaltyPresent float32
+	Mirostat       int
+	MirostatTau    float32
+	MirostatEta    float32
 	PenalizeNl     bool
 	Seed           uint32
 	Grammar        string
+	LogitBias      map[int]float32
 }
 
 func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext, error) {
@@ -545,12 +608,30 @@ func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext,
 	cparams.penalty_repeat = C.float(params.PenaltyRepeat)
 	cparams.penalty_freq = C.float(params.PenaltyFreq)
 	cparams.penalty_present = C.float(params.PenaltyPresent)
+	cparams.mirostat = C.int32_t(params.Mirostat)
+	cparams.mirostat_tau = C.float(params.MirostatTau)
+	cparams.mirostat_eta = C.float(params.MirostatEta)
 	cparams.seed = C.uint32_t(params.Seed)
 
 	grammar := C.CString(params.Grammar)
 	defer C.free(unsafe.Pointer(grammar))
 
 	cparams.grammar = grammar
+
+	if len(params.LogitBias) > 0 {
+		cLogitBias := (*C.struct_llama_logit_bias)(C.malloc(C.size_t(len(params.LogitBias)) * C.size_t(unsafe.Sizeof(C.struct_llama_logit_bias{}))))
+		defer C.free(unsafe.Pointer(cLogitBias))
+
+		logitBias := unsafe.Slice(cLogitBias, len(params.LogitBias))
+		i := 0
+		for id, bias := range params.LogitBias {
+			logitBias[i] = C.struct_llama_logit_bias{token: C.llama_token(id), bias: C.float(bias)}
+			i++
+		}
+		cparams.logit_bias = cLogitBias
+		cparams.n_logit_bias = C.size_t(len(logitBias))
+	}
+
 	context := &SamplingContext{c: C.common_sampler_cinit(model.c, &cparams)}
 	if context.c == nil {
 		return nil, errors.New("unable to create sampling context")
@@ -574,8 +655,9 @@ func (s *SamplingContext) Accept(id int, applyGrammar bool) {
 }
 
 // SchemaToGrammar converts the provided JSON schema to a grammar. It returns
-// nil if the provided schema is invalid JSON or an invalid JSON schema.
-func SchemaToGrammar(schema []byte) []byte {
+// an error if the provided schema is invalid JSON, an invalid JSON schema or
+// uses features that cannot be expressed as a grammar.
+func SchemaToGrammar(schema []byte) ([]byte, error) {
 	cStr := C.CString(string(schema))
 	defer C.free(unsafe.Pointer(cStr))
 
@@ -583,13 +665,28 @@ func SchemaToGrammar(schema []byte) []byte {
 	maxLen := max(32768, min(1024*1024, len(schema)*4))
 	buf := make([]byte, maxLen)
 
-	// Call C function to convert schema to grammar
-	n := C.schema_to_grammar(cStr, (*C.char)(unsafe.Pointer(&buf[0])), C.size_t(maxLen))
-	if n == 0 {
-		// preserve nil
-		return nil
+	// Call C function to convert schema to grammar. A negative length
+	// indicates the buffer holds an error message instead.
+	n := int(C.schema_to_grammar(cStr, (*C.char)(unsafe.Pointer(&buf[0])), C.size_t(maxLen)))
+	if n < 0 {
+		return nil, errors.New(strings.TrimSpace(string(buf[:-n])))
+	} else if n == 0 {
+		return nil, errors.New("empty grammar")
 	}
-	return buf[:n]
+	return buf[:n], nil
+}
+
+// ValidateGrammar parses the provided GBNF grammar and returns an error
+// describing the problem if it is malformed or has no root rule.
+func ValidateGrammar(grammar string) error {
+	cStr := C.CString(grammar)
+	defer C.free(unsafe.Pointer(cStr))
+
+	buf := make([]byte, 1024)
+	if n := int(C.grammar_validate(cStr, (*C.char)(unsafe.Pointer(&buf[0])), C.size_t(len(buf)))); n > 0 {
+		return errors.New(strings.TrimSpace(string(buf[:n])))
+	}
+	return nil
 }
 
 type TokenData struct {
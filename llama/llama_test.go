@@ -55,9 +55,9 @@ const issue7978JSONSchema = `{
 }`
 
 func TestIssue7978(t *testing.T) {
-	g := SchemaToGrammar([]byte(issue7978JSONSchema))
-	if g == nil {
-		t.Fatal("failed to convert JSON schema to grammar")
+	g, err := SchemaToGrammar([]byte(issue7978JSONSchema))
+	if err != nil {
+		t.Fatalf("failed to convert JSON schema to grammar: %v", err)
 	}
 
 	t.Logf("grammar:\n%s", g)
@@ -86,6 +86,8 @@ func TestSchemaToGrammer(t *testing.T) {
 		prefix []byte // nil is check as nil
 	}{
 		{`invalid`, nil},
+		{`{"type":"unknown"}`, nil},
+		{`{"$ref":"#/$defs/missing"}`, nil},
 
 		// Simple heuristic/smoke test
 		{`{"type":"object"}`, []byte("root ::= object")},
@@ -93,9 +95,15 @@ func TestSchemaToGrammer(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run("x", func(t *testing.T) {
-			g := SchemaToGrammar([]byte(c.schema))
-			if c.prefix == nil && g != nil {
-				t.Fatalf("grammar = %v, want nil", g)
+			g, err := SchemaToGrammar([]byte(c.schema))
+			if c.prefix == nil {
+				if err == nil {
+					t.Fatalf("grammar = %q, want error", g)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
 			}
 			if !bytes.HasPrefix(g, c.prefix) {
 				t.Errorf("grammar = %q, want %q", g, c.prefix)
@@ -103,3 +111,29 @@ func TestSchemaToGrammer(t *testing.T) {
 		})
 	}
 }
+
+func TestSchemaToGrammarConstraints(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{"integer", `{"type":"integer"}`, `root ::= ("-"? integral-part) space`},
+		{"number", `{"type":"number"}`, `root ::= ("-"? integral-part) ("." decimal-part)?`},
+		{"string length", `{"type":"string","minLength":2,"maxLength":4}`, `char{2,4}`},
+		{"integer range", `{"type":"integer","minimum":1,"maximum":9}`, `[1-9]`},
+		{"enum", `{"enum":["red","green"]}`, `"\"red\"" | "\"green\""`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			g, err := SchemaToGrammar([]byte(c.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(g, []byte(c.want)) {
+				t.Errorf("grammar = %q, want to contain %q", g, c.want)
+			}
+		})
+	}
+}
@@ -19,8 +19,12 @@ struct common_sampler *common_sampler_cinit(const struct llama_model *model, str
         sparams.penalty_repeat = params->penalty_repeat;
         sparams.penalty_freq = params->penalty_freq;
         sparams.penalty_present = params->penalty_present;
+        sparams.mirostat = params->mirostat;
+        sparams.mirostat_tau = params->mirostat_tau;
+        sparams.mirostat_eta = params->mirostat_eta;
         sparams.seed = params->seed;
         sparams.grammar = params->grammar;
+        sparams.logit_bias.assign(params->logit_bias, params->logit_bias + params->n_logit_bias);
         sparams.xtc_probability = 0.0;
         sparams.xtc_threshold = 0.5;
         return common_sampler_init(model, sparams);
@@ -61,9 +65,73 @@ int schema_to_grammar(const char *json_schema, char *grammar, size_t max_len)
     }
     catch (const std::exception &e)
     {
-        strncpy(grammar, "", max_len - 1);
+        // report the reason as a negative length so callers can surface
+        // why the schema was rejected
+        size_t len = strlen(e.what());
+        if (len >= max_len)
+        {
+            len = max_len - 1;
+        }
+        strncpy(grammar, e.what(), len);
+        return -(int)len;
+    }
+}
+
+int grammar_validate(const char *grammar, char *err, size_t max_len)
+{
+    try
+    {
+        llama_grammar_parser parser;
+
+        // parse_rule expects leading whitespace and comments to be consumed
+        const char *pos = grammar;
+        while (*pos == ' ' || *pos == '\t' || *pos == '\r' || *pos == '\n' || *pos == '#')
+        {
+            if (*pos == '#')
+            {
+                while (*pos && *pos != '\r' && *pos != '\n')
+                {
+                    pos++;
+                }
+            }
+            else
+            {
+                pos++;
+            }
+        }
+
+        while (*pos)
+        {
+            pos = parser.parse_rule(pos);
+        }
+
+        for (const auto &kv : parser.symbol_ids)
+        {
+            if (kv.second >= parser.rules.size() || parser.rules[kv.second].empty())
+            {
+                throw std::runtime_error("undefined rule identifier '" + kv.first + "'");
+            }
+        }
+
+        if (parser.symbol_ids.find("root") == parser.symbol_ids.end())
+        {
+            throw std::runtime_error("grammar does not contain a 'root' rule");
+        }
+
         return 0;
     }
+    catch (const std::exception &e)
+    {
+        // report the reason as a positive length so callers can surface
+        // why the grammar was rejected
+        size_t len = strlen(e.what());
+        if (len >= max_len)
+        {
+            len = max_len - 1;
+        }
+        strncpy(err, e.what(), len);
+        return len;
+    }
 }
 
 struct llama_vocab * llama_load_vocab_from_file(const char * fname) {
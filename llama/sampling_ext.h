@@ -20,8 +20,13 @@ extern "C"
         float penalty_repeat;
         float penalty_freq;
         float penalty_present;
+        int32_t mirostat;
+        float mirostat_tau;
+        float mirostat_eta;
         uint32_t seed;
         char *grammar;
+        const struct llama_logit_bias *logit_bias;
+        size_t n_logit_bias;
     };
 
     struct common_sampler *common_sampler_cinit(const struct llama_model *model, struct common_sampler_cparams *params);
@@ -31,6 +36,7 @@ extern "C"
     llama_token common_sampler_csample(struct common_sampler *sampler, struct llama_context *ctx, int idx);
 
     int schema_to_grammar(const char *json_schema, char *grammar, size_t max_len);
+    int grammar_validate(const char *grammar, char *err, size_t max_len);
 
 
     struct llama_grammar *grammar_init(char* grammar, uint32_t* tokens, size_t n_tokens, const char** pieces, uint32_t* eog_tokens, size_t n_eog_tokens);
@@ -128,4 +128,30 @@ func TestEstimateGPULayers(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("forced", func(t *testing.T) {
+		gpus[0].FreeMemory = 0
+		gpus[1].FreeMemory = 0
+		opts := opts
+		opts.NumGPU = 4
+		opts.ForceGPULayers = true
+
+		// nothing fits, but the requested layers are trusted and still sized
+		estimate := EstimateGPULayers(gpus, ggml, projectors, opts, 1)
+		assert.Equal(t, 4, estimate.Layers)
+		assert.Equal(t, "2,2", estimate.TensorSplit)
+		var layerSums uint64
+		for _, b := range estimate.GPUSizes {
+			assert.Greater(t, b, gpuMinimumMemory+2*layerSize+graphPartialOffload)
+			layerSums += b
+		}
+		assert.Equal(t, estimate.VRAMSize, layerSums)
+		assert.Less(t, estimate.VRAMSize, estimate.TotalSize)
+
+		fits, _ := PredictServerFit(gpus, ggml, nil, projectors, opts, 1)
+		assert.True(t, fits)
+
+		opts.ForceGPULayers = false
+		assert.Equal(t, 0, EstimateGPULayers(gpus, ggml, projectors, opts, 1).Layers)
+	})
 }
@@ -3,13 +3,16 @@ package llm
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -21,7 +24,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/sync/semaphore"
 
@@ -62,18 +67,40 @@ func (e filteredEnv) LogValue() slog.Value {
 	return slog.GroupValue(attrs...)
 }
 
+// ErrPoolingUnsupported is returned when loading a model that runs on the
+// Ollama engine with pooling "none", since the engine always pools token
+// embeddings into one
+var ErrPoolingUnsupported = errors.New(`pooling "none" is not supported by models that run on the Ollama engine`)
+
 type LlamaServer interface {
 	Ping(ctx context.Context) error
 	WaitUntilRunning(ctx context.Context) error
 	Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error
-	Embedding(ctx context.Context, input string) ([]float32, error)
+	// Embedding embeds input. If fn is not nil, it is called with the
+	// progress of processing inputs that take more than one batch.
+	Embedding(ctx context.Context, input string, fn func(api.PromptEvalProgress)) ([]float32, error)
 	Tokenize(ctx context.Context, content string) ([]int, error)
+	// PromptTokens tokenizes the prompt of req as the runner does for a
+	// completion, including the special tokens it inserts. Images in the
+	// prompt are not counted.
+	PromptTokens(ctx context.Context, req CompletionRequest) ([]int, error)
 	Detokenize(ctx context.Context, tokens []int) (string, error)
 	Close() error
 	EstimatedVRAM() uint64 // Total VRAM across all GPUs
 	EstimatedTotal() uint64
 	EstimatedVRAMByGPU(gpuID string) uint64
+	// LoadProgress is how much of the model has been loaded, from 0 to 1
+	LoadProgress() float32
+	// TrainContextLength is the context length the model was trained with,
+	// or extended to by RoPE scaling, or 0 if it isn't known
+	TrainContextLength() int
 	Pid() int
+	Usage(ctx context.Context) (ServerUsage, error)
+	// SaveSession writes the session sharing the longest prefix with tokens,
+	// or the most recently used one if tokens is empty, to path and returns
+	// the tokens of the saved session. The session is recorded as saved
+	// with the model with the given digest.
+	SaveSession(ctx context.Context, digest string, tokens []int, path string) ([]int, error)
 }
 
 // llmServer is an instance of the llama.cpp server
@@ -84,7 +111,9 @@ type llmServer struct {
 	status      *StatusWriter
 	options     api.Options
 	numParallel int
+	trainCtx    int
 	modelPath   string
+	adapters    []string
 
 	// llamaModel is an instance of the cgo llama.cpp model definition
 	// nil if this server is running the new engine
@@ -95,14 +124,117 @@ type llmServer struct {
 	// nil if this server is running the llama.cpp based engine
 	textProcessor model.TextProcessor
 
+	// tokenPieces is the text of each token in the vocabulary, decoded on
+	// first use for token healing. Guarded by llamaModelLock.
+	tokenPieces []string
+
 	estimate    MemoryEstimate
 	totalLayers uint64
 	// gpuCount     int
 	gpus         discover.GpuInfoList // Recorded just before the model loaded, free space will be incorrect
 	loadDuration time.Duration        // Record how long it took the model to load
-	loadProgress float32
+
+	// loadProgress holds the bits of the float32 load progress so it can be
+	// read while the model is loading
+	loadProgress atomic.Uint32
 
 	sem *semaphore.Weighted
+
+	// embedding is set for models that only produce embeddings, which
+	// can't generate a token to warm up with
+	embedding bool
+
+	// systemCache holds the system prompts retained in the runner's KV cache
+	systemCache systemPromptCache
+}
+
+// systemPromptCache tracks, by content hash, the system prompts that the
+// runner has been asked to retain in its KV cache, keeping the most recently
+// used ones up to the number of cache slots
+type systemPromptCache struct {
+	mu       sync.Mutex
+	lastUsed map[[sha256.Size]byte]time.Time
+}
+
+// contains reports whether the system prompt was retained by an earlier
+// request
+func (c *systemPromptCache) contains(prompt string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := sha256.Sum256([]byte(prompt))
+	if _, ok := c.lastUsed[key]; !ok {
+		return false
+	}
+
+	c.lastUsed[key] = time.Now()
+	return true
+}
+
+// add records that the system prompt has been retained, forgetting the least
+// recently used prompt once there are more than limit
+func (c *systemPromptCache) add(prompt string, limit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lastUsed == nil {
+		c.lastUsed = make(map[[sha256.Size]byte]time.Time)
+	}
+
+	c.lastUsed[sha256.Sum256([]byte(prompt))] = time.Now()
+
+	for len(c.lastUsed) > max(limit, 1) {
+		var oldest [sha256.Size]byte
+		var oldestTime time.Time
+		for key, t := range c.lastUsed {
+			if oldestTime.IsZero() || t.Before(oldestTime) {
+				oldest, oldestTime = key, t
+			}
+		}
+		delete(c.lastUsed, oldest)
+	}
+}
+
+// loadVocabulary loads the vocabulary of the model at modelPath for the
+// engine it runs on, the Ollama engine if it supports the model or the
+// llama engine otherwise. Exactly one of the results is non-nil.
+func loadVocabulary(modelPath string, f *ggml.GGML) (*llama.Model, model.TextProcessor, error) {
+	if envconfig.NewEngine() || f.KV().OllamaEngineRequired() {
+		textProcessor, err := model.NewTextProcessor(modelPath)
+		if err == nil {
+			return nil, textProcessor, nil
+		}
+
+		// To prepare for opt-out mode, instead of treating this as an error, we fallback to the old runner
+		slog.Debug("model not yet supported by Ollama engine, switching to compatibility mode", "model", modelPath, "error", err)
+	}
+
+	llamaModel, err := llama.LoadModelFromFile(modelPath, llama.ModelParams{VocabOnly: true})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return llamaModel, nil, nil
+}
+
+// Tokenizer converts between text and tokens with a model's vocabulary
+type Tokenizer interface {
+	Tokenize(ctx context.Context, content string) ([]int, error)
+	Detokenize(ctx context.Context, tokens []int) (string, error)
+	// Pieces returns the text of each of tokens decoded on its own
+	Pieces(ctx context.Context, tokens []int) ([]string, error)
+	Close() error
+}
+
+// NewTokenizer loads only the vocabulary of the model at modelPath, so that
+// text can be tokenized as the model would without loading it
+func NewTokenizer(modelPath string, f *ggml.GGML) (Tokenizer, error) {
+	llamaModel, textProcessor, err := loadVocabulary(modelPath, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &llmServer{llamaModel: llamaModel, textProcessor: textProcessor}, nil
 }
 
 // LoadModel will load a model from disk. The model must be in the GGML format.
@@ -115,14 +247,7 @@ func LoadModel(model string, maxArraySize int) (*ggml.GGML, error) {
 		return nil, err
 	}
 
-	f, err := os.Open(model)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	ggml, err := ggml.Decode(f, maxArraySize)
-	return ggml, err
+	return ggml.DecodeFile(model, maxArraySize)
 }
 
 // NewLlamaServer will run a server for the given GPUs
@@ -139,11 +264,51 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		gpus = discover.GetCPUInfo()
 	}
 
-	// Verify the requested context size is <= the model training size
+	llamaModel, textProcessor, err := loadVocabulary(modelPath, f)
+	if err != nil {
+		return nil, err
+	}
+
+	if textProcessor != nil && opts.Pooling == "none" {
+		return nil, ErrPoolingUnsupported
+	}
+
+	// RoPE scaling is only honored by some architectures on the Ollama
+	// engine, and would otherwise widen the context without adjusting the
+	// frequencies to match
+	if err := opts.ValidateRopeScaling(f.KV().Architecture(), textProcessor != nil); err != nil {
+		return nil, err
+	}
+
+	// Verify the requested context size is <= the model training size, or
+	// the size it is extended to by RoPE scaling, unless it's overridden
 	trainCtx := f.KV().ContextLength()
+	if opts.RopeFrequencyScale > 0 {
+		trainCtx = uint64(float32(trainCtx) / opts.RopeFrequencyScale)
+	}
 	if opts.NumCtx/numParallel > int(trainCtx) && trainCtx > 0 {
-		slog.Warn("requested context size too large for model", "num_ctx", opts.NumCtx, "num_parallel", numParallel, "n_ctx_train", trainCtx)
-		opts.NumCtx = int(trainCtx) * numParallel
+		if opts.ExceedTrainCtx {
+			slog.Warn("requested context size is larger than the model was trained with", "num_ctx", opts.NumCtx, "num_parallel", numParallel, "n_ctx_train", trainCtx)
+		} else {
+			slog.Warn("requested context size too large for model", "num_ctx", opts.NumCtx, "num_parallel", numParallel, "n_ctx_train", trainCtx)
+			opts.NumCtx = int(trainCtx) * numParallel
+		}
+	}
+
+	if opts.GPULayerRanges != "" {
+		layers, err := api.ParseLayerRanges(opts.GPULayerRanges)
+		if err != nil {
+			return nil, err
+		}
+
+		// the output layer is numbered after the last repeating layer
+		if last := layers[len(layers)-1]; uint64(last) > f.KV().BlockCount() {
+			return nil, fmt.Errorf("gpu_layer_ranges: layer %d is out of range for a model with %d layers", last, f.KV().BlockCount()+1)
+		}
+	}
+
+	if opts.ForceGPULayers {
+		slog.Warn("free gpu memory check bypassed by force_gpu_layers, the model may not fit", "num_gpu", opts.NumGPU, "num_ctx", opts.NumCtx)
 	}
 
 	estimate := EstimateGPULayers(gpus, f, projectors, opts, numParallel)
@@ -174,60 +339,8 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 
 	slog.Info("offload", "", estimate)
 
-	params := []string{
-		"--model", modelPath,
-		"--ctx-size", strconv.Itoa(opts.NumCtx),
-		"--batch-size", strconv.Itoa(opts.NumBatch),
-	}
-
-	if opts.NumGPU >= 0 {
-		params = append(params, "--n-gpu-layers", strconv.Itoa(opts.NumGPU))
-	}
-
-	if opts.MainGPU > 0 {
-		params = append(params, "--main-gpu", strconv.Itoa(opts.MainGPU))
-	}
-
-	if len(adapters) > 0 {
-		for _, adapter := range adapters {
-			params = append(params, "--lora", adapter)
-		}
-	}
-
-	defaultThreads := systemInfo.GetOptimalThreadCount()
-	if opts.NumThread > 0 {
-		params = append(params, "--threads", strconv.Itoa(opts.NumThread))
-	} else if defaultThreads > 0 {
-		params = append(params, "--threads", strconv.Itoa(defaultThreads))
-	}
-
-	fa := envconfig.FlashAttention()
-	if fa && !gpus.FlashAttentionSupported() {
-		slog.Warn("flash attention enabled but not supported by gpu")
-		fa = false
-	}
-
-	if fa && !f.SupportsFlashAttention() {
-		slog.Warn("flash attention enabled but not supported by model")
-		fa = false
-	}
-
-	kvct := strings.ToLower(envconfig.KvCacheType())
-
-	if fa {
-		slog.Info("enabling flash attention")
-		params = append(params, "--flash-attn")
-
-		// Flash Attention also supports kv cache quantization
-		// Enable if the requested and kv cache type is supported by the model
-		if kvct != "" && f.SupportsKVCacheType(kvct) {
-			params = append(params, "--kv-cache-type", kvct)
-		} else {
-			slog.Warn("kv cache type not supported by model", "type", kvct)
-		}
-	} else if kvct != "" && kvct != "f16" {
-		slog.Warn("quantized kv cache requested but flash attention disabled", "type", kvct)
-	}
+	params := runnerParams(modelPath, adapters, opts, systemInfo.GetOptimalThreadCount())
+	params = append(params, flashAttentionParams(gpus, f, opts)...)
 
 	// mmap has issues with partial offloading on metal
 	for _, g := range gpus {
@@ -298,22 +411,6 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		exe = eval
 	}
 
-	var llamaModel *llama.Model
-	var textProcessor model.TextProcessor
-	if envconfig.NewEngine() || f.KV().OllamaEngineRequired() {
-		textProcessor, err = model.NewTextProcessor(modelPath)
-		if err != nil {
-			// To prepare for opt-out mode, instead of treating this as an error, we fallback to the old runner
-			slog.Debug("model not yet supported by Ollama engine, switching to compatibility mode", "model", modelPath, "error", err)
-		}
-	}
-	if textProcessor == nil {
-		llamaModel, err = llama.LoadModelFromFile(modelPath, llama.ModelParams{VocabOnly: true})
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	if len(projectors) > 0 && llamaModel != nil {
 		params = append(params, "--mmproj", projectors[0])
 	}
@@ -339,6 +436,41 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 			// New engine
 			// TODO - if we have failure to load scenarios, add logic to retry with the old runner
 			finalParams = append(finalParams, "--ollama-engine")
+			for _, override := range opts.GGUFOverride {
+				key, value, _ := api.ParseGGUFOverride(override)
+				finalParams = append(finalParams, "--gguf-override", key+"="+value)
+			}
+			if opts.RopeFrequencyScale > 0 {
+				finalParams = append(finalParams, "--rope-scaling-type", cmp.Or(opts.RopeScalingType, "linear"), "--rope-freq-scale", strconv.FormatFloat(float64(opts.RopeFrequencyScale), 'f', -1, 32))
+			}
+			if len(opts.RopeFactors) > 0 && f.KV().Architecture() != "mllama" {
+				slog.Warn("rope_factors is only supported by mllama models, ignoring", "architecture", f.KV().Architecture(), "count", len(opts.RopeFactors))
+			} else if len(opts.RopeFactors) > 0 {
+				factors := make([]string, len(opts.RopeFactors))
+				for i, f := range opts.RopeFactors {
+					factors[i] = strconv.FormatFloat(float64(f), 'f', -1, 32)
+				}
+				finalParams = append(finalParams, "--rope-factors", strings.Join(factors, ","))
+			}
+			if opts.Pooling != "" {
+				slog.Warn("pooling is not supported by the Ollama engine, ignoring", "pooling", opts.Pooling)
+			}
+			if opts.GPULayerRanges != "" && opts.NumGPU > 0 {
+				finalParams = append(finalParams, "--gpu-layer-ranges", opts.GPULayerRanges)
+			}
+		} else {
+			if opts.GPULayerRanges != "" {
+				slog.Warn("gpu_layer_ranges is only supported by the Ollama engine, offloading the last layers instead", "ranges", opts.GPULayerRanges, "num_gpu", opts.NumGPU)
+			}
+			if len(opts.GGUFOverride) > 0 {
+				slog.Warn("gguf_override is only supported by the Ollama engine, ignoring", "overrides", opts.GGUFOverride)
+			}
+			if len(opts.RopeFactors) > 0 {
+				slog.Warn("rope_factors is only supported by the Ollama engine, ignoring", "count", len(opts.RopeFactors))
+			}
+			if opts.Pooling != "" {
+				finalParams = append(finalParams, "--pooling", opts.Pooling)
+			}
 		}
 		finalParams = append(finalParams, params...)
 		finalParams = append(finalParams, "--port", strconv.Itoa(port))
@@ -379,20 +511,24 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		// finally, add the root library path
 		libraryPaths = append(libraryPaths, discover.LibOllamaPath)
 
+		_, embedding := f.KV()[fmt.Sprintf("%s.pooling_type", f.KV().Architecture())]
 		s := &llmServer{
 			port:          port,
 			cmd:           exec.Command(exe, finalParams...),
 			status:        NewStatusWriter(os.Stderr),
 			options:       opts,
 			modelPath:     modelPath,
+			adapters:      adapters,
 			llamaModel:    llamaModel,
 			textProcessor: textProcessor,
 			estimate:      estimate,
 			numParallel:   numParallel,
+			trainCtx:      int(trainCtx),
 			sem:           semaphore.NewWeighted(int64(numParallel)),
 			totalLayers:   f.KV().BlockCount() + 1,
 			gpus:          gpus,
 			done:          make(chan error, 1),
+			embedding:     embedding,
 		}
 
 		s.cmd.Env = os.Environ()
@@ -503,9 +639,48 @@ func (s ServerStatus) String() string {
 type ServerStatusResponse struct {
 	Status   ServerStatus `json:"status"`
 	Progress float32      `json:"progress"`
+
+	// Usage is set once the model is loaded
+	Usage *ServerUsage `json:"usage,omitempty"`
+}
+
+// ServerUsage is the current resource usage of a runner
+type ServerUsage struct {
+	// ContextUsed is the number of inputs currently held in the KV cache
+	// across all parallel sequences, out of ContextTotal
+	ContextUsed  int `json:"context_used"`
+	ContextTotal int `json:"context_total"`
+
+	// VRAM is the GPU memory allocated by the runner and GPULayers the
+	// number of layers that were offloaded
+	VRAM      uint64 `json:"vram"`
+	GPULayers int    `json:"gpu_layers"`
+
+	// GPULayerRanges lists the offloaded layers in the form of
+	// [api.Runner.GPULayerRanges]
+	GPULayerRanges string `json:"gpu_layer_ranges,omitempty"`
 }
 
 func (s *llmServer) getServerStatus(ctx context.Context) (ServerStatus, error) {
+	ssr, status, err := s.health(ctx)
+	if err != nil {
+		return status, err
+	}
+
+	switch ssr.Status {
+	case ServerStatusLoadingModel:
+		s.loadProgress.Store(math.Float32bits(ssr.Progress))
+		return ssr.Status, nil
+	case ServerStatusReady, ServerStatusNoSlotsAvailable:
+		return ssr.Status, nil
+	default:
+		return ssr.Status, fmt.Errorf("server error: %+v", *ssr)
+	}
+}
+
+// health queries the runner's health endpoint. On failure, the returned
+// status describes why the runner could not be reached.
+func (s *llmServer) health(ctx context.Context) (*ServerStatusResponse, ServerStatus, error) {
 	// Fail fast if its exited
 	if s.cmd.ProcessState != nil {
 		msg := ""
@@ -516,46 +691,68 @@ func (s *llmServer) getServerStatus(ctx context.Context) (ServerStatus, error) {
 			// Most likely a signal killed it, log some more details to try to help troubleshoot
 			slog.Warn("llama runner process no longer running", "sys", s.cmd.ProcessState.Sys(), "string", s.cmd.ProcessState)
 		}
-		return ServerStatusError, fmt.Errorf("llama runner process no longer running: %d %s", s.cmd.ProcessState.ExitCode(), msg)
+		return nil, ServerStatusError, fmt.Errorf("llama runner process no longer running: %d %s", s.cmd.ProcessState.ExitCode(), msg)
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/health", s.port), nil)
 	if err != nil {
-		return ServerStatusError, fmt.Errorf("error creating GET request: %v", err)
+		return nil, ServerStatusError, fmt.Errorf("error creating GET request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		if errors.Is(err, context.DeadlineExceeded) {
-			return ServerStatusNotResponding, errors.New("server not responding")
+			return nil, ServerStatusNotResponding, errors.New("server not responding")
 		}
 		if strings.Contains(err.Error(), "connection refused") {
-			return ServerStatusNotResponding, errors.New("connection refused")
+			return nil, ServerStatusNotResponding, errors.New("connection refused")
 		}
-		return ServerStatusError, fmt.Errorf("health resp: %w", err)
+		return nil, ServerStatusError, fmt.Errorf("health resp: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return ServerStatusError, fmt.Errorf("read health request: %w", err)
+		return nil, ServerStatusError, fmt.Errorf("read health request: %w", err)
 	}
 
 	var ssr ServerStatusResponse
 	if err := json.Unmarshal(body, &ssr); err != nil {
-		return ServerStatusError, fmt.Errorf("health unmarshal encode response: %w", err)
+		return nil, ServerStatusError, fmt.Errorf("health unmarshal encode response: %w", err)
 	}
 
-	switch ssr.Status {
-	case ServerStatusLoadingModel:
-		s.loadProgress = ssr.Progress
-		return ssr.Status, nil
-	case ServerStatusReady, ServerStatusNoSlotsAvailable:
-		return ssr.Status, nil
-	default:
-		return ssr.Status, fmt.Errorf("server error: %+v", ssr)
+	return &ssr, ssr.Status, nil
+}
+
+// Usage returns the runner's current context and GPU usage. The llama.cpp
+// engine can't report the GPU memory it allocated, so the load time estimate
+// is used instead.
+func (s *llmServer) Usage(ctx context.Context) (ServerUsage, error) {
+	ssr, _, err := s.health(ctx)
+	if err != nil {
+		return ServerUsage{}, err
+	}
+
+	if ssr.Usage == nil {
+		return ServerUsage{}, errors.New("model is not loaded")
 	}
+
+	usage := *ssr.Usage
+	if s.llamaModel != nil {
+		usage.VRAM = s.estimate.VRAMSize
+		usage.GPULayers = s.estimate.Layers
+
+		// llama.cpp offloads the last repeating layers, then the output layer
+		var layers []int
+		start := max(0, int(s.totalLayers)-1-usage.GPULayers)
+		for i := start; i < min(start+usage.GPULayers, int(s.totalLayers)); i++ {
+			layers = append(layers, i)
+		}
+		usage.GPULayerRanges = api.FormatLayerRanges(layers)
+	}
+
+	return usage, nil
 }
 
 // getServerStatusRetry will retry if ServerStatusNoSlotsAvailable is received
@@ -614,7 +811,7 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 			if s.status != nil && s.status.LastErrMsg != "" {
 				msg = s.status.LastErrMsg
 			}
-			return fmt.Errorf("timed out waiting for llama runner to start - progress %0.2f - %s", s.loadProgress, msg)
+			return fmt.Errorf("timed out waiting for llama runner to start - progress %0.2f - %s", s.LoadProgress(), msg)
 		}
 		if s.cmd.ProcessState != nil {
 			msg := ""
@@ -623,26 +820,32 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 			}
 			return fmt.Errorf("llama runner process no longer running: %d %s", s.cmd.ProcessState.ExitCode(), msg)
 		}
-		ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		statusCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
 		defer cancel()
-		priorProgress := s.loadProgress
-		status, _ := s.getServerStatus(ctx)
+		priorProgress := s.LoadProgress()
+		status, _ := s.getServerStatus(statusCtx)
 		if lastStatus != status && status != ServerStatusReady {
 			// Only log on status changes
 			slog.Info("waiting for server to become available", "status", status)
 		}
 		switch status {
 		case ServerStatusReady:
+			s.loadProgress.Store(math.Float32bits(1))
 			s.loadDuration = time.Since(start)
 			slog.Info(fmt.Sprintf("llama runner started in %0.2f seconds", s.loadDuration.Seconds()))
+			if !envconfig.NoWarmup() && !s.embedding {
+				// the model is usable without warming up, so requests
+				// don't wait for it beyond sharing the runner's slots
+				go s.warmup(context.WithoutCancel(ctx))
+			}
 			return nil
 		default:
 			lastStatus = status
 			// Reset the timer as long as we're making forward progress on the load
-			if priorProgress != s.loadProgress {
-				slog.Debug(fmt.Sprintf("model load progress %0.2f", s.loadProgress))
+			if progress := s.LoadProgress(); priorProgress != progress {
+				slog.Debug(fmt.Sprintf("model load progress %0.2f", progress))
 				stallTimer = time.Now().Add(stallDuration)
-			} else if !fullyLoaded && int(s.loadProgress*100.0) >= 100 {
+			} else if !fullyLoaded && int(progress*100.0) >= 100 {
 				slog.Debug("model load completed, waiting for server to become available", "status", status)
 				stallTimer = time.Now().Add(stallDuration)
 				fullyLoaded = true
@@ -653,6 +856,24 @@ func (s *llmServer) WaitUntilRunning(ctx context.Context) error {
 	}
 }
 
+// warmup generates a single token from a short prompt so the first real
+// request doesn't pay for cold caches and kernel compilation. Failing to warm
+// up doesn't stop the model from being used so errors are only logged.
+func (s *llmServer) warmup(ctx context.Context) {
+	start := time.Now()
+
+	opts := api.DefaultOptions()
+	opts.NumPredict = 1
+	opts.Temperature = 0
+
+	if err := s.Completion(ctx, CompletionRequest{Prompt: "hello", Options: &opts}, func(CompletionResponse) {}); err != nil {
+		slog.Warn("model warmup failed", "error", err)
+		return
+	}
+
+	slog.Info(fmt.Sprintf("llama runner warmed up in %0.2f seconds", time.Since(start).Seconds()))
+}
+
 func (s *llmServer) Pid() int {
 	if s.cmd != nil && s.cmd.Process != nil {
 		return s.cmd.Process.Pid
@@ -685,9 +906,17 @@ ws ::= ([ \t\n] ws)?
 
 const maxBufferSize = 512 * format.KiloByte
 
+// maxLogitsBufferSize is the maximum size of a response line from the runner
+// when it includes logits
+const maxLogitsBufferSize = 64 * format.MegaByte
+
 type ImageData struct {
 	Data []byte `json:"data"`
 	ID   int    `json:"id"`
+
+	// Detail is the level of detail the image is encoded at, set from the
+	// request's image_detail option
+	Detail string `json:"detail,omitempty"`
 }
 
 type CompletionRequest struct {
@@ -697,6 +926,43 @@ type CompletionRequest struct {
 	Options *api.Options
 
 	Grammar string // set before sending the request to the subprocess
+	Adapter string // path of the selected adapter, set before sending the request to the subprocess
+
+	// Session is the path of a session saved with SaveSession that the
+	// runner restores into its KV cache before processing the prompt. The
+	// prompt should start with the session's tokens.
+	Session string
+
+	// CachePrefix is the length in bytes of a system prompt at the start of
+	// Prompt that the runner retains in its KV cache for later requests
+	CachePrefix int
+
+	// SkipSpecialTokens tokenizes Prompt without the special tokens, such as
+	// BOS, that the model's tokenizer would otherwise insert. Special tokens
+	// written in Prompt are still recognized.
+	SkipSpecialTokens bool
+}
+
+// adapterName returns the name used to select the adapter at path, its digest
+func adapterName(path string) string {
+	return strings.Replace(filepath.Base(path), "-", ":", 1)
+}
+
+// adapterPath returns the path of the model adapter with the given name
+func (s *llmServer) adapterPath(name string) (string, error) {
+	names := make([]string, len(s.adapters))
+	for i, adapter := range s.adapters {
+		if adapterName(adapter) == name {
+			return adapter, nil
+		}
+		names[i] = adapterName(adapter)
+	}
+
+	if len(names) == 0 {
+		return "", fmt.Errorf("adapter %q not found; model has no adapters", name)
+	}
+
+	return "", fmt.Errorf("adapter %q not found; available adapters: %s", name, strings.Join(names, ", "))
 }
 
 // DoneReason represents the reason why a completion response is done
@@ -709,6 +975,8 @@ const (
 	DoneReasonLength
 	// DoneReasonConnectionClosed indicates the completion stopped due to the connection being closed
 	DoneReasonConnectionClosed
+	// DoneReasonTimeout indicates the completion stopped because the request's deadline passed
+	DoneReasonTimeout
 )
 
 func (d DoneReason) String() string {
@@ -717,97 +985,562 @@ func (d DoneReason) String() string {
 		return "length"
 	case DoneReasonStop:
 		return "stop"
+	case DoneReasonTimeout:
+		return "timeout"
 	default:
 		return "" // closed
 	}
 }
 
 type CompletionResponse struct {
-	Content            string        `json:"content"`
-	DoneReason         DoneReason    `json:"done_reason"`
-	Done               bool          `json:"done"`
-	PromptEvalCount    int           `json:"prompt_eval_count"`
-	PromptEvalDuration time.Duration `json:"prompt_eval_duration"`
-	EvalCount          int           `json:"eval_count"`
-	EvalDuration       time.Duration `json:"eval_duration"`
+	Content            string                  `json:"content"`
+	PromptEvalProgress *api.PromptEvalProgress `json:"prompt_eval_progress,omitempty"`
+	DoneReason         DoneReason              `json:"done_reason"`
+	StopSequence       string                  `json:"stop_sequence,omitempty"`
+	StopToken          string                  `json:"stop_token,omitempty"`
+	Done               bool                    `json:"done"`
+	PromptEvalCount    int                     `json:"prompt_eval_count"`
+	CachedPromptCount  int                     `json:"cached_prompt_tokens"`
+	DraftCount         int                     `json:"draft_tokens,omitempty"`
+	AcceptedDraftCount int                     `json:"accepted_draft_tokens,omitempty"`
+	PromptEvalDuration time.Duration           `json:"prompt_eval_duration"`
+	EvalCount          int                     `json:"eval_count"`
+	EvalDuration       time.Duration           `json:"eval_duration"`
+
+	// Logits are the raw logits the last generated token was sampled from
+	// when the return_logits option is set. They are only sent with the
+	// final response.
+	Logits []float32 `json:"logits,omitempty"`
+
+	// Logprobs are the log probabilities of the tokens whose text is in
+	// Content when the logprobs option is set, with their raw logits if the
+	// raw_logits option is set too.
+	Logprobs []api.Logprob `json:"logprobs,omitempty"`
+
+	// Tokens is the number of generated tokens whose text is in Content, for
+	// responses that aren't done. A canceled request has used this many
+	// tokens even though it never gets a final response with EvalCount.
+	Tokens int `json:"tokens,omitempty"`
+
+	// Bytes is the raw text of the generated tokens when the bytes option is
+	// set, which may end part way through a UTF-8 character. The runner sends
+	// it in place of Content, which can only hold valid UTF-8.
+	Bytes []byte `json:"bytes,omitempty"`
+
+	// CachePrefixCount is the number of tokens of the request's CachePrefix
+	// that the runner retains in its KV cache
+	CachePrefixCount int `json:"cache_prefix_tokens,omitempty"`
+
+	// SystemCacheHit reports whether the retained system prompt of an earlier
+	// request was reused. It is computed by the server rather than the runner.
+	SystemCacheHit bool `json:"-"`
+
+	// EvalRate is the rolling generation rate in tokens per second. It is
+	// computed by the server rather than the runner.
+	EvalRate float64 `json:"-"`
+
+	// TokenTimings are the times each token whose text is in Content was
+	// sampled since the runner received the request, when the
+	// return_token_timings option is set. The server collects them into the
+	// final response.
+	TokenTimings []time.Duration `json:"token_timings,omitempty"`
+
+	// Index is which of the responses requested with the n option this
+	// belongs to. It is set by the server rather than the runner.
+	Index int `json:"-"`
+
+	// StoppedAt is the text that ended generation, either StopSequence or,
+	// if generation ended on a token rather than a stop sequence, StopToken.
+	// It is set by the server rather than the runner.
+	StoppedAt string `json:"-"`
+
+	// DraftAcceptanceRate is the fraction of the tokens drafted by lookahead
+	// decoding that were accepted. It is computed by the server rather than
+	// the runner.
+	DraftAcceptanceRate float64 `json:"-"`
 }
 
-func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
-	slog.Debug("completion request", "images", len(req.Images), "prompt", len(req.Prompt), "format", string(req.Format))
-	slog.Log(ctx, logutil.LevelTrace, "completion request", "prompt", req.Prompt)
+// evalRateWindow is the period over which the rolling eval rate is smoothed
+const evalRateWindow = time.Second
 
-	if len(req.Format) > 0 {
-		switch string(req.Format) {
-		case `null`, `""`:
-			// Field was set, but "missing" a value. We accept
-			// these as "not set".
-			break
-		case `"json"`:
-			req.Grammar = grammarJSON
-		default:
-			if req.Format[0] != '{' {
-				return fmt.Errorf("invalid format: %q; expected \"json\" or a valid JSON Schema object", req.Format)
-			}
+// evalRate tracks the times recent tokens were generated to compute a rolling
+// generation rate
+type evalRate struct {
+	times []time.Time
+}
 
-			// User provided a JSON schema
-			g := llama.SchemaToGrammar(req.Format)
-			if g == nil {
-				return fmt.Errorf("invalid JSON schema in format")
-			}
-			req.Grammar = string(g)
-		}
+// add records a token generated at t and returns the rate in tokens per
+// second over the preceding window, or zero until there are enough tokens
+func (r *evalRate) add(t time.Time) float64 {
+	r.times = append(r.times, t)
+
+	// keep the last token before the window as the start of the span so a
+	// stall slows the rate rather than resetting it
+	cutoff := t.Add(-evalRateWindow)
+	i := 0
+	for i < len(r.times)-1 && !r.times[i+1].After(cutoff) {
+		i++
 	}
+	r.times = r.times[i:]
 
-	if req.Options == nil {
-		opts := api.DefaultOptions()
-		req.Options = &opts
+	if len(r.times) < 2 {
+		return 0
 	}
 
-	if err := s.sem.Acquire(ctx, 1); err != nil {
-		if errors.Is(err, context.Canceled) {
-			slog.Info("aborting completion request due to client closing the connection")
-		} else {
-			slog.Error("Failed to acquire semaphore", "error", err)
-		}
-		return err
+	span := r.times[len(r.times)-1].Sub(r.times[0])
+	if span <= 0 {
+		return 0
 	}
-	defer s.sem.Release(1)
 
-	// put an upper limit on num_predict to avoid the model running on forever
-	if req.Options.NumPredict < 0 || req.Options.NumPredict > 10*s.options.NumCtx {
-		req.Options.NumPredict = 10 * s.options.NumCtx
+	return float64(len(r.times)-1) / span.Seconds()
+}
+
+// runnerParams returns the runner flags for the model, its adapters and the
+// options it's loaded with. defaultThreads is used unless num_thread is set.
+func runnerParams(modelPath string, adapters []string, opts api.Options, defaultThreads int) []string {
+	params := []string{
+		"--model", modelPath,
+		"--ctx-size", strconv.Itoa(opts.NumCtx),
+		"--batch-size", strconv.Itoa(opts.NumBatch),
 	}
 
-	// Make sure the server is ready
-	status, err := s.getServerStatusRetry(ctx)
-	if err != nil {
-		return err
-	} else if status != ServerStatusReady {
-		return fmt.Errorf("unexpected server status: %s", status)
+	if opts.NumGPU >= 0 {
+		params = append(params, "--n-gpu-layers", strconv.Itoa(opts.NumGPU))
 	}
 
-	// Handling JSON marshaling with special characters unescaped.
-	buffer := &bytes.Buffer{}
-	enc := json.NewEncoder(buffer)
-	enc.SetEscapeHTML(false)
+	if opts.MainGPU > 0 {
+		params = append(params, "--main-gpu", strconv.Itoa(opts.MainGPU))
+	}
 
-	if err := enc.Encode(req); err != nil {
-		return fmt.Errorf("failed to marshal data: %v", err)
+	for _, adapter := range adapters {
+		params = append(params, "--lora", adapter)
 	}
 
-	endpoint := fmt.Sprintf("http://127.0.0.1:%d/completion", s.port)
-	serverReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, buffer)
-	if err != nil {
-		return fmt.Errorf("error creating POST request: %v", err)
+	if opts.NumThread > 0 {
+		params = append(params, "--threads", strconv.Itoa(opts.NumThread))
+	} else if defaultThreads > 0 {
+		params = append(params, "--threads", strconv.Itoa(defaultThreads))
 	}
-	serverReq.Header.Set("Content-Type", "application/json")
 
-	res, err := http.DefaultClient.Do(serverReq)
-	if err != nil {
-		slog.Error("post predict", "error", err)
-		return errors.New("model runner has unexpectedly stopped, this may be due to resource limitations or an internal error, check ollama server logs for details")
+	return params
+}
+
+// flashAttentionParams returns the runner flags that enable flash attention
+// and, with it, K/V cache quantization, if the gpus and model support them.
+func flashAttentionParams(gpus discover.GpuInfoList, f *ggml.GGML, opts api.Options) []string {
+	fa := envconfig.FlashAttention()
+	if fa && !gpus.FlashAttentionSupported() {
+		slog.Warn("flash attention enabled but not supported by gpu")
+		fa = false
 	}
-	defer res.Body.Close()
+
+	if fa && !f.SupportsFlashAttention() {
+		slog.Warn("flash attention enabled but not supported by model")
+		fa = false
+	}
+
+	kvct := kvCacheType(opts)
+
+	if !fa {
+		if kvct != "" && kvct != "f16" {
+			slog.Warn("quantized kv cache requested but flash attention disabled", "type", kvct)
+		}
+		return nil
+	}
+
+	slog.Info("enabling flash attention")
+	params := []string{"--flash-attn"}
+
+	// Flash Attention also supports kv cache quantization
+	// Enable if the requested and kv cache type is supported by the model
+	if kvct != "" && f.SupportsKVCacheType(kvct) {
+		params = append(params, "--kv-cache-type", kvct)
+	} else {
+		slog.Warn("kv cache type not supported by model", "type", kvct)
+	}
+
+	return params
+}
+
+// kvCacheType returns the requested K/V cache quantization type, preferring
+// the per-request option over the server default.
+func kvCacheType(opts api.Options) string {
+	if opts.CacheType != "" {
+		return strings.ToLower(opts.CacheType)
+	}
+
+	return strings.ToLower(envconfig.KvCacheType())
+}
+
+// greedyOptions returns a copy of opts with sampling options set so that
+// either runner always selects the most likely token.
+func greedyOptions(opts api.Options) *api.Options {
+	opts.Temperature = 0
+	opts.TemperatureSchedule = ""
+	opts.TopK = 1
+	opts.TopP = 1
+	opts.MinP = 0
+	opts.TypicalP = 1
+	opts.Mirostat = 0
+	opts.RepeatPenalty = 1
+	opts.PresencePenalty = 0
+	opts.FrequencyPenalty = 0
+	return &opts
+}
+
+// stopBuffer holds back streamed text that may still become a stop sequence
+// so partial matches spanning several tokens never reach the caller.
+type stopBuffer struct {
+	stops   []string
+	pending string
+
+	// matched is the stop sequence that ended the response, once stopped
+	matched string
+}
+
+// write appends content to the buffer and returns the text that can no
+// longer be part of a stop sequence. If a stop sequence is complete, the text
+// preceding the earliest match is returned and stopped is true.
+func (b *stopBuffer) write(content string) (flush string, stopped bool) {
+	b.pending += content
+
+	index := -1
+	for _, stop := range b.stops {
+		if stop == "" {
+			continue
+		}
+
+		if i := strings.Index(b.pending, stop); i >= 0 && (index < 0 || i < index) {
+			index = i
+			b.matched = stop
+		}
+	}
+
+	if index >= 0 {
+		flush = b.pending[:index]
+		b.pending = ""
+		return flush, true
+	}
+
+	hold := len(b.pending)
+	for _, stop := range b.stops {
+		// a full match was ruled out above so only proper prefixes can remain
+		for i := min(len(stop)-1, len(b.pending)); i > 0; i-- {
+			if strings.HasSuffix(b.pending, stop[:i]) {
+				hold = min(hold, len(b.pending)-i)
+				break
+			}
+		}
+	}
+
+	// never split a multi-byte character across flushes
+	for i := len(b.pending) - 1; i >= 0 && i >= len(b.pending)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b.pending[i]) {
+			if !utf8.FullRuneInString(b.pending[i:]) {
+				hold = min(hold, i)
+			}
+			break
+		}
+	}
+
+	flush, b.pending = b.pending[:hold], b.pending[hold:]
+	return flush, false
+}
+
+// flush returns any text still held back by the buffer.
+func (b *stopBuffer) flush() string {
+	pending := b.pending
+	b.pending = ""
+	return pending
+}
+
+func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
+	if req.Options == nil || req.Options.N <= 1 {
+		return s.completion(ctx, req, fn)
+	}
+
+	// each response is generated in turn, which takes as long as making the
+	// requests one after another but reuses the cached prompt
+	for i := range req.Options.N {
+		opts := *req.Options
+		opts.N = 0
+		if opts.Seed >= 0 {
+			opts.Seed += i
+		}
+
+		r := req
+		r.Options = &opts
+		if err := s.completion(ctx, r, func(c CompletionResponse) {
+			c.Index = i
+			fn(c)
+		}); err != nil {
+			return err
+		}
+
+		// the request reached its deadline part way through a response
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (s *llmServer) completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
+	slog.Debug("completion request", "images", len(req.Images), "prompt", len(req.Prompt), "format", string(req.Format))
+	slog.Log(ctx, logutil.LevelTrace, "completion request", "prompt", req.Prompt)
+
+	if len(req.Format) > 0 {
+		switch string(req.Format) {
+		case `null`, `""`:
+			// Field was set, but "missing" a value. We accept
+			// these as "not set".
+			break
+		case `"json"`:
+			req.Grammar = grammarJSON
+		default:
+			if req.Format[0] == '"' {
+				// A string other than "json" is a GBNF grammar
+				var g string
+				if err := json.Unmarshal(req.Format, &g); err != nil {
+					return fmt.Errorf("invalid format: %q: %w", req.Format, err)
+				}
+				if err := llama.ValidateGrammar(g); err != nil {
+					return fmt.Errorf("invalid grammar in format: %w", err)
+				}
+				req.Grammar = g
+				break
+			}
+
+			if req.Format[0] != '{' {
+				return fmt.Errorf("invalid format: %q; expected \"json\", a valid JSON Schema object or a GBNF grammar", req.Format)
+			}
+
+			// User provided a JSON schema
+			g, err := llama.SchemaToGrammar(req.Format)
+			if err != nil {
+				return fmt.Errorf("invalid JSON schema in format: %w", err)
+			}
+			req.Grammar = string(g)
+		}
+	}
+
+	if req.Options == nil {
+		opts := api.DefaultOptions()
+		req.Options = &opts
+	}
+
+	if req.Options.Greedy {
+		req.Options = greedyOptions(*req.Options)
+	}
+
+	if n := s.vocabularySize(); n > 0 {
+		for id := range req.Options.LogitBias {
+			if id >= n {
+				return fmt.Errorf("logit_bias token ID %d is out of range for the model's vocabulary of %d tokens", id, n)
+			}
+		}
+
+		for _, id := range req.Options.StopTokens {
+			if id >= n {
+				return fmt.Errorf("stop_tokens token ID %d is out of range for the model's vocabulary of %d tokens", id, n)
+			}
+		}
+	}
+
+	if bos, eos, ok := s.specialTokens(); ok {
+		if add := req.Options.AddBOS; add != nil && *add && bos < 0 {
+			return errors.New("add_bos is set but the model has no beginning of sequence token")
+		}
+		if add := req.Options.AddEOS; add != nil && *add && eos < 0 {
+			return errors.New("add_eos is set but the model has no end of sequence token")
+		}
+	}
+
+	// the runner evaluates the negative prompt as a second sequence alongside
+	// the request's, so it needs a parallel slot of its own
+	slots := int64(1)
+	if req.Options.NegativePrompt != "" {
+		if s.textProcessor == nil {
+			return errors.New("negative_prompt requires a model that runs on the Ollama engine")
+		}
+
+		if s.numParallel < 2 {
+			return fmt.Errorf("negative_prompt requires at least 2 parallel sequences, the model was loaded with %d", s.numParallel)
+		}
+
+		slots = 2
+	}
+
+	if req.Options.Lookahead {
+		if s.textProcessor == nil {
+			return errors.New("lookahead requires a model that runs on the Ollama engine")
+		}
+
+		if req.Options.NegativePrompt != "" {
+			return errors.New("lookahead is not supported with negative_prompt")
+		}
+	}
+
+	if req.Options.TemperatureSchedule != "" && s.textProcessor == nil {
+		return errors.New("temperature_schedule requires a model that runs on the Ollama engine")
+	}
+
+	if req.Session != "" && s.textProcessor == nil {
+		return errors.New("restoring sessions requires a model that runs on the Ollama engine")
+	}
+
+	if d := req.Options.ImageDetail; d != "" && d != "auto" && len(req.Images) > 0 {
+		if s.textProcessor == nil {
+			return errors.New("image_detail requires a model that runs on the Ollama engine")
+		}
+
+		for i := range req.Images {
+			req.Images[i].Detail = d
+		}
+	}
+
+	// llama.cpp's sampler treats a negative window as disabled rather than
+	// the whole context
+	if req.Options.RepeatLastN < 0 {
+		req.Options.RepeatLastN = s.options.NumCtx
+	}
+
+	if req.Options.Adapter != "" {
+		if s.textProcessor != nil {
+			return errors.New("adapter requires a model that runs on the llama engine")
+		}
+
+		adapter, err := s.adapterPath(req.Options.Adapter)
+		if err != nil {
+			return err
+		}
+		req.Adapter = adapter
+	}
+
+	// the healed text is regenerated by the model so it is removed from the
+	// start of the response, which continues the original prompt
+	var healed string
+	if len(req.Options.Choices) > 0 {
+		if req.Grammar != "" {
+			return errors.New("choices cannot be used with format")
+		}
+		req.Grammar = choicesGrammar(req.Options.Choices)
+	}
+
+	if req.Options.TokenHealing {
+		if req.Grammar != "" {
+			slog.Debug("token healing is disabled when a format is set")
+		} else {
+			prompt, prefix, err := s.healPrompt(ctx, req.Prompt)
+			if err != nil {
+				return err
+			}
+
+			if prefix != "" {
+				slog.Debug("healing last prompt token", "prefix", prefix)
+				req.Prompt, req.Grammar, healed = prompt, healingGrammar(prefix), prefix
+			}
+		}
+	}
+
+	var systemPrompt string
+	var systemCached bool
+	if req.CachePrefix > 0 {
+		req.CachePrefix = min(req.CachePrefix, len(req.Prompt))
+		systemPrompt = req.Prompt[:req.CachePrefix]
+		systemCached = s.systemCache.contains(systemPrompt)
+	}
+
+	if err := s.sem.Acquire(ctx, slots); err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.Info("aborting completion request due to client closing the connection")
+		} else {
+			slog.Error("Failed to acquire semaphore", "error", err)
+		}
+		return err
+	}
+	defer s.sem.Release(slots)
+
+	// put an upper limit on num_predict to avoid the model running on forever
+	if req.Options.NumPredict < 0 || req.Options.NumPredict > 10*s.options.NumCtx {
+		req.Options.NumPredict = 10 * s.options.NumCtx
+	}
+
+	// Make sure the server is ready
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return err
+	} else if status != ServerStatusReady {
+		return fmt.Errorf("unexpected server status: %s", status)
+	}
+
+	// Handling JSON marshaling with special characters unescaped.
+	buffer := &bytes.Buffer{}
+	enc := json.NewEncoder(buffer)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(req); err != nil {
+		return fmt.Errorf("failed to marshal data: %v", err)
+	}
+
+	endpoint := fmt.Sprintf("http://127.0.0.1:%d/completion", s.port)
+	serverReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, buffer)
+	if err != nil {
+		return fmt.Errorf("error creating POST request: %v", err)
+	}
+	serverReq.Header.Set("Content-Type", "application/json")
+
+	sb := stopBuffer{stops: req.Options.Stop}
+	var stopped bool
+
+	// count and time the tokens received so far in case the request reaches
+	// its deadline before the runner sends its final response
+	start := time.Now()
+	var firstToken time.Time
+	var evalCount int
+	var timings []time.Duration
+
+	// canceled returns the error for a request whose context is done. A
+	// request that reached its deadline instead ends with a final response
+	// after the text generated so far.
+	canceled := func() error {
+		if !errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+			return context.Cause(ctx)
+		}
+
+		if content := sb.flush(); content != "" && !stopped {
+			fn(CompletionResponse{Content: content})
+		}
+
+		c := CompletionResponse{
+			Done:               true,
+			DoneReason:         DoneReasonTimeout,
+			EvalCount:          evalCount,
+			PromptEvalDuration: time.Since(start),
+			TokenTimings:       timings,
+		}
+
+		if !firstToken.IsZero() {
+			c.PromptEvalDuration = firstToken.Sub(start)
+			c.EvalDuration = time.Since(firstToken)
+		}
+
+		slog.Debug("completion request reached its deadline", "eval_count", evalCount)
+		fn(c)
+		return nil
+	}
+
+	res, err := http.DefaultClient.Do(serverReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return canceled()
+		}
+
+		slog.Error("post predict", "error", err)
+		return errors.New("model runner has unexpectedly stopped, this may be due to resource limitations or an internal error, check ollama server logs for details")
+	}
+	defer res.Body.Close()
 
 	if res.StatusCode >= 400 {
 		bodyBytes, err := io.ReadAll(res.Body)
@@ -815,22 +1548,41 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 			return fmt.Errorf("failed reading llm error response: %w", err)
 		}
 		log.Printf("llm predict error: %s", bodyBytes)
+		if res.StatusCode == http.StatusRequestEntityTooLarge {
+			// the prompt doesn't fit in the context of the model
+			return api.StatusError{StatusCode: http.StatusBadRequest, ErrorMessage: strings.TrimSpace(string(bodyBytes)), Code: api.ErrorCodeContextExceeded}
+		}
 		return fmt.Errorf("%s", bodyBytes)
 	}
 
 	scanner := bufio.NewScanner(res.Body)
 	buf := make([]byte, 0, maxBufferSize)
-	scanner.Buffer(buf, maxBufferSize)
+	if req.Options.ReturnLogits {
+		// the final response has a logit for every token in the vocabulary
+		scanner.Buffer(buf, maxLogitsBufferSize)
+	} else {
+		scanner.Buffer(buf, maxBufferSize)
+	}
 
 	// keep track of the last token generated, this is used to abort if the model starts looping
 	var lastToken string
 	var tokenRepeat int
 
+	var rate *evalRate
+	if req.Options.ReportEvalRate {
+		rate = &evalRate{}
+	}
+
+	// logprobs and number of the tokens whose text hasn't been passed to fn
+	// yet
+	var logprobs []api.Logprob
+	var tokens int
+
 	for scanner.Scan() {
 		select {
 		case <-ctx.Done():
 			// This handles the request cancellation
-			return ctx.Err()
+			return canceled()
 		default:
 			line := scanner.Bytes()
 			if len(line) == 0 {
@@ -846,6 +1598,16 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 			if err := json.Unmarshal(evt, &c); err != nil {
 				return fmt.Errorf("error unmarshalling llm prediction response: %v", err)
 			}
+
+			if c.PromptEvalProgress != nil {
+				fn(CompletionResponse{PromptEvalProgress: c.PromptEvalProgress})
+				continue
+			}
+
+			if len(c.Bytes) > 0 {
+				c.Content = string(c.Bytes)
+			}
+
 			switch {
 			case strings.TrimSpace(c.Content) == lastToken:
 				tokenRepeat++
@@ -861,12 +1623,85 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 			}
 
 			if c.Content != "" {
-				fn(CompletionResponse{
-					Content: c.Content,
-				})
+				if firstToken.IsZero() {
+					firstToken = time.Now()
+				}
+				evalCount++
+
+				timings = append(timings, c.TokenTimings...)
+			}
+
+			if healed != "" {
+				n := min(len(healed), len(c.Content))
+				healed, c.Content = healed[n:], c.Content[n:]
+			}
+
+			var tokensPerSecond float64
+			if rate != nil && c.Content != "" {
+				tokensPerSecond = rate.add(time.Now())
+			}
+
+			logprobs = append(logprobs, c.Logprobs...)
+			tokens += c.Tokens
+			if c.Content != "" && !stopped {
+				var raw []byte
+				if req.Options.Bytes {
+					raw = []byte(c.Content)
+				}
+
+				var content string
+				content, stopped = sb.write(c.Content)
+				if stopped {
+					// the runner trims stop sequences itself, so this is
+					// rare and the raw text past the match is dropped
+					raw = nil
+				}
+
+				if content != "" || raw != nil {
+					fn(CompletionResponse{
+						Content:  content,
+						Bytes:    raw,
+						EvalRate: tokensPerSecond,
+						Logprobs: logprobs,
+						Tokens:   tokens,
+					})
+					logprobs, tokens = nil, 0
+				}
 			}
 
 			if c.Done {
+				if stopped {
+					c.DoneReason = DoneReasonStop
+					c.StopSequence = sb.matched
+				} else if content := sb.flush(); content != "" {
+					fn(CompletionResponse{
+						Content:  content,
+						Logprobs: logprobs,
+						Tokens:   tokens,
+					})
+				}
+
+				if c.CachePrefixCount > 0 {
+					// the runner confirms the retained prompt was actually
+					// reused rather than evicted since it was last seen
+					c.SystemCacheHit = systemCached && c.CachedPromptCount >= c.CachePrefixCount
+					s.systemCache.add(systemPrompt, s.numParallel)
+				}
+
+				if c.DoneReason == DoneReasonStop {
+					c.StoppedAt = cmp.Or(c.StopSequence, c.StopToken)
+				}
+
+				// the runner counts the whole prompt, but only the tokens that
+				// weren't reused from its cache were evaluated
+				c.PromptEvalCount -= c.CachedPromptCount
+				if c.DraftCount > 0 {
+					c.DraftAcceptanceRate = float64(c.AcceptedDraftCount) / float64(c.DraftCount)
+				}
+
+				c.Content = ""
+				c.Logprobs = nil
+				c.TokenTimings = timings
 				fn(c)
 				return nil
 			}
@@ -874,6 +1709,10 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 	}
 
 	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return canceled()
+		}
+
 		if strings.Contains(err.Error(), "unexpected EOF") || strings.Contains(err.Error(), "forcibly closed") {
 			s.Close()
 			var msg string
@@ -893,13 +1732,24 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 
 type EmbeddingRequest struct {
 	Content string `json:"content"`
+
+	// Progress has the runner send responses with the progress of
+	// processing the content before the one with the embedding
+	Progress bool `json:"progress,omitempty"`
 }
 
 type EmbeddingResponse struct {
+	// Embedding is the pooled embedding of the content or, if the model is
+	// loaded with pooling "none", the embeddings of each of its tokens one
+	// after another.
 	Embedding []float32 `json:"embedding"`
+
+	// PromptEvalProgress is set on responses sent while the content is still
+	// being processed, when the request's Progress is set
+	PromptEvalProgress *api.PromptEvalProgress `json:"prompt_eval_progress,omitempty"`
 }
 
-func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, error) {
+func (s *llmServer) Embedding(ctx context.Context, input string, fn func(api.PromptEvalProgress)) ([]float32, error) {
 	slog.Log(ctx, logutil.LevelTrace, "embedding request", "input", input)
 
 	if err := s.sem.Acquire(ctx, 1); err != nil {
@@ -920,7 +1770,7 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 		return nil, fmt.Errorf("unexpected server status: %s", status)
 	}
 
-	data, err := json.Marshal(EmbeddingRequest{Content: input})
+	data, err := json.Marshal(EmbeddingRequest{Content: input, Progress: fn != nil})
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling embed data: %w", err)
 	}
@@ -937,22 +1787,109 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading embed response: %w", err)
+		}
+		log.Printf("llm embedding error: %s", body)
+		return nil, fmt.Errorf("%s", body)
+	}
+
+	// progress responses, if any, come before the one with the embedding
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e EmbeddingResponse
+		if err := dec.Decode(&e); err != nil {
+			return nil, fmt.Errorf("unmarshal embedding response: %w", err)
+		}
+
+		if e.PromptEvalProgress == nil {
+			return e.Embedding, nil
+		}
+
+		if fn != nil {
+			fn(*e.PromptEvalProgress)
+		}
+	}
+}
+
+// SessionHeader begins a session saved by a runner, on a line of its own,
+// followed by the state of the session in the KV cache.
+type SessionHeader struct {
+	// Model is the digest of the model the session was saved with
+	Model string `json:"model"`
+
+	// Tokens are the tokens of the session, whose state follows
+	Tokens []int `json:"tokens"`
+}
+
+// ReadSessionHeader reads the header of a session saved by a runner and
+// returns it with a reader of the state that follows.
+func ReadSessionHeader(r io.Reader) (SessionHeader, io.Reader, error) {
+	dec := json.NewDecoder(r)
+
+	var header SessionHeader
+	if err := dec.Decode(&header); err != nil {
+		return SessionHeader{}, nil, fmt.Errorf("invalid session: %w", err)
+	}
+
+	// the decoder may have read past the header, and the newline after it
+	// is part of the header too
+	rest := bufio.NewReader(io.MultiReader(dec.Buffered(), r))
+	if b, err := rest.ReadByte(); err != nil || b != '\n' {
+		return SessionHeader{}, nil, errors.New("invalid session")
+	}
+
+	return header, rest, nil
+}
+
+type SaveSessionRequest struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+	Path   string `json:"path"`
+}
+
+type SaveSessionResponse struct {
+	Tokens []int `json:"tokens"`
+}
+
+func (s *llmServer) SaveSession(ctx context.Context, digest string, tokens []int, path string) ([]int, error) {
+	if s.textProcessor == nil {
+		return nil, errors.New("saving sessions requires a model that runs on the Ollama engine")
+	}
+
+	data, err := json.Marshal(SaveSessionRequest{Model: digest, Tokens: tokens, Path: path})
 	if err != nil {
-		return nil, fmt.Errorf("error reading embed response: %w", err)
+		return nil, err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/session/save", s.port), bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("error creating save session request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("do save session request: %w", err)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		log.Printf("llm embedding error: %s", body)
-		return nil, fmt.Errorf("%s", body)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading save session response: %w", err)
+		}
+		return nil, errors.New(strings.TrimSpace(string(body)))
 	}
 
-	var e EmbeddingResponse
-	if err := json.Unmarshal(body, &e); err != nil {
-		return nil, fmt.Errorf("unmarshal tokenize response: %w", err)
+	var ssr SaveSessionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ssr); err != nil {
+		return nil, fmt.Errorf("unmarshal save session response: %w", err)
 	}
 
-	return e.Embedding, nil
+	return ssr.Tokens, nil
 }
 
 type TokenizeRequest struct {
@@ -985,6 +1922,225 @@ func (s *llmServer) Tokenize(ctx context.Context, content string) ([]int, error)
 	return nil, fmt.Errorf("no tokenizer configured")
 }
 
+func (s *llmServer) PromptTokens(ctx context.Context, req CompletionRequest) ([]int, error) {
+	var addBOS, addEOS *bool
+	if req.Options != nil {
+		addBOS, addEOS = req.Options.AddBOS, req.Options.AddEOS
+	}
+
+	// the tokenizer inserts its own special tokens unless they are overridden
+	addSpecial := !req.SkipSpecialTokens && addBOS == nil && addEOS == nil
+
+	s.llamaModelLock.Lock()
+	defer s.llamaModelLock.Unlock()
+
+	var tokens []int
+	var bos, eos int
+	var defaultBOS, defaultEOS bool
+	switch {
+	case s.llamaModel != nil:
+		var err error
+		tokens, err = s.llamaModel.Tokenize(req.Prompt, addSpecial, true)
+		if err != nil {
+			return nil, err
+		}
+
+		bos, eos = s.llamaModel.TokenBOS(), s.llamaModel.TokenEOS()
+		defaultBOS, defaultEOS = s.llamaModel.AddBOSToken(), s.llamaModel.AddEOSToken()
+	case s.textProcessor != nil:
+		encoded, err := s.textProcessor.Encode(req.Prompt, addSpecial)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = make([]int, len(encoded))
+		for i, t := range encoded {
+			tokens[i] = int(t)
+		}
+
+		vocab := s.textProcessor.Vocabulary()
+		bos, eos = -1, -1
+		if len(vocab.BOS) > 0 {
+			bos = int(vocab.BOS[0])
+		}
+		if len(vocab.EOS) > 0 {
+			eos = int(vocab.EOS[0])
+		}
+		defaultBOS, defaultEOS = vocab.AddBOS, vocab.AddEOS
+	default:
+		return nil, fmt.Errorf("no tokenizer configured")
+	}
+
+	if addBOS == nil && addEOS == nil {
+		return tokens, nil
+	}
+
+	insertBOS := defaultBOS && !req.SkipSpecialTokens
+	if addBOS != nil {
+		insertBOS = *addBOS
+	}
+
+	insertEOS := defaultEOS && !req.SkipSpecialTokens
+	if addEOS != nil {
+		insertEOS = *addEOS
+	}
+
+	if insertBOS && bos >= 0 {
+		tokens = append([]int{bos}, tokens...)
+	}
+
+	if insertEOS && eos >= 0 {
+		tokens = append(tokens, eos)
+	}
+
+	return tokens, nil
+}
+
+// vocabularySize returns the number of tokens in the model's vocabulary, or
+// 0 if no tokenizer is loaded.
+func (s *llmServer) vocabularySize() int {
+	s.llamaModelLock.Lock()
+	defer s.llamaModelLock.Unlock()
+
+	if s.llamaModel != nil {
+		return s.llamaModel.NumVocab()
+	}
+	if s.textProcessor != nil {
+		return len(s.textProcessor.Vocabulary().Values)
+	}
+	return 0
+}
+
+// specialTokens returns the model's beginning and end of sequence tokens, -1
+// for either it doesn't have. ok is false if no tokenizer is loaded.
+func (s *llmServer) specialTokens() (bos, eos int, ok bool) {
+	s.llamaModelLock.Lock()
+	defer s.llamaModelLock.Unlock()
+
+	if s.llamaModel != nil {
+		return s.llamaModel.TokenBOS(), s.llamaModel.TokenEOS(), true
+	}
+	if s.textProcessor != nil {
+		vocab := s.textProcessor.Vocabulary()
+		bos, eos = -1, -1
+		if len(vocab.BOS) > 0 {
+			bos = int(vocab.BOS[0])
+		}
+		if len(vocab.EOS) > 0 {
+			eos = int(vocab.EOS[0])
+		}
+		return bos, eos, true
+	}
+	return -1, -1, false
+}
+
+// vocabularyPieces returns the text of each token in the model's vocabulary,
+// or nil if no tokenizer is loaded.
+func (s *llmServer) vocabularyPieces() []string {
+	s.llamaModelLock.Lock()
+	defer s.llamaModelLock.Unlock()
+
+	if s.tokenPieces != nil {
+		return s.tokenPieces
+	}
+
+	if s.llamaModel != nil {
+		s.tokenPieces = make([]string, s.llamaModel.NumVocab())
+		for i := range s.tokenPieces {
+			s.tokenPieces[i] = s.llamaModel.TokenToPiece(i)
+		}
+	} else if s.textProcessor != nil {
+		s.tokenPieces = make([]string, len(s.textProcessor.Vocabulary().Values))
+		for i := range s.tokenPieces {
+			// tokens that fail to decode on their own can't be healed
+			s.tokenPieces[i], _ = s.textProcessor.Decode([]int32{int32(i)})
+		}
+	}
+
+	return s.tokenPieces
+}
+
+// healPrompt removes the last token of prompt if it is the start of a longer
+// token in the vocabulary, such as a partial word, so that the model can
+// choose the full token instead. It returns the shortened prompt and the
+// removed text, which the response must begin with, or an empty prefix if
+// there is nothing to heal.
+func (s *llmServer) healPrompt(ctx context.Context, prompt string) (string, string, error) {
+	tokens, err := s.Tokenize(ctx, prompt)
+	if err != nil {
+		return "", "", err
+	}
+
+	// keep at least one token so the prompt is never empty
+	if len(tokens) < 2 {
+		return prompt, "", nil
+	}
+
+	pieces := s.vocabularyPieces()
+	last := tokens[len(tokens)-1]
+	if last < 0 || last >= len(pieces) {
+		return prompt, "", nil
+	}
+
+	// a partial UTF-8 sequence can't be expressed in a grammar
+	prefix := pieces[last]
+	if prefix == "" || !utf8.ValidString(prefix) || !strings.HasSuffix(prompt, prefix) {
+		return prompt, "", nil
+	}
+
+	for i, piece := range pieces {
+		if i != last && len(piece) > len(prefix) && strings.HasPrefix(piece, prefix) {
+			return strings.TrimSuffix(prompt, prefix), prefix, nil
+		}
+	}
+
+	return prompt, "", nil
+}
+
+// healingGrammar returns a GBNF grammar that accepts any text beginning with
+// prefix.
+func healingGrammar(prefix string) string {
+	return "root ::= " + gbnfLiteral(prefix) + " .*"
+}
+
+// choicesGrammar returns a GBNF grammar that accepts exactly one of choices
+// and nothing else. Choices that are prefixes of others, such as "no" and
+// "none", are fine since the grammar only allows the response to end once
+// it matches a whole choice.
+func choicesGrammar(choices []string) string {
+	alternatives := make([]string, len(choices))
+	for i, choice := range choices {
+		alternatives[i] = gbnfLiteral(choice)
+	}
+
+	return "root ::= " + strings.Join(alternatives, " | ")
+}
+
+// gbnfLiteral returns s quoted as a GBNF string literal.
+func gbnfLiteral(s string) string {
+	var sb strings.Builder
+	sb.WriteRune('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			sb.WriteRune('\\')
+			sb.WriteRune(r)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\r':
+			sb.WriteString(`\r`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&sb, `\x%02X`, r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteRune('"')
+	return sb.String()
+}
+
 type DetokenizeRequest struct {
 	Tokens []int `json:"tokens"`
 }
@@ -1019,6 +2175,31 @@ func (s *llmServer) Detokenize(ctx context.Context, tokens []int) (string, error
 	return "", fmt.Errorf("no tokenizer configured")
 }
 
+func (s *llmServer) Pieces(ctx context.Context, tokens []int) ([]string, error) {
+	s.llamaModelLock.Lock()
+	defer s.llamaModelLock.Unlock()
+
+	pieces := make([]string, len(tokens))
+	switch {
+	case s.llamaModel != nil:
+		for i, token := range tokens {
+			pieces[i] = s.llamaModel.TokenToPiece(token)
+		}
+	case s.textProcessor != nil:
+		for i, token := range tokens {
+			piece, err := s.textProcessor.Decode([]int32{int32(token)})
+			if err != nil {
+				return nil, err
+			}
+			pieces[i] = piece
+		}
+	default:
+		return nil, fmt.Errorf("no tokenizer configured")
+	}
+
+	return pieces, nil
+}
+
 func (s *llmServer) Close() error {
 	s.llamaModelLock.Lock()
 	if s.llamaModel != nil {
@@ -1052,6 +2233,14 @@ func (s *llmServer) EstimatedTotal() uint64 {
 	return s.estimate.TotalSize
 }
 
+func (s *llmServer) LoadProgress() float32 {
+	return math.Float32frombits(s.loadProgress.Load())
+}
+
+func (s *llmServer) TrainContextLength() int {
+	return s.trainCtx
+}
+
 func (s *llmServer) EstimatedVRAMByGPU(gpuID string) uint64 {
 	for i, gpu := range s.gpus {
 		if gpu.ID == gpuID {
@@ -1,16 +1,70 @@
 package llm
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llama"
+	"github.com/ollama/ollama/model"
+	"github.com/ollama/ollama/sample"
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 )
 
+// newTestLLMServer returns an llmServer for a fake runner that reports being
+// ready on /health and serves every other path with handler
+func newTestLLMServer(t *testing.T, handler http.HandlerFunc) *llmServer {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			json.NewEncoder(w).Encode(ServerStatusResponse{Status: ServerStatusReady})
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &llmServer{
+		port:    port,
+		cmd:     &exec.Cmd{},
+		options: api.Options{Runner: api.Runner{NumCtx: 2048}},
+		sem:     semaphore.NewWeighted(1),
+	}
+}
+
 func TestLLMServerCompletionFormat(t *testing.T) {
 	// This test was written to fix an already deployed issue. It is a bit
 	// of a mess, and but it's good enough, until we can refactoring the
@@ -28,14 +82,37 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 			Format:  []byte(format),
 		}, nil)
 
-		want := fmt.Sprintf("invalid format: %q; expected \"json\" or a valid JSON Schema", format)
+		want := fmt.Sprintf("invalid format: %q; expected \"json\", a valid JSON Schema object or a GBNF grammar", format)
 		if err == nil || !strings.Contains(err.Error(), want) {
 			t.Fatalf("err = %v; want %q", err, want)
 		}
 	}
 
 	checkInvalid("X")   // invalid format
-	checkInvalid(`"X"`) // invalid JSON Schema
+	checkInvalid("[1]") // not a string or object
+
+	err := s.Completion(ctx, CompletionRequest{
+		Options: new(api.Options),
+		Format:  []byte(`{"type":"unknown"}`),
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid JSON schema in format: ") {
+		t.Fatalf("err = %v; want unsupported schema error", err)
+	}
+
+	for _, grammar := range []string{
+		`"X"`,                       // no rule
+		`"root ::= expr"`,           // undefined rule
+		`"expr ::= [0-9]+"`,         // no root rule
+		`"root ::= \"a\" | (\"b\""`, // unbalanced parentheses
+	} {
+		err := s.Completion(ctx, CompletionRequest{
+			Options: new(api.Options),
+			Format:  []byte(grammar),
+		}, nil)
+		if err == nil || !strings.Contains(err.Error(), "invalid grammar in format: ") {
+			t.Fatalf("format %s: err = %v; want invalid grammar error", grammar, err)
+		}
+	}
 
 	cancel() // prevent further processing if request makes it past the format check
 
@@ -55,6 +132,9 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 		// JSON
 		`"json"`,
 		`{"type":"object"}`,
+
+		// GBNF grammar
+		`"root ::= [0-9]+ (\" \" [-+*/] \" \" [0-9]+)*"`,
 	}
 	for _, valid := range valids {
 		err := s.Completion(ctx, CompletionRequest{
@@ -64,9 +144,1653 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 		checkValid(err)
 	}
 
-	err := s.Completion(ctx, CompletionRequest{
+	err = s.Completion(ctx, CompletionRequest{
 		Options: new(api.Options),
 		Format:  nil, // missing format
 	}, nil)
 	checkValid(err)
 }
+
+func TestLLMServerCompletionLogitBias(t *testing.T) {
+	s := &llmServer{
+		sem: semaphore.NewWeighted(1),
+		textProcessor: model.NewBytePairEncoding(``, &model.Vocabulary{
+			Values: []string{"a", "b", "c"},
+			Types:  []int32{1, 1, 1},
+		}),
+	}
+
+	err := s.Completion(t.Context(), CompletionRequest{
+		Options: &api.Options{LogitBias: map[int]float32{3: -100}},
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Fatalf("err = %v; want out of range error", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel() // prevent further processing if request makes it past the check
+
+	err = s.Completion(ctx, CompletionRequest{
+		Options: &api.Options{LogitBias: map[int]float32{2: -100}},
+	}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Completion: err = %v; expected context.Canceled", err)
+	}
+}
+
+func TestLLMServerCompletionSpecialTokens(t *testing.T) {
+	s := &llmServer{
+		sem: semaphore.NewWeighted(1),
+		textProcessor: model.NewBytePairEncoding(``, &model.Vocabulary{
+			Values: []string{"<s>", "a", "b"},
+			Types:  []int32{3, 1, 1},
+			BOS:    []int32{0},
+		}),
+	}
+
+	yes, no := true, false
+	cases := []struct {
+		name           string
+		addBOS, addEOS *bool
+		err            string
+	}{
+		{name: "default"},
+		{name: "add bos", addBOS: &yes},
+		{name: "no bos", addBOS: &no},
+		{name: "no eos", addEOS: &no},
+		{name: "add eos", addEOS: &yes, err: "no end of sequence token"},
+		{name: "both", addBOS: &yes, addEOS: &yes, err: "no end of sequence token"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(t.Context())
+			cancel() // prevent further processing if request makes it past the check
+
+			err := s.Completion(ctx, CompletionRequest{
+				Options: &api.Options{AddBOS: tt.addBOS, AddEOS: tt.addEOS},
+			}, nil)
+			if tt.err == "" && !errors.Is(err, context.Canceled) {
+				t.Fatalf("Completion: err = %v; expected context.Canceled", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("err = %v; want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLLMServerPromptTokens(t *testing.T) {
+	s := &llmServer{
+		textProcessor: model.NewBytePairEncoding(`\S+|\s+`, &model.Vocabulary{
+			Values: []string{"<s>", "a", "b", "</s>"},
+			Types:  []int32{3, 1, 1, 3},
+			AddBOS: true,
+			BOS:    []int32{0},
+			EOS:    []int32{3},
+		}),
+	}
+
+	yes, no := true, false
+	cases := []struct {
+		name              string
+		skipSpecialTokens bool
+		addBOS, addEOS    *bool
+		want              []int
+	}{
+		{name: "default", want: []int{0, 1}},
+		{name: "skip special tokens", skipSpecialTokens: true, want: []int{1}},
+		{name: "no bos", addBOS: &no, want: []int{1}},
+		{name: "add eos", addEOS: &yes, want: []int{0, 1, 3}},
+		{name: "skip special tokens and add bos", skipSpecialTokens: true, addBOS: &yes, want: []int{0, 1}},
+		{name: "skip special tokens and add eos", skipSpecialTokens: true, addEOS: &yes, want: []int{1, 3}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := s.PromptTokens(t.Context(), CompletionRequest{
+				Prompt:            "a",
+				Options:           &api.Options{AddBOS: tt.addBOS, AddEOS: tt.addEOS},
+				SkipSpecialTokens: tt.skipSpecialTokens,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(tokens, tt.want) {
+				t.Errorf("tokens = %v; want %v", tokens, tt.want)
+			}
+		})
+	}
+}
+
+func TestStopBuffer(t *testing.T) {
+	cases := []struct {
+		name    string
+		stops   []string
+		pieces  []string
+		want    []string
+		stopped bool
+	}{
+		{
+			name:   "no stops",
+			pieces: []string{"Hello", " world"},
+			want:   []string{"Hello", " world"},
+		},
+		{
+			name:   "no match",
+			stops:  []string{"<end>"},
+			pieces: []string{"Hello", " world"},
+			want:   []string{"Hello", " world"},
+		},
+		{
+			name:    "single token",
+			stops:   []string{"<end>"},
+			pieces:  []string{"Hello", "<end>"},
+			want:    []string{"Hello", ""},
+			stopped: true,
+		},
+		{
+			name:    "spans tokens",
+			stops:   []string{"<end>"},
+			pieces:  []string{"Hello <", "en", "d> world"},
+			want:    []string{"Hello ", "", ""},
+			stopped: true,
+		},
+		{
+			name:   "partial match released",
+			stops:  []string{"<end>"},
+			pieces: []string{"Hello <", "en", "try"},
+			want:   []string{"Hello ", "", "<entry"},
+		},
+		{
+			name:   "prefix cannot extend",
+			stops:  []string{"<end>"},
+			pieces: []string{"a<", "b"},
+			want:   []string{"a", "<b"},
+		},
+		{
+			name:    "overlapping stops",
+			stops:   []string{"abcd", "bc"},
+			pieces:  []string{"xa", "b", "c"},
+			want:    []string{"x", "", "a"},
+			stopped: true,
+		},
+		{
+			name:   "overlapping prefixes",
+			stops:  []string{"aab", "ab"},
+			pieces: []string{"xaa", "ac"},
+			want:   []string{"x", "aaac"},
+		},
+		{
+			name:    "multi-byte stop",
+			stops:   []string{"世界"},
+			pieces:  []string{"你好", "世", "界"},
+			want:    []string{"你好", "", ""},
+			stopped: true,
+		},
+		{
+			name:   "incomplete utf-8",
+			stops:  []string{"<end>"},
+			pieces: []string{"a\xe4\xb8", "\x96b"},
+			want:   []string{"a", "世b"},
+		},
+		{
+			name:    "multi-byte stop split mid-rune",
+			stops:   []string{"世界"},
+			pieces:  []string{"a\xe4\xb8", "\x96\xe7", "\x95\x8c!"},
+			want:    []string{"a", "", ""},
+			stopped: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			b := stopBuffer{stops: tt.stops}
+
+			var got []string
+			var stopped bool
+			for _, piece := range tt.pieces {
+				var flush string
+				flush, stopped = b.write(piece)
+				got = append(got, flush)
+				if stopped {
+					break
+				}
+			}
+
+			if !stopped {
+				got[len(got)-1] += b.flush()
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+
+			if stopped != tt.stopped {
+				t.Errorf("stopped = %v, want %v", stopped, tt.stopped)
+			}
+		})
+	}
+}
+
+func TestKVCacheType(t *testing.T) {
+	t.Setenv("OLLAMA_KV_CACHE_TYPE", "Q4_0")
+
+	opts := api.DefaultOptions()
+	if got := kvCacheType(opts); got != "q4_0" {
+		t.Errorf("kvCacheType() = %q, want %q", got, "q4_0")
+	}
+
+	if err := opts.FromMap(map[string]any{"cache_type": "q8_0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := kvCacheType(opts); got != "q8_0" {
+		t.Errorf("kvCacheType() = %q, want %q", got, "q8_0")
+	}
+}
+
+func TestRunnerParams(t *testing.T) {
+	cases := []struct {
+		name    string
+		options string
+		want    []string
+	}{
+		{
+			name: "default",
+			want: []string{"--model", "model.gguf", "--ctx-size", "4096", "--batch-size", "512", "--threads", "6"},
+		},
+		{
+			name:    "threads and batch",
+			options: `{"num_thread": 8, "num_batch": 128}`,
+			want:    []string{"--model", "model.gguf", "--ctx-size", "4096", "--batch-size", "128", "--threads", "8"},
+		},
+		{
+			// zero leaves the defaults
+			name:    "zero threads and batch",
+			options: `{"num_thread": 0, "num_batch": 0}`,
+			want:    []string{"--model", "model.gguf", "--ctx-size", "4096", "--batch-size", "512", "--threads", "6"},
+		},
+		{
+			name:    "gpu",
+			options: `{"num_gpu": 10, "main_gpu": 1}`,
+			want:    []string{"--model", "model.gguf", "--ctx-size", "4096", "--batch-size", "512", "--n-gpu-layers", "10", "--main-gpu", "1", "--threads", "6"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var m map[string]any
+			if err := json.Unmarshal([]byte(cmp.Or(tt.options, "{}")), &m); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := api.DefaultOptions()
+			opts.NumCtx = 4096
+			if err := opts.FromMap(m); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := runnerParams("model.gguf", nil, opts, 6); !slices.Equal(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFlashAttentionParams(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "model.gguf")
+	w, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := ggml.WriteGGUF(w, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := LoadModel(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metal := discover.GpuInfoList{{Library: "metal"}}
+	cpu := discover.GpuInfoList{{Library: "cpu"}}
+
+	cases := []struct {
+		name           string
+		flashAttention string
+		cacheType      string
+		options        map[string]any
+		gpus           discover.GpuInfoList
+		want           []string
+	}{
+		{name: "default", flashAttention: "1", gpus: metal, want: []string{"--flash-attn"}},
+		{name: "server cache type", flashAttention: "1", cacheType: "q4_0", gpus: metal, want: []string{"--flash-attn", "--kv-cache-type", "q4_0"}},
+		{name: "cache type option", flashAttention: "1", cacheType: "q4_0", options: map[string]any{"cache_type": "Q8_0"}, gpus: metal, want: []string{"--flash-attn", "--kv-cache-type", "q8_0"}},
+		{name: "flash attention disabled", cacheType: "q4_0", options: map[string]any{"cache_type": "q8_0"}, gpus: metal},
+		{name: "unsupported gpu", flashAttention: "1", options: map[string]any{"cache_type": "q8_0"}, gpus: cpu},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_FLASH_ATTENTION", tt.flashAttention)
+			t.Setenv("OLLAMA_KV_CACHE_TYPE", tt.cacheType)
+
+			opts := api.DefaultOptions()
+			if err := opts.FromMap(tt.options); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := flashAttentionParams(tt.gpus, f, opts); !slices.Equal(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGreedyOptions(t *testing.T) {
+	opts := api.DefaultOptions()
+	opts.Temperature = 1.5
+	opts.TopK = 100
+	opts.TopP = 0.5
+	opts.MinP = 0.2
+	opts.RepeatPenalty = 1.3
+	opts.PresencePenalty = 1.5
+	opts.FrequencyPenalty = 1.5
+	opts.Mirostat = 2
+	opts.TemperatureSchedule = "start=2,end=1,tokens=10"
+	opts.Greedy = true
+
+	greedy := greedyOptions(opts)
+	if opts.Temperature != 1.5 {
+		t.Fatal("greedyOptions modified its input")
+	}
+
+	if greedy.TemperatureSchedule != "" {
+		t.Fatalf("expected no temperature schedule, got %q", greedy.TemperatureSchedule)
+	}
+
+	logits := make([]float32, 256)
+	for i := range logits {
+		logits[i] = float32((i * 7919) % 251)
+	}
+	want := int32(slices.Index(logits, slices.Max(logits)))
+
+	for seed := range 10 {
+		sampler := sample.NewSampler(greedy.Temperature, greedy.TopK, greedy.TopP, greedy.MinP, greedy.Mirostat, greedy.MirostatTau, greedy.MirostatEta, seed, nil, nil, sample.Penalties{
+			LastN:     greedy.RepeatLastN,
+			Repeat:    greedy.RepeatPenalty,
+			Presence:  greedy.PresencePenalty,
+			Frequency: greedy.FrequencyPenalty,
+		})
+		for range 10 {
+			got, err := sampler.Sample(slices.Clone(logits))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != want {
+				t.Fatalf("seed %d: got token %d, want %d", seed, got, want)
+			}
+		}
+	}
+}
+
+func TestAdapterPath(t *testing.T) {
+	s := &llmServer{adapters: []string{
+		filepath.Join("blobs", "sha256-aaaa"),
+		filepath.Join("blobs", "sha256-bbbb"),
+	}}
+
+	path, err := s.adapterPath("sha256:bbbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("blobs", "sha256-bbbb"); path != want {
+		t.Errorf("path = %q, want %q", path, want)
+	}
+
+	_, err = s.adapterPath("sha256:cccc")
+	want := `adapter "sha256:cccc" not found; available adapters: sha256:aaaa, sha256:bbbb`
+	if err == nil || err.Error() != want {
+		t.Errorf("err = %v, want %q", err, want)
+	}
+
+	_, err = (&llmServer{}).adapterPath("sha256:aaaa")
+	if err == nil || !strings.Contains(err.Error(), "model has no adapters") {
+		t.Errorf("err = %v, want no adapters error", err)
+	}
+
+	// the Ollama engine applies every adapter, so selecting one is an error
+	// rather than silently ignored
+	s = &llmServer{
+		sem:           semaphore.NewWeighted(1),
+		adapters:      []string{filepath.Join("blobs", "sha256-aaaa")},
+		textProcessor: model.NewBytePairEncoding(``, &model.Vocabulary{Values: []string{"a"}, Types: []int32{1}}),
+	}
+
+	err = s.Completion(t.Context(), CompletionRequest{Options: &api.Options{Adapter: "sha256:aaaa"}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "requires a model that runs on the llama engine") {
+		t.Errorf("err = %v, want llama engine error", err)
+	}
+}
+
+func TestCompletionRepeatLastN(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel() // stop the request once options have been resolved
+
+	s := &llmServer{
+		options: api.Options{Runner: api.Runner{NumCtx: 2048}},
+		sem:     semaphore.NewWeighted(1),
+	}
+
+	for _, tt := range []struct{ in, want int }{{-1, 2048}, {0, 0}, {64, 64}} {
+		opts := api.DefaultOptions()
+		opts.RepeatLastN = tt.in
+		if err := s.Completion(ctx, CompletionRequest{Options: &opts}, nil); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Completion: err = %v; expected context.Canceled", err)
+		}
+
+		if opts.RepeatLastN != tt.want {
+			t.Errorf("repeat_last_n %d: got %d, want %d", tt.in, opts.RepeatLastN, tt.want)
+		}
+	}
+}
+
+func TestCompletionMirostat(t *testing.T) {
+	var got CompletionRequest
+	s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/completion":
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				t.Error(err)
+			}
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true, DoneReason: DoneReasonStop})
+		}
+	})
+
+	opts := api.DefaultOptions()
+	opts.Mirostat = 2
+	opts.MirostatTau = 3.5
+	opts.MirostatEta = 0.25
+
+	if err := s.Completion(t.Context(), CompletionRequest{Options: &opts}, func(CompletionResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Options == nil {
+		t.Fatal("expected options in the runner request")
+	}
+
+	if got.Options.Mirostat != 2 || got.Options.MirostatTau != 3.5 || got.Options.MirostatEta != 0.25 {
+		t.Errorf("mirostat = %d, tau = %v, eta = %v; want 2, 3.5, 0.25", got.Options.Mirostat, got.Options.MirostatTau, got.Options.MirostatEta)
+	}
+}
+
+func TestCompletionTokenHealing(t *testing.T) {
+	cases := []struct {
+		name    string
+		prompt  string
+		format  json.RawMessage
+		sent    string
+		grammar string
+		content string
+	}{
+		{
+			name:    "partial word",
+			prompt:  "a ca",
+			sent:    "a ",
+			grammar: `root ::= "ca" .*`,
+			content: "t sat",
+		},
+		{
+			name:    "complete word",
+			prompt:  "a cat",
+			sent:    "a cat",
+			content: "cat sat",
+		},
+		{
+			name:    "format",
+			prompt:  "a ca",
+			format:  json.RawMessage(`"json"`),
+			sent:    "a ca",
+			grammar: grammarJSON,
+			content: "cat sat",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var got CompletionRequest
+			s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/completion":
+					if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+						t.Error(err)
+					}
+
+					// the model regenerates the healed token as part of a longer one
+					enc := json.NewEncoder(w)
+					enc.Encode(CompletionResponse{Content: "cat"})
+					enc.Encode(CompletionResponse{Content: " sat"})
+					enc.Encode(CompletionResponse{Done: true, DoneReason: DoneReasonStop})
+				}
+			})
+			s.textProcessor = model.NewBytePairEncoding(`\S+|\s+`, &model.Vocabulary{
+				Values: []string{"a", "c", "t", "Ġ", "ca", "cat"},
+				Types:  []int32{1, 1, 1, 1, 1, 1},
+				Merges: []string{"c a", "ca t"},
+			})
+
+			opts := api.DefaultOptions()
+			opts.TokenHealing = true
+
+			var content strings.Builder
+			req := CompletionRequest{Prompt: tt.prompt, Format: tt.format, Options: &opts}
+			if err := s.Completion(t.Context(), req, func(r CompletionResponse) {
+				content.WriteString(r.Content)
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Prompt != tt.sent {
+				t.Errorf("prompt = %q; want %q", got.Prompt, tt.sent)
+			}
+
+			if got.Grammar != tt.grammar {
+				t.Errorf("grammar = %q; want %q", got.Grammar, tt.grammar)
+			}
+
+			if content.String() != tt.content {
+				t.Errorf("content = %q; want %q", content.String(), tt.content)
+			}
+		})
+	}
+}
+
+func TestHealingGrammar(t *testing.T) {
+	cases := map[string]string{
+		"fo":        `root ::= "fo" .*`,
+		` "q\`:      `root ::= " \"q\\" .*`,
+		"a\n\t\x01": `root ::= "a\n\t\x01" .*`,
+		"héllo":     `root ::= "héllo" .*`,
+	}
+
+	for prefix, want := range cases {
+		got := healingGrammar(prefix)
+		if got != want {
+			t.Errorf("healingGrammar(%q) = %q; want %q", prefix, got, want)
+		}
+
+		if err := llama.ValidateGrammar(got); err != nil {
+			t.Errorf("healingGrammar(%q): %v", prefix, err)
+		}
+	}
+}
+
+func TestWaitUntilRunningWarmup(t *testing.T) {
+	cases := []struct {
+		name      string
+		noWarmup  string
+		embedding bool
+		status    int
+		warmups   int
+	}{
+		{name: "warmup", status: http.StatusOK, warmups: 1},
+		{name: "disabled", noWarmup: "1", status: http.StatusOK},
+		// embedding models can't generate a token
+		{name: "embedding", embedding: true, status: http.StatusOK},
+		// a failed warmup doesn't fail the load
+		{name: "failed", status: http.StatusInternalServerError, warmups: 1},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_NO_WARMUP", tt.noWarmup)
+
+			// the warmup only finishes once the load has returned, so it
+			// can't hold up the load
+			loaded := make(chan struct{})
+			warmups := make(chan CompletionRequest, 1)
+			s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/completion":
+					var req CompletionRequest
+					if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+						t.Error(err)
+					}
+
+					<-loaded
+					warmups <- req
+
+					w.WriteHeader(tt.status)
+					json.NewEncoder(w).Encode(CompletionResponse{Content: "!", Done: true, DoneReason: DoneReasonLength})
+				}
+			})
+			s.embedding = tt.embedding
+
+			if err := s.WaitUntilRunning(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+			close(loaded)
+
+			var n int
+			for n < tt.warmups {
+				select {
+				case req := <-warmups:
+					if req.Options.NumPredict != 1 {
+						t.Errorf("expected warmup to generate 1 token, got num_predict %d", req.Options.NumPredict)
+					}
+					n++
+				case <-time.After(5 * time.Second):
+					t.Fatalf("expected %d warmup requests, got %d", tt.warmups, n)
+				}
+			}
+
+			select {
+			case <-warmups:
+				t.Errorf("expected %d warmup requests, got more", tt.warmups)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestCompletionN(t *testing.T) {
+	s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/completion":
+			var req CompletionRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+
+			if req.Options.N != 0 {
+				t.Errorf("expected each request to generate one response, got n %d", req.Options.N)
+			}
+
+			// the output depends only on the seed, like a model sampling
+			// with a fixed seed
+			enc := json.NewEncoder(w)
+			enc.Encode(CompletionResponse{Content: fmt.Sprintf("seed %d", req.Options.Seed)})
+			enc.Encode(CompletionResponse{Done: true, DoneReason: DoneReasonStop})
+		}
+	})
+
+	opts := api.DefaultOptions()
+	opts.N = 3
+	opts.Seed = 42
+
+	var contents []string
+	var done []int
+	if err := s.Completion(t.Context(), CompletionRequest{Prompt: "a", Options: &opts}, func(r CompletionResponse) {
+		if r.Done {
+			done = append(done, r.Index)
+			return
+		}
+
+		if r.Index != len(contents) {
+			t.Errorf("expected response %d, got %d", len(contents), r.Index)
+		}
+		contents = append(contents, r.Content)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"seed 42", "seed 43", "seed 44"}; !slices.Equal(contents, want) {
+		t.Errorf("contents = %q; want %q", contents, want)
+	}
+
+	if want := []int{0, 1, 2}; !slices.Equal(done, want) {
+		t.Errorf("final responses = %v; want %v", done, want)
+	}
+
+	if opts.N != 3 || opts.Seed != 42 {
+		t.Errorf("expected the request options to be unchanged, got n %d seed %d", opts.N, opts.Seed)
+	}
+}
+
+func TestChoicesGrammar(t *testing.T) {
+	cases := []struct {
+		choices []string
+		want    string
+	}{
+		{[]string{"positive", "negative"}, `root ::= "positive" | "negative"`},
+		// choices that are prefixes of each other
+		{[]string{"y", "yes", "yes!"}, `root ::= "y" | "yes" | "yes!"`},
+		{[]string{`say "hi"`, "a\\b"}, `root ::= "say \"hi\"" | "a\\b"`},
+	}
+
+	for _, tt := range cases {
+		got := choicesGrammar(tt.choices)
+		if got != tt.want {
+			t.Errorf("choicesGrammar(%q) = %q; want %q", tt.choices, got, tt.want)
+		}
+
+		if err := llama.ValidateGrammar(got); err != nil {
+			t.Errorf("choicesGrammar(%q): %v", tt.choices, err)
+		}
+	}
+}
+
+func TestCompletionChoices(t *testing.T) {
+	var got CompletionRequest
+	s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/completion":
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				t.Error(err)
+			}
+			json.NewEncoder(w).Encode(CompletionResponse{Content: "no", Done: true, DoneReason: DoneReasonStop})
+		}
+	})
+
+	opts := api.DefaultOptions()
+	opts.Choices = []string{"no", "none"}
+
+	if err := s.Completion(t.Context(), CompletionRequest{Prompt: "a", Options: &opts}, func(CompletionResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `root ::= "no" | "none"`; got.Grammar != want {
+		t.Errorf("grammar = %q; want %q", got.Grammar, want)
+	}
+
+	err := s.Completion(t.Context(), CompletionRequest{Prompt: "a", Format: json.RawMessage(`"json"`), Options: &opts}, func(CompletionResponse) {})
+	if err == nil || !strings.Contains(err.Error(), "choices cannot be used with format") {
+		t.Errorf("expected an error using choices with format, got %v", err)
+	}
+}
+
+func TestCompletionSystemCache(t *testing.T) {
+	const numParallel = 4
+
+	s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/completion":
+			var req CompletionRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+
+			// pretend every byte of the system prompt is a token and that the
+			// runner always has it cached
+			json.NewEncoder(w).Encode(CompletionResponse{
+				Done:              true,
+				CachePrefixCount:  req.CachePrefix,
+				CachedPromptCount: req.CachePrefix,
+			})
+		}
+	})
+	s.numParallel = numParallel
+	s.sem = semaphore.NewWeighted(numParallel)
+
+	complete := func(system string) (bool, error) {
+		var hit bool
+		err := s.Completion(t.Context(), CompletionRequest{
+			Prompt:      system + "user: Hello!",
+			Options:     &api.Options{},
+			CachePrefix: len(system),
+		}, func(r CompletionResponse) {
+			if r.Done {
+				hit = r.SystemCacheHit
+			}
+		})
+		return hit, err
+	}
+
+	if hit, err := complete("system: You are a pirate.\n"); err != nil {
+		t.Fatal(err)
+	} else if hit {
+		t.Error("expected a miss for a new system prompt")
+	}
+
+	var hits atomic.Int32
+	var g errgroup.Group
+	for range 4 * numParallel {
+		g.Go(func() error {
+			hit, err := complete("system: You are a pirate.\n")
+			if hit {
+				hits.Add(1)
+			}
+			return err
+		})
+	}
+
+	// a different system prompt concurrently is tracked separately
+	g.Go(func() error {
+		hit, err := complete("system: You are a parrot.\n")
+		if hit {
+			return errors.New("expected a miss for a different system prompt")
+		}
+		return err
+	})
+
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := hits.Load(); got != 4*numParallel {
+		t.Errorf("expected %d hits, got %d", 4*numParallel, got)
+	}
+
+	// a request without a system prompt to cache never reports a hit
+	if hit, err := complete(""); err != nil {
+		t.Fatal(err)
+	} else if hit {
+		t.Error("expected no hit without a system prompt")
+	}
+}
+
+func TestCompletionCachedPromptCount(t *testing.T) {
+	var last string
+	s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/completion":
+			var req CompletionRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+
+			// pretend every byte of the prompt is a token and that the runner
+			// reuses all but the last of those it saw in the previous request
+			var cached int
+			for cached < min(len(req.Prompt), len(last))-1 && req.Prompt[cached] == last[cached] {
+				cached++
+			}
+			last = req.Prompt
+
+			json.NewEncoder(w).Encode(CompletionResponse{
+				Done:              true,
+				PromptEvalCount:   len(req.Prompt),
+				CachedPromptCount: cached,
+			})
+		}
+	})
+
+	complete := func(prompt string) (evaluated, cached int) {
+		if err := s.Completion(t.Context(), CompletionRequest{Prompt: prompt, Options: &api.Options{}}, func(r CompletionResponse) {
+			if r.Done {
+				evaluated, cached = r.PromptEvalCount, r.CachedPromptCount
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return evaluated, cached
+	}
+
+	if evaluated, cached := complete("Hello!"); evaluated != 6 || cached != 0 {
+		t.Errorf("expected 6 tokens evaluated and none cached, got %d and %d", evaluated, cached)
+	}
+
+	// the repeated prompt only evaluates the token that isn't cached
+	if evaluated, cached := complete("Hello!"); evaluated != 1 || cached != 5 {
+		t.Errorf("expected 1 token evaluated and 5 cached, got %d and %d", evaluated, cached)
+	}
+}
+
+func TestEvalRate(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	var r evalRate
+	if got := r.add(at(0)); got != 0 {
+		t.Errorf("expected no rate for the first token, got %v", got)
+	}
+
+	// 10 tokens/s
+	var got float64
+	for ms := 100; ms <= 900; ms += 100 {
+		got = r.add(at(ms))
+	}
+	if math.Abs(got-10) > 1e-9 {
+		t.Errorf("expected 10 tokens/s, got %v", got)
+	}
+
+	// tokens older than the window no longer count once generation speeds
+	// up to 50 tokens/s
+	for ms := 920; ms <= 2000; ms += 20 {
+		got = r.add(at(ms))
+	}
+	if math.Abs(got-50) > 1e-9 {
+		t.Errorf("expected 50 tokens/s, got %v", got)
+	}
+
+	// a stall longer than the window leaves a single token
+	if got := r.add(at(4000)); got != 1.0/2 {
+		t.Errorf("expected 0.5 tokens/s after a stall, got %v", got)
+	}
+}
+
+func TestCompletionDoneReason(t *testing.T) {
+	cases := []struct {
+		name         string
+		stops        []string
+		responses    []CompletionResponse
+		content      string
+		doneReason   DoneReason
+		stopSequence string
+	}{
+		{
+			name: "end of sequence",
+			responses: []CompletionResponse{
+				{Content: "Hello"},
+				{Done: true, DoneReason: DoneReasonStop},
+			},
+			content:    "Hello",
+			doneReason: DoneReasonStop,
+		},
+		{
+			name: "predict limit",
+			responses: []CompletionResponse{
+				{Content: "Hello"},
+				{Content: " world"},
+				{Done: true, DoneReason: DoneReasonLength},
+			},
+			content:    "Hello world",
+			doneReason: DoneReasonLength,
+		},
+		{
+			name:  "stop sequence matched by runner",
+			stops: []string{"###"},
+			responses: []CompletionResponse{
+				{Content: "Hello"},
+				{Done: true, DoneReason: DoneReasonStop, StopSequence: "###"},
+			},
+			content:      "Hello",
+			doneReason:   DoneReasonStop,
+			stopSequence: "###",
+		},
+		{
+			// the stop sequence spans tokens, so only the server sees it before
+			// the runner reaches the predict limit
+			name:  "stop sequence before predict limit",
+			stops: []string{"\n\n", "###"},
+			responses: []CompletionResponse{
+				{Content: "Hello"},
+				{Content: "#"},
+				{Content: "##"},
+				{Content: " world"},
+				{Done: true, DoneReason: DoneReasonLength},
+			},
+			content:      "Hello",
+			doneReason:   DoneReasonStop,
+			stopSequence: "###",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/completion":
+					for _, resp := range tt.responses {
+						json.NewEncoder(w).Encode(resp)
+					}
+				}
+			})
+
+			var content strings.Builder
+			var final CompletionResponse
+			if err := s.Completion(t.Context(), CompletionRequest{
+				Options: &api.Options{Stop: tt.stops},
+			}, func(r CompletionResponse) {
+				content.WriteString(r.Content)
+				if r.Done {
+					final = r
+				}
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if !final.Done {
+				t.Fatal("expected a final response")
+			}
+
+			if content.String() != tt.content {
+				t.Errorf("content = %q; want %q", content.String(), tt.content)
+			}
+
+			if final.DoneReason != tt.doneReason {
+				t.Errorf("done reason = %s; want %s", final.DoneReason, tt.doneReason)
+			}
+
+			if final.StopSequence != tt.stopSequence {
+				t.Errorf("stop sequence = %q; want %q", final.StopSequence, tt.stopSequence)
+			}
+		})
+	}
+}
+
+func TestCompletionBytes(t *testing.T) {
+	cases := []struct {
+		name   string
+		pieces []string
+		want   []string
+	}{
+		{
+			// 👋🏽 is a wave followed by a skin tone modifier, four bytes each
+			name:   "emoji",
+			pieces: []string{"hi \xf0\x9f", "\x91\x8b\xf0", "\x9f\x8f", "\xbd!"},
+			want:   []string{"hi ", "👋", "", "🏽!"},
+		},
+		{
+			name:   "cjk",
+			pieces: []string{"\xe4\xbd", "\xa0\xe5\xa5\xbd\xe4", "\xb8\x96\xe7\x95\x8c"},
+			want:   []string{"", "你好", "世界"},
+		},
+	}
+
+	for _, tt := range cases {
+		for _, raw := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/bytes=%v", tt.name, raw), func(t *testing.T) {
+				s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+					switch r.URL.Path {
+					case "/completion":
+						for _, piece := range tt.pieces {
+							json.NewEncoder(w).Encode(CompletionResponse{Bytes: []byte(piece)})
+						}
+						json.NewEncoder(w).Encode(CompletionResponse{Done: true, DoneReason: DoneReasonStop})
+					}
+				})
+
+				var content, pieces []string
+				if err := s.Completion(t.Context(), CompletionRequest{
+					Options: &api.Options{Bytes: raw},
+				}, func(r CompletionResponse) {
+					if r.Done {
+						return
+					}
+
+					if !utf8.ValidString(r.Content) {
+						t.Errorf("content %q is not valid utf-8", r.Content)
+					}
+
+					content = append(content, r.Content)
+					if r.Bytes != nil {
+						pieces = append(pieces, string(r.Bytes))
+					}
+				}); err != nil {
+					t.Fatal(err)
+				}
+
+				// responses with only bytes carry no content when not requested
+				want := slices.DeleteFunc(slices.Clone(tt.want), func(c string) bool { return !raw && c == "" })
+				if !slices.Equal(content, want) {
+					t.Errorf("content = %q; want %q", content, want)
+				}
+
+				var wantPieces []string
+				if raw {
+					wantPieces = tt.pieces
+				}
+
+				if !slices.Equal(pieces, wantPieces) {
+					t.Errorf("bytes = %q; want %q", pieces, wantPieces)
+				}
+			})
+		}
+	}
+}
+
+func TestCompletionNegativePrompt(t *testing.T) {
+	vocab := model.NewBytePairEncoding(``, &model.Vocabulary{
+		Values: []string{"a", "b", "c"},
+		Types:  []int32{1, 1, 1},
+	})
+
+	cases := []struct {
+		name string
+		s    *llmServer
+		err  string
+	}{
+		{name: "llama engine", s: &llmServer{numParallel: 2}, err: "Ollama engine"},
+		{name: "one parallel sequence", s: &llmServer{textProcessor: vocab, numParallel: 1}, err: "at least 2 parallel sequences"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.s.sem = semaphore.NewWeighted(int64(tt.s.numParallel))
+			err := tt.s.Completion(t.Context(), CompletionRequest{
+				Options: &api.Options{NegativePrompt: "sad", GuidanceScale: 1.5},
+			}, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v; want %q", err, tt.err)
+			}
+		})
+	}
+
+	s := &llmServer{textProcessor: vocab, numParallel: 2, sem: semaphore.NewWeighted(2)}
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel() // prevent further processing if request makes it past the check
+
+	err := s.Completion(ctx, CompletionRequest{
+		Options: &api.Options{NegativePrompt: "sad", GuidanceScale: 1.5},
+	}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Completion: err = %v; expected context.Canceled", err)
+	}
+}
+
+func TestCompletionLookahead(t *testing.T) {
+	vocab := model.NewBytePairEncoding(``, &model.Vocabulary{
+		Values: []string{"a", "b", "c"},
+		Types:  []int32{1, 1, 1},
+	})
+
+	cases := []struct {
+		name string
+		s    *llmServer
+		opts api.Options
+		err  string
+	}{
+		{name: "llama engine", s: &llmServer{numParallel: 1}, opts: api.Options{Lookahead: true}, err: "Ollama engine"},
+		{name: "negative prompt", s: &llmServer{textProcessor: vocab, numParallel: 2}, opts: api.Options{Lookahead: true, NegativePrompt: "sad", GuidanceScale: 1.5}, err: "not supported with negative_prompt"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.s.sem = semaphore.NewWeighted(int64(tt.s.numParallel))
+			err := tt.s.Completion(t.Context(), CompletionRequest{Options: &tt.opts}, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v; want %q", err, tt.err)
+			}
+		})
+	}
+
+	s := &llmServer{textProcessor: vocab, numParallel: 1, sem: semaphore.NewWeighted(1)}
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel() // prevent further processing if request makes it past the check
+
+	err := s.Completion(ctx, CompletionRequest{Options: &api.Options{Lookahead: true}}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Completion: err = %v; expected context.Canceled", err)
+	}
+}
+
+func TestCompletionImageDetail(t *testing.T) {
+	vocab := model.NewBytePairEncoding(``, &model.Vocabulary{
+		Values: []string{"a", "b", "c"},
+		Types:  []int32{1, 1, 1},
+	})
+
+	images := []ImageData{{Data: []byte("image"), ID: 0}}
+
+	s := &llmServer{numParallel: 1, sem: semaphore.NewWeighted(1)}
+	err := s.Completion(t.Context(), CompletionRequest{Images: images, Options: &api.Options{ImageDetail: "low"}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "Ollama engine") {
+		t.Fatalf("err = %v; want %q", err, "Ollama engine")
+	}
+
+	var got []ImageData
+	s = newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/completion":
+			var req CompletionRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+			got = req.Images
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true, DoneReason: DoneReasonStop})
+		}
+	})
+	s.textProcessor = vocab
+
+	if err := s.Completion(t.Context(), CompletionRequest{Images: images, Options: &api.Options{ImageDetail: "low"}}, func(CompletionResponse) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 || got[0].Detail != "low" {
+		t.Errorf("expected the image to be sent with low detail, got %+v", got)
+	}
+}
+
+func TestCompletionLogits(t *testing.T) {
+	// a vocabulary large enough for the final response to exceed the
+	// buffer used for other responses
+	logits := make([]float32, 152064)
+	for i := range logits {
+		logits[i] = float32(i) / 3
+	}
+
+	s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/completion":
+			json.NewEncoder(w).Encode(CompletionResponse{Content: "hi"})
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true, DoneReason: DoneReasonStop, Logits: logits})
+		}
+	})
+
+	var got []float32
+	if err := s.Completion(t.Context(), CompletionRequest{
+		Options: &api.Options{ReturnLogits: true},
+	}, func(r CompletionResponse) {
+		if r.Done {
+			got = r.Logits
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(got, logits) {
+		t.Errorf("expected %d logits, got %d", len(logits), len(got))
+	}
+}
+
+func TestCompletionLogprobs(t *testing.T) {
+	logprob := func(id int, token string, logprob float64, logit float32) api.Logprob {
+		return api.Logprob{
+			TokenLogprob: api.TokenLogprob{ID: id, Token: token, Logprob: logprob, Logit: &logit},
+			TopLogprobs:  []api.TokenLogprob{{ID: id, Token: token, Logprob: logprob, Logit: &logit}},
+		}
+	}
+
+	s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/completion":
+			json.NewEncoder(w).Encode(CompletionResponse{Content: "The sky", Logprobs: []api.Logprob{logprob(1, "The", -0.1, 9), logprob(2, " sky", -0.2, 8)}})
+			// held back as it may be the start of the stop sequence
+			json.NewEncoder(w).Encode(CompletionResponse{Content: " is", Logprobs: []api.Logprob{logprob(3, " is", -0.3, 7)}})
+			json.NewEncoder(w).Encode(CompletionResponse{Content: " blue", Logprobs: []api.Logprob{logprob(4, " blue", -0.4, 6)}})
+			json.NewEncoder(w).Encode(CompletionResponse{Content: "\nEND", Logprobs: []api.Logprob{logprob(5, "\nEND", -0.5, 5)}})
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true, DoneReason: DoneReasonStop})
+		}
+	})
+
+	var content strings.Builder
+	var logprobs []api.Logprob
+	if err := s.Completion(t.Context(), CompletionRequest{
+		Options: &api.Options{Stop: []string{" is red", "\nEND"}, Logprobs: true, TopLogprobs: 1, RawLogits: true},
+	}, func(r CompletionResponse) {
+		content.WriteString(r.Content)
+		logprobs = append(logprobs, r.Logprobs...)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if content.String() != "The sky is blue" {
+		t.Errorf("expected content %q, got %q", "The sky is blue", content.String())
+	}
+
+	// the tokens whose text was returned, leaving out the stop sequence
+	var tokens strings.Builder
+	for i, lp := range logprobs {
+		tokens.WriteString(lp.Token)
+
+		if lp.ID != i+1 || lp.Logit == nil || *lp.Logit != float32(9-i) || len(lp.TopLogprobs) != 1 || *lp.TopLogprobs[0].Logit != *lp.Logit {
+			t.Errorf("expected token %d with logit %d, got %+v", i+1, 9-i, lp)
+		}
+	}
+
+	if tokens.String() != content.String() {
+		t.Errorf("expected log probabilities of %q, got %q", content.String(), tokens.String())
+	}
+}
+
+func TestCompletionTokenTimings(t *testing.T) {
+	// the runner can send several tokens in one response, each with the
+	// time it was sampled
+	chunks := []CompletionResponse{
+		{Content: "The", Tokens: 1, TokenTimings: []time.Duration{10 * time.Millisecond}},
+		{Content: " sky is", Tokens: 2, TokenTimings: []time.Duration{12 * time.Millisecond, 14 * time.Millisecond}},
+		{Content: " blue.", Tokens: 2, TokenTimings: []time.Duration{16 * time.Millisecond, 18 * time.Millisecond}},
+	}
+
+	s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/completion":
+			var req CompletionRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+
+			for _, chunk := range chunks {
+				if !req.Options.ReturnTokenTimings {
+					chunk.TokenTimings = nil
+				}
+				json.NewEncoder(w).Encode(chunk)
+			}
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true, DoneReason: DoneReasonStop, EvalCount: 5})
+		}
+	})
+
+	for _, enabled := range []bool{false, true} {
+		t.Run(strconv.FormatBool(enabled), func(t *testing.T) {
+			var final CompletionResponse
+			if err := s.Completion(t.Context(), CompletionRequest{
+				Options: &api.Options{ReturnTokenTimings: enabled},
+			}, func(r CompletionResponse) {
+				if r.TokenTimings != nil && !r.Done {
+					t.Error("expected token timings only on the final response")
+				}
+
+				if r.Done {
+					final = r
+				}
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if !enabled {
+				if final.TokenTimings != nil {
+					t.Errorf("expected no token timings, got %v", final.TokenTimings)
+				}
+				return
+			}
+
+			want := []time.Duration{10 * time.Millisecond, 12 * time.Millisecond, 14 * time.Millisecond, 16 * time.Millisecond, 18 * time.Millisecond}
+			if !slices.Equal(final.TokenTimings, want) {
+				t.Errorf("expected token timings %v, got %v", want, final.TokenTimings)
+			}
+		})
+	}
+}
+
+func TestCompletionContextExceeded(t *testing.T) {
+	s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/completion":
+			http.Error(w, "Failed to create new sequence: entire prompt removed by truncation", http.StatusRequestEntityTooLarge)
+		}
+	})
+
+	err := s.Completion(t.Context(), CompletionRequest{Options: &api.Options{}}, func(CompletionResponse) {})
+
+	var serr api.StatusError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected a status error, got %v", err)
+	}
+
+	want := api.StatusError{StatusCode: http.StatusBadRequest, ErrorMessage: "Failed to create new sequence: entire prompt removed by truncation", Code: api.ErrorCodeContextExceeded}
+	if serr != want {
+		t.Errorf("expected %+v, got %+v", want, serr)
+	}
+}
+
+func TestCompletionStoppedAt(t *testing.T) {
+	var responses []CompletionResponse
+	s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/completion":
+			for _, resp := range responses {
+				json.NewEncoder(w).Encode(resp)
+			}
+		}
+	})
+
+	cases := []struct {
+		name      string
+		responses []CompletionResponse
+		want      string
+	}{
+		{
+			name: "stop sequence from runner",
+			responses: []CompletionResponse{
+				{Content: "The sky is blue."},
+				{Done: true, DoneReason: DoneReasonStop, StopSequence: "END"},
+			},
+			want: "END",
+		},
+		{
+			// the runner usually trims stop sequences itself, but the
+			// server matches any it lets through
+			name: "stop sequence from server",
+			responses: []CompletionResponse{
+				{Content: "The sky is blue."},
+				{Content: "\nEND"},
+				{Content: " more"},
+				{Done: true, DoneReason: DoneReasonStop},
+			},
+			want: "\nEND",
+		},
+		{
+			name: "eos token",
+			responses: []CompletionResponse{
+				{Content: "The sky is blue."},
+				{Done: true, DoneReason: DoneReasonStop, StopToken: "<|eot_id|>"},
+			},
+			want: "<|eot_id|>",
+		},
+		{
+			name: "length",
+			responses: []CompletionResponse{
+				{Content: "The sky is"},
+				{Done: true, DoneReason: DoneReasonLength},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			responses = tt.responses
+
+			var final CompletionResponse
+			if err := s.Completion(t.Context(), CompletionRequest{
+				Options: &api.Options{Stop: []string{"###", "\nEND", "User:"}},
+			}, func(r CompletionResponse) {
+				if r.Done {
+					final = r
+				}
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if final.StoppedAt != tt.want {
+				t.Errorf("expected to have stopped at %q, got %q", tt.want, final.StoppedAt)
+			}
+		})
+	}
+}
+
+func TestEmbeddingProgress(t *testing.T) {
+	s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/embedding":
+			var req EmbeddingRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+
+			// a long input is processed in several batches
+			if req.Progress {
+				for _, processed := range []int{512, 1024, 1536} {
+					json.NewEncoder(w).Encode(EmbeddingResponse{PromptEvalProgress: &api.PromptEvalProgress{Processed: processed, Total: 2000}})
+				}
+			}
+			json.NewEncoder(w).Encode(EmbeddingResponse{Embedding: []float32{0.6, 0.8}})
+		}
+	})
+
+	input := strings.Repeat("word ", 2000)
+
+	var progress []int
+	embedding, err := s.Embedding(t.Context(), input, func(p api.PromptEvalProgress) {
+		if p.Total != 2000 {
+			t.Errorf("expected a total of 2000, got %d", p.Total)
+		}
+		progress = append(progress, p.Processed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(progress, []int{512, 1024, 1536}) {
+		t.Errorf("expected progress after each batch, got %v", progress)
+	}
+
+	if !slices.Equal(embedding, []float32{0.6, 0.8}) {
+		t.Errorf("unexpected embedding %v", embedding)
+	}
+
+	// without a callback the runner isn't asked for progress
+	embedding, err = s.Embedding(t.Context(), input, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(embedding, []float32{0.6, 0.8}) {
+		t.Errorf("unexpected embedding %v", embedding)
+	}
+}
+
+func TestCompletionTimeout(t *testing.T) {
+	cases := []struct {
+		name      string
+		tokens    []string
+		content   string
+		evalCount int
+	}{
+		{"partial response", []string{"Hello", " world"}, "Hello world", 2},
+		{"before first token", nil, "", 0},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/completion":
+					io.Copy(io.Discard, r.Body)
+
+					enc := json.NewEncoder(w)
+					for _, token := range tt.tokens {
+						enc.Encode(CompletionResponse{Content: token})
+					}
+					w.(http.Flusher).Flush()
+
+					// a slow generation that never finishes before the deadline
+					<-r.Context().Done()
+				}
+			})
+
+			ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+			defer cancel()
+
+			var content strings.Builder
+			var final CompletionResponse
+			if err := s.Completion(ctx, CompletionRequest{Options: &api.Options{}}, func(r CompletionResponse) {
+				content.WriteString(r.Content)
+				if r.Done {
+					final = r
+				}
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if content.String() != tt.content {
+				t.Errorf("content = %q; want %q", content.String(), tt.content)
+			}
+
+			if !final.Done || final.DoneReason != DoneReasonTimeout {
+				t.Fatalf("final response = %+v; want done with reason timeout", final)
+			}
+
+			if final.EvalCount != tt.evalCount {
+				t.Errorf("eval count = %d; want %d", final.EvalCount, tt.evalCount)
+			}
+
+			if final.PromptEvalDuration <= 0 {
+				t.Errorf("prompt eval duration = %v; want positive", final.PromptEvalDuration)
+			}
+
+			if tt.evalCount > 0 && final.EvalDuration <= 0 {
+				t.Errorf("eval duration = %v; want positive", final.EvalDuration)
+			}
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/completion":
+				// the server only notices the client going away once the
+				// request body is read
+				io.Copy(io.Discard, r.Body)
+				<-r.Context().Done()
+			}
+		})
+
+		// requests canceled for other reasons still fail
+		ctx, cancel := context.WithCancel(t.Context())
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		err := s.Completion(ctx, CompletionRequest{Options: &api.Options{}}, func(CompletionResponse) {
+			t.Error("unexpected response")
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("err = %v; want context.Canceled", err)
+		}
+	})
+}
+
+func TestCompletionParallel(t *testing.T) {
+	const numParallel = 2
+
+	// the runner only responds once numParallel requests are in flight, so
+	// this deadlocks if the server serializes requests
+	var inflight atomic.Int32
+	ready := make(chan struct{})
+	stop := make(chan struct{})
+	s := newTestLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/completion":
+			if inflight.Add(1) == numParallel {
+				close(ready)
+			}
+
+			select {
+			case <-ready:
+				json.NewEncoder(w).Encode(CompletionResponse{Done: true})
+			case <-stop:
+			}
+		}
+	})
+	s.numParallel = numParallel
+	s.sem = semaphore.NewWeighted(numParallel)
+	defer close(stop)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	var g errgroup.Group
+	for range numParallel {
+		g.Go(func() error {
+			return s.Completion(ctx, CompletionRequest{}, func(CompletionResponse) {})
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		t.Fatalf("expected %d requests to run concurrently, got %v", numParallel, err)
+	}
+}
+
+func TestReadSessionHeader(t *testing.T) {
+	header, state, err := ReadSessionHeader(strings.NewReader(`{"model":"sha256:abc","tokens":[1,2,3]}` + "\n" + "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Model != "sha256:abc" || !slices.Equal(header.Tokens, []int{1, 2, 3}) {
+		t.Errorf("unexpected header %+v", header)
+	}
+
+	if b, err := io.ReadAll(state); err != nil || string(b) != "state" {
+		t.Errorf("expected the state to follow the header, got %q and %v", b, err)
+	}
+
+	for _, s := range []string{`{"model":"sha256:abc"}state`, `{"model":`, ""} {
+		if _, _, err := ReadSessionHeader(strings.NewReader(s)); err == nil {
+			t.Errorf("expected an error reading %q", s)
+		}
+	}
+}
@@ -66,11 +66,28 @@ type BackendParams struct {
 	// NumGPULayers is the number of layers to offload to GPUs
 	NumGPULayers int
 
+	// GPULayers are the layers to offload to GPUs, numbered from 0 with the
+	// output layer last. If set, NumGPULayers is ignored.
+	GPULayers []int
+
 	// TensorSplit is the fraction of the model to offload to each GPU
 	TensorSplit []float32
 
 	// FlashAttention indicates that we should use a fused flash attention kernel
 	FlashAttention bool
+
+	// KVOverrides replaces the values of model metadata keys before the
+	// model is loaded
+	KVOverrides map[string]string
+
+	// RopeScalingType and RopeFrequencyScale replace the RoPE scaling of
+	// the model if RopeScalingType is set
+	RopeScalingType    string
+	RopeFrequencyScale float32
+
+	// RopeFactors replace the RoPE frequency factors loaded from the model
+	// if set
+	RopeFactors []float32
 }
 
 // ErrNoMem is returned when panicing due to insufficient memory. It includes
@@ -218,6 +235,10 @@ type Context interface {
 	FromFloatSlice(s []float32, shape ...int) Tensor
 	FromIntSlice(s []int32, shape ...int) Tensor
 
+	// FromBytes creates a tensor of dtype from the raw data of a tensor of
+	// the same type and shape, such as returned by [Tensor.Bytes].
+	FromBytes(dtype DType, s []byte, shape ...int) Tensor
+
 	// Arange creates a 1D tensor with values within an interval (start, stop] increased by step.
 	Arange(start, stop, step float32, dtype DType) Tensor
 
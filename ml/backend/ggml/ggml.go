@@ -44,9 +44,7 @@ func devices() []*C.struct_ggml_backend_device {
 }
 
 type Backend struct {
-	// modelPath is the location of the model data
-	modelPath string
-
+	// meta is the model metadata, including the files the model data is in
 	meta *fsggml.GGML
 
 	// tensorLoadTargets maps from the name of the tensor in the file
@@ -77,16 +75,47 @@ type Backend struct {
 	maxGraphNodes int
 }
 
+// offloadedLayers returns the layers to offload to gpus, numbered from 0 with
+// the output layer numbered blocks. Unless the layers are set explicitly,
+// these are the last NumGPULayers repeating layers, and the output layer once
+// all of them are offloaded.
+func offloadedLayers(params ml.BackendParams, blocks int) []int {
+	if len(params.GPULayers) > 0 {
+		return params.GPULayers
+	}
+
+	var layers []int
+	start := max(0, blocks-params.NumGPULayers)
+	for i := start; i < min(start+params.NumGPULayers, blocks+1); i++ {
+		layers = append(layers, i)
+	}
+	return layers
+}
+
 func New(modelPath string, params ml.BackendParams) (ml.Backend, error) {
-	r, err := os.Open(modelPath)
+	meta, err := fsggml.DecodeFile(modelPath, -1)
 	if err != nil {
 		return nil, err
 	}
-	defer r.Close()
 
-	meta, err := fsggml.Decode(r, -1)
-	if err != nil {
-		return nil, err
+	for key, value := range params.KVOverrides {
+		if err := meta.KV().Override(key, value); err != nil {
+			return nil, fmt.Errorf("gguf override: %w", err)
+		}
+
+		slog.Info("overriding model metadata", "key", key, "value", value)
+	}
+
+	if params.RopeScalingType != "" {
+		kv := meta.KV()
+		kv[kv.Architecture()+".rope.scaling.type"] = params.RopeScalingType
+		kv[kv.Architecture()+".rope.freq_scale"] = params.RopeFrequencyScale
+		slog.Info("overriding rope scaling", "type", params.RopeScalingType, "freq_scale", params.RopeFrequencyScale)
+	}
+
+	if len(params.RopeFactors) > 0 {
+		meta.KV().SetFloats("rope.freq_factors", params.RopeFactors)
+		slog.Info("overriding rope factors", "count", len(params.RopeFactors))
 	}
 
 	slog.Info(
@@ -196,15 +225,16 @@ func New(modelPath string, params ml.BackendParams) (ml.Backend, error) {
 	// inputs always use cpu
 	input := cpuDeviceBufferType
 
-	// define a range of gpu layers. anything outside of this range is assigned to the cpu
-	gpuRangeStart := max(0, blocks-params.NumGPULayers)
-	gpuRangeStop := min(gpuRangeStart+params.NumGPULayers, blocks+1)
+	// anything other than the gpu layers is assigned to the cpu
+	gpuLayers := offloadedLayers(params, blocks)
 	assignLayer := func(i int) deviceBufferType {
-		if i < gpuRangeStart || i >= gpuRangeStop {
+		position := slices.Index(gpuLayers, i)
+		if position < 0 {
 			return cpuDeviceBufferType
 		}
 
-		index := slices.IndexFunc(splits, func(f float32) bool { return float32(i-gpuRangeStart)/float32(gpuRangeStop-gpuRangeStart) < f })
+		// gpu layers are split between gpus in order, whether or not they are contiguous
+		index := slices.IndexFunc(splits, func(f float32) bool { return float32(position)/float32(len(gpuLayers)) < f })
 		if index < 0 || index >= len(gpuDeviceBufferTypes) {
 			return cpuDeviceBufferType
 		}
@@ -388,7 +418,6 @@ func New(modelPath string, params ml.BackendParams) (ml.Backend, error) {
 
 	maxGraphNodes := max(8192, len(meta.Tensors().Items())*5)
 	return &Backend{
-		modelPath:         modelPath,
 		flashAttention:    params.FlashAttention,
 		meta:              meta,
 		tensorLoadTargets: targets,
@@ -423,7 +452,10 @@ func init() {
 
 func (b *Backend) Load(ctx context.Context, progress func(float32)) error {
 	var doneBytes atomic.Uint64
-	totalBytes := uint64(b.meta.Length) - b.meta.Tensors().Offset
+	var totalBytes uint64
+	for _, shard := range b.meta.Shards {
+		totalBytes += uint64(shard.Length) - shard.Offset
+	}
 
 	g, ctx := errgroup.WithContext(ctx)
 	g.SetLimit(runtime.GOMAXPROCS(0))
@@ -447,13 +479,14 @@ func (b *Backend) Load(ctx context.Context, progress func(float32)) error {
 
 			// Create a new FD for each goroutine so that each FD is read sequentially, rather than
 			// seeking around within an FD shared between all goroutines.
-			file, err := os.Open(b.modelPath)
+			shard := b.meta.Shards[t.Shard]
+			file, err := os.Open(shard.Path)
 			if err != nil {
-				slog.Warn("file open error", "file", b.modelPath, "error", err)
+				slog.Warn("file open error", "file", shard.Path, "error", err)
 				return err
 			}
 			defer file.Close()
-			sr := io.NewSectionReader(file, int64(b.meta.Tensors().Offset+t.Offset), int64(t.Size()))
+			sr := io.NewSectionReader(file, int64(shard.Offset+t.Offset), int64(t.Size()))
 			bts := make([]byte, 128*format.KibiByte)
 
 			var s uint64
@@ -465,7 +498,7 @@ func (b *Backend) Load(ctx context.Context, progress func(float32)) error {
 
 				n, err := io.ReadFull(sr, bts[:min(len(bts), int(t.Size()-s))])
 				if err != nil {
-					slog.Warn("file read error", "file", b.modelPath, "error", err)
+					slog.Warn("file read error", "file", shard.Path, "error", err)
 					return err
 				}
 
@@ -765,6 +798,20 @@ func (c *Context) FromFloatSlice(s []float32, shape ...int) ml.Tensor {
 	return t
 }
 
+func (c *Context) FromBytes(dtype ml.DType, s []byte, shape ...int) ml.Tensor {
+	t := c.newTensor(dtype, shape)
+
+	if n := C.ggml_nbytes(t.(*Tensor).t); C.size_t(len(s)) != n {
+		panic(fmt.Errorf("invalid size: %d bytes for a tensor of %d bytes", len(s), n))
+	}
+
+	if len(s) > 0 {
+		C.ggml_backend_tensor_set(t.(*Tensor).t, unsafe.Pointer(&s[0]), 0, C.ggml_nbytes(t.(*Tensor).t))
+	}
+
+	return t
+}
+
 func (c *Context) FromIntSlice(s []int32, shape ...int) ml.Tensor {
 	checkShape(s, shape...)
 
@@ -1171,7 +1218,7 @@ func (t *Tensor) RoPE(ctx ml.Context, positions ml.Tensor, ropeDim int, ropeBase
 			C.int(opts.OriginalContextLength),
 			C.float(ropeBase),
 			C.float(ropeScale),
-			C.float(0.0),
+			C.float(opts.ExtrapolationFactor),
 			C.float(1.0),
 			C.float(32.0),
 			C.float(1.0),
@@ -0,0 +1,35 @@
+package ggml
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/ml"
+)
+
+func TestOffloadedLayers(t *testing.T) {
+	cases := []struct {
+		name   string
+		params ml.BackendParams
+		want   []int
+	}{
+		{name: "none"},
+		{name: "last layer", params: ml.BackendParams{NumGPULayers: 1}, want: []int{3}},
+		{name: "repeating layers", params: ml.BackendParams{NumGPULayers: 4}, want: []int{0, 1, 2, 3}},
+		{name: "all layers", params: ml.BackendParams{NumGPULayers: 5}, want: []int{0, 1, 2, 3, 4}},
+		{name: "more than all layers", params: ml.BackendParams{NumGPULayers: 10}, want: []int{0, 1, 2, 3, 4}},
+		{
+			name:   "explicit layers",
+			params: ml.BackendParams{NumGPULayers: 1, GPULayers: []int{0, 2, 4}},
+			want:   []int{0, 2, 4},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := offloadedLayers(tt.params, 4); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
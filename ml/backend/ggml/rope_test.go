@@ -0,0 +1,118 @@
+package ggml
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fsggml "github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/ml/nn/rope"
+)
+
+func setup(tb testing.TB) ml.Backend {
+	tb.Helper()
+
+	f, err := os.Create(filepath.Join(tb.TempDir(), "model.gguf"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fsggml.WriteGGUF(f, fsggml.KV{"general.architecture": "test"}, nil); err != nil {
+		tb.Fatal(err)
+	}
+
+	b, err := New(f.Name(), ml.BackendParams{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return b
+}
+
+// ropeReference rotates adjacent pairs of x, laid out as [dim, seqLen], the
+// same way ggml's normal (non-NeoX) RoPE does, including YaRN's frequency
+// ramp and magnitude scaling when originalContextLength is non-zero.
+func ropeReference(x []float32, positions []int32, dim int, base, scale float64, originalContextLength int) []float32 {
+	corrDim := func(rotations float64) float64 {
+		return float64(dim) * math.Log(float64(originalContextLength)/(rotations*2*math.Pi)) / (2 * math.Log(base))
+	}
+
+	mscale := 1.0
+	var low, high float64
+	if originalContextLength > 0 {
+		mscale *= 1 + 0.1*math.Log(1/scale)
+		low = math.Max(0, math.Floor(corrDim(32)))
+		high = math.Min(float64(dim-1), math.Ceil(corrDim(1)))
+	}
+
+	out := make([]float32, len(x))
+	for s, p := range positions {
+		for i := 0; i < dim; i += 2 {
+			extrapolated := float64(p) * math.Pow(base, -float64(i)/float64(dim))
+			theta := scale * extrapolated
+			if originalContextLength > 0 {
+				ramp := 1 - min(max((float64(i/2)-low)/math.Max(0.001, high-low), 0), 1)
+				theta = theta*(1-ramp) + extrapolated*ramp
+			}
+
+			x0, x1 := float64(x[s*dim+i]), float64(x[s*dim+i+1])
+			sin, cos := math.Sincos(theta)
+			out[s*dim+i] = float32((x0*cos - x1*sin) * mscale)
+			out[s*dim+i+1] = float32((x0*sin + x1*cos) * mscale)
+		}
+	}
+
+	return out
+}
+
+func TestRoPEScaling(t *testing.T) {
+	const (
+		dim  = 16
+		base = 10000
+	)
+
+	positions := []int32{0, 1, 2, 7, 31, 100}
+	x := make([]float32, dim*len(positions))
+	for i := range x {
+		x[i] = float32(math.Sin(float64(i)))
+	}
+
+	cases := []struct {
+		name                  string
+		scale                 float32
+		originalContextLength int
+		options               []func(*rope.Options)
+	}{
+		{name: "none", scale: 1},
+		{name: "linear", scale: 0.25},
+		{name: "yarn", scale: 0.25, originalContextLength: 32, options: []func(*rope.Options){rope.WithYaRN(32)}},
+	}
+
+	b := setup(t)
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := b.NewContext()
+			defer ctx.Close()
+
+			input := ctx.Input().FromFloatSlice(x, dim, 1, len(positions))
+			pos := ctx.Input().FromIntSlice(positions, len(positions))
+			out := input.(*Tensor).RoPE(ctx, pos, dim, base, tt.scale, tt.options...)
+			ctx.Forward(out).Compute(out)
+
+			want := ropeReference(x, positions, dim, base, float64(tt.scale), tt.originalContextLength)
+			got := out.Floats()
+			if len(got) != len(want) {
+				t.Fatalf("expected %d values, got %d", len(want), len(got))
+			}
+
+			for i := range want {
+				if math.Abs(float64(got[i]-want[i])) > 1e-4 {
+					t.Errorf("value %d: expected %v, got %v", i, want[i], got[i])
+				}
+			}
+		})
+	}
+}
@@ -7,6 +7,10 @@ type Options struct {
 	OriginalContextLength int
 	Type                  int
 	Factors               ml.Tensor
+
+	// ExtrapolationFactor mixes YaRN's extrapolated frequencies into the
+	// scaled ones. Zero disables YaRN.
+	ExtrapolationFactor float32
 }
 
 // WithOriginalContextLength sets a custom context length
@@ -31,3 +35,12 @@ func WithFactors(factors ml.Tensor) func(*Options) {
 		}
 	}
 }
+
+// WithYaRN enables YaRN scaling for a model trained with a context of
+// originalContextLength
+func WithYaRN(originalContextLength int) func(*Options) {
+	return func(opts *Options) {
+		opts.OriginalContextLength = originalContextLength
+		opts.ExtrapolationFactor = 1
+	}
+}
@@ -67,6 +67,15 @@ type MultimodalProcessor interface {
 	PostTokenize([]input.Input) ([]input.Input, error)
 }
 
+// ImageDetailProcessor is implemented by multimodal models that can encode an
+// image at a lower level of detail, such as by splitting it into fewer tiles,
+// trading accuracy for speed and memory.
+type ImageDetailProcessor interface {
+	// EncodeMultimodalDetail is EncodeMultimodal at a level of detail: "low",
+	// "high" or "auto", which leaves it to the model.
+	EncodeMultimodalDetail(ml.Context, []byte, string) ([]input.Multimodal, error)
+}
+
 // Base implements the common fields and methods for all models
 type Base struct {
 	b ml.Backend
@@ -74,6 +83,11 @@ type Base struct {
 }
 
 type config struct {
+	// Cache stores the keys and values of the model's attention layers. When
+	// a sequence fills the context window, the runner removes its oldest
+	// tokens after num_keep from the cache rather than failing the request,
+	// so a cache that can't remove tokens from the middle of a sequence has
+	// the remaining inputs processed over again.
 	Cache kvcache.Cache
 }
 
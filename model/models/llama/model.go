@@ -18,6 +18,19 @@ type Options struct {
 	hiddenSize, numHeads, numKVHeads int
 	headDim, ropeDim                 int
 	eps, ropeBase, ropeScale         float32
+
+	// yarnOriginalContextLength is the training context length of the
+	// model when its context is extended with YaRN scaling
+	yarnOriginalContextLength int
+}
+
+func (o *Options) ropeOptions(factors ml.Tensor) []func(*rope.Options) {
+	options := []func(*rope.Options){rope.WithFactors(factors)}
+	if o.yarnOriginalContextLength > 0 {
+		options = append(options, rope.WithYaRN(o.yarnOriginalContextLength))
+	}
+
+	return options
 }
 
 type Model struct {
@@ -62,6 +75,10 @@ func New(c fs.Config) (model.Model, error) {
 		},
 	}
 
+	if c.String("rope.scaling.type") == "yarn" {
+		m.yarnOriginalContextLength = int(c.Uint("rope.scaling.original_context_length", c.Uint("context_length")))
+	}
+
 	m.Cache = kvcache.NewCausalCache(m.Shift)
 
 	return &m, nil
@@ -89,8 +106,8 @@ func (sa *SelfAttention) Forward(ctx ml.Context, hiddenState, positions ml.Tenso
 	value := sa.Value.Forward(ctx, hiddenState)
 	value = value.Reshape(ctx, headDim, opts.numKVHeads, batchSize)
 
-	query = fast.RoPE(ctx, query, positions, ropeDim, opts.ropeBase, opts.ropeScale, rope.WithFactors(sa.RopeFactors))
-	key = fast.RoPE(ctx, key, positions, ropeDim, opts.ropeBase, opts.ropeScale, rope.WithFactors(sa.RopeFactors))
+	query = fast.RoPE(ctx, query, positions, ropeDim, opts.ropeBase, opts.ropeScale, opts.ropeOptions(sa.RopeFactors)...)
+	key = fast.RoPE(ctx, key, positions, ropeDim, opts.ropeBase, opts.ropeScale, opts.ropeOptions(sa.RopeFactors)...)
 
 	attention := nn.Attention(ctx, query, key, value, 1.0/math.Sqrt(float64(headDim)), cache)
 	attention = attention.Reshape(ctx, headDim*opts.numHeads, batchSize)
@@ -99,7 +116,7 @@ func (sa *SelfAttention) Forward(ctx ml.Context, hiddenState, positions ml.Tenso
 
 func (m *Model) Shift(ctx ml.Context, layer int, key, shift ml.Tensor) (ml.Tensor, error) {
 	ropeDim := cmp.Or(m.ropeDim, m.hiddenSize/m.numHeads)
-	return fast.RoPE(ctx, key, shift, ropeDim, m.ropeBase, m.ropeScale, rope.WithFactors(m.Layers[layer].SelfAttention.RopeFactors)), nil
+	return fast.RoPE(ctx, key, shift, ropeDim, m.ropeBase, m.ropeScale, m.ropeOptions(m.Layers[layer].SelfAttention.RopeFactors)...), nil
 }
 
 type MLP struct {
@@ -0,0 +1,55 @@
+package llama
+
+import (
+	"testing"
+
+	fsggml "github.com/ollama/ollama/fs/ggml"
+)
+
+func TestYaRNOriginalContextLength(t *testing.T) {
+	cases := []struct {
+		name string
+		kv   fsggml.KV
+		want int
+	}{
+		{
+			name: "original context length",
+			kv: fsggml.KV{
+				"llama.rope.scaling.type":                    "yarn",
+				"llama.context_length":                       uint32(131072),
+				"llama.rope.scaling.original_context_length": uint32(32768),
+			},
+			want: 32768,
+		},
+		{
+			name: "context length",
+			kv: fsggml.KV{
+				"llama.rope.scaling.type": "yarn",
+				"llama.context_length":    uint32(32768),
+			},
+			want: 32768,
+		},
+		{
+			name: "not yarn",
+			kv: fsggml.KV{
+				"llama.context_length":                       uint32(131072),
+				"llama.rope.scaling.original_context_length": uint32(32768),
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.kv["general.architecture"] = "llama"
+
+			m, err := New(tt.kv)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := m.(*Model).yarnOriginalContextLength; got != tt.want {
+				t.Errorf("expected original context length %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
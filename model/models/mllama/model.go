@@ -3,7 +3,7 @@ package mllama
 import (
 	"bytes"
 	"image"
-	"slices"
+	"math"
 
 	"github.com/ollama/ollama/fs"
 	"github.com/ollama/ollama/kvcache"
@@ -31,6 +31,11 @@ const (
 )
 
 func New(c fs.Config) (model.Model, error) {
+	textModel, err := newTextModel(c)
+	if err != nil {
+		return nil, err
+	}
+
 	m := Model{
 		BytePairEncoding: model.NewBytePairEncoding(
 			c.String("tokenizer.ggml.pretokenizer", `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`),
@@ -49,17 +54,38 @@ func New(c fs.Config) (model.Model, error) {
 		),
 		ImageProcessor: newImageProcessor(c),
 		VisionModel:    newVisionModel(c),
-		TextModel:      newTextModel(c),
+		TextModel:      textModel,
 	}
 
+	m.Cache = newCache(c, m.TextModel)
+
+	return &m, nil
+}
+
+// newCache returns the cache for the cross attention and self attention
+// layers. If the model was trained with sliding window attention, the self
+// attention layers only attend to the last attention.sliding_window positions.
+func newCache(c fs.Config, m *TextModel) *kvcache.WrapperCache {
 	encoderCache := kvcache.NewEncoderCache()
 	encoderCache.SetConfig(ml.CacheConfig{})
-	m.Cache = kvcache.NewWrapperCache(encoderCache, kvcache.NewCausalCache(m.TextModel.Shift))
 
-	return &m, nil
+	selfAttentionCache := kvcache.NewCausalCache(m.Shift)
+	if window := c.Uint("attention.sliding_window"); window > 0 {
+		selfAttentionCache = kvcache.NewSWACache(int32(window), m.Shift)
+	}
+
+	return kvcache.NewWrapperCache(encoderCache, selfAttentionCache)
 }
 
 func (m *Model) EncodeMultimodal(ctx ml.Context, multimodalData []byte) ([]input.Multimodal, error) {
+	return m.EncodeMultimodalDetail(ctx, multimodalData, "auto")
+}
+
+// EncodeMultimodalDetail splits the image into a single tile at low detail,
+// into the model's maximum number of tiles at high detail and into as many
+// as fit the image otherwise. Only the tiles of the image are encoded, so
+// fewer tiles take less time and fewer vision tokens.
+func (m *Model) EncodeMultimodalDetail(ctx ml.Context, multimodalData []byte, detail string) ([]input.Multimodal, error) {
 	if len(m.VisionModel.Transformer.Layers) == 0 || len(m.GlobalTransformer.Layers) == 0 {
 		return nil, model.ErrNoVisionModel
 	}
@@ -69,20 +95,11 @@ func (m *Model) EncodeMultimodal(ctx ml.Context, multimodalData []byte) ([]input
 		return nil, err
 	}
 
-	f32s, ratio, err := m.ImageProcessor.ProcessImage(image)
+	pixelValues, aspectRatio, err := m.visionInputs(ctx, image, detail)
 	if err != nil {
 		return nil, err
 	}
 
-	if ratio.numTiles() < m.maxNumTiles {
-		// Pad tiles to maxNumTiles
-		f32s = slices.Grow(f32s, m.imageSize*m.imageSize*m.numChannels*m.maxNumTiles)
-		f32s = f32s[:m.imageSize*m.imageSize*m.numChannels*m.maxNumTiles]
-	}
-
-	pixelValues := ctx.Input().FromFloatSlice(f32s, m.imageSize, m.imageSize, m.numChannels, m.maxNumTiles)
-	aspectRatio := ctx.Input().FromIntSlice([]int32{int32(ratio.rank)}, 1)
-
 	positionIDs := ctx.Arange(0, 1601, 1, ml.DTypeI32)
 	crossAttentionStates := m.VisionModel.Forward(ctx, pixelValues, positionIDs, aspectRatio)
 	projectedOutputs := m.Projector.Forward(ctx, crossAttentionStates)
@@ -90,27 +107,92 @@ func (m *Model) EncodeMultimodal(ctx ml.Context, multimodalData []byte) ([]input
 	return []input.Multimodal{{Tensor: projectedOutputs}}, nil
 }
 
+// visionInputs returns the pixel values of the tiles of img, one for each
+// tile along the fourth dimension, and the aspect ratio they are arranged in
+func (m *Model) visionInputs(ctx ml.Context, img image.Image, detail string) (ml.Tensor, ml.Tensor, error) {
+	f32s, ratio, err := m.ImageProcessor.ProcessImage(img, detail)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pixelValues := ctx.Input().FromFloatSlice(f32s, m.imageSize, m.imageSize, m.numChannels, ratio.numTiles())
+	aspectRatio := ctx.Input().FromIntSlice([]int32{int32(ratio.rank)}, 1)
+	return pixelValues, aspectRatio, nil
+}
+
+// PostTokenize replaces images with the <|image|> token. The encoder cache
+// only keeps the last image of a batch, so an image followed by another is
+// processed in the same batch as the text up to that image, which has to
+// attend to it.
 func (m *Model) PostTokenize(inputs []input.Input) ([]input.Input, error) {
+	last := -1
 	for i := range inputs {
 		if inputs[i].Multimodal != nil {
 			inputs[i].Token = 128256 // <|image|>
+			if last >= 0 {
+				inputs[last].SameBatch = i - last - 1
+			}
+			last = i
 		}
 	}
 
 	return inputs, nil
 }
 
+// imageAttentionMask returns a mask over the vision tokens of the images in
+// batch, imageTokens[i] for the ith image, that lets each position attend
+// only to the most recent image at or before it. Positions before the first
+// image attend to the first image.
+func imageAttentionMask(batch input.Batch, imageTokens []int) []float32 {
+	var total int
+	starts := make([]int, len(imageTokens))
+	for i, n := range imageTokens {
+		starts[i] = total
+		total += n
+	}
+
+	mask := make([]float32, len(batch.Positions)*total)
+
+	var image int
+	for i := range batch.Positions {
+		for image+1 < len(imageTokens) && batch.Multimodal[image+1].Index <= i {
+			image++
+		}
+
+		row := mask[i*total : (i+1)*total]
+		for j := range row {
+			if j < starts[image] || j >= starts[image]+imageTokens[image] {
+				row[j] = float32(math.Inf(-1))
+			}
+		}
+	}
+
+	return mask
+}
+
 func (m *Model) Forward(ctx ml.Context, batch input.Batch) (ml.Tensor, error) {
-	var crossAttentionStates ml.Tensor
-	if len(batch.Multimodal) > 0 {
-		crossAttentionStates = batch.Multimodal[len(batch.Multimodal)-1].Multimodal[0].Tensor
+	// Images may be split into different numbers of tiles, so the tiles of
+	// each image are flattened into [hiddenSize, numVisionTokens*numTiles]
+	var crossAttentionStates []ml.Tensor
+	var crossAttentionMask ml.Tensor
+	imageTokens := make([]int, len(batch.Multimodal))
+	for i, mm := range batch.Multimodal {
+		states := mm.Multimodal[0].Tensor
+		states = states.Reshape(ctx, states.Dim(0), states.Dim(1)*states.Dim(2))
+		crossAttentionStates = append(crossAttentionStates, states)
+		imageTokens[i] = states.Dim(1)
+	}
+
+	if len(batch.Multimodal) > 1 {
+		mask := imageAttentionMask(batch, imageTokens)
+		crossAttentionMask = ctx.Input().FromFloatSlice(mask, len(mask)/len(batch.Positions), len(batch.Positions))
 	}
 
 	positions := ctx.Input().FromIntSlice(batch.Positions, len(batch.Positions))
 	outputs := ctx.Input().FromIntSlice(batch.Outputs, len(batch.Outputs))
 
-	// TODO: attention mask, cross attention mask
-	return m.TextModel.Forward(ctx, batch.Inputs, positions, outputs, crossAttentionStates, nil, m.Cache.(*kvcache.WrapperCache)), nil
+	// TODO: attention mask
+	return m.TextModel.Forward(ctx, batch.Inputs, positions, outputs, crossAttentionStates, crossAttentionMask, m.Cache.(*kvcache.WrapperCache)), nil
 }
 
 func init() {
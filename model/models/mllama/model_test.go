@@ -0,0 +1,375 @@
+package mllama
+
+import (
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	fsggml "github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/kvcache"
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/ml/backend/ggml"
+	"github.com/ollama/ollama/ml/nn"
+	"github.com/ollama/ollama/model/input"
+)
+
+func TestImageAttentionMask(t *testing.T) {
+	// a prompt with two images: text, image, text, image, text
+	batch := input.Batch{
+		Positions:  []int32{0, 1, 2, 3, 4, 5, 6},
+		Multimodal: []input.MultimodalIndex{{Index: 1}, {Index: 4}},
+	}
+
+	// the images are split into different numbers of tiles
+	imageTokens := []int{3, 2}
+	mask := imageAttentionMask(batch, imageTokens)
+
+	const total = 5
+	if len(mask) != len(batch.Positions)*total {
+		t.Fatalf("expected %d mask values, got %d", len(batch.Positions)*total, len(mask))
+	}
+
+	// the image each position attends to, and the vision tokens of each image
+	want := []int{0, 0, 0, 0, 1, 1, 1}
+	images := []int{0, 0, 0, 1, 1}
+	for i, image := range want {
+		row := mask[i*total : (i+1)*total]
+		for j, v := range row {
+			attends := !math.IsInf(float64(v), -1)
+			if attends != (images[j] == image) {
+				t.Errorf("position %d, vision token %d: expected attending to image %d, got mask %v", i, j, image, row)
+				break
+			}
+		}
+	}
+}
+
+func TestVisionInputsTiles(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fsggml.WriteGGUF(f, fsggml.KV{"general.architecture": "test", "test.block_count": uint32(1)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ggml.New(f.Name(), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := Model{ImageProcessor: ImageProcessor{imageSize: 560, numChannels: 3, maxNumTiles: 4}}
+
+	cases := []struct {
+		detail string
+		tiles  int
+	}{
+		{detail: "auto", tiles: 1},
+		{detail: "low", tiles: 1},
+		{detail: "high", tiles: 4},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.detail, func(t *testing.T) {
+			ctx := b.NewContext()
+			defer ctx.Close()
+
+			// a small image fits in a single tile unless more are forced
+			pixelValues, aspectRatio, err := m.visionInputs(ctx, image.NewRGBA(image.Rect(0, 0, 100, 100)), tt.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pixelValues.Dim(3) != tt.tiles {
+				t.Errorf("expected %d tiles of pixel values, got shape %v", tt.tiles, pixelValues.Shape())
+			}
+
+			if aspectRatio.Dim(0) != 1 {
+				t.Errorf("expected a single aspect ratio, got %v", aspectRatio.Shape())
+			}
+		})
+	}
+}
+
+func TestPostTokenizeSameBatch(t *testing.T) {
+	image := input.Input{Multimodal: []input.Multimodal{{}}}
+	text := input.Input{Token: 1}
+
+	var m Model
+	inputs, err := m.PostTokenize([]input.Input{text, image, text, text, image, text, text})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each image is batched with the text up to the next image, and the
+	// text after the last image may be split since it only attends to the
+	// last image, which the encoder cache keeps
+	want := []int{0, 2, 0, 0, 0, 0, 0}
+	for i, inp := range inputs {
+		if inp.SameBatch != want[i] {
+			t.Errorf("input %d: expected SameBatch %d, got %d", i, want[i], inp.SameBatch)
+		}
+	}
+}
+
+func TestTextCrossAttentionImages(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fsggml.WriteGGUF(f, fsggml.KV{"general.architecture": "test", "test.block_count": uint32(1)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ggml.New(f.Name(), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const hiddenSize = 4
+
+	opts := &TextModelOptions{hiddenSize: hiddenSize, numHeads: 1, numKVHeads: 1, eps: 1e-5}
+
+	encoderCache := kvcache.NewEncoderCache()
+	encoderCache.SetConfig(ml.CacheConfig{})
+	cache := kvcache.NewWrapperCache(encoderCache)
+	cache.Init(b, ml.DTypeF32, 1, 16, 16)
+	defer cache.Close()
+
+	hidden := []float32{
+		1, 0, 0, 0,
+		0, 1, 0, 0,
+		0, 0, 1, 1,
+	}
+
+	// the second image has more vision tokens, as when it's split into
+	// more tiles
+	images := [][]float32{
+		{1, 2, 0, 0, 0, 0, 3, 1},
+		{0, 1, 1, 0, 2, 0, 0, 1, 1, 0, 0, 2},
+	}
+
+	// forward runs cross attention for the hidden states of each position
+	// over the given images, which are at the given batch indices
+	forward := func(hidden []float32, images [][]float32, indices []int) []float32 {
+		ctx := b.NewContext()
+		defer ctx.Close()
+
+		identity := make([]float32, hiddenSize*hiddenSize)
+		for i := range hiddenSize {
+			identity[i*hiddenSize+i] = 1
+		}
+		ones := []float32{1, 1, 1, 1}
+
+		ca := TextCrossAttention{
+			QueryNorm: &nn.RMSNorm{Weight: ctx.Input().FromFloatSlice(ones, hiddenSize)},
+			Query:     &nn.Linear{Weight: ctx.Input().FromFloatSlice(identity, hiddenSize, hiddenSize)},
+			KeyNorm:   &nn.RMSNorm{Weight: ctx.Input().FromFloatSlice(ones, hiddenSize)},
+			Key:       &nn.Linear{Weight: ctx.Input().FromFloatSlice(identity, hiddenSize, hiddenSize)},
+			Value:     &nn.Linear{Weight: ctx.Input().FromFloatSlice(identity, hiddenSize, hiddenSize)},
+			Output:    &nn.Linear{Weight: ctx.Input().FromFloatSlice(identity, hiddenSize, hiddenSize)},
+		}
+
+		batch := input.Batch{Positions: make([]int32, len(hidden)/hiddenSize)}
+		var states []ml.Tensor
+		var mask ml.Tensor
+		var imageTokens []int
+		for i, image := range images {
+			batch.Multimodal = append(batch.Multimodal, input.MultimodalIndex{Index: indices[i]})
+			states = append(states, ctx.Input().FromFloatSlice(image, hiddenSize, len(image)/hiddenSize))
+			imageTokens = append(imageTokens, len(image)/hiddenSize)
+		}
+
+		if len(images) > 1 {
+			m := imageAttentionMask(batch, imageTokens)
+			mask = ctx.Input().FromFloatSlice(m, len(m)/len(batch.Positions), len(batch.Positions))
+		}
+
+		if err := cache.StartForward(ctx, batch, false); err != nil {
+			t.Fatal(err)
+		}
+		cache.SetLayer(0)
+		cache.SetLayerType(0)
+
+		out := ca.Forward(ctx, ctx.Input().FromFloatSlice(hidden, hiddenSize, len(batch.Positions)), states, mask, cache, opts)
+		ctx.Forward(out).Compute(out)
+		return out.Floats()
+	}
+
+	first := forward(hidden, images[:1], []int{0})
+	second := forward(hidden, images[1:], []int{1})
+	both := forward(hidden, images, []int{0, 1})
+
+	// the first position precedes the second image so only sees the first
+	want := append(slices.Clone(first[:hiddenSize]), second[hiddenSize:]...)
+	for i := range want {
+		if math.Abs(float64(both[i]-want[i])) > 1e-5 {
+			t.Fatalf("expected %v, got %v", want, both)
+		}
+	}
+
+	// a batch split after the text of the first image, as SameBatch
+	// requires, gives the same result as a single batch
+	split := append(forward(hidden[:hiddenSize], images[:1], []int{0}), forward(hidden[hiddenSize:], images[1:], []int{0})...)
+	for i := range both {
+		if math.Abs(float64(split[i]-both[i])) > 1e-5 {
+			t.Fatalf("expected %v from split batches, got %v", both, split)
+		}
+	}
+
+	// later decode steps attend to the last image from the encoder cache
+	cached := forward(hidden, nil, nil)
+	for i := range second {
+		if math.Abs(float64(cached[i]-second[i])) > 1e-5 {
+			t.Fatalf("expected %v from the cached image, got %v", second, cached)
+		}
+	}
+}
+
+func TestSelfAttentionSlidingWindowMask(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fsggml.WriteGGUF(f, fsggml.KV{"general.architecture": "test", "test.block_count": uint32(1)}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ggml.New(f.Name(), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		window uint32
+		// the first position each position attends to
+		want []int
+	}{
+		{name: "causal", want: []int{0, 0, 0, 0, 0}},
+		{name: "sliding window", window: 2, want: []int{0, 0, 0, 1, 2}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := fsggml.KV{"general.architecture": "mllama"}
+			if tt.window > 0 {
+				kv["mllama.attention.sliding_window"] = tt.window
+			}
+
+			cache := newCache(kv, &TextModel{})
+			cache.Init(b, ml.DTypeF32, 1, 16, 16)
+			defer cache.Close()
+
+			ctx := b.NewContext()
+			defer ctx.Close()
+
+			positions := []int32{0, 1, 2, 3, 4}
+			batch := input.Batch{Positions: positions, Sequences: make([]int, len(positions))}
+			if err := cache.StartForward(ctx, batch, false); err != nil {
+				t.Fatal(err)
+			}
+
+			cache.SetLayer(0)
+			cache.SetLayerType(selfAttentionLayer)
+
+			key := ctx.Input().FromFloatSlice(make([]float32, len(positions)), 1, 1, len(positions))
+			cache.Put(ctx, key, key)
+
+			_, _, mask := cache.Get(ctx)
+			ctx.Forward(mask).Compute(mask)
+
+			length := mask.Dim(0)
+			values := mask.Floats()
+			for i, first := range tt.want {
+				for j := range length {
+					attends := !math.IsInf(float64(values[i*length+j]), -1)
+					if attends != (j >= first && j <= i) {
+						t.Errorf("position %d: expected attending to positions %d through %d, got mask %v", i, first, i, values[i*length:(i+1)*length])
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRopeFactors(t *testing.T) {
+	cases := []struct {
+		name    string
+		factors []float32
+		err     bool
+	}{
+		{name: "loaded"},
+		{name: "one per pair of dimensions", factors: []float32{1, 2, 4, 8}},
+		{name: "too few", factors: []float32{1, 2, 4}, err: true},
+		{name: "one per dimension", factors: []float32{1, 1, 2, 2, 4, 4, 8, 8}, err: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := fsggml.KV{"general.architecture": "mllama", "mllama.rope.dimension_count": uint32(8)}
+			if tt.factors != nil {
+				kv.SetFloats("rope.freq_factors", tt.factors)
+			}
+
+			m, err := newTextModel(kv)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(m.ropeFactors, tt.factors) {
+				t.Errorf("expected factors %v, got %v", tt.factors, m.ropeFactors)
+			}
+		})
+	}
+
+	t.Run("replaces loaded", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if err := fsggml.WriteGGUF(f, fsggml.KV{"general.architecture": "test", "test.block_count": uint32(1)}, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ggml.New(f.Name(), ml.BackendParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := b.NewContext()
+		defer ctx.Close()
+
+		loaded := ctx.Input().FromFloatSlice([]float32{1, 1}, 2)
+		if got := (&TextModelOptions{}).factors(ctx, loaded); got != loaded {
+			t.Error("expected the loaded factors without an override")
+		}
+
+		if got := (&TextModelOptions{}).factors(ctx, nil); got != nil {
+			t.Errorf("expected no factors without an override, got %v", got)
+		}
+
+		factors := (&TextModelOptions{ropeFactors: []float32{1, 4}}).factors(ctx, loaded)
+		ctx.Forward(factors).Compute(factors)
+		if got := factors.Floats(); !slices.Equal(got, []float32{1, 4}) {
+			t.Errorf("expected the overriding factors, got %v", got)
+		}
+	})
+}
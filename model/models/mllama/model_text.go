@@ -1,6 +1,7 @@
 package mllama
 
 import (
+	"fmt"
 	"math"
 	"slices"
 
@@ -20,17 +21,20 @@ type TextSelfAttention struct {
 	RopeFactors ml.Tensor  `gguf:"rope_freqs.weight"`
 }
 
-func (sa *TextSelfAttention) Forward(ctx ml.Context, hiddenState, positions ml.Tensor, cache *kvcache.WrapperCache, opts *TextModelOptions) ml.Tensor {
+func (sa *TextSelfAttention) Forward(ctx ml.Context, hiddenState, positions, factors ml.Tensor, cache *kvcache.WrapperCache, opts *TextModelOptions) ml.Tensor {
 	batchSize := hiddenState.Dim(1)
 	headDim := opts.hiddenSize / opts.numHeads
+	if factors == nil {
+		factors = sa.RopeFactors
+	}
 
 	query := sa.Query.Forward(ctx, hiddenState)
 	query = query.Reshape(ctx, headDim, opts.numHeads, batchSize)
-	query = fast.RoPE(ctx, query, positions, opts.ropeDim, opts.ropeBase, opts.ropeScale, rope.WithFactors(sa.RopeFactors))
+	query = fast.RoPE(ctx, query, positions, opts.ropeDim, opts.ropeBase, opts.ropeScale, opts.ropeOptions(factors)...)
 
 	key := sa.Key.Forward(ctx, hiddenState)
 	key = key.Reshape(ctx, headDim, opts.numKVHeads, batchSize)
-	key = fast.RoPE(ctx, key, positions, opts.ropeDim, opts.ropeBase, opts.ropeScale, rope.WithFactors(sa.RopeFactors))
+	key = fast.RoPE(ctx, key, positions, opts.ropeDim, opts.ropeBase, opts.ropeScale, opts.ropeOptions(factors)...)
 
 	value := sa.Value.Forward(ctx, hiddenState)
 	value = value.Reshape(ctx, headDim, opts.numKVHeads, batchSize)
@@ -45,7 +49,7 @@ func (sa *TextSelfAttention) Forward(ctx ml.Context, hiddenState, positions ml.T
 func (m *TextModel) Shift(ctx ml.Context, layer int, key, shift ml.Tensor) (ml.Tensor, error) {
 	// This will only get called for layers in the cache, which are just the self attention layers
 	if sa, ok := m.Transformer.Layers[layer].(*TextSelfAttentionDecoderLayer); ok {
-		return fast.RoPE(ctx, key, shift, m.ropeDim, m.ropeBase, m.ropeScale, rope.WithFactors(sa.SelfAttention.RopeFactors)), nil
+		return fast.RoPE(ctx, key, shift, m.ropeDim, m.ropeBase, m.ropeScale, m.ropeOptions(m.factors(ctx, sa.SelfAttention.RopeFactors))...), nil
 	}
 
 	return key, nil
@@ -70,11 +74,11 @@ type TextSelfAttentionDecoderLayer struct {
 	MLP     *TextMLP
 }
 
-func (d *TextSelfAttentionDecoderLayer) Forward(ctx ml.Context, hiddenState, positions, outputs, _, _ ml.Tensor, cache *kvcache.WrapperCache, opts *TextModelOptions) ml.Tensor {
+func (d *TextSelfAttentionDecoderLayer) Forward(ctx ml.Context, hiddenState, positions, outputs, ropeFactors ml.Tensor, _ []ml.Tensor, _ ml.Tensor, cache *kvcache.WrapperCache, opts *TextModelOptions) ml.Tensor {
 	residual := hiddenState
 
 	hiddenState = d.AttentionNorm.Forward(ctx, hiddenState, opts.eps)
-	hiddenState = d.SelfAttention.Forward(ctx, hiddenState, positions, cache, opts)
+	hiddenState = d.SelfAttention.Forward(ctx, hiddenState, positions, ropeFactors, cache, opts)
 
 	// In the final layer (outputs != nil), optimize by pruning to just the token positions
 	// we need logits for.
@@ -100,7 +104,7 @@ type TextCrossAttention struct {
 	Output    *nn.Linear  `gguf:"cross_attn_o_proj"`
 }
 
-func (ca *TextCrossAttention) Forward(ctx ml.Context, hiddenState, crossAttentionStates ml.Tensor, cache *kvcache.WrapperCache, opts *TextModelOptions) ml.Tensor {
+func (ca *TextCrossAttention) Forward(ctx ml.Context, hiddenState ml.Tensor, crossAttentionStates []ml.Tensor, crossAttentionMask ml.Tensor, cache *kvcache.WrapperCache, opts *TextModelOptions) ml.Tensor {
 	batchSize := hiddenState.Dim(1)
 	headDim := opts.hiddenSize / opts.numHeads
 
@@ -108,21 +112,37 @@ func (ca *TextCrossAttention) Forward(ctx ml.Context, hiddenState, crossAttentio
 	query = query.Reshape(ctx, headDim, opts.numHeads, batchSize)
 	query = ca.QueryNorm.Forward(ctx, query, opts.eps)
 
+	// Vision states are only present in the batch containing the images.
+	// The vision tokens of all of its images are attended to together, with
+	// crossAttentionMask selecting the image for each position. Only the key
+	// and value of the last image are stored in the encoder cache, to be
+	// reused by every following decode step until the next image, which is
+	// why PostTokenize keeps the text between images in their batch.
 	var key, value ml.Tensor
-	if crossAttentionStates != nil {
-		numVisionTokens, numTiles := crossAttentionStates.Dim(1), crossAttentionStates.Dim(2)
+	if len(crossAttentionStates) > 0 {
+		states := crossAttentionStates[0]
+		for _, s := range crossAttentionStates[1:] {
+			states = states.Concat(ctx, s, 1)
+		}
+
+		imageTokens := states.Dim(1)
+		lastImageTokens := crossAttentionStates[len(crossAttentionStates)-1].Dim(1)
 
-		key = ca.Key.Forward(ctx, crossAttentionStates)
-		key = key.Reshape(ctx, headDim, opts.numKVHeads, numVisionTokens*numTiles)
+		key = ca.Key.Forward(ctx, states)
+		key = key.Reshape(ctx, headDim, opts.numKVHeads, imageTokens)
 		key = ca.KeyNorm.Forward(ctx, key, opts.eps)
 
-		value = ca.Value.Forward(ctx, crossAttentionStates)
-		value = value.Reshape(ctx, headDim, opts.numKVHeads, numVisionTokens*numTiles)
+		value = ca.Value.Forward(ctx, states)
+		value = value.Reshape(ctx, headDim, opts.numKVHeads, imageTokens)
 
-		cache.Put(ctx, key, value)
-	}
+		lastImage := func(t ml.Tensor) ml.Tensor {
+			return t.View(ctx, t.Stride(2)*(imageTokens-lastImageTokens), headDim, t.Stride(1), opts.numKVHeads, t.Stride(2), lastImageTokens)
+		}
 
-	key, value, _ = cache.Get(ctx)
+		cache.Put(ctx, lastImage(key), lastImage(value))
+	} else {
+		key, value, _ = cache.Get(ctx)
+	}
 
 	scaleFactor := 1.0 / math.Sqrt(float64(headDim))
 
@@ -133,6 +153,9 @@ func (ca *TextCrossAttention) Forward(ctx ml.Context, hiddenState, crossAttentio
 	kq := key.MulmatFullPrec(ctx, query)
 
 	kq = kq.Scale(ctx, scaleFactor)
+	if crossAttentionMask != nil {
+		kq = kq.Add(ctx, crossAttentionMask)
+	}
 	kq = kq.Softmax(ctx)
 
 	kqv := value.Mulmat(ctx, kq)
@@ -152,11 +175,11 @@ type TextCrossAttentionDecoderLayer struct {
 	MLPGate ml.Tensor `gguf:"cross_attn_mlp_gate"`
 }
 
-func (d *TextCrossAttentionDecoderLayer) Forward(ctx ml.Context, hiddenState, _, _, crossAttentionStates, crossAttentionMask ml.Tensor, cache *kvcache.WrapperCache, opts *TextModelOptions) ml.Tensor {
+func (d *TextCrossAttentionDecoderLayer) Forward(ctx ml.Context, hiddenState, _, _, _ ml.Tensor, crossAttentionStates []ml.Tensor, crossAttentionMask ml.Tensor, cache *kvcache.WrapperCache, opts *TextModelOptions) ml.Tensor {
 	residual := hiddenState
 
 	hiddenState = d.AttentionNorm.Forward(ctx, hiddenState, opts.eps)
-	hiddenState = d.CrossAttention.Forward(ctx, hiddenState, crossAttentionStates, cache, opts)
+	hiddenState = d.CrossAttention.Forward(ctx, hiddenState, crossAttentionStates, crossAttentionMask, cache, opts)
 	hiddenState = hiddenState.Mul(ctx, d.AttentionGate.Tanh(ctx))
 	hiddenState = hiddenState.Add(ctx, residual)
 	residual = hiddenState
@@ -168,14 +191,17 @@ func (d *TextCrossAttentionDecoderLayer) Forward(ctx ml.Context, hiddenState, _,
 }
 
 type TextDecoderLayer interface {
-	Forward(ctx ml.Context, hiddenState, positionIDs, outputs, crossAttentionStates, crossAttentionMask ml.Tensor, cache *kvcache.WrapperCache, opts *TextModelOptions) ml.Tensor
+	Forward(ctx ml.Context, hiddenState, positionIDs, outputs, ropeFactors ml.Tensor, crossAttentionStates []ml.Tensor, crossAttentionMask ml.Tensor, cache *kvcache.WrapperCache, opts *TextModelOptions) ml.Tensor
 }
 
 type TextDecoder struct {
 	Layers []TextDecoderLayer
 }
 
-func (d *TextDecoder) Forward(ctx ml.Context, hiddenState, positionIDs, outputs, crossAttentionStates, crossAttentionMask ml.Tensor, cache *kvcache.WrapperCache, opts *TextModelOptions) ml.Tensor {
+func (d *TextDecoder) Forward(ctx ml.Context, hiddenState, positionIDs, outputs ml.Tensor, crossAttentionStates []ml.Tensor, crossAttentionMask ml.Tensor, cache *kvcache.WrapperCache, opts *TextModelOptions) ml.Tensor {
+	// build any overriding factors once for all of the layers
+	ropeFactors := opts.factors(ctx, nil)
+
 	for i, layer := range d.Layers {
 		layerType := selfAttentionLayer
 		if slices.Contains(opts.crossAttentionLayers, int32(i)) {
@@ -185,13 +211,13 @@ func (d *TextDecoder) Forward(ctx ml.Context, hiddenState, positionIDs, outputs,
 		cache.SetLayer(i)
 		cache.SetLayerType(layerType)
 
-		if layerType == selfAttentionLayer || crossAttentionStates != nil || cache.UnderlyingCache().(*kvcache.EncoderCache).EncoderCached() {
+		if layerType == selfAttentionLayer || len(crossAttentionStates) > 0 || cache.UnderlyingCache().(*kvcache.EncoderCache).EncoderCached() {
 			var lastLayerOutputs ml.Tensor
 			if i == len(d.Layers)-1 {
 				lastLayerOutputs = outputs
 			}
 
-			hiddenState = layer.Forward(ctx, hiddenState, positionIDs, lastLayerOutputs, crossAttentionStates, crossAttentionMask, cache, opts)
+			hiddenState = layer.Forward(ctx, hiddenState, positionIDs, lastLayerOutputs, ropeFactors, crossAttentionStates, crossAttentionMask, cache, opts)
 		}
 	}
 
@@ -203,9 +229,36 @@ type TextModelOptions struct {
 	ropeDim                          int
 	eps, ropeBase, ropeScale         float32
 
+	// yarnOriginalContextLength is the training context length of the
+	// model when its context is extended with YaRN scaling
+	yarnOriginalContextLength int
+
+	// ropeFactors replace the RoPE frequency factors loaded with each self
+	// attention layer if set
+	ropeFactors []float32
+
 	crossAttentionLayers []int32
 }
 
+// factors returns the RoPE frequency factors to use in place of those loaded
+// with a layer, or loaded itself if they aren't overridden
+func (o *TextModelOptions) factors(ctx ml.Context, loaded ml.Tensor) ml.Tensor {
+	if o.ropeFactors == nil {
+		return loaded
+	}
+
+	return ctx.Input().FromFloatSlice(o.ropeFactors, len(o.ropeFactors))
+}
+
+func (o *TextModelOptions) ropeOptions(factors ml.Tensor) []func(*rope.Options) {
+	options := []func(*rope.Options){rope.WithFactors(factors)}
+	if o.yarnOriginalContextLength > 0 {
+		options = append(options, rope.WithYaRN(o.yarnOriginalContextLength))
+	}
+
+	return options
+}
+
 type TextModel struct {
 	TokenEmbedding *nn.Embedding `gguf:"token_embd"`
 	Transformer    *TextDecoder  `gguf:"blk"`
@@ -215,14 +268,14 @@ type TextModel struct {
 	*TextModelOptions
 }
 
-func (m *TextModel) Forward(ctx ml.Context, inputIDs, positionIDs, outputs, crossAttentionStates, crossAttentionMask ml.Tensor, cache *kvcache.WrapperCache) ml.Tensor {
+func (m *TextModel) Forward(ctx ml.Context, inputIDs, positionIDs, outputs ml.Tensor, crossAttentionStates []ml.Tensor, crossAttentionMask ml.Tensor, cache *kvcache.WrapperCache) ml.Tensor {
 	hiddenState := m.TokenEmbedding.Forward(ctx, inputIDs)
 	hiddenState = m.Transformer.Forward(ctx, hiddenState, positionIDs, outputs, crossAttentionStates, crossAttentionMask, cache, m.TextModelOptions)
 	hiddenState = m.OutputNorm.Forward(ctx, hiddenState, m.eps)
 	return m.Output.Forward(ctx, hiddenState)
 }
 
-func newTextModel(c fs.Config) *TextModel {
+func newTextModel(c fs.Config) (*TextModel, error) {
 	var decoderLayers []TextDecoderLayer
 	for i := range c.Uint("block_count") {
 		var textDecoderLayer TextDecoderLayer
@@ -235,7 +288,7 @@ func newTextModel(c fs.Config) *TextModel {
 		decoderLayers = append(decoderLayers, textDecoderLayer)
 	}
 
-	return &TextModel{
+	m := &TextModel{
 		Transformer: &TextDecoder{Layers: decoderLayers},
 		TextModelOptions: &TextModelOptions{
 			hiddenSize:           int(c.Uint("embedding_length")),
@@ -246,6 +299,18 @@ func newTextModel(c fs.Config) *TextModel {
 			ropeBase:             c.Float("rope.freq_base"),
 			ropeScale:            c.Float("rope.freq_scale", 1),
 			crossAttentionLayers: c.Ints("attention.cross_attention_layers"),
+			ropeFactors:          c.Floats("rope.freq_factors"),
 		},
 	}
+
+	if c.String("rope.scaling.type") == "yarn" {
+		m.yarnOriginalContextLength = int(c.Uint("rope.scaling.original_context_length", c.Uint("context_length")))
+	}
+
+	// the factors scale the frequencies, one for each pair of dimensions
+	if m.ropeFactors != nil && len(m.ropeFactors) != m.ropeDim/2 {
+		return nil, fmt.Errorf("rope factors must have %d values for a rope dimension of %d, got %d", m.ropeDim/2, m.ropeDim, len(m.ropeFactors))
+	}
+
+	return m, nil
 }
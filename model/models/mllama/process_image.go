@@ -64,8 +64,24 @@ func (p ImageProcessor) fitToCanvas(imageSize, canvasSize image.Point) image.Poi
 	return image.Point{w, h}
 }
 
-func (p ImageProcessor) optimalTiledCanvas(imageSize image.Point) image.Point {
-	possibleTileArrangements := p.supportedAspectRatios()
+// tiles returns the fewest and most tiles an image is split into at a level
+// of detail. Low detail fits the image in a single tile and high detail
+// always uses the maximum number of tiles.
+func (p ImageProcessor) tiles(detail string) (int, int) {
+	switch detail {
+	case "low":
+		return 1, 1
+	case "high":
+		return p.maxNumTiles, p.maxNumTiles
+	default:
+		return 1, p.maxNumTiles
+	}
+}
+
+func (p ImageProcessor) optimalTiledCanvas(imageSize image.Point, minTiles, maxTiles int) image.Point {
+	possibleTileArrangements := slices.DeleteFunc(p.supportedAspectRatios(), func(a supportedAspectRatio) bool {
+		return a.numTiles() < minTiles || a.numTiles() > maxTiles
+	})
 	possibleCanvasSizes := make([]image.Point, len(possibleTileArrangements))
 	for i, pta := range possibleTileArrangements {
 		possibleCanvasSizes[i] = image.Point{pta.width * p.imageSize, pta.height * p.imageSize}
@@ -101,6 +117,12 @@ func (p ImageProcessor) optimalTiledCanvas(imageSize image.Point) image.Point {
 		selectedScale = minUpscale
 	}
 
+	// with a fixed number of tiles, using fewer of them can't avoid
+	// upscaling, so the arrangement the image fills best is used
+	if minTiles == maxTiles {
+		selectedScale = slices.Max(scales)
+	}
+
 	var selectedCanvas image.Point
 	for n, pcs := range possibleCanvasSizes {
 		if scales[n] == selectedScale {
@@ -144,10 +166,10 @@ func (p ImageProcessor) splitToTiles(img image.Image, numTilesSize image.Point)
 	return images
 }
 
-func (p ImageProcessor) resize(img image.Image) (image.Image, image.Point) {
+func (p ImageProcessor) resize(img image.Image, minTiles, maxTiles int) (image.Image, image.Point) {
 	b := img.Bounds()
 
-	canvasSize := p.optimalTiledCanvas(b.Max)
+	canvasSize := p.optimalTiledCanvas(b.Max, minTiles, maxTiles)
 	aspectRatio := image.Point{canvasSize.X / p.imageSize, canvasSize.Y / p.imageSize}
 	newSize := p.fitToCanvas(b.Max, canvasSize)
 
@@ -208,8 +230,11 @@ func (p ImageProcessor) pack(img image.Image, aspectRatio image.Point) []float32
 	return pixelVals
 }
 
-func (p ImageProcessor) ProcessImage(img image.Image) ([]float32, supportedAspectRatio, error) {
-	newImage, newImageRatio := p.resize(img)
+// ProcessImage resizes, tiles and normalizes img at a level of detail, as
+// accepted by [Model.EncodeMultimodalDetail].
+func (p ImageProcessor) ProcessImage(img image.Image, detail string) ([]float32, supportedAspectRatio, error) {
+	minTiles, maxTiles := p.tiles(detail)
+	newImage, newImageRatio := p.resize(img, minTiles, maxTiles)
 	newImage = p.pad(newImage, newImageRatio)
 	pixelValues := p.pack(newImage, newImageRatio)
 
@@ -191,7 +191,7 @@ func TestOptimalTiledCanvas(t *testing.T) {
 	}
 
 	for _, tt := range cases {
-		actual := tt.p.optimalTiledCanvas(tt.image)
+		actual := tt.p.optimalTiledCanvas(tt.image, 1, tt.p.maxNumTiles)
 		if diff := cmp.Diff(actual, tt.expect); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
@@ -286,7 +286,7 @@ func TestResize(t *testing.T) {
 	}
 
 	for _, tt := range cases {
-		actualImage, actualAspectRatio := tt.p.resize(image.Rectangle{Max: tt.imageMax})
+		actualImage, actualAspectRatio := tt.p.resize(image.Rectangle{Max: tt.imageMax}, 1, tt.p.maxNumTiles)
 
 		if actualImage.Bounds() != tt.expectImage.Bounds() {
 			t.Errorf("image size incorrect: '%#v': expect: '%#v'", actualImage.Bounds(), tt.expectImage.Bounds())
@@ -357,31 +357,67 @@ func TestPackImages(t *testing.T) {
 func TestPreprocess(t *testing.T) {
 	cases := []struct {
 		imageMax            image.Point
+		detail              string
 		expectAspectRatioID int
+		expectTiles         int
 	}{
 		{
 			imageMax:            image.Point{10, 10},
+			detail:              "auto",
 			expectAspectRatioID: 1,
+			expectTiles:         1,
+		},
+		{
+			imageMax:            image.Point{10, 10},
+			detail:              "high",
+			expectAspectRatioID: 6,
+			expectTiles:         4,
 		},
 		{
 			imageMax:            image.Point{1024, 768},
+			detail:              "auto",
 			expectAspectRatioID: 6,
+			expectTiles:         4,
+		},
+		{
+			imageMax:            image.Point{1024, 768},
+			detail:              "high",
+			expectAspectRatioID: 6,
+			expectTiles:         4,
+		},
+		{
+			imageMax:            image.Point{1024, 768},
+			detail:              "low",
+			expectAspectRatioID: 1,
+			expectTiles:         1,
+		},
+		{
+			imageMax:            image.Point{2560, 640},
+			detail:              "high",
+			expectAspectRatioID: 8,
+			expectTiles:         4,
+		},
+		{
+			imageMax:            image.Point{2560, 640},
+			detail:              "low",
+			expectAspectRatioID: 1,
+			expectTiles:         1,
 		},
 	}
 
 	p := ImageProcessor{imageSize: 560, maxNumTiles: 4}
 	for _, tt := range cases {
-		img, aspectRatio, err := p.ProcessImage(image.NewRGBA(image.Rectangle{Max: tt.imageMax}))
+		img, aspectRatio, err := p.ProcessImage(image.NewRGBA(image.Rectangle{Max: tt.imageMax}), tt.detail)
 		if err != nil {
 			t.Fatalf("error processing: %q", err)
 		}
 
-		if len(img) == 0 {
-			t.Errorf("no image data returned")
+		if len(img) != tt.expectTiles*3*560*560 {
+			t.Errorf("%v at %s detail: expected %d tiles of image data, got %d values", tt.imageMax, tt.detail, tt.expectTiles, len(img))
 		}
 
-		if aspectRatio.rank != tt.expectAspectRatioID {
-			t.Errorf("aspect ratio incorrect: '%d': expect: '%d'", aspectRatio, tt.expectAspectRatioID)
+		if aspectRatio.rank != tt.expectAspectRatioID || aspectRatio.numTiles() != tt.expectTiles {
+			t.Errorf("%v at %s detail: aspect ratio incorrect: '%+v': expect rank %d with %d tiles", tt.imageMax, tt.detail, aspectRatio, tt.expectAspectRatioID, tt.expectTiles)
 		}
 	}
 }
@@ -3,20 +3,27 @@ package openai
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"math/rand"
 	"net/http"
+	"net/netip"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/publicnet"
+	"github.com/ollama/ollama/sse"
 	"github.com/ollama/ollama/types/model"
 )
 
@@ -34,9 +41,11 @@ type ErrorResponse struct {
 }
 
 type Message struct {
-	Role      string     `json:"role"`
-	Content   any        `json:"content"`
-	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	Role             string     `json:"role,omitempty"`
+	Content          any        `json:"content"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	Name             string     `json:"name,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
 }
 
 type Choice struct {
@@ -69,12 +78,113 @@ type ResponseFormat struct {
 }
 
 type JsonSchema struct {
-	Schema json.RawMessage `json:"schema"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Strict      bool            `json:"strict,omitempty"`
+	Schema      json.RawMessage `json:"schema"`
+}
+
+// unsupportedSchemaKeywords are JSON schema keywords that can't be enforced
+// by the grammar a schema is converted to for constrained generation. They
+// are ignored unless the schema is strict.
+var unsupportedSchemaKeywords = []string{
+	"not", "if", "then", "else",
+	"dependentRequired", "dependentSchemas", "patternProperties", "propertyNames",
+	"unevaluatedProperties", "unevaluatedItems", "minProperties", "maxProperties",
+	"uniqueItems", "contains", "minContains", "maxContains", "multipleOf",
+}
+
+// supportedStringFormats are the values of the "format" keyword that
+// constrained generation enforces
+var supportedStringFormats = []string{"date", "time", "date-time", "uuid"}
+
+// toFormat converts an OpenAI response_format into the format of a chat
+// request
+func toFormat(rf *ResponseFormat) (json.RawMessage, error) {
+	if rf == nil {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(rf.Type)) {
+	// Support the old "json_object" type for OpenAI compatibility
+	case "json_object":
+		return json.RawMessage(`"json"`), nil
+	case "json_schema":
+		if rf.JsonSchema == nil || len(rf.JsonSchema.Schema) == 0 {
+			return nil, errors.New("response_format of type json_schema requires a json_schema with a schema")
+		}
+
+		if rf.JsonSchema.Strict {
+			var schema any
+			if err := json.Unmarshal(rf.JsonSchema.Schema, &schema); err != nil {
+				return nil, fmt.Errorf("invalid json_schema %q: %w", rf.JsonSchema.Name, err)
+			}
+
+			if err := checkStrictSchema(schema, "#"); err != nil {
+				return nil, fmt.Errorf("json_schema %q can't be strict: %w", rf.JsonSchema.Name, err)
+			}
+		}
+
+		return rf.JsonSchema.Schema, nil
+	}
+
+	return nil, nil
+}
+
+// checkStrictSchema returns an error if schema, at the JSON pointer path,
+// uses a feature that constrained generation can't enforce
+func checkStrictSchema(schema any, path string) error {
+	s, ok := schema.(map[string]any)
+	if !ok {
+		// boolean schemas
+		return nil
+	}
+
+	for _, keyword := range unsupportedSchemaKeywords {
+		if _, ok := s[keyword]; ok {
+			return fmt.Errorf("%q at %s is not supported", keyword, path)
+		}
+	}
+
+	if format, ok := s["format"].(string); ok && !slices.Contains(supportedStringFormats, format) {
+		return fmt.Errorf("format %q at %s is not supported", format, path)
+	}
+
+	if ref, ok := s["$ref"].(string); ok && !strings.HasPrefix(ref, "#") {
+		return fmt.Errorf("external $ref %q at %s is not supported", ref, path)
+	}
+
+	for _, keyword := range slices.Sorted(maps.Keys(s)) {
+		v := s[keyword]
+		switch keyword {
+		case "properties", "$defs", "definitions":
+			defs, _ := v.(map[string]any)
+			for _, name := range slices.Sorted(maps.Keys(defs)) {
+				if err := checkStrictSchema(defs[name], path+"/"+keyword+"/"+name); err != nil {
+					return err
+				}
+			}
+		case "anyOf", "oneOf", "allOf", "prefixItems":
+			defs, _ := v.([]any)
+			for i, def := range defs {
+				if err := checkStrictSchema(def, fmt.Sprintf("%s/%s/%d", path, keyword, i)); err != nil {
+					return err
+				}
+			}
+		case "items", "additionalProperties":
+			if err := checkStrictSchema(v, path+"/"+keyword); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
 type EmbedRequest struct {
-	Input any    `json:"input"`
-	Model string `json:"model"`
+	Input      any    `json:"input"`
+	Model      string `json:"model"`
+	Dimensions int    `json:"dimensions"`
 }
 
 type StreamOptions struct {
@@ -82,19 +192,24 @@ type StreamOptions struct {
 }
 
 type ChatCompletionRequest struct {
-	Model            string          `json:"model"`
-	Messages         []Message       `json:"messages"`
-	Stream           bool            `json:"stream"`
-	StreamOptions    *StreamOptions  `json:"stream_options"`
-	MaxTokens        *int            `json:"max_tokens"`
-	Seed             *int            `json:"seed"`
-	Stop             any             `json:"stop"`
-	Temperature      *float64        `json:"temperature"`
-	FrequencyPenalty *float64        `json:"frequency_penalty"`
-	PresencePenalty  *float64        `json:"presence_penalty"`
-	TopP             *float64        `json:"top_p"`
-	ResponseFormat   *ResponseFormat `json:"response_format"`
-	Tools            []api.Tool      `json:"tools"`
+	Model            string             `json:"model"`
+	Messages         []Message          `json:"messages"`
+	Stream           bool               `json:"stream"`
+	StreamOptions    *StreamOptions     `json:"stream_options"`
+	MaxTokens        *int               `json:"max_tokens"`
+	Seed             *int               `json:"seed"`
+	Stop             any                `json:"stop"`
+	Temperature      *float64           `json:"temperature"`
+	FrequencyPenalty *float64           `json:"frequency_penalty"`
+	PresencePenalty  *float64           `json:"presence_penalty"`
+	TopP             *float64           `json:"top_p"`
+	MinP             *float64           `json:"min_p"`
+	LogitBias        map[string]float64 `json:"logit_bias"`
+	ResponseFormat   *ResponseFormat    `json:"response_format"`
+	Tools            []api.Tool         `json:"tools"`
+	N                *int               `json:"n"`
+	ToolValidation   string             `json:"tool_validation"`
+	ReasoningEffort  *string            `json:"reasoning_effort"`
 }
 
 type ChatCompletion struct {
@@ -119,18 +234,21 @@ type ChatCompletionChunk struct {
 
 // TODO (https://github.com/ollama/ollama/issues/5259): support []string, []int and [][]int
 type CompletionRequest struct {
-	Model            string         `json:"model"`
-	Prompt           string         `json:"prompt"`
-	FrequencyPenalty float32        `json:"frequency_penalty"`
-	MaxTokens        *int           `json:"max_tokens"`
-	PresencePenalty  float32        `json:"presence_penalty"`
-	Seed             *int           `json:"seed"`
-	Stop             any            `json:"stop"`
-	Stream           bool           `json:"stream"`
-	StreamOptions    *StreamOptions `json:"stream_options"`
-	Temperature      *float32       `json:"temperature"`
-	TopP             float32        `json:"top_p"`
-	Suffix           string         `json:"suffix"`
+	Model            string             `json:"model"`
+	Prompt           string             `json:"prompt"`
+	FrequencyPenalty float32            `json:"frequency_penalty"`
+	MaxTokens        *int               `json:"max_tokens"`
+	PresencePenalty  float32            `json:"presence_penalty"`
+	Seed             *int               `json:"seed"`
+	Stop             any                `json:"stop"`
+	Stream           bool               `json:"stream"`
+	StreamOptions    *StreamOptions     `json:"stream_options"`
+	Temperature      *float32           `json:"temperature"`
+	TopP             float32            `json:"top_p"`
+	MinP             *float32           `json:"min_p"`
+	LogitBias        map[string]float64 `json:"logit_bias"`
+	Suffix           string             `json:"suffix"`
+	N                *int               `json:"n"`
 }
 
 type Completion struct {
@@ -154,13 +272,15 @@ type CompletionChunk struct {
 }
 
 type ToolCall struct {
-	ID       string `json:"id"`
+	ID       string `json:"id,omitempty"`
 	Index    int    `json:"index"`
-	Type     string `json:"type"`
+	Type     string `json:"type,omitempty"`
 	Function struct {
-		Name      string `json:"name"`
+		Name      string `json:"name,omitempty"`
 		Arguments string `json:"arguments"`
 	} `json:"function"`
+	Valid           *bool  `json:"valid,omitempty"`
+	ValidationError string `json:"validation_error,omitempty"`
 }
 
 type Model struct {
@@ -168,6 +288,10 @@ type Model struct {
 	Object  string `json:"object"`
 	Created int64  `json:"created"`
 	OwnedBy string `json:"owned_by"`
+
+	// ContextLength is not part of the OpenAI API. It is included so that
+	// clients can size prompts without a separate request.
+	ContextLength uint64 `json:"context_length,omitempty"`
 }
 
 type Embedding struct {
@@ -207,6 +331,17 @@ func NewError(code int, message string) ErrorResponse {
 	return ErrorResponse{Error{Type: etype, Message: message}}
 }
 
+// systemFingerprint returns the fingerprint of the configuration that
+// generated a response, for clients checking whether the same seed should
+// reproduce it.
+func systemFingerprint(fp string) string {
+	if fp == "" {
+		return "fp_ollama"
+	}
+
+	return fp
+}
+
 func toUsage(r api.ChatResponse) Usage {
 	return Usage{
 		PromptTokens:     r.PromptEvalCount,
@@ -231,6 +366,8 @@ func toToolCalls(tc []api.ToolCall) []ToolCall {
 		toolCalls[i].Type = "function"
 		toolCalls[i].Function.Name = tc.Function.Name
 		toolCalls[i].Index = tc.Function.Index
+		toolCalls[i].Valid = tc.Valid
+		toolCalls[i].ValidationError = tc.ValidationError
 
 		args, err := json.Marshal(tc.Function.Arguments)
 		if err != nil {
@@ -250,10 +387,10 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 		Object:            "chat.completion",
 		Created:           r.CreatedAt.Unix(),
 		Model:             r.Model,
-		SystemFingerprint: "fp_ollama",
+		SystemFingerprint: systemFingerprint(r.Fingerprint),
 		Choices: []Choice{{
 			Index:   0,
-			Message: Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
+			Message: Message{Role: r.Message.Role, Content: r.Message.Content, ReasoningContent: r.Message.Thinking, ToolCalls: toolCalls},
 			FinishReason: func(reason string) *string {
 				if len(toolCalls) > 0 {
 					reason = "tool_calls"
@@ -268,28 +405,58 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 	}
 }
 
-func toChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChunk {
+// toChunk converts a chat response into one or more streaming chunks. Tool
+// calls are split following the OpenAI delta schema: a first chunk carries the
+// tool call's index, id, type and function name, and the arguments follow as a
+// string fragment in a separate chunk with the same index.
+func toChunk(id string, r api.ChatResponse, toolCallSent bool) []ChatCompletionChunk {
 	toolCalls := toToolCalls(r.Message.ToolCalls)
-	return ChatCompletionChunk{
-		Id:                id,
-		Object:            "chat.completion.chunk",
-		Created:           time.Now().Unix(),
-		Model:             r.Model,
-		SystemFingerprint: "fp_ollama",
-		Choices: []ChunkChoice{{
-			Index: 0,
-			Delta: Message{Role: "assistant", Content: r.Message.Content, ToolCalls: toolCalls},
-			FinishReason: func(reason string) *string {
-				if len(reason) > 0 {
-					if toolCallSent {
-						return &finishReasonToolCalls
-					}
-					return &reason
-				}
-				return nil
-			}(r.DoneReason),
-		}},
+
+	var finishReason *string
+	if len(r.DoneReason) > 0 {
+		finishReason = &r.DoneReason
+		if toolCallSent || len(toolCalls) > 0 {
+			finishReason = &finishReasonToolCalls
+		}
 	}
+
+	created := time.Now().Unix()
+	chunk := func(delta Message) ChatCompletionChunk {
+		return ChatCompletionChunk{
+			Id:                id,
+			Object:            "chat.completion.chunk",
+			Created:           created,
+			Model:             r.Model,
+			SystemFingerprint: systemFingerprint(r.Fingerprint),
+			Choices:           []ChunkChoice{{Index: 0, Delta: delta}},
+		}
+	}
+
+	// thinking is sent in a delta of its own, without content, before any
+	// content that follows it in the same response
+	var chunks []ChatCompletionChunk
+	if r.Message.Thinking != "" {
+		chunks = append(chunks, chunk(Message{Role: "assistant", ReasoningContent: r.Message.Thinking}))
+	}
+
+	if (len(toolCalls) == 0 && r.Message.Thinking == "") || r.Message.Content != "" {
+		chunks = append(chunks, chunk(Message{Role: "assistant", Content: r.Message.Content}))
+	}
+
+	for _, tc := range toolCalls {
+		var fragment ToolCall
+		fragment.Index = tc.Index
+		fragment.Function.Arguments = tc.Function.Arguments
+
+		tc.Function.Arguments = ""
+		chunks = append(chunks,
+			chunk(Message{Role: "assistant", ToolCalls: []ToolCall{tc}}),
+			chunk(Message{ToolCalls: []ToolCall{fragment}}),
+		)
+	}
+
+	chunks[len(chunks)-1].Choices[0].FinishReason = finishReason
+	return chunks
 }
 
 func toUsageGenerate(r api.GenerateResponse) Usage {
@@ -306,7 +473,7 @@ func toCompletion(id string, r api.GenerateResponse) Completion {
 		Object:            "text_completion",
 		Created:           r.CreatedAt.Unix(),
 		Model:             r.Model,
-		SystemFingerprint: "fp_ollama",
+		SystemFingerprint: systemFingerprint(r.Fingerprint),
 		Choices: []CompleteChunkChoice{{
 			Text:  r.Response,
 			Index: 0,
@@ -327,7 +494,7 @@ func toCompleteChunk(id string, r api.GenerateResponse) CompletionChunk {
 		Object:            "text_completion",
 		Created:           time.Now().Unix(),
 		Model:             r.Model,
-		SystemFingerprint: "fp_ollama",
+		SystemFingerprint: systemFingerprint(r.Fingerprint),
 		Choices: []CompleteChunkChoice{{
 			Text:  r.Response,
 			Index: 0,
@@ -349,6 +516,8 @@ func toListCompletion(r api.ListResponse) ListCompletion {
 			Object:  "model",
 			Created: m.ModifiedAt.Unix(),
 			OwnedBy: model.ParseName(m.Name).Namespace,
+
+			ContextLength: m.ContextLength,
 		})
 	}
 
@@ -384,20 +553,134 @@ func toEmbeddingList(model string, r api.EmbedResponse) EmbeddingList {
 }
 
 func toModel(r api.ShowResponse, m string) Model {
+	var contextLength uint64
+	if arch, ok := r.ModelInfo["general.architecture"].(string); ok {
+		// numbers in model info are float64 once decoded from JSON
+		if n, ok := r.ModelInfo[arch+".context_length"].(float64); ok {
+			contextLength = uint64(n)
+		}
+	}
+
 	return Model{
 		Id:      m,
 		Object:  "model",
 		Created: r.ModifiedAt.Unix(),
 		OwnedBy: model.ParseName(m).Namespace,
+
+		ContextLength: contextLength,
 	}
 }
 
-func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
+// maxImageSize is the largest image that will be fetched from a remote URL.
+var maxImageSize int64 = 20 << 20
+
+// imageClient fetches remote images. It only connects to the addresses that
+// imageAddrAllowed accepts, which is checked after DNS resolution and for each
+// redirect, so that an image URL can't reach the server's own network.
+var imageClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		// imageAddrAllowed is looked up on each dial so tests can replace it
+		DialContext:         publicnet.Dialer(30*time.Second, func(addr netip.AddrPort) bool { return imageAddrAllowed(addr) }).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+		}
+
+		return nil
+	},
+}
+
+// imageAddrAllowed reports whether remote images can be fetched from addr,
+// which is only a public address.
+var imageAddrAllowed = func(addr netip.AddrPort) bool {
+	return publicnet.Addr(addr.Addr())
+}
+
+var errRemoteImagesDisabled = errors.New("invalid image input: remote image urls are disabled; set OLLAMA_REMOTE_IMAGES=1 on the server to fetch them")
+
+// supportedImageTypes are the image formats understood by the vision models.
+var supportedImageTypes = []string{"image/jpeg", "image/png", "image/webp"}
+
+// decodeImageURL returns the image referenced by an image_url content part,
+// which is either a base64 data URL or a remote http(s) URL.
+func decodeImageURL(ctx context.Context, url string) (api.ImageData, error) {
+	var img []byte
+	switch {
+	case strings.HasPrefix(url, "data:"):
+		mediaType, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ";base64,")
+		if !ok {
+			return nil, errors.New("invalid image input: data URL must be base64 encoded")
+		}
+
+		if mediaType == "image/jpg" {
+			mediaType = "image/jpeg"
+		}
+
+		if !slices.Contains(supportedImageTypes, mediaType) {
+			return nil, fmt.Errorf("unsupported image type %q; supported types are %s", mediaType, strings.Join(supportedImageTypes, ", "))
+		}
+
+		var err error
+		img, err = base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, errors.New("invalid message format")
+		}
+	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
+		if !envconfig.RemoteImages() {
+			return nil, errRemoteImagesDisabled
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image url: %w", err)
+		}
+
+		resp, err := imageClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch image: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch image: %s", resp.Status)
+		}
+
+		img, err = io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch image: %w", err)
+		}
+
+		if int64(len(img)) > maxImageSize {
+			return nil, fmt.Errorf("image exceeds maximum size of %d bytes", maxImageSize)
+		}
+
+		// the Content-Type header is often missing or generic, so the
+		// format is detected from the image itself
+		if mediaType := http.DetectContentType(img); !slices.Contains(supportedImageTypes, mediaType) {
+			return nil, fmt.Errorf("unsupported image type %q; supported types are %s", mediaType, strings.Join(supportedImageTypes, ", "))
+		}
+	default:
+		return nil, errors.New("invalid image input: url must be a data URL or an http(s) URL")
+	}
+
+	return img, nil
+}
+
+func fromChatRequest(ctx context.Context, r ChatCompletionRequest) (*api.ChatRequest, error) {
 	var messages []api.Message
+	var detail string
 	for _, msg := range r.Messages {
+		start := len(messages)
 		switch content := msg.Content.(type) {
 		case string:
-			messages = append(messages, api.Message{Role: msg.Role, Content: content})
+			messages = append(messages, api.Message{Role: msg.Role, Name: msg.Name, Content: content})
 		case []any:
 			for _, c := range content {
 				data, ok := c.(map[string]any)
@@ -410,40 +693,40 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 					if !ok {
 						return nil, errors.New("invalid message format")
 					}
-					messages = append(messages, api.Message{Role: msg.Role, Content: text})
+					messages = append(messages, api.Message{Role: msg.Role, Name: msg.Name, Content: text})
 				case "image_url":
 					var url string
 					if urlMap, ok := data["image_url"].(map[string]any); ok {
 						if url, ok = urlMap["url"].(string); !ok {
 							return nil, errors.New("invalid message format")
 						}
+
+						// the detail is an option of the whole request
+						if d, ok := urlMap["detail"]; ok {
+							s, _ := d.(string)
+							switch s {
+							case "low", "high", "auto":
+							default:
+								return nil, fmt.Errorf("invalid image detail %q, must be one of low, high or auto", fmt.Sprint(d))
+							}
+
+							if detail != "" && s != detail {
+								return nil, errors.New("all images must have the same detail")
+							}
+							detail = s
+						}
 					} else {
 						if url, ok = data["image_url"].(string); !ok {
 							return nil, errors.New("invalid message format")
 						}
 					}
 
-					types := []string{"jpeg", "jpg", "png"}
-					valid := false
-					for _, t := range types {
-						prefix := "data:image/" + t + ";base64,"
-						if strings.HasPrefix(url, prefix) {
-							url = strings.TrimPrefix(url, prefix)
-							valid = true
-							break
-						}
-					}
-
-					if !valid {
-						return nil, errors.New("invalid image input")
-					}
-
-					img, err := base64.StdEncoding.DecodeString(url)
+					img, err := decodeImageURL(ctx, url)
 					if err != nil {
-						return nil, errors.New("invalid message format")
+						return nil, err
 					}
 
-					messages = append(messages, api.Message{Role: msg.Role, Images: []api.ImageData{img}})
+					messages = append(messages, api.Message{Role: msg.Role, Name: msg.Name, Images: []api.ImageData{img}})
 				default:
 					return nil, errors.New("invalid message format")
 				}
@@ -461,7 +744,13 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 					return nil, errors.New("invalid tool call arguments")
 				}
 			}
-			messages = append(messages, api.Message{Role: msg.Role, ToolCalls: toolCalls})
+			messages = append(messages, api.Message{Role: msg.Role, Name: msg.Name, ToolCalls: toolCalls})
+		}
+
+		// the reasoning of an earlier assistant turn is given back to the
+		// template as its thinking
+		if msg.ReasoningContent != "" && len(messages) > start {
+			messages[start].Thinking = msg.ReasoningContent
 		}
 	}
 
@@ -480,6 +769,10 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		options["stop"] = stops
 	}
 
+	if detail != "" {
+		options["image_detail"] = detail
+	}
+
 	if r.MaxTokens != nil {
 		options["num_predict"] = *r.MaxTokens
 	}
@@ -508,26 +801,51 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		options["top_p"] = 1.0
 	}
 
-	var format json.RawMessage
-	if r.ResponseFormat != nil {
-		switch strings.ToLower(strings.TrimSpace(r.ResponseFormat.Type)) {
-		// Support the old "json_object" type for OpenAI compatibility
-		case "json_object":
-			format = json.RawMessage(`"json"`)
-		case "json_schema":
-			if r.ResponseFormat.JsonSchema != nil {
-				format = r.ResponseFormat.JsonSchema.Schema
-			}
+	if r.MinP != nil {
+		options["min_p"] = *r.MinP
+	}
+
+	if len(r.LogitBias) > 0 {
+		options["logit_bias"] = r.LogitBias
+	}
+
+	if r.N != nil {
+		options["n"] = *r.N
+	}
+
+	format, err := toFormat(r.ResponseFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	// several choices are always streamed, and combined into one response by
+	// the writer if the request isn't
+	stream := r.Stream || (r.N != nil && *r.N > 1)
+
+	// models only think or don't, so every effort other than none turns
+	// thinking on
+	var think *bool
+	if r.ReasoningEffort != nil {
+		switch *r.ReasoningEffort {
+		case "none":
+			think = new(bool)
+		case "minimal", "low", "medium", "high":
+			think = new(bool)
+			*think = true
+		default:
+			return nil, fmt.Errorf("invalid reasoning_effort %q, must be one of none, minimal, low, medium or high", *r.ReasoningEffort)
 		}
 	}
 
 	return &api.ChatRequest{
-		Model:    r.Model,
-		Messages: messages,
-		Format:   format,
-		Options:  options,
-		Stream:   &r.Stream,
-		Tools:    r.Tools,
+		Model:          r.Model,
+		Messages:       messages,
+		Format:         format,
+		Options:        options,
+		Stream:         &stream,
+		Tools:          r.Tools,
+		ToolValidation: r.ToolValidation,
+		Think:          think,
 	}, nil
 }
 
@@ -573,11 +891,27 @@ func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 		options["top_p"] = 1.0
 	}
 
+	if r.MinP != nil {
+		options["min_p"] = *r.MinP
+	}
+
+	if len(r.LogitBias) > 0 {
+		options["logit_bias"] = r.LogitBias
+	}
+
+	if r.N != nil {
+		options["n"] = *r.N
+	}
+
+	// several choices are always streamed, and combined into one response by
+	// the writer if the request isn't
+	stream := r.Stream || (r.N != nil && *r.N > 1)
+
 	return api.GenerateRequest{
 		Model:   r.Model,
 		Prompt:  r.Prompt,
 		Options: options,
-		Stream:  &r.Stream,
+		Stream:  &stream,
 		Suffix:  r.Suffix,
 	}, nil
 }
@@ -592,6 +926,16 @@ type ChatWriter struct {
 	id            string
 	toolCallSent  bool
 	BaseWriter
+
+	// n is the number of choices requested. When it's more than one the
+	// choices are generated one after another, the request is always
+	// streamed and anything sent once every choice is done is held back
+	// until [ChatWriter.finish].
+	n         int
+	index     int
+	responses []api.ChatResponse
+	last      *api.ChatResponse
+	usage     Usage
 }
 
 type CompleteWriter struct {
@@ -599,6 +943,12 @@ type CompleteWriter struct {
 	streamOptions *StreamOptions
 	id            string
 	BaseWriter
+
+	// n is the number of choices requested, like [ChatWriter.n]
+	n         int
+	responses []api.GenerateResponse
+	last      *api.GenerateResponse
+	usage     Usage
 }
 
 type ListWriter struct {
@@ -622,8 +972,14 @@ func (w *BaseWriter) writeError(data []byte) (int, error) {
 		return 0, err
 	}
 
+	resp := NewError(http.StatusInternalServerError, serr.Error())
+	if serr.Code != "" {
+		// the codes of Ollama's errors, such as model_not_found, carry over
+		resp.Error.Code = &serr.Code
+	}
+
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w.ResponseWriter).Encode(NewError(http.StatusInternalServerError, serr.Error()))
+	err = json.NewEncoder(w.ResponseWriter).Encode(resp)
 	if err != nil {
 		return 0, err
 	}
@@ -638,24 +994,46 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 		return 0, err
 	}
 
-	// chat chunk
-	if w.stream {
-		c := toChunk(w.id, chatResponse, w.toolCallSent)
-		d, err := json.Marshal(c)
-		if err != nil {
+	// prompt processing progress has no equivalent in the OpenAI API
+	if chatResponse.PromptEvalProgress != nil {
+		return len(data), nil
+	}
+
+	// the request ID has no equivalent in the OpenAI API, so it is sent as
+	// a header with the first chunk instead
+	if chatResponse.RequestID != "" {
+		w.ResponseWriter.Header().Set("X-Request-Id", chatResponse.RequestID)
+	}
+
+	if w.n > 1 {
+		if err := w.writeChoice(chatResponse); err != nil {
 			return 0, err
 		}
-		if !w.toolCallSent && len(c.Choices) > 0 && len(c.Choices[0].Delta.ToolCalls) > 0 {
+		return len(data), nil
+	}
+
+	// chat chunk
+	if w.stream {
+		chunks := toChunk(w.id, chatResponse, w.toolCallSent)
+		if len(chatResponse.Message.ToolCalls) > 0 {
 			w.toolCallSent = true
 		}
 
-		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
-		_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
-		if err != nil {
-			return 0, err
+		w.ResponseWriter.Header().Set("Content-Type", sse.ContentType)
+		for _, c := range chunks {
+			d, err := json.Marshal(c)
+			if err != nil {
+				return 0, err
+			}
+
+			err = sse.Write(w.ResponseWriter, d)
+			if err != nil {
+				return 0, err
+			}
 		}
 
 		if chatResponse.Done {
+			c := chunks[len(chunks)-1]
 			if w.streamOptions != nil && w.streamOptions.IncludeUsage {
 				u := toUsage(chatResponse)
 				c.Usage = &u
@@ -664,12 +1042,12 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 				if err != nil {
 					return 0, err
 				}
-				_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
+				err = sse.Write(w.ResponseWriter, d)
 				if err != nil {
 					return 0, err
 				}
 			}
-			_, err = w.ResponseWriter.Write([]byte("data: [DONE]\n\n"))
+			err = sse.WriteDone(w.ResponseWriter)
 			if err != nil {
 				return 0, err
 			}
@@ -688,6 +1066,109 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 	return len(data), nil
 }
 
+// writeChoice writes a response to a request for more than one choice
+func (w *ChatWriter) writeChoice(r api.ChatResponse) error {
+	if r.Done {
+		addChoiceUsage(&w.usage, r.Index, r.Metrics)
+		w.last = &r
+	}
+
+	if !w.stream {
+		// the request was only streamed to tell the choices apart, so each
+		// is combined into one response like a non-streamed request
+		w.ResponseWriter.Header().Set("Content-Type", "application/json")
+		for len(w.responses) <= r.Index {
+			w.responses = append(w.responses, api.ChatResponse{})
+		}
+
+		choice := &w.responses[r.Index]
+		content := choice.Message.Content + r.Message.Content
+		thinking := choice.Message.Thinking + r.Message.Thinking
+		toolCalls := append(choice.Message.ToolCalls, r.Message.ToolCalls...)
+		*choice = r
+		choice.Message.Content, choice.Message.Thinking, choice.Message.ToolCalls = content, thinking, toolCalls
+		return nil
+	}
+
+	if r.Index != w.index {
+		w.index, w.toolCallSent = r.Index, false
+	}
+
+	chunks := toChunk(w.id, r, w.toolCallSent)
+	if len(r.Message.ToolCalls) > 0 {
+		w.toolCallSent = true
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", sse.ContentType)
+	for _, c := range chunks {
+		c.Choices[0].Index = r.Index
+		d, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+
+		if err := sse.Write(w.ResponseWriter, d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finish writes what's held back from a response to a request for more than
+// one choice once every choice is done
+func (w *ChatWriter) finish() error {
+	if w.n <= 1 || w.last == nil || w.ResponseWriter.Status() != http.StatusOK {
+		return nil
+	}
+
+	if !w.stream {
+		completion := toChatCompletion(w.id, *w.last)
+		completion.Choices = nil
+		for i, r := range w.responses {
+			choice := toChatCompletion(w.id, r).Choices[0]
+			choice.Index = i
+			completion.Choices = append(completion.Choices, choice)
+		}
+		completion.Usage = w.usage
+
+		return json.NewEncoder(w.ResponseWriter).Encode(completion)
+	}
+
+	if w.streamOptions != nil && w.streamOptions.IncludeUsage {
+		d, err := json.Marshal(ChatCompletionChunk{
+			Id:                w.id,
+			Object:            "chat.completion.chunk",
+			Created:           time.Now().Unix(),
+			Model:             w.last.Model,
+			SystemFingerprint: systemFingerprint(w.last.Fingerprint),
+			Choices:           []ChunkChoice{},
+			Usage:             &w.usage,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := sse.Write(w.ResponseWriter, d); err != nil {
+			return err
+		}
+	}
+
+	err := sse.WriteDone(w.ResponseWriter)
+	return err
+}
+
+// addChoiceUsage adds the tokens of the final response of a choice to the
+// usage of the request. The prompt is only counted once since every choice
+// shares it.
+func addChoiceUsage(u *Usage, index int, m api.Metrics) {
+	if index == 0 {
+		u.PromptTokens = m.PromptEvalCount
+	}
+	u.CompletionTokens += m.EvalCount
+	u.TotalTokens = u.PromptTokens + u.CompletionTokens
+}
+
 func (w *ChatWriter) Write(data []byte) (int, error) {
 	code := w.ResponseWriter.Status()
 	if code != http.StatusOK {
@@ -704,19 +1185,34 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 		return 0, err
 	}
 
+	if generateResponse.PromptEvalProgress != nil {
+		return len(data), nil
+	}
+
+	// the request ID has no equivalent in the OpenAI API, so it is sent as
+	// a header with the first chunk instead
+	if generateResponse.RequestID != "" {
+		w.ResponseWriter.Header().Set("X-Request-Id", generateResponse.RequestID)
+	}
+
+	if w.n > 1 {
+		if err := w.writeChoice(generateResponse); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
 	// completion chunk
 	if w.stream {
+		// the usage is only sent in a chunk of its own once the response is done
 		c := toCompleteChunk(w.id, generateResponse)
-		if w.streamOptions != nil && w.streamOptions.IncludeUsage {
-			c.Usage = &Usage{}
-		}
 		d, err := json.Marshal(c)
 		if err != nil {
 			return 0, err
 		}
 
-		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
-		_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
+		w.ResponseWriter.Header().Set("Content-Type", sse.ContentType)
+		err = sse.Write(w.ResponseWriter, d)
 		if err != nil {
 			return 0, err
 		}
@@ -730,12 +1226,12 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 				if err != nil {
 					return 0, err
 				}
-				_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
+				err = sse.Write(w.ResponseWriter, d)
 				if err != nil {
 					return 0, err
 				}
 			}
-			_, err = w.ResponseWriter.Write([]byte("data: [DONE]\n\n"))
+			err = sse.WriteDone(w.ResponseWriter)
 			if err != nil {
 				return 0, err
 			}
@@ -754,6 +1250,83 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 	return len(data), nil
 }
 
+// writeChoice writes a response to a request for more than one choice
+func (w *CompleteWriter) writeChoice(r api.GenerateResponse) error {
+	if r.Done {
+		addChoiceUsage(&w.usage, r.Index, r.Metrics)
+		w.last = &r
+	}
+
+	if !w.stream {
+		// the request was only streamed to tell the choices apart, so each
+		// is combined into one response like a non-streamed request
+		w.ResponseWriter.Header().Set("Content-Type", "application/json")
+		for len(w.responses) <= r.Index {
+			w.responses = append(w.responses, api.GenerateResponse{})
+		}
+
+		choice := &w.responses[r.Index]
+		text := choice.Response + r.Response
+		*choice = r
+		choice.Response = text
+		return nil
+	}
+
+	c := toCompleteChunk(w.id, r)
+	c.Choices[0].Index = r.Index
+	d, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", sse.ContentType)
+	err = sse.Write(w.ResponseWriter, d)
+	return err
+}
+
+// finish writes what's held back from a response to a request for more than
+// one choice once every choice is done
+func (w *CompleteWriter) finish() error {
+	if w.n <= 1 || w.last == nil || w.ResponseWriter.Status() != http.StatusOK {
+		return nil
+	}
+
+	if !w.stream {
+		completion := toCompletion(w.id, *w.last)
+		completion.Choices = nil
+		for i, r := range w.responses {
+			choice := toCompletion(w.id, r).Choices[0]
+			choice.Index = i
+			completion.Choices = append(completion.Choices, choice)
+		}
+		completion.Usage = w.usage
+
+		return json.NewEncoder(w.ResponseWriter).Encode(completion)
+	}
+
+	if w.streamOptions != nil && w.streamOptions.IncludeUsage {
+		d, err := json.Marshal(CompletionChunk{
+			Id:                w.id,
+			Object:            "text_completion",
+			Created:           time.Now().Unix(),
+			Model:             w.last.Model,
+			SystemFingerprint: systemFingerprint(w.last.Fingerprint),
+			Choices:           []CompleteChunkChoice{},
+			Usage:             &w.usage,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := sse.Write(w.ResponseWriter, d); err != nil {
+			return err
+		}
+	}
+
+	err := sse.WriteDone(w.ResponseWriter)
+	return err
+}
+
 func (w *CompleteWriter) Write(data []byte) (int, error) {
 	code := w.ResponseWriter.Status()
 	if code != http.StatusOK {
@@ -902,9 +1475,16 @@ func CompletionsMiddleware() gin.HandlerFunc {
 			id:            fmt.Sprintf("cmpl-%d", rand.Intn(999)),
 			streamOptions: req.StreamOptions,
 		}
+		if req.N != nil {
+			w.n = *req.N
+		}
 
 		c.Writer = w
 		c.Next()
+
+		if err := w.finish(); err != nil {
+			slog.Error("failed to write completion choices", "error", err)
+		}
 	}
 }
 
@@ -932,7 +1512,7 @@ func EmbeddingsMiddleware() gin.HandlerFunc {
 		}
 
 		var b bytes.Buffer
-		if err := json.NewEncoder(&b).Encode(api.EmbedRequest{Model: req.Model, Input: req.Input}); err != nil {
+		if err := json.NewEncoder(&b).Encode(api.EmbedRequest{Model: req.Model, Input: req.Input, Dimensions: req.Dimensions}); err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
 			return
 		}
@@ -966,7 +1546,7 @@ func ChatMiddleware() gin.HandlerFunc {
 
 		var b bytes.Buffer
 
-		chatReq, err := fromChatRequest(req)
+		chatReq, err := fromChatRequest(c.Request.Context(), req)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
 			return
@@ -985,9 +1565,16 @@ func ChatMiddleware() gin.HandlerFunc {
 			id:            fmt.Sprintf("chatcmpl-%d", rand.Intn(999)),
 			streamOptions: req.StreamOptions,
 		}
+		if req.N != nil {
+			w.n = *req.N
+		}
 
 		c.Writer = w
 
 		c.Next()
+
+		if err := w.finish(); err != nil {
+			slog.Error("failed to write chat completion choices", "error", err)
+		}
 	}
 }
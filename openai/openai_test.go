@@ -4,10 +4,14 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"reflect"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -16,6 +20,7 @@ import (
 	"github.com/google/go-cmp/cmp"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/publicnet"
 )
 
 const (
@@ -74,6 +79,36 @@ func TestChatMiddleware(t *testing.T) {
 				Stream: &False,
 			},
 		},
+		{
+			name: "chat handler with names",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "name": "alice", "content": "Hello"},
+					{"role": "user", "name": "bob", "content": "Hi"}
+				]
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Name:    "alice",
+						Content: "Hello",
+					},
+					{
+						Role:    "user",
+						Name:    "bob",
+						Content: "Hi",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+			},
+		},
 		{
 			name: "chat handler with options",
 			body: `{
@@ -89,6 +124,8 @@ func TestChatMiddleware(t *testing.T) {
 				"frequency_penalty": 4.0,
 				"presence_penalty":  5.0,
 				"top_p":             6.0,
+				"min_p":             0.5,
+				"logit_bias":        {"1234": -100, "42": 2.5},
 				"response_format":   {"type": "json_object"}
 			}`,
 			req: api.ChatRequest{
@@ -107,6 +144,8 @@ func TestChatMiddleware(t *testing.T) {
 					"frequency_penalty": 4.0,
 					"presence_penalty":  5.0,
 					"top_p":             6.0,
+					"min_p":             0.5,
+					"logit_bias":        map[string]any{"1234": -100.0, "42": 2.5},
 				},
 				Format: json.RawMessage(`"json"`),
 				Stream: &True,
@@ -197,6 +236,72 @@ func TestChatMiddleware(t *testing.T) {
 				Stream: &False,
 			},
 		},
+		{
+			name: "chat handler with image detail",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{
+						"role": "user",
+						"content": [
+							{
+								"type": "image_url",
+								"image_url": {
+									"url": "` + prefix + image + `",
+									"detail": "low"
+								}
+							}
+						]
+					}
+				]
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role: "user",
+						Images: []api.ImageData{
+							func() []byte {
+								img, _ := base64.StdEncoding.DecodeString(image)
+								return img
+							}(),
+						},
+					},
+				},
+				Options: map[string]any{
+					"image_detail": "low",
+					"temperature":  1.0,
+					"top_p":        1.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "chat handler with invalid image detail",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{
+						"role": "user",
+						"content": [
+							{
+								"type": "image_url",
+								"image_url": {
+									"url": "` + prefix + image + `",
+									"detail": "medium"
+								}
+							}
+						]
+					}
+				]
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: `invalid image detail "medium", must be one of low, high or auto`,
+					Type:    "invalid_request_error",
+				},
+			},
+		},
 		{
 			name: "chat handler with tools",
 			body: `{
@@ -319,6 +424,96 @@ func TestChatMiddleware(t *testing.T) {
 				Stream: &True,
 			},
 		},
+		{
+			name: "chat handler with reasoning",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"},
+					{"role": "assistant", "content": "Hi!", "reasoning_content": "They said hello"},
+					{"role": "user", "content": "How are you?"}
+				],
+				"reasoning_effort": "high"
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello"},
+					{Role: "assistant", Content: "Hi!", Thinking: "They said hello"},
+					{Role: "user", Content: "How are you?"},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+				Think:  &True,
+			},
+		},
+		{
+			name: "chat handler with reasoning effort none",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"reasoning_effort": "none"
+			}`,
+			req: api.ChatRequest{
+				Model:    "test-model",
+				Messages: []api.Message{{Role: "user", Content: "Hello"}},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+				Think:  &False,
+			},
+		},
+		{
+			name: "chat handler with json schema",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"response_format": {
+					"type": "json_schema",
+					"json_schema": {"name": "greeting", "strict": true, "schema": {"type":"object","properties":{"text":{"type":"string"}},"required":["text"]}}
+				}
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Format: json.RawMessage(`{"type":"object","properties":{"text":{"type":"string"}},"required":["text"]}`),
+				Stream: &False,
+			},
+		},
+		{
+			name: "chat handler with invalid reasoning effort",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"reasoning_effort": "maximal"
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: `invalid reasoning_effort "maximal", must be one of none, minimal, low, medium or high`,
+					Type:    "invalid_request_error",
+				},
+			},
+		},
 		{
 			name: "chat handler error forwarding",
 			body: `{
@@ -372,6 +567,721 @@ func TestChatMiddleware(t *testing.T) {
 	}
 }
 
+func TestToFormat(t *testing.T) {
+	// a property named like an unsupported keyword is allowed
+	strictSchema := `{"type": "object", "properties": {"name": {"type": "string", "minLength": 1}, "born": {"type": "string", "format": "date"}, "not": {"anyOf": [{"type": "integer", "minimum": 0}, {"$ref": "#/$defs/unknown"}]}}, "required": ["name"], "additionalProperties": false, "$defs": {"unknown": {"type": "null"}}}`
+
+	cases := []struct {
+		name   string
+		format string
+		want   string
+		err    string
+	}{
+		{name: "text", format: `{"type": "text"}`},
+		{name: "json object", format: `{"type": "json_object"}`, want: `"json"`},
+		{
+			name:   "json schema",
+			format: `{"type": "json_schema", "json_schema": {"name": "person", "schema": {"type": "object"}}}`,
+			want:   `{"type": "object"}`,
+		},
+		{
+			name:   "missing schema",
+			format: `{"type": "json_schema"}`,
+			err:    "response_format of type json_schema requires a json_schema with a schema",
+		},
+		{
+			name:   "unsupported keyword without strict",
+			format: `{"type": "json_schema", "json_schema": {"name": "person", "schema": {"type": "object", "minProperties": 1}}}`,
+			want:   `{"type": "object", "minProperties": 1}`,
+		},
+		{
+			name:   "strict",
+			format: `{"type": "json_schema", "json_schema": {"name": "person", "strict": true, "schema": ` + strictSchema + `}}`,
+			want:   strictSchema,
+		},
+		{
+			name:   "strict with unsupported keyword",
+			format: `{"type": "json_schema", "json_schema": {"name": "person", "strict": true, "schema": {"type": "object", "minProperties": 1}}}`,
+			err:    `json_schema "person" can't be strict: "minProperties" at # is not supported`,
+		},
+		{
+			name: "strict with nested unsupported keyword",
+			format: `{"type": "json_schema", "json_schema": {"name": "people", "strict": true, "schema": {
+				"type": "array",
+				"items": {"type": "object", "properties": {"tags": {"type": "array", "uniqueItems": true}}}
+			}}}`,
+			err: `json_schema "people" can't be strict: "uniqueItems" at #/items/properties/tags is not supported`,
+		},
+		{
+			name:   "strict with unsupported format",
+			format: `{"type": "json_schema", "json_schema": {"name": "site", "strict": true, "schema": {"anyOf": [{"type": "string", "format": "uri"}]}}}`,
+			err:    `json_schema "site" can't be strict: format "uri" at #/anyOf/0 is not supported`,
+		},
+		{
+			name:   "strict with external ref",
+			format: `{"type": "json_schema", "json_schema": {"name": "site", "strict": true, "schema": {"$ref": "https://example.com/site.json"}}}`,
+			err:    `json_schema "site" can't be strict: external $ref "https://example.com/site.json" at # is not supported`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var rf ResponseFormat
+			if err := json.Unmarshal([]byte(tt.format), &rf); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := toFormat(&rf)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("expected format %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDecodeImageURL(t *testing.T) {
+	png, _ := base64.StdEncoding.DecodeString(image)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.png":
+			w.Write(png)
+		case "/image.txt":
+			w.Write([]byte("not an image"))
+		case "/redirect":
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(png)
+	}))
+	defer internal.Close()
+
+	t.Setenv("OLLAMA_REMOTE_IMAGES", "1")
+
+	// the test servers listen on loopback, which is only allowed for srv
+	defer func(f func(netip.AddrPort) bool) { imageAddrAllowed = f }(imageAddrAllowed)
+	public := imageAddrAllowed
+	srvAddr := netip.MustParseAddrPort(srv.Listener.Addr().String())
+	imageAddrAllowed = func(addr netip.AddrPort) bool { return addr == srvAddr }
+
+	cases := []struct {
+		name string
+		url  string
+		err  string
+	}{
+		{name: "data url", url: prefix + image},
+		{name: "data url png", url: "data:image/png;base64," + image},
+		{name: "data url jpg", url: "data:image/jpg;base64," + image},
+		{name: "data url unsupported type", url: "data:image/gif;base64," + image, err: `unsupported image type "image/gif"; supported types are image/jpeg, image/png, image/webp`},
+		{name: "data url not base64", url: "data:image/png," + image, err: "invalid image input: data URL must be base64 encoded"},
+		{name: "remote", url: srv.URL + "/image.png"},
+		{name: "remote unsupported type", url: srv.URL + "/image.txt", err: `unsupported image type "text/plain; charset=utf-8"; supported types are image/jpeg, image/png, image/webp`},
+		{name: "remote not found", url: srv.URL + "/missing.png", err: "failed to fetch image: 404 Not Found"},
+		{name: "unsupported scheme", url: "ftp://example.com/image.png", err: "invalid image input: url must be a data URL or an http(s) URL"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			img, err := decodeImageURL(t.Context(), tc.url)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(img, png) {
+				t.Errorf("image did not match")
+			}
+		})
+	}
+
+	t.Run("remote too large", func(t *testing.T) {
+		defer func(n int64) { maxImageSize = n }(maxImageSize)
+		maxImageSize = int64(len(png)) - 1
+
+		_, err := decodeImageURL(t.Context(), srv.URL+"/image.png")
+		if err == nil || !strings.Contains(err.Error(), "image exceeds maximum size") {
+			t.Fatalf("expected size error, got %v", err)
+		}
+	})
+
+	t.Run("remote non-public address", func(t *testing.T) {
+		for _, url := range []string{
+			internal.URL + "/image.png",
+			srv.URL + "/redirect?to=" + internal.URL + "/image.png",
+		} {
+			_, err := decodeImageURL(t.Context(), url)
+			if !errors.Is(err, publicnet.ErrNotPublic) || !strings.Contains(err.Error(), "127.0.0.1") {
+				t.Errorf("%s: expected non-public address error, got %v", url, err)
+			}
+		}
+	})
+
+	t.Run("remote disabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_REMOTE_IMAGES", "")
+
+		_, err := decodeImageURL(t.Context(), srv.URL+"/image.png")
+		if !errors.Is(err, errRemoteImagesDisabled) {
+			t.Fatalf("expected %v, got %v", errRemoteImagesDisabled, err)
+		}
+	})
+
+	t.Run("public addresses", func(t *testing.T) {
+		cases := map[string]bool{
+			"93.184.215.14:443":         true,
+			"[2606:4700:4700::1111]:80": true,
+			"127.0.0.1:80":              false,
+			"10.0.0.1:80":               false,
+			"192.168.1.1:80":            false,
+			"169.254.169.254:80":        false,
+			"0.0.0.0:80":                false,
+			"0.1.2.3:80":                false,
+			"100.64.0.1:80":             false,
+			"100.127.255.254:80":        false,
+			"100.128.0.1:80":            true,
+			"198.18.0.1:80":             false,
+			"240.0.0.1:80":              false,
+			"255.255.255.255:80":        false,
+			"224.0.0.1:80":              false,
+			"[::]:80":                   false,
+			"[ff02::1]:80":              false,
+			"[::ffff:100.64.0.1]:80":    false,
+			"[::1]:80":                  false,
+			"[fd00::1]:80":              false,
+			"[fe80::1]:80":              false,
+			"[::ffff:127.0.0.1]:80":     false,
+		}
+
+		for addr, want := range cases {
+			if got := public(netip.MustParseAddrPort(addr)); got != want {
+				t.Errorf("%s: expected %v, got %v", addr, want, got)
+			}
+		}
+	})
+}
+
+func TestChatMiddlewareStreamToolCalls(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(ChatMiddleware())
+	router.Handle(http.MethodPost, "/api/chat", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		for _, r := range []api.ChatResponse{
+			{
+				Model: "test-model",
+				Message: api.Message{
+					Role: "assistant",
+					ToolCalls: []api.ToolCall{
+						{Function: api.ToolCallFunction{Index: 0, Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}},
+						{Function: api.ToolCallFunction{Index: 1, Name: "get_time", Arguments: api.ToolCallFunctionArguments{"timezone": "CET"}}},
+					},
+				},
+			},
+			{
+				Model:      "test-model",
+				Message:    api.Message{Role: "assistant"},
+				Done:       true,
+				DoneReason: "stop",
+			},
+		} {
+			bts, _ := json.Marshal(r)
+			c.Writer.Write(bts)
+		}
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{
+		"model": "test-model",
+		"messages": [{"role": "user", "content": "What's the weather and time in Paris?"}],
+		"stream": true
+	}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	var deltas []Message
+	var finishReasons []*string
+	for _, line := range strings.Split(resp.Body.String(), "\n\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range chunk.Choices[0].Delta.ToolCalls {
+			tc := &chunk.Choices[0].Delta.ToolCalls[i]
+			if tc.Function.Name != "" && !strings.HasPrefix(tc.ID, "call_") {
+				t.Errorf("expected tool call id, got %q", tc.ID)
+			}
+			tc.ID = ""
+		}
+
+		deltas = append(deltas, chunk.Choices[0].Delta)
+		finishReasons = append(finishReasons, chunk.Choices[0].FinishReason)
+	}
+
+	toolCall := func(index int, typ, name, arguments string) []ToolCall {
+		tc := ToolCall{Index: index, Type: typ}
+		tc.Function.Name = name
+		tc.Function.Arguments = arguments
+		return []ToolCall{tc}
+	}
+
+	expected := []Message{
+		{Role: "assistant", ToolCalls: toolCall(0, "function", "get_weather", "")},
+		{ToolCalls: toolCall(0, "", "", `{"location":"Paris"}`)},
+		{Role: "assistant", ToolCalls: toolCall(1, "function", "get_time", "")},
+		{ToolCalls: toolCall(1, "", "", `{"timezone":"CET"}`)},
+		{Role: "assistant", Content: ""},
+	}
+
+	if diff := cmp.Diff(expected, deltas); diff != "" {
+		t.Errorf("deltas did not match (-want +got):\n%s", diff)
+	}
+
+	for i, reason := range finishReasons {
+		if i < len(finishReasons)-1 {
+			if reason != nil {
+				t.Errorf("expected no finish reason on chunk %d, got %q", i, *reason)
+			}
+		} else if reason == nil || *reason != "tool_calls" {
+			t.Errorf("expected finish reason tool_calls on final chunk, got %v", reason)
+		}
+	}
+}
+
+func TestChatMiddlewareReasoning(t *testing.T) {
+	responses := []api.ChatResponse{
+		{Model: "test-model", Message: api.Message{Role: "assistant", Thinking: "Let me"}},
+		{Model: "test-model", Message: api.Message{Role: "assistant", Thinking: " think", Content: "The"}},
+		{Model: "test-model", Message: api.Message{Role: "assistant", Content: " answer"}},
+		{Model: "test-model", Message: api.Message{Role: "assistant"}, Done: true, DoneReason: "stop"},
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(ChatMiddleware())
+	router.Handle(http.MethodPost, "/api/chat", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		var req api.ChatRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			t.Fatal(err)
+		}
+
+		if *req.Stream {
+			for _, r := range responses {
+				bts, _ := json.Marshal(r)
+				c.Writer.Write(bts)
+			}
+			return
+		}
+
+		bts, _ := json.Marshal(api.ChatResponse{
+			Model:      "test-model",
+			Message:    api.Message{Role: "assistant", Thinking: "Let me think", Content: "The answer"},
+			Done:       true,
+			DoneReason: "stop",
+		})
+		c.Writer.Write(bts)
+	})
+
+	request := func(t *testing.T, stream bool) string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(fmt.Sprintf(`{
+			"model": "test-model",
+			"messages": [{"role": "user", "content": "What's the answer?"}],
+			"stream": %t
+		}`, stream)))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp.Body.String()
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		var deltas []Message
+		for _, line := range strings.Split(request(t, true), "\n\n") {
+			data, ok := strings.CutPrefix(line, "data: ")
+			if !ok || data == "[DONE]" {
+				continue
+			}
+
+			var chunk ChatCompletionChunk
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				t.Fatal(err)
+			}
+			deltas = append(deltas, chunk.Choices[0].Delta)
+		}
+
+		// thinking and content are sent in separate deltas, even when they
+		// arrive in the same response
+		expected := []Message{
+			{Role: "assistant", ReasoningContent: "Let me"},
+			{Role: "assistant", ReasoningContent: " think"},
+			{Role: "assistant", Content: "The"},
+			{Role: "assistant", Content: " answer"},
+			{Role: "assistant", Content: ""},
+		}
+
+		if diff := cmp.Diff(expected, deltas); diff != "" {
+			t.Errorf("deltas did not match (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("no stream", func(t *testing.T) {
+		var completion ChatCompletion
+		if err := json.Unmarshal([]byte(request(t, false)), &completion); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg := completion.Choices[0].Message; msg.ReasoningContent != "Let me think" || msg.Content != "The answer" {
+			t.Errorf("expected reasoning content and content apart, got %+v", msg)
+		}
+	})
+}
+
+func TestStreamIncludeUsage(t *testing.T) {
+	cases := []struct {
+		name       string
+		middleware gin.HandlerFunc
+		responses  []any
+		body       string
+	}{
+		{
+			name:       "chat",
+			middleware: ChatMiddleware(),
+			responses: []any{
+				api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant", Content: "Hello"}, Fingerprint: "fp_test"},
+				api.ChatResponse{
+					Model:       "test-model",
+					Message:     api.Message{Role: "assistant", Content: "!"},
+					Done:        true,
+					DoneReason:  "stop",
+					Fingerprint: "fp_test",
+					Metrics:     api.Metrics{PromptEvalCount: 5, EvalCount: 2},
+				},
+			},
+			body: `{"model": "test-model", "messages": [{"role": "user", "content": "Hi"}], "stream": true, "stream_options": {"include_usage": true}}`,
+		},
+		{
+			name:       "completions",
+			middleware: CompletionsMiddleware(),
+			responses: []any{
+				api.GenerateResponse{Model: "test-model", Response: "Hello", Fingerprint: "fp_test"},
+				api.GenerateResponse{
+					Model:       "test-model",
+					Response:    "!",
+					Done:        true,
+					DoneReason:  "stop",
+					Fingerprint: "fp_test",
+					Metrics:     api.Metrics{PromptEvalCount: 5, EvalCount: 2},
+				},
+			},
+			body: `{"model": "test-model", "prompt": "Hi", "stream": true, "stream_options": {"include_usage": true}}`,
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(tc.middleware)
+			router.Handle(http.MethodPost, "/", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+				for _, r := range tc.responses {
+					bts, _ := json.Marshal(r)
+					c.Writer.Write(bts)
+				}
+			})
+
+			req, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			var events []string
+			for _, line := range strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n") {
+				data, ok := strings.CutPrefix(line, "data: ")
+				if !ok {
+					t.Fatalf("unexpected line %q", line)
+				}
+				events = append(events, data)
+			}
+
+			if len(events) != len(tc.responses)+2 {
+				t.Fatalf("expected %d events, got %d: %v", len(tc.responses)+2, len(events), events)
+			}
+
+			if events[len(events)-1] != "[DONE]" {
+				t.Fatalf("expected stream to end with [DONE], got %q", events[len(events)-1])
+			}
+
+			var chunk struct {
+				Choices           []json.RawMessage `json:"choices"`
+				Usage             *Usage            `json:"usage"`
+				SystemFingerprint string            `json:"system_fingerprint"`
+			}
+
+			for _, e := range events[:len(events)-2] {
+				chunk.Usage = nil
+				if err := json.Unmarshal([]byte(e), &chunk); err != nil {
+					t.Fatal(err)
+				}
+
+				if chunk.SystemFingerprint != "fp_test" {
+					t.Errorf("expected system fingerprint fp_test, got %q", chunk.SystemFingerprint)
+				}
+
+				if len(chunk.Choices) != 1 {
+					t.Errorf("expected one choice in content chunk, got %d", len(chunk.Choices))
+				}
+
+				if chunk.Usage != nil {
+					t.Errorf("expected no usage in content chunk, got %+v", *chunk.Usage)
+				}
+			}
+
+			chunk.Usage = nil
+			if err := json.Unmarshal([]byte(events[len(events)-2]), &chunk); err != nil {
+				t.Fatal(err)
+			}
+
+			if chunk.Choices == nil || len(chunk.Choices) != 0 {
+				t.Errorf("expected empty choices in usage chunk, got %v", chunk.Choices)
+			}
+
+			if chunk.SystemFingerprint != "fp_test" {
+				t.Errorf("expected system fingerprint fp_test in usage chunk, got %q", chunk.SystemFingerprint)
+			}
+
+			want := Usage{PromptTokens: 5, CompletionTokens: 2, TotalTokens: 7}
+			if chunk.Usage == nil || *chunk.Usage != want {
+				t.Errorf("expected usage %+v, got %+v", want, chunk.Usage)
+			}
+		})
+
+		t.Run(tc.name+" without include_usage", func(t *testing.T) {
+			router := gin.New()
+			router.Use(tc.middleware)
+			router.Handle(http.MethodPost, "/", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+				for _, r := range tc.responses {
+					bts, _ := json.Marshal(r)
+					c.Writer.Write(bts)
+				}
+			})
+
+			body := strings.Replace(tc.body, `, "stream_options": {"include_usage": true}`, "", 1)
+			req, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			events := strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n")
+			if len(events) != len(tc.responses)+1 {
+				t.Fatalf("expected %d events, got %d: %v", len(tc.responses)+1, len(events), events)
+			}
+
+			for _, e := range events {
+				if strings.Contains(e, `"usage"`) {
+					t.Errorf("expected no usage without include_usage, got %s", e)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareN(t *testing.T) {
+	chat := []any{
+		api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant", Content: "Hel"}},
+		api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant", Content: "lo"}, Done: true, DoneReason: "stop", Metrics: api.Metrics{PromptEvalCount: 5, EvalCount: 2}},
+		api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant", Content: "Hi"}, Index: 1},
+		api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant", Content: "!"}, Index: 1, Done: true, DoneReason: "length", Metrics: api.Metrics{PromptEvalCount: 1, EvalCount: 2}},
+	}
+
+	generate := []any{
+		api.GenerateResponse{Model: "test-model", Response: "Hel"},
+		api.GenerateResponse{Model: "test-model", Response: "lo", Done: true, DoneReason: "stop", Metrics: api.Metrics{PromptEvalCount: 5, EvalCount: 2}},
+		api.GenerateResponse{Model: "test-model", Response: "Hi", Index: 1},
+		api.GenerateResponse{Model: "test-model", Response: "!", Index: 1, Done: true, DoneReason: "length", Metrics: api.Metrics{PromptEvalCount: 1, EvalCount: 2}},
+	}
+
+	cases := []struct {
+		name       string
+		middleware gin.HandlerFunc
+		responses  []any
+		body       string
+		stream     bool
+	}{
+		{
+			name:       "chat",
+			middleware: ChatMiddleware(),
+			responses:  chat,
+			body:       `{"model": "test-model", "messages": [{"role": "user", "content": "Hi"}], "n": 2}`,
+		},
+		{
+			name:       "chat stream",
+			middleware: ChatMiddleware(),
+			responses:  chat,
+			body:       `{"model": "test-model", "messages": [{"role": "user", "content": "Hi"}], "n": 2, "stream": true, "stream_options": {"include_usage": true}}`,
+			stream:     true,
+		},
+		{
+			name:       "completions",
+			middleware: CompletionsMiddleware(),
+			responses:  generate,
+			body:       `{"model": "test-model", "prompt": "Hi", "n": 2}`,
+		},
+		{
+			name:       "completions stream",
+			middleware: CompletionsMiddleware(),
+			responses:  generate,
+			body:       `{"model": "test-model", "prompt": "Hi", "n": 2, "stream": true, "stream_options": {"include_usage": true}}`,
+			stream:     true,
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(tc.middleware)
+			router.Handle(http.MethodPost, "/", func(c *gin.Context) {
+				var req struct {
+					Stream  *bool          `json:"stream"`
+					Options map[string]any `json:"options"`
+				}
+				if err := c.ShouldBindJSON(&req); err != nil {
+					t.Fatal(err)
+				}
+
+				// the choices are told apart by streaming
+				if req.Stream == nil || !*req.Stream {
+					t.Error("expected the request to be streamed")
+				}
+
+				if req.Options["n"] != float64(2) {
+					t.Errorf("expected option n to be 2, got %v", req.Options["n"])
+				}
+
+				c.Status(http.StatusOK)
+				for _, r := range tc.responses {
+					bts, _ := json.Marshal(r)
+					c.Writer.Write(bts)
+				}
+			})
+
+			req, _ := http.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			type choice struct {
+				Index        int     `json:"index"`
+				Text         string  `json:"text"`
+				Message      Message `json:"message"`
+				Delta        Message `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			}
+
+			var response struct {
+				Choices []choice `json:"choices"`
+				Usage   *Usage   `json:"usage"`
+			}
+
+			text := make(map[int]string)
+			finishReasons := make(map[int]string)
+			add := func(c choice) {
+				text[c.Index] += c.Text
+				if s, ok := c.Message.Content.(string); ok {
+					text[c.Index] += s
+				}
+				if s, ok := c.Delta.Content.(string); ok {
+					text[c.Index] += s
+				}
+				if c.FinishReason != nil {
+					finishReasons[c.Index] = *c.FinishReason
+				}
+			}
+
+			if tc.stream {
+				events := strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n")
+				if events[len(events)-1] != "data: [DONE]" || slices.Index(events, "data: [DONE]") != len(events)-1 {
+					t.Fatalf("expected the stream to end with a single [DONE], got %v", events)
+				}
+
+				for _, e := range events[:len(events)-1] {
+					response.Usage = nil
+					if err := json.Unmarshal([]byte(strings.TrimPrefix(e, "data: ")), &response); err != nil {
+						t.Fatal(err)
+					}
+
+					for _, c := range response.Choices {
+						add(c)
+					}
+				}
+			} else {
+				if ct := resp.Header().Get("Content-Type"); ct != "application/json" {
+					t.Errorf("expected content type application/json, got %q", ct)
+				}
+
+				if err := json.Unmarshal(resp.Body.Bytes(), &response); err != nil {
+					t.Fatal(err)
+				}
+
+				if len(response.Choices) != 2 || response.Choices[0].Index != 0 || response.Choices[1].Index != 1 {
+					t.Fatalf("expected choices 0 and 1, got %+v", response.Choices)
+				}
+
+				for _, c := range response.Choices {
+					add(c)
+				}
+			}
+
+			if diff := cmp.Diff(map[int]string{0: "Hello", 1: "Hi!"}, text); diff != "" {
+				t.Errorf("text mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(map[int]string{0: "stop", 1: "length"}, finishReasons); diff != "" {
+				t.Errorf("finish reasons mismatch (-want +got):\n%s", diff)
+			}
+
+			// the prompt is only counted once
+			want := Usage{PromptTokens: 5, CompletionTokens: 4, TotalTokens: 9}
+			if response.Usage == nil || *response.Usage != want {
+				t.Errorf("expected usage %+v, got %+v", want, response.Usage)
+			}
+		})
+	}
+}
+
 func TestCompletionsMiddleware(t *testing.T) {
 	type testCase struct {
 		name string
@@ -389,6 +1299,8 @@ func TestCompletionsMiddleware(t *testing.T) {
 				"model": "test-model",
 				"prompt": "Hello",
 				"temperature": 0.8,
+				"min_p": 0.25,
+				"logit_bias": {"1234": -100},
 				"stop": ["\n", "stop"],
 				"suffix": "suffix"
 			}`,
@@ -400,6 +1312,8 @@ func TestCompletionsMiddleware(t *testing.T) {
 					"presence_penalty":  0.0,
 					"temperature":       0.8,
 					"top_p":             1.0,
+					"min_p":             0.25,
+					"logit_bias":        map[string]any{"1234": -100.0},
 					"stop":              []any{"\n", "stop"},
 				},
 				Suffix: "suffix",
@@ -543,6 +1457,19 @@ func TestEmbeddingsMiddleware(t *testing.T) {
 				Model: "test-model",
 			},
 		},
+		{
+			name: "embed handler dimensions",
+			body: `{
+				"input": ["Hello", "World"],
+				"model": "test-model",
+				"dimensions": 256
+			}`,
+			req: api.EmbedRequest{
+				Input:      []any{"Hello", "World"},
+				Model:      "test-model",
+				Dimensions: 256,
+			},
+		},
 		{
 			name: "embed handler error forwarding",
 			body: `{
@@ -611,6 +1538,11 @@ func TestListMiddleware(t *testing.T) {
 							Name:       "test-model",
 							ModifiedAt: time.Unix(int64(1686935002), 0).UTC(),
 						},
+						{
+							Name:          "user/test-model:7b",
+							ModifiedAt:    time.Unix(int64(1686935002), 0).UTC(),
+							ContextLength: 8192,
+						},
 					},
 				})
 			},
@@ -622,6 +1554,13 @@ func TestListMiddleware(t *testing.T) {
 						"object": "model",
 						"created": 1686935002,
 						"owned_by": "library"
+					},
+					{
+						"id": "user/test-model:7b",
+						"object": "model",
+						"created": 1686935002,
+						"owned_by": "user",
+						"context_length": 8192
 					}
 				]
 			}`,
@@ -688,6 +1627,25 @@ func TestRetrieveMiddleware(t *testing.T) {
 				"owned_by":"library"}
 			`,
 		},
+		{
+			name: "retrieve handler with context length",
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusOK, api.ShowResponse{
+					ModifiedAt: time.Unix(int64(1686935002), 0).UTC(),
+					ModelInfo: map[string]any{
+						"general.architecture": "llama",
+						"llama.context_length": 131072,
+					},
+				})
+			},
+			resp: `{
+				"id":"test-model",
+				"object":"model",
+				"created":1686935002,
+				"owned_by":"library",
+				"context_length":131072}
+			`,
+		},
 		{
 			name: "retrieve handler error forwarding",
 			endpoint: func(c *gin.Context) {
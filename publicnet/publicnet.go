@@ -0,0 +1,63 @@
+// Package publicnet restricts connections the server makes on behalf of its
+// clients, such as to fetch an image URL or post a webhook, to addresses on
+// the internet, so that a client can't use them to reach the server's own
+// network.
+package publicnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// ErrNotPublic is the error of a connection refused by a [Dialer].
+var ErrNotPublic = errors.New("connection to a non-public address is not allowed")
+
+// nonPublicPrefixes are the ranges that aren't reachable on the internet but
+// that netip.Addr doesn't classify: "this network", the shared address space
+// of carrier-grade NAT, benchmarking and the reserved class E.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// Addr reports whether ip is a public address: a global unicast address that
+// isn't private or in one of the other ranges reserved for local use.
+// IPv4-mapped IPv6 addresses are treated as the IPv4 address they map.
+func Addr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+
+	return !slices.ContainsFunc(nonPublicPrefixes, func(p netip.Prefix) bool {
+		return p.Contains(ip)
+	})
+}
+
+// Dialer returns a dialer that only connects to the addresses allowed
+// accepts. They're checked after DNS resolution, for each address dialed, so
+// a host name can't resolve to an address that isn't allowed.
+func Dialer(timeout time.Duration, allowed func(netip.AddrPort) bool) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+
+			if !allowed(addr) {
+				return fmt.Errorf("%w: %s", ErrNotPublic, addr.Addr())
+			}
+
+			return nil
+		},
+	}
+}
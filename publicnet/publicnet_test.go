@@ -0,0 +1,80 @@
+package publicnet
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestAddr(t *testing.T) {
+	cases := map[string]bool{
+		"93.184.215.14":        true,
+		"2606:4700:4700::1111": true,
+		"100.128.0.1":          true,
+		"127.0.0.1":            false,
+		"10.0.0.1":             false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false,
+		"0.0.0.0":              false,
+		"0.1.2.3":              false,
+		"100.64.0.1":           false,
+		"100.127.255.254":      false,
+		"198.18.0.1":           false,
+		"240.0.0.1":            false,
+		"255.255.255.255":      false,
+		"224.0.0.1":            false,
+		"::":                   false,
+		"::1":                  false,
+		"fd00::1":              false,
+		"fe80::1":              false,
+		"ff02::1":              false,
+		"::ffff:127.0.0.1":     false,
+		"::ffff:100.64.0.1":    false,
+		"::ffff:93.184.215.14": true,
+	}
+
+	for addr, want := range cases {
+		if got := Addr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("%s: expected %v, got %v", addr, want, got)
+		}
+	}
+}
+
+func TestDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	allowed := netip.MustParseAddrPort(l.Addr().String())
+
+	t.Run("allowed", func(t *testing.T) {
+		d := Dialer(time.Second, func(addr netip.AddrPort) bool { return addr == allowed })
+		conn, err := d.DialContext(t.Context(), "tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		d := Dialer(time.Second, func(addr netip.AddrPort) bool { return Addr(addr.Addr()) })
+		_, err := d.DialContext(t.Context(), "tcp", l.Addr().String())
+		if !errors.Is(err, ErrNotPublic) {
+			t.Fatalf("expected %v, got %v", ErrNotPublic, err)
+		}
+	})
+}
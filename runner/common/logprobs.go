@@ -0,0 +1,73 @@
+package common
+
+import (
+	"math"
+	"sort"
+
+	"github.com/ollama/ollama/api"
+)
+
+// Logprobs returns the log probability of token under the distribution
+// given by logits, along with those of the top most likely tokens. decode
+// returns the text of a token. If raw is set, each token's logit is
+// included too.
+func Logprobs(logits []float32, token int, top int, raw bool, decode func(int) string) api.Logprob {
+	if token < 0 || token >= len(logits) {
+		return api.Logprob{TokenLogprob: api.TokenLogprob{ID: token, Token: decode(token)}}
+	}
+
+	// the log of the softmax's denominator, shifted by the largest logit
+	// so that the exponentials can't overflow
+	maxLogit := float64(logits[0])
+	for _, l := range logits[1:] {
+		maxLogit = max(maxLogit, float64(l))
+	}
+
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l) - maxLogit)
+	}
+	logSum := maxLogit + math.Log(sum)
+
+	tokenLogprob := func(id int) api.TokenLogprob {
+		lp := api.TokenLogprob{
+			ID:      id,
+			Token:   decode(id),
+			Logprob: float64(logits[id]) - logSum,
+		}
+
+		if raw {
+			logit := logits[id]
+			lp.Logit = &logit
+		}
+
+		return lp
+	}
+
+	lp := api.Logprob{TokenLogprob: tokenLogprob(token)}
+	if top <= 0 {
+		return lp
+	}
+
+	// the most likely tokens in order, highest logit first; most logits are
+	// lower than the lowest of these so are only compared once
+	ids := make([]int, 0, top+1)
+	for id, l := range logits {
+		if len(ids) == top && l <= logits[ids[top-1]] {
+			continue
+		}
+
+		i := sort.Search(len(ids), func(i int) bool { return logits[ids[i]] < l })
+		ids = append(ids, 0)
+		copy(ids[i+1:], ids[i:])
+		ids[i] = id
+		ids = ids[:min(len(ids), top)]
+	}
+
+	lp.TopLogprobs = make([]api.TokenLogprob, len(ids))
+	for i, id := range ids {
+		lp.TopLogprobs[i] = tokenLogprob(id)
+	}
+
+	return lp
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestLogprobs(t *testing.T) {
+	logits := []float32{1, 3, -2, 0.5, 3, 2}
+	decode := func(id int) string { return "t" + strconv.Itoa(id) }
+
+	// the log of the softmax's denominator
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l))
+	}
+	logSum := math.Log(sum)
+
+	t.Run("token", func(t *testing.T) {
+		lp := Logprobs(logits, 3, 0, false, decode)
+		if lp.ID != 3 || lp.Token != "t3" {
+			t.Errorf("expected token 3, got %d %q", lp.ID, lp.Token)
+		}
+
+		if want := 0.5 - logSum; math.Abs(lp.Logprob-want) > 1e-9 {
+			t.Errorf("expected log probability %v, got %v", want, lp.Logprob)
+		}
+
+		if lp.Logit != nil || lp.TopLogprobs != nil {
+			t.Errorf("expected no logit or top log probabilities, got %v and %v", lp.Logit, lp.TopLogprobs)
+		}
+	})
+
+	t.Run("top", func(t *testing.T) {
+		lp := Logprobs(logits, 3, 3, true, decode)
+
+		// ties are in order of token ID
+		want := []int{1, 4, 5}
+		if len(lp.TopLogprobs) != len(want) {
+			t.Fatalf("expected %d top log probabilities, got %d", len(want), len(lp.TopLogprobs))
+		}
+
+		for i, top := range lp.TopLogprobs {
+			if top.ID != want[i] || top.Token != decode(want[i]) {
+				t.Errorf("expected token %d at %d, got %d %q", want[i], i, top.ID, top.Token)
+			}
+		}
+
+		// the log probability of each token is its logit less the same
+		// normalizing constant
+		for _, top := range append(lp.TopLogprobs, lp.TokenLogprob) {
+			if top.Logit == nil || *top.Logit != logits[top.ID] {
+				t.Fatalf("expected token %d to have logit %v, got %v", top.ID, logits[top.ID], top.Logit)
+			}
+
+			if got := float64(*top.Logit) - top.Logprob; math.Abs(got-logSum) > 1e-9 {
+				t.Errorf("expected token %d's logit to exceed its log probability by %v, got %v", top.ID, logSum, got)
+			}
+		}
+	})
+
+	t.Run("top exceeds vocabulary", func(t *testing.T) {
+		lp := Logprobs(logits, 0, 10, false, decode)
+		if len(lp.TopLogprobs) != len(logits) {
+			t.Fatalf("expected %d top log probabilities, got %d", len(logits), len(lp.TopLogprobs))
+		}
+
+		var total float64
+		for i, top := range lp.TopLogprobs {
+			if i > 0 && top.Logprob > lp.TopLogprobs[i-1].Logprob {
+				t.Errorf("expected decreasing log probabilities, got %v after %v", top.Logprob, lp.TopLogprobs[i-1].Logprob)
+			}
+			total += math.Exp(top.Logprob)
+		}
+
+		if math.Abs(total-1) > 1e-9 {
+			t.Errorf("expected probabilities summing to 1, got %v", total)
+		}
+	})
+
+	t.Run("large logits", func(t *testing.T) {
+		lp := Logprobs([]float32{1000, 1000}, 0, 0, false, decode)
+		if math.Abs(lp.Logprob-math.Log(0.5)) > 1e-9 {
+			t.Errorf("expected log probability %v, got %v", math.Log(0.5), lp.Logprob)
+		}
+	})
+}
@@ -45,6 +45,16 @@ func NewInputCache(lc *llama.Context, kvSize int, numSlots int, multiUserCache b
 	}, nil
 }
 
+// Usage returns the number of inputs stored in the cache across all slots and
+// the total number of inputs the cache can hold
+func (c *InputCache) Usage() (used, total int) {
+	for _, s := range c.slots {
+		used += len(s.Inputs)
+	}
+
+	return used, c.numCtx * len(c.slots)
+}
+
 // Locking: Operations on InputCacheSlot (including finding one
 // through LoadCacheSlot) require a lock to be be held that serializes
 // these operations with each other and llama.Decode
@@ -56,6 +66,15 @@ type InputCacheSlot struct {
 	// Inputs that are stored in the KV cache
 	Inputs []input
 
+	// path of the LoRA adapter the inputs were processed with, empty
+	// if all of the model's adapters were applied
+	Adapter string
+
+	// number of inputs at the start of Inputs that form a system prompt
+	// retained for later requests. Slots that would lose it are only used
+	// when there is no other choice.
+	Pinned int
+
 	// is this cache actively being processed as part of a sequence?
 	InUse bool
 
@@ -63,7 +82,10 @@ type InputCacheSlot struct {
 	lastUsed time.Time
 }
 
-func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCacheSlot, []input, error) {
+// LoadCacheSlot finds a slot for prompt and returns the inputs that still need
+// to be processed. The first pinned inputs of prompt form a system prompt to
+// retain in the slot for later requests.
+func (c *InputCache) LoadCacheSlot(prompt []input, adapter string, cachePrompt bool, pinned int) (*InputCacheSlot, []input, error) {
 	var slot *InputCacheSlot
 	var numPast int
 	var err error
@@ -75,9 +97,9 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 	// at the cost of worse performance when we miss the input cache (because it causes
 	// GPU L2 cache misses due to spreading out accesses across VRAM).
 	if !c.multiUserCache {
-		slot, numPast, err = c.findLongestCacheSlot(prompt)
+		slot, numPast, err = c.findLongestCacheSlot(prompt, adapter)
 	} else {
-		slot, numPast, err = c.findBestCacheSlot(prompt)
+		slot, numPast, err = c.findBestCacheSlot(prompt, adapter)
 	}
 	if err != nil {
 		return nil, nil, err
@@ -89,6 +111,7 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 
 	slot.InUse = true
 	slot.lastUsed = time.Now()
+	slot.Adapter = adapter
 
 	if numPast == len(prompt) {
 		// Leave one input to sample so we can get a response
@@ -104,13 +127,19 @@ func (c *InputCache) LoadCacheSlot(prompt []input, cachePrompt bool) (*InputCach
 	slog.Debug("loading cache slot", "id", slot.Id, "cache", len(slot.Inputs), "prompt", len(prompt),
 		"used", numPast, "remaining", len(prompt)-numPast)
 
+	if !slot.keepsPinned(numPast) {
+		slog.Debug("dropping retained system prompt", "id", slot.Id, "inputs", slot.Pinned)
+		slot.Pinned = 0
+	}
+	slot.Pinned = max(slot.Pinned, pinned)
+
 	slot.Inputs = prompt[:numPast]
 	prompt = prompt[numPast:]
 
 	return slot, prompt, nil
 }
 
-func (c *InputCache) findLongestCacheSlot(prompt []input) (*InputCacheSlot, int, error) {
+func (c *InputCache) findLongestCacheSlot(prompt []input, adapter string) (*InputCacheSlot, int, error) {
 	longest := -1
 	var longestSlot *InputCacheSlot
 
@@ -120,7 +149,12 @@ func (c *InputCache) findLongestCacheSlot(prompt []input) (*InputCacheSlot, int,
 		}
 
 		count := countCommonPrefix(s.Inputs, prompt)
-		if count > longest {
+		if s.Adapter != adapter {
+			// the cached inputs were processed with different weights
+			count = 0
+		}
+
+		if count > longest || count == longest && !longestSlot.keepsPinned(longest) && s.keepsPinned(count) {
 			longest = count
 			longestSlot = &c.slots[i]
 		}
@@ -133,8 +167,7 @@ func (c *InputCache) findLongestCacheSlot(prompt []input) (*InputCacheSlot, int,
 	return longestSlot, longest, nil
 }
 
-func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, error) {
-	oldest := time.Now()
+func (c *InputCache) findBestCacheSlot(prompt []input, adapter string) (*InputCacheSlot, int, error) {
 	var oldestSlot *InputCacheSlot
 
 	longest := -1
@@ -142,13 +175,16 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, er
 
 	for i, s := range c.slots {
 		count := countCommonPrefix(s.Inputs, prompt)
+		if s.Adapter != adapter {
+			count = 0
+		}
+
 		if count > longest {
 			longest = count
 			longestSlot = &c.slots[i]
 		}
 
-		if s.lastUsed.Compare(oldest) < 0 && !s.InUse {
-			oldest = s.lastUsed
+		if !s.InUse && (oldestSlot == nil || evictBefore(&c.slots[i], oldestSlot)) {
 			oldestSlot = &c.slots[i]
 		}
 	}
@@ -157,7 +193,7 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, er
 		return longestSlot, longest, nil
 	}
 
-	if oldestSlot.InUse {
+	if oldestSlot == nil {
 		return nil, 0, errors.New("no available cache slots")
 	}
 
@@ -181,6 +217,23 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, er
 	return oldestSlot, longest, nil
 }
 
+// keepsPinned reports whether reusing count inputs of the slot keeps its
+// retained system prompt
+func (s *InputCacheSlot) keepsPinned(count int) bool {
+	return count >= s.Pinned
+}
+
+// evictBefore reports whether slot a should be evicted before slot b, which
+// is the least recently used one unless only one of them retains a system
+// prompt
+func evictBefore(a, b *InputCacheSlot) bool {
+	if (a.Pinned > 0) != (b.Pinned > 0) {
+		return a.Pinned == 0
+	}
+
+	return a.lastUsed.Before(b.lastUsed)
+}
+
 func countCommonPrefix(a []input, b []input) int {
 	var count int
 
@@ -272,6 +325,8 @@ func (c *InputCache) ShiftCacheSlot(slot *InputCacheSlot, numKeep int) error {
 	}
 
 	// Standard shift succeeded - update input array
+	slot.Pinned = min(slot.Pinned, numKeep)
+
 	for i := numKeep + discard; i < inputLen; i++ {
 		slot.Inputs[i-discard] = slot.Inputs[i]
 	}
@@ -76,6 +76,7 @@ func TestFindCacheSlot(t *testing.T) {
 		name    string
 		cache   InputCache
 		prompt  []input
+		adapter string
 		longest expected
 		best    expected
 	}{
@@ -201,11 +202,53 @@ func TestFindCacheSlot(t *testing.T) {
 			longest: expected{result: 1, len: 1},
 			best:    expected{result: 1, len: 2},
 		},
+		{
+			name: "Adapter",
+			cache: InputCache{slots: []InputCacheSlot{
+				{
+					Id:       0,
+					Inputs:   []input{{token: 1}, {token: 2}},
+					Adapter:  "sql.gguf",
+					InUse:    false,
+					lastUsed: time.Now().Add(-time.Second),
+				},
+				{
+					Id:       1,
+					Inputs:   []input{{token: 1}},
+					InUse:    false,
+					lastUsed: time.Now().Add(-2 * time.Second),
+				},
+			}},
+			prompt:  []input{{token: 1}, {token: 2}},
+			longest: expected{result: 1, len: 1},
+			best:    expected{result: 1, len: 1},
+		},
+		{
+			name: "Pinned",
+			cache: InputCache{slots: []InputCacheSlot{
+				{
+					Id:       0,
+					Inputs:   []input{{token: 1}, {token: 2}},
+					Pinned:   2,
+					InUse:    false,
+					lastUsed: time.Now().Add(-2 * time.Second),
+				},
+				{
+					Id:       1,
+					Inputs:   []input{{token: 3}},
+					InUse:    false,
+					lastUsed: time.Now().Add(-time.Second),
+				},
+			}},
+			prompt:  []input{{token: 4}},
+			longest: expected{result: 1, len: 0},
+			best:    expected{result: 1, len: 0},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run("Longest-"+tt.name, func(t *testing.T) {
-			result, resultLen, err := tt.cache.findLongestCacheSlot(tt.prompt)
+			result, resultLen, err := tt.cache.findLongestCacheSlot(tt.prompt, tt.adapter)
 			if err != nil {
 				t.Errorf("findLongestCacheSlot: err %v", err)
 			} else if result.Id != tt.longest.result || resultLen != tt.longest.len {
@@ -217,7 +260,7 @@ func TestFindCacheSlot(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run("Best-"+tt.name, func(t *testing.T) {
-			result, resultLen, err := tt.cache.findBestCacheSlot(tt.prompt)
+			result, resultLen, err := tt.cache.findBestCacheSlot(tt.prompt, tt.adapter)
 			if err != nil {
 				t.Errorf("findBestCacheSlot: err %v", err)
 			} else if result.Id != tt.best.result || resultLen != tt.best.len {
@@ -13,9 +13,11 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -54,11 +56,24 @@ type Sequence struct {
 	// tokens that have been generated but not returned yet (e.g. for stop sequences)
 	pendingResponses []string
 
+	// log probabilities of the tokens in pendingResponses, if requested
+	pendingLogprobs []api.Logprob
+
+	// times since processing started that the tokens in pendingResponses
+	// were sampled, if tokenTimings is set
+	pendingTimings []time.Duration
+
 	// input cache being used by this sequence
 	cache *InputCacheSlot
 
+	// path of the LoRA adapter to apply, empty to apply all adapters
+	adapter string
+
 	// channel to send responses over
-	responses chan string
+	responses chan response
+
+	// channel to report the number of prompt inputs processed so far
+	progress chan int
 
 	// channel to stop decoding (such as if the remote connection is closed)
 	quit chan bool
@@ -71,9 +86,15 @@ type Sequence struct {
 	// channel to send back the embedding if embedding only
 	embedding chan []float32
 
+	// embeddings of the inputs decoded so far if returning token embeddings
+	tokenEmbeddings []float32
+
 	// stop sequences
 	stop []string
 
+	// token IDs that end generation as soon as one is sampled
+	stopTokens []int
+
 	// number of inputs to keep at the beginning when shifting context window
 	numKeep int
 
@@ -82,11 +103,40 @@ type Sequence struct {
 
 	doneReason llm.DoneReason
 
+	// stopSequence is the stop sequence that ended generation, if any
+	stopSequence string
+
+	// stopToken is the text of the token that ended generation, if any
+	stopToken string
+
 	// Metrics
 	startProcessingTime time.Time
 	startGenerationTime time.Time
 	numDecoded          int
 	numPromptInputs     int
+	numCachedInputs     int
+
+	// number of prompt inputs that form a system prompt retained in the cache
+	numPinnedInputs int
+
+	// rawBytes returns the text of each token as it is generated, even if it
+	// ends part way through a UTF-8 character
+	rawBytes bool
+
+	// returnLogits keeps the logits that each token is sampled from, so
+	// those of the last one can be returned with the final response
+	returnLogits bool
+	logits       []float32
+
+	// logprobs returns the log probability of each generated token, with
+	// those of the topLogprobs most likely tokens, and their logits if
+	// rawLogits is set
+	logprobs    bool
+	topLogprobs int
+	rawLogits   bool
+
+	// tokenTimings returns the time each generated token was sampled
+	tokenTimings bool
 }
 
 type NewSequenceParams struct {
@@ -95,6 +145,32 @@ type NewSequenceParams struct {
 	numKeep        int
 	samplingParams *llama.SamplingParams
 	embedding      bool
+	adapter        string
+
+	// skipSpecialTokens tokenizes the prompt without inserting a BOS token
+	skipSpecialTokens bool
+
+	// rawBytes returns token text without holding back partial UTF-8 characters
+	rawBytes bool
+
+	// returnLogits returns the logits of the last token with the final response
+	returnLogits bool
+
+	// logprobs returns the log probability of each generated token and of
+	// the topLogprobs most likely tokens, with their logits if rawLogits
+	logprobs    bool
+	topLogprobs int
+	rawLogits   bool
+
+	// tokenTimings returns the time each generated token was sampled
+	tokenTimings bool
+
+	// stopTokens are token IDs that end generation without their text
+	stopTokens []int
+
+	// addBOS and addEOS force the BOS and EOS tokens in or out of the
+	// prompt, overriding the tokenizer and skipSpecialTokens, if set
+	addBOS, addEOS *bool
 }
 
 func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -102,7 +178,11 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 
 	startTime := time.Now()
 
-	inputs, err := s.inputs(prompt, images)
+	if params.adapter != "" && !slices.ContainsFunc(s.loras, func(l loraAdapter) bool { return l.path == params.adapter }) {
+		return nil, fmt.Errorf("adapter %q is not loaded", params.adapter)
+	}
+
+	inputs, addBOS, err := s.promptInputs(prompt, images, params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to process inputs: %w", err)
 	} else if len(inputs) == 0 {
@@ -113,7 +193,7 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		params.numKeep = len(inputs)
 	}
 
-	if s.model.AddBOSToken() {
+	if addBOS {
 		params.numKeep += 1
 	}
 
@@ -148,20 +228,94 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		startProcessingTime: startTime,
 		numPredict:          params.numPredict,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		responses:           make(chan response, 100),
+		progress:            make(chan int, 1),
 		quit:                make(chan bool, 1),
 		embedding:           make(chan []float32, 1),
 		samplingCtx:         sc,
 		embeddingOnly:       params.embedding,
 		stop:                params.stop,
+		stopTokens:          params.stopTokens,
 		numKeep:             params.numKeep,
+		adapter:             params.adapter,
+		rawBytes:            params.rawBytes,
+		returnLogits:        params.returnLogits,
+		logprobs:            params.logprobs,
+		topLogprobs:         params.topLogprobs,
+		rawLogits:           params.rawLogits,
+		tokenTimings:        params.tokenTimings,
 	}, nil
 }
 
+// reportProgress sends the number of prompt inputs processed so far, replacing
+// any update the client has not received yet so that prompt processing never
+// blocks on a slow reader.
+func (seq *Sequence) reportProgress() {
+	select {
+	case <-seq.progress:
+	default:
+	}
+
+	seq.progress <- seq.numPromptInputs - len(seq.inputs)
+}
+
+// pinnedInputs returns the number of inputs of seq that come from the first
+// n bytes of prompt, the system prompt to retain in the cache
+func (s *Server) pinnedInputs(seq *Sequence, prompt string, n int, addSpecial bool) int {
+	if n <= 0 {
+		return 0
+	}
+
+	prefix, err := s.inputs(prompt[:min(n, len(prompt))], nil, addSpecial)
+	if err != nil {
+		slog.Warn("unable to retain system prompt in cache", "error", err)
+		return 0
+	}
+
+	return countCommonPrefix(prefix, seq.inputs)
+}
+
+// promptInputs processes the prompt of a new sequence into inputs, inserting
+// the BOS and EOS tokens as params asks. It also reports whether BOS is
+// inserted.
+func (s *Server) promptInputs(prompt string, images []llm.ImageData, params NewSequenceParams) ([]input, bool, error) {
+	addBOS := s.model.AddBOSToken() && !params.skipSpecialTokens
+	if params.addBOS == nil && params.addEOS == nil {
+		inputs, err := s.inputs(prompt, images, !params.skipSpecialTokens)
+		return inputs, addBOS, err
+	}
+
+	inputs, err := s.inputs(prompt, images, false)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if params.addBOS != nil {
+		addBOS = *params.addBOS
+	}
+
+	addEOS := s.model.AddEOSToken() && !params.skipSpecialTokens
+	if params.addEOS != nil {
+		addEOS = *params.addEOS
+	}
+
+	if bos := s.model.TokenBOS(); addBOS && bos >= 0 {
+		inputs = append([]input{{token: bos}}, inputs...)
+	}
+
+	if eos := s.model.TokenEOS(); addEOS && eos >= 0 {
+		inputs = append(inputs, input{token: eos})
+	}
+
+	return inputs, addBOS, nil
+}
+
 // inputs processes the prompt and images into a list of inputs
 // by splitting the prompt on [img-<n>] tags, tokenizing text and
-// generating image embeddings for each image
-func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input, error) {
+// generating image embeddings for each image. addSpecial adds the special
+// tokens, such as BOS, that the model's tokenizer inserts at the start of
+// the prompt.
+func (s *Server) inputs(prompt string, images []llm.ImageData, addSpecial bool) ([]input, error) {
 	var inputs []input
 	var parts []string
 	var matches [][]string
@@ -176,7 +330,7 @@ func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input, error)
 
 	for i, part := range parts {
 		// text - tokenize
-		tokens, err := s.lc.Model().Tokenize(part, i == 0, true)
+		tokens, err := s.lc.Model().Tokenize(part, addSpecial && i == 0, true)
 		if err != nil {
 			return nil, err
 		}
@@ -226,6 +380,9 @@ type Server struct {
 	// image model context for multi-modal models
 	image *ImageContext
 
+	// LoRA adapters loaded for the model
+	loras []loraAdapter
+
 	// status for external health reporting - loading, ready to serve, etc.
 	status llm.ServerStatus
 
@@ -239,6 +396,16 @@ type Server struct {
 	// TODO (jmorganca): make this n_batch
 	batchSize int
 
+	// tokenEmbeddings is true if embeddings are returned for every token of
+	// the input rather than pooled
+	tokenEmbeddings bool
+
+	// contextUsed and contextTotal are the inputs stored in the cache and
+	// the number it can hold. They are updated after each batch so that
+	// health checks don't wait for the lock held while a batch decodes.
+	contextUsed  atomic.Int64
+	contextTotal atomic.Int64
+
 	// protects access to everything below this line
 	// this is context state needed for decoding
 	mu sync.Mutex
@@ -249,6 +416,10 @@ type Server struct {
 	// decoding state
 	lc *llama.Context
 
+	// path of the adapter currently applied to lc, empty if all
+	// adapters are applied
+	adapter string
+
 	// the list of simultaneous sequences being evaluated
 	seqs []*Sequence
 
@@ -272,9 +443,27 @@ func (s *Server) allNil() bool {
 	return true
 }
 
+// response is text generated for a sequence, with the log probabilities of
+// its tokens if they were requested
+type response struct {
+	content  string
+	logprobs []api.Logprob
+
+	// tokens is the number of tokens the content was generated from
+	tokens int
+
+	// timings are the times the tokens were sampled, if requested
+	timings []time.Duration
+}
+
 func flushPending(seq *Sequence) bool {
 	joined := strings.Join(seq.pendingResponses, "")
+	logprobs := seq.pendingLogprobs
+	timings := seq.pendingTimings
+	tokens := len(seq.pendingResponses)
 	seq.pendingResponses = []string{}
+	seq.pendingLogprobs = nil
+	seq.pendingTimings = nil
 
 	// Check if there are any partial UTF-8 characters remaining.
 	// We already check and queue as we are generating but some may
@@ -282,7 +471,7 @@ func flushPending(seq *Sequence) bool {
 	// - Sequence is ending, e.g. generation limit has been hit
 	// - Invalid characters in the middle of a string
 	// This is a stricter check to ensure we never output invalid Unicode.
-	for !utf8.ValidString(joined) {
+	for !seq.rawBytes && !utf8.ValidString(joined) {
 		joined = joined[:len(joined)-1]
 	}
 
@@ -291,7 +480,7 @@ func flushPending(seq *Sequence) bool {
 	}
 
 	select {
-	case seq.responses <- joined:
+	case seq.responses <- response{content: joined, logprobs: logprobs, tokens: tokens, timings: timings}:
 		return true
 	case <-seq.quit:
 		return false
@@ -362,8 +551,10 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 		s.cond.Wait() // Wait until an item is added
 	}
 	defer s.mu.Unlock()
+	defer s.updateUsage()
 
 	var batch *llama.Batch
+	var adapter *string
 
 	seqIdx := s.nextSeq - 1
 	for range s.seqs {
@@ -380,6 +571,15 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			continue
 		}
 
+		// adapters apply to the whole context so only sequences using the
+		// same adapter can share a batch, the others go in the next batch
+		if adapter == nil {
+			adapter = &seq.adapter
+		} else if seq.adapter != *adapter {
+			s.nextSeq = seqIdx
+			continue
+		}
+
 		for i, input := range seq.inputs {
 			if len(seq.cache.Inputs)+len(seq.pendingInputs)+1 > s.cache.numCtx {
 				if len(seq.pendingInputs) == 0 {
@@ -421,7 +621,8 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 				break
 			}
 
-			batch.Add(input.token, input.embed, len(seq.cache.Inputs)+len(seq.pendingInputs), i+1 == len(seq.inputs), seq.cache.Id)
+			output := i+1 == len(seq.inputs) || (seq.embeddingOnly && s.tokenEmbeddings)
+			batch.Add(input.token, input.embed, len(seq.cache.Inputs)+len(seq.pendingInputs), output, seq.cache.Id)
 			seq.pendingInputs = append(seq.pendingInputs, input)
 			seq.iBatch = batch.NumTokens() - 1
 		}
@@ -433,6 +634,10 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 		return nil
 	}
 
+	if err := s.setAdapter(*adapter); err != nil {
+		return err
+	}
+
 	err := s.lc.Decode(batch)
 	if err != nil {
 		return fmt.Errorf("failed to decode batch: %w", err)
@@ -445,12 +650,19 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 
 		// After calling Decode, pending inputs are now in the cache
 		if len(seq.pendingInputs) > 0 {
+			if seq.embeddingOnly && s.tokenEmbeddings {
+				for j := seq.iBatch - len(seq.pendingInputs) + 1; j <= seq.iBatch; j++ {
+					seq.tokenEmbeddings = append(seq.tokenEmbeddings, s.lc.GetEmbeddingsIth(j)...)
+				}
+			}
+
 			seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs...)
 			seq.pendingInputs = []input{}
 		}
 
 		// don't sample prompt processing
 		if len(seq.inputs) != 0 {
+			seq.reportProgress()
 			continue
 		}
 
@@ -461,8 +673,10 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 
 		// if done processing the prompt, generate an embedding and return
 		if seq.embeddingOnly {
-			embed := s.lc.GetEmbeddingsSeq(seq.cache.Id)
-			if embed == nil {
+			var embed []float32
+			if s.tokenEmbeddings {
+				embed = seq.tokenEmbeddings
+			} else if embed = s.lc.GetEmbeddingsSeq(seq.cache.Id); embed == nil {
 				embed = s.lc.GetEmbeddingsIth(seq.iBatch)
 			}
 
@@ -472,9 +686,17 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 		}
 
 		// sample a token
+		var logits []float32
+		if seq.returnLogits || seq.logprobs {
+			logits = s.lc.GetLogitsIth(seq.iBatch)
+		}
+
+		if seq.returnLogits {
+			seq.logits = logits
+		}
+
 		token := seq.samplingCtx.Sample(s.lc, seq.iBatch)
 		seq.samplingCtx.Accept(token, true)
-		piece := s.model.TokenToPiece(token)
 
 		seq.numPredicted++
 
@@ -484,13 +706,31 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			// as it's important for the /api/generate context
 			// seq.responses <- piece
 
+			seq.stopToken = s.model.TokenToPiece(token)
+			s.removeSequence(i, llm.DoneReasonStop)
+			continue
+		}
+
+		// stop tokens are checked before detokenizing, so they match even if
+		// their text would be split across stop sequences or is empty
+		if slices.Contains(seq.stopTokens, token) {
+			slog.Debug("hit stop token id", "token", token)
+			seq.stopToken = s.model.TokenToPiece(token)
 			s.removeSequence(i, llm.DoneReasonStop)
 			continue
 		}
 
+		piece := s.model.TokenToPiece(token)
+
 		seq.inputs = []input{{token: token}}
 
 		seq.pendingResponses = append(seq.pendingResponses, piece)
+		if seq.logprobs {
+			seq.pendingLogprobs = append(seq.pendingLogprobs, common.Logprobs(logits, token, seq.topLogprobs, seq.rawLogits, s.model.TokenToPiece))
+		}
+		if seq.tokenTimings {
+			seq.pendingTimings = append(seq.pendingTimings, time.Since(seq.startProcessingTime))
+		}
 		sequence := strings.Join(seq.pendingResponses, "")
 
 		if ok, stop := common.FindStop(sequence, seq.stop); ok {
@@ -500,6 +740,12 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			origLen := len(seq.pendingResponses)
 			seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
 			newLen := len(seq.pendingResponses)
+			if seq.logprobs {
+				seq.pendingLogprobs = seq.pendingLogprobs[:newLen]
+			}
+			if seq.tokenTimings {
+				seq.pendingTimings = seq.pendingTimings[:newLen]
+			}
 
 			// Update the cache based on the tokens that will be returned:
 			// - We have 1 token more than is currently in the cache because
@@ -515,6 +761,7 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			}
 			seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
 
+			seq.stopSequence = stop
 			s.removeSequence(i, llm.DoneReasonStop)
 			continue
 		}
@@ -523,7 +770,7 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			continue
 		}
 
-		if common.IncompleteUnicode(sequence) {
+		if !seq.rawBytes && common.IncompleteUnicode(sequence) {
 			continue
 		}
 
@@ -568,22 +815,40 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		PenaltyRepeat:  req.Options.RepeatPenalty,
 		PenaltyFreq:    req.Options.FrequencyPenalty,
 		PenaltyPresent: req.Options.PresencePenalty,
+		Mirostat:       req.Options.Mirostat,
+		MirostatTau:    req.Options.MirostatTau,
+		MirostatEta:    req.Options.MirostatEta,
 		Seed:           uint32(req.Options.Seed),
 		Grammar:        req.Grammar,
+		LogitBias:      req.Options.LogitBias,
 	}
 
 	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
 		numPredict:     req.Options.NumPredict,
 		stop:           req.Options.Stop,
-		numKeep:        req.Options.NumKeep,
+		numKeep:        req.Options.Keep(),
 		samplingParams: &samplingParams,
 		embedding:      false,
+		adapter:        req.Adapter,
+
+		skipSpecialTokens: req.SkipSpecialTokens,
+		rawBytes:          req.Options.Bytes,
+		returnLogits:      req.Options.ReturnLogits,
+		logprobs:          req.Options.Logprobs,
+		topLogprobs:       req.Options.TopLogprobs,
+		rawLogits:         req.Options.RawLogits,
+		tokenTimings:      req.Options.ReturnTokenTimings,
+		stopTokens:        req.Options.StopTokens,
+		addBOS:            req.Options.AddBOS,
+		addEOS:            req.Options.AddEOS,
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	seq.numPinnedInputs = s.pinnedInputs(seq, req.Prompt, req.CachePrefix, !req.SkipSpecialTokens)
+
 	// Ensure there is a place to put the sequence, released when removed from s.seqs
 	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
 		if errors.Is(err, context.Canceled) {
@@ -598,13 +863,14 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, true)
+			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, seq.adapter, true, seq.numPinnedInputs)
 			if err != nil {
 				s.mu.Unlock()
 				s.seqsSem.Release(1)
 				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
 				return
 			}
+			seq.numCachedInputs = seq.numPromptInputs - len(seq.inputs)
 
 			s.seqs[i] = seq
 			s.cond.Signal()
@@ -625,11 +891,31 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		case <-r.Context().Done():
 			close(seq.quit)
 			return
+		case processed := <-seq.progress:
+			if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
+				PromptEvalProgress: &api.PromptEvalProgress{
+					Processed: processed,
+					Total:     seq.numPromptInputs,
+				},
+			}); err != nil {
+				http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+				close(seq.quit)
+				return
+			}
+
+			flusher.Flush()
 		case content, ok := <-seq.responses:
 			if ok {
-				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
-					Content: content,
-				}); err != nil {
+				resp := llm.CompletionResponse{Content: content.content}
+				if seq.rawBytes {
+					// JSON strings can only hold valid UTF-8
+					resp = llm.CompletionResponse{Bytes: []byte(content.content)}
+				}
+				resp.Logprobs = content.logprobs
+				resp.Tokens = content.tokens
+				resp.TokenTimings = content.timings
+
+				if err := json.NewEncoder(w).Encode(&resp); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 					close(seq.quit)
 					return
@@ -640,10 +926,15 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
 					Done:               true,
 					DoneReason:         seq.doneReason,
+					StopSequence:       seq.stopSequence,
+					StopToken:          seq.stopToken,
 					PromptEvalCount:    seq.numPromptInputs,
+					CachedPromptCount:  seq.numCachedInputs,
+					CachePrefixCount:   seq.numPinnedInputs,
 					PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime),
 					EvalCount:          seq.numDecoded,
 					EvalDuration:       time.Since(seq.startGenerationTime),
+					Logits:             seq.logits,
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
 				}
@@ -683,7 +974,7 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, false)
+			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, seq.adapter, false, 0)
 			if err != nil {
 				s.mu.Unlock()
 				s.seqsSem.Release(1)
@@ -704,25 +995,101 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	embedding := <-seq.embedding
+	// the sequence runs to completion even if the client goes away, as its
+	// embedding is computed in one piece
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case processed := <-seq.progress:
+			if !req.Progress {
+				continue
+			}
+
+			if err := json.NewEncoder(w).Encode(&llm.EmbeddingResponse{
+				PromptEvalProgress: &api.PromptEvalProgress{
+					Processed: processed,
+					Total:     seq.numPromptInputs,
+				},
+			}); err != nil {
+				http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+				return
+			}
 
-	if err := json.NewEncoder(w).Encode(&llm.EmbeddingResponse{
-		Embedding: embedding,
-	}); err != nil {
-		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		case embedding := <-seq.embedding:
+			if err := json.NewEncoder(w).Encode(&llm.EmbeddingResponse{
+				Embedding: embedding,
+			}); err != nil {
+				http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+}
+
+// updateUsage records the cache's usage for health checks. s.mu must be
+// held.
+func (s *Server) updateUsage() {
+	if s.cache == nil {
+		return
 	}
+
+	used, total := s.cache.Usage()
+	s.contextUsed.Store(int64(used))
+	s.contextTotal.Store(int64(total))
 }
 
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(&llm.ServerStatusResponse{
+	resp := llm.ServerStatusResponse{
 		Status:   s.status,
 		Progress: s.progress,
-	}); err != nil {
+	}
+
+	if s.status == llm.ServerStatusReady {
+		used, total := int(s.contextUsed.Load()), int(s.contextTotal.Load())
+
+		// llama.cpp doesn't report the memory it allocated per device so
+		// GPU usage is left to the server's estimates
+		resp.Usage = &llm.ServerUsage{ContextUsed: used, ContextTotal: total}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
 		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 	}
 }
 
+type loraAdapter struct {
+	path    string
+	adapter *llama.LoraAdapter
+}
+
+// setAdapter applies the adapter at path to the context, or all of the
+// model's adapters if path is empty. It is a no-op if the adapter is already
+// applied.
+func (s *Server) setAdapter(path string) error {
+	if path == s.adapter {
+		return nil
+	}
+
+	var adapters []*llama.LoraAdapter
+	for _, l := range s.loras {
+		if path == "" || l.path == path {
+			adapters = append(adapters, l.adapter)
+		}
+	}
+
+	if err := s.lc.SetLoraAdapters(adapters, 1.0); err != nil {
+		return fmt.Errorf("failed to apply adapter %q: %w", path, err)
+	}
+
+	s.adapter = path
+	return nil
+}
+
 type multiLPath []string
 
 func (m *multiLPath) Set(value string) error {
@@ -741,6 +1108,7 @@ func (s *Server) loadModel(
 	ppath string,
 	kvSize int,
 	kvCacheType string,
+	poolingType string,
 	flashAttention bool,
 	threads int,
 	multiUserCache bool,
@@ -751,18 +1119,27 @@ func (s *Server) loadModel(
 		panic(err)
 	}
 
-	ctxParams := llama.NewContextParams(kvSize, s.batchSize*s.parallel, s.parallel, threads, flashAttention, kvCacheType)
+	ctxParams := llama.NewContextParams(kvSize, s.batchSize*s.parallel, s.parallel, threads, flashAttention, kvCacheType, poolingType)
 	s.lc, err = llama.NewContextWithModel(s.model, ctxParams)
 	if err != nil {
 		panic(err)
 	}
 
 	if lpath.String() != "" {
+		adapters := make([]*llama.LoraAdapter, 0, len(lpath))
 		for _, path := range lpath {
-			err := s.model.ApplyLoraFromFile(s.lc, path, 1.0, threads)
+			adapter, err := s.model.LoadLoraFromFile(path)
 			if err != nil {
 				panic(err)
 			}
+
+			s.loras = append(s.loras, loraAdapter{path: path, adapter: adapter})
+			adapters = append(adapters, adapter)
+		}
+
+		// all adapters are applied unless a request selects one
+		if err := s.lc.SetLoraAdapters(adapters, 1.0); err != nil {
+			panic(err)
 		}
 	}
 
@@ -778,6 +1155,7 @@ func (s *Server) loadModel(
 	if err != nil {
 		panic(err)
 	}
+	s.updateUsage()
 
 	s.status = llm.ServerStatusReady
 	s.ready.Done()
@@ -794,6 +1172,7 @@ func Execute(args []string) error {
 	flashAttention := fs.Bool("flash-attn", false, "Enable flash attention")
 	kvSize := fs.Int("ctx-size", 2048, "Context (or KV cache) size")
 	kvCacheType := fs.String("kv-cache-type", "", "quantization type for KV cache (default: f16)")
+	pooling := fs.String("pooling", "", "pooling of embeddings: mean, cls, last or none (default: from model)")
 	port := fs.Int("port", 8080, "Port to expose the server on")
 	threads := fs.Int("threads", runtime.NumCPU(), "Number of threads to use during generation")
 	_ = fs.Bool("verbose", false, "verbose output (default: disabled)")
@@ -817,11 +1196,12 @@ func Execute(args []string) error {
 	llama.BackendInit()
 
 	server := &Server{
-		batchSize: *batchSize,
-		parallel:  *parallel,
-		seqs:      make([]*Sequence, *parallel),
-		seqsSem:   semaphore.NewWeighted(int64(*parallel)),
-		status:    llm.ServerStatusLoadingModel,
+		batchSize:       *batchSize,
+		parallel:        *parallel,
+		tokenEmbeddings: *pooling == "none",
+		seqs:            make([]*Sequence, *parallel),
+		seqsSem:         semaphore.NewWeighted(int64(*parallel)),
+		status:          llm.ServerStatusLoadingModel,
 	}
 
 	var tensorSplitFloats []float32
@@ -845,7 +1225,7 @@ func Execute(args []string) error {
 	}
 
 	server.ready.Add(1)
-	go server.loadModel(params, *mpath, lpaths, *ppath, *kvSize, *kvCacheType, *flashAttention, *threads, *multiUserCache)
+	go server.loadModel(params, *mpath, lpaths, *ppath, *kvSize, *kvCacheType, *pooling, *flashAttention, *threads, *multiUserCache)
 
 	server.cond = sync.NewCond(&server.mu)
 
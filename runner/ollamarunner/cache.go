@@ -3,8 +3,10 @@ package ollamarunner
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"math"
+	"slices"
 	"time"
 
 	"github.com/ollama/ollama/kvcache"
@@ -73,6 +75,16 @@ func (c *InputCache) Close() {
 	c.cache.Close()
 }
 
+// Usage returns the number of inputs stored in the cache across all slots and
+// the total number of inputs the cache can hold
+func (c *InputCache) Usage() (used, total int) {
+	for _, s := range c.slots {
+		used += len(s.Inputs)
+	}
+
+	return used, int(c.numCtx) * len(c.slots)
+}
+
 // Locking: Operations on InputCacheSlot (including finding one
 // through LoadCacheSlot) require a lock to be be held that serializes
 // these operations with each other and processBatch
@@ -84,6 +96,11 @@ type InputCacheSlot struct {
 	// Inputs that are stored in the KV cache
 	Inputs []input.Input
 
+	// number of inputs at the start of Inputs that form a system prompt
+	// retained for later requests. Slots that would lose it are only used
+	// when there is no other choice.
+	Pinned int32
+
 	// is this cache actively being processed as part of a sequence?
 	InUse bool
 
@@ -91,7 +108,10 @@ type InputCacheSlot struct {
 	lastUsed time.Time
 }
 
-func (c *InputCache) LoadCacheSlot(prompt []input.Input) (*InputCacheSlot, []input.Input, error) {
+// LoadCacheSlot finds a slot for prompt and returns the inputs that still need
+// to be processed. The first pinned inputs of prompt form a system prompt to
+// retain in the slot for later requests.
+func (c *InputCache) LoadCacheSlot(prompt []input.Input, pinned int32) (*InputCacheSlot, []input.Input, error) {
 	var slot *InputCacheSlot
 	var numPast int32
 	var err error
@@ -136,6 +156,12 @@ func (c *InputCache) LoadCacheSlot(prompt []input.Input) (*InputCacheSlot, []inp
 	slog.Debug("loading cache slot", "id", slot.Id, "cache", len(slot.Inputs), "prompt", len(prompt),
 		"used", numPast, "remaining", int32(len(prompt))-numPast)
 
+	if !slot.keepsPinned(numPast) {
+		slog.Debug("dropping retained system prompt", "id", slot.Id, "inputs", slot.Pinned)
+		slot.Pinned = 0
+	}
+	slot.Pinned = max(slot.Pinned, pinned)
+
 	slot.Inputs = prompt[:numPast]
 	prompt = prompt[numPast:]
 
@@ -152,7 +178,7 @@ func (c *InputCache) findLongestCacheSlot(prompt []input.Input) (*InputCacheSlot
 		}
 
 		count := countCommonPrefix(s.Inputs, prompt)
-		if count > longest {
+		if count > longest || count == longest && !longestSlot.keepsPinned(longest) && s.keepsPinned(count) {
 			longest = count
 			longestSlot = &c.slots[i]
 		}
@@ -166,7 +192,6 @@ func (c *InputCache) findLongestCacheSlot(prompt []input.Input) (*InputCacheSlot
 }
 
 func (c *InputCache) findBestCacheSlot(prompt []input.Input) (*InputCacheSlot, int32, error) {
-	oldest := time.Now()
 	var oldestSlot *InputCacheSlot
 
 	longest := int32(-1)
@@ -179,8 +204,7 @@ func (c *InputCache) findBestCacheSlot(prompt []input.Input) (*InputCacheSlot, i
 			longestSlot = &c.slots[i]
 		}
 
-		if s.lastUsed.Compare(oldest) < 0 && !s.InUse {
-			oldest = s.lastUsed
+		if !s.InUse && (oldestSlot == nil || evictBefore(&c.slots[i], oldestSlot)) {
 			oldestSlot = &c.slots[i]
 		}
 	}
@@ -189,7 +213,7 @@ func (c *InputCache) findBestCacheSlot(prompt []input.Input) (*InputCacheSlot, i
 		return longestSlot, longest, nil
 	}
 
-	if oldestSlot.InUse {
+	if oldestSlot == nil {
 		return nil, 0, errors.New("no available cache slots")
 	}
 
@@ -211,6 +235,117 @@ func (c *InputCache) findBestCacheSlot(prompt []input.Input) (*InputCacheSlot, i
 	return oldestSlot, longest, nil
 }
 
+var errSessionsNotSupported = errors.New("the model's cache doesn't support saving sessions")
+
+// SessionSlot returns the slot sharing the longest prefix with prompt, or the
+// most recently used slot if prompt is empty, with its inputs to save as a
+// session. Slots in use aren't saved while their contents change.
+func (c *InputCache) SessionSlot(prompt []input.Input) (*InputCacheSlot, []input.Input, error) {
+	if sc, ok := c.cache.(kvcache.StateCache); !ok || !sc.CanSave() {
+		return nil, nil, errSessionsNotSupported
+	}
+
+	var slot *InputCacheSlot
+	var count int32
+	for i, s := range c.slots {
+		if s.InUse {
+			continue
+		}
+
+		if len(prompt) == 0 {
+			if slot == nil || s.lastUsed.After(slot.lastUsed) {
+				slot, count = &c.slots[i], int32(len(s.Inputs))
+			}
+		} else if n := countCommonPrefix(s.Inputs, prompt); n > count {
+			slot, count = &c.slots[i], n
+		}
+	}
+
+	if slot == nil || count == 0 {
+		return nil, nil, errors.New("no cached session to save")
+	}
+
+	inputs := slot.Inputs[:count]
+	if slices.ContainsFunc(inputs, func(i input.Input) bool { return i.Multimodal != nil }) {
+		return nil, nil, errors.New("sessions with images can't be saved")
+	}
+
+	return slot, inputs, nil
+}
+
+// SaveSlot writes the state of the first n inputs of slot in the KV cache to
+// w
+func (c *InputCache) SaveSlot(slot *InputCacheSlot, n int32, w io.Writer) error {
+	sc, ok := c.cache.(kvcache.StateCache)
+	if !ok || !sc.CanSave() {
+		return errSessionsNotSupported
+	}
+
+	return sc.Save(slot.Id, n, w)
+}
+
+// LoadSession restores inputs and their state in the KV cache, as written by
+// SaveSlot, into the least recently used slot, unless a slot already holds
+// them. The next prompt that starts with inputs then continues from them.
+func (c *InputCache) LoadSession(inputs []input.Input, r io.Reader) error {
+	sc, ok := c.cache.(kvcache.StateCache)
+	if !ok || !sc.CanSave() {
+		return errSessionsNotSupported
+	}
+
+	if int32(len(inputs)) > c.numCtx {
+		return fmt.Errorf("session of %d tokens doesn't fit in the context of %d", len(inputs), c.numCtx)
+	}
+
+	var slot *InputCacheSlot
+	for i, s := range c.slots {
+		if s.InUse {
+			continue
+		}
+
+		if countCommonPrefix(s.Inputs, inputs) == int32(len(inputs)) {
+			return nil
+		}
+
+		if slot == nil || evictBefore(&c.slots[i], slot) {
+			slot = &c.slots[i]
+		}
+	}
+
+	if slot == nil {
+		return errors.New("no available cache slots")
+	}
+
+	slot.Pinned = 0
+	if err := sc.Load(slot.Id, r); err != nil {
+		_ = c.cache.Remove(slot.Id, 0, math.MaxInt32)
+		slot.Inputs = []input.Input{}
+		return err
+	}
+
+	slot.Inputs = inputs
+	slot.lastUsed = time.Now()
+
+	return nil
+}
+
+// keepsPinned reports whether reusing count inputs of the slot keeps its
+// retained system prompt
+func (s *InputCacheSlot) keepsPinned(count int32) bool {
+	return count >= s.Pinned
+}
+
+// evictBefore reports whether slot a should be evicted before slot b, which
+// is the least recently used one unless only one of them retains a system
+// prompt
+func evictBefore(a, b *InputCacheSlot) bool {
+	if (a.Pinned > 0) != (b.Pinned > 0) {
+		return a.Pinned == 0
+	}
+
+	return a.lastUsed.Before(b.lastUsed)
+}
+
 func countCommonPrefix(a []input.Input, b []input.Input) int32 {
 	var count int32
 
@@ -292,6 +427,8 @@ func (c *InputCache) ShiftCacheSlot(slot *InputCacheSlot, numKeep int32) error {
 		}
 	}
 
+	slot.Pinned = min(slot.Pinned, numKeep)
+
 	for i := numKeep + discard; i < inputLen; i++ {
 		slot.Inputs[i-discard] = slot.Inputs[i]
 	}
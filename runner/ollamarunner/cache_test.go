@@ -3,9 +3,12 @@ package ollamarunner
 import (
 	"errors"
 	"fmt"
+	"io"
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/ollama/ollama/kvcache"
 	"github.com/ollama/ollama/ml"
 	"github.com/ollama/ollama/model/input"
 )
@@ -206,6 +209,27 @@ func TestFindCacheSlot(t *testing.T) {
 			longest: expected{result: 1, len: 1},
 			best:    expected{result: 1, len: 2},
 		},
+		{
+			name: "Pinned",
+			cache: InputCache{slots: []InputCacheSlot{
+				{
+					Id:       0,
+					Inputs:   []input.Input{{Token: 1}, {Token: 2}},
+					Pinned:   2,
+					InUse:    false,
+					lastUsed: time.Now().Add(-2 * time.Second),
+				},
+				{
+					Id:       1,
+					Inputs:   []input.Input{{Token: 3}},
+					InUse:    false,
+					lastUsed: time.Now().Add(-time.Second),
+				},
+			}},
+			prompt:  []input.Input{{Token: 4}},
+			longest: expected{result: 1, len: 0},
+			best:    expected{result: 1, len: 0},
+		},
 	}
 
 	for _, tt := range tests {
@@ -393,7 +417,7 @@ func TestLoadCacheSlot(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			slot, remainingPrompt, err := tt.cache.LoadCacheSlot(tt.prompt)
+			slot, remainingPrompt, err := tt.cache.LoadCacheSlot(tt.prompt, 0)
 
 			// Check error state
 			if (err != nil) != tt.wantErr {
@@ -512,3 +536,111 @@ func TestShiftCacheSlot(t *testing.T) {
 		})
 	}
 }
+
+// mockStateCache is a cache that records which sequences are saved and loaded
+type mockStateCache struct {
+	mockCache
+	saved, loaded []int
+	loadErr       error
+}
+
+func (m *mockStateCache) CanSave() bool { return true }
+
+func (m *mockStateCache) Save(seq int, n int32, w io.Writer) error {
+	m.saved = append(m.saved, seq)
+	return nil
+}
+
+func (m *mockStateCache) Load(seq int, r io.Reader) error {
+	m.loaded = append(m.loaded, seq)
+	return m.loadErr
+}
+
+func TestSessions(t *testing.T) {
+	now := time.Now()
+	newCache := func(cache kvcache.Cache) InputCache {
+		return InputCache{numCtx: 8, cache: cache, slots: []InputCacheSlot{
+			{Id: 0, Inputs: []input.Input{{Token: 1}, {Token: 2}, {Token: 3}}, lastUsed: now.Add(-2 * time.Second)},
+			{Id: 1, Inputs: []input.Input{{Token: 1}, {Token: 2}, {Token: 4}, {Token: 5}}, lastUsed: now.Add(-time.Second)},
+			{Id: 2, Inputs: []input.Input{{Token: 1}, {Token: 2}, {Token: 4}, {Token: 5}, {Token: 6}}, InUse: true, lastUsed: now},
+		}}
+	}
+
+	t.Run("save", func(t *testing.T) {
+		c := newCache(&mockStateCache{})
+
+		cases := []struct {
+			prompt []input.Input
+			slot   int
+			inputs int
+		}{
+			{prompt: []input.Input{{Token: 1}, {Token: 2}, {Token: 4}, {Token: 7}}, slot: 1, inputs: 3},
+			{prompt: []input.Input{{Token: 1}, {Token: 2}, {Token: 3}, {Token: 4}}, slot: 0, inputs: 3},
+			{slot: 1, inputs: 4},
+		}
+
+		for _, tt := range cases {
+			slot, inputs, err := c.SessionSlot(tt.prompt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if slot.Id != tt.slot || len(inputs) != tt.inputs {
+				t.Errorf("expected %d inputs of slot %d, got %d of slot %d", tt.inputs, tt.slot, len(inputs), slot.Id)
+			}
+		}
+
+		if _, _, err := c.SessionSlot([]input.Input{{Token: 9}}); err == nil {
+			t.Error("expected an error with no matching slot")
+		}
+
+		c.slots[1].Inputs[1].Multimodal = []input.Multimodal{{}}
+		if _, _, err := c.SessionSlot([]input.Input{{Token: 1}, {Token: 2}, {Token: 4}}); err == nil {
+			t.Error("expected an error saving an image")
+		}
+
+		for _, cache := range []kvcache.Cache{&mockCache{}, kvcache.NewSWACache(4, nil), kvcache.NewChunkedAttentionCache(4, nil)} {
+			c = newCache(cache)
+			if _, _, err := c.SessionSlot(nil); !errors.Is(err, errSessionsNotSupported) {
+				t.Errorf("%T: expected %v, got %v", cache, errSessionsNotSupported, err)
+			}
+		}
+	})
+
+	t.Run("load", func(t *testing.T) {
+		mock := &mockStateCache{}
+		c := newCache(mock)
+
+		// a slot not in use already holds these
+		if err := c.LoadSession([]input.Input{{Token: 1}, {Token: 2}, {Token: 4}}, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(mock.loaded) != 0 {
+			t.Errorf("expected nothing to be loaded, got %v", mock.loaded)
+		}
+
+		// the least recently used slot is replaced
+		inputs := []input.Input{{Token: 1}, {Token: 2}, {Token: 4}, {Token: 5}, {Token: 6}}
+		if err := c.LoadSession(inputs, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(mock.loaded, []int{0}) || len(c.slots[0].Inputs) != len(inputs) {
+			t.Errorf("expected slot 0 to be loaded with %d inputs, got %v and %d inputs", len(inputs), mock.loaded, len(c.slots[0].Inputs))
+		}
+
+		mock.loadErr = errors.New("mismatched cache")
+		if err := c.LoadSession([]input.Input{{Token: 7}}, nil); err == nil {
+			t.Fatal("expected an error")
+		}
+
+		if len(c.slots[1].Inputs) != 0 {
+			t.Errorf("expected the slot that failed to load to be emptied, got %v", c.slots[1].Inputs)
+		}
+
+		if err := c.LoadSession(make([]input.Input, 9), nil); err == nil {
+			t.Error("expected an error for a session longer than the context")
+		}
+	})
+}
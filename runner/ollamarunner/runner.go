@@ -1,6 +1,7 @@
 package ollamarunner
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -9,16 +10,20 @@ import (
 	"fmt"
 	"hash/maphash"
 	"image"
+	"io"
 	"log"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -58,11 +63,21 @@ type Sequence struct {
 	// tokens that have been generated but not returned yet (e.g. for stop sequences)
 	pendingResponses []string
 
+	// log probabilities of the tokens in pendingResponses, if requested
+	pendingLogprobs []api.Logprob
+
+	// times since processing started that the tokens in pendingResponses
+	// were sampled, if tokenTimings is set
+	pendingTimings []time.Duration
+
 	// input cache being used by this sequence
 	cache *InputCacheSlot
 
 	// channel to send responses over
-	responses chan string
+	responses chan response
+
+	// channel to report the number of prompt inputs processed so far
+	progress chan int
 
 	// channel to stop decoding (such as if the remote connection is closed)
 	quit chan bool
@@ -79,6 +94,9 @@ type Sequence struct {
 	// stop sequences
 	stop []string
 
+	// token IDs that end generation as soon as one is sampled
+	stopTokens []int
+
 	// number of inputs to keep at the beginning when shifting context window
 	numKeep int32
 
@@ -87,11 +105,58 @@ type Sequence struct {
 
 	doneReason llm.DoneReason
 
+	// stopSequence is the stop sequence that ended generation, if any
+	stopSequence string
+
+	// stopToken is the text of the token that ended generation, if any
+	stopToken string
+
 	// Metrics
 	startProcessingTime time.Time
 	startGenerationTime time.Time
 	numPredicted        int
 	numPromptInputs     int
+	numCachedInputs     int
+
+	// number of prompt inputs that form a system prompt retained in the cache
+	numPinnedInputs int
+
+	// rawBytes returns the text of each token as it is generated, even if it
+	// ends part way through a UTF-8 character
+	rawBytes bool
+
+	// returnLogits keeps the logits that each token is sampled from, so
+	// those of the last one can be returned with the final response
+	returnLogits bool
+	logits       []float32
+
+	// logprobs returns the log probability of each generated token, with
+	// those of the topLogprobs most likely tokens, and their logits if
+	// rawLogits is set. logprob is that of the last token sampled.
+	logprobs    bool
+	topLogprobs int
+	rawLogits   bool
+	logprob     api.Logprob
+
+	// tokenTimings returns the time each generated token was sampled
+	tokenTimings bool
+
+	// guidance evaluates the negative prompt of classifier-free guidance
+	// alongside this sequence. It isn't in s.seqs and is never sampled
+	// itself, but is given each token sampled for this sequence.
+	guidance      *Sequence
+	guidanceScale float32
+
+	// next holds the logits of the next token of a guided sequence, or of
+	// its guidance, until those of the other are ready
+	next []float32
+
+	// lookahead drafts the tokens to follow each one sampled by prompt
+	// lookup. drafts are those at the end of inputs waiting to be verified.
+	lookahead   bool
+	drafts      []int32
+	numDrafted  int
+	numAccepted int
 }
 
 type NewSequenceParams struct {
@@ -100,14 +165,46 @@ type NewSequenceParams struct {
 	numKeep    int32
 	sampler    sample.Sampler
 	embedding  bool
+
+	// skipSpecialTokens tokenizes the prompt without inserting a BOS token
+	skipSpecialTokens bool
+
+	// rawBytes returns token text without holding back partial UTF-8 characters
+	rawBytes bool
+
+	// returnLogits returns the logits of the last token with the final response
+	returnLogits bool
+
+	// logprobs returns the log probability of each generated token and of
+	// the topLogprobs most likely tokens, with their logits if rawLogits
+	logprobs    bool
+	topLogprobs int
+	rawLogits   bool
+
+	// tokenTimings returns the time each generated token was sampled
+	tokenTimings bool
+
+	// stopTokens are token IDs that end generation without their text
+	stopTokens []int
+
+	// addBOS and addEOS force the BOS and EOS tokens in or out of the
+	// prompt, overriding the tokenizer and skipSpecialTokens, if set
+	addBOS, addEOS *bool
+
+	// lookahead drafts tokens by prompt lookup for the model to verify
+	lookahead bool
 }
 
+// errPromptTruncated is returned by NewSequence for a prompt that doesn't fit
+// in the context even after truncation
+var errPromptTruncated = errors.New("entire prompt removed by truncation")
+
 func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSequenceParams) (*Sequence, error) {
 	s.ready.Wait()
 
 	startTime := time.Now()
 
-	inputs, ctxs, mmStore, err := s.inputs(prompt, images)
+	inputs, ctxs, mmStore, err := s.promptInputs(prompt, images, params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to process inputs: %w", err)
 	} else if len(inputs) == 0 {
@@ -148,7 +245,7 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		}
 
 		if promptStart >= int32(len(inputs)) {
-			return nil, errors.New("entire prompt removed by truncation")
+			return nil, errPromptTruncated
 		}
 
 		newInputs := inputs[:params.numKeep]
@@ -168,20 +265,93 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		startProcessingTime: startTime,
 		numPredict:          params.numPredict,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		responses:           make(chan response, 100),
+		progress:            make(chan int, 1),
 		quit:                make(chan bool, 1),
 		embedding:           make(chan []float32, 1),
 		sampler:             params.sampler,
 		embeddingOnly:       params.embedding,
 		stop:                params.stop,
+		stopTokens:          params.stopTokens,
 		numKeep:             params.numKeep,
+		rawBytes:            params.rawBytes,
+		returnLogits:        params.returnLogits,
+		logprobs:            params.logprobs,
+		topLogprobs:         params.topLogprobs,
+		rawLogits:           params.rawLogits,
+		tokenTimings:        params.tokenTimings,
+		lookahead:           params.lookahead,
 	}, nil
 }
 
+// reportProgress sends the number of prompt inputs processed so far, replacing
+// any update the client has not received yet so that prompt processing never
+// blocks on a slow reader.
+func (seq *Sequence) reportProgress() {
+	select {
+	case <-seq.progress:
+	default:
+	}
+
+	seq.progress <- seq.numPromptInputs - len(seq.inputs)
+}
+
+// pinnedInputs returns the number of inputs of seq that come from the first
+// n bytes of prompt, the system prompt to retain in the cache
+func (s *Server) pinnedInputs(seq *Sequence, prompt string, n int, addSpecial bool) int32 {
+	if n <= 0 {
+		return 0
+	}
+
+	prefix, _, _, err := s.inputs(prompt[:min(n, len(prompt))], nil, addSpecial)
+	if err != nil {
+		slog.Warn("unable to retain system prompt in cache", "error", err)
+		return 0
+	}
+
+	return countCommonPrefix(prefix, seq.inputs)
+}
+
+// promptInputs processes the prompt of a new sequence into inputs, inserting
+// the BOS and EOS tokens as params asks
+func (s *Server) promptInputs(prompt string, images []llm.ImageData, params NewSequenceParams) ([]input.Input, []ml.Context, multimodalStore, error) {
+	if params.addBOS == nil && params.addEOS == nil {
+		return s.inputs(prompt, images, !params.skipSpecialTokens)
+	}
+
+	inputs, ctxs, mmStore, err := s.inputs(prompt, images, false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	vocab := s.model.(model.TextProcessor).Vocabulary()
+
+	addBOS := vocab.AddBOS && !params.skipSpecialTokens
+	if params.addBOS != nil {
+		addBOS = *params.addBOS
+	}
+
+	addEOS := vocab.AddEOS && !params.skipSpecialTokens
+	if params.addEOS != nil {
+		addEOS = *params.addEOS
+	}
+
+	if addBOS && len(vocab.BOS) > 0 {
+		inputs = append([]input.Input{{Token: vocab.BOS[0]}}, inputs...)
+	}
+
+	if addEOS && len(vocab.EOS) > 0 {
+		inputs = append(inputs, input.Input{Token: vocab.EOS[0]})
+	}
+
+	return inputs, ctxs, mmStore, nil
+}
+
 // inputs processes the prompt and images into a list of inputs
 // by splitting the prompt on [img-<n>] tags, tokenizing text and
-// decoding images
-func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input.Input, []ml.Context, multimodalStore, error) {
+// decoding images. addSpecial adds the special tokens, such as BOS, that the
+// model's tokenizer inserts at the start of the prompt.
+func (s *Server) inputs(prompt string, images []llm.ImageData, addSpecial bool) ([]input.Input, []ml.Context, multimodalStore, error) {
 	var inputs []input.Input
 	var ctxs []ml.Context
 	var mmStore multimodalStore
@@ -203,7 +373,7 @@ func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input.Input, [
 	postTokenize := false
 	for i, part := range parts {
 		// text - tokenize
-		tokens, err := s.model.(model.TextProcessor).Encode(part, i == 0)
+		tokens, err := s.model.(model.TextProcessor).Encode(part, addSpecial && i == 0)
 		if err != nil {
 			return nil, nil, nil, err
 		}
@@ -231,13 +401,21 @@ func (s *Server) inputs(prompt string, images []llm.ImageData) ([]input.Input, [
 			ctx := s.model.Backend().NewContext()
 			runtime.SetFinalizer(ctx, func(c ml.Context) { c.Close() })
 			ctxs = append(ctxs, ctx)
-			imageEmbeddings, err := multimodalProcessor.EncodeMultimodal(ctx, images[imageIndex].Data)
+			var imageEmbeddings []input.Multimodal
+			var err error
+			if p, ok := multimodalProcessor.(model.ImageDetailProcessor); ok && images[imageIndex].Detail != "" {
+				imageEmbeddings, err = p.EncodeMultimodalDetail(ctx, images[imageIndex].Data, images[imageIndex].Detail)
+			} else {
+				imageEmbeddings, err = multimodalProcessor.EncodeMultimodal(ctx, images[imageIndex].Data)
+			}
 			if err != nil {
 				return nil, nil, nil, err
 			}
 
+			// the same image at another level of detail has other embeddings
 			s.multimodalHash.Reset()
 			_, _ = s.multimodalHash.Write(images[imageIndex].Data)
+			_, _ = s.multimodalHash.Write([]byte(images[imageIndex].Detail))
 			imageHash := s.multimodalHash.Sum64()
 
 			mmStore.addMultimodal(imageEmbeddings)
@@ -279,6 +457,12 @@ type Server struct {
 	// TODO (jmorganca): make this n_batch
 	batchSize int
 
+	// contextUsed and contextTotal are the inputs stored in the cache and
+	// the number it can hold. They are updated after each batch so that
+	// health checks don't wait for the lock held while a batch decodes.
+	contextUsed  atomic.Int64
+	contextTotal atomic.Int64
+
 	// protects access to everything below this line
 	// this is context state needed for decoding
 	mu sync.Mutex
@@ -313,9 +497,27 @@ func (s *Server) allNil() bool {
 	return true
 }
 
+// response is text generated for a sequence, with the log probabilities of
+// its tokens if they were requested
+type response struct {
+	content  string
+	logprobs []api.Logprob
+
+	// tokens is the number of tokens the content was generated from
+	tokens int
+
+	// timings are the times the tokens were sampled, if requested
+	timings []time.Duration
+}
+
 func flushPending(seq *Sequence) bool {
 	joined := strings.Join(seq.pendingResponses, "")
+	logprobs := seq.pendingLogprobs
+	timings := seq.pendingTimings
+	tokens := len(seq.pendingResponses)
 	seq.pendingResponses = []string{}
+	seq.pendingLogprobs = nil
+	seq.pendingTimings = nil
 
 	// Check if there are any partial UTF-8 characters remaining.
 	// We already check and queue as we are generating but some may
@@ -323,7 +525,7 @@ func flushPending(seq *Sequence) bool {
 	// - Sequence is ending, e.g. generation limit has been hit
 	// - Invalid characters in the middle of a string
 	// This is a stricter check to ensure we never output invalid Unicode.
-	for !utf8.ValidString(joined) {
+	for !seq.rawBytes && !utf8.ValidString(joined) {
 		joined = joined[:len(joined)-1]
 	}
 
@@ -332,7 +534,7 @@ func flushPending(seq *Sequence) bool {
 	}
 
 	select {
-	case seq.responses <- joined:
+	case seq.responses <- response{content: joined, logprobs: logprobs, tokens: tokens, timings: timings}:
 		return true
 	case <-seq.quit:
 		return false
@@ -347,8 +549,30 @@ func (s *Server) removeSequence(seqIndex int, reason llm.DoneReason) {
 	close(seq.responses)
 	close(seq.embedding)
 	seq.cache.InUse = false
+	if seq.guidance != nil {
+		seq.guidance.cache.InUse = false
+	}
 	s.seqs[seqIndex] = nil
-	s.seqsSem.Release(1)
+	s.seqsSem.Release(seq.slots())
+}
+
+// slots returns the number of cache slots seq uses
+func (seq *Sequence) slots() int64 {
+	if seq.guidance != nil {
+		return 2
+	}
+
+	return 1
+}
+
+// batched returns seq and, if it's guided, its guidance, which are added to
+// batches together
+func (seq *Sequence) batched() []*Sequence {
+	if seq.guidance != nil {
+		return []*Sequence{seq, seq.guidance}
+	}
+
+	return []*Sequence{seq}
 }
 
 func (s *Server) run(ctx context.Context) {
@@ -373,6 +597,7 @@ func (s *Server) processBatch() error {
 		s.cond.Wait() // Wait until an item is added
 	}
 	defer s.mu.Unlock()
+	defer s.updateUsage()
 
 	ctx := s.model.Backend().NewContext()
 	defer ctx.Close()
@@ -396,75 +621,82 @@ func (s *Server) processBatch() error {
 			continue
 		}
 
-		if !s.cache.enabled {
-			seq.inputs = append(seq.cache.Inputs, seq.inputs...)
-			seq.cache.Inputs = []input.Input{}
-		}
-
-		batchSize := s.batchSize
+		for _, seq := range seq.batched() {
+			seq.iBatch = -1
 
-		for i, inp := range seq.inputs {
-			// If we are required to put following inputs into a single batch then extend the
-			// batch size. Since we are only extending the size the minimum amount possible, this
-			// will cause a break if we have existing inputs.
-			minBatch := 1 + inp.SameBatch
-			if minBatch > batchSize {
-				batchSize = minBatch
+			if !s.cache.enabled {
+				seq.inputs = append(seq.cache.Inputs, seq.inputs...)
+				seq.cache.Inputs = []input.Input{}
 			}
 
-			// Stop if the required batch would put us over the total batch size (including tokens
-			// added by other sequences). If we haven't been able to add anything yet then pick up
-			// here again for the next batch to avoid starvation, though we can opportunistically
-			// check if other sequences can still squeeze something in.
-			if len(batchInputs)+minBatch > batchSize {
-				if len(seq.pendingInputs) == 0 && resumeSeq == -1 {
-					resumeSeq = seqIdx
+			batchSize := s.batchSize
+
+			for i, inp := range seq.inputs {
+				// If we are required to put following inputs into a single batch then extend the
+				// batch size. Since we are only extending the size the minimum amount possible, this
+				// will cause a break if we have existing inputs.
+				minBatch := 1 + inp.SameBatch
+				if minBatch > batchSize {
+					batchSize = minBatch
 				}
-				break
-			}
 
-			// If the sum of our working set (already processed tokens, tokens we added to this
-			// batch, required following tokens) exceeds the context size, then trigger a shift
-			// now so we don't have to do one later when we can't break the batch.
-			if int32(len(seq.cache.Inputs)+len(seq.pendingInputs)+minBatch) > s.cache.numCtx {
-				if len(seq.pendingInputs) != 0 {
+				// Stop if the required batch would put us over the total batch size (including tokens
+				// added by other sequences). If we haven't been able to add anything yet then pick up
+				// here again for the next batch to avoid starvation, though we can opportunistically
+				// check if other sequences can still squeeze something in.
+				if len(batchInputs)+minBatch > batchSize {
+					if len(seq.pendingInputs) == 0 && resumeSeq == -1 {
+						resumeSeq = seqIdx
+					}
 					break
 				}
 
-				err := s.cache.ShiftCacheSlot(seq.cache, seq.numKeep)
-				if err != nil {
-					var reprocess *ErrReprocessInputs
-					if errors.As(err, &reprocess) {
-						// Prepend these inputs to the sequence's inputs queue for reprocessing
-						seq.inputs = append(reprocess.Inputs, seq.inputs...)
-						// Skip this sequence but continue processing the rest
-						continue
-					} else {
-						return err
+				// If the sum of our working set (already processed tokens, tokens we added to this
+				// batch, required following tokens) exceeds the context size, then trigger a shift
+				// now so we don't have to do one later when we can't break the batch.
+				if int32(len(seq.cache.Inputs)+len(seq.pendingInputs)+minBatch) > s.cache.numCtx {
+					if len(seq.pendingInputs) != 0 {
+						break
+					}
+
+					err := s.cache.ShiftCacheSlot(seq.cache, seq.numKeep)
+					if err != nil {
+						var reprocess *ErrReprocessInputs
+						if errors.As(err, &reprocess) {
+							// Prepend these inputs to the sequence's inputs queue for reprocessing
+							seq.inputs = append(reprocess.Inputs, seq.inputs...)
+							// Skip this sequence but continue processing the rest
+							continue
+						} else {
+							return err
+						}
 					}
 				}
-			}
 
-			batchInputs = append(batchInputs, inp.Token)
-			if inp.Multimodal != nil {
-				mm, err := seq.mmStore.getMultimodal(s.model.Backend(), ctx, inp.Multimodal, false)
-				if err != nil {
-					return err
+				batchInputs = append(batchInputs, inp.Token)
+				if inp.Multimodal != nil {
+					mm, err := seq.mmStore.getMultimodal(s.model.Backend(), ctx, inp.Multimodal, false)
+					if err != nil {
+						return err
+					}
+					batch.Multimodal = append(batch.Multimodal, input.MultimodalIndex{Index: len(batchInputs) - 1, Multimodal: mm})
 				}
-				batch.Multimodal = append(batch.Multimodal, input.MultimodalIndex{Index: len(batchInputs) - 1, Multimodal: mm})
-			}
 
-			batch.Positions = append(batch.Positions, int32(len(seq.cache.Inputs)+len(seq.pendingInputs)))
-			batch.Sequences = append(batch.Sequences, seq.cache.Id)
+				batch.Positions = append(batch.Positions, int32(len(seq.cache.Inputs)+len(seq.pendingInputs)))
+				batch.Sequences = append(batch.Sequences, seq.cache.Id)
 
-			seq.iBatch = len(batch.Outputs)
-			if i+1 == len(seq.inputs) {
-				batch.Outputs = append(batch.Outputs, int32(len(batchInputs)-1))
+				// drafts are verified by the outputs of the inputs before them
+				if i+1 >= len(seq.inputs)-len(seq.drafts) {
+					if seq.iBatch < 0 {
+						seq.iBatch = len(batch.Outputs)
+					}
+					batch.Outputs = append(batch.Outputs, int32(len(batchInputs)-1))
+				}
+				seq.pendingInputs = append(seq.pendingInputs, inp)
 			}
-			seq.pendingInputs = append(seq.pendingInputs, inp)
-		}
 
-		seq.inputs = seq.inputs[len(seq.pendingInputs):]
+			seq.inputs = seq.inputs[len(seq.pendingInputs):]
+		}
 	}
 
 	if resumeSeq != -1 {
@@ -484,15 +716,26 @@ func (s *Server) processBatch() error {
 
 	logits := modelOutput.Floats()
 
+	var vocabSize int
+	if len(batch.Outputs) > 0 {
+		vocabSize = len(logits) / len(batch.Outputs)
+	}
+
 	for i, seq := range s.seqs {
 		if seq == nil {
 			continue
 		}
 
 		// After calling Forward, pending inputs are now in the cache
-		if len(seq.pendingInputs) > 0 {
-			seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs...)
-			seq.pendingInputs = []input.Input{}
+		for _, seq := range seq.batched() {
+			if len(seq.pendingInputs) > 0 {
+				seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs...)
+				seq.pendingInputs = []input.Input{}
+			}
+		}
+
+		if g := seq.guidance; g != nil && g.iBatch >= 0 {
+			g.next = slices.Clone(logits[g.iBatch*vocabSize : (g.iBatch+1)*vocabSize])
 		}
 
 		// don't sample prompt processing
@@ -500,9 +743,29 @@ func (s *Server) processBatch() error {
 			if !s.cache.enabled {
 				return errors.New("caching disabled but unable to fit entire input in a batch")
 			}
+			seq.reportProgress()
 			continue
 		}
 
+		var next []float32
+		if seq.iBatch >= 0 {
+			next = logits[seq.iBatch*vocabSize : (seq.iBatch+1)*vocabSize]
+		}
+
+		if seq.guidance != nil {
+			if next != nil {
+				seq.next = slices.Clone(next)
+			}
+
+			// the prompts may finish processing in different batches
+			if seq.next == nil || seq.guidance.next == nil {
+				continue
+			}
+
+			next = sample.Guide(seq.next, seq.guidance.next, seq.guidanceScale)
+			seq.next, seq.guidance.next = nil, nil
+		}
+
 		seq.numPredicted++
 		if seq.numPredicted == 1 {
 			seq.startGenerationTime = time.Now()
@@ -516,76 +779,335 @@ func (s *Server) processBatch() error {
 			continue
 		}
 
-		// sample a token
-		vocabSize := len(logits) / len(batch.Outputs)
+		// drafts are accepted for as long as they are the tokens that would
+		// have been sampled anyway
+		drafts := seq.drafts
+		seq.drafts = nil
+		for j := 0; ; j++ {
+			if j > 0 {
+				seq.numPredicted++
+				next = logits[(seq.iBatch+j)*vocabSize : (seq.iBatch+j+1)*vocabSize]
+			}
+
+			// sample a token
+			if seq.returnLogits {
+				seq.logits = append(seq.logits[:0], next...)
+			}
 
-		token, err := seq.sampler.Sample(logits[seq.iBatch*vocabSize : (seq.iBatch+1)*vocabSize])
-		if err != nil {
-			return fmt.Errorf("failed to sample token: %w", err)
-		}
+			token, err := seq.sampler.Sample(next)
+			if err != nil {
+				return fmt.Errorf("failed to sample token: %w", err)
+			}
 
-		// if it's an end of sequence token, break
-		if s.model.(model.TextProcessor).Is(token, model.SpecialEOS) {
-			// TODO (jmorganca): we should send this back
-			// as it's important for the /api/generate context
-			// seq.responses <- piece
+			if seq.logprobs {
+				seq.logprob = common.Logprobs(next, int(token), seq.topLogprobs, seq.rawLogits, s.decodeToken)
+			}
 
-			s.removeSequence(i, llm.DoneReasonStop)
-			continue
-		}
+			// the number of drafts in the cache from this token on
+			ahead := len(drafts) - j
+			if ahead > 0 {
+				if token == drafts[j] {
+					seq.numAccepted++
+				} else {
+					if err := s.rejectDrafts(seq, ahead); err != nil {
+						return err
+					}
+					ahead = 0
+				}
+			}
 
-		piece, err := s.model.(model.TextProcessor).Decode([]int32{token})
-		if err != nil {
-			return err
+			removed, err := s.addToken(i, seq, token, ahead)
+			if err != nil {
+				return err
+			}
+
+			if removed {
+				break
+			}
+
+			if ahead == 0 {
+				if seq.lookahead {
+					seq.draft(s.batchSize)
+				}
+				break
+			}
 		}
+	}
 
-		seq.inputs = []input.Input{{Token: token}}
+	return nil
+}
 
-		seq.pendingResponses = append(seq.pendingResponses, piece)
-		sequence := strings.Join(seq.pendingResponses, "")
+// decodeToken returns the text of a token, or "" if it can't be decoded
+func (s *Server) decodeToken(token int) string {
+	piece, _ := s.model.(model.TextProcessor).Decode([]int32{int32(token)})
+	return piece
+}
 
-		if ok, stop := common.FindStop(sequence, seq.stop); ok {
-			slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+// addToken adds a token sampled for the sequence at index i, after which
+// there are the given number of drafted tokens in the cache, and returns
+// whether it ended the sequence
+func (s *Server) addToken(i int, seq *Sequence, token int32, ahead int) (bool, error) {
+	// if it's an end of sequence token, break
+	if s.model.(model.TextProcessor).Is(token, model.SpecialEOS) {
+		// TODO (jmorganca): we should send this back
+		// as it's important for the /api/generate context
+		// seq.responses <- piece
+
+		seq.cache.Inputs = seq.cache.Inputs[:len(seq.cache.Inputs)-ahead]
+		seq.stopToken, _ = s.model.(model.TextProcessor).Decode([]int32{token})
+		s.removeSequence(i, llm.DoneReasonStop)
+		return true, nil
+	}
 
-			var tokenTruncated bool
-			origLen := len(seq.pendingResponses)
-			seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
-			newLen := len(seq.pendingResponses)
+	// stop tokens are checked before decoding, so they match even if
+	// their text would be split across stop sequences or is empty
+	if slices.Contains(seq.stopTokens, int(token)) {
+		slog.Debug("hit stop token id", "token", token)
+		seq.cache.Inputs = seq.cache.Inputs[:len(seq.cache.Inputs)-ahead]
+		seq.stopToken, _ = s.model.(model.TextProcessor).Decode([]int32{token})
+		s.removeSequence(i, llm.DoneReasonStop)
+		return true, nil
+	}
 
-			// Update the cache based on the tokens that will be returned:
-			// - We have 1 token more than is currently in the cache because
-			// the last one generated wasn't submitted to Decode
-			// - Remove any stop sequences that we stripped out
-			// - If truncateStop removed a portion of a token, drop that
-			// - As defense-in-depth, if truncatedToken didn't find a stop token
-			// remove the extra one that we added to the cache len
-			tokenLen := len(seq.cache.Inputs) + 1
-			tokenLen -= origLen - newLen
-			if tokenTruncated || origLen == newLen {
-				tokenLen--
-			}
-			seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
+	piece, err := s.model.(model.TextProcessor).Decode([]int32{token})
+	if err != nil {
+		return false, err
+	}
 
-			s.removeSequence(i, llm.DoneReasonStop)
-			continue
+	// an accepted draft is already in the cache
+	if ahead == 0 {
+		seq.inputs = []input.Input{{Token: token}}
+		if seq.guidance != nil {
+			seq.guidance.inputs = []input.Input{{Token: token}}
 		}
+	}
 
-		if common.ContainsStopSuffix(sequence, seq.stop) {
-			continue
+	seq.pendingResponses = append(seq.pendingResponses, piece)
+	if seq.logprobs {
+		seq.pendingLogprobs = append(seq.pendingLogprobs, seq.logprob)
+	}
+	if seq.tokenTimings {
+		seq.pendingTimings = append(seq.pendingTimings, time.Since(seq.startProcessingTime))
+	}
+	sequence := strings.Join(seq.pendingResponses, "")
+
+	if ok, stop := common.FindStop(sequence, seq.stop); ok {
+		slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+
+		var tokenTruncated bool
+		origLen := len(seq.pendingResponses)
+		seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
+		newLen := len(seq.pendingResponses)
+		if seq.logprobs {
+			seq.pendingLogprobs = seq.pendingLogprobs[:newLen]
+		}
+		if seq.tokenTimings {
+			seq.pendingTimings = seq.pendingTimings[:newLen]
 		}
 
-		if common.IncompleteUnicode(sequence) {
-			continue
+		// Update the cache based on the tokens that will be returned:
+		// - We have 1 token more than is currently in the cache because
+		// the last one generated wasn't submitted to Decode, unless it's
+		// an accepted draft
+		// - Remove any stop sequences that we stripped out
+		// - If truncateStop removed a portion of a token, drop that
+		// - As defense-in-depth, if truncatedToken didn't find a stop token
+		// remove the extra one that we added to the cache len
+		tokenLen := len(seq.cache.Inputs) - ahead + 1
+		tokenLen -= origLen - newLen
+		if tokenTruncated || origLen == newLen {
+			tokenLen--
 		}
+		seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
+
+		seq.stopSequence = stop
+		s.removeSequence(i, llm.DoneReasonStop)
+		return true, nil
+	}
+
+	if common.ContainsStopSuffix(sequence, seq.stop) {
+		return false, nil
+	}
+
+	if !seq.rawBytes && common.IncompleteUnicode(sequence) {
+		return false, nil
+	}
+
+	if !flushPending(seq) {
+		s.removeSequence(i, llm.DoneReasonConnectionClosed)
+		return true, nil
+	}
 
-		if !flushPending(seq) {
-			s.removeSequence(i, llm.DoneReasonConnectionClosed)
+	return false, nil
+}
+
+// rejectDrafts removes the last n drafted tokens of seq from its cache
+func (s *Server) rejectDrafts(seq *Sequence, n int) error {
+	pos := len(seq.cache.Inputs) - n
+	if s.cache.cache != nil {
+		if err := s.cache.cache.Remove(seq.cache.Id, int32(pos), math.MaxInt32); err != nil {
+			return err
 		}
 	}
 
+	seq.cache.Inputs = seq.cache.Inputs[:pos]
 	return nil
 }
 
+const (
+	// lookaheadNgram is the longest run of recent tokens looked up to draft
+	// the next ones
+	lookaheadNgram = 3
+
+	// lookaheadTokens is the most tokens drafted at once
+	lookaheadTokens = 8
+)
+
+// draft proposes the tokens to follow the one last sampled for seq by prompt
+// lookup: those that followed the latest earlier occurrence of its last few
+// tokens, trying the longest runs first. The drafts are added to its inputs to
+// be verified in the same batch.
+func (seq *Sequence) draft(batchSize int) {
+	n := min(lookaheadTokens, batchSize-1)
+	if seq.numPredict > 0 {
+		n = min(n, seq.numPredict-seq.numPredicted-1)
+	}
+
+	if n <= 0 {
+		return
+	}
+
+	// multimodal inputs are never matched or drafted
+	history := make([]int32, 0, len(seq.cache.Inputs)+1)
+	for _, inp := range seq.cache.Inputs {
+		if inp.Multimodal != nil {
+			history = append(history, -1)
+		} else {
+			history = append(history, inp.Token)
+		}
+	}
+	history = append(history, seq.inputs[0].Token)
+
+	for ngram := min(lookaheadNgram, len(history)-1); ngram > 0 && seq.drafts == nil; ngram-- {
+		suffix := history[len(history)-ngram:]
+		for i := len(history) - ngram - 1; i >= 0; i-- {
+			if !slices.Equal(history[i:i+ngram], suffix) {
+				continue
+			}
+
+			for _, token := range history[i+ngram : min(i+ngram+n, len(history))] {
+				if token < 0 {
+					break
+				}
+				seq.drafts = append(seq.drafts, token)
+				seq.inputs = append(seq.inputs, input.Input{Token: token})
+			}
+			break
+		}
+	}
+
+	// the drafts must be evaluated with the token before them
+	seq.inputs[0].SameBatch = len(seq.drafts)
+	seq.numDrafted += len(seq.drafts)
+}
+
+// readSession reads the inputs and cache state of the session saved at path,
+// so that only restoring it into the cache needs to hold s.mu
+func readSession(path string) ([]input.Input, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	header, r, err := llm.ReadSessionHeader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inputs := make([]input.Input, len(header.Tokens))
+	for i, t := range header.Tokens {
+		inputs[i] = input.Input{Token: int32(t)}
+	}
+
+	return inputs, state, nil
+}
+
+func (s *Server) saveSession(w http.ResponseWriter, r *http.Request) {
+	var req llm.SaveSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	prompt := make([]input.Input, len(req.Tokens))
+	for i, t := range req.Tokens {
+		prompt[i] = input.Input{Token: int32(t)}
+	}
+
+	// the state is copied out under the lock and written to disk after
+	// releasing it so that saving doesn't hold up decoding
+	s.mu.Lock()
+	slot, inputs, err := s.cache.SessionSlot(prompt)
+	if err != nil {
+		s.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tokens := make([]int, len(inputs))
+	for i, inp := range inputs {
+		tokens[i] = int(inp.Token)
+	}
+
+	var state bytes.Buffer
+	err = s.cache.SaveSlot(slot, int32(len(inputs)), &state)
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := writeSession(req.Path, llm.SessionHeader{Model: req.Model, Tokens: tokens}, state.Bytes()); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(llm.SaveSessionResponse{Tokens: tokens}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// writeSession writes header to a new file at path followed by state
+func writeSession(path string, header llm.SessionHeader, state []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	if err := json.NewEncoder(bw).Encode(header); err != nil {
+		return err
+	}
+
+	if _, err := bw.Write(state); err != nil {
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
 func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	var req llm.CompletionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -624,24 +1146,85 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		req.Options.TopK,
 		req.Options.TopP,
 		req.Options.MinP,
+		req.Options.Mirostat,
+		req.Options.MirostatTau,
+		req.Options.MirostatEta,
 		req.Options.Seed,
 		grammar,
+		req.Options.LogitBias,
+		sample.Penalties{
+			LastN:     req.Options.RepeatLastN,
+			Repeat:    req.Options.RepeatPenalty,
+			Presence:  req.Options.PresencePenalty,
+			Frequency: req.Options.FrequencyPenalty,
+		},
 	)
 
+	if req.Options.TemperatureSchedule != "" {
+		schedule, err := api.ParseTemperatureSchedule(req.Options.TemperatureSchedule)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid temperature schedule: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if schedule.Tokens == 0 {
+			schedule.Tokens = req.Options.NumPredict
+		}
+		sampler.ScheduleTemperature(schedule.Temperature)
+	}
+
 	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
 		numPredict: req.Options.NumPredict,
 		stop:       req.Options.Stop,
-		numKeep:    int32(req.Options.NumKeep),
+		numKeep:    int32(req.Options.Keep()),
 		sampler:    sampler,
 		embedding:  false,
+
+		skipSpecialTokens: req.SkipSpecialTokens,
+		rawBytes:          req.Options.Bytes,
+		returnLogits:      req.Options.ReturnLogits,
+		logprobs:          req.Options.Logprobs,
+		topLogprobs:       req.Options.TopLogprobs,
+		rawLogits:         req.Options.RawLogits,
+		tokenTimings:      req.Options.ReturnTokenTimings,
+		stopTokens:        req.Options.StopTokens,
+		addBOS:            req.Options.AddBOS,
+		addEOS:            req.Options.AddEOS,
+		lookahead:         req.Options.Lookahead && req.Options.NegativePrompt == "",
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		if errors.Is(err, errPromptTruncated) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), status)
 		return
 	}
 
+	seq.numPinnedInputs = int(s.pinnedInputs(seq, req.Prompt, req.CachePrefix, !req.SkipSpecialTokens))
+
+	if req.Options.NegativePrompt != "" {
+		// the negative prompt needs a cache slot of its own
+		if s.parallel < 2 {
+			http.Error(w, "negative_prompt requires at least 2 parallel sequences", http.StatusBadRequest)
+			return
+		}
+
+		seq.guidance, err = s.NewSequence(req.Options.NegativePrompt, nil, NewSequenceParams{
+			numKeep:           int32(req.Options.Keep()),
+			skipSpecialTokens: req.SkipSpecialTokens,
+			addBOS:            req.Options.AddBOS,
+			addEOS:            req.Options.AddEOS,
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create guidance sequence: %v", err), http.StatusInternalServerError)
+			return
+		}
+		seq.guidanceScale = req.Options.GuidanceScale
+	}
+
 	// Ensure there is a place to put the sequence, released when removed from s.seqs
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+	if err := s.seqsSem.Acquire(r.Context(), seq.slots()); err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting completion request due to client closing the connection")
 		} else {
@@ -650,17 +1233,49 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var sessionInputs []input.Input
+	var sessionState []byte
+	if req.Session != "" {
+		sessionInputs, sessionState, err = readSession(req.Session)
+		if err != nil {
+			s.seqsSem.Release(seq.slots())
+			http.Error(w, fmt.Sprintf("Failed to restore session: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
 	s.mu.Lock()
+	if req.Session != "" {
+		if err := s.cache.LoadSession(sessionInputs, bytes.NewReader(sessionState)); err != nil {
+			s.mu.Unlock()
+			s.seqsSem.Release(seq.slots())
+			http.Error(w, fmt.Sprintf("Failed to restore session: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
 	found := false
 	for i, sq := range s.seqs {
 		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs)
+			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, int32(seq.numPinnedInputs))
 			if err != nil {
 				s.mu.Unlock()
-				s.seqsSem.Release(1)
+				s.seqsSem.Release(seq.slots())
 				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
 				return
 			}
+			seq.numCachedInputs = seq.numPromptInputs - len(seq.inputs)
+
+			if g := seq.guidance; g != nil {
+				g.cache, g.inputs, err = s.cache.LoadCacheSlot(g.inputs, 0)
+				if err != nil {
+					seq.cache.InUse = false
+					s.mu.Unlock()
+					s.seqsSem.Release(seq.slots())
+					http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
+					return
+				}
+			}
 
 			s.seqs[i] = seq
 			s.cond.Signal()
@@ -671,7 +1286,7 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	s.mu.Unlock()
 
 	if !found {
-		s.seqsSem.Release(1)
+		s.seqsSem.Release(seq.slots())
 		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
 		return
 	}
@@ -681,11 +1296,31 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		case <-r.Context().Done():
 			close(seq.quit)
 			return
+		case processed := <-seq.progress:
+			if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
+				PromptEvalProgress: &api.PromptEvalProgress{
+					Processed: processed,
+					Total:     seq.numPromptInputs,
+				},
+			}); err != nil {
+				http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+				close(seq.quit)
+				return
+			}
+
+			flusher.Flush()
 		case content, ok := <-seq.responses:
 			if ok {
-				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
-					Content: content,
-				}); err != nil {
+				resp := llm.CompletionResponse{Content: content.content}
+				if seq.rawBytes {
+					// JSON strings can only hold valid UTF-8
+					resp = llm.CompletionResponse{Bytes: []byte(content.content)}
+				}
+				resp.Logprobs = content.logprobs
+				resp.Tokens = content.tokens
+				resp.TokenTimings = content.timings
+
+				if err := json.NewEncoder(w).Encode(&resp); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 					close(seq.quit)
 					return
@@ -696,10 +1331,17 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
 					Done:               true,
 					DoneReason:         seq.doneReason,
+					StopSequence:       seq.stopSequence,
+					StopToken:          seq.stopToken,
 					PromptEvalCount:    seq.numPromptInputs,
+					CachedPromptCount:  seq.numCachedInputs,
+					DraftCount:         seq.numDrafted,
+					AcceptedDraftCount: seq.numAccepted,
+					CachePrefixCount:   seq.numPinnedInputs,
 					PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime),
 					EvalCount:          seq.numPredicted,
 					EvalDuration:       time.Since(seq.startGenerationTime),
+					Logits:             seq.logits,
 				}); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
 				}
@@ -710,16 +1352,63 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// updateUsage records the cache's usage for health checks. s.mu must be
+// held.
+func (s *Server) updateUsage() {
+	if s.cache == nil {
+		return
+	}
+
+	used, total := s.cache.Usage()
+	s.contextUsed.Store(int64(used))
+	s.contextTotal.Store(int64(total))
+}
+
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(&llm.ServerStatusResponse{
+	resp := llm.ServerStatusResponse{
 		Status:   s.status,
 		Progress: s.progress,
-	}); err != nil {
+	}
+
+	if s.status == llm.ServerStatusReady {
+		used, total := int(s.contextUsed.Load()), int(s.contextTotal.Load())
+
+		vram, layers := gpuUsage(s.model.Backend().BackendMemory())
+		resp.Usage = &llm.ServerUsage{
+			ContextUsed:    used,
+			ContextTotal:   total,
+			VRAM:           vram,
+			GPULayers:      len(layers),
+			GPULayerRanges: api.FormatLayerRanges(layers),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
 		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
 	}
 }
 
+// gpuUsage returns the GPU memory the backend has allocated and the layers
+// with weights allocated on a GPU
+func gpuUsage(m ml.BackendMemory) (vram uint64, layers []int) {
+	for _, g := range m.GPUs {
+		for _, mem := range slices.Concat(g.Weights, g.Cache, []ml.Memory{g.Graph}) {
+			if mem.Status == ml.Allocated {
+				vram += mem.Size
+			}
+		}
+	}
+
+	for i := range m.CPU.Weights {
+		if slices.ContainsFunc(m.GPUs, func(g ml.DeviceMemory) bool { return g.Weights[i].Status == ml.Allocated }) {
+			layers = append(layers, i)
+		}
+	}
+
+	return vram, layers
+}
+
 type multiLPath []string
 
 func (m *multiLPath) Set(value string) error {
@@ -731,6 +1420,27 @@ func (m *multiLPath) String() string {
 	return strings.Join(*m, ", ")
 }
 
+type kvOverrides map[string]string
+
+func (m kvOverrides) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid gguf override %q, expected key=value", s)
+	}
+
+	m[key] = value
+	return nil
+}
+
+func (m kvOverrides) String() string {
+	var overrides []string
+	for key, value := range m {
+		overrides = append(overrides, key+"="+value)
+	}
+
+	return strings.Join(overrides, ", ")
+}
+
 func (s *Server) reserveWorstCaseGraph() error {
 	ctx := s.model.Backend().NewContext()
 	defer ctx.Close()
@@ -852,6 +1562,7 @@ func (s *Server) initModel(
 	if err != nil {
 		return err
 	}
+	s.updateUsage()
 
 	if !s.cache.enabled && parallel > 1 {
 		parallel = 1
@@ -900,6 +1611,7 @@ func Execute(args []string) error {
 	parallel := fs.Int("parallel", 1, "Number of sequences to handle simultaneously")
 	batchSize := fs.Int("batch-size", 512, "Batch size")
 	numGPULayers := fs.Int("n-gpu-layers", 0, "Number of layers to offload to GPU")
+	gpuLayerRanges := fs.String("gpu-layer-ranges", "", "Layers to offload to GPU as comma-separated layers or ranges, e.g. 0-9,20-31 (overrides n-gpu-layers)")
 	mainGPU := fs.Int("main-gpu", 0, "Main GPU")
 	flashAttention := fs.Bool("flash-attn", false, "Enable flash attention")
 	kvSize := fs.Int("ctx-size", 2048, "Context (or KV cache) size")
@@ -910,10 +1622,16 @@ func Execute(args []string) error {
 	_ = fs.Bool("no-mmap", false, "do not memory-map model (slower load but may reduce pageouts if not using mlock)")
 	tensorSplit := fs.String("tensor-split", "", "fraction of the model to offload to each GPU, comma-separated list of proportions")
 	multiUserCache := fs.Bool("multiuser-cache", false, "optimize input cache algorithm for multiple users")
+	ropeScalingType := fs.String("rope-scaling-type", "", "RoPE scaling method to extend the context, linear or yarn (default: from model)")
+	ropeFreqScale := fs.Float64("rope-freq-scale", 0, "RoPE frequency scaling factor, used with rope-scaling-type")
+	ropeFactors := fs.String("rope-factors", "", "RoPE frequency factors replacing the model's, comma-separated list")
 
 	var lpaths multiLPath
 	fs.Var(&lpaths, "lora", "Path to lora layer file (can be specified multiple times)")
 
+	kvOverrides := make(kvOverrides)
+	fs.Var(kvOverrides, "gguf-override", "Override a model metadata key as key=value (can be specified multiple times)")
+
 	fs.Usage = func() {
 		fmt.Fprintf(fs.Output(), "Runner usage\n")
 		fs.PrintDefaults()
@@ -948,12 +1666,40 @@ func Execute(args []string) error {
 		}
 	}
 
+	var ropeFactorFloats []float32
+	if *ropeFactors != "" {
+		factors := strings.Split(*ropeFactors, ",")
+		ropeFactorFloats = make([]float32, len(factors))
+		for i, s := range factors {
+			f, err := strconv.ParseFloat(s, 32)
+			if err != nil {
+				return fmt.Errorf("rope-factors: %w", err)
+			}
+			ropeFactorFloats[i] = float32(f)
+		}
+	}
+
+	var gpuLayers []int
+	if *gpuLayerRanges != "" {
+		var err error
+		gpuLayers, err = api.ParseLayerRanges(*gpuLayerRanges)
+		if err != nil {
+			return fmt.Errorf("gpu-layer-ranges: %w", err)
+		}
+	}
+
 	params := ml.BackendParams{
 		NumThreads:     *threads,
 		NumGPULayers:   *numGPULayers,
+		GPULayers:      gpuLayers,
 		MainGPU:        *mainGPU,
 		TensorSplit:    tensorSplitFloats,
 		FlashAttention: *flashAttention,
+		KVOverrides:    kvOverrides,
+
+		RopeScalingType:    *ropeScalingType,
+		RopeFrequencyScale: float32(*ropeFreqScale),
+		RopeFactors:        ropeFactorFloats,
 	}
 
 	go server.load(ctx, *mpath, params, lpaths, *parallel, *kvCacheType, *kvSize, *multiUserCache)
@@ -974,6 +1720,7 @@ func Execute(args []string) error {
 	})
 
 	mux.HandleFunc("POST /completion", server.completion)
+	mux.HandleFunc("POST /session/save", server.saveSession)
 	mux.HandleFunc("GET /health", server.health)
 
 	httpServer := http.Server{
@@ -0,0 +1,842 @@
+package ollamarunner
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ollama/ollama/api"
+	fsggml "github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/ml/backend/ggml"
+	"github.com/ollama/ollama/model"
+	"github.com/ollama/ollama/model/input"
+	"github.com/ollama/ollama/sample"
+)
+
+func TestGPUUsage(t *testing.T) {
+	m := ml.BackendMemory{
+		CPU: ml.DeviceMemory{
+			Weights: []ml.Memory{{Size: 10, Status: ml.Allocated}, {}, {}, {}},
+		},
+		GPUs: []ml.DeviceMemory{
+			{
+				Weights: []ml.Memory{{}, {Size: 100, Status: ml.Allocated}, {}, {}},
+				Cache:   []ml.Memory{{}, {Size: 20, Status: ml.Allocated}, {}, {}},
+				Graph:   ml.Memory{Size: 5, Status: ml.Allocated},
+			},
+			{
+				// the last layer was required but failed to allocate
+				Weights: []ml.Memory{{}, {}, {Size: 100, Status: ml.Allocated}, {Size: 50, Status: ml.Failed}},
+				Cache:   []ml.Memory{{}, {}, {Size: 20, Status: ml.Allocated}, {}},
+				Graph:   ml.Memory{Size: 5, Status: ml.Unallocated},
+			},
+		},
+	}
+
+	vram, layers := gpuUsage(m)
+	if vram != 245 {
+		t.Errorf("vram = %d, want 245", vram)
+	}
+
+	if !slices.Equal(layers, []int{1, 2}) {
+		t.Errorf("layers = %v, want [1 2]", layers)
+	}
+}
+
+type textModel struct {
+	model.Base
+	model.BytePairEncoding
+}
+
+func (textModel) Forward(ml.Context, input.Batch) (ml.Tensor, error) {
+	return nil, nil
+}
+
+func TestInputsSkipSpecialTokens(t *testing.T) {
+	s := &Server{
+		model: &textModel{
+			BytePairEncoding: model.NewBytePairEncoding(`\S+|\s+`, &model.Vocabulary{
+				Values: []string{"<s>", "h", "i", "hi"},
+				Types:  []int32{model.TOKEN_TYPE_CONTROL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL},
+				Merges: []string{"h i"},
+				BOS:    []int32{0},
+				AddBOS: true,
+			}),
+		},
+	}
+
+	tokens := func(prompt string, addSpecial bool) []int32 {
+		inputs, _, _, err := s.inputs(prompt, nil, addSpecial)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var tokens []int32
+		for _, inp := range inputs {
+			tokens = append(tokens, inp.Token)
+		}
+		return tokens
+	}
+
+	if got := tokens("hi", true); !slices.Equal(got, []int32{0, 3}) {
+		t.Errorf("expected BOS to be inserted, got %v", got)
+	}
+
+	// a prompt that already starts with BOS keeps exactly one
+	if got := tokens("<s>hi", false); !slices.Equal(got, []int32{0, 3}) {
+		t.Errorf("expected no extra BOS, got %v", got)
+	}
+
+	if got := tokens("hi", false); !slices.Equal(got, []int32{3}) {
+		t.Errorf("expected no BOS, got %v", got)
+	}
+}
+
+func TestPromptInputsSpecialTokens(t *testing.T) {
+	s := &Server{
+		model: &textModel{
+			BytePairEncoding: model.NewBytePairEncoding(`\S+|\s+`, &model.Vocabulary{
+				Values: []string{"<s>", "h", "i", "hi", "</s>"},
+				Types:  []int32{model.TOKEN_TYPE_CONTROL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_CONTROL},
+				Merges: []string{"h i"},
+				BOS:    []int32{0},
+				EOS:    []int32{4},
+				AddBOS: true,
+			}),
+		},
+	}
+
+	yes, no := true, false
+	cases := []struct {
+		name   string
+		params NewSequenceParams
+		want   []int32
+	}{
+		{name: "default", want: []int32{0, 3}},
+		{name: "skip special tokens", params: NewSequenceParams{skipSpecialTokens: true}, want: []int32{3}},
+		{name: "no bos", params: NewSequenceParams{addBOS: &no}, want: []int32{3}},
+		{name: "add bos", params: NewSequenceParams{addBOS: &yes}, want: []int32{0, 3}},
+		{name: "add bos over skip", params: NewSequenceParams{addBOS: &yes, skipSpecialTokens: true}, want: []int32{0, 3}},
+		{name: "add eos", params: NewSequenceParams{addEOS: &yes}, want: []int32{0, 3, 4}},
+		{name: "no eos", params: NewSequenceParams{addEOS: &no}, want: []int32{0, 3}},
+		{name: "add eos over skip", params: NewSequenceParams{addEOS: &yes, skipSpecialTokens: true}, want: []int32{3, 4}},
+		{name: "add both", params: NewSequenceParams{addBOS: &yes, addEOS: &yes}, want: []int32{0, 3, 4}},
+		{name: "no bos add eos", params: NewSequenceParams{addBOS: &no, addEOS: &yes}, want: []int32{3, 4}},
+		{name: "neither", params: NewSequenceParams{addBOS: &no, addEOS: &no}, want: []int32{3}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			inputs, _, _, err := s.promptInputs("hi", nil, tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []int32
+			for _, inp := range inputs {
+				got = append(got, inp.Token)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFlushPendingRawBytes(t *testing.T) {
+	cases := []struct {
+		name     string
+		rawBytes bool
+		want     string
+	}{
+		{name: "text", want: "a"},
+		{name: "raw bytes", rawBytes: true, want: "a\xf0\x9f"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			seq := &Sequence{
+				// the first half of 👋
+				pendingResponses: []string{"a", "\xf0\x9f"},
+				responses:        make(chan response, 1),
+				quit:             make(chan bool, 1),
+				rawBytes:         tt.rawBytes,
+			}
+
+			if !flushPending(seq) {
+				t.Fatal("expected flush to succeed")
+			}
+
+			if got := (<-seq.responses).content; got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlushPendingTimings(t *testing.T) {
+	timings := []time.Duration{time.Millisecond, 2 * time.Millisecond}
+	seq := &Sequence{
+		pendingResponses: []string{"a", "b"},
+		pendingTimings:   timings,
+		responses:        make(chan response, 1),
+		quit:             make(chan bool, 1),
+		tokenTimings:     true,
+	}
+
+	if !flushPending(seq) {
+		t.Fatal("expected flush to succeed")
+	}
+
+	resp := <-seq.responses
+	if resp.tokens != 2 || !slices.Equal(resp.timings, timings) {
+		t.Errorf("expected 2 tokens with timings %v, got %d with %v", timings, resp.tokens, resp.timings)
+	}
+
+	if seq.pendingTimings != nil {
+		t.Errorf("expected pending timings to be cleared, got %v", seq.pendingTimings)
+	}
+}
+
+// logitsModel is a tiny model that produces the same logits for every output
+type logitsModel struct {
+	textModel
+	backend ml.Backend
+	logits  []float32
+}
+
+func (m *logitsModel) Backend() ml.Backend {
+	return m.backend
+}
+
+func (m *logitsModel) Forward(ctx ml.Context, batch input.Batch) (ml.Tensor, error) {
+	var logits []float32
+	for range batch.Outputs {
+		logits = append(logits, m.logits...)
+	}
+
+	return ctx.Input().FromFloatSlice(logits, len(m.logits), len(batch.Outputs)), nil
+}
+
+func TestProcessBatchReturnLogits(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fsggml.WriteGGUF(f, fsggml.KV{"general.architecture": "test"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ggml.New(f.Name(), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vocab := &model.Vocabulary{
+		Values: []string{"<s>", "h", "i", "hi"},
+		Types:  []int32{model.TOKEN_TYPE_CONTROL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL},
+		Merges: []string{"h i"},
+	}
+
+	for _, returnLogits := range []bool{false, true} {
+		m := &logitsModel{
+			textModel: textModel{BytePairEncoding: model.NewBytePairEncoding(`\S+|\s+`, vocab)},
+			backend:   b,
+			logits:    []float32{-1, 0.5, 2, 3.5},
+		}
+
+		s := &Server{
+			model:     m,
+			batchSize: 8,
+			seqsSem:   semaphore.NewWeighted(1),
+			cache:     &InputCache{numCtx: 16, enabled: true},
+		}
+		s.cond = sync.NewCond(&s.mu)
+
+		seq := &Sequence{
+			inputs:       []input.Input{{Token: 1}},
+			cache:        &InputCacheSlot{},
+			responses:    make(chan response, 1),
+			embedding:    make(chan []float32, 1),
+			quit:         make(chan bool, 1),
+			sampler:      sample.NewSampler(0, 0, 0, 0, 0, 0, 0, -1, nil, nil, sample.Penalties{}),
+			returnLogits: returnLogits,
+		}
+		s.seqs = []*Sequence{seq}
+
+		if err := s.processBatch(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := (<-seq.responses).content; got != "hi" {
+			t.Errorf("expected the most likely token, got %q", got)
+		}
+
+		if !returnLogits {
+			if seq.logits != nil {
+				t.Errorf("expected no logits, got %v", seq.logits)
+			}
+			continue
+		}
+
+		if len(seq.logits) != len(vocab.Values) {
+			t.Fatalf("expected %d logits, one for each token in the vocabulary, got %d", len(vocab.Values), len(seq.logits))
+		}
+
+		if !slices.Equal(seq.logits, m.logits) {
+			t.Errorf("expected logits %v, got %v", m.logits, seq.logits)
+		}
+	}
+}
+
+func TestProcessBatchStopTokens(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fsggml.WriteGGUF(f, fsggml.KV{"general.architecture": "test"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ggml.New(f.Name(), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vocab := &model.Vocabulary{
+		Values: []string{"<s>", "h", "i", "hi"},
+		Types:  []int32{model.TOKEN_TYPE_CONTROL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL},
+		Merges: []string{"h i"},
+	}
+
+	cases := []struct {
+		name       string
+		stopTokens []int
+		stop       []string
+		want       []string
+	}{
+		{name: "other token", stopTokens: []int{2}, want: []string{"hi"}},
+		{name: "sampled token", stopTokens: []int{3}},
+		// a stop token ends generation before its text could match a stop
+		// sequence
+		{name: "with stop sequence", stopTokens: []int{3}, stop: []string{"hi"}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				model: &logitsModel{
+					textModel: textModel{BytePairEncoding: model.NewBytePairEncoding(`\S+|\s+`, vocab)},
+					backend:   b,
+					logits:    []float32{-1, 0.5, 2, 3.5},
+				},
+				batchSize: 8,
+				seqsSem:   semaphore.NewWeighted(1),
+				cache:     &InputCache{numCtx: 16, enabled: true},
+			}
+			s.cond = sync.NewCond(&s.mu)
+
+			seq := &Sequence{
+				inputs:     []input.Input{{Token: 1}},
+				cache:      &InputCacheSlot{},
+				responses:  make(chan response, 1),
+				embedding:  make(chan []float32, 1),
+				quit:       make(chan bool, 1),
+				sampler:    sample.NewSampler(0, 0, 0, 0, 0, 0, 0, -1, nil, nil, sample.Penalties{}),
+				stop:       tt.stop,
+				stopTokens: tt.stopTokens,
+			}
+			s.seqs = []*Sequence{seq}
+
+			// removing the sequence releases the slot the handler acquired
+			if err := s.seqsSem.Acquire(t.Context(), 1); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.processBatch(); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want != nil {
+				if got := (<-seq.responses).content; got != tt.want[0] {
+					t.Errorf("expected %q, got %q", tt.want[0], got)
+				}
+				return
+			}
+
+			if got, ok := <-seq.responses; ok {
+				t.Errorf("expected generation to stop without a response, got %q", got.content)
+			}
+
+			if seq.doneReason != llm.DoneReasonStop || seq.stopSequence != "" || seq.stopToken != "hi" {
+				t.Errorf("expected to stop on the token, got %v %q %q", seq.doneReason, seq.stopSequence, seq.stopToken)
+			}
+
+			if len(seq.cache.Inputs) != 1 {
+				t.Errorf("expected only the prompt in the cache, got %v", seq.cache.Inputs)
+			}
+		})
+	}
+}
+
+// slotLogitsModel produces logits that depend on the cache slot of each output
+type slotLogitsModel struct {
+	textModel
+	backend ml.Backend
+	logits  map[int][]float32
+}
+
+func (m *slotLogitsModel) Backend() ml.Backend {
+	return m.backend
+}
+
+func (m *slotLogitsModel) Forward(ctx ml.Context, batch input.Batch) (ml.Tensor, error) {
+	var logits []float32
+	for _, i := range batch.Outputs {
+		logits = append(logits, m.logits[batch.Sequences[i]]...)
+	}
+
+	return ctx.Input().FromFloatSlice(logits, 4, len(batch.Outputs)), nil
+}
+
+func TestProcessBatchGuidance(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fsggml.WriteGGUF(f, fsggml.KV{"general.architecture": "test"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ggml.New(f.Name(), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vocab := &model.Vocabulary{
+		Values: []string{"<s>", "h", "i", "hi"},
+		Types:  []int32{model.TOKEN_TYPE_CONTROL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL},
+		Merges: []string{"h i"},
+	}
+
+	m := &slotLogitsModel{
+		textModel: textModel{BytePairEncoding: model.NewBytePairEncoding(`\S+|\s+`, vocab)},
+		backend:   b,
+		logits: map[int][]float32{
+			0: {-1, 0.5, 2, 3.5},
+			// the negative prompt favours "hi" even more
+			1: {0, 0, 0, 4},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		negative []input.Input
+		batches  int
+		want     string
+	}{
+		{name: "unguided", want: "hi"},
+		{name: "guided", negative: []input.Input{{Token: 1}}, batches: 1, want: "i"},
+		// the negative prompt takes another batch to process, so sampling
+		// waits for it
+		{name: "guided over batches", negative: []input.Input{{Token: 1}, {Token: 1}, {Token: 1}}, batches: 2, want: "i"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				model:     m,
+				batchSize: 2,
+				seqsSem:   semaphore.NewWeighted(2),
+				cache:     &InputCache{numCtx: 16, enabled: true},
+			}
+			s.cond = sync.NewCond(&s.mu)
+
+			seq := &Sequence{
+				inputs:    []input.Input{{Token: 1}},
+				cache:     &InputCacheSlot{Id: 0},
+				responses: make(chan response, 1),
+				embedding: make(chan []float32, 1),
+				quit:      make(chan bool, 1),
+				sampler:   sample.NewSampler(0, 0, 0, 0, 0, 0, 0, -1, nil, nil, sample.Penalties{}),
+			}
+
+			if tt.negative != nil {
+				seq.guidance = &Sequence{inputs: tt.negative, cache: &InputCacheSlot{Id: 1}}
+				seq.guidanceScale = 2
+			}
+			s.seqs = []*Sequence{seq}
+
+			for range max(tt.batches, 1) {
+				if len(seq.responses) > 0 {
+					t.Fatal("expected sampling to wait for the negative prompt")
+				}
+
+				if err := s.processBatch(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := (<-seq.responses).content; got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+
+			if g := seq.guidance; g != nil {
+				if len(g.cache.Inputs) != len(tt.negative) {
+					t.Errorf("expected the negative prompt to be processed, got %v", g.cache.Inputs)
+				}
+
+				// the sampled token continues both prompts
+				if len(g.inputs) != 1 || g.inputs[0].Token != seq.inputs[0].Token {
+					t.Errorf("expected guidance inputs %v, got %v", seq.inputs, g.inputs)
+				}
+			}
+		})
+	}
+}
+
+func TestCompletionCachedPrompt(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fsggml.WriteGGUF(f, fsggml.KV{"general.architecture": "test"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ggml.New(f.Name(), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vocab := &model.Vocabulary{
+		Values: []string{"<s>", "h", "i", "hi"},
+		Types:  []int32{model.TOKEN_TYPE_CONTROL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL},
+		Merges: []string{"h i"},
+	}
+
+	s := &Server{
+		model: &logitsModel{
+			textModel: textModel{BytePairEncoding: model.NewBytePairEncoding(`\S+|\s+`, vocab)},
+			backend:   b,
+			logits:    []float32{-1, 0.5, 2, 3.5},
+		},
+		parallel:  1,
+		batchSize: 8,
+		seqs:      make([]*Sequence, 1),
+		seqsSem:   semaphore.NewWeighted(1),
+		cache:     &InputCache{numCtx: 16, enabled: true, slots: []InputCacheSlot{{Id: 0}}},
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run(t.Context())
+
+	complete := func(t *testing.T) llm.CompletionResponse {
+		t.Helper()
+
+		opts := api.DefaultOptions()
+		opts.NumPredict = 1
+		opts.Temperature = 0
+
+		bts, err := json.Marshal(llm.CompletionRequest{Prompt: "hihihi", Options: &opts})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		s.completion(w, httptest.NewRequest(http.MethodPost, "/completion", bytes.NewReader(bts)))
+
+		var resp llm.CompletionResponse
+		decoder := json.NewDecoder(w.Body)
+		for {
+			var r llm.CompletionResponse
+			if err := decoder.Decode(&r); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			resp = r
+		}
+
+		if !resp.Done {
+			t.Fatalf("expected a final response, got %+v", resp)
+		}
+		return resp
+	}
+
+	if resp := complete(t); resp.PromptEvalCount != 3 || resp.CachedPromptCount != 0 {
+		t.Errorf("expected 3 prompt tokens with none cached, got %d with %d cached", resp.PromptEvalCount, resp.CachedPromptCount)
+	}
+
+	// all but the last token, which is evaluated again to sample from, are
+	// reused the second time
+	if resp := complete(t); resp.PromptEvalCount != 3 || resp.CachedPromptCount != 2 {
+		t.Errorf("expected 3 prompt tokens with 2 cached, got %d with %d cached", resp.PromptEvalCount, resp.CachedPromptCount)
+	}
+}
+
+func TestCompletionContextShift(t *testing.T) {
+	// keep_tokens takes the place of num_keep when it's set
+	cases := []struct {
+		name                string
+		numKeep, keepTokens int
+	}{
+		{name: "num_keep", numKeep: 1},
+		{name: "keep_tokens", keepTokens: 1},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			if err := fsggml.WriteGGUF(f, fsggml.KV{"general.architecture": "test"}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := ggml.New(f.Name(), ml.BackendParams{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			vocab := &model.Vocabulary{
+				Values: []string{"<s>", "h", "i", "hi"},
+				Types:  []int32{model.TOKEN_TYPE_CONTROL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL},
+				Merges: []string{"h i"},
+			}
+
+			const numCtx = 8
+			s := &Server{
+				model: &logitsModel{
+					textModel: textModel{BytePairEncoding: model.NewBytePairEncoding(`\S+|\s+`, vocab)},
+					backend:   b,
+					logits:    []float32{-1, 0.5, 2, 3.5},
+				},
+				parallel:  1,
+				batchSize: 8,
+				seqs:      make([]*Sequence, 1),
+				seqsSem:   semaphore.NewWeighted(1),
+				cache:     &InputCache{numCtx: numCtx, enabled: true, slots: []InputCacheSlot{{Id: 0}}},
+			}
+			s.cond = sync.NewCond(&s.mu)
+			go s.run(t.Context())
+
+			// generate several times the context window, keeping the first token of
+			// the prompt
+			opts := api.DefaultOptions()
+			opts.NumCtx = numCtx
+			opts.NumKeep = tt.numKeep
+			opts.KeepTokens = tt.keepTokens
+			opts.NumPredict = 3 * numCtx
+			opts.Temperature = 0
+
+			bts, err := json.Marshal(llm.CompletionRequest{Prompt: "hhi", Options: &opts})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			s.completion(w, httptest.NewRequest(http.MethodPost, "/completion", bytes.NewReader(bts)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var content strings.Builder
+			var resp llm.CompletionResponse
+			decoder := json.NewDecoder(w.Body)
+			for {
+				var r llm.CompletionResponse
+				if err := decoder.Decode(&r); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				content.WriteString(r.Content)
+				resp = r
+			}
+
+			if !resp.Done || resp.DoneReason != llm.DoneReasonLength {
+				t.Fatalf("expected generation to stop at num_predict, got %+v", resp)
+			}
+
+			if resp.EvalCount != opts.NumPredict || content.String() != strings.Repeat("hi", opts.NumPredict) {
+				t.Errorf("expected %d tokens, got %d: %q", opts.NumPredict, resp.EvalCount, content.String())
+			}
+
+			// the cache never grows past the context window and keeps the pinned
+			// prompt token through each shift
+			slot := s.cache.slots[0]
+			if len(slot.Inputs) > numCtx {
+				t.Errorf("expected at most %d cached inputs, got %d", numCtx, len(slot.Inputs))
+			}
+
+			if len(slot.Inputs) == 0 || slot.Inputs[0].Token != 1 {
+				t.Errorf("expected the kept token 1 first, got %v", slot.Inputs)
+			}
+		})
+	}
+}
+
+// cycleModel predicts the tokens 1, 2 and 3 over and over by position and
+// counts the batches it's run on
+type cycleModel struct {
+	textModel
+	backend  ml.Backend
+	forwards int
+}
+
+func (m *cycleModel) Backend() ml.Backend {
+	return m.backend
+}
+
+func (m *cycleModel) Forward(ctx ml.Context, batch input.Batch) (ml.Tensor, error) {
+	m.forwards++
+
+	var logits []float32
+	for _, i := range batch.Outputs {
+		next := make([]float32, 4)
+		next[(batch.Positions[i]+1)%3+1] = 1
+		logits = append(logits, next...)
+	}
+
+	return ctx.Input().FromFloatSlice(logits, 4, len(batch.Outputs)), nil
+}
+
+func TestProcessBatchLookahead(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "model.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := fsggml.WriteGGUF(f, fsggml.KV{"general.architecture": "test"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ggml.New(f.Name(), ml.BackendParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vocab := &model.Vocabulary{
+		Values: []string{"<s>", "a", "b", "c"},
+		Types:  []int32{model.TOKEN_TYPE_CONTROL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL, model.TOKEN_TYPE_NORMAL},
+	}
+
+	generate := func(t *testing.T, prompt []int32, lookahead bool) (string, *Sequence, int) {
+		t.Helper()
+
+		m := &cycleModel{
+			textModel: textModel{BytePairEncoding: model.NewBytePairEncoding(`\S+|\s+`, vocab)},
+			backend:   b,
+		}
+
+		s := &Server{
+			model:     m,
+			batchSize: 16,
+			seqsSem:   semaphore.NewWeighted(1),
+			cache:     &InputCache{numCtx: 64, enabled: true},
+		}
+		s.cond = sync.NewCond(&s.mu)
+
+		var inputs []input.Input
+		for _, token := range prompt {
+			inputs = append(inputs, input.Input{Token: token})
+		}
+
+		seq := &Sequence{
+			inputs:     inputs,
+			cache:      &InputCacheSlot{},
+			numPredict: 12,
+			responses:  make(chan response, 100),
+			embedding:  make(chan []float32, 1),
+			quit:       make(chan bool, 1),
+			sampler:    sample.NewSampler(0, 0, 0, 0, 0, 0, 0, -1, nil, nil, sample.Penalties{}),
+			lookahead:  lookahead,
+		}
+		s.seqs = []*Sequence{seq}
+
+		if err := s.seqsSem.Acquire(t.Context(), 1); err != nil {
+			t.Fatal(err)
+		}
+
+		for s.seqs[0] != nil {
+			if err := s.processBatch(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var sb strings.Builder
+		for piece := range seq.responses {
+			sb.WriteString(piece.content)
+		}
+
+		return sb.String(), seq, m.forwards
+	}
+
+	cases := []struct {
+		name   string
+		prompt []int32
+		want   string
+		// rejected is whether any draft is rejected
+		rejected bool
+	}{
+		// the prompt repeats what the model generates
+		{name: "repetitive", prompt: []int32{1, 2, 3, 1, 2, 3}, want: "abcabcabcabc"},
+		// the "a" generated first is drafted to be followed by "b" and "a", as
+		// the one in the prompt was, but the model follows "ab" with "c"
+		{name: "rejected drafts", prompt: []int32{1, 2, 3, 3, 1, 2}, want: "abcabcabcabc", rejected: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			want, _, forwards := generate(t, tt.prompt, false)
+			if want != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, want)
+			}
+
+			got, seq, lookaheadForwards := generate(t, tt.prompt, true)
+			if got != want {
+				t.Errorf("expected the same response with lookahead, got %q, want %q", got, want)
+			}
+
+			if lookaheadForwards >= forwards {
+				t.Errorf("expected fewer batches with lookahead, got %d, without %d", lookaheadForwards, forwards)
+			}
+
+			if seq.numDrafted == 0 || (seq.numAccepted < seq.numDrafted) != tt.rejected {
+				t.Errorf("expected drafts to be rejected %t, got %d of %d accepted", tt.rejected, seq.numAccepted, seq.numDrafted)
+			}
+
+			// the prompt and every generated token but the last, which wasn't
+			// evaluated, and no rejected drafts
+			if seq.numPredicted != 12 || len(seq.cache.Inputs) != len(tt.prompt)+11 {
+				t.Errorf("expected 12 tokens with all but the last in the cache, got %d with %d cached", seq.numPredicted, len(seq.cache.Inputs))
+			}
+		})
+	}
+}
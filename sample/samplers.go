@@ -23,6 +23,69 @@ type Sampler struct {
 	minP        float32
 	temperature float32
 	grammar     *GrammarSampler
+	logitBias   map[int]float32
+
+	// schedule, if set, gives the temperature of each token from the number
+	// of tokens sampled before it
+	schedule func(n int) float32
+	sampled  int
+
+	// mirostat controls the output perplexity instead of a fixed top_k or
+	// top_p, adjusting mu after every token so the observed surprise tracks
+	// mirostatTau
+	mirostat    int
+	mirostatTau float32
+	mirostatEta float32
+	mu          float32
+	surprise    float32
+
+	// penalties lower the logits of the tokens in history, the most recently
+	// sampled tokens
+	penalties Penalties
+	history   []int32
+}
+
+// Penalties discourage the sampler from repeating the tokens it has sampled
+// most recently. They are applied the same way as by llama.cpp.
+type Penalties struct {
+	// LastN is the number of recently sampled tokens that are penalized. Zero
+	// disables penalties and -1 penalizes every token sampled so far.
+	LastN int
+
+	// Repeat divides positive logits and multiplies negative logits of
+	// tokens that were sampled. 1 disables it.
+	Repeat float32
+
+	// Presence is subtracted once from the logits of tokens that were sampled,
+	// no matter how often.
+	Presence float32
+
+	// Frequency is subtracted from the logits of tokens once for every time
+	// they were sampled.
+	Frequency float32
+}
+
+func (p Penalties) enabled() bool {
+	return p.LastN != 0 && (p.Repeat != 1 || p.Presence != 0 || p.Frequency != 0)
+}
+
+// Guide combines the logits of a prompt with those of a negative prompt for
+// classifier-free guidance, moving them scale times as far from the negative
+// logits as they are. A scale of 1 leaves the logits unchanged.
+func Guide(logits, negative []float32, scale float32) []float32 {
+	guided := make([]float32, len(logits))
+	for i := range logits {
+		guided[i] = negative[i] + scale*(logits[i]-negative[i])
+	}
+
+	return guided
+}
+
+// ScheduleTemperature replaces the sampler's constant temperature with
+// temperature(n) for the token at position n, counting from 0 for the first
+// token sampled.
+func (s *Sampler) ScheduleTemperature(temperature func(n int) float32) {
+	s.schedule = temperature
 }
 
 func (s *Sampler) Sample(logits []float32) (int32, error) {
@@ -30,6 +93,23 @@ func (s *Sampler) Sample(logits []float32) (int32, error) {
 		return -1, errors.New("sample: no logits provided to sample")
 	}
 
+	if s.schedule != nil {
+		s.temperature = max(s.schedule(s.sampled), 0)
+		s.sampled++
+	}
+
+	if len(s.logitBias) > 0 || len(s.history) > 0 {
+		logits = slices.Clone(logits)
+	}
+
+	for id, bias := range s.logitBias {
+		if id >= 0 && id < len(logits) {
+			logits[id] += bias
+		}
+	}
+
+	s.penalize(logits)
+
 	tokens := make([]token, len(logits))
 	for i := range logits {
 		tokens[i].id = int32(i)
@@ -48,6 +128,8 @@ func (s *Sampler) Sample(logits []float32) (int32, error) {
 		s.grammar.Apply(top)
 		if !math.IsInf(float64(top[0].value), -1) {
 			s.grammar.Accept(top[0].id)
+			s.updateMu()
+			s.remember(top[0].id)
 			return top[0].id, nil
 		}
 
@@ -66,14 +148,69 @@ func (s *Sampler) Sample(logits []float32) (int32, error) {
 		s.grammar.Accept(t.id)
 	}
 
+	s.updateMu()
+	s.remember(t.id)
 	return t.id, nil
 }
 
-// greedy returns the highest probability token from the tokens
+// penalize lowers the logits of the tokens in the sampler's history. The
+// frequency penalty grows with the number of times a token was sampled while
+// the presence penalty is the same for any token that was sampled at all.
+func (s *Sampler) penalize(logits []float32) {
+	if len(s.history) == 0 {
+		return
+	}
+
+	counts := make(map[int32]int)
+	for _, id := range s.history {
+		counts[id]++
+	}
+
+	for id, n := range counts {
+		if id < 0 || int(id) >= len(logits) {
+			continue
+		}
+
+		if logits[id] > 0 {
+			logits[id] /= s.penalties.Repeat
+		} else {
+			logits[id] *= s.penalties.Repeat
+		}
+
+		logits[id] -= float32(n)*s.penalties.Frequency + s.penalties.Presence
+	}
+}
+
+// remember adds a sampled token to the history used for penalties, keeping
+// only the most recent tokens
+func (s *Sampler) remember(id int32) {
+	if !s.penalties.enabled() {
+		return
+	}
+
+	s.history = append(s.history, id)
+	if s.penalties.LastN > 0 && len(s.history) > s.penalties.LastN {
+		s.history = s.history[len(s.history)-s.penalties.LastN:]
+	}
+}
+
+// updateMu moves mu towards the target surprise using the surprise of the
+// token that was just sampled
+func (s *Sampler) updateMu() {
+	if s.mirostat == 0 || s.temperature == 0 {
+		return
+	}
+
+	s.mu -= s.mirostatEta * (s.surprise - s.mirostatTau)
+}
+
+// greedy returns the highest probability token from the tokens. Ties go to
+// the lowest token ID, whatever order the tokens are in, so greedy output is
+// the same across runs and machines.
 func greedy(tokens []token) token {
 	max := tokens[0]
 	for i := 1; i < len(tokens); i++ {
-		if tokens[i].value > max.value {
+		if tokens[i].value > max.value || tokens[i].value == max.value && tokens[i].id < max.id {
 			max = tokens[i]
 		}
 	}
@@ -88,15 +225,29 @@ func (s *Sampler) sample(tokens []token) (token, error) {
 		return greedy(tokens), nil
 	}
 
-	// topK also sorts the tokens in descending order of logits
-	tokens = topK(tokens, s.topK)
+	n := len(tokens)
+	if s.mirostat != 0 {
+		// mirostat replaces top_k, top_p and min_p truncation
+		tokens = topK(tokens, 0)
+		temperature(tokens, s.temperature)
+		softmax(tokens)
+
+		if s.mirostat == 1 {
+			tokens = mirostatV1(tokens, n, s.mirostatTau, s.mu)
+		} else {
+			tokens = mirostatV2(tokens, s.mu)
+		}
+	} else {
+		// topK also sorts the tokens in descending order of logits
+		tokens = topK(tokens, s.topK)
 
-	// scale and normalize the tokens in place
-	temperature(tokens, s.temperature)
-	softmax(tokens)
+		// scale and normalize the tokens in place
+		temperature(tokens, s.temperature)
+		softmax(tokens)
 
-	tokens = topP(tokens, s.topP)
-	tokens = minP(tokens, s.minP)
+		tokens = topP(tokens, s.topP)
+		tokens = minP(tokens, s.minP)
+	}
 
 	var r float32
 	if s.rng != nil {
@@ -123,11 +274,61 @@ func (s *Sampler) sample(tokens []token) (token, error) {
 	if math.IsNaN(float64(sum)) {
 		return token{}, errors.New("sample: logits sum to NaN, check model output")
 	}
+
+	if s.mirostat != 0 {
+		p := tokens[idx].value
+		if idx > 0 {
+			p -= tokens[idx-1].value
+		}
+		s.surprise = -float32(math.Log2(float64(p / sum)))
+	}
+
 	return tokens[idx], nil
 }
 
+// mirostatV1 keeps the k most likely tokens, where k is estimated from the
+// Zipf exponent of the distribution so the expected surprise is mu.
+// requires ts to be sorted in descending order of probabilities
+func mirostatV1(ts []token, n int, tau, mu float32) []token {
+	const m = 100
+
+	var sumTiBi, sumTiSq float64
+	for i := 0; i < min(m, len(ts))-1; i++ {
+		ti := math.Log(float64(i+2) / float64(i+1))
+		bi := math.Log(float64(ts[i].value / ts[i+1].value))
+		sumTiBi += ti * bi
+		sumTiSq += ti * ti
+	}
+
+	if sumTiSq == 0 || math.IsNaN(sumTiBi) || math.IsInf(sumTiBi, 0) {
+		return ts[:1]
+	}
+
+	sHat := sumTiBi / sumTiSq
+	epsilonHat := sHat - 1
+	k := math.Pow(epsilonHat*math.Pow(2, float64(mu))/(1-math.Pow(float64(n), -epsilonHat)), 1/sHat)
+	if math.IsNaN(k) || k < 1 {
+		return ts[:1]
+	}
+
+	return ts[:min(int(math.Round(k)), len(ts))]
+}
+
+// mirostatV2 drops tokens whose surprise, -log2(p), is greater than mu,
+// always keeping the most likely token.
+// requires ts to be sorted in descending order of probabilities
+func mirostatV2(ts []token, mu float32) []token {
+	for i := 1; i < len(ts); i++ {
+		if -math.Log2(float64(ts[i].value)) > float64(mu) {
+			return ts[:i]
+		}
+	}
+
+	return ts
+}
+
 // TODO(parthsareen): update sampler interface to use json unmarshal https://github.com/ollama/ollama/issues/9278
-func NewSampler(temperature float32, topK int, topP float32, minP float32, seed int, grammar *GrammarSampler) Sampler {
+func NewSampler(temperature float32, topK int, topP float32, minP float32, mirostat int, mirostatTau, mirostatEta float32, seed int, grammar *GrammarSampler, logitBias map[int]float32, penalties Penalties) Sampler {
 	var rng *rand.Rand
 	if seed != -1 {
 		// PCG requires two parameters: sequence and stream
@@ -154,6 +355,10 @@ func NewSampler(temperature float32, topK int, topP float32, minP float32, seed
 		minP = 1.0
 	}
 
+	if penalties.Repeat <= 0 {
+		penalties.Repeat = 1
+	}
+
 	return Sampler{
 		rng:         rng,
 		topK:        topK,
@@ -161,6 +366,12 @@ func NewSampler(temperature float32, topK int, topP float32, minP float32, seed
 		minP:        minP,
 		temperature: temperature,
 		grammar:     grammar,
+		logitBias:   logitBias,
+		mirostat:    mirostat,
+		mirostatTau: mirostatTau,
+		mirostatEta: mirostatEta,
+		mu:          2 * mirostatTau,
+		penalties:   penalties,
 	}
 }
 
@@ -6,6 +6,9 @@ import (
 	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/ollama/ollama/model"
@@ -13,7 +16,7 @@ import (
 
 func TestWeighted(t *testing.T) {
 	logits := []float32{-10, 3, -10, -10}
-	sampler := NewSampler(0, 0, 0, 0, 0, nil)
+	sampler := NewSampler(0, 0, 0, 0, 0, 0, 0, 0, nil, nil, Penalties{})
 	got, err := sampler.Sample(logits)
 	if err != nil {
 		t.Error(err)
@@ -25,7 +28,7 @@ func TestWeighted(t *testing.T) {
 	}
 
 	logits = []float32{-100, -10, 0, 10}
-	sampler = NewSampler(0, 0, 0, 0, 0, nil)
+	sampler = NewSampler(0, 0, 0, 0, 0, 0, 0, 0, nil, nil, Penalties{})
 	got, err = sampler.Sample(logits)
 	if err != nil {
 		t.Error(err)
@@ -39,7 +42,7 @@ func TestWeighted(t *testing.T) {
 	// Test very high p
 	logits = []float32{1.0, 0.9999999999999999, 0.5, 0.1}
 	// Use extremely small topP to filter out all tokens
-	sampler = NewSampler(1.0, 0, 1e-10, 0, 0, nil)
+	sampler = NewSampler(1.0, 0, 1e-10, 0, 0, 0, 0, 0, nil, nil, Penalties{})
 	got, err = sampler.Sample(logits)
 	if err != nil {
 		t.Error(err)
@@ -52,7 +55,7 @@ func TestWeighted(t *testing.T) {
 	}
 
 	logits = []float32{float32(math.NaN()), float32(math.NaN()), float32(math.NaN())}
-	sampler = NewSampler(1, 0, 0.95, 0.05, 0, nil)
+	sampler = NewSampler(1, 0, 0.95, 0.05, 0, 0, 0, 0, nil, nil, Penalties{})
 	got, err = sampler.Sample(logits)
 	if err == nil {
 		t.Errorf("expected error, got %d", got)
@@ -60,6 +63,218 @@ func TestWeighted(t *testing.T) {
 	}
 }
 
+func TestMirostat(t *testing.T) {
+	// a steep distribution where most of the mass is on the first few tokens
+	logits := make([]float32, 1000)
+	for i := range logits {
+		logits[i] = -float32(i) / 10
+	}
+
+	for _, mode := range []int{1, 2} {
+		sampler := NewSampler(1, 0, 0, 0, mode, 1, 0.1, 42, nil, nil, Penalties{})
+		if sampler.mu != 2 {
+			t.Fatalf("mirostat %d: mu = %v, want 2*tau", mode, sampler.mu)
+		}
+
+		for range 100 {
+			got, err := sampler.Sample(logits)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got < 0 || int(got) >= len(logits) {
+				t.Fatalf("mirostat %d: sampled out of range token %d", mode, got)
+			}
+		}
+
+		if sampler.mu == 2 {
+			t.Errorf("mirostat %d: mu was not updated", mode)
+		}
+	}
+
+	// a low target surprise keeps only the most likely token
+	sampler := NewSampler(1, 0, 0, 0, 2, 1e-3, 0.1, 42, nil, nil, Penalties{})
+	for range 10 {
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != 0 {
+			t.Fatalf("got token %d, want 0", got)
+		}
+	}
+}
+
+func TestLogitBias(t *testing.T) {
+	logits := []float32{1, 4, 2, 3}
+
+	// banning the most likely token
+	sampler := NewSampler(1, 0, 1, 0, 0, 0, 0, 0, nil, map[int]float32{1: -100}, Penalties{})
+	for range 1000 {
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == 1 {
+			t.Fatal("sampled banned token 1")
+		}
+	}
+
+	// boosting an unlikely token
+	sampler = NewSampler(0, 0, 0, 0, 0, 0, 0, 0, nil, map[int]float32{0: 10}, Penalties{})
+	got, err := sampler.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0 {
+		t.Errorf("index mismatch: want %d, got %d", 0, got)
+	}
+
+	// the caller's logits are left unchanged
+	if logits[0] != 1 {
+		t.Errorf("logits modified: got %v", logits)
+	}
+}
+
+func TestGreedyTies(t *testing.T) {
+	logits := []float32{1, 5, 3, 5, 5}
+
+	sampler := NewSampler(0, 0, 0, 0, 0, 0, 0, 0, nil, nil, Penalties{})
+	for range 10 {
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 1 {
+			t.Fatalf("expected the lowest of the tied tokens, 1, got %d", got)
+		}
+	}
+
+	// the tie is broken by ID, not by the order of the tokens
+	tokens := make([]token, len(logits))
+	for i, v := range logits {
+		tokens[i] = token{id: int32(i), value: v}
+	}
+
+	r := rand.New(rand.NewPCG(42, 0))
+	for range 10 {
+		r.Shuffle(len(tokens), func(i, j int) { tokens[i], tokens[j] = tokens[j], tokens[i] })
+		if got := greedy(tokens); got.id != 1 {
+			t.Fatalf("expected token 1 from %v, got %d", tokens, got.id)
+		}
+	}
+}
+
+func TestScheduleTemperature(t *testing.T) {
+	logits := []float32{1, 5, 3, 4}
+
+	// the temperature starts high and falls to 0, when sampling is greedy
+	temperatures := []float32{100, 50, 0, -1}
+
+	var positions []int
+	sampler := NewSampler(0.8, 0, 0, 0, 0, 0, 0, 42, nil, nil, Penalties{})
+	sampler.ScheduleTemperature(func(n int) float32 {
+		positions = append(positions, n)
+		return temperatures[n]
+	})
+
+	for n, want := range temperatures {
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// negative temperatures are treated as 0
+		if want := max(want, 0); sampler.temperature != want {
+			t.Errorf("expected temperature %v at position %d, got %v", want, n, sampler.temperature)
+		}
+
+		if want <= 0 && got != 1 {
+			t.Errorf("expected the most likely token, 1, at position %d, got %d", n, got)
+		}
+	}
+
+	if !slices.Equal(positions, []int{0, 1, 2, 3}) {
+		t.Errorf("expected the schedule at positions 0 to 3, got %v", positions)
+	}
+}
+
+func TestGuide(t *testing.T) {
+	logits := []float32{1, 4, 2, 3}
+
+	if got := Guide(logits, []float32{0, 0, 0, 0}, 1); !slices.Equal(got, logits) {
+		t.Errorf("expected a scale of 1 to leave logits unchanged, got %v", got)
+	}
+
+	// the negative prompt favours the most likely token, so guidance moves
+	// away from it
+	got := Guide(logits, []float32{1, 4.5, 2, 2}, 2)
+	if want := []float32{1, 3.5, 2, 4}; !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	sampler := NewSampler(0, 0, 0, 0, 0, 0, 0, 0, nil, nil, Penalties{})
+	token, err := sampler.Sample(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != 3 {
+		t.Errorf("expected guidance to change the sampled token to 3, got %d", token)
+	}
+}
+
+func TestPenalties(t *testing.T) {
+	logits := []float32{5, 4.5, 4, 3.5, 3}
+
+	// repeats returns how many of n greedily sampled tokens are the most
+	// likely one
+	repeats := func(penalties Penalties, n int) int {
+		sampler := NewSampler(0, 0, 0, 0, 0, 0, 0, 0, nil, nil, penalties)
+
+		var count int
+		for range n {
+			got, err := sampler.Sample(logits)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got == 0 {
+				count++
+			}
+		}
+		return count
+	}
+
+	if got := repeats(Penalties{}, 20); got != 20 {
+		t.Errorf("expected no penalty to always repeat, got %d of 20", got)
+	}
+
+	frequency := repeats(Penalties{LastN: -1, Repeat: 1, Frequency: 1}, 20)
+	presence := repeats(Penalties{LastN: -1, Repeat: 1, Presence: 1}, 20)
+	if frequency >= presence {
+		t.Errorf("expected frequency penalty to repeat less than presence penalty, got %d and %d of 20", frequency, presence)
+	}
+
+	// the presence penalty stops growing once a token has been sampled
+	if presence < 15 {
+		t.Errorf("expected presence penalty to mostly repeat, got %d of 20", presence)
+	}
+
+	// only the most recent token is penalized, so the first two alternate
+	if got := repeats(Penalties{LastN: 1, Repeat: 1, Presence: 1}, 20); got != 10 {
+		t.Errorf("expected last_n of 1 to alternate, got %d of 20", got)
+	}
+
+	if got := repeats(Penalties{LastN: -1, Repeat: 2}, 2); got != 1 {
+		t.Errorf("expected repeat penalty to halve the logit, got %d of 2", got)
+	}
+
+	if logits[0] != 5 {
+		t.Errorf("logits modified: got %v", logits)
+	}
+}
+
 func modelHelper(t testing.TB) model.BytePairEncoding {
 	t.Helper()
 
@@ -150,10 +365,110 @@ func TestGrammar(t *testing.T) {
 	}
 }
 
+func TestGrammarArithmetic(t *testing.T) {
+	tokenizer := modelHelper(t)
+
+	vocab := tokenizer.Vocabulary()
+	eos := int32(len(vocab.Values))
+	vocab.Values = append(vocab.Values, "<|eot_id|>")
+	vocab.Types = append(vocab.Types, model.TOKEN_TYPE_CONTROL)
+	vocab.EOS = []int32{eos}
+
+	grammar, err := NewGrammarSampler(tokenizer, `
+root   ::= number " " op " " number
+number ::= [1-9] [0-9]?
+op     ::= "+" | "-" | "*" | "/"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer grammar.Free()
+
+	sampler := NewSampler(0, 0, 0, 0, 0, 0, 0, 0, grammar, nil, Penalties{})
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	var sb strings.Builder
+	for range 64 {
+		logits := make([]float32, len(vocab.Values))
+		for i := range logits {
+			logits[i] = rng.Float32()
+		}
+		// end generation as soon as the grammar allows it
+		logits[eos] = 2
+
+		id, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == eos {
+			break
+		}
+
+		piece, err := tokenizer.Decode([]int32{id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb.WriteString(piece)
+	}
+
+	if !regexp.MustCompile(`^[1-9][0-9]? [-+*/] [1-9][0-9]?$`).MatchString(sb.String()) {
+		t.Errorf("expected an arithmetic expression, got %q", sb.String())
+	}
+}
+
+func TestGrammarChoices(t *testing.T) {
+	tokenizer := modelHelper(t)
+
+	vocab := tokenizer.Vocabulary()
+	eos := int32(len(vocab.Values))
+	vocab.Values = append(vocab.Values, "<|eot_id|>")
+	vocab.Types = append(vocab.Types, model.TOKEN_TYPE_CONTROL)
+	vocab.EOS = []int32{eos}
+
+	// "no" is a prefix of "none" so either can follow it
+	grammar, err := NewGrammarSampler(tokenizer, `root ::= "no" | "none"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer grammar.Free()
+
+	allowed := func() map[string]bool {
+		tokens := make([]token, len(vocab.Values))
+		for i := range tokens {
+			tokens[i].id = int32(i)
+		}
+		grammar.Apply(tokens)
+
+		m := make(map[string]bool)
+		for _, tok := range tokens {
+			if !math.IsInf(float64(tok.value), -1) {
+				m[vocab.Values[tok.id]] = true
+			}
+		}
+		return m
+	}
+
+	got := allowed()
+	if !got["no"] || !got["none"] || got["<|eot_id|>"] || got["Ġno"] || got["yes"] {
+		t.Errorf("unexpected tokens allowed at the start: no=%t none=%t eos=%t Ġno=%t yes=%t", got["no"], got["none"], got["<|eot_id|>"], got["Ġno"], got["yes"])
+	}
+
+	grammar.Accept(vocab.Encode("no"))
+	got = allowed()
+	if !got["<|eot_id|>"] || !got["ne"] || got["Ġ"] || got["no"] {
+		t.Errorf("unexpected tokens allowed after \"no\": eos=%t ne=%t Ġ=%t no=%t", got["<|eot_id|>"], got["ne"], got["Ġ"], got["no"])
+	}
+
+	grammar.Accept(vocab.Encode("ne"))
+	if got := allowed(); len(got) != 1 || !got["<|eot_id|>"] {
+		t.Errorf("expected only the end of generation after \"none\", got %d tokens", len(got))
+	}
+}
+
 func BenchmarkSample(b *testing.B) {
 	samplers := map[string]Sampler{
-		"Greedy":   NewSampler(0, 0, 0, 0, 0, nil), // Use NewSampler with temp=0 for greedy
-		"Weighted": NewSampler(0.5, 10, 0.9, 0.2, -1, nil),
+		"Greedy":   NewSampler(0, 0, 0, 0, 0, 0, 0, 0, nil, nil, Penalties{}), // Use NewSampler with temp=0 for greedy
+		"Weighted": NewSampler(0.5, 10, 0.9, 0.2, 0, 0, 0, -1, nil, nil, Penalties{}),
 	}
 
 	// Generate random logits for benchmarking
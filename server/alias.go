@@ -0,0 +1,226 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ollama/ollama/types/model"
+)
+
+// errAliasConflict is returned by SetAlias for an alias with the name of an
+// existing model
+var errAliasConflict = errors.New("a model with this name already exists")
+
+// SetAlias creates or updates an alias that resolves to target. An alias only
+// records the name of its target, so it shares the target's blobs and follows
+// the target as it's updated. Its target must be a model, not another alias.
+func SetAlias(alias, target model.Name) error {
+	if !alias.IsFullyQualified() {
+		return model.Unqualified(alias)
+	}
+	if !target.IsFullyQualified() {
+		return model.Unqualified(target)
+	}
+
+	// names are matched case-insensitively, as they are for models, so an
+	// alias can't differ from a model or another alias only by case
+	alias, err := getExistingName(alias)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ParseNamedManifest(alias); err == nil {
+		return fmt.Errorf("alias %q: %w", alias.DisplayShortest(), errAliasConflict)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if _, err := ParseNamedManifest(target); err != nil {
+		return err
+	}
+
+	if existing, _, err := findAlias(alias); err == nil {
+		alias = existing
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	aliases, err := GetAliasPath()
+	if err != nil {
+		return err
+	}
+
+	p := filepath.Join(aliases, alias.Filepath())
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	// the alias is replaced at once so that it never resolves to a partly
+	// written name
+	temp, err := os.CreateTemp(filepath.Dir(p), ".alias-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.WriteString(target.String()); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), p)
+}
+
+// DeleteAlias removes an alias. Its target is left as it is.
+func DeleteAlias(alias model.Name) error {
+	if !alias.IsFullyQualified() {
+		return model.Unqualified(alias)
+	}
+
+	alias, _, err := findAlias(alias)
+	if err != nil {
+		return err
+	}
+
+	aliases, err := GetAliasPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(aliases, alias.Filepath())); err != nil {
+		return err
+	}
+
+	return PruneDirectory(aliases)
+}
+
+// deleteAliasesOf removes the aliases that resolve to target, so that they
+// don't outlive the model they refer to.
+func deleteAliasesOf(target model.Name) error {
+	as, err := Aliases()
+	if err != nil {
+		return err
+	}
+
+	aliases, err := GetAliasPath()
+	if err != nil {
+		return err
+	}
+
+	for alias, t := range as {
+		if strings.EqualFold(t.String(), target.String()) {
+			if err := os.Remove(filepath.Join(aliases, alias.Filepath())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return PruneDirectory(aliases)
+}
+
+// Aliases returns the target of each alias.
+func Aliases() (map[model.Name]model.Name, error) {
+	aliases, err := GetAliasPath()
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(aliases, "*", "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	as := make(map[model.Name]model.Name)
+	for _, match := range matches {
+		fi, err := os.Stat(match)
+		if err != nil {
+			return nil, err
+		}
+
+		if fi.IsDir() {
+			continue
+		}
+
+		rel, err := filepath.Rel(aliases, match)
+		if err != nil {
+			return nil, err
+		}
+
+		n := model.ParseNameFromFilepath(rel)
+		if !n.IsValid() {
+			slog.Warn("bad alias name", "path", rel)
+			continue
+		}
+
+		bts, err := os.ReadFile(match)
+		if err != nil {
+			return nil, err
+		}
+
+		target := model.ParseName(strings.TrimSpace(string(bts)))
+		if !target.IsFullyQualified() {
+			slog.Warn("bad alias target", "alias", n, "target", string(bts))
+			continue
+		}
+
+		as[n] = target
+	}
+
+	return as, nil
+}
+
+// findAlias returns the alias matching n case-insensitively, with its
+// target, or an error wrapping [os.ErrNotExist] if there's none.
+func findAlias(n model.Name) (model.Name, model.Name, error) {
+	as, err := Aliases()
+	if err != nil {
+		return n, n, err
+	}
+
+	for alias, target := range as {
+		if strings.EqualFold(alias.String(), n.String()) {
+			return alias, target, nil
+		}
+	}
+
+	return n, n, fmt.Errorf("alias %q: %w", n.DisplayShortest(), os.ErrNotExist)
+}
+
+// resolveAlias returns the target of n if it's an alias, or n otherwise. A
+// model takes precedence over an alias of the same name, such as one pulled
+// after the alias was created. An alias whose target no longer exists is an
+// error wrapping [os.ErrNotExist].
+func resolveAlias(n model.Name) (model.Name, error) {
+	if !n.IsFullyQualified() {
+		return n, nil
+	}
+
+	if _, err := ParseNamedManifest(n); err == nil {
+		return n, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return n, err
+	}
+
+	_, target, err := findAlias(n)
+	if errors.Is(err, os.ErrNotExist) {
+		return n, nil
+	} else if err != nil {
+		return n, err
+	}
+
+	if _, err := ParseNamedManifest(target); errors.Is(err, os.ErrNotExist) {
+		return n, fmt.Errorf("alias %q refers to model %q, which no longer exists: %w", n.DisplayShortest(), target.DisplayShortest(), os.ErrNotExist)
+	} else if err != nil {
+		return n, err
+	}
+
+	return target, nil
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+)
+
+// sessionHeader identifies the session a request is counted against when
+// OLLAMA_SESSION_BUDGET is set. Its value is opaque to the server.
+const sessionHeader = "X-Ollama-Session"
+
+// sessionRemainingHeader is the number of tokens a session had left before a
+// request, sent in its response.
+const sessionRemainingHeader = "X-Ollama-Session-Remaining"
+
+// sessionIdle is how long a session's budget is kept after its last request,
+// after which the session starts again with the full budget.
+const sessionIdle = 24 * time.Hour
+
+// errBudgetExhausted is returned for a session with no tokens left
+var errBudgetExhausted = errors.New("session token budget exhausted")
+
+// tokenBudgets tracks the tokens each session has generated against the
+// budget every session is given
+type tokenBudgets struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionBudget
+}
+
+type sessionBudget struct {
+	// used is the number of tokens generated and reserved the number held
+	// by requests in progress, which may generate up to that many
+	used     int
+	reserved int
+	seen     time.Time
+}
+
+// reserve reserves up to want tokens from the budget of session, or all that
+// are left if want isn't positive, limiting a request so that the session's
+// requests together can't exceed the budget. It returns the tokens left
+// before the reservation, and errBudgetExhausted if there are none. A nil
+// reservation is returned if budgets are disabled.
+func (b *tokenBudgets) reserve(session string, want int) (*tokenReservation, int, error) {
+	limit := int(envconfig.SessionBudget())
+	if limit == 0 || session == "" {
+		return nil, 0, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.sessions == nil {
+		b.sessions = make(map[string]*sessionBudget)
+	}
+
+	for id, sb := range b.sessions {
+		if sb.reserved == 0 && now.Sub(sb.seen) > sessionIdle {
+			delete(b.sessions, id)
+		}
+	}
+
+	sb, ok := b.sessions[session]
+	if !ok {
+		sb = &sessionBudget{}
+		b.sessions[session] = sb
+	}
+	sb.seen = now
+
+	left := max(limit-sb.used-sb.reserved, 0)
+	if left == 0 {
+		return nil, 0, errBudgetExhausted
+	}
+
+	if want <= 0 || want > left {
+		want = left
+	}
+
+	sb.reserved += want
+	return &tokenReservation{budgets: b, session: sb, tokens: want}, left, nil
+}
+
+// tokenReservation is the part of a session's budget held by a request.
+// Its methods do nothing on a nil reservation, so requests without a budget
+// don't need to check for one.
+type tokenReservation struct {
+	budgets *tokenBudgets
+	session *sessionBudget
+
+	// tokens is the number reserved and used the number generated so far
+	tokens int
+	used   int
+
+	// streamed is the number of tokens charged so far for each response
+	// requested with n that isn't done yet
+	streamed map[int]int
+}
+
+// Tokens returns the number of tokens reserved, or 0 if there is no limit.
+func (r *tokenReservation) Tokens() int {
+	if r == nil {
+		return 0
+	}
+
+	return r.tokens
+}
+
+// Charge counts n generated tokens against the reservation.
+func (r *tokenReservation) Charge(n int) {
+	if r == nil {
+		return
+	}
+
+	r.budgets.mu.Lock()
+	defer r.budgets.mu.Unlock()
+	r.used += n
+}
+
+// Count charges the tokens of a completion response: those of each response
+// that isn't done as it arrives and, once it is done, the rest of its
+// EvalCount. A request that is canceled or fails part way through is charged
+// for the tokens it generated before then.
+func (r *tokenReservation) Count(cr llm.CompletionResponse) {
+	if r == nil {
+		return
+	}
+
+	r.budgets.mu.Lock()
+	defer r.budgets.mu.Unlock()
+	if !cr.Done {
+		if r.streamed == nil {
+			r.streamed = make(map[int]int)
+		}
+		r.streamed[cr.Index] += cr.Tokens
+		r.used += cr.Tokens
+		return
+	}
+
+	r.used += max(cr.EvalCount-r.streamed[cr.Index], 0)
+	delete(r.streamed, cr.Index)
+}
+
+// Left returns the number of reserved tokens that haven't been generated,
+// or 0 if there is no limit.
+func (r *tokenReservation) Left() int {
+	if r == nil {
+		return 0
+	}
+
+	r.budgets.mu.Lock()
+	defer r.budgets.mu.Unlock()
+	return max(r.tokens-r.used, 0)
+}
+
+// Release adds the tokens generated to the session's usage and returns the
+// rest of the reservation to its budget.
+func (r *tokenReservation) Release() {
+	if r == nil {
+		return
+	}
+
+	r.budgets.mu.Lock()
+	defer r.budgets.mu.Unlock()
+	r.session.reserved -= r.tokens
+	r.session.used += r.used
+	r.session.seen = time.Now()
+	r.tokens, r.used = 0, 0
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTokenBudgets(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		var b tokenBudgets
+		r, _, err := b.reserve("a", 0)
+		if err != nil || r != nil {
+			t.Fatalf("expected no reservation, got %v, %v", r, err)
+		}
+
+		// a nil reservation does nothing
+		r.Charge(10)
+		r.Release()
+	})
+
+	t.Setenv("OLLAMA_SESSION_BUDGET", "10")
+
+	t.Run("no session", func(t *testing.T) {
+		var b tokenBudgets
+		if r, _, err := b.reserve("", 0); err != nil || r != nil {
+			t.Fatalf("expected no reservation, got %v, %v", r, err)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var b tokenBudgets
+
+		first, left, err := b.reserve("a", 6)
+		if err != nil || first.Tokens() != 6 || left != 10 {
+			t.Fatalf("expected 6 of 10 tokens, got %d of %d, %v", first.Tokens(), left, err)
+		}
+
+		// requests in progress hold their tokens until they finish
+		second, left, err := b.reserve("a", 0)
+		if err != nil || second.Tokens() != 4 || left != 4 {
+			t.Fatalf("expected 4 of 4 tokens, got %d of %d, %v", second.Tokens(), left, err)
+		}
+
+		if _, _, err := b.reserve("a", 1); !errors.Is(err, errBudgetExhausted) {
+			t.Fatalf("expected %v, got %v", errBudgetExhausted, err)
+		}
+
+		// tokens that weren't generated are returned to the budget
+		first.Charge(2)
+		first.Release()
+		if first.Left() != 0 {
+			t.Errorf("expected a released reservation to have no tokens left, got %d", first.Left())
+		}
+
+		second.Charge(4)
+		second.Release()
+
+		third, left, err := b.reserve("a", 0)
+		if err != nil || third.Tokens() != 4 || left != 4 {
+			t.Fatalf("expected 4 of 4 tokens, got %d of %d, %v", third.Tokens(), left, err)
+		}
+		third.Release()
+	})
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// acceptedEncoding returns the compression, gzip or deflate, to use for a
+// request with the Accept-Encoding header, or "" if it accepts neither.
+// gzip is preferred when both are accepted.
+func acceptedEncoding(header string) string {
+	quality := make(map[string]float64)
+	for part := range strings.SplitSeq(header, ",") {
+		name, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		quality[name] = q
+	}
+
+	var best string
+	var bestQuality float64
+	for _, name := range []string{"gzip", "deflate"} {
+		q, ok := quality[name]
+		if !ok {
+			q = quality["*"]
+		}
+
+		if q > bestQuality {
+			best, bestQuality = name, q
+		}
+	}
+
+	return best
+}
+
+// compressWriter compresses the body written through it. The compressor is
+// created on the first write so that responses without a body are sent
+// without one.
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	w        interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		w.Header().Del("Content-Encoding")
+		w.encoding = ""
+	}
+
+	// the length is of the uncompressed body
+	if w.encoding != "" {
+		w.Header().Del("Content-Length")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.encoding == "" {
+		return w.ResponseWriter.Write(b)
+	}
+
+	if w.w == nil {
+		w.Header().Del("Content-Length")
+		if w.encoding == "gzip" {
+			w.w = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.w = zlib.NewWriter(w.ResponseWriter)
+		}
+	}
+
+	return w.w.Write(b)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends what has been written so far, so that each part of a streamed
+// response reaches the client as soon as it's written.
+func (w *compressWriter) Flush() {
+	if w.w != nil {
+		if err := w.w.Flush(); err != nil {
+			return
+		}
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) close() error {
+	if w.w == nil && w.encoding != "" {
+		if !w.Written() {
+			// a response without a body isn't compressed
+			w.Header().Del("Content-Encoding")
+			return nil
+		}
+
+		// the headers have been flushed, so the body must be a valid,
+		// if empty, compressed stream
+		if _, err := w.Write(nil); err != nil {
+			return err
+		}
+	}
+
+	if w.w != nil {
+		return w.w.Close()
+	}
+	return nil
+}
+
+// compressMiddleware compresses responses with gzip or deflate when the
+// request's Accept-Encoding header allows it.
+func compressMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		encoding := acceptedEncoding(c.GetHeader("Accept-Encoding"))
+		if encoding == "" || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+
+		// the header is set before the handler runs since streamed responses
+		// send their headers with the first flush
+		c.Header("Content-Encoding", encoding)
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+
+		w := &compressWriter{ResponseWriter: c.Writer, encoding: encoding}
+		c.Writer = w
+		defer w.close()
+
+		c.Next()
+	}
+}
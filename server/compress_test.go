@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                           "",
+		"identity":                   "",
+		"gzip":                       "gzip",
+		"deflate":                    "deflate",
+		"gzip, deflate":              "gzip",
+		"deflate, gzip":              "gzip",
+		"GZIP":                       "gzip",
+		"br, deflate":                "deflate",
+		"gzip;q=0.5, deflate":        "deflate",
+		"gzip;q=0, deflate;q=0.1":    "deflate",
+		"gzip;q=0":                   "",
+		"*":                          "gzip",
+		"*, gzip;q=0":                "deflate",
+		"gzip;level=1;q=0":           "",
+		"gzip; Q=0.2, deflate;q=0.1": "gzip",
+		"gzip;q, deflate":            "deflate",
+	}
+
+	for header, want := range cases {
+		if got := acceptedEncoding(header); got != want {
+			t.Errorf("%q: expected %q, got %q", header, want, got)
+		}
+	}
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	chunks := make(chan chan any, 1)
+
+	r := gin.New()
+	r.Use(compressMiddleware())
+	r.GET("/json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.GenerateResponse{Model: "test", Response: strings.Repeat("why is the sky blue? ", 100)})
+	})
+	r.GET("/stream", func(c *gin.Context) {
+		streamResponse(c, <-chunks)
+	})
+	r.GET("/empty", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// the transport would otherwise decompress gzip itself
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	// get requests path accepting the encoding and checks the response is
+	// compressed with want
+	get := func(t *testing.T, path, encoding, want string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+
+		if got := resp.Header.Get("Content-Encoding"); got != want {
+			t.Fatalf("expected content encoding %q, got %q", want, got)
+		}
+
+		return resp
+	}
+
+	decompress := func(t *testing.T, resp *http.Response) io.Reader {
+		t.Helper()
+
+		var r io.Reader = resp.Body
+		var err error
+		switch resp.Header.Get("Content-Encoding") {
+		case "gzip":
+			r, err = gzip.NewReader(resp.Body)
+		case "deflate":
+			r, err = zlib.NewReader(resp.Body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return r
+	}
+
+	uncompressed, err := io.ReadAll(get(t, "/json", "", "").Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			t.Run("json", func(t *testing.T) {
+				resp := get(t, "/json", encoding, encoding)
+				compressed, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(compressed) >= len(uncompressed) {
+					t.Errorf("expected fewer than %d bytes, got %d", len(uncompressed), len(compressed))
+				}
+
+				decompressed, err := io.ReadAll(decompress(t, &http.Response{
+					Header: resp.Header,
+					Body:   io.NopCloser(bytes.NewReader(compressed)),
+				}))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(string(decompressed), string(uncompressed)); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+			})
+
+			t.Run("stream", func(t *testing.T) {
+				ch := make(chan any)
+				chunks <- ch
+
+				wants := []string{"why", " is", " the sky blue?"}
+
+				// the headers are sent with the first chunk
+				go func() { ch <- api.GenerateResponse{Model: "test", Response: wants[0]} }()
+				resp := get(t, "/stream", encoding, encoding)
+				scanner := bufio.NewScanner(decompress(t, resp))
+
+				// each chunk can be read before the next is written
+				for i, want := range wants {
+					if i > 0 {
+						go func() { ch <- api.GenerateResponse{Model: "test", Response: want} }()
+					}
+
+					if !scanner.Scan() {
+						t.Fatalf("expected a chunk, got %v", scanner.Err())
+					}
+
+					if !strings.Contains(scanner.Text(), `"response":"`+want+`"`) {
+						t.Errorf("expected response %q, got %s", want, scanner.Text())
+					}
+				}
+
+				close(ch)
+				if scanner.Scan() || scanner.Err() != nil {
+					t.Errorf("expected the end of the stream, got %q, %v", scanner.Text(), scanner.Err())
+				}
+			})
+
+			t.Run("no content", func(t *testing.T) {
+				resp := get(t, "/empty", encoding, "")
+				if resp.StatusCode != http.StatusNoContent {
+					t.Errorf("expected status code 204, got %d", resp.StatusCode)
+				}
+			})
+		})
+	}
+}
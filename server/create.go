@@ -41,29 +41,29 @@ var (
 func (s *Server) CreateHandler(c *gin.Context) {
 	var r api.CreateRequest
 	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
 		return
 	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		return
 	}
 
 	for v := range r.Files {
 		if !fs.ValidPath(v) {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errFilePath.Error()})
+			c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, errFilePath.Error()))
 			return
 		}
 	}
 
 	name := model.ParseName(cmp.Or(r.Model, r.Name))
 	if !name.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, errtypes.InvalidModelNameErrMsg))
 		return
 	}
 
 	name, err := getExistingName(name)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		return
 	}
 
@@ -81,7 +81,7 @@ func (s *Server) CreateHandler(c *gin.Context) {
 			slog.Debug("create model from model name")
 			fromName := model.ParseName(r.From)
 			if !fromName.IsValid() {
-				ch <- gin.H{"error": errtypes.InvalidModelNameErrMsg, "status": http.StatusBadRequest}
+				ch <- gin.H{"error": errtypes.InvalidModelNameErrMsg, "code": api.ErrorCodeInvalidRequest, "status": http.StatusBadRequest}
 				return
 			}
 
@@ -90,22 +90,22 @@ func (s *Server) CreateHandler(c *gin.Context) {
 
 			baseLayers, err = parseFromModel(ctx, fromName, fn)
 			if err != nil {
-				ch <- gin.H{"error": err.Error()}
+				ch <- errorJSON(api.ErrorCodeInternal, err.Error())
 			}
 		} else if r.Files != nil {
 			baseLayers, err = convertModelFromFiles(r.Files, baseLayers, false, fn)
 			if err != nil {
 				for _, badReq := range []error{errNoFilesProvided, errOnlyGGUFSupported, errUnknownType} {
 					if errors.Is(err, badReq) {
-						ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+						ch <- gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest, "status": http.StatusBadRequest}
 						return
 					}
 				}
-				ch <- gin.H{"error": err.Error()}
+				ch <- errorJSON(api.ErrorCodeInternal, err.Error())
 				return
 			}
 		} else {
-			ch <- gin.H{"error": errNeitherFromOrFiles.Error(), "status": http.StatusBadRequest}
+			ch <- gin.H{"error": errNeitherFromOrFiles.Error(), "code": api.ErrorCodeInvalidRequest, "status": http.StatusBadRequest}
 			return
 		}
 
@@ -115,11 +115,11 @@ func (s *Server) CreateHandler(c *gin.Context) {
 			if err != nil {
 				for _, badReq := range []error{errNoFilesProvided, errOnlyOneAdapterSupported, errOnlyGGUFSupported, errUnknownType, errFilePath} {
 					if errors.Is(err, badReq) {
-						ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+						ch <- gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest, "status": http.StatusBadRequest}
 						return
 					}
 				}
-				ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+				ch <- gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest, "status": http.StatusBadRequest}
 				return
 			}
 		}
@@ -130,16 +130,16 @@ func (s *Server) CreateHandler(c *gin.Context) {
 
 		if err := createModel(r, name, baseLayers, fn); err != nil {
 			if errors.Is(err, errBadTemplate) {
-				ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+				ch <- gin.H{"error": err.Error(), "code": api.ErrorCodeInvalidRequest, "status": http.StatusBadRequest}
 				return
 			}
-			ch <- gin.H{"error": err.Error()}
+			ch <- errorJSON(api.ErrorCodeInternal, err.Error())
 			return
 		}
 
 		if !envconfig.NoPrune() && oldManifest != nil {
 			if err := oldManifest.RemoveLayers(); err != nil {
-				ch <- gin.H{"error": err.Error()}
+				ch <- errorJSON(api.ErrorCodeInternal, err.Error())
 			}
 		}
 
@@ -284,7 +284,7 @@ func convertFromSafetensors(files map[string]string, baseLayers []*layerGGML, is
 		return nil, err
 	}
 
-	layer, err := NewLayer(t, mediaType)
+	layer, err := newLayerWithProgress(t, mediaType, "verifying conversion", fn)
 	if err != nil {
 		return nil, err
 	}
@@ -411,7 +411,7 @@ func createModel(r api.CreateRequest, name model.Name, baseLayers []*layerGGML,
 
 	for _, layer := range layers {
 		if layer.status != "" {
-			fn(api.ProgressResponse{Status: layer.status})
+			fn(api.ProgressResponse{Status: layer.status, Digest: layer.Digest, Total: layer.Size, Completed: layer.Size})
 		}
 	}
 
@@ -430,7 +430,7 @@ func quantizeLayer(layer *layerGGML, quantizeType string, fn func(resp api.Progr
 	fnWrap := func(n uint64) {
 		done := doneBytes.Add(n)
 		progress := float32(done) / float32(totalBytes)
-		fn(api.ProgressResponse{Status: fmt.Sprintf("quantizing %s model to %s", ft, quantizeType), Digest: "0000000000000000000", Total: layer.Size, Completed: int64(progress * float32(layer.Size))})
+		fn(api.ProgressResponse{Status: fmt.Sprintf("quantizing %s model to %s", ft, quantizeType), Digest: layer.Digest, Total: layer.Size, Completed: int64(progress * float32(layer.Size))})
 	}
 	ftype, err := ggml.ParseFileType(quantizeType)
 	if err != nil {
@@ -458,11 +458,11 @@ func quantizeLayer(layer *layerGGML, quantizeType string, fn func(resp api.Progr
 		return nil, err
 	}
 	temp.Seek(0, io.SeekStart)
-	fn(api.ProgressResponse{Status: "verifying conversion"})
-	newLayer, err := NewLayer(temp, layer.MediaType)
+	newLayer, err := newLayerWithProgress(temp, layer.MediaType, "verifying conversion", fn)
 	if err != nil {
 		return nil, err
 	}
+	newLayer.From = layer.From
 	if _, err := temp.Seek(0, io.SeekStart); err != nil {
 		return nil, err
 	}
@@ -475,6 +475,44 @@ func quantizeLayer(layer *layerGGML, quantizeType string, fn func(resp api.Progr
 	return &layerGGML{newLayer, f}, nil
 }
 
+// progressReader calls fn with the number of bytes read so far each time
+// roughly another percent of total has been read.
+type progressReader struct {
+	io.Reader
+	total, completed, reported int64
+	fn                         func(completed int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.completed += int64(n)
+	if r.completed != r.reported && (r.completed >= r.total || r.completed-r.reported >= r.total/100) {
+		r.reported = r.completed
+		r.fn(r.completed)
+	}
+	return n, err
+}
+
+// newLayerWithProgress creates a layer from f like NewLayer, reporting the
+// progress of digesting and storing it under status since f can be large.
+func newLayerWithProgress(f *os.File, mediatype, status string, fn func(resp api.ProgressResponse)) (Layer, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return Layer{}, err
+	}
+
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return Layer{}, err
+	}
+
+	total := fi.Size() - offset
+	fn(api.ProgressResponse{Status: status, Total: total})
+	return NewLayer(&progressReader{Reader: f, total: total, fn: func(completed int64) {
+		fn(api.ProgressResponse{Status: status, Total: total, Completed: completed})
+	}}, mediatype)
+}
+
 func ggufLayers(digest string, fn func(resp api.ProgressResponse)) ([]*layerGGML, error) {
 	var layers []*layerGGML
 
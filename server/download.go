@@ -60,6 +60,7 @@ type blobDownloadPart struct {
 
 	lastUpdatedMu sync.Mutex
 	lastUpdated   time.Time
+	lastPersisted time.Time
 
 	*blobDownload `json:"-"`
 }
@@ -100,6 +101,11 @@ const (
 	maxDownloadPartSize int64 = 1000 * format.MegaByte
 )
 
+// partPersistInterval is how often the progress of a part is written to its
+// part file while downloading, so an interrupted pull resumes from close to
+// where it stopped rather than from the start of the part.
+var partPersistInterval = time.Second
+
 func (p *blobDownloadPart) Name() string {
 	return strings.Join([]string{
 		p.blobDownload.Name, "partial", strconv.Itoa(p.N),
@@ -114,12 +120,25 @@ func (p *blobDownloadPart) StopsAt() int64 {
 	return p.Offset + p.Size
 }
 
+// Write records that b has been written to the blob file at the end of the
+// part's completed range.
 func (p *blobDownloadPart) Write(b []byte) (n int, err error) {
 	n = len(b)
+	p.Completed.Add(int64(n))
 	p.blobDownload.Completed.Add(int64(n))
+
 	p.lastUpdatedMu.Lock()
 	p.lastUpdated = time.Now()
+	persist := p.lastUpdated.Sub(p.lastPersisted) >= partPersistInterval
+	if persist {
+		p.lastPersisted = p.lastUpdated
+	}
 	p.lastUpdatedMu.Unlock()
+
+	if persist {
+		return n, p.blobDownload.writePart(p.Name(), p)
+	}
+
 	return n, nil
 }
 
@@ -340,19 +359,18 @@ func (b *blobDownload) downloadChunk(ctx context.Context, requestURL *url.URL, w
 		}
 		defer resp.Body.Close()
 
-		n, err := io.CopyN(w, io.TeeReader(resp.Body, part), part.Size-part.Completed.Load())
-		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, io.ErrUnexpectedEOF) {
-			// rollback progress
-			b.Completed.Add(-n)
-			return err
+		if resp.StatusCode == http.StatusOK && part.StartsAt() > 0 {
+			// the server ignored the range and is sending the blob from the start
+			return fmt.Errorf("%s part %d: server does not support range requests", b.Digest[7:19], part.N)
 		}
 
-		part.Completed.Add(n)
+		// bytes are counted by part only once they are written to the file,
+		// so its persisted progress never runs ahead of the data
+		_, err = io.CopyN(io.MultiWriter(w, part), resp.Body, part.Size-part.Completed.Load())
 		if err := b.writePart(part.Name(), part); err != nil {
 			return err
 		}
 
-		// return nil or context.Canceled or UnexpectedEOF (resumable)
 		return err
 	})
 
@@ -499,6 +517,16 @@ func downloadBlob(ctx context.Context, opts downloadOpts) (cacheHit bool, _ erro
 			return false, err
 		}
 
+		if completed := download.Completed.Load(); completed > 0 {
+			slog.Info(fmt.Sprintf("resuming %s at %s of %s", opts.digest[7:19], format.HumanBytes(completed), format.HumanBytes(download.Total)))
+			opts.fn(api.ProgressResponse{
+				Status:    fmt.Sprintf("resuming %s", opts.digest[7:19]),
+				Digest:    opts.digest,
+				Total:     download.Total,
+				Completed: completed,
+			})
+		}
+
 		//nolint:contextcheck
 		go download.Run(context.Background(), requestURL, opts.regOpts)
 	}
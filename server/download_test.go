@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestDownloadBlobResume(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/blobs/"+digest):
+			http.Redirect(w, r, "http://"+r.Context().Value(http.LocalAddrContextKey).(net.Addr).String()+"/direct", http.StatusTemporaryRedirect)
+		case r.URL.Path == "/direct":
+			ranges = append(ranges, r.Header.Get("Range"))
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	testMakeRequestDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", srv.Listener.Addr().String())
+	}
+	t.Cleanup(func() { testMakeRequestDialContext = nil })
+
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a download that was interrupted part way through its only part
+	offset := int64(len(blob) / 3)
+	if err := os.WriteFile(fp+"-partial", blob[:offset], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	part := blobDownloadPart{Size: int64(len(blob))}
+	part.Completed.Store(offset)
+	bts, err := json.Marshal(&part)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(fp+"-partial-0", bts, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var statuses []api.ProgressResponse
+	if _, err := downloadBlob(t.Context(), downloadOpts{
+		mp:      ParseModelPath("http://registry.test/library/test:latest"),
+		digest:  digest,
+		regOpts: &registryOptions{Insecure: true},
+		fn:      func(resp api.ProgressResponse) { statuses = append(statuses, resp) },
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{fmt.Sprintf("bytes=%d-%d", offset, len(blob)-1)}; !slices.Equal(ranges, want) {
+		t.Errorf("expected ranges %v, got %v", want, ranges)
+	}
+
+	got, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, blob) {
+		t.Error("downloaded blob does not match")
+	}
+
+	if _, err := os.Stat(fp + "-partial-0"); !os.IsNotExist(err) {
+		t.Errorf("expected part file to be removed, got %v", err)
+	}
+
+	if len(statuses) == 0 || statuses[0].Status != "resuming "+digest[7:19] {
+		t.Fatalf("expected a resuming status first, got %v", statuses)
+	}
+
+	if statuses[0].Completed != offset || statuses[0].Total != int64(len(blob)) {
+		t.Errorf("expected resume at %d of %d, got %d of %d", offset, len(blob), statuses[0].Completed, statuses[0].Total)
+	}
+}
+
+func TestDownloadPartPersistsProgress(t *testing.T) {
+	dir := t.TempDir()
+
+	b := &blobDownload{Name: dir + "/blob", Digest: "sha256:" + strings.Repeat("a", 64)}
+	part := &blobDownloadPart{Size: 100, blobDownload: b}
+
+	if _, err := part.Write(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	var persisted blobDownloadPart
+	bts, err := os.ReadFile(part.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(bts, &persisted); err != nil {
+		t.Fatal(err)
+	}
+
+	if persisted.Completed.Load() != 10 {
+		t.Errorf("expected 10 bytes persisted, got %d", persisted.Completed.Load())
+	}
+
+	if b.Completed.Load() != 10 {
+		t.Errorf("expected 10 bytes completed, got %d", b.Completed.Load())
+	}
+}
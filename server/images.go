@@ -16,13 +16,18 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/format"
+	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/fs/gguf"
 	"github.com/ollama/ollama/parser"
 	"github.com/ollama/ollama/template"
@@ -40,6 +45,8 @@ var (
 	errCapabilityEmbedding  = errors.New("embedding")
 	errCapabilityThinking   = errors.New("thinking")
 	errInsecureProtocol     = errors.New("insecure protocol http")
+	errInvalidModelFile     = errors.New("not a valid GGUF file")
+	errModelFileNotAllowed  = errors.New("not in a directory of OLLAMA_MODEL_FILE_DIRS")
 )
 
 type registryOptions struct {
@@ -118,6 +125,48 @@ func (m *Model) Capabilities() []model.Capability {
 	return capabilities
 }
 
+// fimTokens are the text of the special tokens that a code model is prompted
+// with to fill in the middle between a prefix and a suffix
+type fimTokens struct {
+	prefix, suffix, middle string
+}
+
+// errNoFIMTokens is returned for models that don't declare fill-in-the-middle
+// tokens in their metadata
+var errNoFIMTokens = errors.New("does not declare fill-in-the-middle tokens")
+
+// fimTokens returns the model's fill-in-the-middle tokens, which are declared
+// by token ID in its metadata under either current or older key names.
+func (m *Model) fimTokens() (fimTokens, error) {
+	f, err := gguf.Open(m.ModelPath)
+	if err != nil {
+		return fimTokens{}, err
+	}
+	defer f.Close()
+
+	tokens := f.KeyValue("tokenizer.ggml.tokens").Strings()
+	token := func(keys ...string) string {
+		for _, key := range keys {
+			if kv := f.KeyValue(key); kv.Valid() && kv.Uint() < uint64(len(tokens)) {
+				return tokens[kv.Uint()]
+			}
+		}
+		return ""
+	}
+
+	fim := fimTokens{
+		prefix: token("tokenizer.ggml.fim_pre_token_id", "tokenizer.ggml.prefix_token_id"),
+		suffix: token("tokenizer.ggml.fim_suf_token_id", "tokenizer.ggml.suffix_token_id"),
+		middle: token("tokenizer.ggml.fim_mid_token_id", "tokenizer.ggml.middle_token_id"),
+	}
+
+	if fim.prefix == "" || fim.suffix == "" || fim.middle == "" {
+		return fimTokens{}, errNoFIMTokens
+	}
+
+	return fim, nil
+}
+
 // CheckCapabilities checks if the model has the specified capabilities returning an error describing
 // any missing or unknown capabilities
 func (m *Model) CheckCapabilities(want ...model.Capability) error {
@@ -271,7 +320,103 @@ func GetManifest(mp ModelPath) (*Manifest, string, error) {
 	return &manifest, hex.EncodeToString(sha256sum.Sum(nil)), nil
 }
 
+// isModelFile reports whether name is the absolute path of a GGUF file rather
+// than the name of a model
+func isModelFile(name string) bool {
+	return filepath.IsAbs(name) && strings.EqualFold(filepath.Ext(name), ".gguf")
+}
+
+// modelFileAllowed reports whether path is inside one of the directories that
+// OLLAMA_MODEL_FILE_DIRS allows GGUF files to be loaded from
+func modelFileAllowed(path string) bool {
+	for _, dir := range envconfig.ModelFileDirs() {
+		dirs := []string{dir}
+		if eval, err := filepath.EvalSymlinks(dir); err == nil {
+			dirs = append(dirs, eval)
+		}
+
+		for _, dir := range dirs {
+			if rel, err := filepath.Rel(dir, path); err == nil && filepath.IsLocal(rel) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// modelFile is a decoded GGUF file, which is decoded again if the file changes
+type modelFile struct {
+	modTime time.Time
+	size    int64
+	model   *Model
+}
+
+// modelFiles caches the models of GGUF files by path so that each request for
+// one doesn't decode it again
+var modelFiles sync.Map
+
+// modelFromFile returns a model for a GGUF file that hasn't been created. It
+// only lasts as long as it's loaded and uses the default template. The file
+// must be in a directory of OLLAMA_MODEL_FILE_DIRS, following any symlinks.
+func modelFromFile(path string) (*Model, error) {
+	if !modelFileAllowed(filepath.Clean(path)) {
+		return nil, fmt.Errorf("%s is %w", path, errModelFileNotAllowed)
+	}
+
+	eval, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !modelFileAllowed(eval) {
+		return nil, fmt.Errorf("%s is %w", path, errModelFileNotAllowed)
+	}
+
+	fi, err := os.Stat(eval)
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := modelFiles.Load(path); ok {
+		if mf := v.(modelFile); mf.modTime.Equal(fi.ModTime()) && mf.size == fi.Size() {
+			m := *mf.model
+			return &m, nil
+		}
+	}
+
+	f, err := ggml.DecodeFile(eval, 0)
+	if err != nil {
+		modelFiles.Delete(path)
+		return nil, fmt.Errorf("%s is %w: %v", path, errInvalidModelFile, err)
+	}
+
+	kv := f.KV()
+	m := &Model{
+		Name:      path,
+		ShortName: path,
+		ModelPath: path,
+		Template:  template.DefaultTemplate,
+		Config: ConfigV2{
+			ModelFormat:   f.Name(),
+			ModelFamily:   kv.Architecture(),
+			ModelFamilies: []string{kv.Architecture()},
+			ModelType:     format.HumanNumber(kv.ParameterCount()),
+			FileType:      kv.FileType().String(),
+		},
+	}
+
+	modelFiles.Store(path, modelFile{modTime: fi.ModTime(), size: fi.Size(), model: m})
+
+	c := *m
+	return &c, nil
+}
+
 func GetModel(name string) (*Model, error) {
+	if isModelFile(name) {
+		return modelFromFile(name)
+	}
+
 	mp := ParseModelPath(name)
 	manifest, digest, err := GetManifest(mp)
 	if err != nil {
@@ -371,6 +516,107 @@ func GetModel(name string) (*Model, error) {
 	return model, nil
 }
 
+// errInvalidOptions is returned by SetModelOptions and modelOptions for
+// options that aren't valid
+var errInvalidOptions = errors.New("invalid options")
+
+// optionsError is an errInvalidOptions that keeps the message of err
+type optionsError struct{ err error }
+
+func (e optionsError) Error() string   { return e.err.Error() }
+func (e optionsError) Unwrap() []error { return []error{errInvalidOptions, e.err} }
+
+// modelOptionsMu serializes SetModelOptions so concurrent updates don't
+// overwrite each other's options
+var modelOptionsMu sync.Mutex
+
+// SetModelOptions merges opts into the default options of the model, which
+// are stored in its params layer, and returns the result. Options set to nil
+// are removed.
+func SetModelOptions(name model.Name, opts map[string]any) (map[string]any, error) {
+	modelOptionsMu.Lock()
+	defer modelOptionsMu.Unlock()
+
+	mf, err := ParseNamedManifest(name)
+	if err != nil {
+		return nil, err
+	}
+
+	params := make(map[string]any)
+	var layers []Layer
+	var oldLayer *Layer
+	for _, layer := range mf.Layers {
+		if layer.MediaType != "application/vnd.ollama.image.params" {
+			layers = append(layers, layer)
+			continue
+		}
+
+		oldLayer = &layer
+
+		blob, err := GetBlobsPath(layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		bts, err := os.ReadFile(blob)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(bts, &params); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[api.Options]()) {
+		names[strings.Split(field.Tag.Get("json"), ",")[0]] = true
+	}
+
+	for k, v := range opts {
+		if !names[k] {
+			return nil, fmt.Errorf("%w: unknown option %q", errInvalidOptions, k)
+		}
+
+		if v == nil {
+			delete(params, k)
+		} else {
+			params[k] = v
+		}
+	}
+
+	defaults := api.DefaultOptions()
+	if err := defaults.FromMap(params); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidOptions, err)
+	}
+
+	if len(params) > 0 {
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(params); err != nil {
+			return nil, err
+		}
+
+		layer, err := NewLayer(&b, "application/vnd.ollama.image.params")
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+
+	if err := WriteManifest(name, mf.Config, layers); err != nil {
+		return nil, err
+	}
+
+	// the old params are removed unless another model shares them
+	if !envconfig.NoPrune() && oldLayer != nil {
+		if err := oldLayer.Remove(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	return params, nil
+}
+
 func CopyModel(src, dst model.Name) error {
 	if !dst.IsFullyQualified() {
 		return model.Unqualified(dst)
@@ -410,6 +656,77 @@ func CopyModel(src, dst model.Name) error {
 	return err
 }
 
+// CopyQuantizedModel copies src to dst, quantizing the model weights to
+// quantType. All other layers are shared with src, and the quantized layer
+// records src as the model it was created from.
+func CopyQuantizedModel(ctx context.Context, src, dst model.Name, quantType string, fn func(api.ProgressResponse)) error {
+	if !dst.IsFullyQualified() {
+		return model.Unqualified(dst)
+	}
+	if !src.IsFullyQualified() {
+		return model.Unqualified(src)
+	}
+
+	want, err := ggml.ParseFileType(quantType)
+	if err != nil {
+		return err
+	}
+
+	m, err := ParseNamedManifest(src)
+	if err != nil {
+		return err
+	}
+
+	var config ConfigV2
+	if m.Config.Digest != "" {
+		configPath, err := GetBlobsPath(m.Config.Digest)
+		if err != nil {
+			return err
+		}
+
+		bts, err := os.ReadFile(configPath)
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(bts, &config); err != nil {
+			return err
+		}
+	}
+
+	baseLayers, err := parseFromModel(ctx, src, fn)
+	if err != nil {
+		return err
+	}
+
+	var layers []Layer
+	for _, layer := range baseLayers {
+		if layer.GGML != nil && layer.MediaType == "application/vnd.ollama.image.model" {
+			if layer.GGML.Name() != "gguf" {
+				return errors.New("quantization is only supported for GGUF models")
+			}
+
+			if layer.GGML.KV().FileType() != want {
+				layer, err = quantizeLayer(layer, quantType, fn)
+				if err != nil {
+					return err
+				}
+			}
+
+			config.FileType = layer.GGML.KV().FileType().String()
+		}
+		layers = append(layers, layer.Layer)
+	}
+
+	configLayer, err := createConfigLayer(layers, config)
+	if err != nil {
+		return err
+	}
+
+	fn(api.ProgressResponse{Status: "writing manifest"})
+	return WriteManifest(dst, *configLayer, layers)
+}
+
 func deleteUnusedLayers(deleteMap map[string]struct{}) error {
 	// Ignore corrupt manifests to avoid blocking deletion of layers that are freshly orphaned
 	manifests, err := Manifests(true)
@@ -673,6 +990,17 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 	return nil
 }
 
+// RemoteManifest fetches the manifest of name from its registry without
+// downloading any of its blobs.
+func RemoteManifest(ctx context.Context, name string, regOpts *registryOptions) (*Manifest, error) {
+	mp := ParseModelPath(name)
+	if mp.ProtocolScheme == "http" && !regOpts.Insecure {
+		return nil, errInsecureProtocol
+	}
+
+	return pullModelManifest(ctx, mp, regOpts)
+}
+
 func pullModelManifest(ctx context.Context, mp ModelPath, regOpts *registryOptions) (*Manifest, error) {
 	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
 
@@ -16,7 +16,15 @@ type Layer struct {
 	status    string
 }
 
+var errLayerDigestMismatch = errors.New("digest mismatch")
+
 func NewLayer(r io.Reader, mediatype string) (Layer, error) {
+	return newLayer(r, mediatype, "")
+}
+
+// newLayer stores r as a blob. If expected isn't empty, the content must
+// hash to it or nothing is stored.
+func newLayer(r io.Reader, mediatype, expected string) (Layer, error) {
 	blobs, err := GetBlobsPath("")
 	if err != nil {
 		return Layer{}, err
@@ -40,6 +48,10 @@ func NewLayer(r io.Reader, mediatype string) (Layer, error) {
 	}
 
 	digest := fmt.Sprintf("sha256:%x", sha256sum.Sum(nil))
+	if expected != "" && digest != expected {
+		return Layer{}, fmt.Errorf("%w: want %s, got %s", errLayerDigestMismatch, expected, digest)
+	}
+
 	blob, err := GetBlobsPath(digest)
 	if err != nil {
 		return Layer{}, err
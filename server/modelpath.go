@@ -122,6 +122,33 @@ func GetManifestPath() (string, error) {
 	return path, nil
 }
 
+// GetAliasPath returns the directory aliases are stored in. Aliases are kept
+// apart from the manifests so that they aren't listed as models.
+func GetAliasPath() (string, error) {
+	path := filepath.Join(envconfig.Models(), "aliases")
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return "", fmt.Errorf("%w: ensure path elements are traversable", err)
+	}
+
+	return path, nil
+}
+
+// GetSessionPath returns the path of the session with digest, or of the
+// directory of sessions if digest is empty. Sessions are kept apart from the
+// blobs so that pruning unreferenced blobs leaves them.
+func GetSessionPath(digest string) (string, error) {
+	if digest != "" && !regexp.MustCompile("^sha256[:-][0-9a-fA-F]{64}$").MatchString(digest) {
+		return "", ErrInvalidDigestFormat
+	}
+
+	dir := filepath.Join(envconfig.Models(), "sessions")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("%w: ensure path elements are traversable", err)
+	}
+
+	return filepath.Join(dir, strings.ToLower(strings.ReplaceAll(digest, ":", "-"))), nil
+}
+
 func GetBlobsPath(digest string) (string, error) {
 	// only accept actual sha256 digests
 	pattern := "^sha256[:-][0-9a-fA-F]{64}$"
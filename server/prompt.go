@@ -3,11 +3,11 @@ package server
 import (
 	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"log/slog"
 	"slices"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/llm"
@@ -17,10 +17,23 @@ import (
 type tokenizeFunc func(context.Context, string) ([]int, error)
 
 // chatPrompt accepts a list of messages and returns the prompt and images that should be used for the next chat turn.
-// chatPrompt truncates any messages that exceed the context window of the model, making sure to always include 1) the
-// latest message and 2) system messages
-func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool, think *bool) (prompt string, images []llm.ImageData, _ error) {
-	var system []api.Message
+// chatPrompt truncates the oldest messages that exceed the context window of the model, making sure to always include
+// 1) the latest message and 2) system messages, unless keepSystem is false. It also returns the number of messages that
+// were truncated. If prefill is set, a trailing assistant message is rendered as the start of the response for the model
+// to continue.
+func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool, think *bool, prefill, keepSystem bool) (prompt string, images []llm.ImageData, truncated int, _ error) {
+	// systemBefore returns the system messages kept from those before msgs[i]
+	systemBefore := func(i int) []api.Message {
+		system := make([]api.Message, 0)
+		if keepSystem {
+			for j := range i {
+				if msgs[j].Role == "system" {
+					system = append(system, msgs[j])
+				}
+			}
+		}
+		return system
+	}
 
 	// TODO: Ideally we would compute this from the projector metadata but some pieces are implementation dependent
 	// Clip images are represented as 768 tokens, each an embedding
@@ -34,25 +47,20 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 			continue
 		}
 
-		system = make([]api.Message, 0)
-		for j := range i {
-			if msgs[j].Role == "system" {
-				system = append(system, msgs[j])
-			}
-		}
+		system := systemBefore(i)
 
 		thinkVal := false
 		if think != nil {
 			thinkVal = *think
 		}
 		var b bytes.Buffer
-		if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[i:]...), Tools: tools, Think: thinkVal, IsThinkSet: think != nil}); err != nil {
-			return "", nil, err
+		if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[i:]...), Tools: tools, Think: thinkVal, IsThinkSet: think != nil, Prefill: prefill}); err != nil {
+			return "", nil, 0, err
 		}
 
 		s, err := tokenize(ctx, b.String())
 		if err != nil {
-			return "", nil, err
+			return "", nil, 0, err
 		}
 
 		ctxLen := len(s)
@@ -71,12 +79,10 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 	}
 
 	currMsgIdx := n
+	system := systemBefore(currMsgIdx)
+	truncated = currMsgIdx - len(system)
 
 	for cnt, msg := range msgs[currMsgIdx:] {
-		if slices.Contains(m.Config.ModelFamilies, "mllama") && len(msg.Images) > 1 {
-			return "", nil, errors.New("this model only supports one image while more than one image requested")
-		}
-
 		var prefix string
 		prompt := msg.Content
 
@@ -104,9 +110,51 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 	if think != nil {
 		thinkVal = *think
 	}
-	if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[currMsgIdx:]...), Tools: tools, Think: thinkVal, IsThinkSet: think != nil}); err != nil {
-		return "", nil, err
+	if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[currMsgIdx:]...), Tools: tools, Think: thinkVal, IsThinkSet: think != nil, Prefill: prefill}); err != nil {
+		return "", nil, 0, err
+	}
+
+	return b.String(), images, truncated, nil
+}
+
+// systemPromptPrefix returns the length of the start of prompt that is rendered
+// from the system messages at the start of msgs, if any of them is marked to
+// be cached. It is 0 if none are, or if the template does not render the
+// system messages before the rest of the conversation.
+func systemPromptPrefix(m *Model, msgs []api.Message, tools []api.Tool, think *bool, prompt string) (int, error) {
+	var system []api.Message
+	for _, msg := range msgs {
+		if msg.Role != "system" {
+			break
+		}
+		system = append(system, msg)
+	}
+
+	if !slices.ContainsFunc(system, func(msg api.Message) bool { return msg.CachePrompt }) {
+		return 0, nil
+	}
+
+	var b bytes.Buffer
+	if err := m.Template.Execute(&b, template.Values{Messages: system, Tools: tools, Think: think != nil && *think, IsThinkSet: think != nil}); err != nil {
+		return 0, err
+	}
+
+	// the template may end the system messages differently when they are the
+	// whole conversation, so only keep what they have in common
+	rendered := b.String()
+	var n int
+	for n < len(rendered) && n < len(prompt) && rendered[n] == prompt[n] {
+		n++
+	}
+
+	for n > 0 && n < len(prompt) && !utf8.RuneStart(prompt[n]) {
+		n--
+	}
+
+	if !strings.Contains(prompt[:n], system[len(system)-1].Content) {
+		slog.Debug("system prompt is not at the start of the prompt, not caching it")
+		return 0, nil
 	}
 
-	return b.String(), images, nil
+	return n, nil
 }
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"slices"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -202,6 +203,18 @@ func TestChatPrompt(t *testing.T) {
 				images: [][]byte{[]byte("one hotdog"), []byte("two hotdogs")},
 			},
 		},
+		{
+			name:  "multiple images mllama",
+			model: Model{Template: tmpl, Config: ConfigV2{ModelFamilies: []string{"mllama"}}},
+			limit: 2048,
+			msgs: []api.Message{
+				{Role: "user", Content: "Compare these two pictures of hotdogs", Images: []api.ImageData{[]byte("one hotdog"), []byte("two hotdogs")}},
+			},
+			expect: expect{
+				prompt: "[img-0][img-1]Compare these two pictures of hotdogs ",
+				images: [][]byte{[]byte("one hotdog"), []byte("two hotdogs")},
+			},
+		},
 	}
 
 	for _, tt := range cases {
@@ -209,7 +222,7 @@ func TestChatPrompt(t *testing.T) {
 			model := tt.model
 			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}}
 			think := false
-			prompt, images, err := chatPrompt(t.Context(), &model, mockRunner{}.Tokenize, &opts, tt.msgs, nil, &think)
+			prompt, images, _, err := chatPrompt(t.Context(), &model, (&mockRunner{}).Tokenize, &opts, tt.msgs, nil, &think, false, true)
 			if tt.error == nil && err != nil {
 				t.Fatal(err)
 			} else if tt.error != nil && err != tt.error {
@@ -238,3 +251,123 @@ func TestChatPrompt(t *testing.T) {
 		})
 	}
 }
+
+func TestChatPromptTruncationStrategy(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- if .System }}{{ .System }} {{ end }}
+{{- if .Prompt }}{{ .Prompt }} {{ end }}
+{{- if .Response }}{{ .Response }} {{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "You are the Test Who Lived."},
+		{Role: "user", Content: "You're a test, Harry!"},
+		{Role: "assistant", Content: "I-I'm a what?"},
+		{Role: "user", Content: "A test."},
+	}
+
+	// the mock tokenizer counts words, so the conversation is 15 tokens
+	cases := []struct {
+		name       string
+		limit      int
+		keepSystem bool
+		prompt     string
+		truncated  int
+	}{
+		{name: "keep system fits", limit: 15, keepSystem: true, prompt: "You are the Test Who Lived. You're a test, Harry! I-I'm a what? A test. "},
+		{name: "keep system", limit: 8, keepSystem: true, prompt: "You are the Test Who Lived. A test. ", truncated: 2},
+		{name: "drop oldest fits", limit: 15, prompt: "You are the Test Who Lived. You're a test, Harry! I-I'm a what? A test. "},
+		{name: "drop oldest", limit: 8, prompt: "I-I'm a what? A test. ", truncated: 2},
+		// the latest message is kept even if it doesn't fit on its own
+		{name: "drop oldest latest only", limit: 1, prompt: "A test. ", truncated: 3},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := Model{Template: tmpl}
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}}
+			prompt, _, truncated, err := chatPrompt(t.Context(), &model, (&mockRunner{}).Tokenize, &opts, slices.Clone(msgs), nil, nil, false, tt.keepSystem)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(prompt, tt.prompt); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+
+			if truncated != tt.truncated {
+				t.Errorf("expected %d truncated messages, got %d", tt.truncated, truncated)
+			}
+		})
+	}
+}
+
+func TestSystemPromptPrefix(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- range .Messages }}
+{{- .Role }}: {{ .Content }}
+{{ end }}assistant: `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Model{Template: tmpl}
+
+	cases := []struct {
+		name string
+		msgs []api.Message
+		want string
+	}{
+		{
+			name: "cached",
+			msgs: []api.Message{
+				{Role: "system", Content: "You are a pirate.", CachePrompt: true},
+				{Role: "user", Content: "Hello!"},
+			},
+			want: "system: You are a pirate.\n",
+		},
+		{
+			name: "several system messages",
+			msgs: []api.Message{
+				{Role: "system", Content: "You are a pirate."},
+				{Role: "system", Content: "Answer briefly.", CachePrompt: true},
+				{Role: "user", Content: "Hello!"},
+			},
+			want: "system: You are a pirate.\n\nAnswer briefly.\n",
+		},
+		{
+			name: "not cached",
+			msgs: []api.Message{
+				{Role: "system", Content: "You are a pirate."},
+				{Role: "user", Content: "Hello!"},
+			},
+		},
+		{
+			name: "no leading system message",
+			msgs: []api.Message{
+				{Role: "user", Content: "Hello!"},
+				{Role: "system", Content: "You are a pirate.", CachePrompt: true},
+				{Role: "user", Content: "Hello again!"},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := m.Template.Execute(&b, template.Values{Messages: tt.msgs}); err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := systemPromptPrefix(&m, tt.msgs, nil, nil, b.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := b.String()[:n]; got != tt.want {
+				t.Errorf("expected prefix %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -177,6 +177,9 @@ func quantize(in, out *os.File, orig *fsggml.GGML, newFileType fsggml.FileType,
 	for i, tensor := range origTensors {
 		tensor := tensor
 		newType := newType(tensor, kv, qs, newFileType)
+		if newType != fsggml.TensorType(tensor.Kind) && !canDequantize(fsggml.TensorType(tensor.Kind)) {
+			return fmt.Errorf("unable to quantize tensor %s from %s", tensor.Name, fsggml.TensorType(tensor.Kind))
+		}
 		newTensor := &fsggml.Tensor{
 			Name:  tensor.Name,
 			Shape: tensor.Shape,
@@ -194,6 +197,19 @@ func quantize(in, out *os.File, orig *fsggml.GGML, newFileType fsggml.FileType,
 	return fsggml.WriteGGUF(out, kv, outputTensors)
 }
 
+// canDequantize reports whether tensors of type t can be converted to F32 to
+// be quantized to another type.
+func canDequantize(t fsggml.TensorType) bool {
+	switch t {
+	case fsggml.TensorTypeF32, fsggml.TensorTypeF16, fsggml.TensorTypeBF16,
+		fsggml.TensorTypeQ4_0, fsggml.TensorTypeQ4_1, fsggml.TensorTypeQ5_0, fsggml.TensorTypeQ5_1, fsggml.TensorTypeQ8_0,
+		fsggml.TensorTypeQ2_K, fsggml.TensorTypeQ3_K, fsggml.TensorTypeQ4_K, fsggml.TensorTypeQ5_K, fsggml.TensorTypeQ6_K:
+		return true
+	default:
+		return false
+	}
+}
+
 func newType(t *fsggml.Tensor, kv fsggml.KV, qs *quantizeState, ftype fsggml.FileType) fsggml.TensorType {
 	defaultType := ftype.ToTensorType()
 	name := t.Name
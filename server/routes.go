@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"cmp"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,19 +12,25 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"math"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/netip"
 	"os"
 	"os/signal"
+	"reflect"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"golang.org/x/image/webp"
 	"golang.org/x/sync/errgroup"
 
@@ -31,11 +38,13 @@ import (
 	"github.com/ollama/ollama/discover"
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/fs/gguf"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/logutil"
 	"github.com/ollama/ollama/openai"
 	"github.com/ollama/ollama/server/internal/client/ollama"
 	"github.com/ollama/ollama/server/internal/registry"
+	"github.com/ollama/ollama/sse"
 	"github.com/ollama/ollama/template"
 	"github.com/ollama/ollama/thinking"
 	"github.com/ollama/ollama/tools"
@@ -55,6 +64,14 @@ var mode string = gin.DebugMode
 type Server struct {
 	addr  net.Addr
 	sched *Scheduler
+
+	// inflight holds the generate and chat requests in progress so they
+	// can be canceled by ID
+	inflight inflightRequests
+
+	// budgets tracks the tokens generated for each session against
+	// OLLAMA_SESSION_BUDGET
+	budgets tokenBudgets
 }
 
 func init() {
@@ -72,24 +89,221 @@ func init() {
 var (
 	errRequired    = errors.New("is required")
 	errBadTemplate = errors.New("template error")
+
+	// errRequestCanceled is the cause of canceling a request with
+	// [Server.CancelHandler]
+	errRequestCanceled = errors.New("request was canceled")
+
+	// errNRequiresStream is returned for non-streamed requests with an n
+	// option greater than 1, which has no single response to return
+	errNRequiresStream = errors.New("n greater than 1 requires stream to be true")
 )
 
+// toolValidationRetries is how many more times a chat response with invalid
+// tool calls is generated when tool_validation is "retry"
+const toolValidationRetries = 2
+
+// validateToolCalls marks each of calls as valid or not against the tools the
+// request declares and returns the first reason one isn't
+func validateToolCalls(tt []api.Tool, calls []api.ToolCall) error {
+	var first error
+	for i := range calls {
+		err := tools.Validate(tt, calls[i])
+		valid := err == nil
+		calls[i].Valid = &valid
+		if err != nil {
+			calls[i].ValidationError = err.Error()
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
+}
+
 func modelOptions(model *Model, requestOpts map[string]any) (api.Options, error) {
 	opts := api.DefaultOptions()
 	if err := opts.FromMap(model.Options); err != nil {
-		return api.Options{}, err
+		return api.Options{}, optionsError{err}
 	}
 
 	if err := opts.FromMap(requestOpts); err != nil {
-		return api.Options{}, err
+		return api.Options{}, optionsError{err}
+	}
+
+	if opts.GPULayerRanges != "" {
+		// the ranges take the place of num_gpu, so the number of layers is
+		// used when estimating the memory they need
+		layers, err := api.ParseLayerRanges(opts.GPULayerRanges)
+		if err != nil {
+			return api.Options{}, err
+		}
+		opts.NumGPU = len(layers)
+	}
+
+	if opts.Greedy {
+		for _, key := range []string{"temperature", "top_k", "top_p", "min_p", "typical_p", "mirostat", "mirostat_tau", "mirostat_eta", "repeat_penalty", "presence_penalty", "frequency_penalty"} {
+			if _, ok := requestOpts[key]; ok {
+				slog.Warn("sampling option has no effect with greedy decoding", "option", key)
+			}
+		}
 	}
 
 	return opts, nil
 }
 
+// requestTemplate parses a template given in a request to override the
+// model's own. Like any template it can only use the text/template builtins
+// and json, none of which reach outside the values it's executed with.
+func requestTemplate(s string) (*template.Template, error) {
+	tmpl, err := template.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errBadTemplate, err)
+	}
+
+	return tmpl, nil
+}
+
+// resolveThink returns whether a request should think. The think field of
+// the request takes precedence over the think option, which can also be set
+// by the model's parameters. Either one being false rather than unset has the
+// model's template tell it not to think, and any thinking it does anyway is
+// dropped from the response.
+func resolveThink(m *Model, think *bool, opts *api.Options) (*bool, error) {
+	if think != nil {
+		return think, nil
+	}
+
+	if opts.Think != nil && *opts.Think {
+		if err := m.CheckCapabilities(model.CapabilityThinking); err != nil {
+			return nil, err
+		}
+	}
+
+	return opts.Think, nil
+}
+
+// contextWarning returns the warning for responses when num_ctx is larger
+// than the model was trained with, and so was limited to it
+func contextWarning(r llm.LlamaServer, opts *api.Options) string {
+	trainCtx := r.TrainContextLength()
+	if trainCtx == 0 || opts.NumCtx <= trainCtx || opts.ExceedTrainCtx {
+		return ""
+	}
+
+	return fmt.Sprintf("num_ctx %d is larger than the %d tokens the model was trained with, so it was limited to %d; set exceed_train_ctx to use it anyway", opts.NumCtx, trainCtx, trainCtx)
+}
+
+// resolveSeed picks a random seed when one was not requested so the seed
+// actually used for sampling can be reported back to the caller.
+func resolveSeed(opts *api.Options) {
+	if opts.Seed < 0 {
+		opts.Seed = rand.IntN(math.MaxInt32)
+	}
+}
+
+// fingerprint identifies the configuration that generates responses with a
+// model: the model itself, the version of Ollama and the options the model
+// was loaded with. Responses to the same seed may differ if any of them
+// change. If the options can't be encoded, such as a NaN RoPE factor, the
+// fingerprint is unknownFingerprint.
+func fingerprint(m *Model, opts *api.Options) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s ", m.Digest, version.Version)
+	if err := json.NewEncoder(h).Encode(opts.Runner); err != nil {
+		slog.Warn("unable to fingerprint options", "error", err)
+		return unknownFingerprint
+	}
+	return fmt.Sprintf("fp_%x", h.Sum(nil)[:5])
+}
+
+// unknownFingerprint is the fingerprint of a configuration that can't be
+// identified
+const unknownFingerprint = "fp_0000000000"
+
+// completionMetrics returns the metrics reported with a completion response
+func completionMetrics(cr llm.CompletionResponse) api.Metrics {
+	return api.Metrics{
+		PromptEvalCount:      cr.PromptEvalCount,
+		PromptEvalDuration:   cr.PromptEvalDuration,
+		EvalCount:            cr.EvalCount,
+		EvalDuration:         cr.EvalDuration,
+		EvalRate:             cr.EvalRate,
+		CachedPromptTokens:   cr.CachedPromptCount,
+		PromptCacheHitTokens: cr.CachedPromptCount,
+		DraftTokens:          cr.DraftCount,
+		AcceptedDraftTokens:  cr.AcceptedDraftCount,
+		DraftAcceptanceRate:  cr.DraftAcceptanceRate,
+		TokenTimings:         cr.TokenTimings,
+	}
+}
+
+// generationContext returns a context for generating a response that is done
+// once the requested timeout passes. A missing, zero or negative timeout
+// leaves generation unbounded.
+func generationContext(ctx context.Context, timeout *api.Duration) (context.Context, context.CancelFunc) {
+	// negative durations are decoded as the maximum duration
+	if timeout == nil || timeout.Duration <= 0 || timeout.Duration == math.MaxInt64 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout.Duration)
+}
+
+// inflightRequests tracks requests by ID so they can be canceled regardless
+// of whether the client's connection is closed
+type inflightRequests struct {
+	mu       sync.Mutex
+	requests map[string]context.CancelCauseFunc
+}
+
+// track assigns the request using ctx an ID and returns a context that is
+// canceled with cause errRequestCanceled if it is canceled by that ID. The
+// returned func stops tracking the request once it has finished.
+func (r *inflightRequests) track(ctx context.Context) (context.Context, string, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	id := uuid.NewString()
+
+	r.mu.Lock()
+	if r.requests == nil {
+		r.requests = make(map[string]context.CancelCauseFunc)
+	}
+	r.requests[id] = cancel
+	r.mu.Unlock()
+
+	untrack := func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.requests, id)
+	}
+
+	stop := context.AfterFunc(ctx, untrack)
+	return ctx, id, func() {
+		stop()
+		untrack()
+	}
+}
+
+// cancel cancels the request with the given ID, reporting whether it was
+// still in progress
+func (r *inflightRequests) cancel(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cancel, ok := r.requests[id]
+	if ok {
+		delete(r.requests, id)
+		cancel(errRequestCanceled)
+	}
+	return ok
+}
+
 // scheduleRunner schedules a runner after validating inputs such as capabilities and model options.
 // It returns the allocated runner, model instance, and consolidated options if successful and error otherwise.
-func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.Capability, requestOpts map[string]any, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, error) {
+// The context of c's request is replaced with one that is canceled if the model is
+// unloaded with abort while the request is in flight.
+func (s *Server) scheduleRunner(c *gin.Context, name string, caps []model.Capability, requestOpts map[string]any, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, error) {
 	if name == "" {
 		return nil, nil, nil, fmt.Errorf("model %w", errRequired)
 	}
@@ -112,7 +326,7 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.C
 		return nil, nil, nil, err
 	}
 
-	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive)
+	runnerCh, errCh := s.sched.GetRunner(c.Request.Context(), model, opts, keepAlive)
 	var runner *runnerRef
 	select {
 	case runner = <-runnerCh:
@@ -120,51 +334,146 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.C
 		return nil, nil, nil, err
 	}
 
+	c.Request = c.Request.WithContext(runner.track(c.Request.Context()))
 	return runner.llama, model, &opts, nil
 }
 
-func (s *Server) GenerateHandler(c *gin.Context) {
-	checkpointStart := time.Now()
-	var req api.GenerateRequest
-	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
-		return
-	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+// generateModel resolves the model named by a generate request, which is a
+// GGUF file loaded as is, a model or an alias of one. It returns the name to
+// schedule the model with, or writes the error response and returns false.
+func generateModel(c *gin.Context, requested string) (string, *Model, bool) {
+	modelName := requested
+	if !isModelFile(requested) {
+		name := model.ParseName(requested)
+		if !name.IsValid() {
+			// Ideally this is "invalid model name" but we're keeping with
+			// what the API currently returns until we can change it.
+			c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", requested)))
+			return "", nil, false
+		}
 
-	name := model.ParseName(req.Model)
-	if !name.IsValid() {
-		// Ideally this is "invalid model name" but we're keeping with
-		// what the API currently returns until we can change it.
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
-		return
-	}
+		// We cannot currently consolidate this into GetModel because all we'll
+		// induce infinite recursion given the current code structure.
+		name, err := getExistingName(name)
+		if err != nil {
+			c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", requested)))
+			return "", nil, false
+		}
 
-	// We cannot currently consolidate this into GetModel because all we'll
-	// induce infinite recursion given the current code structure.
-	name, err := getExistingName(name)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
-		return
+		if name, err = resolveAlias(name); err != nil {
+			handleAliasError(c, err)
+			return "", nil, false
+		}
+		modelName = name.String()
 	}
 
-	m, err := GetModel(name.String())
+	m, err := GetModel(modelName)
 	if err != nil {
 		switch {
 		case errors.Is(err, fs.ErrNotExist):
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+			c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", requested)))
+		case errors.Is(err, errInvalidModelFile):
+			c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		case errors.Is(err, errModelFileNotAllowed):
+			c.JSON(http.StatusForbidden, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		case err.Error() == errtypes.InvalidModelNameErrMsg:
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		}
+		return "", nil, false
+	}
+
+	return modelName, m, true
+}
+
+// generatePrompt renders the prompt of a generate request as it's sent to the
+// runner: as is in raw mode, between the fill-in-the-middle tokens, or
+// otherwise through the template. It writes the error response and returns
+// false if the prompt can't be rendered.
+func generatePrompt(c *gin.Context, r llm.LlamaServer, m *Model, req *api.GenerateRequest, fim fimTokens, images []llm.ImageData, think *bool) (string, bool) {
+	if req.FIM {
+		// the tokens are written as text, which the runner's tokenizer
+		// recognizes as the special tokens they are
+		return fim.prefix + req.Prompt + fim.suffix + req.Suffix + fim.middle, true
+	} else if req.Raw {
+		return req.Prompt, true
+	}
+
+	tmpl := m.Template
+	if req.Template != "" {
+		var err error
+		tmpl, err = requestTemplate(req.Template)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+			return "", false
+		}
+	}
+
+	var values template.Values
+	if req.Suffix != "" {
+		values.Prompt = req.Prompt
+		values.Suffix = req.Suffix
+	} else {
+		var msgs []api.Message
+		if req.System != "" {
+			msgs = append(msgs, api.Message{Role: "system", Content: req.System})
+		} else if m.System != "" {
+			msgs = append(msgs, api.Message{Role: "system", Content: m.System})
+		}
+
+		if req.Context == nil {
+			msgs = append(msgs, m.Messages...)
 		}
+
+		for _, i := range images {
+			imgPrompt := ""
+			msgs = append(msgs, api.Message{Role: "user", Content: fmt.Sprintf("[img-%d]"+imgPrompt, i.ID)})
+		}
+
+		values.Messages = append(msgs, api.Message{Role: "user", Content: req.Prompt})
+	}
+
+	values.Think = think != nil && *think
+	values.IsThinkSet = think != nil
+
+	var b bytes.Buffer
+	if req.Context != nil {
+		slog.Warn("the context field is deprecated and will be removed in a future version of Ollama")
+		s, err := r.Detokenize(c.Request.Context(), req.Context)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+			return "", false
+		}
+		b.WriteString(s)
+	}
+
+	if err := tmpl.Execute(&b, values); err != nil {
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return "", false
+	}
+
+	return b.String(), true
+}
+
+func (s *Server) GenerateHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.GenerateRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	modelName, m, ok := generateModel(c, req.Model)
+	if !ok {
 		return
 	}
 
 	// expire the runner
-	if req.Prompt == "" && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
+	if req.Prompt == "" && req.KeepAlive != nil && req.KeepAlive.Duration == 0 {
 		s.sched.expireRunner(m)
 
 		c.JSON(http.StatusOK, api.GenerateResponse{
@@ -178,12 +487,40 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	}
 
 	if req.Raw && (req.Template != "" || req.System != "" || len(req.Context) > 0) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support template, system, or context"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "raw mode does not support template, system, or context"))
+		return
+	}
+
+	if req.Session != "" && (req.Raw || req.FIM || len(req.Context) > 0) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "session can't be combined with raw, fim, or context"))
+		return
+	}
+
+	if req.SkipSpecialTokens && !req.Raw {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "skip_special_tokens is only supported in raw mode"))
 		return
 	}
 
+	var fim fimTokens
+	if req.FIM {
+		if req.Template != "" || req.System != "" || len(req.Context) > 0 || len(req.Images) > 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "fim does not support template, system, context, or images"))
+			return
+		}
+
+		var err error
+		fim, err = m.fimTokens()
+		if errors.Is(err, errNoFIMTokens) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeUnsupported, fmt.Sprintf("%q %v", req.Model, err)))
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+			return
+		}
+	}
+
 	caps := []model.Capability{model.CapabilityCompletion}
-	if req.Suffix != "" {
+	if req.Suffix != "" && !req.FIM {
 		caps = append(caps, model.CapabilityInsert)
 	}
 	if req.Think != nil && *req.Think {
@@ -194,19 +531,43 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		// updated template supporting thinking
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
+	r, m, opts, err := s.scheduleRunner(c, modelName, caps, req.Options, req.KeepAlive)
 	if errors.Is(err, errCapabilityCompletion) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeUnsupported, fmt.Sprintf("%q does not support generate", req.Model)))
 		return
 	} else if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
+	think, err := resolveThink(m, req.Think, opts)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	if opts.N > 1 && req.Stream != nil && !*req.Stream {
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, errNRequiresStream.Error()))
+		return
+	}
+
+	var session string
+	if req.Session != "" {
+		session, req.Context, err = sessionContext(req.Session, m)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeNotFound, fmt.Sprintf("session '%s' not found", req.Session)))
+			return
+		case err != nil:
+			c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+			return
+		}
+	}
+
 	checkpointLoaded := time.Now()
 
-	// load the model
-	if req.Prompt == "" {
+	// load the model, unless filling in before a suffix with no prefix
+	if req.Prompt == "" && (!req.FIM || req.Suffix == "") {
 		c.JSON(http.StatusOK, api.GenerateResponse{
 			Model:      req.Model,
 			CreatedAt:  time.Now().UTC(),
@@ -216,134 +577,145 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
-	if slices.Contains(m.Config.ModelFamilies, "mllama") && len(req.Images) > 1 {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "this model only supports one image while more than one image requested"})
-		return
-	}
-
 	images := make([]llm.ImageData, len(req.Images))
 	for i := range req.Images {
 		images[i] = llm.ImageData{ID: i, Data: req.Images[i]}
 	}
 
-	prompt := req.Prompt
-	if !req.Raw {
-		tmpl := m.Template
-		if req.Template != "" {
-			tmpl, err = template.Parse(req.Template)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-		}
-
-		var values template.Values
-		if req.Suffix != "" {
-			values.Prompt = prompt
-			values.Suffix = req.Suffix
-		} else {
-			var msgs []api.Message
-			if req.System != "" {
-				msgs = append(msgs, api.Message{Role: "system", Content: req.System})
-			} else if m.System != "" {
-				msgs = append(msgs, api.Message{Role: "system", Content: m.System})
-			}
-
-			if req.Context == nil {
-				msgs = append(msgs, m.Messages...)
-			}
-
-			for _, i := range images {
-				imgPrompt := ""
-				msgs = append(msgs, api.Message{Role: "user", Content: fmt.Sprintf("[img-%d]"+imgPrompt, i.ID)})
-			}
-
-			values.Messages = append(msgs, api.Message{Role: "user", Content: req.Prompt})
-		}
-
-		values.Think = req.Think != nil && *req.Think
-		values.IsThinkSet = req.Think != nil
-
-		var b bytes.Buffer
-		if req.Context != nil {
-			slog.Warn("the context field is deprecated and will be removed in a future version of Ollama")
-			s, err := r.Detokenize(c.Request.Context(), req.Context)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-			b.WriteString(s)
-		}
-
-		if err := tmpl.Execute(&b, values); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		prompt = b.String()
+	prompt, ok := generatePrompt(c, r, m, &req, fim, images, think)
+	if !ok {
+		return
 	}
 
 	var thinkingState *thinking.Parser
 	openingTag, closingTag := thinking.InferTags(m.Template.Template)
-	if req.Think != nil && *req.Think && openingTag != "" && closingTag != "" {
+	if think != nil && openingTag != "" && closingTag != "" {
 		thinkingState = &thinking.Parser{
 			OpeningTag: openingTag,
 			ClosingTag: closingTag,
 		}
 	}
 
+	resolveSeed(opts)
+	warning := contextWarning(r, opts)
+	fp := fingerprint(m, opts)
+
+	var promptTokens []int
+	if opts.ReturnPromptTokens {
+		promptTokens, err = r.PromptTokens(c.Request.Context(), llm.CompletionRequest{
+			Prompt:            prompt,
+			Options:           opts,
+			SkipSpecialTokens: req.SkipSpecialTokens,
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+			return
+		}
+	}
+
+	reservation, ok := s.reserveTokens(c, opts)
+	if !ok {
+		return
+	}
+
+	ctx, requestID, untrack := s.inflight.track(c.Request.Context())
+
 	ch := make(chan any)
 	go func() {
 		// TODO (jmorganca): avoid building the response twice both here and below
 		var sb strings.Builder
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
+		defer untrack()
+		defer reservation.Release()
+
+		// only the first streamed response carries the request ID
+		var pendingID string
+		if req.Stream == nil || *req.Stream {
+			pendingID = requestID
+		}
+
+		ctx, cancel := generationContext(ctx, req.Timeout)
+		defer cancel()
+
+		// the state of each response requested with n starts afresh
+		var index int
+		if err := r.Completion(ctx, llm.CompletionRequest{
+			Prompt:            prompt,
+			Images:            images,
+			Format:            req.Format,
+			Options:           opts,
+			SkipSpecialTokens: req.SkipSpecialTokens,
+			Session:           session,
 		}, func(cr llm.CompletionResponse) {
+			reservation.Count(cr)
+			if cr.PromptEvalProgress != nil {
+				ch <- api.GenerateResponse{
+					Model:              req.Model,
+					CreatedAt:          time.Now().UTC(),
+					PromptEvalProgress: cr.PromptEvalProgress,
+					RequestID:          pendingID,
+				}
+				pendingID = ""
+				return
+			}
+
+			if cr.Index != index {
+				index = cr.Index
+				sb.Reset()
+				if thinkingState != nil {
+					thinkingState = &thinking.Parser{OpeningTag: openingTag, ClosingTag: closingTag}
+				}
+			}
+
 			res := api.GenerateResponse{
-				Model:     req.Model,
-				CreatedAt: time.Now().UTC(),
-				Response:  cr.Content,
-				Done:      cr.Done,
-				Metrics: api.Metrics{
-					PromptEvalCount:    cr.PromptEvalCount,
-					PromptEvalDuration: cr.PromptEvalDuration,
-					EvalCount:          cr.EvalCount,
-					EvalDuration:       cr.EvalDuration,
-				},
+				Model:       req.Model,
+				CreatedAt:   time.Now().UTC(),
+				Response:    cr.Content,
+				Bytes:       cr.Bytes,
+				Logprobs:    cr.Logprobs,
+				Done:        cr.Done,
+				Index:       cr.Index,
+				Fingerprint: fp,
+				Metrics:     completionMetrics(cr),
 			}
 
 			if thinkingState != nil {
 				thinking, content := thinkingState.AddContent(cr.Content)
-				res.Thinking = thinking
+				if *think {
+					res.Thinking = thinking
+				}
 				res.Response = content
 			}
 
 			if _, err := sb.WriteString(cr.Content); err != nil {
-				ch <- gin.H{"error": err.Error()}
+				ch <- errorJSON(api.ErrorCodeInternal, err.Error())
 			}
 
 			if cr.Done {
 				res.DoneReason = cr.DoneReason.String()
+				res.StopSequence = cr.StopSequence
+				res.StoppedAt = cr.StoppedAt
+				res.Seed = opts.Seed + cr.Index
+				res.Warning = warning
+				res.PromptTokens = promptTokens
+				res.Logits = cr.Logits
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
 
 				if !req.Raw {
 					tokens, err := r.Tokenize(c.Request.Context(), prompt+sb.String())
 					if err != nil {
-						ch <- gin.H{"error": err.Error()}
+						ch <- errorJSON(api.ErrorCodeInternal, err.Error())
 						return
 					}
 					res.Context = tokens
 				}
 			}
 
+			res.RequestID, pendingID = pendingID, ""
 			ch <- res
 		}); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			ch <- completionErrorJSON(err)
 		}
 	}()
 
@@ -351,11 +723,15 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		var r api.GenerateResponse
 		var sbThinking strings.Builder
 		var sbContent strings.Builder
+		var raw []byte
+		var logprobs []api.Logprob
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.GenerateResponse:
 				sbThinking.WriteString(t.Thinking)
 				sbContent.WriteString(t.Response)
+				raw = append(raw, t.Bytes...)
+				logprobs = append(logprobs, t.Logprobs...)
 				r = t
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -363,16 +739,28 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 					msg = "unexpected error format in response"
 				}
 
-				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+				status, ok := t["status"].(int)
+				if !ok {
+					status = http.StatusInternalServerError
+				}
+
+				code, ok := t["code"].(string)
+				if !ok {
+					code = api.ErrorCodeInternal
+				}
+
+				c.JSON(status, errorJSON(code, msg))
 				return
 			default:
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response"})
+				c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, "unexpected response"))
 				return
 			}
 		}
 
 		r.Thinking = sbThinking.String()
 		r.Response = sbContent.String()
+		r.Bytes = raw
+		r.Logprobs = logprobs
 
 		c.JSON(http.StatusOK, r)
 		return
@@ -381,188 +769,960 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
-func (s *Server) EmbedHandler(c *gin.Context) {
+// BatchGenerateHandler responds to many prompts with one model. The prompts
+// are completed concurrently, leaving the llm server to hand the runner as
+// many of them at once as it has parallel slots to batch them in.
+func (s *Server) BatchGenerateHandler(c *gin.Context) {
 	checkpointStart := time.Now()
-	var req api.EmbedRequest
-	err := c.ShouldBindJSON(&req)
-	switch {
-	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+	var req api.BatchGenerateRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
 		return
-	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		return
 	}
 
-	truncate := true
-
-	if req.Truncate != nil && !*req.Truncate {
-		truncate = false
-	}
-
-	var input []string
-
-	switch i := req.Input.(type) {
-	case string:
-		if len(i) > 0 {
-			input = append(input, i)
-		}
-	case []any:
-		for _, v := range i {
-			if _, ok := v.(string); !ok {
-				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid input type"})
-				return
-			}
-			input = append(input, v.(string))
-		}
-	default:
-		if req.Input != nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid input type"})
-			return
-		}
+	if len(req.Prompts) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "prompts are required"))
+		return
 	}
 
-	name, err := getExistingName(model.ParseName(req.Model))
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+	modelName, _, ok := generateModel(c, req.Model)
+	if !ok {
 		return
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{}, req.Options, req.KeepAlive)
-	if err != nil {
+	r, m, opts, err := s.scheduleRunner(c, modelName, []model.Capability{model.CapabilityCompletion}, req.Options, req.KeepAlive)
+	if errors.Is(err, errCapabilityCompletion) {
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeUnsupported, fmt.Sprintf("%q does not support generate", req.Model)))
+		return
+	} else if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
 	checkpointLoaded := time.Now()
 
-	if len(input) == 0 {
-		c.JSON(http.StatusOK, api.EmbedResponse{Model: req.Model, Embeddings: [][]float32{}})
-		return
-	}
+	prompts := make([]string, len(req.Prompts))
+	options := make([]api.Options, len(req.Prompts))
+	for i, p := range req.Prompts {
+		options[i] = *opts
+		if len(p.Options) > 0 {
+			requestOpts := maps.Clone(req.Options)
+			if requestOpts == nil {
+				requestOpts = make(map[string]any)
+			}
+			maps.Copy(requestOpts, p.Options)
 
-	kvData, _, err := getModelData(m.ModelPath, false)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+			options[i], err = modelOptions(m, requestOpts)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidOptions, fmt.Sprintf("prompt %d: %v", i, err)))
+				return
+			}
+
+			// every prompt is run by the runner loaded for the request
+			if !reflect.DeepEqual(options[i].Runner, opts.Runner) {
+				c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("prompt %d: options that affect how the model is loaded, such as num_ctx, must be the same for every prompt", i)))
+				return
+			}
+		}
+
+		if options[i].N > 1 {
+			c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "n is not supported by batch generate"))
+			return
+		}
+
+		resolveSeed(&options[i])
+
+		// each prompt is rendered as a generate request of its own would be
+		if prompts[i], ok = generatePrompt(c, r, m, &api.GenerateRequest{
+			Prompt: p.Prompt,
+			System: cmp.Or(p.System, req.System),
+			Raw:    req.Raw,
+		}, fimTokens{}, nil, nil); !ok {
+			return
+		}
+	}
+
+	// each prompt is limited by the session's budget like a request of its
+	// own, and the tokens left before the batch are sent
+	reservations := make([]*tokenReservation, len(prompts))
+	var remaining string
+	for i := range options {
+		var ok bool
+		if reservations[i], ok = s.reserveTokens(c, &options[i]); !ok {
+			for _, r := range reservations[:i] {
+				r.Release()
+			}
+			return
+		}
+
+		if i == 0 {
+			remaining = c.Writer.Header().Get(sessionRemainingHeader)
+		}
+	}
+
+	if remaining != "" {
+		c.Header(sessionRemainingHeader, remaining)
+	}
+
+	pending := make(chan int, len(prompts))
+	for i := range prompts {
+		pending <- i
+	}
+	close(pending)
+
+	// the runner only completes so many prompts at once, so the rest wait
+	// their turn here rather than each in a goroutine of its own
+	parallel := cmp.Or(opts.NumParallel, int(envconfig.NumParallel()), defaultParallel)
+
+	// responses are sent as they're done, which needn't be in order
+	results := make(chan api.BatchResponse, len(prompts))
+	for range min(parallel, len(prompts)) {
+		go func() {
+			for i := range pending {
+				res := api.BatchResponse{Index: i}
+
+				var sb strings.Builder
+				if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
+					Prompt:  prompts[i],
+					Options: &options[i],
+				}, func(cr llm.CompletionResponse) {
+					reservations[i].Count(cr)
+					sb.WriteString(cr.Content)
+					if cr.Done {
+						res.DoneReason = cr.DoneReason.String()
+						res.StoppedAt = cr.StoppedAt
+						res.Metrics = completionMetrics(cr)
+					}
+				}); err != nil {
+					res.Error = strings.TrimSpace(err.Error())
+				}
+				reservations[i].Release()
+
+				res.Response = sb.String()
+				results <- res
+			}
+		}()
+	}
+
+	if req.Stream == nil || *req.Stream {
+		ch := make(chan any)
+		go func() {
+			defer close(ch)
+			for range prompts {
+				ch <- api.BatchGenerateResponse{
+					Model:     req.Model,
+					CreatedAt: time.Now().UTC(),
+					Responses: []api.BatchResponse{<-results},
+				}
+			}
+
+			ch <- api.BatchGenerateResponse{
+				Model:         req.Model,
+				CreatedAt:     time.Now().UTC(),
+				Done:          true,
+				TotalDuration: time.Since(checkpointStart),
+				LoadDuration:  checkpointLoaded.Sub(checkpointStart),
+			}
+		}()
+
+		streamResponse(c, ch)
+		return
+	}
+
+	responses := make([]api.BatchResponse, len(prompts))
+	for range prompts {
+		res := <-results
+		responses[res.Index] = res
+	}
+
+	c.JSON(http.StatusOK, api.BatchGenerateResponse{
+		Model:         req.Model,
+		CreatedAt:     time.Now().UTC(),
+		Responses:     responses,
+		Done:          true,
+		TotalDuration: time.Since(checkpointStart),
+		LoadDuration:  checkpointLoaded.Sub(checkpointStart),
+	})
+}
+
+func (s *Server) EmbedHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.EmbedRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	truncate := true
+
+	if req.Truncate != nil && !*req.Truncate {
+		truncate = false
+	}
+
+	normalized := req.Normalize == nil || *req.Normalize
+	streamed := req.Stream != nil && *req.Stream
+
+	if req.ReportProgress && !streamed {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "report_progress requires stream"))
+		return
+	}
+
+	if req.Dimensions < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "dimensions must not be negative"))
+		return
+	}
+
+	req.Pooling = strings.ToLower(req.Pooling)
+	switch req.Pooling {
+	case "":
+	case "mean", "cls", "last", "none":
+		req.Options = maps.Clone(req.Options)
+		if req.Options == nil {
+			req.Options = make(map[string]any)
+		}
+		req.Options["pooling"] = req.Pooling
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("pooling must be one of mean, cls, last or none, got %q", req.Pooling)))
+		return
+	}
+
+	var input []string
+
+	switch i := req.Input.(type) {
+	case string:
+		if len(i) > 0 {
+			input = append(input, i)
+		}
+	case []any:
+		for _, v := range i {
+			if _, ok := v.(string); !ok {
+				c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "invalid input type"))
+				return
+			}
+			input = append(input, v.(string))
+		}
+	default:
+		if req.Input != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "invalid input type"))
+			return
+		}
+	}
+
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", req.Model)))
+		return
+	}
+
+	if name, err = resolveAlias(name); err != nil {
+		handleAliasError(c, err)
+		return
+	}
+
+	r, m, opts, err := s.scheduleRunner(c, name.String(), []model.Capability{}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	if len(input) == 0 {
+		c.JSON(http.StatusOK, api.EmbedResponse{Model: req.Model, Embeddings: [][]float32{}})
+		return
+	}
+
+	kvData, _, err := getModelData(m.ModelPath, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	counts, err := truncateInputs(c.Request.Context(), r, input, min(opts.NumCtx, int(kvData.ContextLength())), truncate)
+	if err != nil {
+		var serr api.StatusError
+		if !errors.As(err, &serr) {
+			serr.StatusCode = http.StatusInternalServerError
+		}
+		c.JSON(serr.StatusCode, errorJSON(cmp.Or(serr.Code, statusErrorCode(serr.StatusCode)), err.Error()))
+		return
+	}
 
 	var count int
+	for _, n := range counts {
+		count += n
+	}
+
+	// process applies pooling, dimensions and normalization to the
+	// embedding of an input, returning how many tokens it's of with pooling
+	// "none"
+	process := func(embedding []float32, count int) ([][]float32, int, error) {
+		embeddings := [][]float32{embedding}
+		if opts.Pooling == "none" {
+			// the runner returns the embeddings of every token of an input one
+			// after another, so split them into an embedding per token
+			n := int(kvData.EmbeddingLength())
+			if n == 0 {
+				return nil, 0, api.StatusError{StatusCode: http.StatusInternalServerError, ErrorMessage: "unknown embedding length"}
+			}
+
+			embeddings = slices.Collect(slices.Chunk(embedding, n))
+			count = len(embeddings)
+		}
+
+		for i, embedding := range embeddings {
+			if req.Dimensions > 0 {
+				if req.Dimensions > len(embedding) {
+					return nil, 0, api.StatusError{StatusCode: http.StatusBadRequest, ErrorMessage: fmt.Sprintf("dimensions %d exceeds the model's embedding length %d", req.Dimensions, len(embedding))}
+				}
+
+				embedding = embedding[:req.Dimensions]
+			}
+
+			if normalized {
+				embedding = normalize(embedding)
+			}
+
+			embeddings[i] = embedding
+		}
+
+		return embeddings, count, nil
+	}
+
+	type result struct {
+		embeddings [][]float32
+		count      int
+		err        error
+	}
+
+	// progress is reported as it arrives rather than in the order of the
+	// inputs
+	progress := make(chan api.EmbedResponse, len(input))
+
+	// inputs are embedded concurrently but their results are taken in order
+	results := make([]chan result, len(input))
+	for i, text := range input {
+		results[i] = make(chan result, 1)
+		go func() {
+			var fn func(api.PromptEvalProgress)
+			if req.ReportProgress {
+				fn = func(p api.PromptEvalProgress) {
+					select {
+					case progress <- api.EmbedResponse{Model: req.Model, Index: i, Embeddings: [][]float32{}, PromptEvalProgress: &p}:
+					case <-c.Request.Context().Done():
+					}
+				}
+			}
+
+			embedding, err := r.Embedding(c.Request.Context(), text, fn)
+			if err != nil {
+				results[i] <- result{err: api.StatusError{StatusCode: http.StatusInternalServerError, ErrorMessage: strings.TrimSpace(err.Error())}}
+				return
+			}
+
+			embeddings, count, err := process(embedding, counts[i])
+			results[i] <- result{embeddings, count, err}
+		}()
+	}
+
+	if streamed {
+		ch := make(chan any)
+		go func() {
+			defer close(ch)
+			for i := range input {
+				var res result
+				for done := false; !done; {
+					select {
+					case p := <-progress:
+						ch <- p
+					case res = <-results[i]:
+						done = true
+					}
+				}
+
+				// progress sent before the result may still be buffered
+				for len(progress) > 0 {
+					ch <- <-progress
+				}
+
+				if res.err != nil {
+					ch <- errorJSON(api.ErrorCodeInternal, res.err.Error())
+					return
+				}
+
+				ch <- api.EmbedResponse{
+					Model:       req.Model,
+					Index:       i,
+					Embeddings:  res.embeddings,
+					TokenCounts: []int{res.count},
+				}
+			}
+
+			ch <- api.EmbedResponse{
+				Model:           req.Model,
+				Embeddings:      [][]float32{},
+				Done:            true,
+				TotalDuration:   time.Since(checkpointStart),
+				LoadDuration:    checkpointLoaded.Sub(checkpointStart),
+				PromptEvalCount: count,
+			}
+		}()
+
+		streamResponse(c, ch)
+		return
+	}
+
+	var embeddings [][]float32
+	for i := range input {
+		res := <-results[i]
+		if res.err != nil {
+			var serr api.StatusError
+			if !errors.As(res.err, &serr) {
+				serr.StatusCode = http.StatusInternalServerError
+			}
+			c.AbortWithStatusJSON(serr.StatusCode, errorJSON(cmp.Or(serr.Code, statusErrorCode(serr.StatusCode)), res.err.Error()))
+			return
+		}
+
+		embeddings = append(embeddings, res.embeddings...)
+		counts[i] = res.count
+	}
+
+	resp := api.EmbedResponse{
+		Model:           req.Model,
+		Embeddings:      embeddings,
+		TokenCounts:     counts,
+		TotalDuration:   time.Since(checkpointStart),
+		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
+		PromptEvalCount: count,
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// truncateInputs shortens each input in place to at most ctxLen tokens, or
+// fails with a 400 if one is longer and truncate is false. It returns the
+// number of tokens of each input.
+func truncateInputs(ctx context.Context, r llm.LlamaServer, input []string, ctxLen int, truncate bool) ([]int, error) {
+	counts := make([]int, len(input))
 	for i, s := range input {
-		tokens, err := r.Tokenize(c.Request.Context(), s)
+		tokens, err := r.Tokenize(ctx, s)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+			return nil, err
 		}
 
-		ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
 		if len(tokens) > ctxLen {
 			if !truncate {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "input length exceeds maximum context length"})
-				return
+				return nil, api.StatusError{StatusCode: http.StatusBadRequest, ErrorMessage: "input length exceeds maximum context length", Code: api.ErrorCodeContextExceeded}
 			}
 
 			tokens = tokens[:ctxLen]
-			s, err = r.Detokenize(c.Request.Context(), tokens)
+			s, err = r.Detokenize(ctx, tokens)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
+				return nil, err
 			}
 		}
 
-		count += len(tokens)
-
+		counts[i] = len(tokens)
 		input[i] = s
 	}
 
-	var g errgroup.Group
+	return counts, nil
+}
+
+// SimilarityHandler embeds a query and candidates and ranks the candidates by
+// the cosine similarity of their embeddings to the query's.
+func (s *Server) SimilarityHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.SimilarityRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	if req.Query == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "query is required"))
+		return
+	}
+
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", req.Model)))
+		return
+	}
+
+	if name, err = resolveAlias(name); err != nil {
+		handleAliasError(c, err)
+		return
+	}
+
+	r, m, opts, err := s.scheduleRunner(c, name.String(), []model.Capability{}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	if opts.Pooling == "none" {
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "pooling \"none\" is only supported by /api/embed"))
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	kvData, _, err := getModelData(m.ModelPath, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	// the query is embedded along with the candidates, as the first input
+	input := append([]string{req.Query}, req.Candidates...)
+	counts, err := truncateInputs(c.Request.Context(), r, input, min(opts.NumCtx, int(kvData.ContextLength())), req.Truncate == nil || *req.Truncate)
+	if err != nil {
+		var serr api.StatusError
+		if !errors.As(err, &serr) {
+			serr.StatusCode = http.StatusInternalServerError
+		}
+		c.JSON(serr.StatusCode, errorJSON(cmp.Or(serr.Code, statusErrorCode(serr.StatusCode)), err.Error()))
+		return
+	}
+
 	embeddings := make([][]float32, len(input))
+	g, ctx := errgroup.WithContext(c.Request.Context())
 	for i, text := range input {
 		g.Go(func() error {
-			embedding, err := r.Embedding(c.Request.Context(), text)
+			embedding, err := r.Embedding(ctx, text, nil)
 			if err != nil {
 				return err
 			}
+
 			embeddings[i] = normalize(embedding)
 			return nil
 		})
 	}
 
 	if err := g.Wait(); err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": strings.TrimSpace(err.Error())})
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, strings.TrimSpace(err.Error())))
 		return
 	}
 
-	resp := api.EmbedResponse{
+	similarities := make([]api.Similarity, len(req.Candidates))
+	for i, embedding := range embeddings[1:] {
+		if len(embedding) != len(embeddings[0]) {
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, "embeddings have different lengths"))
+			return
+		}
+
+		// the embeddings are normalized, so their dot product is the cosine
+		var score float64
+		for j := range embedding {
+			score += float64(embedding[j]) * float64(embeddings[0][j])
+		}
+
+		similarities[i] = api.Similarity{Index: i, Score: score}
+	}
+
+	slices.SortStableFunc(similarities, func(a, b api.Similarity) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+
+	var count int
+	for _, n := range counts {
+		count += n
+	}
+
+	c.JSON(http.StatusOK, api.SimilarityResponse{
 		Model:           req.Model,
-		Embeddings:      embeddings,
+		Similarities:    similarities,
 		TotalDuration:   time.Since(checkpointStart),
 		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
 		PromptEvalCount: count,
+	})
+}
+
+func normalize(vec []float32) []float32 {
+	var sum float32
+	for _, v := range vec {
+		sum += v * v
+	}
+
+	norm := float32(0.0)
+	if sum > 0 {
+		norm = float32(1.0 / math.Sqrt(float64(sum)))
+	}
+
+	for i := range vec {
+		vec[i] *= norm
+	}
+	return vec
+}
+
+func (s *Server) EmbeddingsHandler(c *gin.Context) {
+	var req api.EmbeddingRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "model is required"))
+		return
+	}
+
+	name, err := resolveAlias(name)
+	if err != nil {
+		handleAliasError(c, err)
+		return
+	}
+
+	r, _, opts, err := s.scheduleRunner(c, name.String(), []model.Capability{}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	if opts.Pooling == "none" {
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "pooling \"none\" is only supported by /api/embed"))
+		return
+	}
+
+	// an empty request loads the model
+	if req.Prompt == "" {
+		c.JSON(http.StatusOK, api.EmbeddingResponse{Embedding: []float64{}})
+		return
+	}
+
+	embedding, err := r.Embedding(c.Request.Context(), req.Prompt, nil)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, strings.TrimSpace(err.Error())))
+		return
+	}
+
+	var e []float64
+	for _, v := range embedding {
+		e = append(e, float64(v))
+	}
+
+	resp := api.EmbeddingResponse{
+		Embedding: e,
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// sessionContext returns the path of the session with digest and the tokens
+// saved in it, which must have been saved with m
+func sessionContext(digest string, m *Model) (string, []int, error) {
+	path, err := GetSessionPath(digest)
+	if err != nil {
+		return "", nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	header, _, err := llm.ReadSessionHeader(f)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if header.Model != m.Digest {
+		return "", nil, errors.New("session was saved with a different model")
+	}
+
+	return path, header.Tokens, nil
+}
+
+// SaveSessionHandler saves the KV cache of a loaded model to a session file
+// named by its digest, which generate requests can continue from.
+func (s *Server) SaveSessionHandler(c *gin.Context) {
+	var req api.SessionSaveRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", req.Model)))
+		return
+	}
+
+	if name, err = resolveAlias(name); err != nil {
+		handleAliasError(c, err)
+		return
+	}
+
+	m, err := GetModel(name.String())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	// only the cache of a loaded model can be saved, so the model isn't
+	// loaded for it
+	runner, ok := s.sched.loadedRunner(m)
+	if ok {
+		select {
+		case <-runner.loaded:
+		default:
+			ok = false
+		}
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeNotFound, fmt.Sprintf("model '%s' is not loaded", req.Model)))
+		return
+	}
+	c.Request = c.Request.WithContext(runner.track(c.Request.Context()))
+	r := runner.llama
+
+	// the runner writes the session to a temporary file, which is renamed
+	// to its digest once it is complete
+	dir, err := GetSessionPath("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	tmp, err := os.CreateTemp(dir, "sha256-")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	tokens, err := r.SaveSession(c.Request.Context(), m.Digest, req.Context, tmp.Name())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	digest := fmt.Sprintf("sha256:%x", h.Sum(nil))
+	path, err := GetSessionPath(digest)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, api.SessionSaveResponse{Model: req.Model, Session: digest, Tokens: len(tokens), Size: size})
+}
+
+// loadTokenizer loads the vocabulary of the model with the given name, so
+// that tokenizing doesn't load the model or evict others from memory
+func loadTokenizer(name model.Name) (llm.Tokenizer, error) {
+	m, err := GetModel(name.String())
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := llm.LoadModel(m.ModelPath, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return llm.NewTokenizer(m.ModelPath, f)
+}
+
+func (s *Server) TokenizeHandler(c *gin.Context) {
+	var req api.TokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	if req.Model == "" {
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "model is required"))
+		return
+	}
+
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", req.Model)))
+		return
+	}
+
+	r, err := loadTokenizer(name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", req.Model)))
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+	defer r.Close()
+
+	tokens := []int{}
+	if req.Text != "" {
+		tokens, err = r.Tokenize(c.Request.Context(), req.Text)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, api.TokenizeResponse{Model: req.Model, Tokens: tokens})
+}
+
+// CompareTokenizersHandler tokenizes text with two models and responds with
+// both tokenizations and the difference in their number of tokens.
+func (s *Server) CompareTokenizersHandler(c *gin.Context) {
+	var req api.CompareTokenizersRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	if len(req.Models) != 2 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("models must name 2 models to compare, got %d", len(req.Models))))
+		return
+	}
+
+	names := make([]model.Name, len(req.Models))
+	for i, m := range req.Models {
+		name, err := getExistingName(model.ParseName(m))
+		if err != nil {
+			c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", m)))
+			return
+		}
+		names[i] = name
+	}
+
+	resp := api.CompareTokenizersResponse{Tokenizations: make([]api.Tokenization, len(names))}
+	for i, name := range names {
+		r, err := loadTokenizer(name)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", req.Models[i])))
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+			return
+		}
+
+		tokenization, err := tokenPieces(c.Request.Context(), r, req.Text)
+		r.Close()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+			return
+		}
+
+		tokenization.Model = req.Models[i]
+		resp.Tokenizations[i] = tokenization
 	}
+
+	resp.Diff = len(resp.Tokenizations[1].Tokens) - len(resp.Tokenizations[0].Tokens)
 	c.JSON(http.StatusOK, resp)
 }
 
-func normalize(vec []float32) []float32 {
-	var sum float32
-	for _, v := range vec {
-		sum += v * v
+// tokenPieces tokenizes text with r and decodes each of its tokens on its own
+func tokenPieces(ctx context.Context, r llm.Tokenizer, text string) (api.Tokenization, error) {
+	t := api.Tokenization{Tokens: []int{}, Pieces: []string{}}
+	if text == "" {
+		return t, nil
 	}
 
-	norm := float32(0.0)
-	if sum > 0 {
-		norm = float32(1.0 / math.Sqrt(float64(sum)))
+	tokens, err := r.Tokenize(ctx, text)
+	if err != nil {
+		return t, err
 	}
 
-	for i := range vec {
-		vec[i] *= norm
+	pieces, err := r.Pieces(ctx, tokens)
+	if err != nil {
+		return t, err
 	}
-	return vec
+
+	t.Tokens, t.Pieces = tokens, pieces
+	return t, nil
 }
 
-func (s *Server) EmbeddingsHandler(c *gin.Context) {
-	var req api.EmbeddingRequest
+func (s *Server) DetokenizeHandler(c *gin.Context) {
+	var req api.DetokenizeRequest
 	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
 		return
 	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		return
 	}
 
-	name := model.ParseName(req.Model)
-	if !name.IsValid() {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+	if req.Model == "" {
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "model is required"))
 		return
 	}
 
-	r, _, _, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{}, req.Options, req.KeepAlive)
+	name, err := getExistingName(model.ParseName(req.Model))
 	if err != nil {
-		handleScheduleError(c, req.Model, err)
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", req.Model)))
 		return
 	}
 
-	// an empty request loads the model
-	if req.Prompt == "" {
-		c.JSON(http.StatusOK, api.EmbeddingResponse{Embedding: []float64{}})
+	r, err := loadTokenizer(name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", req.Model)))
 		return
-	}
-
-	embedding, err := r.Embedding(c.Request.Context(), req.Prompt)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": strings.TrimSpace(err.Error())})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 		return
 	}
+	defer r.Close()
 
-	var e []float64
-	for _, v := range embedding {
-		e = append(e, float64(v))
+	var text string
+	if len(req.Tokens) > 0 {
+		text, err = r.Detokenize(c.Request.Context(), req.Tokens)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+			return
+		}
 	}
 
-	resp := api.EmbeddingResponse{
-		Embedding: e,
-	}
-	c.JSON(http.StatusOK, resp)
+	c.JSON(http.StatusOK, api.DetokenizeResponse{Model: req.Model, Text: text})
 }
 
 func (s *Server) PullHandler(c *gin.Context) {
@@ -570,45 +1730,79 @@ func (s *Server) PullHandler(c *gin.Context) {
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		return
 	}
 
 	name := model.ParseName(cmp.Or(req.Model, req.Name))
 	if !name.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, errtypes.InvalidModelNameErrMsg))
 		return
 	}
 
 	name, err = getExistingName(name)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		return
 	}
 
+	if req.Webhook != "" {
+		if err := validateWebhook(req.Webhook); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+			return
+		}
+	}
+
+	// with a webhook to report to, the pull continues after the client
+	// disconnects, and progress is dropped once the response has ended
+	ctx := c.Request.Context()
+	if req.Webhook != "" {
+		ctx = context.WithoutCancel(ctx)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
 	ch := make(chan any)
+	send := func(v any) {
+		select {
+		case ch <- v:
+		case <-done:
+		}
+	}
+
 	go func() {
 		defer close(ch)
 		fn := func(r api.ProgressResponse) {
-			ch <- r
+			send(r)
 		}
 
 		regOpts := &registryOptions{
 			Insecure: req.Insecure,
 		}
 
-		ctx, cancel := context.WithCancel(c.Request.Context())
+		ctx, cancel := context.WithCancel(ctx)
 		defer cancel()
 
-		if err := PullModel(ctx, name.DisplayShortest(), regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+		err := PullModel(ctx, name.DisplayShortest(), regOpts, fn)
+		if req.Webhook != "" {
+			go notifyPull(context.WithoutCancel(ctx), req.Webhook, name.DisplayShortest(), err)
+		}
+
+		if err != nil {
+			send(errorJSON(api.ErrorCodeInternal, err.Error()))
 		}
 	}()
 
 	if req.Stream != nil && !*req.Stream {
+		if req.Webhook != "" {
+			c.JSON(http.StatusAccepted, api.ProgressResponse{Status: "pulling"})
+			return
+		}
+
 		waitForStream(c, ch)
 		return
 	}
@@ -621,10 +1815,10 @@ func (s *Server) PushHandler(c *gin.Context) {
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		return
 	}
 
@@ -634,7 +1828,7 @@ func (s *Server) PushHandler(c *gin.Context) {
 	} else if req.Name != "" {
 		mname = req.Name
 	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "model is required"))
 		return
 	}
 
@@ -654,12 +1848,12 @@ func (s *Server) PushHandler(c *gin.Context) {
 
 		name, err := getExistingName(model.ParseName(mname))
 		if err != nil {
-			ch <- gin.H{"error": err.Error()}
+			ch <- errorJSON(api.ErrorCodeInternal, err.Error())
 			return
 		}
 
 		if err := PushModel(ctx, name.DisplayShortest(), regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			ch <- errorJSON(api.ErrorCodeInternal, err.Error())
 		}
 	}()
 
@@ -671,6 +1865,67 @@ func (s *Server) PushHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
+func (s *Server) ManifestHandler(c *gin.Context) {
+	var req api.ManifestRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, errtypes.InvalidModelNameErrMsg))
+		return
+	}
+
+	m, err := RemoteManifest(c.Request.Context(), name.DisplayShortest(), &registryOptions{Insecure: req.Insecure})
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		c.AbortWithStatusJSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", req.Model)))
+		return
+	case errors.Is(err, errUnauthorized):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, errorJSON(api.ErrorCodeUnauthorized, err.Error()))
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	layers := m.Layers
+	if m.Config.Digest != "" {
+		layers = append(layers, m.Config)
+	}
+
+	resp := api.ManifestResponse{Model: name.DisplayShortest(), Layers: make([]api.ManifestLayer, 0, len(layers))}
+	for _, layer := range layers {
+		local := false
+		if p, err := GetBlobsPath(layer.Digest); err == nil {
+			if fi, err := os.Stat(p); err == nil && fi.Size() == layer.Size {
+				local = true
+			}
+		}
+
+		resp.Layers = append(resp.Layers, api.ManifestLayer{
+			MediaType: layer.MediaType,
+			Digest:    layer.Digest,
+			Size:      layer.Size,
+			Local:     local,
+		})
+
+		resp.TotalSize += layer.Size
+		if !local {
+			resp.MissingSize += layer.Size
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
 // getExistingName searches the models directory for the longest prefix match of
 // the input name and returns the input name with all existing parts replaced
 // with each part found. If no parts are found, the input name is returned as
@@ -699,25 +1954,151 @@ func getExistingName(n model.Name) (model.Name, error) {
 	return n, nil
 }
 
+func (s *Server) UnloadHandler(c *gin.Context) {
+	var r api.UnloadRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	n := model.ParseName(r.Model)
+	if !n.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("name %q is invalid", r.Model)))
+		return
+	}
+
+	n, err := resolveAlias(n)
+	if err != nil {
+		handleAliasError(c, err)
+		return
+	}
+
+	m, err := GetModel(n.String())
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", r.Model)))
+		default:
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		}
+		return
+	}
+
+	if err := s.sched.unloadRunner(c.Request.Context(), m, r.Abort); errors.Is(err, errModelNotLoaded) {
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeNotFound, fmt.Sprintf("model '%s' is not loaded", r.Model)))
+		return
+	} else if errors.Is(err, context.Canceled) {
+		c.JSON(499, errorJSON(api.ErrorCodeCanceled, "request canceled"))
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, nil)
+}
+
+// HealthHandler reports whether the server is up or, with a model query
+// parameter, whether that model is loaded and ready for requests. Models that
+// aren't ready get a 503 so the endpoint can be used as a readiness probe.
+func (s *Server) HealthHandler(c *gin.Context) {
+	name := c.Query("model")
+	if name == "" {
+		c.JSON(http.StatusOK, api.HealthResponse{Status: "ok"})
+		return
+	}
+
+	n := model.ParseName(name)
+	if !n.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("name %q is invalid", name)))
+		return
+	}
+
+	m, err := GetModel(n.String())
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", name)))
+		default:
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		}
+		return
+	}
+
+	resp := api.HealthResponse{Status: "not-loaded", Model: name}
+
+	runner, ok := s.sched.loadedRunner(m)
+	if !ok {
+		c.JSON(http.StatusServiceUnavailable, resp)
+		return
+	}
+
+	select {
+	case <-runner.loaded:
+		resp.Status = "ready"
+		resp.Progress = 100
+		c.JSON(http.StatusOK, resp)
+		return
+	default:
+	}
+
+	resp.Status = "loading"
+	progress := runner.llama.LoadProgress()
+	resp.Progress = int(progress * 100)
+	if progress > 0 && progress < 1 {
+		// assume the rest loads as quickly as what has loaded so far
+		elapsed := time.Since(runner.loadStarted)
+		resp.EstimatedTimeToReady = &api.Duration{Duration: time.Duration(float64(elapsed) * float64(1-progress) / float64(progress))}
+	}
+
+	c.JSON(http.StatusServiceUnavailable, resp)
+}
+
+func (s *Server) CancelHandler(c *gin.Context) {
+	var r api.CancelRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	if r.RequestID == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "request_id is required"))
+		return
+	}
+
+	if !s.inflight.cancel(r.RequestID) {
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeNotFound, fmt.Sprintf("request '%s' is not in progress", r.RequestID)))
+		return
+	}
+
+	c.JSON(http.StatusOK, nil)
+}
+
 func (s *Server) DeleteHandler(c *gin.Context) {
 	var r api.DeleteRequest
 	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
 		return
 	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		return
 	}
 
 	n := model.ParseName(cmp.Or(r.Model, r.Name))
 	if !n.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", cmp.Or(r.Model, r.Name))})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("name %q is invalid", cmp.Or(r.Model, r.Name))))
 		return
 	}
 
 	n, err := getExistingName(n)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", cmp.Or(r.Model, r.Name))})
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", cmp.Or(r.Model, r.Name))))
 		return
 	}
 
@@ -725,20 +2106,25 @@ func (s *Server) DeleteHandler(c *gin.Context) {
 	if err != nil {
 		switch {
 		case os.IsNotExist(err):
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", cmp.Or(r.Model, r.Name))})
+			c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", cmp.Or(r.Model, r.Name))))
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 		}
 		return
 	}
 
 	if err := m.Remove(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 		return
 	}
 
 	if err := m.RemoveLayers(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	if err := deleteAliasesOf(n); err != nil {
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 		return
 	}
 }
@@ -748,10 +2134,10 @@ func (s *Server) ShowHandler(c *gin.Context) {
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		return
 	}
 
@@ -760,7 +2146,7 @@ func (s *Server) ShowHandler(c *gin.Context) {
 	} else if req.Name != "" {
 		req.Model = req.Name
 	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "model is required"))
 		return
 	}
 
@@ -768,11 +2154,11 @@ func (s *Server) ShowHandler(c *gin.Context) {
 	if err != nil {
 		switch {
 		case os.IsNotExist(err):
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+			c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", req.Model)))
 		case err.Error() == errtypes.InvalidModelNameErrMsg:
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 		}
 		return
 	}
@@ -860,6 +2246,22 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 		return nil, err
 	}
 
+	resp.Architecture, err = architectureInfo(m.ModelPath, kvData)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.TrainCtx = int(kvData.ContextLength())
+	resp.BitsPerWeight, resp.Quantization = quantization(tensors)
+
+	// models created from a GGUF file have the file type in their config,
+	// but it's also in the file for those that don't
+	if resp.Details.QuantizationLevel == "" {
+		if ft := kvData.FileType(); ft != ggml.FileTypeUnknown {
+			resp.Details.QuantizationLevel = ft.String()
+		}
+	}
+
 	delete(kvData, "general.name")
 	delete(kvData, "tokenizer.chat_template")
 	resp.ModelInfo = kvData
@@ -881,6 +2283,92 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 	return resp, nil
 }
 
+// architectureInfo derives structural details of a model from its metadata.
+func architectureInfo(modelPath string, kv ggml.KV) (*api.ArchitectureInfo, error) {
+	arch := kv.Architecture()
+
+	// read scalar values defensively since some architectures store per-layer
+	// arrays under the same keys
+	uintValue := func(key string) uint64 {
+		if v, ok := kv[arch+"."+key].(uint32); ok {
+			return uint64(v)
+		}
+		return 0
+	}
+
+	info := api.ArchitectureInfo{
+		Name:            arch,
+		BlockCount:      uintValue("block_count"),
+		EmbeddingLength: uintValue("embedding_length"),
+		NumHeads:        uintValue("attention.head_count"),
+		NumKVHeads:      uintValue("attention.head_count_kv"),
+		HeadDim:         uintValue("attention.key_length"),
+	}
+
+	if info.NumKVHeads == 0 {
+		info.NumKVHeads = info.NumHeads
+	}
+
+	if info.HeadDim == 0 && info.NumHeads > 0 {
+		info.HeadDim = info.EmbeddingLength / info.NumHeads
+	}
+
+	key := arch + ".attention.cross_attention_layers"
+	if _, ok := kv[key]; ok {
+		info.CrossAttentionLayers = kv.Ints("attention.cross_attention_layers")
+		if info.CrossAttentionLayers == nil {
+			// array values are dropped unless the model was loaded verbosely
+			f, err := llm.LoadModel(modelPath, math.MaxUint16)
+			if err != nil {
+				return nil, err
+			}
+			info.CrossAttentionLayers = f.KV().Ints("attention.cross_attention_layers")
+		}
+	}
+
+	return &info, nil
+}
+
+// quantization breaks tensors down by type and returns the average bits per
+// weight over all of them
+func quantization(tensors ggml.Tensors) (float64, []api.QuantizationType) {
+	bitsPerWeight := func(size, params uint64) float64 {
+		if params == 0 {
+			return 0
+		}
+		return float64(size*8) / float64(params)
+	}
+
+	var params, size uint64
+	byType := make(map[string]*api.QuantizationType)
+	for _, t := range tensors.Items() {
+		q, ok := byType[t.Type()]
+		if !ok {
+			q = &api.QuantizationType{Type: t.Type()}
+			byType[t.Type()] = q
+		}
+
+		q.Tensors++
+		q.Parameters += t.Elements()
+		q.Size += t.Size()
+
+		params += t.Elements()
+		size += t.Size()
+	}
+
+	types := make([]api.QuantizationType, 0, len(byType))
+	for _, q := range byType {
+		q.BitsPerWeight = bitsPerWeight(q.Size, q.Parameters)
+		types = append(types, *q)
+	}
+
+	slices.SortFunc(types, func(a, b api.QuantizationType) int {
+		return cmp.Or(cmp.Compare(b.Parameters, a.Parameters), cmp.Compare(a.Type, b.Type))
+	})
+
+	return bitsPerWeight(size, params), types
+}
+
 func getModelData(digest string, verbose bool) (ggml.KV, ggml.Tensors, error) {
 	maxArraySize := 0
 	if verbose {
@@ -907,7 +2395,7 @@ func getModelData(digest string, verbose bool) (ggml.KV, ggml.Tensors, error) {
 func (s *Server) ListHandler(c *gin.Context) {
 	ms, err := Manifests(true)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 		return
 	}
 
@@ -943,6 +2431,7 @@ func (s *Server) ListHandler(c *gin.Context) {
 				ParameterSize:     cf.ModelType,
 				QuantizationLevel: cf.FileType,
 			},
+			ContextLength: contextLength(m),
 		})
 	}
 
@@ -951,57 +2440,276 @@ func (s *Server) ListHandler(c *gin.Context) {
 		return cmp.Compare(j.ModifiedAt.Unix(), i.ModifiedAt.Unix())
 	})
 
-	c.JSON(http.StatusOK, api.ListResponse{Models: models})
+	c.JSON(http.StatusOK, api.ListResponse{Models: models})
+}
+
+// contextLengths caches the context length read from each model layer by
+// its digest, since a blob's contents never change
+var contextLengths sync.Map
+
+// contextLength returns the context length the model in m was trained with,
+// or 0 if it has no model layer or the layer cannot be read
+func contextLength(m *Manifest) uint64 {
+	for _, layer := range m.Layers {
+		if layer.MediaType != "application/vnd.ollama.image.model" {
+			continue
+		}
+
+		if n, ok := contextLengths.Load(layer.Digest); ok {
+			return n.(uint64)
+		}
+
+		p, err := GetBlobsPath(layer.Digest)
+		if err != nil {
+			return 0
+		}
+
+		// only the key values up to the one needed are read
+		f, err := gguf.Open(p)
+		if err != nil {
+			slog.Warn("couldn't open model file", "digest", layer.Digest, "error", err)
+			return 0
+		}
+		defer f.Close()
+
+		n := f.KeyValue("context_length").Uint()
+		contextLengths.Store(layer.Digest, n)
+		return n
+	}
+
+	return 0
+}
+
+// OptionsHandler updates the default options of a model, which are merged
+// under those of each request, and responds with them.
+func (s *Server) OptionsHandler(c *gin.Context) {
+	var r api.OptionsRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	n := model.ParseName(r.Model)
+	if !n.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("name %q is invalid", r.Model)))
+		return
+	}
+
+	n, err := getExistingName(n)
+	if err != nil {
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", r.Model)))
+		return
+	}
+
+	var opts map[string]any
+	if len(r.Options) > 0 {
+		opts, err = SetModelOptions(n, r.Options)
+	} else {
+		var m *Model
+		if m, err = GetModel(n.String()); err == nil {
+			opts = m.Options
+		}
+	}
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", r.Model)))
+		return
+	case errors.Is(err, errInvalidOptions):
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidOptions, err.Error()))
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	if opts == nil {
+		opts = make(map[string]any)
+	}
+
+	c.JSON(http.StatusOK, api.OptionsResponse{Model: r.Model, Options: opts})
 }
 
 func (s *Server) CopyHandler(c *gin.Context) {
 	var r api.CopyRequest
 	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
 		return
 	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		return
 	}
 
 	src := model.ParseName(r.Source)
 	if !src.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("source %q is invalid", r.Source)})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("source %q is invalid", r.Source)))
 		return
 	}
 	src, err := getExistingName(src)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		return
 	}
 
 	dst := model.ParseName(r.Destination)
 	if !dst.IsValid() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("destination %q is invalid", r.Destination)})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("destination %q is invalid", r.Destination)))
 		return
 	}
 	dst, err = getExistingName(dst)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	if r.Quantize == "" {
+		if err := CopyModel(src, dst); errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model %q not found", r.Source)))
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		}
+		return
+	}
+
+	quantType := strings.ToUpper(r.Quantize)
+	if _, err := ggml.ParseFileType(quantType); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	if _, err := ParseNamedManifest(src); errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model %q not found", r.Source)))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	ch := make(chan any)
+	go func() {
+		defer close(ch)
+		fn := func(resp api.ProgressResponse) {
+			ch <- resp
+		}
+
+		oldManifest, _ := ParseNamedManifest(dst)
+
+		if err := CopyQuantizedModel(c.Request.Context(), src, dst, quantType, fn); err != nil {
+			ch <- errorJSON(api.ErrorCodeInternal, err.Error())
+			return
+		}
+
+		if !envconfig.NoPrune() && oldManifest != nil && src.Filepath() != dst.Filepath() {
+			if err := oldManifest.RemoveLayers(); err != nil {
+				ch <- errorJSON(api.ErrorCodeInternal, err.Error())
+			}
+		}
+
+		ch <- api.ProgressResponse{Status: "success"}
+	}()
+
+	if r.Stream != nil && !*r.Stream {
+		waitForStream(c, ch)
+		return
+	}
+
+	streamResponse(c, ch)
+}
+
+func (s *Server) AliasHandler(c *gin.Context) {
+	var r api.AliasRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	alias := model.ParseName(r.Alias)
+	if !alias.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("alias %q is invalid", r.Alias)))
+		return
+	}
+
+	target := model.ParseName(r.Model)
+	if !target.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("model %q is invalid", r.Model)))
+		return
+	}
+
+	target, err := getExistingName(target)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 		return
 	}
 
-	if err := CopyModel(src, dst); errors.Is(err, os.ErrNotExist) {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", r.Source)})
+	switch err := SetAlias(alias, target); {
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model %q not found", r.Model)))
+	case errors.Is(err, errAliasConflict):
+		c.JSON(http.StatusConflict, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+	default:
+		c.JSON(http.StatusOK, nil)
+	}
+}
+
+func (s *Server) DeleteAliasHandler(c *gin.Context) {
+	var r api.DeleteAliasRequest
+	if err := c.ShouldBindJSON(&r); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
+		return
 	} else if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	alias := model.ParseName(r.Alias)
+	if !alias.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("alias %q is invalid", r.Alias)))
+		return
+	}
+
+	switch err := DeleteAlias(alias); {
+	case errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeNotFound, fmt.Sprintf("alias %q not found", r.Alias)))
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+	default:
+		c.JSON(http.StatusOK, nil)
 	}
 }
 
+// blobDigest returns the digest in the request path in the sha256:<hex> form
+// blobs are stored by
+func blobDigest(c *gin.Context) (string, error) {
+	if _, err := GetBlobsPath(c.Param("digest")); err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(strings.Replace(c.Param("digest"), "-", ":", 1)), nil
+}
+
 func (s *Server) HeadBlobHandler(c *gin.Context) {
-	path, err := GetBlobsPath(c.Param("digest"))
+	digest, err := blobDigest(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	path, err := GetBlobsPath(digest)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 		return
 	}
 
 	if _, err := os.Stat(path); err != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", c.Param("digest"))})
+		c.AbortWithStatusJSON(http.StatusNotFound, errorJSON(api.ErrorCodeNotFound, fmt.Sprintf("blob %q not found", c.Param("digest"))))
 		return
 	}
 
@@ -1009,18 +2717,30 @@ func (s *Server) HeadBlobHandler(c *gin.Context) {
 }
 
 func (s *Server) CreateBlobHandler(c *gin.Context) {
-	if ib, ok := intermediateBlobs[c.Param("digest")]; ok {
+	digest, err := blobDigest(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	path, err := GetBlobsPath(digest)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	if ib, ok := intermediateBlobs[digest]; ok {
 		p, err := GetBlobsPath(ib)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 			return
 		}
 
 		if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
 			slog.Info("evicting intermediate blob which no longer exists", "digest", ib)
-			delete(intermediateBlobs, c.Param("digest"))
+			delete(intermediateBlobs, digest)
 		} else if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 			return
 		} else {
 			c.Status(http.StatusOK)
@@ -1028,32 +2748,23 @@ func (s *Server) CreateBlobHandler(c *gin.Context) {
 		}
 	}
 
-	path, err := GetBlobsPath(c.Param("digest"))
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
 	_, err = os.Stat(path)
 	switch {
 	case errors.Is(err, os.ErrNotExist):
 		// noop
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 		return
 	default:
 		c.Status(http.StatusOK)
 		return
 	}
 
-	layer, err := NewLayer(c.Request.Body, "")
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if _, err := newLayer(c.Request.Body, "", digest); errors.Is(err, errLayerDigestMismatch) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		return
-	}
-
-	if layer.Digest != c.Param("digest") {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("digest mismatch, expected %q, got %q", c.Param("digest"), layer.Digest)})
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 		return
 	}
 
@@ -1156,6 +2867,7 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 		"User-Agent",
 		"Accept",
 		"X-Requested-With",
+		sessionHeader,
 
 		// OpenAI compatibility headers
 		"OpenAI-Beta",
@@ -1172,6 +2884,7 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 		"x-stainless-runtime-version",
 		"x-stainless-timeout",
 	}
+	corsConfig.ExposeHeaders = []string{sessionRemainingHeader}
 	corsConfig.AllowOrigins = envconfig.AllowedOrigins()
 
 	r := gin.Default()
@@ -1181,32 +2894,52 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 		allowedHostsMiddleware(s.addr),
 	)
 
+	if envconfig.Compression() {
+		r.Use(compressMiddleware())
+	}
+
 	// General
 	r.HEAD("/", func(c *gin.Context) { c.String(http.StatusOK, "Ollama is running") })
 	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, "Ollama is running") })
 	r.HEAD("/api/version", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"version": version.Version}) })
 	r.GET("/api/version", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"version": version.Version}) })
+	r.HEAD("/health", s.HealthHandler)
+	r.GET("/health", s.HealthHandler)
+	r.HEAD("/api/health", s.HealthHandler)
+	r.GET("/api/health", s.HealthHandler)
 
 	// Local model cache management (new implementation is at end of function)
 	r.POST("/api/pull", s.PullHandler)
 	r.POST("/api/push", s.PushHandler)
+	r.POST("/api/manifest", s.ManifestHandler)
 	r.HEAD("/api/tags", s.ListHandler)
 	r.GET("/api/tags", s.ListHandler)
 	r.POST("/api/show", s.ShowHandler)
 	r.DELETE("/api/delete", s.DeleteHandler)
+	r.DELETE("/api/unload", s.UnloadHandler)
+	r.POST("/api/cancel", s.CancelHandler)
 
 	// Create
 	r.POST("/api/create", s.CreateHandler)
 	r.POST("/api/blobs/:digest", s.CreateBlobHandler)
 	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
 	r.POST("/api/copy", s.CopyHandler)
+	r.POST("/api/alias", s.AliasHandler)
+	r.DELETE("/api/alias", s.DeleteAliasHandler)
+	r.POST("/api/options", s.OptionsHandler)
+	r.POST("/api/session/save", s.SaveSessionHandler)
 
 	// Inference
 	r.GET("/api/ps", s.PsHandler)
 	r.POST("/api/generate", s.GenerateHandler)
+	r.POST("/api/generate/batch", s.BatchGenerateHandler)
 	r.POST("/api/chat", s.ChatHandler)
 	r.POST("/api/embed", s.EmbedHandler)
+	r.POST("/api/similarity", s.SimilarityHandler)
 	r.POST("/api/embeddings", s.EmbeddingsHandler)
+	r.POST("/api/tokenize", s.TokenizeHandler)
+	r.POST("/api/tokenize/compare", s.CompareTokenizersHandler)
+	r.POST("/api/detokenize", s.DetokenizeHandler)
 
 	// Inference (OpenAI compatibility)
 	r.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
@@ -1311,6 +3044,11 @@ func Serve(ln net.Listener) error {
 
 	s.sched.Run(schedCtx)
 
+	// requests for a model that is still being preloaded wait for it to load
+	if models := envconfig.Preload(); len(models) > 0 {
+		go s.sched.Preload(schedCtx, models)
+	}
+
 	// register the experimental webp decoder
 	// so webp images can be used in multimodal inputs
 	image.RegisterFormat("webp", "RIFF????WEBP", webp.Decode, webp.DecodeConfig)
@@ -1346,10 +3084,14 @@ func waitForStream(c *gin.Context, ch chan any) {
 			if !ok {
 				errorMsg = "unknown error"
 			}
-			c.JSON(status, gin.H{"error": errorMsg})
+			code, ok := r["code"].(string)
+			if !ok {
+				code = statusErrorCode(status)
+			}
+			c.JSON(status, errorJSON(code, errorMsg))
 			return
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "unknown message type"})
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, "unknown message type"))
 			return
 		}
 	}
@@ -1357,11 +3099,26 @@ func waitForStream(c *gin.Context, ch chan any) {
 	c.JSON(http.StatusOK, latest)
 }
 
+// streamResponse streams each value sent on ch as JSON, one per line, or
+// as server-sent events ending with a [DONE] event if the request accepts
+// them. The OpenAI compatible endpoints frame their own events.
 func streamResponse(c *gin.Context, ch chan any) {
-	c.Header("Content-Type", "application/x-ndjson")
+	events := sse.Accepts(c.GetHeader("Accept")) && !strings.HasPrefix(c.Request.URL.Path, "/v1/")
+	if events {
+		c.Header("Content-Type", sse.ContentType)
+		c.Header("Cache-Control", "no-cache")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+
 	c.Stream(func(w io.Writer) bool {
 		val, ok := <-ch
 		if !ok {
+			if events {
+				if err := sse.WriteDone(w); err != nil {
+					slog.Info(fmt.Sprintf("streamResponse: w.Write failed with %s", err))
+				}
+			}
 			return false
 		}
 
@@ -1371,9 +3128,14 @@ func streamResponse(c *gin.Context, ch chan any) {
 			return false
 		}
 
-		// Delineate chunks with new-line delimiter
-		bts = append(bts, '\n')
-		if _, err := w.Write(bts); err != nil {
+		if events {
+			err = sse.Write(w, bts)
+		} else {
+			// Delineate chunks with new-line delimiter
+			_, err = w.Write(append(bts, '\n'))
+		}
+
+		if err != nil {
 			slog.Info(fmt.Sprintf("streamResponse: w.Write failed with %s", err))
 			return false
 		}
@@ -1382,6 +3144,10 @@ func streamResponse(c *gin.Context, ch chan any) {
 	})
 }
 
+// usageTimeout bounds how long listing the running models waits for each
+// runner to report its usage
+const usageTimeout = 2 * time.Second
+
 func (s *Server) PsHandler(c *gin.Context) {
 	models := []api.ProcessModelResponse{}
 
@@ -1396,21 +3162,49 @@ func (s *Server) PsHandler(c *gin.Context) {
 		}
 
 		mr := api.ProcessModelResponse{
-			Model:     model.ShortName,
-			Name:      model.ShortName,
-			Size:      int64(v.estimatedTotal),
-			SizeVRAM:  int64(v.estimatedVRAM),
-			Digest:    model.Digest,
-			Details:   modelDetails,
-			ExpiresAt: v.expiresAt,
+			Model:       model.ShortName,
+			Name:        model.ShortName,
+			Size:        int64(v.estimatedTotal),
+			SizeVRAM:    int64(v.estimatedVRAM),
+			Digest:      model.Digest,
+			Details:     modelDetails,
+			ExpiresAt:   v.expiresAt,
+			NumParallel: v.numParallel,
 		}
+		mr.Priority, mr.Preloaded = s.sched.preloadPriority(v.modelPath)
 		// The scheduler waits to set expiresAt, so if a model is loading it's
 		// possible that it will be set to the unix epoch. For those cases, just
-		// calculate the time w/ the sessionDuration instead.
+		// calculate the time w/ the sessionDuration instead. The same applies
+		// to models serving requests, as their timer starts once they're idle.
 		var epoch time.Time
-		if v.expiresAt == epoch {
+		v.refMu.Lock()
+		if v.expiresAt == epoch || v.refCount > 0 {
 			mr.ExpiresAt = time.Now().Add(v.sessionDuration)
 		}
+		loading := v.loading
+		v.refMu.Unlock()
+
+		if v.sessionDuration == time.Duration(math.MaxInt64) {
+			mr.ExpiresIn = api.Duration{Duration: -1}
+		} else {
+			mr.ExpiresIn = api.Duration{Duration: max(time.Until(mr.ExpiresAt), 0)}
+		}
+
+		// models that are still loading have no usage to report yet
+		if !loading {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), usageTimeout)
+			usage, err := v.llama.Usage(ctx)
+			cancel()
+			if err != nil {
+				slog.Debug("failed to get model usage", "model", model.ShortName, "error", err)
+			} else {
+				mr.ContextUsed = usage.ContextUsed
+				mr.ContextTotal = usage.ContextTotal
+				mr.VRAMBytes = usage.VRAM
+				mr.GPULayers = usage.GPULayers
+				mr.GPULayerRanges = usage.GPULayerRanges
+			}
+		}
 
 		models = append(models, mr)
 	}
@@ -1428,24 +3222,24 @@ func (s *Server) ChatHandler(c *gin.Context) {
 
 	var req api.ChatRequest
 	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "missing request body"))
 		return
 	} else if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 		return
 	}
 
 	// expire the runner
-	if len(req.Messages) == 0 && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
+	if len(req.Messages) == 0 && req.KeepAlive != nil && req.KeepAlive.Duration == 0 {
 		model, err := GetModel(req.Model)
 		if err != nil {
 			switch {
 			case os.IsNotExist(err):
-				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+				c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model '%s' not found", req.Model)))
 			case err.Error() == errtypes.InvalidModelNameErrMsg:
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
 			default:
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 			}
 			return
 		}
@@ -1471,24 +3265,75 @@ func (s *Server) ChatHandler(c *gin.Context) {
 
 	name := model.ParseName(req.Model)
 	if !name.IsValid() {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "model is required"))
 		return
 	}
 	name, err := getExistingName(name)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "model is required"))
+		return
+	}
+
+	if name, err = resolveAlias(name); err != nil {
+		handleAliasError(c, err)
 		return
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
+	r, m, opts, err := s.scheduleRunner(c, name.String(), caps, req.Options, req.KeepAlive)
 	if errors.Is(err, errCapabilityCompletion) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeUnsupported, fmt.Sprintf("%q does not support chat", req.Model)))
 		return
 	} else if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
+	think, err := resolveThink(m, req.Think, opts)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	if opts.N > 1 && req.Stream != nil && !*req.Stream {
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, errNRequiresStream.Error()))
+		return
+	}
+
+	switch req.ToolValidation {
+	case "", "mark":
+	case "retry":
+		if opts.N > 1 {
+			c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, "tool_validation retry cannot be used with n greater than 1"))
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("invalid tool_validation %q, must be mark or retry", req.ToolValidation)))
+		return
+	}
+
+	var keepSystem bool
+	switch req.TruncationStrategy {
+	case "", "keep_system":
+		keepSystem = true
+	case "drop_oldest":
+	default:
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, fmt.Sprintf("invalid truncation_strategy %q, must be keep_system or drop_oldest", req.TruncationStrategy)))
+		return
+	}
+
+	if req.Template != "" {
+		tmpl, err := requestTemplate(req.Template)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+			return
+		}
+
+		// the template is only overridden for this request
+		override := *m
+		override.Template = tmpl
+		m = &override
+	}
+
 	checkpointLoaded := time.Now()
 
 	if len(req.Messages) == 0 {
@@ -1508,16 +3353,53 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	}
 	msgs = filterThinkTags(msgs, m)
 
-	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools, req.Think)
+	// a trailing assistant message is continued rather than treated as a
+	// completed turn
+	last := req.Messages[len(req.Messages)-1]
+	prefill := last.Role == "assistant" && len(last.ToolCalls) == 0
+
+	prompt, images, truncated, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools, think, prefill, keepSystem)
+	if err != nil {
+		slog.Error("chat prompt error", "error", err)
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	cachePrefix, err := systemPromptPrefix(m, msgs, req.Tools, think, prompt)
 	if err != nil {
 		slog.Error("chat prompt error", "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+		return
+	}
+
+	if req.RenderOnly {
+		tokens, err := r.PromptTokens(c.Request.Context(), llm.CompletionRequest{Prompt: prompt, Options: opts})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+			return
+		}
+
+		c.JSON(http.StatusOK, api.ChatResponse{
+			Model:      req.Model,
+			CreatedAt:  time.Now().UTC(),
+			Message:    api.Message{Role: "assistant"},
+			Prompt:     prompt,
+			Done:       true,
+			DoneReason: "render",
+
+			TruncatedMessages: truncated,
+			Metrics: api.Metrics{
+				TotalDuration:   time.Since(checkpointStart),
+				LoadDuration:    checkpointLoaded.Sub(checkpointStart),
+				PromptEvalCount: len(tokens),
+			},
+		})
 		return
 	}
 
 	var thinkingState *thinking.Parser
 	openingTag, closingTag := thinking.InferTags(m.Template.Template)
-	if req.Think != nil && *req.Think && openingTag != "" && closingTag != "" {
+	if think != nil && openingTag != "" && closingTag != "" {
 		thinkingState = &thinking.Parser{
 			OpeningTag: openingTag,
 			ClosingTag: closingTag,
@@ -1529,31 +3411,131 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		toolParser = tools.NewParser(m.Template.Template, req.Tools)
 	}
 
+	resolveSeed(opts)
+	warning := contextWarning(r, opts)
+	fp := fingerprint(m, opts)
+
+	reservation, ok := s.reserveTokens(c, opts)
+	if !ok {
+		return
+	}
+
+	ctx, requestID, untrack := s.inflight.track(c.Request.Context())
+
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
+		defer untrack()
+		defer reservation.Release()
+
+		// only the first streamed response carries the request ID
+		streamed := req.Stream == nil || *req.Stream
+		var pendingID string
+		if streamed {
+			pendingID = requestID
+		}
+
+		// streamed responses of a thinking request are marked with whether
+		// they're thinking or answering. Responses without either are of the
+		// phase before them.
+		var phase string
+		var phaseIndex int
+		emit := func(res api.ChatResponse) {
+			if streamed && thinkingState != nil && *think && res.PromptEvalProgress == nil {
+				if res.Index != phaseIndex {
+					phase, phaseIndex = "", res.Index
+				}
+
+				answered := res.Message.Content != "" || len(res.Message.ToolCalls) > 0
+				if res.Message.Thinking != "" && answered {
+					// thinking ended within this response, so what came
+					// before the boundary is sent on its own
+					thinking := api.ChatResponse{
+						Model:     res.Model,
+						CreatedAt: res.CreatedAt,
+						Message:   api.Message{Role: res.Message.Role, Thinking: res.Message.Thinking},
+						Index:     res.Index,
+						Phase:     "thinking",
+					}
+					thinking.RequestID, pendingID = pendingID, ""
+					ch <- thinking
+
+					res.Message.Thinking = ""
+				}
+
+				switch {
+				case res.Message.Thinking != "":
+					phase = "thinking"
+				case answered:
+					phase = "answer"
+				}
+				res.Phase = phase
+			}
+
+			res.RequestID, pendingID = pendingID, ""
+			ch <- res
+		}
+
+		// responses are held back when retrying until they're known to be
+		// valid, since an invalid one is replaced
+		var held []api.ChatResponse
+		send := func(res api.ChatResponse) {
+			if req.ToolValidation == "retry" {
+				held = append(held, res)
+				return
+			}
+			emit(res)
+		}
+
+		ctx, cancel := generationContext(ctx, req.Timeout)
+		defer cancel()
+
+		// the state of each response requested with n starts afresh
+		var index int
+		var invalid error
+
+		// logprobs of text held back by the thinking or tool call parsers
+		// are sent with the next response
+		var logprobs []api.Logprob
+		fn := func(r llm.CompletionResponse) {
+			if r.PromptEvalProgress != nil {
+				send(api.ChatResponse{
+					Model:              req.Model,
+					CreatedAt:          time.Now().UTC(),
+					Message:            api.Message{Role: "assistant"},
+					PromptEvalProgress: r.PromptEvalProgress,
+				})
+				return
+			}
+
+			reservation.Count(r)
+			if r.Index != index {
+				index = r.Index
+				logprobs = nil
+				if thinkingState != nil {
+					thinkingState = &thinking.Parser{OpeningTag: openingTag, ClosingTag: closingTag}
+				}
+				if toolParser != nil {
+					toolParser = tools.NewParser(m.Template.Template, req.Tools)
+				}
+			}
+			logprobs = append(logprobs, r.Logprobs...)
 
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
-		}, func(r llm.CompletionResponse) {
 			res := api.ChatResponse{
-				Model:     req.Model,
-				CreatedAt: time.Now().UTC(),
-				Message:   api.Message{Role: "assistant", Content: r.Content},
-				Done:      r.Done,
-				Metrics: api.Metrics{
-					PromptEvalCount:    r.PromptEvalCount,
-					PromptEvalDuration: r.PromptEvalDuration,
-					EvalCount:          r.EvalCount,
-					EvalDuration:       r.EvalDuration,
-				},
+				Model:       req.Model,
+				CreatedAt:   time.Now().UTC(),
+				Message:     api.Message{Role: "assistant", Content: r.Content},
+				Done:        r.Done,
+				Index:       r.Index,
+				Fingerprint: fp,
+				Metrics:     completionMetrics(r),
 			}
 
 			if thinkingState != nil {
 				thinkingContent, remainingContent := thinkingState.AddContent(res.Message.Content)
+				if !*think {
+					thinkingContent = ""
+				}
 				if thinkingContent == "" && remainingContent == "" && !r.Done {
 					// need to accumulate more to decide what to send
 					return
@@ -1564,6 +3546,13 @@ func (s *Server) ChatHandler(c *gin.Context) {
 
 			if r.Done {
 				res.DoneReason = r.DoneReason.String()
+				res.StopSequence = r.StopSequence
+				res.StoppedAt = r.StoppedAt
+				res.Seed = opts.Seed + r.Index
+				res.Warning = warning
+				res.SystemCacheHit = r.SystemCacheHit
+				res.TruncatedMessages = truncated
+				res.Logits = r.Logits
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
 			}
@@ -1573,6 +3562,11 @@ func (s *Server) ChatHandler(c *gin.Context) {
 				if len(content) > 0 {
 					res.Message.Content = content
 				} else if len(toolCalls) > 0 {
+					if req.ToolValidation != "" {
+						if err := validateToolCalls(req.Tools, toolCalls); err != nil && invalid == nil {
+							invalid = err
+						}
+					}
 					res.Message.ToolCalls = toolCalls
 					res.Message.Content = ""
 				} else if res.Message.Thinking != "" {
@@ -1580,15 +3574,60 @@ func (s *Server) ChatHandler(c *gin.Context) {
 				} else {
 					if r.Done {
 						res.Message.Content = toolParser.Content()
-						ch <- res
+						res.Logprobs, logprobs = logprobs, nil
+						send(res)
 					}
 					return
 				}
 			}
 
-			ch <- res
-		}); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			res.Logprobs, logprobs = logprobs, nil
+			send(res)
+		}
+
+		attempts := 1
+		if req.ToolValidation == "retry" {
+			attempts += toolValidationRetries
+		}
+
+		for attempt := range attempts {
+			if err := r.Completion(ctx, llm.CompletionRequest{
+				Prompt:      prompt,
+				Images:      images,
+				Format:      req.Format,
+				Options:     opts,
+				CachePrefix: cachePrefix,
+			}, fn); err != nil {
+				ch <- completionErrorJSON(err)
+				return
+			}
+
+			if invalid == nil || attempt == attempts-1 {
+				break
+			}
+
+			// a retry can only use what's left of the session's budget
+			if reservation != nil {
+				if opts.NumPredict = reservation.Left() / max(opts.N, 1); opts.NumPredict == 0 {
+					break
+				}
+			}
+
+			slog.Info("tool call is invalid, retrying", "attempt", attempt+1, "error", invalid)
+
+			// the same seed would generate the same tool call again
+			opts.Seed++
+			held, index, invalid, logprobs = held[:0], 0, nil, nil
+			if thinkingState != nil {
+				thinkingState = &thinking.Parser{OpeningTag: openingTag, ClosingTag: closingTag}
+			}
+			if toolParser != nil {
+				toolParser = tools.NewParser(m.Template.Template, req.Tools)
+			}
+		}
+
+		for _, res := range held {
+			emit(res)
 		}
 	}()
 
@@ -1597,11 +3636,13 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		var toolCalls []api.ToolCall
 		var sbThinking strings.Builder
 		var sbContent strings.Builder
+		var logprobs []api.Logprob
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.ChatResponse:
 				sbThinking.WriteString(t.Message.Thinking)
 				sbContent.WriteString(t.Message.Content)
+				logprobs = append(logprobs, t.Logprobs...)
 				resp = t
 				if len(req.Tools) > 0 {
 					toolCalls = append(toolCalls, t.Message.ToolCalls...)
@@ -1612,16 +3653,27 @@ func (s *Server) ChatHandler(c *gin.Context) {
 					msg = "unexpected error format in response"
 				}
 
-				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+				status, ok := t["status"].(int)
+				if !ok {
+					status = http.StatusInternalServerError
+				}
+
+				code, ok := t["code"].(string)
+				if !ok {
+					code = api.ErrorCodeInternal
+				}
+
+				c.JSON(status, errorJSON(code, msg))
 				return
 			default:
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response"})
+				c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, "unexpected response"))
 				return
 			}
 		}
 
 		resp.Message.Content = sbContent.String()
 		resp.Message.Thinking = sbThinking.String()
+		resp.Logprobs = logprobs
 
 		if len(toolCalls) > 0 {
 			resp.Message.ToolCalls = toolCalls
@@ -1634,18 +3686,119 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
+// reserveTokens reserves the tokens a generate or chat request may generate
+// from the budget of its session, lowering opts.NumPredict to what's left so
+// that responses are truncated at the budget. Without a num_predict, a
+// context's worth of tokens is reserved for each response so that other
+// requests of the session can run alongside it, and the request is charged
+// for what it generates when it's done. The tokens left before the request
+// are sent in the X-Ollama-Session-Remaining header. If the budget is
+// exhausted, it responds with an error and returns false.
+func (s *Server) reserveTokens(c *gin.Context, opts *api.Options) (*tokenReservation, bool) {
+	n := max(opts.N, 1)
+
+	want := opts.NumCtx * n
+	if opts.NumPredict > 0 {
+		want = opts.NumPredict * n
+	}
+
+	reservation, left, err := s.budgets.reserve(c.GetHeader(sessionHeader), want)
+	if err == nil && reservation != nil && reservation.Tokens() < n {
+		// each response needs at least a token
+		reservation.Release()
+		err = fmt.Errorf("%w: %d tokens left for %d responses", errBudgetExhausted, left, n)
+	}
+
+	if err != nil {
+		body := errorJSON(api.ErrorCodeBudgetExceeded, err.Error())
+		body["remaining"] = left
+		c.Header(sessionRemainingHeader, strconv.Itoa(left))
+		c.JSON(http.StatusTooManyRequests, body)
+		return nil, false
+	}
+
+	if reservation != nil {
+		if opts.NumPredict > 0 {
+			opts.NumPredict = reservation.Tokens() / n
+		} else {
+			// responses continue past the context as it shifts, up to what
+			// the session has left
+			opts.NumPredict = left / n
+		}
+		c.Header(sessionRemainingHeader, strconv.Itoa(left))
+	}
+
+	return reservation, true
+}
+
+// errorJSON is the body of an error response, with the message for people
+// and a code that clients can handle the error by
+func errorJSON(code, message string) gin.H {
+	return gin.H{"error": message, "code": code}
+}
+
+// completionErrorJSON is the error response for a completion that failed
+// with err, which has the status and code of an [api.StatusError]
+func completionErrorJSON(err error) gin.H {
+	var serr api.StatusError
+	if !errors.As(err, &serr) {
+		return errorJSON(api.ErrorCodeInternal, err.Error())
+	}
+
+	h := errorJSON(cmp.Or(serr.Code, statusErrorCode(serr.StatusCode)), err.Error())
+	h["status"] = serr.StatusCode
+	return h
+}
+
+// statusErrorCode returns the code of an error response with status that has
+// no more specific code
+func statusErrorCode(status int) string {
+	switch {
+	case status == http.StatusNotFound:
+		return api.ErrorCodeNotFound
+	case status == http.StatusUnauthorized:
+		return api.ErrorCodeUnauthorized
+	case status == http.StatusServiceUnavailable:
+		return api.ErrorCodeUnavailable
+	case status == 499:
+		return api.ErrorCodeCanceled
+	case status >= http.StatusInternalServerError:
+		return api.ErrorCodeInternal
+	default:
+		return api.ErrorCodeInvalidRequest
+	}
+}
+
+// handleAliasError responds with an error from resolveAlias
+func handleAliasError(c *gin.Context, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
+}
+
 func handleScheduleError(c *gin.Context, name string, err error) {
 	switch {
-	case errors.Is(err, errCapabilities), errors.Is(err, errRequired):
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errCapabilities):
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeUnsupported, err.Error()))
+	case errors.Is(err, errRequired):
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidRequest, err.Error()))
+	case errors.Is(err, errInvalidOptions):
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidOptions, err.Error()))
+	case errors.Is(err, llm.ErrPoolingUnsupported):
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeUnsupported, err.Error()))
+	case errors.Is(err, api.ErrRopeScalingUnsupported):
+		c.JSON(http.StatusBadRequest, errorJSON(api.ErrorCodeInvalidOptions, err.Error()))
 	case errors.Is(err, context.Canceled):
-		c.JSON(499, gin.H{"error": "request canceled"})
+		c.JSON(499, errorJSON(api.ErrorCodeCanceled, "request canceled"))
 	case errors.Is(err, ErrMaxQueue):
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		c.JSON(http.StatusServiceUnavailable, errorJSON(api.ErrorCodeUnavailable, err.Error()))
 	case errors.Is(err, os.ErrNotExist):
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", name)})
+		c.JSON(http.StatusNotFound, errorJSON(api.ErrorCodeModelNotFound, fmt.Sprintf("model %q not found, try pulling it first", name)))
 	default:
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, errorJSON(api.ErrorCodeInternal, err.Error()))
 	}
 }
 
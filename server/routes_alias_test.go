@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestAlias(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	var s Server
+
+	_, digest := createBinFile(t, nil, nil)
+	for _, name := range []string{"test", "test2"} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:  name,
+			Files:  map[string]string{"test.gguf": digest},
+			System: name,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	}
+
+	blobs, err := filepath.Glob(filepath.Join(p, "blobs", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resolve returns the model an alias resolves to and its system prompt
+	resolve := func(t *testing.T, alias string) (string, string) {
+		t.Helper()
+
+		n, err := resolveAlias(model.ParseName(alias))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := GetModel(n.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return n.DisplayShortest(), m.System
+	}
+
+	t.Run("create", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "prod-chat", Model: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		if name, system := resolve(t, "prod-chat"); name != "test:latest" || system != "test" {
+			t.Errorf("expected alias to resolve to test:latest, got %s with system %q", name, system)
+		}
+
+		// an alias isn't a model, so it's neither listed nor given blobs
+		checkFileExists(t, filepath.Join(p, "manifests", "*", "*", "*", "*"), []string{
+			filepath.Join(p, "manifests", "registry.ollama.ai", "library", "test", "latest"),
+			filepath.Join(p, "manifests", "registry.ollama.ai", "library", "test2", "latest"),
+		})
+		checkFileExists(t, filepath.Join(p, "blobs", "*"), blobs)
+	})
+
+	t.Run("update", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "prod-chat", Model: "test2"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		if name, system := resolve(t, "prod-chat"); name != "test2:latest" || system != "test2" {
+			t.Errorf("expected alias to resolve to test2:latest, got %s with system %q", name, system)
+		}
+	})
+
+	t.Run("case insensitive", func(t *testing.T) {
+		if name, system := resolve(t, "PROD-Chat"); name != "test2:latest" || system != "test2" {
+			t.Errorf("expected alias to resolve to test2:latest, got %s with system %q", name, system)
+		}
+
+		// updating an alias by another case replaces it
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "Prod-Chat", Model: "TEST2"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		checkFileExists(t, filepath.Join(p, "aliases", "*", "*", "*", "*"), []string{
+			filepath.Join(p, "aliases", "registry.ollama.ai", "library", "prod-chat", "latest"),
+		})
+
+		// and an alias can't differ from a model only by case
+		w = createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "Test", Model: "test2"})
+		if w.Code != http.StatusConflict {
+			t.Fatalf("expected status code 409, actual %d", w.Code)
+		}
+	})
+
+	t.Run("model", func(t *testing.T) {
+		// a model resolves to itself
+		if name, _ := resolve(t, "test"); name != "test:latest" {
+			t.Errorf("expected test:latest, got %s", name)
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "test", Model: "test2"})
+		if w.Code != http.StatusConflict {
+			t.Fatalf("expected status code 409, actual %d", w.Code)
+		}
+
+		if name, _ := resolve(t, "test"); name != "test:latest" {
+			t.Errorf("expected test:latest, got %s", name)
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "prod-chat", Model: "missing"})
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status code 404, actual %d", w.Code)
+		}
+
+		var resp api.StatusError
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Code != api.ErrorCodeModelNotFound {
+			t.Errorf("expected code %q, got %q", api.ErrorCodeModelNotFound, resp.Code)
+		}
+	})
+
+	t.Run("alias of an alias", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "staging-chat", Model: "prod-chat"})
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status code 404, actual %d", w.Code)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "", Model: "test"})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		w := createRequest(t, s.DeleteAliasHandler, api.DeleteAliasRequest{Alias: "prod-chat"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		// the alias no longer resolves
+		if n, err := resolveAlias(model.ParseName("prod-chat")); err != nil || n.DisplayShortest() != "prod-chat:latest" {
+			t.Errorf("expected prod-chat:latest, got %s, %v", n.DisplayShortest(), err)
+		}
+
+		// the target and its blobs are left
+		if name, system := resolve(t, "test2"); name != "test2:latest" || system != "test2" {
+			t.Errorf("expected test2:latest, got %s with system %q", name, system)
+		}
+		checkFileExists(t, filepath.Join(p, "blobs", "*"), blobs)
+		checkFileExists(t, filepath.Join(p, "aliases", "*"), []string{})
+
+		w = createRequest(t, s.DeleteAliasHandler, api.DeleteAliasRequest{Alias: "prod-chat"})
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status code 404, actual %d", w.Code)
+		}
+	})
+
+	t.Run("delete target", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "prod-chat", Model: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		w = createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		// the alias is deleted with its target
+		checkFileExists(t, filepath.Join(p, "aliases", "*"), []string{})
+
+		if n, err := resolveAlias(model.ParseName("prod-chat")); err != nil || n.DisplayShortest() != "prod-chat:latest" {
+			t.Errorf("expected prod-chat:latest, got %s, %v", n.DisplayShortest(), err)
+		}
+	})
+
+	t.Run("missing target", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "prod-chat", Model: "test2"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		// a target removed other than by the delete API leaves its alias
+		if err := os.Remove(filepath.Join(p, "manifests", "registry.ollama.ai", "library", "test2", "latest")); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := resolveAlias(model.ParseName("prod-chat"))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected a missing target error, got %v", err)
+		}
+
+		if !strings.Contains(err.Error(), "test2:latest") {
+			t.Errorf("expected the error to name the missing target, got %q", err)
+		}
+	})
+}
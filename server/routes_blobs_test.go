@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBlobHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+
+	var s Server
+	r := gin.New()
+	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
+	r.POST("/api/blobs/:digest", s.CreateBlobHandler)
+
+	blob := func(t *testing.T, method, digest, body string) int {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, "/api/blobs/"+digest, strings.NewReader(body)))
+		return w.Code
+	}
+
+	content := "hello, world"
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+
+	t.Run("invalid digest", func(t *testing.T) {
+		if code := blob(t, http.MethodHead, "sha256:123", ""); code != http.StatusBadRequest {
+			t.Errorf("expected status code 400 for head, actual %d", code)
+		}
+
+		if code := blob(t, http.MethodPost, "sha256:123", content); code != http.StatusBadRequest {
+			t.Errorf("expected status code 400 for create, actual %d", code)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if code := blob(t, http.MethodHead, digest, ""); code != http.StatusNotFound {
+			t.Errorf("expected status code 404, actual %d", code)
+		}
+	})
+
+	t.Run("mismatched digest", func(t *testing.T) {
+		if code := blob(t, http.MethodPost, digest, "goodbye, world"); code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", code)
+		}
+
+		// neither the expected nor the actual digest should be stored
+		checkFileExists(t, filepath.Join(p, "blobs", "*"), nil)
+	})
+
+	t.Run("matching digest", func(t *testing.T) {
+		if code := blob(t, http.MethodPost, digest, content); code != http.StatusCreated {
+			t.Fatalf("expected status code 201, actual %d", code)
+		}
+
+		bts, err := os.ReadFile(filepath.Join(p, "blobs", strings.Replace(digest, ":", "-", 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(bts) != content {
+			t.Errorf("expected blob %q, got %q", content, bts)
+		}
+
+		if code := blob(t, http.MethodHead, digest, ""); code != http.StatusOK {
+			t.Errorf("expected status code 200, actual %d", code)
+		}
+	})
+
+	t.Run("existing", func(t *testing.T) {
+		if code := blob(t, http.MethodPost, digest, content); code != http.StatusOK {
+			t.Errorf("expected status code 200, actual %d", code)
+		}
+	})
+
+	t.Run("uppercase digest", func(t *testing.T) {
+		content := "HELLO, WORLD"
+		digest := fmt.Sprintf("sha256-%X", sha256.Sum256([]byte(content)))
+		if code := blob(t, http.MethodPost, digest, content); code != http.StatusCreated {
+			t.Fatalf("expected status code 201, actual %d", code)
+		}
+
+		if _, err := os.Stat(filepath.Join(p, "blobs", strings.ToLower(digest))); err != nil {
+			t.Error(err)
+		}
+
+		if code := blob(t, http.MethodHead, digest, ""); code != http.StatusOK {
+			t.Errorf("expected status code 200, actual %d", code)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestCancelHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var s Server
+
+	running, id, untrack := s.inflight.track(t.Context())
+	defer untrack()
+
+	_, finished, untrackFinished := s.inflight.track(t.Context())
+	untrackFinished()
+
+	cases := []struct {
+		name string
+		id   string
+		code int
+		body string
+	}{
+		{"missing", "", http.StatusBadRequest, `{"code":"invalid_request","error":"request_id is required"}`},
+		{"unknown", "missing", http.StatusNotFound, `{"code":"not_found","error":"request 'missing' is not in progress"}`},
+		{"finished", finished, http.StatusNotFound, `{"code":"not_found","error":"request '` + finished + `' is not in progress"}`},
+		{"running", id, http.StatusOK, `null`},
+		{"already canceled", id, http.StatusNotFound, `{"code":"not_found","error":"request '` + id + `' is not in progress"}`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, s.CancelHandler, api.CancelRequest{RequestID: tt.id})
+			if w.Code != tt.code {
+				t.Fatalf("expected status code %d, actual %d", tt.code, w.Code)
+			}
+
+			if got := w.Body.String(); got != tt.body {
+				t.Errorf("expected body %s, actual %s", tt.body, got)
+			}
+		})
+	}
+
+	if !errors.Is(context.Cause(running), errRequestCanceled) {
+		t.Errorf("expected running request to be canceled, got %v", context.Cause(running))
+	}
+}
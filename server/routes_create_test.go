@@ -20,6 +20,7 @@ import (
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/types/model"
 )
 
 var stream bool = false
@@ -808,3 +809,93 @@ func TestDetectModelTypeFromFiles(t *testing.T) {
 		}
 	})
 }
+
+func TestCreateProgress(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture": "llama",
+		"general.file_type":    uint32(1),
+	}, []*ggml.Tensor{
+		{Name: "blk.0.attn.weight", Kind: uint32(ggml.TensorTypeF16), Shape: []uint64{512, 2}, WriterTo: bytes.NewReader(bytes.Repeat(quantBytes[ggml.TensorTypeF16], 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:     "test",
+		Files:    map[string]string{"test.gguf": digest},
+		Template: "{{ .Prompt }}",
+		Quantize: "q8_0",
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var events []api.ProgressResponse
+	for line := range strings.Lines(w.Body.String()) {
+		var resp api.ProgressResponse
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, resp)
+	}
+
+	var quantizing, verifying, layers []api.ProgressResponse
+	for _, e := range events {
+		switch {
+		case strings.HasPrefix(e.Status, "quantizing"):
+			quantizing = append(quantizing, e)
+		case e.Status == "verifying conversion":
+			verifying = append(verifying, e)
+		case strings.HasPrefix(e.Status, "creating new layer"), strings.HasPrefix(e.Status, "using existing layer"):
+			layers = append(layers, e)
+		}
+	}
+
+	if len(quantizing) == 0 {
+		t.Fatal("expected quantization progress")
+	}
+
+	for _, e := range quantizing {
+		if e.Digest != digest || e.Total == 0 {
+			t.Errorf("expected quantization progress for %s, got %+v", digest, e)
+		}
+	}
+
+	if len(verifying) < 2 || verifying[0].Completed != 0 || verifying[len(verifying)-1].Completed != verifying[0].Total {
+		t.Errorf("expected verification progress from 0 to total, got %+v", verifying)
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := ParseNamedManifest(model.ParseName("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(layers) != len(manifest.Layers) {
+		t.Fatalf("expected %d layer events, got %+v", len(manifest.Layers), layers)
+	}
+
+	for i, e := range layers {
+		l := manifest.Layers[i]
+		if e.Status != fmt.Sprintf("creating new layer %s", l.Digest) || e.Digest != l.Digest || e.Total != l.Size || e.Completed != l.Size {
+			t.Errorf("unexpected layer event %+v for layer %+v", e, l)
+		}
+	}
+
+	if m.Config.FileType != "Q8_0" {
+		t.Errorf("expected file type Q8_0, got %s", m.Config.FileType)
+	}
+
+	if last := events[len(events)-1]; last.Status != "success" {
+		t.Errorf("expected success, got %+v", last)
+	}
+}
@@ -0,0 +1,624 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestEmbed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock mockRunner
+	var loaded api.Options
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				loaded = req.opts
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(4),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{""},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:  "test",
+		Files:  map[string]string{"file.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	t.Run("single input", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model: "test",
+			Input: "why is the sky blue",
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// the model context length is 4 so the input is truncated
+		if diff := cmp.Diff(resp.Embeddings, [][]float32{normalize([]float32{4, 1})}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(resp.TokenCounts, []int{4}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("multiple inputs", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model: "test",
+			Input: []string{"hello", "hello world", "why is the sky"},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		want := [][]float32{
+			normalize([]float32{1, 1}),
+			normalize([]float32{2, 1}),
+			normalize([]float32{4, 1}),
+		}
+		if diff := cmp.Diff(resp.Embeddings, want); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(resp.TokenCounts, []int{1, 2, 4}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if resp.PromptEvalCount != 7 {
+			t.Errorf("expected prompt eval count 7, got %d", resp.PromptEvalCount)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		// shorter inputs take longer so later inputs are embedded first
+		mock.EmbeddingFn = func(_ context.Context, s string) ([]float32, error) {
+			n := len(strings.Fields(s))
+			time.Sleep(time.Duration(4-n) * 10 * time.Millisecond)
+			return []float32{float32(n), 1}, nil
+		}
+		t.Cleanup(func() { mock.EmbeddingFn = nil })
+
+		stream := true
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:  "test",
+			Input:  []string{"hello", "hello world", "why is the sky", "why is"},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resps []api.EmbedResponse
+		decoder := json.NewDecoder(w.Body)
+		for {
+			var resp api.EmbedResponse
+			if err := decoder.Decode(&resp); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			resps = append(resps, resp)
+		}
+
+		if len(resps) != 5 {
+			t.Fatalf("expected 4 embeddings and a final response, got %d responses", len(resps))
+		}
+
+		for i, want := range []float32{1, 2, 4, 2} {
+			resp := resps[i]
+			if resp.Index != i || resp.Done {
+				t.Errorf("response %d: expected index %d, got %d", i, i, resp.Index)
+			}
+
+			if diff := cmp.Diff(resp.Embeddings, [][]float32{normalize([]float32{want, 1})}); diff != "" {
+				t.Errorf("response %d: mismatch (-got +want):\n%s", i, diff)
+			}
+
+			if diff := cmp.Diff(resp.TokenCounts, []int{int(want)}); diff != "" {
+				t.Errorf("response %d: mismatch (-got +want):\n%s", i, diff)
+			}
+		}
+
+		if last := resps[4]; !last.Done || len(last.Embeddings) != 0 || last.PromptEvalCount != 9 {
+			t.Errorf("expected a final response with a prompt eval count of 9, got %+v", last)
+		}
+	})
+
+	t.Run("report progress", func(t *testing.T) {
+		stream := true
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:          "test",
+			Input:          "why is the sky blue",
+			Stream:         &stream,
+			ReportProgress: true,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var progress []api.PromptEvalProgress
+		var embeddings int
+		decoder := json.NewDecoder(w.Body)
+		for {
+			var resp api.EmbedResponse
+			if err := decoder.Decode(&resp); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.PromptEvalProgress != nil {
+				if embeddings > 0 || len(resp.Embeddings) > 0 {
+					t.Errorf("expected progress with no embeddings before the embeddings, got %+v", resp)
+				}
+				progress = append(progress, *resp.PromptEvalProgress)
+			} else if !resp.Done {
+				embeddings++
+			}
+		}
+
+		// the input is truncated to the context length of 4 tokens
+		want := []api.PromptEvalProgress{{Processed: 1, Total: 4}, {Processed: 2, Total: 4}, {Processed: 3, Total: 4}}
+		if diff := cmp.Diff(want, progress); diff != "" {
+			t.Errorf("progress mismatch (-want +got):\n%s", diff)
+		}
+
+		if embeddings != 1 {
+			t.Errorf("expected 1 embedding response, got %d", embeddings)
+		}
+	})
+
+	t.Run("report progress without stream", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:          "test",
+			Input:          "why is the sky blue",
+			ReportProgress: true,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("dimensions", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:      "test",
+			Input:      []string{"hello world", "why is the sky"},
+			Dimensions: 1,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// truncated vectors are renormalized to unit length
+		if diff := cmp.Diff(resp.Embeddings, [][]float32{{1}, {1}}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("dimensions exceeds embedding length", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:      "test",
+			Input:      "hello",
+			Dimensions: 3,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"dimensions 3 exceeds the model's embedding length 2"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("negative dimensions", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:      "test",
+			Input:      "hello",
+			Dimensions: -1,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("normalize", func(t *testing.T) {
+		norm := func(v []float32) float64 {
+			var sum float64
+			for _, x := range v {
+				sum += float64(x * x)
+			}
+			return math.Sqrt(sum)
+		}
+
+		normalizeTrue, normalizeFalse := true, false
+		for _, tt := range []struct {
+			name      string
+			normalize *bool
+			want      []float32
+		}{
+			{name: "default", want: normalize([]float32{2, 1})},
+			{name: "true", normalize: &normalizeTrue, want: normalize([]float32{2, 1})},
+			{name: "false", normalize: &normalizeFalse, want: []float32{2, 1}},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+					Model:     "test",
+					Input:     "hello world",
+					Normalize: tt.normalize,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+
+				var resp api.EmbedResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(resp.Embeddings, [][]float32{tt.want}); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+
+				unit := math.Abs(norm(resp.Embeddings[0])-1) < 1e-6
+				if normalized := tt.normalize == nil || *tt.normalize; unit != normalized {
+					t.Errorf("expected unit norm %t, got norm %f", normalized, norm(resp.Embeddings[0]))
+				}
+			})
+		}
+	})
+
+	t.Run("pooling", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:   "test",
+			Input:   "hello",
+			Pooling: "CLS",
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if loaded.Pooling != "cls" {
+			t.Errorf("expected model loaded with pooling cls, got %q", loaded.Pooling)
+		}
+	})
+
+	t.Run("pooling none", func(t *testing.T) {
+		// one embedding per token, one after another
+		mock.EmbeddingFn = func(context.Context, string) ([]float32, error) {
+			embedding := make([]float32, 3*4096)
+			for i := range 3 {
+				embedding[i*4096+i] = 2
+			}
+			return embedding, nil
+		}
+		t.Cleanup(func() { mock.EmbeddingFn = nil })
+
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:   "test",
+			Input:   []string{"hello", "world"},
+			Pooling: "none",
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp.TokenCounts, []int{3, 3}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if len(resp.Embeddings) != 6 {
+			t.Fatalf("expected 6 token embeddings, got %d", len(resp.Embeddings))
+		}
+
+		for i, embedding := range resp.Embeddings {
+			if len(embedding) != 4096 || embedding[i%3] != 1 {
+				t.Errorf("unexpected embedding %d", i)
+			}
+		}
+	})
+
+	t.Run("invalid pooling", func(t *testing.T) {
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:   "test",
+			Input:   "hello",
+			Pooling: "max",
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"pooling must be one of mean, cls, last or none, got \"max\""}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("pooling none on the Ollama engine", func(t *testing.T) {
+		// as if the model runs on the Ollama engine, which fails to load it
+		ollama := Server{
+			sched: &Scheduler{
+				pendingReqCh:  make(chan *LlmRequest, 1),
+				finishedReqCh: make(chan *LlmRequest, 1),
+				expiredCh:     make(chan *runnerRef, 1),
+				unloadedCh:    make(chan any, 1),
+				loaded:        make(map[string]*runnerRef),
+				newServerFn:   newMockServer(&mock),
+				getGpuFn:      discover.GetGPUInfo,
+				getCpuFn:      discover.GetCPUInfo,
+				reschedDelay:  250 * time.Millisecond,
+				loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+					req.errCh <- llm.ErrPoolingUnsupported
+				},
+			},
+		}
+
+		go ollama.sched.Run(t.Context())
+
+		w := createRequest(t, ollama.EmbedHandler, api.EmbedRequest{
+			Model:   "test",
+			Input:   "hello",
+			Pooling: "none",
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"unsupported","error":"pooling \"none\" is not supported by models that run on the Ollama engine"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("truncate disabled", func(t *testing.T) {
+		truncate := false
+		w := createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model:    "test",
+			Input:    []string{"hello", "why is the sky blue"},
+			Truncate: &truncate,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		var resp api.StatusError
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Code != api.ErrorCodeContextExceeded {
+			t.Errorf("expected code %q, got %q", api.ErrorCodeContextExceeded, resp.Code)
+		}
+	})
+
+	t.Run("similarity", func(t *testing.T) {
+		vectors := map[string][]float32{
+			"cat":    {2, 0, 0},
+			"car":    {0, 1, 0},
+			"kitten": {0.9, 0.1, 0},
+			"tiger":  {1, 0, 1},
+			"road":   {-1, 1, 0},
+		}
+		mock.EmbeddingFn = func(_ context.Context, s string) ([]float32, error) {
+			return vectors[s], nil
+		}
+		t.Cleanup(func() { mock.EmbeddingFn = nil })
+
+		w := createRequest(t, s.SimilarityHandler, api.SimilarityRequest{
+			Model:      "test",
+			Query:      "cat",
+			Candidates: []string{"car", "kitten", "road", "tiger"},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.SimilarityResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.PromptEvalCount != 5 {
+			t.Errorf("expected 5 prompt tokens, got %d", resp.PromptEvalCount)
+		}
+
+		want := []int{1, 3, 0, 2}
+		if len(resp.Similarities) != len(want) {
+			t.Fatalf("expected %d similarities, got %d", len(want), len(resp.Similarities))
+		}
+
+		for i, sim := range resp.Similarities {
+			if sim.Index != want[i] {
+				t.Errorf("expected candidate %d at rank %d, got %d", want[i], i, sim.Index)
+			}
+		}
+
+		// the query is scaled by two, which the cosine ignores
+		if score := resp.Similarities[1].Score; math.Abs(score-1/math.Sqrt2) > 1e-6 {
+			t.Errorf("expected tiger to score %f, got %f", 1/math.Sqrt2, score)
+		}
+
+		if score := resp.Similarities[3].Score; math.Abs(score+1/math.Sqrt2) > 1e-6 {
+			t.Errorf("expected road to score %f, got %f", -1/math.Sqrt2, score)
+		}
+	})
+
+	t.Run("similarity without query", func(t *testing.T) {
+		w := createRequest(t, s.SimilarityHandler, api.SimilarityRequest{
+			Model:      "test",
+			Candidates: []string{"car"},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("similarity pooling none", func(t *testing.T) {
+		// token embeddings can't be compared as a single embedding
+		w := createRequest(t, s.SimilarityHandler, api.SimilarityRequest{
+			Model:      "test",
+			Query:      "cat",
+			Candidates: []string{"car"},
+			Options:    map[string]any{"pooling": "none"},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("alias", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "prod-embed", Model: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		w = createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model: "Prod-Embed",
+			Input: "why is the sky blue",
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.EmbedResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Model != "Prod-Embed" {
+			t.Errorf("expected model Prod-Embed, got %q", resp.Model)
+		}
+
+		if diff := cmp.Diff(resp.Embeddings, [][]float32{normalize([]float32{4, 1})}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("alias of a missing model", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:  "removed",
+			Files:  map[string]string{"file.gguf": digest},
+			Stream: &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		w = createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "stale-embed", Model: "removed"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		manifests, err := GetManifestPath()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Remove(filepath.Join(manifests, "registry.ollama.ai", "library", "removed", "latest")); err != nil {
+			t.Fatal(err)
+		}
+
+		w = createRequest(t, s.EmbedHandler, api.EmbedRequest{
+			Model: "stale-embed",
+			Input: "why is the sky blue",
+		})
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.StatusError
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Code != api.ErrorCodeModelNotFound || !strings.Contains(resp.ErrorMessage, "removed:latest") {
+			t.Errorf("expected the missing target to be named, got %q: %q", resp.Code, resp.ErrorMessage)
+		}
+	})
+}
@@ -4,8 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -25,12 +33,23 @@ type mockRunner struct {
 
 	// CompletionRequest is only valid until the next call to Completion
 	llm.CompletionRequest
+	mu sync.Mutex
+
 	llm.CompletionResponse
 	CompletionFn func(context.Context, llm.CompletionRequest, func(llm.CompletionResponse)) error
+	EmbeddingFn  func(context.Context, string) ([]float32, error)
+	TokenizeFn   func(context.Context, string) ([]int, error)
+	TrainCtx     int
+}
+
+func (m *mockRunner) TrainContextLength() int {
+	return m.TrainCtx
 }
 
 func (m *mockRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+	m.mu.Lock()
 	m.CompletionRequest = r
+	m.mu.Unlock()
 	if m.CompletionFn != nil {
 		return m.CompletionFn(ctx, r, fn)
 	}
@@ -38,7 +57,11 @@ func (m *mockRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn
 	return nil
 }
 
-func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error) {
+func (m *mockRunner) Tokenize(ctx context.Context, s string) (tokens []int, err error) {
+	if m.TokenizeFn != nil {
+		return m.TokenizeFn(ctx, s)
+	}
+
 	for range strings.Fields(s) {
 		tokens = append(tokens, len(tokens))
 	}
@@ -46,6 +69,50 @@ func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error
 	return
 }
 
+func (m *mockRunner) PromptTokens(ctx context.Context, r llm.CompletionRequest) ([]int, error) {
+	return m.Tokenize(ctx, r.Prompt)
+}
+
+func (m *mockRunner) Embedding(ctx context.Context, s string, fn func(api.PromptEvalProgress)) ([]float32, error) {
+	if fn != nil {
+		// as if each token of the input was processed in a batch of its own
+		n := len(strings.Fields(s))
+		for i := 1; i < n; i++ {
+			fn(api.PromptEvalProgress{Processed: i, Total: n})
+		}
+	}
+
+	if m.EmbeddingFn != nil {
+		return m.EmbeddingFn(ctx, s)
+	}
+	return []float32{float32(len(strings.Fields(s))), 1}, nil
+}
+
+func (*mockRunner) Detokenize(_ context.Context, tokens []int) (string, error) {
+	fields := make([]string, len(tokens))
+	for i, token := range tokens {
+		fields[i] = strconv.Itoa(token)
+	}
+
+	return strings.Join(fields, " "), nil
+}
+
+// SaveSession saves a session of tokens with a placeholder for the state
+func (*mockRunner) SaveSession(_ context.Context, digest string, tokens []int, path string) ([]int, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(llm.SessionHeader{Model: digest, Tokens: tokens}); err != nil {
+		return nil, err
+	}
+
+	_, err = f.WriteString("state")
+	return tokens, err
+}
+
 func newMockServer(mock *mockRunner) func(discover.GpuInfoList, string, *ggml.GGML, []string, []string, api.Options, int) (llm.LlamaServer, error) {
 	return func(_ discover.GpuInfoList, _ string, _ *ggml.GGML, _, _ []string, _ api.Options, _ int) (llm.LlamaServer, error) {
 		return mock, nil
@@ -138,7 +205,7 @@ func TestGenerateChat(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"model is required"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"model is required"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -157,7 +224,7 @@ func TestGenerateChat(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"registry.ollama.ai/library/test:latest does not support thinking"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"unsupported","error":"registry.ollama.ai/library/test:latest does not support thinking"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -168,7 +235,7 @@ func TestGenerateChat(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"model is required"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"model is required"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -196,7 +263,7 @@ func TestGenerateChat(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"\"bert\" does not support chat"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"unsupported","error":"\"bert\" does not support chat"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -301,6 +368,290 @@ func TestGenerateChat(t *testing.T) {
 		checkChatResponse(t, w.Body, "test", "Hi!")
 	})
 
+	t.Run("messages with template", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Template: `{{- range .Messages }}<|{{ .Role }}|>{{ .Content }}{{ end }}<|assistant|>`,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "<|user|>Hello!<|assistant|>"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		checkChatResponse(t, w.Body, "test", "Hi!")
+
+		// the model's own template is used by the next request
+		w = createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "user: Hello!\n"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("messages with invalid template", func(t *testing.T) {
+		for _, tmpl := range []string{
+			`{{ range .Messages }}`,
+			// only the text/template builtins and json are available
+			`{{ exec "id" }}`,
+			`{{ env "HOME" }}`,
+		} {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "test",
+				Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+				Template: tmpl,
+				Stream:   &stream,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d", tmpl, w.Code)
+			}
+
+			var resp struct {
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.HasPrefix(resp.Error, "template error: ") {
+				t.Errorf("%s: expected a template error, got %q", tmpl, resp.Error)
+			}
+		}
+	})
+
+	t.Run("messages with thinking (streaming)", func(t *testing.T) {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model: "test-think",
+			From:  "test",
+			Template: `{{- range .Messages }}{{ .Role }}: {{ if .Thinking }}<think>{{ .Thinking }}</think>{{ end }}{{ .Content }}
+{{ end }}`,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			for _, content := range []string{"<think>", "Magic", " words</think>Abra", " kadabra!"} {
+				fn(llm.CompletionResponse{Content: content})
+			}
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		think, streamRequest := true, true
+		w = createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test-think",
+			Messages: []api.Message{{Role: "user", Content: "Show me a trick"}},
+			Think:    &think,
+			Stream:   &streamRequest,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var thinking, content, phases []string
+		decoder := json.NewDecoder(w.Body)
+		for {
+			var resp api.ChatResponse
+			if err := decoder.Decode(&resp); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			thinking = append(thinking, resp.Message.Thinking)
+			content = append(content, resp.Message.Content)
+			phases = append(phases, resp.Phase)
+		}
+
+		// the token that closes the thinking also starts the content, and is
+		// split into a response for each
+		if diff := cmp.Diff(thinking, []string{"Magic", " words", "", "", ""}); diff != "" {
+			t.Errorf("thinking mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(content, []string{"", "", "Abra", " kadabra!", ""}); diff != "" {
+			t.Errorf("content mismatch (-got +want):\n%s", diff)
+		}
+
+		if diff := cmp.Diff(phases, []string{"thinking", "thinking", "answer", "answer", "answer"}); diff != "" {
+			t.Errorf("phase mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("messages with think option", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "<think>Magic words</think>Abra kadabra!", Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		think := false
+		cases := []struct {
+			name     string
+			think    *bool
+			options  map[string]any
+			thinking string
+		}{
+			{name: "enabled", options: map[string]any{"think": true}, thinking: "Magic words"},
+			{name: "disabled", options: map[string]any{"think": false}},
+			{name: "disabled by request", think: &think, options: map[string]any{"think": true}},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model:    "test-think",
+					Messages: []api.Message{{Role: "user", Content: "Show me a trick"}},
+					Think:    tt.think,
+					Options:  tt.options,
+					Stream:   &stream,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+
+				var resp api.ChatResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.Message.Thinking != tt.thinking || resp.Message.Content != "Abra kadabra!" {
+					t.Errorf("expected thinking %q and content %q, got %q and %q", tt.thinking, "Abra kadabra!", resp.Message.Thinking, resp.Message.Content)
+				}
+			})
+		}
+
+		t.Run("missing thinking capability", func(t *testing.T) {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "test",
+				Messages: []api.Message{{Role: "user", Content: "Show me a trick"}},
+				Options:  map[string]any{"think": true},
+				Stream:   &stream,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+		})
+	})
+
+	t.Run("messages with seed", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Options: map[string]any{"seed": 42},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Seed != 42 {
+			t.Errorf("expected seed 42, got %d", resp.Seed)
+		}
+
+		if mock.CompletionRequest.Options.Seed != 42 {
+			t.Errorf("expected runner seed 42, got %d", mock.CompletionRequest.Options.Seed)
+		}
+	})
+
+	t.Run("messages without seed", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Seed < 0 {
+			t.Errorf("expected non-negative seed, got %d", resp.Seed)
+		}
+
+		if resp.Seed != mock.CompletionRequest.Options.Seed {
+			t.Errorf("expected seed %d, got %d", mock.CompletionRequest.Options.Seed, resp.Seed)
+		}
+	})
+
+	t.Run("messages fingerprint", func(t *testing.T) {
+		fingerprint := func(t *testing.T, opts map[string]any) string {
+			t.Helper()
+
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model: "test",
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello!"},
+				},
+				Options: opts,
+				Stream:  &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			var resp api.ChatResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			return resp.Fingerprint
+		}
+
+		fp := fingerprint(t, map[string]any{"seed": 42})
+		if !strings.HasPrefix(fp, "fp_") {
+			t.Fatalf("expected a fingerprint, got %q", fp)
+		}
+
+		// sampling options don't change how the model is loaded
+		if other := fingerprint(t, map[string]any{"seed": 7, "temperature": 0.1}); other != fp {
+			t.Errorf("expected fingerprint %q, got %q", fp, other)
+		}
+
+		if other := fingerprint(t, map[string]any{"seed": 42, "num_ctx": 1024}); other == fp {
+			t.Errorf("expected the fingerprint to change with num_ctx, got %q", other)
+		}
+	})
+
 	w = createRequest(t, s.CreateHandler, api.CreateRequest{
 		Model:  "test-system",
 		From:   "test",
@@ -353,6 +704,37 @@ func TestGenerateChat(t *testing.T) {
 		checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
 
+	t.Run("messages with cached system", func(t *testing.T) {
+		mock.CompletionResponse.SystemCacheHit = true
+		t.Cleanup(func() { mock.CompletionResponse.SystemCacheHit = false })
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "system", Content: "You can perform magic tricks.", CachePrompt: true},
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if want := len("system: You can perform magic tricks.\n"); mock.CompletionRequest.CachePrefix != want {
+			t.Errorf("expected cache prefix %d, got %d", want, mock.CompletionRequest.CachePrefix)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if !resp.SystemCacheHit {
+			t.Error("expected system_cache_hit to be set")
+		}
+	})
+
 	t.Run("messages with interleaved system", func(t *testing.T) {
 		w := createRequest(t, s.ChatHandler, api.ChatRequest{
 			Model: "test-system",
@@ -376,58 +758,212 @@ func TestGenerateChat(t *testing.T) {
 		checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
 
-	t.Run("messages with tools (non-streaming)", func(t *testing.T) {
+	t.Run("messages with assistant prefill", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+				{Role: "assistant", Content: "Abra"},
+			},
+			Stream: &stream,
+		})
+
 		if w.Code != http.StatusOK {
-			t.Fatalf("failed to create test-system model: %d", w.Code)
+			t.Errorf("expected status 200, got %d", w.Code)
 		}
 
-		tools := []api.Tool{
-			{
-				Type: "function",
-				Function: api.ToolFunction{
-					Name:        "get_weather",
-					Description: "Get the current weather",
-					Parameters: struct {
-						Type       string   `json:"type"`
-						Defs       any      `json:"$defs,omitempty"`
-						Items      any      `json:"items,omitempty"`
-						Required   []string `json:"required"`
-						Properties map[string]struct {
-							Type        api.PropertyType `json:"type"`
-							Items       any              `json:"items,omitempty"`
-							Description string           `json:"description"`
-							Enum        []any            `json:"enum,omitempty"`
-						} `json:"properties"`
-					}{
-						Type:     "object",
-						Required: []string{"location"},
-						Properties: map[string]struct {
-							Type        api.PropertyType `json:"type"`
-							Items       any              `json:"items,omitempty"`
-							Description string           `json:"description"`
-							Enum        []any            `json:"enum,omitempty"`
-						}{
-							"location": {
-								Type:        api.PropertyType{"string"},
-								Description: "The city and state",
-							},
-							"unit": {
-								Type: api.PropertyType{"string"},
-								Enum: []any{"celsius", "fahrenheit"},
-							},
-						},
-					},
-				},
-			},
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "system: You are a helpful assistant.\nuser: Hello!\nassistant: Abra"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
+	})
 
-		mock.CompletionResponse = llm.CompletionResponse{
-			Content:            `{"name":"get_weather","arguments":{"location":"Seattle, WA","unit":"celsius"}}`,
-			Done:               true,
-			DoneReason:         llm.DoneReasonStop,
-			PromptEvalCount:    1,
-			PromptEvalDuration: 1,
-			EvalCount:          1,
+	t.Run("render only", func(t *testing.T) {
+		mock.CompletionRequest = llm.CompletionRequest{}
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			RenderOnly: true,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp.Prompt, "system: You are a helpful assistant.\nuser: Hello!\n"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if resp.DoneReason != "render" || !resp.Done {
+			t.Errorf("expected done with reason render, got %q", resp.DoneReason)
+		}
+
+		if resp.PromptEvalCount != 8 {
+			t.Errorf("expected prompt eval count 8, got %d", resp.PromptEvalCount)
+		}
+
+		if mock.CompletionRequest.Prompt != "" {
+			t.Errorf("expected no completion, got prompt %q", mock.CompletionRequest.Prompt)
+		}
+	})
+
+	t.Run("truncation strategy", func(t *testing.T) {
+		cases := []struct {
+			name      string
+			strategy  string
+			prompt    string
+			truncated int
+		}{
+			{name: "default", prompt: "system: You are a helpful assistant.\nuser: Hello!\n", truncated: 2},
+			{name: "keep system", strategy: "keep_system", prompt: "system: You are a helpful assistant.\nuser: Hello!\n", truncated: 2},
+			{name: "drop oldest", strategy: "drop_oldest", prompt: "assistant: Four.\nuser: Hello!\n", truncated: 2},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, s.ChatHandler, api.ChatRequest{
+					Model: "test-system",
+					Messages: []api.Message{
+						{Role: "user", Content: "One two three."},
+						{Role: "assistant", Content: "Four."},
+						{Role: "user", Content: "Hello!"},
+					},
+					// the mock tokenizer counts words, so only the last two
+					// messages fit, and the system prompt alone needs 6
+					Options:            map[string]any{"num_ctx": 6},
+					TruncationStrategy: tt.strategy,
+					RenderOnly:         true,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+				}
+
+				var resp api.ChatResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(resp.Prompt, tt.prompt); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+
+				if resp.TruncatedMessages != tt.truncated {
+					t.Errorf("expected %d truncated messages, got %d", tt.truncated, resp.TruncatedMessages)
+				}
+			})
+		}
+
+		t.Run("invalid", func(t *testing.T) {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:              "test-system",
+				Messages:           []api.Message{{Role: "user", Content: "Hello!"}},
+				TruncationStrategy: "summarize",
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+
+			if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"invalid truncation_strategy \"summarize\", must be keep_system or drop_oldest"}`); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	})
+
+	t.Run("messages with stop sequence", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi!"})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, StopSequence: "###", StoppedAt: "###"})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Options: map[string]any{"stop": []string{"###"}},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.DoneReason != "stop" || resp.StopSequence != "###" {
+			t.Errorf("expected done reason stop with stop sequence %q, got %q with %q", "###", resp.DoneReason, resp.StopSequence)
+		}
+
+		if resp.StoppedAt != "###" {
+			t.Errorf("expected to have stopped at %q, got %q", "###", resp.StoppedAt)
+		}
+	})
+
+	t.Run("messages with tools (non-streaming)", func(t *testing.T) {
+		if w.Code != http.StatusOK {
+			t.Fatalf("failed to create test-system model: %d", w.Code)
+		}
+
+		tools := []api.Tool{
+			{
+				Type: "function",
+				Function: api.ToolFunction{
+					Name:        "get_weather",
+					Description: "Get the current weather",
+					Parameters: struct {
+						Type       string   `json:"type"`
+						Defs       any      `json:"$defs,omitempty"`
+						Items      any      `json:"items,omitempty"`
+						Required   []string `json:"required"`
+						Properties map[string]struct {
+							Type        api.PropertyType `json:"type"`
+							Items       any              `json:"items,omitempty"`
+							Description string           `json:"description"`
+							Enum        []any            `json:"enum,omitempty"`
+						} `json:"properties"`
+					}{
+						Type:     "object",
+						Required: []string{"location"},
+						Properties: map[string]struct {
+							Type        api.PropertyType `json:"type"`
+							Items       any              `json:"items,omitempty"`
+							Description string           `json:"description"`
+							Enum        []any            `json:"enum,omitempty"`
+						}{
+							"location": {
+								Type:        api.PropertyType{"string"},
+								Description: "The city and state",
+							},
+							"unit": {
+								Type: api.PropertyType{"string"},
+								Enum: []any{"celsius", "fahrenheit"},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		mock.CompletionResponse = llm.CompletionResponse{
+			Content:            `{"name":"get_weather","arguments":{"location":"Seattle, WA","unit":"celsius"}}`,
+			Done:               true,
+			DoneReason:         llm.DoneReasonStop,
+			PromptEvalCount:    1,
+			PromptEvalDuration: 1,
+			EvalCount:          1,
 			EvalDuration:       1,
 		}
 
@@ -466,6 +1002,10 @@ func TestGenerateChat(t *testing.T) {
 			t.Error("expected tool calls, got nil")
 		}
 
+		if resp.RequestID == "" {
+			t.Error("expected a request ID in the first response")
+		}
+
 		expectedToolCall := api.ToolCall{
 			Function: api.ToolCallFunction{
 				Name: "get_weather",
@@ -613,6 +1153,161 @@ func TestGenerateChat(t *testing.T) {
 			t.Errorf("final tool call mismatch (-got +want):\n%s", diff)
 		}
 	})
+
+	t.Run("messages with tool validation", func(t *testing.T) {
+		var tools []api.Tool
+		if err := json.Unmarshal([]byte(`[{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "required": ["location"], "properties": {"location": {"type": "string"}}}}}]`), &tools); err != nil {
+			t.Fatal(err)
+		}
+
+		var seeds []int
+		contents := []string{
+			`{"name":"get_weather","arguments":{"location":98101}}`,
+			`{"name":"get_weather","arguments":{"location":"Seattle, WA"}}`,
+		}
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			seeds = append(seeds, r.Options.Seed)
+			fn(llm.CompletionResponse{Content: contents[min(len(seeds), len(contents))-1], Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		chat := func(t *testing.T, validation string) (int, api.ChatResponse) {
+			t.Helper()
+			seeds = nil
+
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:          "test-system",
+				Messages:       []api.Message{{Role: "user", Content: "What's the weather in Seattle?"}},
+				Tools:          tools,
+				ToolValidation: validation,
+				Options:        map[string]any{"seed": 7},
+				Stream:         &stream,
+			})
+
+			var resp api.ChatResponse
+			if w.Code == http.StatusOK {
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			return w.Code, resp
+		}
+
+		t.Run("off", func(t *testing.T) {
+			code, resp := chat(t, "")
+			if code != http.StatusOK || len(resp.Message.ToolCalls) != 1 || resp.Message.ToolCalls[0].Valid != nil {
+				t.Errorf("expected an unmarked tool call, got %d %+v", code, resp.Message.ToolCalls)
+			}
+		})
+
+		t.Run("mark", func(t *testing.T) {
+			code, resp := chat(t, "mark")
+			if code != http.StatusOK || len(resp.Message.ToolCalls) != 1 {
+				t.Fatalf("expected a tool call, got %d %+v", code, resp.Message.ToolCalls)
+			}
+
+			tc := resp.Message.ToolCalls[0]
+			if tc.Valid == nil || *tc.Valid || tc.ValidationError != `argument "location" must be of type string, got float64` {
+				t.Errorf("expected an invalid tool call, got %+v", tc)
+			}
+
+			if len(seeds) != 1 {
+				t.Errorf("expected 1 completion, got %d", len(seeds))
+			}
+		})
+
+		t.Run("retry", func(t *testing.T) {
+			code, resp := chat(t, "retry")
+			if code != http.StatusOK || len(resp.Message.ToolCalls) != 1 {
+				t.Fatalf("expected a tool call, got %d %+v", code, resp.Message.ToolCalls)
+			}
+
+			tc := resp.Message.ToolCalls[0]
+			if tc.Valid == nil || !*tc.Valid || tc.Function.Arguments["location"] != "Seattle, WA" {
+				t.Errorf("expected the valid tool call of the retry, got %+v", tc)
+			}
+
+			if !slices.Equal(seeds, []int{7, 8}) || resp.Seed != 8 {
+				t.Errorf("expected a retry with the next seed, got seeds %v and response seed %d", seeds, resp.Seed)
+			}
+		})
+
+		t.Run("retries exhausted", func(t *testing.T) {
+			mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+				seeds = append(seeds, r.Options.Seed)
+				fn(llm.CompletionResponse{Content: contents[0], Done: true, DoneReason: llm.DoneReasonStop})
+				return nil
+			}
+
+			code, resp := chat(t, "retry")
+			if code != http.StatusOK || len(resp.Message.ToolCalls) != 1 || *resp.Message.ToolCalls[0].Valid {
+				t.Fatalf("expected an invalid tool call, got %d %+v", code, resp.Message.ToolCalls)
+			}
+
+			if len(seeds) != 1+toolValidationRetries {
+				t.Errorf("expected %d completions, got %d", 1+toolValidationRetries, len(seeds))
+			}
+		})
+
+		t.Run("invalid", func(t *testing.T) {
+			if code, _ := chat(t, "reject"); code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", code)
+			}
+		})
+	})
+
+	t.Run("alias", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "prod-chat", Model: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi!", Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w = createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "prod-chat",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Model != "prod-chat" || resp.Message.Content != "Hi!" {
+			t.Errorf("expected a response from prod-chat, got %q from %q", resp.Message.Content, resp.Model)
+		}
+	})
+
+	t.Run("context exceeded", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			return api.StatusError{StatusCode: http.StatusBadRequest, ErrorMessage: "entire prompt removed by truncation", Code: api.ErrorCodeContextExceeded}
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+			Stream:   &stream,
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"context_exceeded","error":"entire prompt removed by truncation"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
 }
 
 func TestGenerate(t *testing.T) {
@@ -697,7 +1392,7 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected status 404, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"model '' not found"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"model_not_found","error":"model '' not found"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -708,7 +1403,7 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected status 404, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"model '' not found"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"model_not_found","error":"model '' not found"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -737,7 +1432,7 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"\"bert\" does not support generate"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"unsupported","error":"\"bert\" does not support generate"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -753,7 +1448,7 @@ func TestGenerate(t *testing.T) {
 			t.Errorf("expected status 400, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(w.Body.String(), `{"error":"registry.ollama.ai/library/test:latest does not support insert"}`); diff != "" {
+		if diff := cmp.Diff(w.Body.String(), `{"code":"unsupported","error":"registry.ollama.ai/library/test:latest does not support insert"}`); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
@@ -927,63 +1622,1444 @@ func TestGenerate(t *testing.T) {
 		checkGenerateResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
 
-	w = createRequest(t, s.CreateHandler, api.CreateRequest{
-		Model: "test-suffix",
-		Template: `{{- if .Suffix }}<PRE> {{ .Prompt }} <SUF>{{ .Suffix }} <MID>
-{{- else }}{{ .Prompt }}
-{{- end }}`,
-		From: "test",
+	t.Run("prompt with invalid template", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:    "test-system",
+			Prompt:   "Help me write tests.",
+			Template: `{{ .Prompt `,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
 	})
 
-	if w.Code != http.StatusOK {
-		t.Fatalf("expected status 200, got %d", w.Code)
-	}
+	t.Run("model file", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("OLLAMA_MODEL_FILE_DIRS", dir)
+
+		f, err := os.Create(filepath.Join(dir, "tiny.gguf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if err := ggml.WriteGGUF(f, ggml.KV{
+			"general.architecture": "llama",
+			"llama.block_count":    uint32(1),
+		}, []*ggml.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		}); err != nil {
+			t.Fatal(err)
+		}
 
-	t.Run("prompt with suffix", func(t *testing.T) {
 		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
-			Model:  "test-suffix",
-			Prompt: "def add(",
-			Suffix: "    return c",
+			Model:  f.Name(),
+			Prompt: "Hello!",
+			Stream: &stream,
 		})
 
 		if w.Code != http.StatusOK {
-			t.Errorf("expected status 200, got %d", w.Code)
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
 		}
 
-		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "<PRE> def add( <SUF>    return c <MID>"); diff != "" {
+		// there's no template, so the prompt is used as is
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "Hello!"); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
-	})
 
-	t.Run("prompt without suffix", func(t *testing.T) {
-		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
-			Model:  "test-suffix",
-			Prompt: "def add(",
+		checkGenerateResponse(t, w.Body, f.Name(), "Abra kadabra!")
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:    f.Name(),
+			Prompt:   "Hello!",
+			Template: `User: {{ .Prompt }} Assistant:`,
+			Stream:   &stream,
 		})
 
 		if w.Code != http.StatusOK {
-			t.Errorf("expected status 200, got %d", w.Code)
+			t.Fatalf("expected status 200, got %d", w.Code)
 		}
 
-		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "def add("); diff != "" {
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "User: Hello! Assistant:"); diff != "" {
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
-	})
 
-	t.Run("raw", func(t *testing.T) {
-		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
-			Model:  "test-system",
-			Prompt: "Help me write tests.",
-			Raw:    true,
-			Stream: &stream,
+		t.Run("missing", func(t *testing.T) {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:  filepath.Join(dir, "missing.gguf"),
+				Prompt: "Hello!",
+			})
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("expected status 404, got %d", w.Code)
+			}
 		})
 
-		if w.Code != http.StatusOK {
-			t.Errorf("expected status 200, got %d", w.Code)
-		}
+		t.Run("invalid", func(t *testing.T) {
+			p := filepath.Join(dir, "invalid.gguf")
+			if err := os.WriteFile(p, []byte("not a model"), 0o644); err != nil {
+				t.Fatal(err)
+			}
 
-		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "Help me write tests."); diff != "" {
-			t.Errorf("mismatch (-got +want):\n%s", diff)
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:  p,
+				Prompt: "Hello!",
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+		})
+
+		t.Run("cached", func(t *testing.T) {
+			fi, err := os.Stat(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the decoded model is reused while the file is unchanged
+			if err := os.WriteFile(f.Name(), make([]byte, fi.Size()), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Chtimes(f.Name(), fi.ModTime(), fi.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := GetModel(f.Name()); err != nil {
+				t.Fatalf("expected the cached model, got %v", err)
+			}
+
+			// and decoded again once it changes
+			later := fi.ModTime().Add(time.Second)
+			if err := os.Chtimes(f.Name(), later, later); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := GetModel(f.Name()); !errors.Is(err, errInvalidModelFile) {
+				t.Errorf("expected the changed file to be decoded again, got %v", err)
+			}
+		})
+
+		t.Run("not allowed", func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "outside.gguf")
+			if err := os.WriteFile(p, []byte("not a model"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			link := filepath.Join(dir, "link.gguf")
+			if err := os.Symlink(p, link); err != nil {
+				t.Skip("symlinks not supported")
+			}
+
+			// neither a file outside the allowed directories nor a link to one
+			// can be loaded, and loading by path is disabled by default
+			for _, tt := range []struct {
+				name, dirs, path string
+			}{
+				{name: "outside", dirs: dir, path: p},
+				{name: "symlink", dirs: dir, path: link},
+				{name: "disabled", path: f.Name()},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
+					t.Setenv("OLLAMA_MODEL_FILE_DIRS", tt.dirs)
+
+					w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+						Model:  tt.path,
+						Prompt: "Hello!",
+					})
+
+					if w.Code != http.StatusForbidden {
+						t.Errorf("expected status 403, got %d: %s", w.Code, w.Body.String())
+					}
+				})
+			}
+		})
+	})
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test-suffix",
+		Template: `{{- if .Suffix }}<PRE> {{ .Prompt }} <SUF>{{ .Suffix }} <MID>
+{{- else }}{{ .Prompt }}
+{{- end }}`,
+		From: "test",
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	t.Run("prompt with suffix", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-suffix",
+			Prompt: "def add(",
+			Suffix: "    return c",
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "<PRE> def add( <SUF>    return c <MID>"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("prompt without suffix", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-suffix",
+			Prompt: "def add(",
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "def add("); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("fim", func(t *testing.T) {
+		fimModel := func(t *testing.T, name string, tokens []string, ids ggml.KV) {
+			t.Helper()
+
+			kv := ggml.KV{
+				"general.architecture":          "llama",
+				"llama.block_count":             uint32(1),
+				"llama.context_length":          uint32(8192),
+				"llama.embedding_length":        uint32(4096),
+				"llama.attention.head_count":    uint32(32),
+				"llama.attention.head_count_kv": uint32(8),
+				"tokenizer.ggml.tokens":         tokens,
+				"tokenizer.ggml.scores":         make([]float32, len(tokens)),
+				"tokenizer.ggml.token_type":     slices.Repeat([]int32{3}, len(tokens)),
+			}
+			maps.Copy(kv, ids)
+
+			_, digest := createBinFile(t, kv, []*ggml.Tensor{
+				{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+				{Name: "blk.0.attn_norm.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+				{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			})
+
+			w := createRequest(t, s.CreateHandler, api.CreateRequest{
+				Model:  name,
+				Files:  map[string]string{"file.gguf": digest},
+				Stream: &stream,
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+		}
+
+		// Qwen2.5-Coder's layout, with the FIM tokens among the other
+		// special tokens after the vocabulary
+		fimModel(t, "test-fim", []string{"<|endoftext|>", "<|fim_prefix|>", "<|fim_middle|>", "<|fim_suffix|>"}, ggml.KV{
+			"tokenizer.ggml.fim_pre_token_id": uint32(1),
+			"tokenizer.ggml.fim_suf_token_id": uint32(3),
+			"tokenizer.ggml.fim_mid_token_id": uint32(2),
+		})
+
+		// CodeLlama's layout, declared with the older key names
+		fimModel(t, "test-fim-legacy", []string{"<s>", "</s>", "▁<PRE>", "▁<SUF>", "▁<MID>"}, ggml.KV{
+			"tokenizer.ggml.prefix_token_id": uint32(2),
+			"tokenizer.ggml.suffix_token_id": uint32(3),
+			"tokenizer.ggml.middle_token_id": uint32(4),
+		})
+
+		cases := []struct {
+			name   string
+			req    api.GenerateRequest
+			code   int
+			prompt string
+			err    string
+		}{
+			{
+				name:   "prefix and suffix",
+				req:    api.GenerateRequest{Model: "test-fim", Prompt: "def add(a, b):\n", Suffix: "\n    return c"},
+				code:   http.StatusOK,
+				prompt: "<|fim_prefix|>def add(a, b):\n<|fim_suffix|>\n    return c<|fim_middle|>",
+			},
+			{
+				name:   "empty prefix",
+				req:    api.GenerateRequest{Model: "test-fim", Suffix: "return c"},
+				code:   http.StatusOK,
+				prompt: "<|fim_prefix|><|fim_suffix|>return c<|fim_middle|>",
+			},
+			{
+				name:   "legacy keys",
+				req:    api.GenerateRequest{Model: "test-fim-legacy", Prompt: "def add(", Suffix: "return c"},
+				code:   http.StatusOK,
+				prompt: "▁<PRE>def add(▁<SUF>return c▁<MID>",
+			},
+			{
+				name: "no fim tokens",
+				req:  api.GenerateRequest{Model: "test", Prompt: "def add(", Suffix: "return c"},
+				code: http.StatusBadRequest,
+				err:  `{"code":"unsupported","error":"\"test\" does not declare fill-in-the-middle tokens"}`,
+			},
+			{
+				name: "with system",
+				req:  api.GenerateRequest{Model: "test-fim", Prompt: "def add(", System: "You write Python."},
+				code: http.StatusBadRequest,
+				err:  `{"code":"invalid_request","error":"fim does not support template, system, context, or images"}`,
+			},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				mock.CompletionRequest = llm.CompletionRequest{}
+
+				tt.req.FIM = true
+				tt.req.Stream = &stream
+				w := createRequest(t, s.GenerateHandler, tt.req)
+				if w.Code != tt.code {
+					t.Fatalf("expected status %d, got %d: %s", tt.code, w.Code, w.Body.String())
+				}
+
+				if tt.err != "" {
+					if diff := cmp.Diff(w.Body.String(), tt.err); diff != "" {
+						t.Errorf("mismatch (-got +want):\n%s", diff)
+					}
+					return
+				}
+
+				if diff := cmp.Diff(mock.CompletionRequest.Prompt, tt.prompt); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+			})
+		}
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-system",
+			Prompt: "Help me write tests.",
+			Raw:    true,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "Help me write tests."); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if mock.CompletionRequest.SkipSpecialTokens {
+			t.Error("expected special tokens to be inserted by default")
+		}
+	})
+
+	t.Run("raw skip special tokens", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:             "test-system",
+			Prompt:            "<s>Help me write tests.",
+			Raw:               true,
+			SkipSpecialTokens: true,
+			Stream:            &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if !mock.CompletionRequest.SkipSpecialTokens {
+			t.Error("expected special tokens to be skipped")
+		}
+	})
+
+	t.Run("skip special tokens without raw", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:             "test-system",
+			Prompt:            "Help me write tests.",
+			SkipSpecialTokens: true,
+			Stream:            &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"skip_special_tokens is only supported in raw mode"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("prompt with seed", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"seed": 42},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Seed != 42 {
+			t.Errorf("expected seed 42, got %d", resp.Seed)
+		}
+
+		if mock.CompletionRequest.Options.Seed != 42 {
+			t.Errorf("expected runner seed 42, got %d", mock.CompletionRequest.Options.Seed)
+		}
+	})
+
+	t.Run("prompt with num_ctx larger than trained", func(t *testing.T) {
+		mock.TrainCtx = 4096
+		t.Cleanup(func() { mock.TrainCtx = 0 })
+
+		cases := []struct {
+			name    string
+			options map[string]any
+			warning string
+		}{
+			{name: "within", options: map[string]any{"num_ctx": 4096}},
+			{
+				name:    "limited",
+				options: map[string]any{"num_ctx": 8192},
+				warning: "num_ctx 8192 is larger than the 4096 tokens the model was trained with, so it was limited to 4096; set exceed_train_ctx to use it anyway",
+			},
+			{name: "overridden", options: map[string]any{"num_ctx": 8192, "exceed_train_ctx": true}},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+					Model:   "test",
+					Prompt:  "Hello!",
+					Options: tt.options,
+					Stream:  &stream,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+
+				var resp api.GenerateResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.Warning != tt.warning {
+					t.Errorf("expected warning %q, got %q", tt.warning, resp.Warning)
+				}
+			})
+		}
+	})
+
+	t.Run("prompt without seed", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Seed < 0 {
+			t.Errorf("expected non-negative seed, got %d", resp.Seed)
+		}
+
+		if resp.Seed != mock.CompletionRequest.Options.Seed {
+			t.Errorf("expected seed %d, got %d", mock.CompletionRequest.Options.Seed, resp.Seed)
+		}
+	})
+
+	t.Run("prompt with n without streaming", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"n": 2},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"invalid_request","error":"n greater than 1 requires stream to be true"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("prompt with min_p", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"min_p": 0.05},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.Options.MinP != 0.05 {
+			t.Errorf("expected runner min_p 0.05, got %v", mock.CompletionRequest.Options.MinP)
+		}
+	})
+
+	t.Run("prompt with invalid min_p", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"min_p": 2},
+			Stream:  &stream,
+		})
+
+		if w.Code == http.StatusOK {
+			t.Errorf("expected error status, got %d", w.Code)
+		}
+	})
+
+	t.Run("prompt tokens", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test-system",
+			Prompt:  "Help me write tests.",
+			Options: map[string]any{"return_prompt_tokens": true},
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// the mock tokenizer returns one token per word of the rendered prompt
+		want, _ := (&mockRunner{}).Tokenize(t.Context(), mock.CompletionRequest.Prompt)
+		if diff := cmp.Diff(resp.PromptTokens, want); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if len(want) <= len(strings.Fields("Help me write tests.")) {
+			t.Errorf("expected prompt tokens to include the system prompt, got %v", want)
+		}
+	})
+
+	t.Run("prompt tokens off by default", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test-system",
+			Prompt: "Help me write tests.",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.PromptTokens != nil {
+			t.Errorf("expected no prompt tokens, got %v", resp.PromptTokens)
+		}
+	})
+
+	t.Run("prompt eval progress", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{PromptEvalProgress: &api.PromptEvalProgress{Processed: 512, Total: 1024}})
+			fn(llm.CompletionResponse{PromptEvalProgress: &api.PromptEvalProgress{Processed: 1024, Total: 1024}})
+			fn(llm.CompletionResponse{Content: "Hi!"})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, PromptEvalCount: 1024})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		streamRequest := true
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Stream: &streamRequest,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var progress []api.PromptEvalProgress
+		var content strings.Builder
+		decoder := json.NewDecoder(w.Body)
+		for {
+			var resp api.GenerateResponse
+			if err := decoder.Decode(&resp); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.PromptEvalProgress != nil {
+				if content.Len() > 0 {
+					t.Error("expected prompt eval progress before content")
+				}
+				progress = append(progress, *resp.PromptEvalProgress)
+			}
+
+			content.WriteString(resp.Response)
+		}
+
+		if diff := cmp.Diff(progress, []api.PromptEvalProgress{{Processed: 512, Total: 1024}, {Processed: 1024, Total: 1024}}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if content.String() != "Hi!" {
+			t.Errorf("expected content %q, got %q", "Hi!", content.String())
+		}
+	})
+
+	t.Run("cached prompt tokens", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi!"})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, PromptEvalCount: 24, CachedPromptCount: 1000})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.PromptEvalCount != 24 || resp.CachedPromptTokens != 1000 || resp.PromptCacheHitTokens != 1000 {
+			t.Errorf("expected 24 prompt tokens evaluated and 1000 cached, got %d and %d (%d hits)", resp.PromptEvalCount, resp.CachedPromptTokens, resp.PromptCacheHitTokens)
+		}
+	})
+
+	t.Run("repeated prompt", func(t *testing.T) {
+		// as if the whole prompt but its last token is cached when repeated
+		var last string
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			var cached int
+			if r.Prompt == last {
+				cached = len(strings.Fields(r.Prompt)) - 1
+			}
+			last = r.Prompt
+
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, PromptEvalCount: len(strings.Fields(r.Prompt)) - cached, CachedPromptCount: cached})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		generate := func() api.GenerateResponse {
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:  "test",
+				Prompt: "why is the sky blue",
+				Raw:    true,
+				Stream: &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			var resp api.GenerateResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+
+		if resp := generate(); resp.PromptEvalCount != 5 || resp.PromptCacheHitTokens != 0 {
+			t.Errorf("expected 5 prompt tokens evaluated and no cache hits, got %d and %d", resp.PromptEvalCount, resp.PromptCacheHitTokens)
+		}
+
+		if resp := generate(); resp.PromptEvalCount != 1 || resp.PromptCacheHitTokens != 4 {
+			t.Errorf("expected 1 prompt token evaluated and 4 cache hits, got %d and %d", resp.PromptEvalCount, resp.PromptCacheHitTokens)
+		}
+	})
+
+	t.Run("logprobs", func(t *testing.T) {
+		logit := float32(12.5)
+		hi := api.Logprob{
+			TokenLogprob: api.TokenLogprob{ID: 1, Token: "Hi", Logprob: -0.25, Logit: &logit},
+			TopLogprobs:  []api.TokenLogprob{{ID: 1, Token: "Hi", Logprob: -0.25, Logit: &logit}},
+		}
+		bang := api.Logprob{TokenLogprob: api.TokenLogprob{ID: 2, Token: "!", Logprob: -0.5, Logit: &logit}}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			if !r.Options.Logprobs || r.Options.TopLogprobs != 1 || !r.Options.RawLogits {
+				t.Errorf("expected logprobs with 1 top candidate and raw logits, got %v, %d and %v", r.Options.Logprobs, r.Options.TopLogprobs, r.Options.RawLogits)
+			}
+
+			fn(llm.CompletionResponse{Content: "Hi", Logprobs: []api.Logprob{hi}})
+			fn(llm.CompletionResponse{Content: "!", Logprobs: []api.Logprob{bang}})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Stream:  &stream,
+			Options: map[string]any{"logprobs": true, "top_logprobs": 1, "raw_logits": true},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// the log probabilities of every response are combined
+		if diff := cmp.Diff(resp.Logprobs, []api.Logprob{hi, bang}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("alias", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "prod-generate", Model: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi!", Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "prod-generate",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Model != "prod-generate" || resp.Response != "Hi!" {
+			t.Errorf("expected a response from prod-generate, got %q from %q", resp.Response, resp.Model)
+		}
+	})
+
+	t.Run("session budget", func(t *testing.T) {
+		t.Setenv("OLLAMA_SESSION_BUDGET", "10")
+
+		// each response generates 6 tokens unless num_predict is lower
+		var limits []int
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			limits = append(limits, r.Options.NumPredict)
+
+			count, reason := 6, llm.DoneReasonStop
+			if r.Options.NumPredict < count {
+				count, reason = r.Options.NumPredict, llm.DoneReasonLength
+			}
+
+			fn(llm.CompletionResponse{Content: "Hi!", Done: true, DoneReason: reason, EvalCount: count})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		generate := func(session string) *httptest.ResponseRecorder {
+			t.Helper()
+			return createRequest(t, func(c *gin.Context) {
+				c.Request.Header = http.Header{sessionHeader: {session}}
+				s.GenerateHandler(c)
+			}, api.GenerateRequest{
+				Model:  "test",
+				Prompt: "Hello!",
+				Stream: &stream,
+			})
+		}
+
+		decode := func(w *httptest.ResponseRecorder) api.GenerateResponse {
+			t.Helper()
+			var resp api.GenerateResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+
+		w := generate("a")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if got := w.Header().Get(sessionRemainingHeader); got != "10" {
+			t.Errorf("expected 10 tokens remaining, got %q", got)
+		}
+
+		if resp := decode(w); resp.DoneReason != "stop" || resp.EvalCount != 6 {
+			t.Errorf("expected a complete response of 6 tokens, got %q after %d", resp.DoneReason, resp.EvalCount)
+		}
+
+		// the second request is truncated at the 4 tokens left
+		w = generate("a")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if got := w.Header().Get(sessionRemainingHeader); got != "4" {
+			t.Errorf("expected 4 tokens remaining, got %q", got)
+		}
+
+		if resp := decode(w); resp.DoneReason != "length" || resp.EvalCount != 4 {
+			t.Errorf("expected a truncated response of 4 tokens, got %q after %d", resp.DoneReason, resp.EvalCount)
+		}
+
+		// the budget is exhausted
+		w = generate("a")
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected status 429, got %d", w.Code)
+		}
+
+		var errResp struct {
+			Error     string `json:"error"`
+			Code      string `json:"code"`
+			Remaining *int   `json:"remaining"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&errResp); err != nil {
+			t.Fatal(err)
+		}
+
+		if errResp.Code != api.ErrorCodeBudgetExceeded || errResp.Remaining == nil || *errResp.Remaining != 0 {
+			t.Errorf("expected code %q with 0 remaining, got %+v", api.ErrorCodeBudgetExceeded, errResp)
+		}
+
+		// other sessions have budgets of their own
+		if w := generate("b"); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(limits, []int{10, 4, 10}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		// batches are limited by the same budget
+		w = createRequest(t, func(c *gin.Context) {
+			c.Request.Header = http.Header{sessionHeader: {"a"}}
+			s.BatchGenerateHandler(c)
+		}, api.BatchGenerateRequest{
+			Model:   "test",
+			Prompts: []api.BatchPrompt{{Prompt: "first"}, {Prompt: "second"}},
+			Stream:  &stream,
+		})
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected status 429 for a batch, got %d", w.Code)
+		}
+
+		// each prompt of a batch is given what the session has left when
+		// it's reserved
+		limits = nil
+		w = createRequest(t, func(c *gin.Context) {
+			c.Request.Header = http.Header{sessionHeader: {"d"}}
+			s.BatchGenerateHandler(c)
+		}, api.BatchGenerateRequest{
+			Model:   "test",
+			Prompts: []api.BatchPrompt{{Prompt: "first", Options: map[string]any{"num_predict": 6}}, {Prompt: "second"}},
+			Raw:     true,
+			Stream:  &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if got := w.Header().Get(sessionRemainingHeader); got != "10" {
+			t.Errorf("expected 10 tokens remaining before the batch, got %q", got)
+		}
+
+		slices.Sort(limits)
+		if diff := cmp.Diff(limits, []int{4, 6}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		// a request canceled part way through is charged for the tokens it
+		// streamed before then
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi", Tokens: 3})
+
+			// the client disconnects before the response is done
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		}
+
+		createRequest(t, func(c *gin.Context) {
+			c.Request = c.Request.WithContext(ctx)
+			c.Request.Header = http.Header{sessionHeader: {"c"}}
+			s.GenerateHandler(c)
+		}, api.GenerateRequest{Model: "test", Prompt: "Hello!"})
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Hi!", Done: true, DoneReason: llm.DoneReasonStop, EvalCount: 1})
+			return nil
+		}
+
+		if got := generate("c").Header().Get(sessionRemainingHeader); got != "7" {
+			t.Errorf("expected 7 tokens remaining after a canceled request, got %q", got)
+		}
+	})
+
+	t.Run("session budget without num_predict", func(t *testing.T) {
+		t.Setenv("OLLAMA_SESSION_BUDGET", "100000")
+
+		// the first request holds its reservation until the second is done
+		started, done := make(chan struct{}), make(chan struct{})
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			if r.Prompt == "first" {
+				close(started)
+				<-done
+			}
+
+			fn(llm.CompletionResponse{Content: "Hi!", Done: true, DoneReason: llm.DoneReasonStop, EvalCount: 3})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		generate := func(prompt string) *httptest.ResponseRecorder {
+			t.Helper()
+			return createRequest(t, func(c *gin.Context) {
+				c.Request.Header = http.Header{sessionHeader: {"e"}}
+				s.GenerateHandler(c)
+			}, api.GenerateRequest{
+				Model:  "test",
+				Prompt: prompt,
+				Raw:    true,
+				Stream: &stream,
+			})
+		}
+
+		first := make(chan *httptest.ResponseRecorder)
+		go func() { first <- generate("first") }()
+		<-started
+
+		// only a context's worth is reserved, so the session's budget isn't
+		// held by the first request
+		w := generate("second")
+		close(done)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		left, err := strconv.Atoi(w.Header().Get(sessionRemainingHeader))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if left <= 0 || left >= 100000 {
+			t.Errorf("expected part of the budget to be reserved by the first request, got %d left", left)
+		}
+
+		if w := <-first; w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		// both are charged for what they generated
+		if got := generate("third").Header().Get(sessionRemainingHeader); got != "99994" {
+			t.Errorf("expected 99994 tokens remaining, got %q", got)
+		}
+	})
+
+	t.Run("raw logits without logprobs", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Stream:  &stream,
+			Options: map[string]any{"raw_logits": true},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("done reason", func(t *testing.T) {
+		cases := []struct {
+			name         string
+			final        llm.CompletionResponse
+			doneReason   string
+			stopSequence string
+			stoppedAt    string
+		}{
+			{"stop", llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop}, "stop", "", ""},
+			{"length", llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonLength}, "length", "", ""},
+			{"stop sequence", llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, StopSequence: "\n\n", StoppedAt: "\n\n"}, "stop", "\n\n", "\n\n"},
+			{"eos token", llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, StoppedAt: "</s>"}, "stop", "", "</s>"},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+					fn(llm.CompletionResponse{Content: "Hi!"})
+					fn(tt.final)
+					return nil
+				}
+				t.Cleanup(func() { mock.CompletionFn = nil })
+
+				w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+					Model:  "test",
+					Prompt: "Hello!",
+					Stream: &stream,
+				})
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+
+				var resp api.GenerateResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.DoneReason != tt.doneReason || resp.StopSequence != tt.stopSequence {
+					t.Errorf("expected done reason %q with stop sequence %q, got %q with %q", tt.doneReason, tt.stopSequence, resp.DoneReason, resp.StopSequence)
+				}
+
+				if resp.StoppedAt != tt.stoppedAt {
+					t.Errorf("expected to have stopped at %q, got %q", tt.stoppedAt, resp.StoppedAt)
+				}
+			})
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("expected a deadline on the completion context")
+			}
+
+			// generate slowly until the deadline passes
+			fn(llm.CompletionResponse{Content: "Hi"})
+			<-ctx.Done()
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonTimeout, EvalCount: 1})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Stream:  &stream,
+			Timeout: &api.Duration{Duration: 10 * time.Millisecond},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Response != "Hi" || resp.DoneReason != "timeout" || resp.EvalCount != 1 {
+			t.Errorf("expected partial response %q with done reason %q, got %q with %q", "Hi", "timeout", resp.Response, resp.DoneReason)
+		}
+	})
+
+	t.Run("context exceeded", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			return api.StatusError{StatusCode: http.StatusBadRequest, ErrorMessage: "entire prompt removed by truncation", Code: api.ErrorCodeContextExceeded}
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"context_exceeded","error":"entire prompt removed by truncation"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Options: map[string]any{"top_k": "ten"},
+			Stream:  &stream,
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		// the message is that of the option that isn't valid
+		var resp api.StatusError
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Code != api.ErrorCodeInvalidOptions || strings.HasPrefix(resp.ErrorMessage, "invalid options") {
+			t.Errorf("expected code %q with the option's message, got %q with %q", api.ErrorCodeInvalidOptions, resp.Code, resp.ErrorMessage)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		// the first prompt isn't done until the last one is, so the
+		// responses are done out of order
+		last := make(chan struct{})
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			switch r.Prompt {
+			case "User: first ":
+				<-last
+			case "User: last ":
+				defer close(last)
+			}
+
+			fn(llm.CompletionResponse{Content: fmt.Sprintf("%s%v", r.Prompt, r.Options.Temperature)})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, EvalCount: 1})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		var req api.BatchGenerateRequest
+		if err := json.Unmarshal([]byte(`{
+			"model": "test",
+			"prompts": ["first", {"prompt": "second", "options": {"temperature": 0.5}}, "last"],
+			"options": {"temperature": 0},
+			"stream": false
+		}`), &req); err != nil {
+			t.Fatal(err)
+		}
+
+		w := createRequest(t, s.BatchGenerateHandler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.BatchGenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []api.BatchResponse{
+			{Index: 0, Response: "User: first 0", DoneReason: "stop", Metrics: api.Metrics{EvalCount: 1}},
+			{Index: 1, Response: "User: second 0.5", DoneReason: "stop", Metrics: api.Metrics{EvalCount: 1}},
+			{Index: 2, Response: "User: last 0", DoneReason: "stop", Metrics: api.Metrics{EvalCount: 1}},
+		}
+		if diff := cmp.Diff(resp.Responses, want); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if !resp.Done {
+			t.Error("expected the response to be done")
+		}
+	})
+
+	t.Run("batch streamed", func(t *testing.T) {
+		last := make(chan struct{})
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			switch r.Prompt {
+			case "first":
+				<-last
+			case "last":
+				defer close(last)
+			}
+
+			fn(llm.CompletionResponse{Content: r.Prompt, Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.BatchGenerateHandler, api.BatchGenerateRequest{
+			Model:   "test",
+			Prompts: []api.BatchPrompt{{Prompt: "first"}, {Prompt: "last"}},
+			Raw:     true,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var indexes []int
+		var done bool
+		decoder := json.NewDecoder(w.Body)
+		for {
+			var resp api.BatchGenerateResponse
+			if err := decoder.Decode(&resp); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, r := range resp.Responses {
+				if want := []string{"first", "last"}[r.Index]; r.Response != want {
+					t.Errorf("expected response %q for index %d, got %q", want, r.Index, r.Response)
+				}
+				indexes = append(indexes, r.Index)
+			}
+			done = resp.Done
+		}
+
+		// each response is sent as soon as it's done
+		if !slices.Equal(indexes, []int{1, 0}) || !done {
+			t.Errorf("expected responses to indexes [1 0] and then done, got %v and done %t", indexes, done)
+		}
+	})
+
+	t.Run("batch in parallel", func(t *testing.T) {
+		t.Setenv("OLLAMA_NUM_PARALLEL", "2")
+
+		var mu sync.Mutex
+		var running, most int
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			mu.Lock()
+			running++
+			most = max(most, running)
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+
+			fn(llm.CompletionResponse{Content: r.Prompt, Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		prompts := make([]api.BatchPrompt, 6)
+		for i := range prompts {
+			prompts[i] = api.BatchPrompt{Prompt: strconv.Itoa(i)}
+		}
+
+		w := createRequest(t, s.BatchGenerateHandler, api.BatchGenerateRequest{
+			Model:   "test",
+			Prompts: prompts,
+			Raw:     true,
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.BatchGenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, r := range resp.Responses {
+			if r.Response != strconv.Itoa(i) {
+				t.Errorf("expected response %q for index %d, got %q", strconv.Itoa(i), i, r.Response)
+			}
+		}
+
+		if most != 2 {
+			t.Errorf("expected 2 prompts completed at once, got %d", most)
+		}
+	})
+
+	t.Run("batch with load options per prompt", func(t *testing.T) {
+		w := createRequest(t, s.BatchGenerateHandler, api.BatchGenerateRequest{
+			Model:   "test",
+			Prompts: []api.BatchPrompt{{Prompt: "first"}, {Prompt: "second", Options: map[string]any{"num_ctx": 1024}}},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("batch metrics", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: r.Prompt, Done: true, DoneReason: llm.DoneReasonStop, EvalCount: 3, CachedPromptCount: 2, DraftCount: 4, AcceptedDraftCount: 1})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w := createRequest(t, s.BatchGenerateHandler, api.BatchGenerateRequest{
+			Model:   "test",
+			Prompts: []api.BatchPrompt{{Prompt: "first"}},
+			Raw:     true,
+			Stream:  &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.BatchGenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// the metrics are those a generate request reports
+		want := api.Metrics{EvalCount: 3, CachedPromptTokens: 2, PromptCacheHitTokens: 2, DraftTokens: 4, AcceptedDraftTokens: 1}
+		if len(resp.Responses) != 1 {
+			t.Fatalf("expected 1 response, got %d", len(resp.Responses))
+		}
+		if diff := cmp.Diff(resp.Responses[0].Metrics, want); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("batch alias", func(t *testing.T) {
+		w := createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "prod-batch", Model: "test"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: r.Prompt, Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		t.Cleanup(func() { mock.CompletionFn = nil })
+
+		w = createRequest(t, s.BatchGenerateHandler, api.BatchGenerateRequest{
+			Model:   "prod-batch",
+			Prompts: []api.BatchPrompt{{Prompt: "first"}},
+			Raw:     true,
+			Stream:  &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.BatchGenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Model != "prod-batch" || len(resp.Responses) != 1 || resp.Responses[0].Response != "first" {
+			t.Errorf("expected a response from prod-batch, got %+v", resp)
+		}
+	})
+
+	t.Run("session", func(t *testing.T) {
+		// saving doesn't load a model
+		w := createRequest(t, s.SaveSessionHandler, api.SessionSaveRequest{Model: "bert"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for a model that isn't loaded, got %d", w.Code)
+		}
+
+		// loadFn doesn't track loaded runners, so the session is saved from
+		// a scheduler that has the model loaded
+		m, err := GetModel("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loaded := make(chan struct{})
+		close(loaded)
+		saver := Server{sched: &Scheduler{loaded: map[string]*runnerRef{m.ModelPath: {llama: &mock, loaded: loaded}}}}
+
+		w = createRequest(t, saver.SaveSessionHandler, api.SessionSaveRequest{Model: "test", Context: []int{1, 2, 3}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var saved api.SessionSaveResponse
+		if err := json.NewDecoder(w.Body).Decode(&saved); err != nil {
+			t.Fatal(err)
+		}
+
+		if saved.Tokens != 3 || saved.Size == 0 {
+			t.Errorf("expected a session of 3 tokens, got %+v", saved)
+		}
+
+		path, err := GetSessionPath(saved.Session)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// only the completed session is left
+		checkFileExists(t, filepath.Join(filepath.Dir(path), "*"), []string{path})
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Session: saved.Session,
+			Stream:  &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		if mock.CompletionRequest.Session != path || !strings.HasPrefix(mock.CompletionRequest.Prompt, "1 2 3") {
+			t.Errorf("expected the completion to continue from %s and its tokens, got %q and %q", path, mock.CompletionRequest.Session, mock.CompletionRequest.Prompt)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Session: saved.Session,
+			Context: []int{1},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 with context, got %d", w.Code)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Session: fmt.Sprintf("sha256:%064x", 0),
+		})
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for a missing session, got %d", w.Code)
+		}
+
+		other, err := GetSessionPath(fmt.Sprintf("sha256:%064x", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(other, []byte(`{"model":"sha256:other","tokens":[1]}`+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		w = createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:   "test",
+			Prompt:  "Hello!",
+			Session: fmt.Sprintf("sha256:%064x", 1),
+		})
+
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "different model") {
+			t.Errorf("expected status 400 for a session of a different model, got %d: %s", w.Code, w.Body)
 		}
 	})
 }
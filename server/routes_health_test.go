@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestHealthHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	s := Server{sched: &Scheduler{loaded: make(map[string]*runnerRef)}}
+
+	_, digest := createBinFile(t, nil, nil)
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:  "test",
+		Files: map[string]string{"test.gguf": digest},
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	health := func(t *testing.T, target string) (int, api.HealthResponse) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+		s.HealthHandler(c)
+
+		var resp api.HealthResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return w.Code, resp
+	}
+
+	t.Run("server", func(t *testing.T) {
+		code, resp := health(t, "/health")
+		if code != http.StatusOK || resp.Status != "ok" {
+			t.Errorf("expected 200 ok, got %d %+v", code, resp)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if code, _ := health(t, "/api/health?model=missing"); code != http.StatusNotFound {
+			t.Errorf("expected status code 404, actual %d", code)
+		}
+	})
+
+	t.Run("not loaded", func(t *testing.T) {
+		code, resp := health(t, "/api/health?model=test")
+		if code != http.StatusServiceUnavailable || resp.Status != "not-loaded" || resp.Model != "test" {
+			t.Errorf("expected 503 not-loaded, got %d %+v", code, resp)
+		}
+	})
+
+	runner := &runnerRef{
+		llama:       &mockLlm{loadProgress: 0.25},
+		loaded:      make(chan struct{}),
+		loadStarted: time.Now().Add(-3 * time.Second),
+	}
+	s.sched.loaded[m.ModelPath] = runner
+
+	t.Run("loading", func(t *testing.T) {
+		code, resp := health(t, "/api/health?model=test")
+		if code != http.StatusServiceUnavailable || resp.Status != "loading" || resp.Progress != 25 {
+			t.Fatalf("expected 503 loading at 25%%, got %d %+v", code, resp)
+		}
+
+		// a quarter took 3 seconds so the rest should take about 9
+		if eta := resp.EstimatedTimeToReady; eta == nil || eta.Duration < 8*time.Second || eta.Duration > 10*time.Second {
+			t.Errorf("expected about 9s until ready, got %v", eta)
+		}
+	})
+
+	close(runner.loaded)
+
+	t.Run("ready", func(t *testing.T) {
+		code, resp := health(t, "/api/health?model=test")
+		if code != http.StatusOK || resp.Status != "ready" || resp.Progress != 100 || resp.EstimatedTimeToReady != nil {
+			t.Errorf("expected 200 ready, got %d %+v", code, resp)
+		}
+	})
+}
@@ -2,13 +2,16 @@ package server
 
 import (
 	"encoding/json"
+	"maps"
 	"net/http"
+	"os"
 	"slices"
 	"testing"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/fs/ggml"
 )
 
 func TestList(t *testing.T) {
@@ -64,3 +67,66 @@ func TestList(t *testing.T) {
 		t.Fatalf("expected slices to be equal %v", actualNames)
 	}
 }
+
+func TestListContextLength(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	_, llamaDigest := createBinFile(t, ggml.KV{
+		"general.architecture": "llama",
+		"llama.context_length": uint32(8192),
+	}, nil)
+
+	createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:  "test",
+		Files: map[string]string{"test.gguf": llamaDigest},
+	})
+
+	// a model without a context length omits it
+	_, digest := createBinFile(t, nil, nil)
+	createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:  "unknown",
+		Files: map[string]string{"test.gguf": digest},
+	})
+
+	list := func(t *testing.T) map[string]uint64 {
+		t.Helper()
+
+		w := createRequest(t, s.ListHandler, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+
+		var resp api.ListResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make(map[string]uint64)
+		for _, m := range resp.Models {
+			got[m.Name] = m.ContextLength
+		}
+		return got
+	}
+
+	want := map[string]uint64{"test:latest": 8192, "unknown:latest": 0}
+	if got := list(t); !maps.Equal(got, want) {
+		t.Errorf("expected context lengths %v, got %v", want, got)
+	}
+
+	// the context length isn't read from the model again
+	p, err := GetBlobsPath(llamaDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Truncate(p, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := list(t); !maps.Equal(got, want) {
+		t.Errorf("expected cached context lengths %v, got %v", want, got)
+	}
+}
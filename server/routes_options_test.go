@@ -0,0 +1,182 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/types/model"
+)
+
+func TestOptionsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	_, digest := createBinFile(t, nil, nil)
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:       "test",
+		Files:      map[string]string{"test.gguf": digest},
+		Parameters: map[string]any{"temperature": 0.5, "top_k": 20},
+		Stream:     &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	options := func(t *testing.T, opts map[string]any) (int, api.OptionsResponse) {
+		t.Helper()
+
+		w := createRequest(t, s.OptionsHandler, api.OptionsRequest{Model: "test", Options: opts})
+
+		var resp api.OptionsResponse
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		} else if w.Code == http.StatusBadRequest {
+			var serr api.StatusError
+			if err := json.NewDecoder(w.Body).Decode(&serr); err != nil {
+				t.Fatal(err)
+			}
+
+			if serr.Code != api.ErrorCodeInvalidOptions {
+				t.Errorf("expected code %q, got %q", api.ErrorCodeInvalidOptions, serr.Code)
+			}
+		}
+
+		return w.Code, resp
+	}
+
+	t.Run("get", func(t *testing.T) {
+		code, resp := options(t, nil)
+		if code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", code)
+		}
+
+		if diff := cmp.Diff(resp.Options, map[string]any{"temperature": 0.5, "top_k": float64(20)}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		code, resp := options(t, map[string]any{"top_k": 10, "num_predict": 20, "temperature": nil})
+		if code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", code)
+		}
+
+		if diff := cmp.Diff(resp.Options, map[string]any{"top_k": float64(10), "num_predict": float64(20)}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		m, err := GetModel("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the request's options override the model's, which override the
+		// server's; numbers are decoded from requests as float64
+		opts, err := modelOptions(m, map[string]any{"num_predict": float64(5)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defaults := api.DefaultOptions()
+		if opts.NumPredict != 5 || opts.TopK != 10 || opts.Temperature != defaults.Temperature || opts.TopP != defaults.TopP {
+			t.Errorf("expected num_predict 5, top_k 10 and the default temperature and top_p, got %d, %d, %v and %v", opts.NumPredict, opts.TopK, opts.Temperature, opts.TopP)
+		}
+	})
+
+	paramsBlob := func(t *testing.T) string {
+		t.Helper()
+
+		mf, err := ParseNamedManifest(model.ParseName("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, layer := range mf.Layers {
+			if layer.MediaType == "application/vnd.ollama.image.params" {
+				blob, err := GetBlobsPath(layer.Digest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return blob
+			}
+		}
+
+		t.Fatal("expected a params layer")
+		return ""
+	}
+
+	t.Run("old params removed", func(t *testing.T) {
+		old := paramsBlob(t)
+		if code, _ := options(t, map[string]any{"top_k": 30}); code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", code)
+		}
+
+		if _, err := os.Stat(old); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the old params to be removed, got %v", err)
+		}
+
+		if _, err := os.Stat(paramsBlob(t)); err != nil {
+			t.Errorf("expected the new params to exist, got %v", err)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		keys := []string{"seed", "num_keep", "repeat_last_n", "min_p"}
+
+		var wg sync.WaitGroup
+		for _, k := range keys {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if code, _ := options(t, map[string]any{k: 1}); code != http.StatusOK {
+					t.Errorf("expected status code 200, actual %d", code)
+				}
+			}()
+		}
+		wg.Wait()
+
+		_, resp := options(t, nil)
+		for _, k := range keys {
+			if _, ok := resp.Options[k]; !ok {
+				t.Errorf("expected option %q to be set, got %v", k, resp.Options)
+			}
+		}
+	})
+
+	t.Run("invalid value", func(t *testing.T) {
+		if code, _ := options(t, map[string]any{"top_k": "ten"}); code != http.StatusBadRequest {
+			t.Errorf("expected status code 400, actual %d", code)
+		}
+	})
+
+	t.Run("unknown option", func(t *testing.T) {
+		if code, _ := options(t, map[string]any{"top_q": 1}); code != http.StatusBadRequest {
+			t.Errorf("expected status code 400, actual %d", code)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		w := createRequest(t, s.OptionsHandler, api.OptionsRequest{Model: "missing", Options: map[string]any{"top_k": 10}})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status code 404, actual %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"code":"model_not_found","error":"model 'missing' not found"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+}
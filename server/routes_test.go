@@ -3,8 +3,10 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -19,12 +21,14 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 	"unicode"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/go-cmp/cmp"
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/openai"
 	"github.com/ollama/ollama/server/internal/client/ollama"
 	"github.com/ollama/ollama/types/model"
@@ -690,6 +694,96 @@ func TestManifestCaseSensitivity(t *testing.T) {
 	}
 }
 
+func TestManifestHandler(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	local := []byte("already pulled")
+	localDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(local))
+	p, err := GetBlobsPath(localDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, local, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := Manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+		Config:        Layer{MediaType: "application/vnd.docker.container.image.v1+json", Digest: localDigest, Size: int64(len(local))},
+		Layers: []Layer{
+			{MediaType: "application/vnd.ollama.image.model", Digest: "sha256:" + strings.Repeat("a", 64), Size: 1000},
+			{MediaType: "application/vnd.ollama.image.template", Digest: "sha256:" + strings.Repeat("b", 64), Size: 24},
+		},
+	}
+
+	var blobRequests int
+	r := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/library/test/manifests/latest":
+			json.NewEncoder(w).Encode(manifest) //nolint:errcheck
+		default:
+			if strings.Contains(r.URL.Path, "/blobs/") {
+				blobRequests++
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer r.Close()
+
+	testMakeRequestDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", r.Listener.Addr().String())
+	}
+	t.Cleanup(func() { testMakeRequestDialContext = nil })
+
+	var s Server
+
+	t.Run("manifest", func(t *testing.T) {
+		w := createRequest(t, s.ManifestHandler, api.ManifestRequest{Model: "example.com/library/test", Insecure: true})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.ManifestResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		want := api.ManifestResponse{
+			Model: "example.com/library/test:latest",
+			Layers: []api.ManifestLayer{
+				{MediaType: "application/vnd.ollama.image.model", Digest: "sha256:" + strings.Repeat("a", 64), Size: 1000},
+				{MediaType: "application/vnd.ollama.image.template", Digest: "sha256:" + strings.Repeat("b", 64), Size: 24},
+				{MediaType: "application/vnd.docker.container.image.v1+json", Digest: localDigest, Size: int64(len(local)), Local: true},
+			},
+			TotalSize:   1024 + int64(len(local)),
+			MissingSize: 1024,
+		}
+		if diff := cmp.Diff(want, resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if blobRequests != 0 {
+			t.Errorf("expected no blob requests, got %d", blobRequests)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		w := createRequest(t, s.ManifestHandler, api.ManifestRequest{Model: "example.com/library/missing", Insecure: true})
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		w := createRequest(t, s.ManifestHandler, api.ManifestRequest{Model: "!!"})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d", w.Code)
+		}
+	})
+}
+
 func TestShow(t *testing.T) {
 	t.Setenv("OLLAMA_MODELS", t.TempDir())
 
@@ -725,6 +819,183 @@ func TestShow(t *testing.T) {
 	}
 }
 
+func TestShowArchitecture(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":                    "mllama",
+		"mllama.block_count":                      uint32(40),
+		"mllama.embedding_length":                 uint32(4096),
+		"mllama.attention.head_count":             uint32(32),
+		"mllama.attention.head_count_kv":          uint32(8),
+		"mllama.attention.cross_attention_layers": []int32{3, 8, 13},
+		"mllama.context_length":                   uint32(131072),
+	}, nil)
+
+	createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:  "show-model",
+		Files: map[string]string{"model.gguf": digest},
+	})
+
+	w := createRequest(t, s.ShowHandler, api.ShowRequest{
+		Name: "show-model",
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var resp api.ShowResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := &api.ArchitectureInfo{
+		Name:                 "mllama",
+		BlockCount:           40,
+		EmbeddingLength:      4096,
+		NumHeads:             32,
+		NumKVHeads:           8,
+		HeadDim:              128,
+		CrossAttentionLayers: []int32{3, 8, 13},
+	}
+
+	if diff := cmp.Diff(expect, resp.Architecture); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if resp.TrainCtx != 131072 {
+		t.Errorf("expected train_ctx 131072, got %d", resp.TrainCtx)
+	}
+}
+
+func TestShowQuantization(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	tensor := func(name string, kind ggml.TensorType, shape ...uint64) *ggml.Tensor {
+		t := &ggml.Tensor{Name: name, Kind: uint32(kind), Shape: shape}
+		t.WriterTo = bytes.NewReader(make([]byte, t.Size()))
+		return t
+	}
+
+	// a mixed quantization model, as llama.cpp makes for Q4_K_M
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture": "llama",
+		"general.file_type":    uint32(ggml.FileTypeQ4_K_M),
+	}, []*ggml.Tensor{
+		tensor("token_embd.weight", ggml.TensorTypeQ6_K, 512, 2),
+		tensor("blk.0.attn_q.weight", ggml.TensorTypeQ4_K, 512, 2),
+		tensor("blk.0.attn_k.weight", ggml.TensorTypeQ4_K, 512, 2),
+		tensor("output_norm.weight", ggml.TensorTypeF32, 512),
+	})
+
+	createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:  "show-model",
+		Files: map[string]string{"model.gguf": digest},
+	})
+
+	w := createRequest(t, s.ShowHandler, api.ShowRequest{
+		Name: "show-model",
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var resp api.ShowResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Details.QuantizationLevel != "Q4_K_M" {
+		t.Errorf("expected quantization level Q4_K_M, got %q", resp.Details.QuantizationLevel)
+	}
+
+	// Q4_K and Q6_K store blocks of 256 weights in 144 and 210 bytes
+	expect := []api.QuantizationType{
+		{Type: "Q4_K", Tensors: 2, Parameters: 2048, Size: 1152, BitsPerWeight: 4.5},
+		{Type: "Q6_K", Tensors: 1, Parameters: 1024, Size: 840, BitsPerWeight: 6.5625},
+		{Type: "F32", Tensors: 1, Parameters: 512, Size: 2048, BitsPerWeight: 32},
+	}
+
+	if diff := cmp.Diff(expect, resp.Quantization); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	if want := float64(4040*8) / 3584; math.Abs(resp.BitsPerWeight-want) > 1e-9 {
+		t.Errorf("expected %v bits per weight, got %v", want, resp.BitsPerWeight)
+	}
+}
+
+func TestPs(t *testing.T) {
+	s := Server{sched: &Scheduler{loaded: map[string]*runnerRef{
+		"idle": {
+			model: &Model{ShortName: "idle"},
+			llama: &mockLlm{usageResp: llm.ServerUsage{
+				ContextUsed:    100,
+				ContextTotal:   4096,
+				VRAM:           1 << 30,
+				GPULayers:      33,
+				GPULayerRanges: "0-15,17-33",
+			}},
+			sessionDuration: 5 * time.Minute,
+			expiresAt:       time.Now().Add(time.Minute),
+			numParallel:     4,
+		},
+		"busy": {
+			model:           &Model{ShortName: "busy"},
+			llama:           &mockLlm{},
+			refCount:        1,
+			sessionDuration: 10 * time.Minute,
+			expiresAt:       time.Now().Add(-time.Hour),
+		},
+		"forever": {
+			model:           &Model{ShortName: "forever"},
+			llama:           &mockLlm{usageRespErr: errors.New("not responding")},
+			sessionDuration: time.Duration(math.MaxInt64),
+			expiresAt:       time.Now().Add(time.Duration(math.MaxInt64)),
+		},
+	}}}
+
+	w := createRequest(t, s.PsHandler, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var resp api.ProcessResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	expiresIn := make(map[string]time.Duration)
+	for _, m := range resp.Models {
+		expiresIn[m.Name] = m.ExpiresIn.Duration
+
+		if m.Name == "idle" && (m.ContextUsed != 100 || m.ContextTotal != 4096 || m.VRAMBytes != 1<<30 || m.GPULayers != 33 || m.GPULayerRanges != "0-15,17-33" || m.NumParallel != 4) {
+			t.Errorf("idle: unexpected usage, got %+v", m)
+		}
+	}
+
+	// idle models count down from when they went idle
+	if d := expiresIn["idle"]; d <= 0 || d > time.Minute {
+		t.Errorf("idle: expected expires_in up to 1m, got %v", d)
+	}
+
+	// models in use keep their full keep alive until their requests finish
+	if d := expiresIn["busy"]; d <= 9*time.Minute || d > 10*time.Minute {
+		t.Errorf("busy: expected expires_in close to 10m, got %v", d)
+	}
+
+	// -1 unmarshals back to the maximum duration, meaning forever
+	if d := expiresIn["forever"]; d != time.Duration(math.MaxInt64) {
+		t.Errorf("forever: expected expires_in -1, got %v", d)
+	}
+}
+
 func TestNormalize(t *testing.T) {
 	type testCase struct {
 		input []float32
@@ -900,7 +1171,7 @@ func TestWaitForStream(t *testing.T) {
 				gin.H{"error": "internal server error"},
 			},
 			expectCode: http.StatusInternalServerError,
-			expectBody: `{"error":"internal server error"}`,
+			expectBody: `{"code":"internal_error","error":"internal server error"}`,
 		},
 		{
 			name: "error status",
@@ -908,7 +1179,15 @@ func TestWaitForStream(t *testing.T) {
 				gin.H{"status": http.StatusNotFound, "error": "not found"},
 			},
 			expectCode: http.StatusNotFound,
-			expectBody: `{"error":"not found"}`,
+			expectBody: `{"code":"not_found","error":"not found"}`,
+		},
+		{
+			name: "error code",
+			messages: []any{
+				gin.H{"status": http.StatusBadRequest, "error": "invalid model name", "code": api.ErrorCodeInvalidRequest},
+			},
+			expectCode: http.StatusBadRequest,
+			expectBody: `{"code":"invalid_request","error":"invalid model name"}`,
 		},
 		{
 			name: "unknown error",
@@ -916,7 +1195,7 @@ func TestWaitForStream(t *testing.T) {
 				gin.H{"msg": "something else"},
 			},
 			expectCode: http.StatusInternalServerError,
-			expectBody: `{"error":"unknown error"}`,
+			expectBody: `{"code":"internal_error","error":"unknown error"}`,
 		},
 		{
 			name: "unknown type",
@@ -924,7 +1203,7 @@ func TestWaitForStream(t *testing.T) {
 				struct{}{},
 			},
 			expectCode: http.StatusInternalServerError,
-			expectBody: `{"error":"unknown message type"}`,
+			expectBody: `{"code":"internal_error","error":"unknown message type"}`,
 		},
 		{
 			name: "progress success",
@@ -968,3 +1247,222 @@ func TestWaitForStream(t *testing.T) {
 		})
 	}
 }
+
+func TestCopyHandlerQuantize(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	weights := bytes.Repeat(quantBytes[ggml.TensorTypeF16], 4)
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture": "llama",
+		"general.file_type":    uint32(1),
+	}, []*ggml.Tensor{
+		{Name: "blk.0.attn.weight", Kind: uint32(ggml.TensorTypeF16), Shape: []uint64{512, 2}, WriterTo: bytes.NewReader(weights)},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:    "source",
+		Files:    map[string]string{"model.gguf": digest},
+		Template: "{{ .Prompt }}",
+		Stream:   &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	t.Run("quantize", func(t *testing.T) {
+		w := createRequest(t, s.CopyHandler, api.CopyRequest{Source: "source", Destination: "quantized", Quantize: "q8_0"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var quantizing bool
+		for line := range strings.Lines(w.Body.String()) {
+			var resp api.ProgressResponse
+			if err := json.Unmarshal([]byte(line), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			quantizing = quantizing || strings.HasPrefix(resp.Status, "quantizing F16 model to Q8_0")
+		}
+
+		if !quantizing {
+			t.Errorf("expected quantization progress, got %s", w.Body.String())
+		}
+
+		src, err := GetModel("source")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dst, err := GetModel("quantized")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dst.Config.FileType != "Q8_0" {
+			t.Errorf("expected file type Q8_0, got %s", dst.Config.FileType)
+		}
+
+		if dst.ParentModel != "source:latest" {
+			t.Errorf("expected parent model source:latest, got %q", dst.ParentModel)
+		}
+
+		if dst.ModelPath == src.ModelPath {
+			t.Error("expected quantized weights in a new blob")
+		}
+
+		if dst.Template.String() != src.Template.String() {
+			t.Errorf("expected template %q, got %q", src.Template, dst.Template)
+		}
+
+		f, err := os.Open(dst.ModelPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		g, err := ggml.Decode(f, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if kind := ggml.TensorType(g.Tensors().Items()[0].Kind); kind != ggml.TensorTypeQ8_0 {
+			t.Errorf("expected Q8_0 tensor, got %s", kind)
+		}
+	})
+
+	t.Run("requantize", func(t *testing.T) {
+		w := createRequest(t, s.CopyHandler, api.CopyRequest{Source: "quantized", Destination: "requantized", Quantize: "q4_K_M", Stream: &stream})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		m, err := GetModel("requantized")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Config.FileType != "Q4_K_M" {
+			t.Errorf("expected file type Q4_K_M, got %s", m.Config.FileType)
+		}
+	})
+
+	t.Run("unsupported type", func(t *testing.T) {
+		w := createRequest(t, s.CopyHandler, api.CopyRequest{Source: "source", Destination: "bad", Quantize: "q3_K_S"})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if !strings.Contains(w.Body.String(), "unsupported quantization type") {
+			t.Errorf("unexpected error: %s", w.Body.String())
+		}
+	})
+
+	t.Run("missing source", func(t *testing.T) {
+		w := createRequest(t, s.CopyHandler, api.CopyRequest{Source: "missing", Destination: "bad", Quantize: "q8_0"})
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestStreamResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	stream := func(path, accept string) *responseRecorder {
+		ch := make(chan any, 3)
+		ch <- api.GenerateResponse{Model: "test", Response: "Hello"}
+		ch <- api.GenerateResponse{Model: "test", Response: "\n", Done: true}
+		ch <- gin.H{"error": "oops"}
+		close(ch)
+
+		r := gin.New()
+		r.POST(path, func(c *gin.Context) { streamResponse(c, ch) })
+
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		w := NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	cases := []struct {
+		name        string
+		path        string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "ndjson",
+			path:        "/api/generate",
+			contentType: "application/x-ndjson",
+			body: `{"model":"test","created_at":"0001-01-01T00:00:00Z","response":"Hello","done":false}` + "\n" +
+				`{"model":"test","created_at":"0001-01-01T00:00:00Z","response":"\n","done":true}` + "\n" +
+				`{"error":"oops"}` + "\n",
+		},
+		{
+			name:        "events",
+			path:        "/api/generate",
+			accept:      "text/event-stream",
+			contentType: "text/event-stream",
+			body: `data: {"model":"test","created_at":"0001-01-01T00:00:00Z","response":"Hello","done":false}` + "\n\n" +
+				`data: {"model":"test","created_at":"0001-01-01T00:00:00Z","response":"\n","done":true}` + "\n\n" +
+				`data: {"error":"oops"}` + "\n\n" +
+				"data: [DONE]\n\n",
+		},
+		{
+			name:        "wildcard",
+			path:        "/api/generate",
+			accept:      "*/*",
+			contentType: "application/x-ndjson",
+			body: `{"model":"test","created_at":"0001-01-01T00:00:00Z","response":"Hello","done":false}` + "\n" +
+				`{"model":"test","created_at":"0001-01-01T00:00:00Z","response":"\n","done":true}` + "\n" +
+				`{"error":"oops"}` + "\n",
+		},
+		{
+			// the OpenAI middleware frames its own events
+			name:        "openai",
+			path:        "/v1/completions",
+			accept:      "text/event-stream",
+			contentType: "application/x-ndjson",
+			body: `{"model":"test","created_at":"0001-01-01T00:00:00Z","response":"Hello","done":false}` + "\n" +
+				`{"model":"test","created_at":"0001-01-01T00:00:00Z","response":"\n","done":true}` + "\n" +
+				`{"error":"oops"}` + "\n",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := stream(tt.path, tt.accept)
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("expected content type %q, got %q", tt.contentType, got)
+			}
+
+			if diff := cmp.Diff(w.Body.String(), tt.body); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	m := &Model{Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000"}
+
+	opts := api.DefaultOptions()
+	fp := fingerprint(m, &opts)
+	if !strings.HasPrefix(fp, "fp_") || fp == unknownFingerprint {
+		t.Fatalf("expected a fingerprint, got %q", fp)
+	}
+
+	// options that can't be encoded don't fail the request
+	opts.RopeFactors = []float32{float32(math.NaN())}
+	if got := fingerprint(m, &opts); got != unknownFingerprint {
+		t.Errorf("expected %q, got %q", unknownFingerprint, got)
+	}
+}
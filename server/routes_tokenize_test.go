@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/fs/ggml"
+	_ "github.com/ollama/ollama/model/models"
+)
+
+func TestTokenize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_NEW_ENGINE", "1")
+
+	// the server has no scheduler, as tokenizing reads only the model's
+	// vocabulary and never loads it
+	var s Server
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.model":          "gpt2",
+		"tokenizer.ggml.tokens":         []string{"<s>", "a", "Ġ", "b", "Ġb"},
+		"tokenizer.ggml.token_type":     []int32{3, 1, 1, 1, 1},
+		"tokenizer.ggml.merges":         []string{"Ġ b"},
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:  "test",
+		Files:  map[string]string{"file.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	t.Run("tokenize", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model: "test",
+			Text:  "a b a",
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.TokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp, api.TokenizeResponse{Model: "test", Tokens: []int{1, 4, 2, 1}}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("tokenize empty", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model: "test",
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.TokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp, api.TokenizeResponse{Model: "test", Tokens: []int{}}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("tokenize missing model", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model: "missing",
+			Text:  "hello",
+		})
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("tokenize without model", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{Text: "hello"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("detokenize", func(t *testing.T) {
+		w := createRequest(t, s.DetokenizeHandler, api.DetokenizeRequest{
+			Model:  "test",
+			Tokens: []int{1, 4, 2, 1},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.DetokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp, api.DetokenizeResponse{Model: "test", Text: "a b a"}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("detokenize missing model", func(t *testing.T) {
+		w := createRequest(t, s.DetokenizeHandler, api.DetokenizeRequest{
+			Model:  "missing",
+			Tokens: []int{0},
+		})
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("detokenize without model", func(t *testing.T) {
+		w := createRequest(t, s.DetokenizeHandler, api.DetokenizeRequest{Tokens: []int{0}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+}
+
+func TestCompareTokenizers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_NEW_ENGINE", "1")
+
+	var s Server
+
+	// words has a token for each word of the text, and letters for each letter
+	for name, vocab := range map[string]ggml.KV{
+		"words": {
+			"tokenizer.ggml.tokens":     []string{"h", "i", "Ġ", "t", "e", "r", "hi", "Ġt", "Ġth", "er", "Ġther", "Ġthere"},
+			"tokenizer.ggml.token_type": []int32{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+			"tokenizer.ggml.merges":     []string{"h i", "Ġ t", "Ġt h", "e r", "Ġth er", "Ġther e"},
+		},
+		"letters": {
+			"tokenizer.ggml.tokens":     []string{"h", "i", "Ġ", "t", "e", "r"},
+			"tokenizer.ggml.token_type": []int32{1, 1, 1, 1, 1, 1},
+		},
+	} {
+		kv := ggml.KV{
+			"general.architecture": "llama",
+			"general.name":         name,
+			"llama.block_count":    uint32(1),
+			"tokenizer.ggml.model": "gpt2",
+		}
+		maps.Copy(kv, vocab)
+
+		_, digest := createBinFile(t, kv, []*ggml.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:  name,
+			Files:  map[string]string{"file.gguf": digest},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+	}
+
+	t.Run("compare", func(t *testing.T) {
+		w := createRequest(t, s.CompareTokenizersHandler, api.CompareTokenizersRequest{
+			Models: []string{"words", "letters"},
+			Text:   "hi there",
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+
+		var resp api.CompareTokenizersResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp, api.CompareTokenizersResponse{
+			Tokenizations: []api.Tokenization{
+				{Model: "words", Tokens: []int{6, 11}, Pieces: []string{"hi", " there"}},
+				{Model: "letters", Tokens: []int{0, 1, 2, 3, 0, 4, 5, 4}, Pieces: []string{"h", "i", " ", "t", "h", "e", "r", "e"}},
+			},
+			Diff: 6,
+		}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("one model", func(t *testing.T) {
+		w := createRequest(t, s.CompareTokenizersHandler, api.CompareTokenizersRequest{Models: []string{"words"}, Text: "hi"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.CompareTokenizersHandler, api.CompareTokenizersRequest{Models: []string{"words", "missing"}, Text: "hi"})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+}
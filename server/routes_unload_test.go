@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestUnloadHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	s := Server{sched: &Scheduler{loaded: make(map[string]*runnerRef)}}
+
+	_, digest := createBinFile(t, nil, nil)
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:  "test",
+		Files: map[string]string{"test.gguf": digest},
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	w = createRequest(t, s.AliasHandler, api.AliasRequest{Alias: "prod-unload", Model: "test"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	cases := []struct {
+		name  string
+		model string
+		code  int
+		err   string
+	}{
+		{"invalid", "", http.StatusBadRequest, `{"code":"invalid_request","error":"name \"\" is invalid"}`},
+		{"not found", "missing", http.StatusNotFound, `{"code":"model_not_found","error":"model 'missing' not found"}`},
+		{"not loaded", "test", http.StatusNotFound, `{"code":"not_found","error":"model 'test' is not loaded"}`},
+		{"alias", "prod-unload", http.StatusNotFound, `{"code":"not_found","error":"model 'prod-unload' is not loaded"}`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := createRequest(t, s.UnloadHandler, api.UnloadRequest{Model: tt.model})
+			if w.Code != tt.code {
+				t.Fatalf("expected status code %d, actual %d", tt.code, w.Code)
+			}
+
+			if got := w.Body.String(); got != tt.err {
+				t.Errorf("expected body %s, actual %s", tt.err, got)
+			}
+		})
+	}
+}
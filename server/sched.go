@@ -1,10 +1,12 @@
 package server
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
 	"reflect"
 	"runtime"
@@ -44,6 +46,10 @@ type Scheduler struct {
 	loaded   map[string]*runnerRef
 	loadedMu sync.Mutex
 
+	// preloaded holds the priorities of the models, by model path, that are
+	// loaded at startup and kept loaded. It is guarded by loadedMu.
+	preloaded map[string]int
+
 	loadFn       func(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList, numParallel int)
 	newServerFn  func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error)
 	getGpuFn     func() discover.GpuInfoList
@@ -63,6 +69,14 @@ var defaultParallel = 2
 
 var ErrMaxQueue = errors.New("server busy, please try again.  maximum pending requests exceeded")
 
+var (
+	errModelNotLoaded = errors.New("model is not loaded")
+
+	// errModelUnloaded is the cause of canceling requests in flight when
+	// their model is unloaded
+	errModelUnloaded = errors.New("model was unloaded")
+)
+
 func InitScheduler(ctx context.Context) *Scheduler {
 	maxQueue := envconfig.MaxQueue()
 	sched := &Scheduler{
@@ -71,6 +85,7 @@ func InitScheduler(ctx context.Context) *Scheduler {
 		expiredCh:     make(chan *runnerRef, maxQueue),
 		unloadedCh:    make(chan any, maxQueue),
 		loaded:        make(map[string]*runnerRef),
+		preloaded:     make(map[string]int),
 		newServerFn:   llm.NewLlamaServer,
 		getGpuFn:      discover.GetGPUInfo,
 		getCpuFn:      discover.GetCPUInfo,
@@ -133,6 +148,9 @@ func (s *Scheduler) processPending(ctx context.Context) {
 				continue
 			}
 			numParallel := int(envconfig.NumParallel())
+			if pending.opts.NumParallel > 0 {
+				numParallel = pending.opts.NumParallel
+			}
 			// `mllama` is a snowflake and uses an encoder cache which cannot be used with num_parallel > 1
 			// ref: https://github.com/ollama/ollama/issues/4165
 			if slices.Contains(pending.model.Config.ModelFamilies, "mllama") && numParallel != 1 {
@@ -144,7 +162,13 @@ func (s *Scheduler) processPending(ctx context.Context) {
 				var runnerToExpire *runnerRef
 				s.loadedMu.Lock()
 				runner := s.loaded[pending.model.ModelPath]
-				loadedCount := len(s.loaded)
+				// preloaded models don't count towards the maximum
+				var loadedCount int
+				for path := range s.loaded {
+					if _, ok := s.preloaded[path]; !ok {
+						loadedCount++
+					}
+				}
 				s.loadedMu.Unlock()
 				if runner != nil {
 					if runner.needsReload(ctx, pending) {
@@ -396,6 +420,7 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 				// convergence.
 				slog.Debug("orphaned runner shutting down", "orphan", runner, "loaded", runnerToUnload)
 				runner.unload()
+				runner.markUnloaded()
 				s.loadedMu.Unlock()
 				runner.refMu.Unlock()
 			} else {
@@ -406,6 +431,7 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 				s.loadedMu.Unlock()
 				slog.Debug("runner terminated and removed from list, blocking for VRAM recovery", "runner", runner)
 				<-finished
+				runner.markUnloaded()
 				runner.refMu.Unlock()
 				slog.Debug("sending an unloaded event", "runner", runner)
 				s.unloadedCh <- struct{}{}
@@ -426,7 +452,7 @@ func (pending *LlmRequest) useLoadedRunner(runner *runnerRef, finished chan *Llm
 		runner.expireTimer = nil
 	}
 	if pending.sessionDuration != nil {
-		runner.sessionDuration = pending.sessionDuration.Duration
+		runner.sessionDuration = keepAlive(pending.sessionDuration.Duration)
 	}
 	pending.successCh <- runner
 	go func() {
@@ -436,13 +462,28 @@ func (pending *LlmRequest) useLoadedRunner(runner *runnerRef, finished chan *Llm
 	}()
 }
 
+// keepAlive returns how long an idle runner stays loaded for a requested keep
+// alive duration. Zero unloads the runner as soon as it is idle and negative
+// durations keep it loaded until it is evicted or explicitly unloaded.
+func keepAlive(d time.Duration) time.Duration {
+	if d < 0 {
+		return time.Duration(math.MaxInt64)
+	}
+
+	return d
+}
+
 func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList, numParallel int) {
 	if numParallel < 1 {
 		numParallel = 1
 	}
+	_, preloaded := s.preloadPriority(req.model.ModelPath)
 	sessionDuration := envconfig.KeepAlive()
+	if preloaded {
+		sessionDuration = time.Duration(math.MaxInt64)
+	}
 	if req.sessionDuration != nil {
-		sessionDuration = req.sessionDuration.Duration
+		sessionDuration = keepAlive(req.sessionDuration.Duration)
 	}
 	llama, err := s.newServerFn(gpus, req.model.ModelPath, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, numParallel)
 	if err != nil {
@@ -467,6 +508,9 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 		estimatedTotal:  llama.EstimatedTotal(),
 		loading:         true,
 		pid:             llama.Pid(),
+		unloaded:        make(chan struct{}),
+		loaded:          make(chan struct{}),
+		loadStarted:     time.Now(),
 	}
 	runner.numParallel = numParallel
 	runner.refMu.Lock() // hold lock until running or aborted
@@ -477,6 +521,7 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 		slog.Warn("model was still loaded", "old_runner", oldRunner, "new_runner", runner)
 		oldRunner.refMu.Lock()
 		oldRunner.unload()
+		oldRunner.markUnloaded()
 		oldRunner.refMu.Unlock()
 	}
 	s.loaded[req.model.ModelPath] = runner
@@ -498,6 +543,7 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 		}
 		runner.refCount++
 		runner.loading = false
+		close(runner.loaded)
 		go func() {
 			<-req.ctx.Done()
 			slog.Debug("context for request finished")
@@ -579,6 +625,22 @@ type runnerRef struct {
 	refMu    sync.Mutex
 	refCount uint // prevent unloading if > 0
 
+	// requests holds the cancel functions of requests in flight, which are
+	// called if the runner is unloaded with abort
+	requests map[*context.CancelCauseFunc]struct{}
+
+	// unloaded is closed by markUnloaded once the runner has been unloaded
+	// and its VRAM has been released
+	unloaded     chan struct{}
+	unloadedOnce sync.Once
+
+	// loaded is closed once the model has finished loading, which unlike
+	// loading can be checked without waiting for the load to finish
+	loaded chan struct{}
+
+	// loadStarted is when the model started loading
+	loadStarted time.Time
+
 	llama          llm.LlamaServer
 	pid            int
 	loading        bool                 // True only during initial load, then false forever
@@ -596,6 +658,39 @@ type runnerRef struct {
 	*api.Options
 }
 
+// track returns a context for a request using the runner, which is canceled
+// with cause errModelUnloaded if the runner is unloaded with abort while the
+// request is in flight.
+func (runner *runnerRef) track(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	runner.refMu.Lock()
+	defer runner.refMu.Unlock()
+	if runner.requests == nil {
+		runner.requests = make(map[*context.CancelCauseFunc]struct{})
+	}
+	runner.requests[&cancel] = struct{}{}
+
+	context.AfterFunc(ctx, func() {
+		runner.refMu.Lock()
+		defer runner.refMu.Unlock()
+		delete(runner.requests, &cancel)
+	})
+
+	return ctx
+}
+
+// markUnloaded closes unloaded, releasing those waiting for the runner to be
+// unloaded. It's called on every path that stops the runner, and more than
+// once if need be.
+func (runner *runnerRef) markUnloaded() {
+	runner.unloadedOnce.Do(func() {
+		if runner.unloaded != nil {
+			close(runner.unloaded)
+		}
+	})
+}
+
 // The refMu must already be held when calling unload
 func (runner *runnerRef) unload() {
 	if runner.expireTimer != nil {
@@ -758,7 +853,7 @@ func (a ByDurationAndName) Less(i, j int) bool {
 // The list of GPUs returned will always be the same brand (library)
 // If the model can not be fit fully within the available GPU(s) nil is returned
 // If numParallel is <= 0, this will attempt try to optimize parallelism based on available VRAM, and adjust
-// opts.NumCtx accordingly
+// opts.NumCtx accordingly. A requested numParallel that does not fit falls back to 1.
 func pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList, numParallel *int) discover.GpuInfoList {
 	var estimatedVRAM uint64
 
@@ -766,9 +861,12 @@ func pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuIn
 	if *numParallel <= 0 {
 		// If no specific parallel setting was provided, try larger then smaller, always end with 1
 		numParallelToTry = append(numParallelToTry, defaultParallel, 1)
+	} else if *numParallel > 1 {
+		numParallelToTry = []int{*numParallel, 1}
 	} else {
 		numParallelToTry = []int{*numParallel}
 	}
+	requested := *numParallel
 
 	for _, gl := range gpus.ByLibrary() {
 		var ok bool
@@ -786,6 +884,7 @@ func pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuIn
 				for _, g := range sgl {
 					if ok, estimatedVRAM = llm.PredictServerFit([]discover.GpuInfo{g}, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, p); ok {
 						slog.Info("new model will fit in available VRAM in single GPU, loading", "model", req.model.ModelPath, "gpu", g.ID, "parallel", p, "available", g.FreeMemory, "required", format.HumanBytes2(estimatedVRAM))
+						warnParallelFallback(req, requested, p)
 						*numParallel = p
 						return []discover.GpuInfo{g}
 					}
@@ -802,6 +901,7 @@ func pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuIn
 			req.opts.NumCtx = req.origNumCtx * p
 			if ok, estimatedVRAM = llm.PredictServerFit(sgl, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, p); ok {
 				slog.Info("new model will fit in available VRAM, loading", "model", req.model.ModelPath, "library", sgl[0].Library, "parallel", p, "required", format.HumanBytes2(estimatedVRAM))
+				warnParallelFallback(req, requested, p)
 				*numParallel = p
 				return sgl
 			}
@@ -810,6 +910,13 @@ func pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuIn
 	return nil
 }
 
+// warnParallelFallback logs when an explicitly requested parallelism p did not fit
+func warnParallelFallback(req *LlmRequest, requested, p int) {
+	if requested > 0 && p != requested {
+		slog.Warn("requested parallel requests do not fit in available VRAM, falling back", "model", req.model.ModelPath, "requested", requested, "parallel", p)
+	}
+}
+
 // If multiple Libraries are detected, pick the Library which loads the most layers for the model
 func pickBestPartialFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList, numParallel *int) discover.GpuInfoList {
 	if *numParallel <= 0 {
@@ -836,8 +943,12 @@ func pickBestPartialFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.Gp
 func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	s.loadedMu.Lock()
 	runnerList := make([]*runnerRef, 0, len(s.loaded))
-	for _, r := range s.loaded {
+	priorities := make(map[*runnerRef]int)
+	for path, r := range s.loaded {
 		runnerList = append(runnerList, r)
+		if priority, ok := s.preloaded[path]; ok {
+			priorities[r] = priority
+		}
 	}
 	s.loadedMu.Unlock()
 	if len(runnerList) == 0 {
@@ -848,6 +959,19 @@ func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	// In the future we can enhance the algorithm to be smarter about picking the optimal runner to unload
 	// e.g., if we have multiple options, will one make room for the request?
 	sort.Sort(ByDurationAndName(runnerList))
+	// preloaded models are only unloaded once no other model can be, those
+	// with the lowest priority first
+	slices.SortStableFunc(runnerList, func(a, b *runnerRef) int {
+		pa, aok := priorities[a]
+		pb, bok := priorities[b]
+		if aok != bok {
+			if aok {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Compare(pa, pb)
+	})
 
 	// First try to find a runner that's already idle
 	for _, runner := range runnerList {
@@ -864,6 +988,77 @@ func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	return runnerList[0]
 }
 
+// Preload loads models at startup, in order, and keeps them loaded. Models
+// that can't be found or loaded are skipped. It returns once every model has
+// been loaded or skipped, or ctx is done.
+func (s *Scheduler) Preload(ctx context.Context, models []envconfig.PreloadModel) {
+	for _, p := range models {
+		name := model.ParseName(p.Name)
+		if !name.IsValid() {
+			slog.Warn("skipping preload of invalid model name", "model", p.Name)
+			continue
+		}
+
+		m, err := GetModel(name.String())
+		if err != nil {
+			slog.Warn("skipping preload of model", "model", p.Name, "error", err)
+			continue
+		}
+
+		if err := s.preload(ctx, m, p.Priority); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			slog.Warn("failed to preload model", "model", p.Name, "error", err)
+			continue
+		}
+
+		slog.Info("preloaded model", "model", p.Name, "priority", p.Priority)
+	}
+}
+
+// preload loads m as a preloaded model with priority and waits until it is
+// ready. A model that is already loaded is kept loaded from then on.
+func (s *Scheduler) preload(ctx context.Context, m *Model, priority int) error {
+	opts, err := modelOptions(m, nil)
+	if err != nil {
+		return err
+	}
+
+	s.loadedMu.Lock()
+	s.preloaded[m.ModelPath] = priority
+	s.loadedMu.Unlock()
+
+	// the request only holds the runner until it is ready
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	successCh, errCh := s.GetRunner(ctx, m, opts, &api.Duration{Duration: -1})
+	select {
+	case <-successCh:
+		return nil
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// a model that failed to load isn't kept loaded if it's loaded later
+	s.loadedMu.Lock()
+	delete(s.preloaded, m.ModelPath)
+	s.loadedMu.Unlock()
+	return err
+}
+
+// preloadPriority returns the priority of the model at path and whether it is
+// preloaded
+func (s *Scheduler) preloadPriority(path string) (int, bool) {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	priority, ok := s.preloaded[path]
+	return priority, ok
+}
+
 func (s *Scheduler) unloadAllRunners() {
 	s.loadedMu.Lock()
 	defer s.loadedMu.Unlock()
@@ -872,12 +1067,17 @@ func (s *Scheduler) unloadAllRunners() {
 			slog.Debug("shutting down runner", "model", model)
 			runner.llama.Close()
 		}
+		runner.markUnloaded()
 	}
 }
 
+// expireRunner unloads model once its requests in flight are done. A model
+// unloaded this way is no longer preloaded, so it isn't kept loaded if it's
+// loaded again.
 func (s *Scheduler) expireRunner(model *Model) {
 	s.loadedMu.Lock()
 	runner, ok := s.loaded[model.ModelPath]
+	delete(s.preloaded, model.ModelPath)
 	s.loadedMu.Unlock()
 	if ok {
 		runner.refMu.Lock()
@@ -894,6 +1094,44 @@ func (s *Scheduler) expireRunner(model *Model) {
 	}
 }
 
+// loadedRunner returns the runner of the model if it is loaded or loading
+func (s *Scheduler) loadedRunner(model *Model) (*runnerRef, bool) {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	runner, ok := s.loaded[model.ModelPath]
+	return runner, ok
+}
+
+// unloadRunner unloads model and waits until its memory has been released. With
+// abort, requests in flight are canceled rather than allowed to complete
+// first. It returns errModelNotLoaded if the model is not loaded.
+func (s *Scheduler) unloadRunner(ctx context.Context, model *Model, abort bool) error {
+	s.loadedMu.Lock()
+	runner, ok := s.loaded[model.ModelPath]
+	s.loadedMu.Unlock()
+	if !ok {
+		return errModelNotLoaded
+	}
+
+	runner.refMu.Lock()
+	if abort {
+		for cancel := range runner.requests {
+			slog.Debug("aborting request to unload model", "runner", runner)
+			(*cancel)(errModelUnloaded)
+		}
+	}
+	runner.refMu.Unlock()
+
+	s.expireRunner(model)
+
+	select {
+	case <-runner.unloaded:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // If other runners are loaded, make sure the pending request will fit in system memory
 // If not, pick a runner to unload, else return nil and the request can be loaded
 func (s *Scheduler) maybeFindCPURunnerToUnload(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList) *runnerRef {
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"math"
 	"os"
 	"testing"
 	"time"
@@ -205,6 +206,29 @@ func TestRequestsSameModelSameRequest(t *testing.T) {
 	}
 }
 
+func TestRequestsNumParallel(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
+	a.req.opts.NumParallel = 3
+
+	s.newServerFn = a.newServer
+	s.pendingReqCh <- a.req
+	s.Run(ctx)
+	select {
+	case resp := <-a.req.successCh:
+		require.Equal(t, 3, resp.numParallel)
+		require.Equal(t, 3*a.req.origNumCtx, resp.Options.NumCtx)
+	case err := <-a.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+}
+
 func TestRequestsSimpleReloadSameModel(t *testing.T) {
 	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
 	defer done()
@@ -253,6 +277,61 @@ func TestRequestsSimpleReloadSameModel(t *testing.T) {
 	}
 }
 
+func TestRequestsReloadRunnerOptions(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
+	b := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
+	tmpModel := *a.req.model
+	b.req.model = &tmpModel
+	b.f = a.f
+
+	// the options each runner was started with
+	var loaded []api.Options
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+		loaded = append(loaded, opts)
+		if len(loaded) == 1 {
+			return a.srv, nil
+		}
+		return b.srv, nil
+	}
+
+	a.req.opts.NumThread = 4
+	s.pendingReqCh <- a.req
+	s.Run(ctx)
+	select {
+	case resp := <-a.req.successCh:
+		require.Equal(t, resp.llama, a.srv)
+	case err := <-a.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// changing the threads and batch size reloads the runner with them
+	b.req.opts.NumThread = 8
+	b.req.opts.NumBatch = 128
+	s.pendingReqCh <- b.req
+	time.Sleep(1 * time.Millisecond)
+	a.ctxDone()
+	select {
+	case resp := <-b.req.successCh:
+		require.Equal(t, resp.llama, b.srv)
+	case err := <-b.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	require.Len(t, loaded, 2)
+	require.Equal(t, 4, loaded[0].NumThread)
+	require.Equal(t, 8, loaded[1].NumThread)
+	require.Equal(t, 128, loaded[1].NumBatch)
+}
+
 func TestRequestsMultipleLoadedModels(t *testing.T) {
 	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
 	defer done()
@@ -449,6 +528,115 @@ func TestExpireRunner(t *testing.T) {
 	s.loadedMu.Unlock()
 }
 
+func TestUnloadRunner(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 5*time.Second)
+	defer done()
+	s := InitScheduler(ctx)
+	go s.processCompleted(ctx)
+
+	model := &Model{ModelPath: "foo"}
+	require.ErrorIs(t, s.unloadRunner(ctx, model, false), errModelNotLoaded)
+
+	// load starts a request on the model that finishes when reqCtx is done
+	load := func(t *testing.T, reqCtx context.Context) (*runnerRef, *mockLlm) {
+		t.Helper()
+		req := &LlmRequest{
+			ctx:             reqCtx,
+			model:           model,
+			opts:            api.DefaultOptions(),
+			successCh:       make(chan *runnerRef, 1),
+			errCh:           make(chan error, 1),
+			sessionDuration: &api.Duration{Duration: 2 * time.Minute},
+		}
+
+		server := &mockLlm{estimatedVRAMByGPU: map[string]uint64{}}
+		s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+			return server, nil
+		}
+		s.load(req, nil, discover.GpuInfoList{}, 0)
+
+		select {
+		case err := <-req.errCh:
+			t.Fatal(err)
+		case runner := <-req.successCh:
+			return runner, server
+		}
+		return nil, nil
+	}
+
+	t.Run("wait", func(t *testing.T) {
+		reqCtx, finish := context.WithCancel(ctx)
+		runner, server := load(t, reqCtx)
+		inflight := runner.track(reqCtx)
+
+		unloaded := make(chan error, 1)
+		go func() { unloaded <- s.unloadRunner(ctx, model, false) }()
+
+		select {
+		case err := <-unloaded:
+			t.Fatalf("unloaded with a request in flight: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		require.NoError(t, inflight.Err())
+		finish()
+		require.NoError(t, <-unloaded)
+		require.True(t, server.closeCalled)
+
+		s.loadedMu.Lock()
+		require.Empty(t, s.loaded)
+		s.loadedMu.Unlock()
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		reqCtx, finish := context.WithCancel(ctx)
+		defer finish()
+		runner, server := load(t, reqCtx)
+		inflight := runner.track(reqCtx)
+
+		// the handler returns once its request is aborted
+		go func() {
+			<-inflight.Done()
+			finish()
+		}()
+
+		require.NoError(t, s.unloadRunner(ctx, model, true))
+		require.ErrorIs(t, context.Cause(inflight), errModelUnloaded)
+		require.True(t, server.closeCalled)
+
+		s.loadedMu.Lock()
+		require.Empty(t, s.loaded)
+		s.loadedMu.Unlock()
+	})
+
+	t.Run("replaced", func(t *testing.T) {
+		reqCtx, finish := context.WithCancel(ctx)
+		defer finish()
+		runner, server := load(t, reqCtx)
+
+		// those waiting on a runner are released when it's replaced too,
+		// rather than only when it expires
+		waiting := make(chan struct{})
+		go func() {
+			<-runner.unloaded
+			close(waiting)
+		}()
+
+		newCtx, newFinish := context.WithCancel(ctx)
+		load(t, newCtx)
+		require.True(t, server.closeCalled)
+
+		select {
+		case <-waiting:
+		case <-time.After(time.Second):
+			t.Fatal("expected the replaced runner to be marked unloaded")
+		}
+
+		newFinish()
+		require.NoError(t, s.unloadRunner(ctx, model, false))
+	})
+}
+
 // TODO - add one scenario that triggers the bogus finished event with positive ref count
 func TestPrematureExpired(t *testing.T) {
 	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
@@ -609,6 +797,106 @@ func TestFindRunnerToUnload(t *testing.T) {
 	r2.refCount = 1
 	resp = s.findRunnerToUnload()
 	require.Equal(t, r1, resp)
+
+	// idle preloaded models are only unloaded once no other model can be,
+	// lowest priority first
+	r1.refCount, r2.refCount = 0, 0
+	r3 := &runnerRef{sessionDuration: 3, numParallel: 1}
+	s.loadedMu.Lock()
+	s.loaded["c"] = r3
+	s.preloaded["a"] = 2
+	s.preloaded["b"] = 1
+	s.loadedMu.Unlock()
+
+	require.Equal(t, r3, s.findRunnerToUnload())
+	r3.refCount = 1
+	require.Equal(t, r2, s.findRunnerToUnload())
+	r2.refCount = 1
+	require.Equal(t, r1, s.findRunnerToUnload())
+}
+
+func TestPreload(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, nil)
+	var loads int
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+		loads++
+		return a.newServer(gpus, model, f, adapters, projectors, opts, numParallel)
+	}
+	s.Run(ctx)
+
+	if err := s.preload(ctx, a.req.model, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// the model is ready before the first request
+	s.loadedMu.Lock()
+	runner := s.loaded[a.req.model.ModelPath]
+	s.loadedMu.Unlock()
+	require.NotNil(t, runner)
+	select {
+	case <-runner.loaded:
+	default:
+		t.Fatal("expected the preloaded model to have finished loading")
+	}
+
+	require.Equal(t, time.Duration(math.MaxInt64), runner.sessionDuration)
+	priority, ok := s.preloadPriority(a.req.model.ModelPath)
+	require.True(t, ok)
+	require.Equal(t, 5, priority)
+
+	opts, err := modelOptions(a.req.model, nil)
+	require.NoError(t, err)
+
+	successCh, errCh := s.GetRunner(a.ctx, a.req.model, opts, nil)
+	select {
+	case resp := <-successCh:
+		require.Equal(t, runner, resp)
+		require.Equal(t, 1, loads)
+	case err := <-errCh:
+		t.Fatal(err)
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+
+	// a request without a keep alive leaves the model loaded
+	a.ctxDone()
+	time.Sleep(20 * time.Millisecond)
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 1)
+	s.loadedMu.Unlock()
+
+	// unloading the model explicitly stops it being preloaded
+	require.NoError(t, s.unloadRunner(ctx, a.req.model, false))
+	_, ok = s.preloadPriority(a.req.model.ModelPath)
+	require.False(t, ok)
+}
+
+func TestPreloadFailure(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
+	defer done()
+
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, nil)
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+		return nil, errors.New("load failed")
+	}
+	s.Run(ctx)
+
+	require.ErrorContains(t, s.preload(ctx, a.req.model, 5), "load failed")
+
+	// the model isn't treated as preloaded once it loads some other way
+	_, ok := s.preloadPriority(a.req.model.ModelPath)
+	require.False(t, ok)
 }
 
 func TestNeedsReload(t *testing.T) {
@@ -644,6 +932,10 @@ func TestNeedsReload(t *testing.T) {
 	resp = runner.needsReload(ctx, req)
 	require.True(t, resp)
 	req.opts.NumBatch = runner.Options.NumBatch
+	req.opts.NumThread = 8
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
+	req.opts.NumThread = runner.Options.NumThread
 	llm.pingResp = errors.New("foo")
 	resp = runner.needsReload(ctx, req)
 	require.True(t, resp)
@@ -667,7 +959,7 @@ func TestUnloadAllRunners(t *testing.T) {
 	s := InitScheduler(ctx)
 	s.unloadAllRunners()
 
-	r1 := &runnerRef{llama: llm1, numParallel: 1}
+	r1 := &runnerRef{llama: llm1, numParallel: 1, unloaded: make(chan struct{})}
 	r2 := &runnerRef{llama: llm2, numParallel: 1}
 
 	s.loadedMu.Lock()
@@ -678,6 +970,12 @@ func TestUnloadAllRunners(t *testing.T) {
 
 	require.True(t, llm1.closeCalled)
 	require.True(t, llm2.closeCalled)
+
+	select {
+	case <-r1.unloaded:
+	default:
+		t.Fatal("expected the runner to be marked unloaded")
+	}
 }
 
 func TestUnload(t *testing.T) {
@@ -761,6 +1059,12 @@ type mockLlm struct {
 	estimatedVRAM      uint64
 	estimatedTotal     uint64
 	estimatedVRAMByGPU map[string]uint64
+	usageResp          llm.ServerUsage
+	usageRespErr       error
+	loadProgress       float32
+	trainCtx           int
+	saveSessionResp    []int
+	saveSessionRespErr error
 }
 
 func (s *mockLlm) Ping(ctx context.Context) error             { return s.pingResp }
@@ -769,7 +1073,7 @@ func (s *mockLlm) Completion(ctx context.Context, req llm.CompletionRequest, fn
 	return s.completionResp
 }
 
-func (s *mockLlm) Embedding(ctx context.Context, input string) ([]float32, error) {
+func (s *mockLlm) Embedding(ctx context.Context, input string, fn func(api.PromptEvalProgress)) ([]float32, error) {
 	return s.embeddingResp, s.embeddingRespErr
 }
 
@@ -777,6 +1081,10 @@ func (s *mockLlm) Tokenize(ctx context.Context, content string) ([]int, error) {
 	return s.tokenizeResp, s.tokenizeRespErr
 }
 
+func (s *mockLlm) PromptTokens(ctx context.Context, req llm.CompletionRequest) ([]int, error) {
+	return s.tokenizeResp, s.tokenizeRespErr
+}
+
 func (s *mockLlm) Detokenize(ctx context.Context, tokens []int) (string, error) {
 	return s.detokenizeResp, s.detonekizeRespErr
 }
@@ -789,3 +1097,67 @@ func (s *mockLlm) EstimatedVRAM() uint64                  { return s.estimatedVR
 func (s *mockLlm) EstimatedTotal() uint64                 { return s.estimatedTotal }
 func (s *mockLlm) EstimatedVRAMByGPU(gpuid string) uint64 { return s.estimatedVRAMByGPU[gpuid] }
 func (s *mockLlm) Pid() int                               { return -1 }
+func (s *mockLlm) LoadProgress() float32                  { return s.loadProgress }
+func (s *mockLlm) TrainContextLength() int                { return s.trainCtx }
+func (s *mockLlm) Usage(ctx context.Context) (llm.ServerUsage, error) {
+	return s.usageResp, s.usageRespErr
+}
+
+func (s *mockLlm) SaveSession(ctx context.Context, digest string, tokens []int, path string) ([]int, error) {
+	return s.saveSessionResp, s.saveSessionRespErr
+}
+
+func TestKeepAliveIdle(t *testing.T) {
+	cases := []struct {
+		name      string
+		keepAlive time.Duration
+		loaded    bool
+		want      time.Duration
+	}{
+		{"zero unloads", 0, false, 0},
+		{"negative keeps loaded", -1, true, time.Duration(math.MaxInt64)},
+		{"positive keeps loaded", time.Minute, true, time.Minute},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, done := context.WithTimeout(t.Context(), 20*time.Millisecond)
+			defer done()
+			s := InitScheduler(ctx)
+			req := &LlmRequest{
+				ctx:             ctx,
+				model:           &Model{ModelPath: "foo"},
+				opts:            api.DefaultOptions(),
+				successCh:       make(chan *runnerRef, 1),
+				errCh:           make(chan error, 1),
+				sessionDuration: &api.Duration{Duration: tt.keepAlive},
+			}
+
+			server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
+			s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+				return server, nil
+			}
+			s.load(req, nil, discover.GpuInfoList{}, 0)
+
+			select {
+			case err := <-req.errCh:
+				t.Fatalf("expected no errors when loading, got '%s'", err.Error())
+			case <-req.successCh:
+			}
+
+			s.finishedReqCh <- req
+			s.processCompleted(ctx)
+
+			s.loadedMu.Lock()
+			defer s.loadedMu.Unlock()
+			if !tt.loaded {
+				require.Empty(t, s.loaded)
+				return
+			}
+
+			require.Len(t, s.loaded, 1)
+			require.Equal(t, tt.want, s.loaded["foo"].sessionDuration)
+			require.NotNil(t, s.loaded["foo"].expireTimer)
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/publicnet"
+)
+
+const webhookAttempts = 3
+
+// webhookTimeout is how long each attempt to post a webhook can take
+var webhookTimeout = 10 * time.Second
+
+var errInvalidWebhook = errors.New("webhook must be an absolute http or https URL")
+
+func validateWebhook(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errInvalidWebhook
+	}
+
+	return nil
+}
+
+// webhookTransport connects only to public addresses, so that a client can't
+// have the server post to its own network, unless OLLAMA_PRIVATE_WEBHOOKS
+// is set
+func webhookTransport() http.RoundTripper {
+	if envconfig.PrivateWebhooks() {
+		return http.DefaultTransport
+	}
+
+	return &http.Transport{
+		DialContext: publicnet.Dialer(webhookTimeout, func(addr netip.AddrPort) bool {
+			return publicnet.Addr(addr.Addr())
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+	}
+}
+
+// postWebhook posts payload as JSON to the webhook URL. Requests that fail,
+// time out or get a 5xx or 429 response are retried, but not those refused
+// for resolving to a non-public address.
+func postWebhook(ctx context.Context, webhook string, payload any) error {
+	bts, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{
+		Timeout:   webhookTimeout,
+		Transport: webhookTransport(),
+		// redirects could point the request somewhere other than the caller asked
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	backoff := newBackoff(5 * time.Second)
+	for try := range webhookAttempts {
+		if try > 0 {
+			slog.Info("webhook failed, retrying", "attempt", try, "error", err)
+			if err := backoff(ctx); err != nil {
+				return err
+			}
+		}
+
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(bts))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if errors.Is(err, publicnet.ErrNotPublic) {
+			return err
+		} else if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode >= http.StatusInternalServerError, resp.StatusCode == http.StatusTooManyRequests:
+			err = fmt.Errorf("webhook returned %s", resp.Status)
+			continue
+		case resp.StatusCode >= http.StatusMultipleChoices:
+			return fmt.Errorf("webhook returned %s", resp.Status)
+		}
+
+		return nil
+	}
+
+	return err
+}
+
+// notifyPull posts the outcome of pulling model to the webhook
+func notifyPull(ctx context.Context, webhook, model string, pullErr error) {
+	payload := api.PullWebhook{Model: model, Status: "success"}
+	if pullErr != nil {
+		payload.Status = "error"
+		payload.Error = pullErr.Error()
+	}
+
+	if err := postWebhook(ctx, webhook, payload); err != nil {
+		slog.Warn("pull webhook failed", "model", model, "error", err)
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/publicnet"
+)
+
+func TestPostWebhook(t *testing.T) {
+	// the test servers listen on loopback
+	t.Setenv("OLLAMA_PRIVATE_WEBHOOKS", "1")
+
+	cases := []struct {
+		name     string
+		statuses []int
+		attempts int32
+		err      bool
+	}{
+		{name: "success", statuses: []int{http.StatusOK}, attempts: 1},
+		{name: "retried", statuses: []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusNoContent}, attempts: 3},
+		{name: "client error", statuses: []int{http.StatusBadRequest}, attempts: 1, err: true},
+		{name: "redirect", statuses: []int{http.StatusFound}, attempts: 1, err: true},
+		{name: "retries exhausted", statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusOK}, attempts: 3, err: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := attempts.Add(1)
+
+				var payload api.PullWebhook
+				if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Model != "test" {
+					t.Errorf("unexpected payload %v: %v", payload, err)
+				}
+
+				if tt.statuses[n-1] == http.StatusFound {
+					w.Header().Set("Location", "/elsewhere")
+				}
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer srv.Close()
+
+			err := postWebhook(t.Context(), srv.URL, api.PullWebhook{Model: "test", Status: "success"})
+			if tt.err != (err != nil) {
+				t.Errorf("expected error %t, got %v", tt.err, err)
+			}
+
+			if got := attempts.Load(); got != tt.attempts {
+				t.Errorf("expected %d attempts, got %d", tt.attempts, got)
+			}
+		})
+	}
+
+	t.Run("non-public address", func(t *testing.T) {
+		t.Setenv("OLLAMA_PRIVATE_WEBHOOKS", "")
+
+		var attempts atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+		}))
+		defer srv.Close()
+
+		// refused connections aren't retried
+		err := postWebhook(t.Context(), srv.URL, api.PullWebhook{Model: "test", Status: "success"})
+		if !errors.Is(err, publicnet.ErrNotPublic) {
+			t.Errorf("expected %v, got %v", publicnet.ErrNotPublic, err)
+		}
+
+		if got := attempts.Load(); got != 0 {
+			t.Errorf("expected no attempts to reach the server, got %d", got)
+		}
+	})
+}
+
+func TestPullWebhook(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_PRIVATE_WEBHOOKS", "1")
+
+	registry := httptest.NewServer(http.NotFoundHandler())
+	defer registry.Close()
+
+	testMakeRequestDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", registry.Listener.Addr().String())
+	}
+	t.Cleanup(func() { testMakeRequestDialContext = nil })
+
+	payloads := make(chan api.PullWebhook, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload api.PullWebhook
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		payloads <- payload
+	}))
+	defer webhook.Close()
+
+	var s Server
+
+	t.Run("invalid", func(t *testing.T) {
+		w := createRequest(t, s.PullHandler, api.PullRequest{Model: "test", Webhook: "file:///etc/passwd"})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code 400, actual %d", w.Code)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		stream := false
+		w := createRequest(t, s.PullHandler, api.PullRequest{
+			Model:    "registry.test/library/missing",
+			Insecure: true,
+			Stream:   &stream,
+			Webhook:  webhook.URL,
+		})
+
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("expected status code 202, actual %d", w.Code)
+		}
+
+		select {
+		case payload := <-payloads:
+			if payload.Model != "registry.test/library/missing:latest" || payload.Status != "error" || payload.Error == "" {
+				t.Errorf("unexpected payload %+v", payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for webhook")
+		}
+	})
+}
@@ -0,0 +1,65 @@
+// Package sse writes server-sent events, the text/event-stream format read
+// by a browser's EventSource.
+package sse
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the media type of a stream of server-sent events.
+const ContentType = "text/event-stream"
+
+// done is the data of the event that ends a stream.
+const done = "[DONE]"
+
+// Write writes data as an event. Each line of data is sent in a field of
+// its own, so that data with newlines arrives intact, and the event is
+// written at once so that it is never split by a flush.
+func Write(w io.Writer, data []byte) error {
+	var b bytes.Buffer
+	for line := range bytes.Lines(data) {
+		b.WriteString("data: ")
+		b.Write(bytes.TrimSuffix(line, []byte("\n")))
+		b.WriteByte('\n')
+	}
+
+	if b.Len() == 0 {
+		b.WriteString("data: \n")
+	}
+
+	b.WriteByte('\n')
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// WriteDone writes the event that ends a stream, whose data is [DONE], so
+// that clients can tell a finished stream from a dropped connection.
+func WriteDone(w io.Writer) error {
+	return Write(w, []byte(done))
+}
+
+// Accepts reports whether the Accept header of a request asks for server-sent
+// events. Wildcards don't count, since clients that accept anything expect the
+// format they'd get without asking.
+func Accepts(accept string) bool {
+	for part := range strings.SplitSeq(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil || mediaType != ContentType {
+			continue
+		}
+
+		q, ok := params["q"]
+		if !ok {
+			return true
+		}
+
+		quality, err := strconv.ParseFloat(q, 64)
+		return err == nil && quality > 0
+	}
+
+	return false
+}
@@ -0,0 +1,64 @@
+package sse
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"json", `{"response":"hi"}`, "data: {\"response\":\"hi\"}\n\n"},
+		{"multiline", "a\nb\n\nc", "data: a\ndata: b\ndata: \ndata: c\n\n"},
+		{"trailing newline", "a\n", "data: a\n\n"},
+		{"empty", "", "data: \n\n"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := Write(&b, []byte(tt.data)); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := b.String(); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWriteDone(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteDone(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := b.String(), "data: [DONE]\n\n"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	cases := map[string]bool{
+		"":                                    false,
+		"*/*":                                 false,
+		"text/*":                              false,
+		"application/json":                    false,
+		"text/event-stream":                   true,
+		"Text/Event-Stream":                   true,
+		"application/json, text/event-stream": true,
+		"text/event-stream; charset=utf-8":    true,
+		"text/event-stream;q=0.5":             true,
+		"text/event-stream;q=0":               false,
+	}
+
+	for header, want := range cases {
+		if got := Accepts(header); got != want {
+			t.Errorf("%q: expected %v, got %v", header, want, got)
+		}
+	}
+}
@@ -172,6 +172,10 @@ type Values struct {
 	// implicitly false). Templates can't see whether `Think` is nil
 	IsThinkSet bool
 
+	// Prefill renders a trailing assistant message as the beginning of the
+	// response instead of a completed turn, so the prompt ends with its content
+	Prefill bool
+
 	// forceLegacy is a flag used to test compatibility with legacy templates
 	forceLegacy bool
 }
@@ -233,14 +237,20 @@ func (t *Template) Execute(w io.Writer, v Values) error {
 			"IsThinkSet": v.IsThinkSet,
 		})
 	} else if !v.forceLegacy && slices.Contains(t.Vars(), "messages") {
-		return t.Template.Execute(w, map[string]any{
+		vars := map[string]any{
 			"System":     system,
 			"Messages":   messages,
 			"Tools":      v.Tools,
 			"Response":   "",
 			"Think":      v.Think,
 			"IsThinkSet": v.IsThinkSet,
-		})
+		}
+
+		if v.Prefill && len(messages) > 0 && messages[len(messages)-1].Role == "assistant" {
+			return t.executePrefill(w, vars, messages[len(messages)-1])
+		}
+
+		return t.Template.Execute(w, vars)
 	}
 
 	system = ""
@@ -309,7 +319,36 @@ func (t *Template) Execute(w io.Writer, v Values) error {
 	return err
 }
 
-// collate messages based on role. consecutive messages of the same role are merged
+// prefillMarker stands in for the content of the message being prefilled. It
+// cannot appear in message content since it is not valid UTF-8.
+const prefillMarker = "\xff\xfeprefill\xfe\xff"
+
+// executePrefill renders the template with last as a partial assistant
+// message. Templates render every message as a completed turn, so last is
+// rendered with a marker in place of its content and the output is cut where
+// the marker ends, dropping the end of turn and anything after it.
+func (t *Template) executePrefill(w io.Writer, vars map[string]any, last *api.Message) error {
+	content := last.Content
+	last.Content = prefillMarker
+
+	var b bytes.Buffer
+	if err := t.Template.Execute(&b, vars); err != nil {
+		return err
+	}
+
+	prompt, _, ok := strings.Cut(b.String(), prefillMarker)
+	if !ok {
+		// the template does not render the message content so there is
+		// nothing to continue from
+		last.Content = content
+		return t.Template.Execute(w, vars)
+	}
+
+	_, err := io.WriteString(w, prompt+content)
+	return err
+}
+
+// collate messages based on role. consecutive messages of the same role and name are merged
 // into a single message. collate also collects and returns all system messages.
 // collate mutates message content adding image tags ([img-%d]) as needed
 func collate(msgs []api.Message) (string, []*api.Message) {
@@ -321,7 +360,7 @@ func collate(msgs []api.Message) (string, []*api.Message) {
 			system = append(system, msg.Content)
 		}
 
-		if len(collated) > 0 && collated[len(collated)-1].Role == msg.Role {
+		if len(collated) > 0 && collated[len(collated)-1].Role == msg.Role && collated[len(collated)-1].Name == msg.Name {
 			collated[len(collated)-1].Content += "\n\n" + msg.Content
 		} else {
 			collated = append(collated, &msg)
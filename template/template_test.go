@@ -315,6 +315,38 @@ Hello human!<|im_end|>
 <|im_start|>user
 What is your name?<|im_end|>
 <|im_start|>assistant
+`,
+		},
+		{
+			"chatml names",
+			[]template{
+				{"messages", `
+{{- range $index, $_ := .Messages }}<|im_start|>{{ .Role }}{{ if .Name }} name={{ .Name }}{{ end }}
+{{ .Content }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`},
+			},
+			Values{
+				Messages: []api.Message{
+					{Role: "user", Name: "alice", Content: "Hello!"},
+					// consecutive messages are only merged when they have the same name
+					{Role: "user", Name: "bob", Content: "Hi everyone."},
+					{Role: "user", Name: "bob", Content: "What should we eat?"},
+					{Role: "assistant", Content: "How about pizza?"},
+					{Role: "user", Name: "alice", Content: "Sounds good."},
+				},
+			},
+			`<|im_start|>user name=alice
+Hello!<|im_end|>
+<|im_start|>user name=bob
+Hi everyone.
+
+What should we eat?<|im_end|>
+<|im_start|>assistant
+How about pizza?<|im_end|>
+<|im_start|>user name=alice
+Sounds good.<|im_end|>
+<|im_start|>assistant
 `,
 		},
 	}
@@ -342,6 +374,97 @@ What is your name?<|im_end|>
 	}
 }
 
+func TestExecuteWithPrefill(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		prefill  bool
+		expected string
+	}{
+		{
+			"llama",
+			`{{- range .Messages }}<|start_header_id|>{{ .Role }}<|end_header_id|>
+
+{{ .Content }}<|eot_id|>
+{{- end }}<|start_header_id|>assistant<|end_header_id|>
+
+`,
+			true,
+			`<|start_header_id|>user<|end_header_id|>
+
+What is your name?<|eot_id|><|start_header_id|>assistant<|end_header_id|>
+
+My name is`,
+		},
+		{
+			"llama without prefill",
+			`{{- range .Messages }}<|start_header_id|>{{ .Role }}<|end_header_id|>
+
+{{ .Content }}<|eot_id|>
+{{- end }}<|start_header_id|>assistant<|end_header_id|>
+
+`,
+			false,
+			`<|start_header_id|>user<|end_header_id|>
+
+What is your name?<|eot_id|><|start_header_id|>assistant<|end_header_id|>
+
+My name is<|eot_id|><|start_header_id|>assistant<|end_header_id|>
+
+`,
+		},
+		{
+			"chatml",
+			`{{- range .Messages }}<|im_start|>{{ .Role }}
+{{ .Content }}<|im_end|>
+{{ end }}<|im_start|>assistant
+`,
+			true,
+			`<|im_start|>user
+What is your name?<|im_end|>
+<|im_start|>assistant
+My name is`,
+		},
+		{
+			"chatml with last",
+			`{{- range $i, $_ := .Messages }}
+{{- $last := eq (len (slice $.Messages $i)) 1 }}<|im_start|>{{ .Role }}
+{{ .Content }}{{ if not (and $last (eq .Role "assistant")) }}<|im_end|>
+{{ end }}
+{{- end }}`,
+			true,
+			`<|im_start|>user
+What is your name?<|im_end|>
+<|im_start|>assistant
+My name is`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, Values{
+				Messages: []api.Message{
+					{Role: "user", Content: "What is your name?"},
+					{Role: "assistant", Content: "My name is"},
+				},
+				Prefill: tt.prefill,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(b.String(), tt.expected); diff != "" {
+				t.Errorf("mismatch (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestExecuteWithSuffix(t *testing.T) {
 	tmpl, err := Parse(`{{- if .Suffix }}<PRE> {{ .Prompt }} <SUF>{{ .Suffix }} <MID>
 {{- else }}{{ .Prompt }}
@@ -0,0 +1,82 @@
+package tools
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// Validate checks the arguments of a tool call against the parameters its
+// tool declares. Required arguments must be present, and declared arguments
+// must have one of their types and, if the parameter has an enum, one of its
+// values. Arguments the tool doesn't declare are allowed.
+func Validate(tools []api.Tool, call api.ToolCall) error {
+	i := slices.IndexFunc(tools, func(t api.Tool) bool { return t.Function.Name == call.Function.Name })
+	if i < 0 {
+		return fmt.Errorf("tool %q is not defined", call.Function.Name)
+	}
+
+	params := tools[i].Function.Parameters
+	for _, name := range params.Required {
+		if _, ok := call.Function.Arguments[name]; !ok {
+			return fmt.Errorf("missing required argument %q", name)
+		}
+	}
+
+	names := make([]string, 0, len(call.Function.Arguments))
+	for name := range call.Function.Arguments {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		prop, ok := params.Properties[name]
+		if !ok {
+			continue
+		}
+
+		v := call.Function.Arguments[name]
+		if len(prop.Type) > 0 && !slices.ContainsFunc(prop.Type, func(typ string) bool { return hasType(v, typ) }) {
+			return fmt.Errorf("argument %q must be of type %s, got %T", name, strings.Join(prop.Type, " or "), v)
+		}
+
+		if len(prop.Enum) > 0 && !slices.ContainsFunc(prop.Enum, func(e any) bool { return reflect.DeepEqual(e, v) }) {
+			return fmt.Errorf("argument %q must be one of %v, got %v", name, prop.Enum, v)
+		}
+	}
+
+	return nil
+}
+
+// hasType reports whether v, decoded from JSON, is of the JSON schema type.
+// Unknown types match anything.
+func hasType(v any, typ string) bool {
+	switch typ {
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "null":
+		return v == nil
+	default:
+		return true
+	}
+}
@@ -0,0 +1,62 @@
+package tools
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestValidate(t *testing.T) {
+	var tools []api.Tool
+	if err := json.Unmarshal([]byte(`[{
+		"type": "function",
+		"function": {
+			"name": "get_weather",
+			"parameters": {
+				"type": "object",
+				"required": ["location"],
+				"properties": {
+					"location": {"type": "string"},
+					"days": {"type": "integer"},
+					"unit": {"type": "string", "enum": ["celsius", "fahrenheit"]},
+					"detail": {"type": ["boolean", "null"]}
+				}
+			}
+		}
+	}]`), &tools); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		call string
+		err  string
+	}{
+		{name: "valid", call: `{"name": "get_weather", "arguments": {"location": "Paris", "days": 3, "unit": "celsius", "detail": null}}`},
+		{name: "undeclared argument", call: `{"name": "get_weather", "arguments": {"location": "Paris", "country": "France"}}`},
+		{name: "either type", call: `{"name": "get_weather", "arguments": {"location": "Paris", "detail": true}}`},
+		{name: "undefined tool", call: `{"name": "get_time", "arguments": {}}`, err: `tool "get_time" is not defined`},
+		{name: "missing required", call: `{"name": "get_weather", "arguments": {"days": 3}}`, err: `missing required argument "location"`},
+		{name: "wrong type", call: `{"name": "get_weather", "arguments": {"location": 75001}}`, err: `argument "location" must be of type string, got float64`},
+		{name: "fractional integer", call: `{"name": "get_weather", "arguments": {"location": "Paris", "days": 1.5}}`, err: `argument "days" must be of type integer, got float64`},
+		{name: "neither type", call: `{"name": "get_weather", "arguments": {"location": "Paris", "detail": "yes"}}`, err: `argument "detail" must be of type boolean or null, got string`},
+		{name: "not in enum", call: `{"name": "get_weather", "arguments": {"location": "Paris", "unit": "kelvin"}}`, err: `argument "unit" must be one of [celsius fahrenheit], got kelvin`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var call api.ToolCall
+			if err := json.Unmarshal([]byte(tt.call), &call.Function); err != nil {
+				t.Fatal(err)
+			}
+
+			err := Validate(tools, call)
+			if tt.err == "" && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Errorf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}